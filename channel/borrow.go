@@ -0,0 +1,144 @@
+package channel
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// A BorrowedPacket is a Packet whose data has not been copied out of the buffer
+// into which it was read from the network connection. The data is only valid
+// until Release is called, after which the buffer is re-used for reading other
+// messages. Receivers that need to keep the data for longer must copy it.
+type BorrowedPacket struct {
+	wire.Packet
+
+	buf      *borrowedBuffer
+	released uint32
+}
+
+// Release the buffer of the BorrowedPacket. The Packet must not be used after
+// it has been released. Releasing a BorrowedPacket more than once does
+// nothing.
+func (packet *BorrowedPacket) Release() {
+	if atomic.CompareAndSwapUint32(&packet.released, 0, 1) {
+		packet.buf.release()
+	}
+}
+
+// borrowedBuffer is a reference-counted buffer that is returned to its pool
+// once all references have been released.
+type borrowedBuffer struct {
+	b    []byte
+	refs int32
+	pool *sync.Pool
+}
+
+func (buf *borrowedBuffer) release() {
+	if atomic.AddInt32(&buf.refs, -1) == 0 {
+		buf.pool.Put(buf)
+	}
+}
+
+type borrowedReceiver struct {
+	ctx context.Context
+	f   func(id.Signatory, *BorrowedPacket) error
+}
+
+// borrowers are the receivers of BorrowedPackets that have been registered with
+// a Client. Channels that are bound by the Client lend the buffers into which
+// they read messages to these receivers, instead of copying the data of each
+// message.
+type borrowers struct {
+	mu        *sync.RWMutex
+	receivers []borrowedReceiver
+
+	pool *sync.Pool
+
+	// exclusive returns true if there are no other receivers, in which case
+	// messages are not copied for them.
+	exclusive func() bool
+	// kill the Channel to a remote peer, because a receiver returned an
+	// error.
+	kill func(id.Signatory, error)
+}
+
+func newBorrowers(size int, exclusive func() bool, kill func(id.Signatory, error)) *borrowers {
+	b := &borrowers{
+		mu:        new(sync.RWMutex),
+		exclusive: exclusive,
+		kill:      kill,
+	}
+	b.pool = &sync.Pool{
+		New: func() interface{} {
+			return &borrowedBuffer{b: make([]byte, size), pool: b.pool}
+		},
+	}
+	return b
+}
+
+// add a receiver.
+func (b *borrowers) add(ctx context.Context, f func(id.Signatory, *BorrowedPacket) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.receivers = append(b.receivers, borrowedReceiver{ctx: ctx, f: f})
+}
+
+// active returns true if there are receivers.
+func (b *borrowers) active() bool {
+	b.mu.RLock()
+	n, done := len(b.receivers), 0
+	for _, receiver := range b.receivers {
+		if receiver.ctx.Err() != nil {
+			done++
+		}
+	}
+	b.mu.RUnlock()
+	if done == 0 {
+		return n > 0
+	}
+
+	// Forget about receivers whose context is done. A new slice is used, so
+	// that receivers being lent packets are not modified.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	receivers := make([]borrowedReceiver, 0, len(b.receivers))
+	for _, receiver := range b.receivers {
+		if receiver.ctx.Err() == nil {
+			receivers = append(receivers, receiver)
+		}
+	}
+	b.receivers = receivers
+	return len(b.receivers) > 0
+}
+
+// get a buffer from the pool. The caller holds the only reference.
+func (b *borrowers) get() *borrowedBuffer {
+	buf := b.pool.Get().(*borrowedBuffer)
+	buf.refs = 1
+	return buf
+}
+
+// lend the packet, whose data refers to the buffer, to all receivers. The
+// receivers are called synchronously, and each one holds a reference to the
+// buffer until it releases its BorrowedPacket.
+func (b *borrowers) lend(from id.Signatory, packet wire.Packet, buf *borrowedBuffer) {
+	b.mu.RLock()
+	receivers := b.receivers
+	b.mu.RUnlock()
+
+	for _, receiver := range receivers {
+		if receiver.ctx.Err() != nil {
+			continue
+		}
+		atomic.AddInt32(&buf.refs, 1)
+		if err := receiver.f(from, &BorrowedPacket{Packet: packet, buf: buf}); err != nil {
+			b.kill(from, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package channel
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// A CallError is returned by Call when the remote peer responds with an error.
+type CallError struct {
+	Remote id.Signatory
+	Reason string
+}
+
+// Error implements the error interface.
+func (err CallError) Error() string {
+	return fmt.Sprintf("calling %v: %v", err.Remote, err.Reason)
+}
+
+// A CallHandler handles a Req received from a remote peer, and returns the
+// data of the Resp. If an error is returned, it is sent to the remote peer
+// instead (see CallError), and the Channel to the remote peer is not killed.
+type CallHandler func(from id.Signatory, req wire.Req) ([]byte, error)
+
+// callKey identifies a call by the remote peer that must respond, and the ID
+// of the Req, so that remote peers cannot respond to calls made to others.
+type callKey struct {
+	remote id.Signatory
+	id     uint64
+}
+
+// calls that are waiting for a Resp.
+type calls struct {
+	mu      *sync.Mutex
+	next    uint64
+	pending map[callKey]chan wire.Resp
+}
+
+func newCalls() *calls {
+	return &calls{
+		mu:      new(sync.Mutex),
+		next:    0,
+		pending: map[callKey]chan wire.Resp{},
+	}
+}
+
+// add a call to a remote peer, and return the ID of its Req, and the channel
+// to which its Resp is written.
+func (calls *calls) add(remote id.Signatory) (uint64, chan wire.Resp) {
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+
+	calls.next++
+	resp := make(chan wire.Resp, 1)
+	calls.pending[callKey{remote: remote, id: calls.next}] = resp
+	return calls.next, resp
+}
+
+func (calls *calls) remove(remote id.Signatory, id uint64) {
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+
+	delete(calls.pending, callKey{remote: remote, id: id})
+}
+
+// resolve the call that is waiting for a Resp. It returns false if no call is
+// waiting for it (for example, because the call has already returned).
+func (calls *calls) resolve(remote id.Signatory, resp wire.Resp) bool {
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+
+	key := callKey{remote: remote, id: resp.ID}
+	ch, ok := calls.pending[key]
+	if ok {
+		delete(calls.pending, key)
+		ch <- resp
+	}
+	return ok
+}
+
+// Call sends a Req to a remote peer, and waits for its Resp, or for the
+// context to be done. The ID of the Req is chosen by the Client, so that it can
+// be matched with its Resp. Responses are never passed to receivers. If the
+// remote peer responds with an error, a CallError is returned. The remote peer
+// must handle calls (see HandleCalls).
+func (client *Client) Call(ctx context.Context, remote id.Signatory, req wire.Req) (wire.Resp, error) {
+	return client.CallWith(ctx, remote, req, client.Send)
+}
+
+// CallWith is the same as Call, except that the Req is sent using the send
+// function (for example, the Send method of a Transport, so that the remote
+// peer is dialed if it is not connected).
+func (client *Client) CallWith(ctx context.Context, remote id.Signatory, req wire.Req, send func(context.Context, id.Signatory, wire.Msg) error) (wire.Resp, error) {
+	callID, respCh := client.calls.add(remote)
+	defer client.calls.remove(remote, callID)
+
+	req.ID = callID
+	msg, err := req.Msg()
+	if err != nil {
+		return wire.Resp{}, fmt.Errorf("calling %v: %v", remote, err)
+	}
+	if err := send(ctx, remote, msg); err != nil {
+		return wire.Resp{}, fmt.Errorf("calling %v: %w", remote, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return wire.Resp{}, fmt.Errorf("calling %v: %w", remote, ctx.Err())
+	case resp := <-respCh:
+		if resp.Error != "" {
+			return resp, CallError{Remote: remote, Reason: resp.Error}
+		}
+		return resp, nil
+	}
+}
+
+// HandleCalls registers a CallHandler for the Reqs sent by remote peers (see
+// Call). It is a Responder, so Reqs from the same remote peer can be handled
+// concurrently (see Respond).
+func (client *Client) HandleCalls(ctx context.Context, f CallHandler) {
+	client.Respond(ctx, func(from id.Signatory, packet wire.Packet) ([]wire.Msg, error) {
+		if packet.Msg.Type != wire.MsgTypeReq {
+			return nil, nil
+		}
+		req := wire.Req{}
+		if _, _, err := req.Unmarshal(packet.Msg.Data, len(packet.Msg.Data)); err != nil {
+			return nil, fmt.Errorf("unmarshal req: %v", err)
+		}
+		resp := wire.Resp{ID: req.ID}
+		data, err := f(from, req)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Data = data
+		}
+		msg, err := resp.Msg()
+		if err != nil {
+			return nil, fmt.Errorf("marshal resp: %v", err)
+		}
+		return []wire.Msg{msg}, nil
+	})
+}
+
+// receiveResp passes a MsgTypeResp message from a remote peer to the call that
+// is waiting for it. Responses that no call is waiting for are dropped.
+func (client *Client) receiveResp(remote id.Signatory, msg wire.Msg) {
+	resp := wire.Resp{}
+	if _, _, err := resp.Unmarshal(msg.Data, len(msg.Data)); err != nil {
+		client.opts.Logger.Debug("unmarshal resp", zap.String("remote", remote.String()), zap.Error(err))
+		return
+	}
+	if !client.calls.resolve(remote, resp) {
+		client.opts.Logger.Debug("unexpected resp", zap.String("remote", remote.String()), zap.Uint64("id", resp.ID))
+	}
+}
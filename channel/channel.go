@@ -3,10 +3,13 @@ package channel
 import (
 	"bufio"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -35,6 +38,14 @@ type reader struct {
 	io.Reader
 	codec.Decoder
 
+	// timed is the reader wrapped by the buffered reader when timings are
+	// being observed, otherwise it is nil.
+	timed *timedReader
+
+	// contentType is the wire.ContentType of the last message read from the
+	// network connection. It is shared with the writer.
+	contentType *uint32
+
 	// q is a quit channel that is closed by the Channel when the reader is no
 	// longer being used. This happens when the network connection faults, or is
 	// replaced by a new network connection.
@@ -49,6 +60,19 @@ type writer struct {
 	*bufio.Writer
 	codec.Encoder
 
+	// out is the writer wrapped by the buffered writer. It is the network
+	// connection, unless timings are being observed, in which case it is
+	// timed.
+	out   io.Writer
+	timed *timedWriter
+
+	// rekey is the state of the key rotation of the encoder.
+	rekey *rekeyState
+
+	// contentType is the wire.ContentType used to write messages. It is
+	// shared with the reader.
+	contentType *uint32
+
 	// q is a quit channel that is closed by the Channel when the writer is no
 	// longer being used. This happens when the network connection faults, or is
 	// replaced by a new network connection.
@@ -72,7 +96,7 @@ type writer struct {
 //
 //	// Make some messaging channels that we can use to interact with our
 //	// networking Channel.
-//	inbound, outbound := make(chan wire.Msg, 1), make(chan wire.Msg)
+//	inbound, outbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
 //	// Create a networking Channel that will read from the inbound messaging
 //	// channel.
 //	ch := channel.New(remote, inbound, outbound)
@@ -81,8 +105,8 @@ type writer struct {
 //	go ch.Run(ctx)
 //	// Read inbound messages that have been sent by the remote peer and echo
 //	// them back to the remote peer.
-//	for Msg := range inbound {
-//		outbound <- Msg
+//	for packet := range inbound {
+//		outbound <- channel.Envelope{Msg: packet.Msg}
 //	}
 //	// Attach a network connection to the remote peer.
 //	// ...
@@ -99,12 +123,22 @@ type Channel struct {
 	remote id.Signatory
 
 	inbound  chan<- wire.Packet
-	outbound <-chan wire.Msg
+	outbound <-chan Envelope
+	urgent   <-chan Envelope
 
 	readers chan reader
 	writers chan writer
+	flushes chan chan struct{}
+
+	connMu *sync.Mutex
+	conn   *connStats
+
+	// received remembers the nonces of recently received messages, so that
+	// messages that are written more than once are only received once.
+	received *recentNonces
 
-	rateLimiter *rate.Limiter
+	rateLimiter    *rate.Limiter
+	msgRateLimiter *rate.Limiter
 }
 
 // New returns an abstract Channel connection to a remote peer. It will have no
@@ -118,18 +152,36 @@ type Channel struct {
 // outbound messaging channel, but there is no functional attached network
 // connection, or when messages are being received on an attached network
 // connection, but the inbound message channel is not being drained.
-func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound <-chan wire.Msg) *Channel {
+func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound <-chan Envelope) *Channel {
+	return NewWithUrgent(opts, remote, inbound, outbound, nil)
+}
+
+// NewWithUrgent returns an abstract Channel connection to a remote peer that
+// has an additional urgent outbound messaging channel. Whenever the Channel is
+// about to write a message, it will write messages from the urgent outbound
+// messaging channel before messages from the outbound messaging channel. This
+// allows urgent messages (such as consensus votes) to skip ahead of bulk
+// messages (such as synchronisation data).
+func NewWithUrgent(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound, urgent <-chan Envelope) *Channel {
 	return &Channel{
 		opts:   opts,
 		remote: remote,
 
 		inbound:  inbound,
 		outbound: outbound,
+		urgent:   urgent,
 
 		readers: make(chan reader, 1),
 		writers: make(chan writer, 1),
+		flushes: make(chan chan struct{}),
+
+		connMu: new(sync.Mutex),
+		conn:   nil,
+
+		received: newRecentNonces(),
 
-		rateLimiter: rate.NewLimiter(opts.RateLimit, opts.MaxMessageSize),
+		rateLimiter:    rate.NewLimiter(opts.RateLimit, opts.MaxMessageSize),
+		msgRateLimiter: rate.NewLimiter(opts.MessageRateLimit, opts.MessageBurst),
 	}
 }
 
@@ -142,12 +194,32 @@ func New(opts Options, remote id.Signatory, inbound chan<- wire.Packet, outbound
 // Messages that have been received (regardless of changes to the attached
 // network connection) will always eventually be written to the inbound
 // messaging channel. Similarly, messages that are on the outbound queue will
-// always eventually be written to at least one attached network connection.
+// always eventually be written to at least one attached network connection
+// (unless they are being delivered at most once, see DeliveryMode).
 func (ch *Channel) Run(ctx context.Context) error {
 	go ch.writeLoop(ctx)
 	return ch.readLoop(ctx)
 }
 
+// Flush blocks until all messages that are on the outbound messaging channel
+// have been written to an attached network connection, or until the context
+// is done. If the Channel is not running, or no network connection is
+// attached, this method will block until the context is done.
+func (ch *Channel) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ch.flushes <- done:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
 // Attach a network connection to the Channel. This will replace the existing
 // network connection used by the Channel for reading/writing inbound/outbound
 // messages. If the Channel is not running, this method will block until the
@@ -183,17 +255,47 @@ func (ch *Channel) Attach(ctx context.Context, remote id.Signatory, conn net.Con
 	rq := make(chan struct{})
 	wq := make(chan struct{})
 
+	// Count the bytes read from, and written to, the network connection so
+	// that they can be reported by ConnInfo.
+	stats := newConnStats(conn.RemoteAddr(), enc)
+	in := io.Reader(&countingReader{Reader: conn, stats: stats})
+	out := io.Writer(&countingWriter{Writer: conn, stats: stats})
+
+	contentType := uint32(ch.opts.ContentType)
+	r := reader{Conn: conn, Decoder: dec, contentType: &contentType, q: rq}
+	w := writer{Conn: conn, Encoder: enc, out: out, contentType: &contentType, q: wq, rekey: &rekeyState{at: time.Now()}}
+	if ch.opts.TimingObserver != nil {
+		r.timed = &timedReader{Reader: in}
+		w.timed = &timedWriter{Writer: out}
+		w.out = w.timed
+		r.Reader = bufio.NewReaderSize(r.timed, ch.opts.MinBufferSize)
+	} else {
+		r.Reader = bufio.NewReaderSize(in, ch.opts.MinBufferSize)
+	}
+	w.Writer = bufio.NewWriterSize(w.out, ch.opts.MinBufferSize)
+
+	ch.connMu.Lock()
+	ch.conn = stats
+	ch.connMu.Unlock()
+	defer func() {
+		ch.connMu.Lock()
+		if ch.conn == stats {
+			ch.conn = nil
+		}
+		ch.connMu.Unlock()
+	}()
+
 	// Signal that a new reader should be used.
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case ch.readers <- reader{Conn: conn, Reader: bufio.NewReaderSize(conn, ch.opts.MaxMessageSize), Decoder: dec, q: rq}:
+	case ch.readers <- r:
 	}
 	// Signal that a new writer should be used.
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case ch.writers <- writer{Conn: conn, Writer: bufio.NewWriterSize(conn, ch.opts.MaxMessageSize), Encoder: enc, q: wq}:
+	case ch.writers <- w:
 	}
 
 	// Wait for the reader to be closed.
@@ -239,10 +341,41 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 			}
 		}()
 
-		buf := make([]byte, ch.opts.MaxMessageSize)
-		bufSyncData := make([]byte, ch.opts.MaxMessageSize)
+		// The decoding buffer must always be large enough for the maximum
+		// message size, because the size of the next message is not known
+		// until it has been decoded. The synchronisation data buffer is only
+		// allocated once it is needed.
+		buf := []byte(nil)
+		var bufSyncData []byte
+
+		// When there are receivers of BorrowedPackets, messages are read into
+		// buffers that can be lent to them.
+		var lent *borrowedBuffer
+		if ch.opts.borrowers != nil {
+			lent = ch.opts.borrowers.get()
+			buf = lent.b
+			defer func() { lent.release() }()
+		} else {
+			buf = make([]byte, ch.opts.MaxMessageSize)
+		}
+
+		// The nonce of the next message, or zero if the next message does not
+		// have one.
+		nonce := uint64(0)
+
+		// Fragmented messages are reassembled before they are processed, so
+		// the nonce of a fragmented message is kept until it is reassembled.
+		fragments := wire.NewReassembler(ch.opts.ReassemblyTimeout, ch.opts.MaxFragmentedMessageSize, ch.opts.MaxReassemblyBytes)
 
 		for {
+			// Sample the time spent reading this message.
+			sample := r.timed != nil && rand.Float64() < ch.opts.TimingSampleRate
+			var start, decoded time.Time
+			if sample {
+				r.timed.reset()
+				start = time.Now()
+			}
+
 			n, err := r.Decoder(r.Reader, buf[:])
 			if err != nil {
 				draining := atomic.LoadUint64(&draining)
@@ -251,6 +384,10 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 				if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
 					ch.opts.Logger.Error("decode", zap.Uint64("draining", draining), zap.Error(err))
 				}
+				authErr := new(codec.AuthenticationError)
+				if ch.opts.CorruptMessageListener != nil && errors.As(err, &authErr) {
+					ch.opts.CorruptMessageListener.DidReceiveCorruptMessage(ch.remote, authErr.Header, err)
+				}
 				close(r.q)
 				return
 			}
@@ -268,10 +405,112 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 			// Unmarshal the message from binary. If this is successfully, then
 			// we mark the message as available (and will attempt to write it to
 			// the inbound message channel).
-			if _, _, err := m.Unmarshal(buf[:n], len(buf)); err != nil {
+			if sample {
+				decoded = time.Now()
+			}
+			lending := lent != nil && ch.opts.borrowers.active()
+			unmarshal := m.Unmarshal
+			if lending {
+				unmarshal = m.UnmarshalBorrowed
+			}
+			// Messages that are not encoded using surge never refer to the
+			// buffer, so lending them is the same as copying them.
+			contentType := wire.ContentTypeOf(buf[:n])
+			atomic.StoreUint32(r.contentType, uint32(contentType))
+			if contentType == wire.ContentTypeSurge {
+				_, _, err = unmarshal(buf[:n], len(buf))
+			} else {
+				m, err = wire.UnmarshalContent(buf[:n])
+			}
+			if err != nil {
 				ch.opts.Logger.Error("unmarshal", zap.Error(err))
+				if ch.opts.CorruptMessageListener != nil {
+					header := buf[:n]
+					if len(header) > codec.MaxHeaderSize {
+						header = header[:codec.MaxHeaderSize]
+					}
+					ch.opts.CorruptMessageListener.DidReceiveCorruptMessage(ch.remote, append([]byte(nil), header...), err)
+				}
+				continue
+			}
+			// Nonces are not observed, because they are always written
+			// together with the next message.
+			if m.Type == wire.MsgTypeNonce {
+				if len(m.Data) != 8 {
+					ch.opts.Logger.Error("bad nonce", zap.String("remote", ch.remote.String()), zap.Int("len", len(m.Data)))
+					continue
+				}
+				nonce = binary.BigEndian.Uint64(m.Data)
 				continue
 			}
+			if sample {
+				if !r.timed.first.IsZero() {
+					start = r.timed.first
+				}
+				ch.opts.TimingObserver.ObserveRead(ReadTimings{
+					Syscall:   r.timed.d,
+					Decode:    decoded.Sub(start) - r.timed.d,
+					Unmarshal: time.Since(decoded),
+				})
+			}
+			if m.Type == wire.MsgTypeKeepAlive {
+				continue
+			}
+			if m.Type == wire.MsgTypeFragment {
+				reassembled, ok, err := fragments.Add(m, time.Now())
+				if err != nil {
+					ch.opts.Logger.Error("reassemble", zap.String("remote", ch.remote.String()), zap.Error(err))
+					continue
+				}
+				if !ok {
+					continue
+				}
+				m = reassembled
+			}
+			// Compressed messages can be fragmented, so their data is
+			// bounded by the maximum size of fragmented messages.
+			if m.Compression != wire.CompressionNone {
+				decompressed, err := wire.Decompress(m, ch.opts.maxSize())
+				if err != nil {
+					ch.opts.Logger.Error("decompress", zap.String("remote", ch.remote.String()), zap.Error(err))
+					continue
+				}
+				m = decompressed
+			}
+			if m.Type == wire.MsgTypeRekey {
+				// If the decoder does not support rotating its key, then
+				// neither does the encoder of the remote peer (because both
+				// peers use the same Handshake), so the message is ignored.
+				if !codec.RekeyDecoder(r.Decoder) {
+					ch.opts.Logger.Debug("rekey unsupported", zap.String("remote", ch.remote.String()))
+				}
+				continue
+			}
+
+			// The messages in a batch are processed as if they had been read
+			// one at a time, except that they share the nonce of the batch.
+			msgs := []wire.Msg{m}
+			if m.Type == wire.MsgTypeBatch {
+				unbatch := wire.Unbatch
+				if lending {
+					unbatch = wire.UnbatchBorrowed
+				}
+				if msgs, err = unbatch(m); err != nil {
+					ch.opts.Logger.Error("unbatch", zap.String("remote", ch.remote.String()), zap.Error(err))
+					nonce = 0
+					continue
+				}
+			}
+
+			// Check that the remote peer is not exceeding its message rate
+			// limit.
+			if !ch.msgRateLimiter.AllowN(time.Now(), len(msgs)) {
+				ch.opts.Logger.Error("message rate limit exceeded", zap.String("remote", ch.remote.String()), zap.String("addr", r.Conn.RemoteAddr().String()))
+				close(r.q)
+				return
+			}
+			duplicate := ch.received.seen(nonce)
+			nonce = 0
 
 			// An aggressive filtering strategy would involve pre-filtering
 			// synchronisation messages before reading the synchronisation data.
@@ -281,6 +520,9 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 			// rate-limiting, and (b) filtering that happens in the client
 			// results in bad channels being killed quickly anyway.
 			if m.Type == wire.MsgTypeSync {
+				if bufSyncData == nil {
+					bufSyncData = make([]byte, ch.opts.MaxMessageSize)
+				}
 				n, err := r.Decoder(r.Reader, bufSyncData)
 				if err != nil {
 					ch.opts.Logger.Error("decode sync data", zap.Error(err))
@@ -290,17 +532,65 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 					close(r.q)
 					return
 				}
-				m.SyncData = make([]byte, n)
-				copy(m.SyncData, bufSyncData[:n])
+				msgs[0].SyncData = make([]byte, n)
+				copy(msgs[0].SyncData, bufSyncData[:n])
+			}
+			if duplicate {
+				ch.opts.Logger.Debug("duplicate", zap.String("remote", ch.remote.String()))
+				continue
 			}
 
-			select {
-			case <-ctx.Done():
-				if r.q != nil {
-					close(r.q)
+			// Messages that have been relayed too many times are dropped, so
+			// that gossip storms, and routing loops, are bounded.
+			unexpired := msgs[:0]
+			for _, msg := range msgs {
+				msg, ok := msg.Hop()
+				if !ok {
+					ch.opts.Logger.Debug("ttl expired", zap.String("remote", ch.remote.String()), zap.Uint16("type", msg.Type))
+					continue
+				}
+				unexpired = append(unexpired, msg)
+			}
+			msgs = unexpired
+
+			if lending {
+				kept := msgs[:0]
+				for _, msg := range msgs {
+					if msg.Type == wire.MsgTypeSync || msg.Type == wire.MsgTypeResp {
+						// Synchronisation messages are never lent, because
+						// their synchronisation data is always copied.
+						// Responses are never lent, because they are passed
+						// to the calls that are waiting for them instead of
+						// to receivers.
+						msg.Data = append([]byte{}, msg.Data...)
+					} else {
+						ch.opts.borrowers.lend(ch.remote, wire.Packet{Msg: msg, IPAddr: r.Conn.RemoteAddr()}, lent)
+						if ch.opts.borrowers.exclusive() {
+							continue
+						}
+						msg.Data = append([]byte{}, msg.Data...)
+					}
+					kept = append(kept, msg)
+				}
+				msgs = kept
+				if atomic.LoadInt32(&lent.refs) > 1 {
+					// The buffer is still borrowed, so a different buffer
+					// must be used for the next message.
+					lent.release()
+					lent = ch.opts.borrowers.get()
+					buf = lent.b
+				}
+			}
+
+			for _, msg := range msgs {
+				select {
+				case <-ctx.Done():
+					if r.q != nil {
+						close(r.q)
+					}
+					return
+				case ch.inbound <- wire.Packet{Msg: msg, IPAddr: r.Conn.RemoteAddr()}:
 				}
-				return
-			case ch.inbound <- wire.Packet{Msg: m, IPAddr: r.Conn.RemoteAddr()}:
 			}
 		}
 	}
@@ -322,23 +612,93 @@ func (ch *Channel) readLoop(ctx context.Context) error {
 }
 
 func (ch *Channel) writeLoop(ctx context.Context) {
-	buf := make([]byte, ch.opts.MaxMessageSize)
+	// Buffers start at the minimum size, and adapt to the sizes of messages
+	// that are written. After being idle, they shrink back to the minimum size.
+	buf := make([]byte, ch.opts.MinBufferSize)
+	sizes := sizeHistogram{}
+	idle := false
+	var idleC <-chan time.Time
+	if ch.opts.BufferIdleTimeout > 0 {
+		idleTicker := time.NewTicker(ch.opts.BufferIdleTimeout)
+		defer idleTicker.Stop()
+		idleC = idleTicker.C
+	}
+	resize := func(w *writer) {
+		// Resizing is only safe when the writer has been flushed, otherwise
+		// buffered data would be lost.
+		size := clampBufferSize(sizes.percentile(90), ch.opts.MinBufferSize, ch.opts.MaxMessageSize)
+		if w.Writer.Buffered() == 0 && w.Writer.Size() != size {
+			w.Writer = bufio.NewWriterSize(w.out, size)
+		}
+	}
 
 	var w writer
 	var wOk bool
 
-	var m wire.Msg
+	// The nonce of the latest message is kept when the message is written
+	// again, so that the receiving Channel can drop duplicates.
+	nonces := newNonces()
+	fragmentID := uint64(0)
+	var mNonce uint64
+
+	var env Envelope
 	var mOk bool
-	var mQueue <-chan wire.Msg
+	var mQueue <-chan Envelope
+
+	// Messages that were persisted by a previous Channel to the same remote
+	// peer are written before any new outbound messages.
+	var backlog []Envelope
+	if ch.opts.MessageQueue != nil {
+		msgs, err := ch.opts.MessageQueue.Pop(ch.remote)
+		if err != nil {
+			ch.opts.Logger.Error("pop queue", zap.String("remote", ch.remote.String()), zap.Error(err))
+		}
+		for _, msg := range msgs {
+			backlog = append(backlog, Envelope{Msg: msg})
+		}
+	}
+
+	// Quit channels that are waiting for all outbound messages to be written.
+	var flushed []chan struct{}
+
+	// Check for idleness at half the keep-alive interval, so that the network
+	// connection is never idle for longer than the interval.
+	lastWrite := time.Now()
+	var keepAliveC <-chan time.Time
+	if ch.opts.KeepAliveInterval > 0 {
+		keepAliveTicker := time.NewTicker(ch.opts.KeepAliveInterval / 2)
+		defer keepAliveTicker.Stop()
+		keepAliveC = keepAliveTicker.C
+	}
 
 	for {
+		if wOk && !mOk {
+			select {
+			case env = <-ch.urgent:
+				mOk = true
+			default:
+			}
+		}
+		if !mOk && len(backlog) > 0 {
+			env, mOk = backlog[0], true
+			backlog = backlog[1:]
+		}
+		if !mOk && len(flushed) > 0 && len(ch.outbound) == 0 && len(ch.urgent) == 0 {
+			for _, f := range flushed {
+				close(f)
+			}
+			flushed = nil
+		}
+
+		var urgentQueue <-chan Envelope
 		switch {
 		case wOk && mOk:
-			q := make(chan wire.Msg, 1)
-			q <- m
+			q := make(chan Envelope, 1)
+			q <- env
 			mQueue = q
 		case wOk:
 			mQueue = ch.outbound
+			urgentQueue = ch.urgent
 		default:
 			mQueue = nil
 		}
@@ -348,33 +708,165 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 			if w.q != nil {
 				close(w.q)
 			}
+			if mOk {
+				backlog = append([]Envelope{env}, backlog...)
+			}
+			ch.persist(backlog)
 			return
 		case v, vOk := <-ch.writers:
 			if w.q != nil {
 				close(w.q)
 			}
 			w, wOk = v, vOk
-		case m, mOk = <-mQueue:
-			tail, _, err := m.Marshal(buf[:], len(buf))
+			if wOk {
+				resize(&w)
+			}
+			lastWrite = time.Now()
+		case <-keepAliveC:
+			if !wOk || time.Since(lastWrite) < ch.opts.KeepAliveInterval/2 {
+				continue
+			}
+			if err := writeKeepAlive(w); err != nil {
+				if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) && !errors.Is(err, syscall.EPIPE) {
+					ch.opts.Logger.Error("keep-alive", zap.String("remote", ch.remote.String()), zap.Error(err))
+				}
+				// An error when writing a keep-alive message is the same as
+				// an error when writing any other message.
+				close(w.q)
+				w, wOk = writer{}, false
+				continue
+			}
+			lastWrite = time.Now()
+		case f := <-ch.flushes:
+			flushed = append(flushed, f)
+		case env = <-urgentQueue:
+			// The urgent message will be written on the next iteration.
+			mOk = true
+		case <-idleC:
+			if !idle {
+				idle = true
+				continue
+			}
+			sizes.reset()
+			if len(buf) > ch.opts.MinBufferSize {
+				buf = make([]byte, ch.opts.MinBufferSize)
+			}
+			if wOk {
+				resize(&w)
+			}
+		case env, mOk = <-mQueue:
+			idle = false
+			if mQueue == ch.outbound {
+				env, backlog = ch.batch(env, backlog, w.contentTypeOrSurge())
+			}
+			if compressed, err := wire.Compress(env.Msg, ch.opts.CompressionThreshold); err != nil {
+				ch.opts.Logger.Error("compress", zap.Error(err))
+			} else {
+				env.Msg = compressed
+			}
+			m := env.Msg
+			size := m.SizeHint()
+			if size > len(buf) {
+				buf = make([]byte, clampBufferSize(size, ch.opts.MinBufferSize, ch.opts.MaxMessageSize))
+			}
+
+			// Sample the time spent writing this message.
+			sample := w.timed != nil && rand.Float64() < ch.opts.TimingSampleRate
+			var start, marshaled time.Time
+			if sample {
+				start = time.Now()
+			}
+
+			// Messages that are larger than the maximum message size are
+			// written as fragments, which are reassembled by the remote peer.
+			// Fragments are only understood by remote peers that have
+			// negotiated version 4 (or later), so older messages are not
+			// fragmented.
+			// Content types other than surge can be larger than the size
+			// hint (for example, JSON encodes data using base64), so their
+			// encoded size is checked instead.
+			var tail, content []byte
+			var fragments [][]byte
+			var err error
+			contentType := w.contentTypeOrSurge()
+			if contentType != wire.ContentTypeSurge {
+				if content, err = w.marshal(m); err == nil {
+					size = len(content)
+				}
+			}
+			switch {
+			case err != nil:
+			case m.Version >= wire.MsgVersion4 && size > ch.opts.MaxMessageSize && size <= ch.opts.MaxFragmentedMessageSize:
+				fragmentID++
+				fragments, err = marshalFragments(w, m, ch.opts.MaxMessageSize, fragmentID)
+			case size > ch.opts.MaxMessageSize:
+				err = fmt.Errorf("message of %v bytes exceeds the maximum message size", size)
+			case content != nil:
+				if len(content) > len(buf) {
+					buf = make([]byte, len(content))
+				}
+				tail = buf[copy(buf, content):]
+			default:
+				tail, _, err = m.Marshal(buf[:], len(buf))
+			}
+			n := len(buf) - len(tail)
+			if fragments != nil {
+				n = 0
+				for _, fragment := range fragments {
+					n += len(fragment)
+				}
+			}
+			if sample {
+				marshaled = time.Now()
+				w.timed.d = 0
+			}
 			if err != nil {
 				ch.opts.Logger.Error("marshal", zap.Error(err))
 				// Clear the latest message so that we can move on to other
 				// messages. We do this, because failure to marshal is not
 				// something that is typically recoverable.
-				m = wire.Msg{}
+				env.Notify(wire.OutcomeDropped)
+				env = Envelope{}
 				mOk = false
+				mNonce = 0
 				continue
 			}
-			if _, err := w.Encoder(w.Writer, buf[:len(buf)-len(tail)]); err != nil {
+			if w.rekey.due(ch.opts) {
+				if err := writeRekey(w); err != nil {
+					ch.opts.Logger.Error("encode", zap.NamedError("rekey", err))
+					close(w.q)
+					w, wOk = writer{}, false
+					continue
+				}
+			}
+			if ch.opts.DeliveryMode == DeliveryAtLeastOnce {
+				if mNonce == 0 {
+					mNonce = nonces.next()
+				}
+				if err := writeNonce(w, mNonce); err != nil {
+					ch.opts.Logger.Error("encode", zap.NamedError("nonce", err))
+					close(w.q)
+					w, wOk = writer{}, false
+					continue
+				}
+			}
+			if fragments != nil {
+				err = writeFragments(w, fragments)
+			} else {
+				_, err = w.Encoder(w.Writer, buf[:n])
+			}
+			if err != nil {
 				ch.opts.Logger.Error("encode", zap.Error(err))
 				// If an error happened when trying to write to the writer,
 				// then clean the writer. This will force the Channel to
 				// block on future writes until a new network connection is
-				// attached. The latest message is not replaced (so we will
+				// attached. Unless the message is being delivered at most
+				// once, the latest message is not replaced (so we will
 				// re-attempt to write it when a new connection is
 				// eventually attached).
 				close(w.q)
 				w, wOk = writer{}, false
+				env, mOk, mNonce = ch.dropIfAtMostOnce(env, mNonce)
 				continue
 			}
 			if err := w.Writer.Flush(); err != nil {
@@ -386,13 +878,22 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 				// An error when flushing is the same as an error when encoding.
 				close(w.q)
 				w, wOk = writer{}, false
+				env, mOk, mNonce = ch.dropIfAtMostOnce(env, mNonce)
 				continue
 			}
+			if sample {
+				ch.opts.TimingObserver.ObserveWrite(WriteTimings{
+					Marshal: marshaled.Sub(start),
+					Encode:  time.Since(marshaled) - w.timed.d,
+					Syscall: w.timed.d,
+				})
+			}
 			if m.Type == wire.MsgTypeSync {
 				if _, err := w.Encoder(w.Writer, m.SyncData); err != nil {
 					ch.opts.Logger.Error("encode", zap.NamedError("sync data", err))
 					close(w.q)
 					w, wOk = writer{}, false
+					env, mOk, mNonce = ch.dropIfAtMostOnce(env, mNonce)
 					continue
 				}
 				if err := w.Writer.Flush(); err != nil {
@@ -402,14 +903,250 @@ func (ch *Channel) writeLoop(ctx context.Context) {
 					// An error when flushing is the same as an error when encoding.
 					close(w.q)
 					w, wOk = writer{}, false
+					env, mOk, mNonce = ch.dropIfAtMostOnce(env, mNonce)
 					continue
 				}
 			}
 
+			// Observe the size of the message, so that the write buffer can
+			// be adapted to the sizes of messages that are usually written.
+			sizes.observe(n)
+			w.rekey.bytes += n
+			if m.Type == wire.MsgTypeSync {
+				sizes.observe(len(m.SyncData))
+				w.rekey.bytes += len(m.SyncData)
+			}
+			resize(&w)
+			lastWrite = time.Now()
+			env.Notify(wire.OutcomeWritten)
+
 			// Clear the latest message so that we can move on to other
 			// messages.
-			m = wire.Msg{}
+			env = Envelope{}
 			mOk = false
+			mNonce = 0
+		}
+	}
+}
+
+// batch a message with the messages that are waiting on the outbound messaging
+// channel, until the batch would be larger than the maximum batch size. The
+// first message that cannot be batched is put at the front of the backlog, so
+// that it is written next. If no messages are waiting, the message is
+// returned unchanged. The messages are encoded using the content type of the
+// network connection. The outcome of the batch is the outcome of each of its
+// messages, so its OnOutcome callback calls theirs.
+func (ch *Channel) batch(env Envelope, backlog []Envelope, contentType wire.ContentType) (Envelope, []Envelope) {
+	limit := ch.opts.MaxBatchBytes
+	if limit > ch.opts.MaxMessageSize {
+		limit = ch.opts.MaxMessageSize
+	}
+	batchable := func(msg wire.Msg) bool {
+		return msg.Version >= wire.MsgVersion5 && msg.Type != wire.MsgTypeSync
+	}
+	if !batchable(env.Msg) {
+		return env, backlog
+	}
+
+	envs := []Envelope{env}
+	size := wire.BatchOverhead + env.Msg.SizeHint()
+	for waiting := true; waiting && size < limit; {
+		select {
+		case next := <-ch.outbound:
+			if !batchable(next.Msg) || size+next.Msg.SizeHint() > limit {
+				backlog = append([]Envelope{next}, backlog...)
+				waiting = false
+				continue
+			}
+			envs = append(envs, next)
+			size += next.Msg.SizeHint()
+		default:
+			waiting = false
+		}
+	}
+	if len(envs) == 1 {
+		return env, backlog
+	}
+
+	msgs := make([]wire.Msg, len(envs))
+	for i := range envs {
+		msgs[i] = envs[i].Msg
+	}
+	batch, err := wire.BatchContent(msgs, contentType)
+	if err != nil {
+		ch.opts.Logger.Error("batch", zap.Error(err))
+		return env, append(envs[1:], backlog...)
+	}
+	return Envelope{
+		Msg: batch,
+		OnOutcome: func(outcome wire.Outcome) {
+			for _, env := range envs {
+				env.Notify(outcome)
+			}
+		},
+	}, backlog
+}
+
+// dropIfAtMostOnce is called with a message that might have been partially, or
+// completely, written to a faulty network connection. If messages are being
+// delivered at most once, the message is dropped and its sender is notified
+// that it was lost. Otherwise, the message is returned so that it can be
+// written again.
+func (ch *Channel) dropIfAtMostOnce(env Envelope, nonce uint64) (Envelope, bool, uint64) {
+	if ch.opts.DeliveryMode != DeliveryAtMostOnce {
+		return env, true, nonce
+	}
+	env.Notify(wire.OutcomeLost)
+	return Envelope{}, false, 0
+}
+
+// persist unwritten messages, and all messages remaining on the outbound
+// messaging channel, to the MessageQueue (if one is configured). Messages that
+// are not persisted are lost, and their senders are notified.
+func (ch *Channel) persist(envs []Envelope) {
+	for drained := false; !drained; {
+		select {
+		case env := <-ch.urgent:
+			envs = append(envs, env)
+		default:
+			drained = true
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case env := <-ch.outbound:
+			envs = append(envs, env)
+		default:
+			drained = true
+		}
+	}
+
+	outcome := wire.OutcomeLost
+	if ch.opts.MessageQueue != nil {
+		msgs := make([]wire.Msg, len(envs))
+		for i := range envs {
+			msgs[i] = envs[i].Msg
+		}
+		if err := ch.opts.MessageQueue.Push(ch.remote, msgs); err != nil {
+			ch.opts.Logger.Error("push queue", zap.String("remote", ch.remote.String()), zap.Int("n", len(msgs)), zap.Error(err))
+		} else {
+			outcome = wire.OutcomePersisted
 		}
 	}
+	for _, env := range envs {
+		env.Notify(outcome)
+	}
+}
+
+// marshal a message using the content type of the network connection.
+func (w writer) marshal(msg wire.Msg) ([]byte, error) {
+	return wire.MarshalContent(msg, w.contentTypeOrSurge())
+}
+
+// contentTypeOrSurge returns the content type of the network connection.
+func (w writer) contentTypeOrSurge() wire.ContentType {
+	if w.contentType == nil {
+		return wire.ContentTypeSurge
+	}
+	return wire.ContentType(atomic.LoadUint32(w.contentType))
+}
+
+// writeNonce writes the nonce of the next message, without flushing, so that it
+// is usually written in the same system call as the message.
+func writeNonce(w writer, nonce uint64) error {
+	msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeNonce, Data: make([]byte, 8)}
+	binary.BigEndian.PutUint64(msg.Data, nonce)
+	buf, err := w.marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if _, err := w.Encoder(w.Writer, buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	return nil
+}
+
+// marshalFragments fragments a message, and marshals the fragments using the
+// content type of the network connection. An error is returned if any of the
+// marshaled fragments is larger than the maximum size, so that no fragments
+// are written unless all of them can be read by the remote peer.
+func marshalFragments(w writer, msg wire.Msg, maxSize int, id uint64) ([][]byte, error) {
+	fragments, err := wire.FragmentContent(msg, w.contentTypeOrSurge(), maxSize, id)
+	if err != nil {
+		return nil, err
+	}
+	bufs := make([][]byte, len(fragments))
+	for i, fragment := range fragments {
+		if bufs[i], err = w.marshal(fragment); err != nil {
+			return nil, fmt.Errorf("marshal fragment: %w", err)
+		}
+		if len(bufs[i]) > maxSize {
+			return nil, fmt.Errorf("fragment of %v bytes exceeds the maximum message size", len(bufs[i]))
+		}
+	}
+	return bufs, nil
+}
+
+// writeFragments writes the fragments of a message, in order, without
+// flushing.
+func writeFragments(w writer, fragments [][]byte) error {
+	for _, fragment := range fragments {
+		if _, err := w.Encoder(w.Writer, fragment); err != nil {
+			return fmt.Errorf("encode fragment: %w", err)
+		}
+	}
+	return nil
+}
+
+// rekeyState is the state of the key rotation of an encoder.
+type rekeyState struct {
+	at          time.Time
+	bytes       int
+	unsupported bool
+}
+
+// due returns true if the key of the encoder must be rotated before writing
+// the next message.
+func (state *rekeyState) due(opts Options) bool {
+	if state == nil || state.unsupported {
+		return false
+	}
+	return (opts.RekeyInterval > 0 && time.Since(state.at) >= opts.RekeyInterval) ||
+		(opts.RekeyBytes > 0 && state.bytes >= opts.RekeyBytes)
+}
+
+// writeRekey writes a rekey message, without flushing, and then rotates the
+// key of the encoder, so that all later messages are encrypted with the next
+// key. If the encoder does not support rotating its key (for example, because
+// it does not encrypt anything), then no more rekey messages are written.
+func writeRekey(w writer) error {
+	msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeRekey}
+	buf, err := w.marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if _, err := w.Encoder(w.Writer, buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if !codec.RekeyEncoder(w.Encoder) {
+		w.rekey.unsupported = true
+	}
+	w.rekey.at = time.Now()
+	w.rekey.bytes = 0
+	return nil
+}
+
+func writeKeepAlive(w writer) error {
+	msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeKeepAlive}
+	buf, err := w.marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	if _, err := w.Encoder(w.Writer, buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if err := w.Writer.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	return nil
 }
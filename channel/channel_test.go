@@ -3,13 +3,21 @@ package channel_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"log"
 	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"golang.org/x/time/rate"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -17,8 +25,8 @@ import (
 
 var _ = Describe("Channels", func() {
 
-	run := func(ctx context.Context, remote id.Signatory) (*channel.Channel, <-chan wire.Packet, chan<- wire.Msg) {
-		inbound, outbound := make(chan wire.Packet), make(chan wire.Msg)
+	run := func(ctx context.Context, remote id.Signatory) (*channel.Channel, <-chan wire.Packet, chan<- channel.Envelope) {
+		inbound, outbound := make(chan wire.Packet), make(chan channel.Envelope)
 		ch := channel.New(
 			channel.DefaultOptions().WithDrainTimeout(1500*time.Millisecond),
 			remote,
@@ -34,7 +42,7 @@ var _ = Describe("Channels", func() {
 		return ch, inbound, outbound
 	}
 
-	sink := func(outbound chan<- wire.Msg, n uint64) <-chan struct{} {
+	sink := func(outbound chan<- channel.Envelope, n uint64) <-chan struct{} {
 		quit := make(chan struct{})
 		go func() {
 			defer GinkgoRecover()
@@ -45,7 +53,7 @@ var _ = Describe("Channels", func() {
 				data := [8]byte{}
 				binary.BigEndian.PutUint64(data[:], iter)
 				select {
-				case outbound <- wire.Msg{Data: data[:]}:
+				case outbound <- channel.Envelope{Msg: wire.Msg{Data: data[:]}}:
 				case <-timeout:
 					Expect(func() { panic("sink timeout") }).ToNot(Panic())
 				}
@@ -201,4 +209,705 @@ var _ = Describe("Channels", func() {
 			})
 		})
 	})
+	Context("when sending urgent messages", func() {
+		It("should write them before normal messages that are waiting", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			outbound, urgent := make(chan channel.Envelope, 10), make(chan channel.Envelope, 10)
+			local := channel.NewWithUrgent(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory(),
+				make(chan wire.Packet),
+				outbound,
+				urgent)
+			go local.Run(ctx)
+
+			// Queue normal messages before the urgent message, and before
+			// any network connection is attached.
+			for i := 0; i < 5; i++ {
+				outbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("normal")}}
+			}
+			urgent <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("urgent")}}
+
+			localConn, remoteConn := net.Pipe()
+			go local.Attach(
+				ctx,
+				remotePrivKey.Signatory(),
+				localConn,
+				codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder),
+				codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			for i := 0; i < 6; i++ {
+				buf := make([]byte, 1024)
+				n, err := dec(remoteConn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				msg := wire.Msg{}
+				_, _, err = msg.Unmarshal(buf[:n], n)
+				Expect(err).ToNot(HaveOccurred())
+				if msg.Type == wire.MsgTypeNonce {
+					// Messages that are delivered at least once are
+					// preceded by their nonces.
+					i--
+					continue
+				}
+				if i == 0 {
+					Expect(msg.Data).To(Equal([]byte("urgent")))
+				} else {
+					Expect(msg.Data).To(Equal([]byte("normal")))
+				}
+			}
+		})
+	})
+
+	Context("when the keep-alive interval is set", func() {
+		It("should write keep-alive messages to idle connections, and drop them when reading", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			// The local Channel writes keep-alive messages.
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(
+				channel.DefaultOptions().WithKeepAliveInterval(50*time.Millisecond),
+				remotePrivKey.Signatory(),
+				localInbound,
+				localOutbound)
+			go local.Run(ctx)
+
+			// The remote Channel does not write keep-alive messages, but must
+			// drop the ones that it reads.
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			remote := channel.New(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory(),
+				remoteInbound,
+				remoteOutbound)
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			// Keep-alive messages are never seen by the remote inbound
+			// messaging channel.
+			Consistently(remoteInbound, 500*time.Millisecond).ShouldNot(Receive())
+
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			localOutbound <- channel.Envelope{Msg: msg}
+			var packet wire.Packet
+			Eventually(remoteInbound).Should(Receive(&packet))
+			Expect(packet.Msg).To(Equal(msg))
+		})
+
+		It("should write keep-alive messages while the connection is idle", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			local := channel.New(
+				channel.DefaultOptions().WithKeepAliveInterval(50*time.Millisecond),
+				remotePrivKey.Signatory(),
+				make(chan wire.Packet),
+				make(chan channel.Envelope))
+			go local.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			go local.Attach(
+				ctx,
+				remotePrivKey.Signatory(),
+				localConn,
+				codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder),
+				codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			for i := 0; i < 3; i++ {
+				buf := make([]byte, 1024)
+				n, err := dec(remoteConn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				msg := wire.Msg{}
+				_, _, err = msg.Unmarshal(buf[:n], n)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Type).To(Equal(wire.MsgTypeKeepAlive))
+			}
+		})
+	})
+
+	Context("when rekeying is enabled", func() {
+		It("should rotate keys in both directions without losing messages", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			opts := channel.DefaultOptions().WithRekeyBytes(64)
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(opts, remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			remote := channel.New(opts, localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			// Encrypt the network connection, like a Transport would.
+			localConn, remoteConn := net.Pipe()
+			attach := func(ch *channel.Channel, privKey *id.PrivKey, conn net.Conn) {
+				defer GinkgoRecover()
+				enc, dec, remote, err := handshake.NoiseXX(privKey)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
+				dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
+				ch.Attach(ctx, remote, conn, enc, dec)
+			}
+			go attach(local, localPrivKey, localConn)
+			go attach(remote, remotePrivKey, remoteConn)
+
+			n := uint64(100)
+			q1 := sink(localOutbound, n)
+			q2 := stream(remoteInbound, n, true)
+			q3 := sink(remoteOutbound, n)
+			q4 := stream(localInbound, n, true)
+			<-q1
+			<-q2
+			<-q3
+			<-q4
+		})
+
+		It("should not affect network connections that are not encrypted", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			opts := channel.DefaultOptions().WithRekeyBytes(64)
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(opts, remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			remote := channel.New(opts, localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			n := uint64(100)
+			q1 := sink(localOutbound, n)
+			q2 := stream(remoteInbound, n, true)
+			<-q1
+			<-q2
+		})
+	})
+
+	Context("when sending messages using wire version 4", func() {
+		It("should compress large messages, and decompress them when reading", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			remote := channel.New(channel.DefaultOptions(), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			// Record the size of everything encoded by the local Channel.
+			encoded := make(chan int, 16)
+			plainEncoder := func(w io.Writer, buf []byte) (int, error) {
+				encoded <- len(buf)
+				return codec.PlainEncoder(w, buf)
+			}
+			localConn, remoteConn := net.Pipe()
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, codec.LengthPrefixEncoder(codec.PlainEncoder, plainEncoder), dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder), dec)
+
+			data := []byte(strings.Repeat(`{"key":"value"}`, 1000))
+			for _, version := range []uint16{wire.MsgVersion3, wire.MsgVersion4} {
+				localOutbound <- channel.Envelope{Msg: wire.Msg{Version: version, Type: wire.MsgTypeSend, Data: data}}
+				var packet wire.Packet
+				Eventually(remoteInbound).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal(data))
+				Expect(packet.Msg.Compression).To(Equal(wire.CompressionNone))
+
+				if version == wire.MsgVersion4 {
+					Expect(<-encoded).To(BeNumerically("<", len(data)/10))
+				} else {
+					Expect(<-encoded).To(BeNumerically(">", len(data)))
+				}
+			}
+		})
+	})
+
+	Context("when the remote peer writes messages using JSON", func() {
+		It("should read them, and write messages using JSON", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			inbound, outbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			ch := channel.New(channel.DefaultOptions().WithDeliveryMode(channel.DeliveryAtLeastOnce), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			conn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+
+			// The remote peer does not speak surge.
+			_, err := enc(remoteConn, []byte(`{"version":1,"type":4,"data":"aGVsbG8="}`))
+			Expect(err).ToNot(HaveOccurred())
+			var packet wire.Packet
+			Eventually(inbound).Should(Receive(&packet))
+			Expect(packet.Msg.Data).To(Equal([]byte("hello")))
+
+			// The nonce that is written before the message is also encoded
+			// using JSON.
+			outbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("world")}}
+			buf := make([]byte, 1024)
+			for _, msgType := range []uint16{wire.MsgTypeNonce, wire.MsgTypeSend} {
+				n, err := dec(remoteConn, buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wire.ContentTypeOf(buf[:n])).To(Equal(wire.ContentTypeJSON))
+				msg, err := wire.UnmarshalContent(buf[:n])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(msg.Type).To(Equal(msgType))
+				if msgType == wire.MsgTypeSend {
+					Expect(msg.Data).To(Equal([]byte("world")))
+				}
+			}
+		})
+	})
+
+	Context("when writing large messages using JSON", func() {
+		It("should fragment them by their encoded size", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			opts := channel.DefaultOptions().
+				WithMaxMessageSize(4 * 1024).
+				WithMaxFragmentedMessageSize(64 * 1024).
+				WithRateLimit(rate.Inf).
+				WithContentType(wire.ContentTypeJSON)
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(opts, remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			remote := channel.New(opts, localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			// The data fits in the maximum message size, but its base64
+			// encoding does not.
+			data := make([]byte, 3500)
+			rand.Read(data)
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: data}
+			localOutbound <- channel.Envelope{Msg: msg}
+			var packet wire.Packet
+			Eventually(remoteInbound).Should(Receive(&packet))
+			Expect(packet.Msg).To(Equal(msg))
+
+			// Messages of versions that cannot be fragmented are dropped.
+			outcomes := make(chan wire.Outcome, 1)
+			localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeSend, Data: data}, OnOutcome: func(outcome wire.Outcome) { outcomes <- outcome }}
+			Eventually(outcomes).Should(Receive(Equal(wire.OutcomeDropped)))
+			Consistently(remoteInbound, 100*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when receiving messages with a TTL", func() {
+		It("should drop expired messages, and decrement the TTL of the others", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			remote := channel.New(channel.DefaultOptions(), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend}
+			localOutbound <- channel.Envelope{Msg: msg.WithHops(wire.Hops{TTL: 0, Count: 3}).WithHeader(wire.HeaderTypeApplication, []byte("expired"))}
+			localOutbound <- channel.Envelope{Msg: msg.WithHops(wire.Hops{TTL: 1, Count: 3}).WithHeader(wire.HeaderTypeApplication, []byte("unexpired"))}
+
+			var packet wire.Packet
+			Eventually(remoteInbound).Should(Receive(&packet))
+			value, _ := packet.Msg.Header(wire.HeaderTypeApplication)
+			Expect(value).To(Equal([]byte("unexpired")))
+			hops, ok := packet.Msg.Hops()
+			Expect(ok).To(BeTrue())
+			Expect(hops).To(Equal(wire.Hops{TTL: 0, Count: 4}))
+			Consistently(remoteInbound).ShouldNot(Receive())
+		})
+	})
+
+	Context("when receiving corrupt messages", func() {
+		It("should notify the listener about messages that cannot be unmarshaled, and drop them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remotePrivKey := id.NewPrivKey()
+			listener := make(corruptMessageListener, 1)
+			inbound, outbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			ch := channel.New(channel.DefaultOptions().WithCorruptMessageListener(listener), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			conn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go ch.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+
+			// The version is newer than all versions that are known.
+			garbage := append([]byte{0x00, 0x09}, make([]byte, 64)...)
+			_, err := enc(remoteConn, garbage)
+			Expect(err).ToNot(HaveOccurred())
+			var corrupt corruptMessage
+			Eventually(listener).Should(Receive(&corrupt))
+			Expect(corrupt.remote).To(Equal(remotePrivKey.Signatory()))
+			Expect(corrupt.header).To(Equal(garbage[:codec.MaxHeaderSize]))
+			Expect(corrupt.err).To(HaveOccurred())
+
+			// The connection is still usable.
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			data := make([]byte, msg.SizeHint())
+			_, _, err = msg.Marshal(data, len(data))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = enc(remoteConn, data)
+			Expect(err).ToNot(HaveOccurred())
+			var packet wire.Packet
+			Eventually(inbound).Should(Receive(&packet))
+			Expect(packet.Msg.Data).To(Equal([]byte("hello")))
+		})
+
+		It("should notify the listener about messages that cannot be authenticated", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			listener := make(corruptMessageListener, 1)
+			inbound, outbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			ch := channel.New(channel.DefaultOptions().WithCorruptMessageListener(listener), remotePrivKey.Signatory(), inbound, outbound)
+			go ch.Run(ctx)
+
+			// The remote peer seals messages using a different key.
+			var localKey, remoteKey [32]byte
+			rand.Read(localKey[:])
+			rand.Read(remoteKey[:])
+			localSession, err := codec.NewGCMSession(localKey, localPrivKey.Signatory(), remotePrivKey.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			remoteSession, err := codec.NewGCMSession(remoteKey, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+
+			conn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(localSession, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(localSession, codec.PlainDecoder))
+			go ch.Attach(ctx, remotePrivKey.Signatory(), conn, enc, dec)
+
+			remoteEnc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(remoteSession, codec.PlainEncoder))
+			_, err = remoteEnc(remoteConn, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			var corrupt corruptMessage
+			Eventually(listener).Should(Receive(&corrupt))
+			Expect(corrupt.remote).To(Equal(remotePrivKey.Signatory()))
+			Expect(corrupt.header).To(HaveLen(len("hello") + 16))
+			authErr := new(codec.AuthenticationError)
+			Expect(errors.As(corrupt.err, &authErr)).To(BeTrue())
+		})
+	})
+
+	Context("when sending messages that are larger than the maximum message size", func() {
+		It("should fragment them, and reassemble them when reading", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			// Fragments count against the rate limit, which otherwise only
+			// allows bursts of the maximum message size.
+			opts := channel.DefaultOptions().
+				WithMaxMessageSize(4 * 1024).
+				WithMaxFragmentedMessageSize(64 * 1024).
+				WithRateLimit(rate.Inf)
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope)
+			local := channel.New(opts, remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, 1), make(chan channel.Envelope)
+			remote := channel.New(opts, localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			large := make([]byte, 32*1024)
+			rand.Read(large)
+			for _, data := range [][]byte{large, []byte("small"), large[:5000]} {
+				msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: data}
+				localOutbound <- channel.Envelope{Msg: msg}
+				var packet wire.Packet
+				Eventually(remoteInbound).Should(Receive(&packet))
+				Expect(packet.Msg).To(Equal(msg))
+			}
+
+			// Messages that are larger than the maximum fragmented message
+			// size are dropped, and so are large messages of versions that
+			// cannot be fragmented.
+			outcomes := make(chan wire.Outcome, 1)
+			tooLarge := make([]byte, 128*1024)
+			rand.Read(tooLarge)
+			localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: tooLarge}, OnOutcome: func(outcome wire.Outcome) { outcomes <- outcome }}
+			Eventually(outcomes).Should(Receive(Equal(wire.OutcomeDropped)))
+			localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeSend, Data: large}, OnOutcome: func(outcome wire.Outcome) { outcomes <- outcome }}
+			Eventually(outcomes).Should(Receive(Equal(wire.OutcomeDropped)))
+			Consistently(remoteInbound, 100*time.Millisecond).ShouldNot(Receive())
+
+			// Compressed messages are decompressed up to the maximum
+			// fragmented message size.
+			compressible := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: make([]byte, 32*1024)}
+			localOutbound <- channel.Envelope{Msg: compressible}
+			var packet wire.Packet
+			Eventually(remoteInbound).Should(Receive(&packet))
+			Expect(packet.Msg).To(Equal(compressible))
+		})
+	})
+
+	Context("when messages are waiting to be written", func() {
+		It("should write them in batches", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			n := 100
+			localInbound, localOutbound := make(chan wire.Packet), make(chan channel.Envelope, n)
+			local := channel.New(channel.DefaultOptions(), remotePrivKey.Signatory(), localInbound, localOutbound)
+			go local.Run(ctx)
+			remoteInbound, remoteOutbound := make(chan wire.Packet, n), make(chan channel.Envelope)
+			remote := channel.New(channel.DefaultOptions(), localPrivKey.Signatory(), remoteInbound, remoteOutbound)
+			go remote.Run(ctx)
+
+			// Messages are queued before the connection is attached, so that
+			// they are all waiting to be written.
+			written := make(chan wire.Outcome, n)
+			for i := 0; i < n; i++ {
+				data := [8]byte{}
+				binary.BigEndian.PutUint64(data[:], uint64(i))
+				localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: data[:]}, OnOutcome: func(outcome wire.Outcome) { written <- outcome }}
+			}
+
+			// Count the frames encoded by the local Channel.
+			frames := int64(0)
+			plainEncoder := func(w io.Writer, buf []byte) (int, error) {
+				atomic.AddInt64(&frames, 1)
+				return codec.PlainEncoder(w, buf)
+			}
+			localConn, remoteConn := net.Pipe()
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, codec.LengthPrefixEncoder(codec.PlainEncoder, plainEncoder), dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder), dec)
+
+			for i := 0; i < n; i++ {
+				var packet wire.Packet
+				Eventually(remoteInbound).Should(Receive(&packet))
+				Expect(packet.Msg.Type).To(Equal(wire.MsgTypeSend))
+				Expect(binary.BigEndian.Uint64(packet.Msg.Data)).To(Equal(uint64(i)))
+				Eventually(written).Should(Receive(Equal(wire.OutcomeWritten)))
+			}
+			// Each batch is written as one frame.
+			Expect(atomic.LoadInt64(&frames)).To(BeNumerically("<", n/2))
+		})
+	})
+
+	Context("when the remote peer exceeds the message rate limit", func() {
+		It("should stop reading from the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			localOutbound := make(chan channel.Envelope)
+			local := channel.New(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory(),
+				make(chan wire.Packet),
+				localOutbound)
+			go local.Run(ctx)
+
+			// The remote Channel allows a burst of two messages, and then one
+			// message every minute.
+			remoteInbound := make(chan wire.Packet, 3)
+			remote := channel.New(
+				channel.DefaultOptions().WithMessageRateLimit(1.0/60, 2),
+				localPrivKey.Signatory(),
+				remoteInbound,
+				make(chan channel.Envelope))
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			for i := 0; i < 3; i++ {
+				localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}}}
+			}
+			Eventually(remoteInbound).Should(Receive())
+			Eventually(remoteInbound).Should(Receive())
+			Consistently(remoteInbound, 500*time.Millisecond).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a connection faults after writing a message", func() {
+		deliver := func(mode channel.DeliveryMode) ([]wire.Packet, []wire.Outcome) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			localOutbound := make(chan channel.Envelope)
+			local := channel.New(
+				channel.DefaultOptions().WithDeliveryMode(mode),
+				remotePrivKey.Signatory(),
+				make(chan wire.Packet),
+				localOutbound)
+			go local.Run(ctx)
+
+			remoteInbound := make(chan wire.Packet, 10)
+			remote := channel.New(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory(),
+				remoteInbound,
+				make(chan channel.Envelope))
+			go remote.Run(ctx)
+
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			attach := func(faulty bool) {
+				localConn, remoteConn := net.Pipe()
+				if faulty {
+					localConn = faultyConn{Conn: localConn}
+				}
+				go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+				go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+			}
+
+			// The first message is received by the remote peer, but the
+			// local peer sees an error.
+			outcomes := make(chan wire.Outcome, 10)
+			attach(true)
+			localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("first")}, OnOutcome: func(outcome wire.Outcome) { outcomes <- outcome }}
+			time.Sleep(100 * time.Millisecond)
+
+			attach(false)
+			localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("second")}, OnOutcome: func(outcome wire.Outcome) { outcomes <- outcome }}
+
+			packets := []wire.Packet{}
+			for {
+				select {
+				case packet := <-remoteInbound:
+					packets = append(packets, packet)
+					continue
+				case <-time.After(500 * time.Millisecond):
+				}
+				break
+			}
+			close(outcomes)
+			received := []wire.Outcome{}
+			for outcome := range outcomes {
+				received = append(received, outcome)
+			}
+			return packets, received
+		}
+
+		Context("when re-sending messages", func() {
+			It("should write the message again, without a nonce", func() {
+				packets, outcomes := deliver(channel.DeliveryResend)
+				Expect(packets).To(HaveLen(3))
+				Expect(packets[0].Msg.Data).To(Equal([]byte("first")))
+				Expect(packets[1].Msg.Data).To(Equal([]byte("first")))
+				Expect(packets[2].Msg.Data).To(Equal([]byte("second")))
+				Expect(outcomes).To(Equal([]wire.Outcome{wire.OutcomeWritten, wire.OutcomeWritten}))
+			})
+		})
+
+		Context("when delivering messages at least once", func() {
+			It("should write the message again, and the remote peer should drop the duplicate", func() {
+				packets, outcomes := deliver(channel.DeliveryAtLeastOnce)
+				Expect(packets).To(HaveLen(2))
+				Expect(packets[0].Msg.Data).To(Equal([]byte("first")))
+				Expect(packets[1].Msg.Data).To(Equal([]byte("second")))
+				Expect(outcomes).To(Equal([]wire.Outcome{wire.OutcomeWritten, wire.OutcomeWritten}))
+			})
+		})
+
+		Context("when delivering messages at most once", func() {
+			It("should drop the message", func() {
+				packets, outcomes := deliver(channel.DeliveryAtMostOnce)
+				Expect(packets).To(HaveLen(2))
+				Expect(packets[0].Msg.Data).To(Equal([]byte("first")))
+				Expect(packets[1].Msg.Data).To(Equal([]byte("second")))
+				Expect(outcomes).To(Equal([]wire.Outcome{wire.OutcomeLost, wire.OutcomeWritten}))
+			})
+		})
+	})
 })
+
+// faultyConn returns an error after every successful write, as if the network
+// connection faulted after the data was sent.
+type faultyConn struct {
+	net.Conn
+}
+
+func (conn faultyConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	if err == nil {
+		err = errors.New("faulty connection")
+	}
+	return n, err
+}
+
+// corruptMessage is a message received by a corruptMessageListener.
+type corruptMessage struct {
+	remote id.Signatory
+	header []byte
+	err    error
+}
+
+// corruptMessageListener sends every corrupt message that it receives to
+// itself.
+type corruptMessageListener chan corruptMessage
+
+func (listener corruptMessageListener) DidReceiveCorruptMessage(remote id.Signatory, header []byte, err error) {
+	listener <- corruptMessage{remote: remote, header: header, err: err}
+}
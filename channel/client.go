@@ -6,14 +6,118 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
+// ErrShutdown is returned when sending messages using a Client that has been
+// shutdown.
+var ErrShutdown = errors.New("client shutdown")
+
+// ErrOutboundFull is returned when sending a message that should be dropped
+// instead of waiting for room in the outbound queue of the remote peer (see
+// SendOptions.DropIfFull).
+var ErrOutboundFull = errors.New("outbound queue full")
+
+// A RateLimitError is returned when sending a message using a Client would
+// exceed the send rate limit for the remote peer, or the global send rate
+// limit. The message is not sent.
+type RateLimitError struct {
+	Remote id.Signatory
+	Global bool
+}
+
+// Error implements the error interface.
+func (err RateLimitError) Error() string {
+	if err.Global {
+		return fmt.Sprintf("sending to %v: global rate limit exceeded", err.Remote)
+	}
+	return fmt.Sprintf("sending to %v: rate limit exceeded", err.Remote)
+}
+
+// Priority of an outbound message. Messages with a higher priority are written
+// before messages with a lower priority that are waiting to be written to the
+// same remote peer.
+type Priority uint8
+
+// Enumerate all Priority values.
+const (
+	PriorityNormal = Priority(0)
+	PriorityHigh   = Priority(1)
+)
+
+// SendOptions override how an individual message is sent.
+type SendOptions struct {
+	// Priority of the message.
+	Priority Priority
+	// Timeout bounds how long sending the message can take, in addition to
+	// the context. When sending using a Transport, it also bounds how long the
+	// Transport will keep trying to dial the remote peer. Zero means that only
+	// the context is used.
+	Timeout time.Duration
+	// MaxDialAttempts bounds the number of failed attempts that a Transport
+	// will make to dial the remote peer, if it is not already connected. Zero
+	// means that there is no bound. It is ignored by Clients.
+	MaxDialAttempts int
+	// DropIfFull causes the message to be dropped, and ErrOutboundFull to be
+	// returned, when the outbound queue of the remote peer is full. Otherwise,
+	// sending blocks until there is room.
+	DropIfFull bool
+	// OnOutcome is an optional callback that is called once with the final
+	// Outcome of sending the message (see Envelope).
+	OnOutcome func(wire.Outcome)
+}
+
+// DefaultSendOptions returns the SendOptions used by Send.
+func DefaultSendOptions() SendOptions {
+	return SendOptions{
+		Priority:        PriorityNormal,
+		Timeout:         0,
+		MaxDialAttempts: 0,
+		DropIfFull:      false,
+		OnOutcome:       nil,
+	}
+}
+
+func (opts SendOptions) WithPriority(priority Priority) SendOptions {
+	opts.Priority = priority
+	return opts
+}
+
+func (opts SendOptions) WithTimeout(timeout time.Duration) SendOptions {
+	opts.Timeout = timeout
+	return opts
+}
+
+func (opts SendOptions) WithMaxDialAttempts(attempts int) SendOptions {
+	opts.MaxDialAttempts = attempts
+	return opts
+}
+
+func (opts SendOptions) WithDropIfFull(drop bool) SendOptions {
+	opts.DropIfFull = drop
+	return opts
+}
+
+func (opts SendOptions) WithOnOutcome(onOutcome func(wire.Outcome)) SendOptions {
+	opts.OnOutcome = onOutcome
+	return opts
+}
+
+// Notify the OnOutcome callback of the SendOptions, if there is one. It is
+// used by senders that reject a message before it reaches a Client.
+func (opts SendOptions) Notify(outcome wire.Outcome) {
+	if opts.OnOutcome != nil {
+		opts.OnOutcome(outcome)
+	}
+}
+
 type receiver struct {
 	ctx context.Context
 	f   func(id.Signatory, wire.Packet) error
@@ -32,7 +136,16 @@ type sharedChannel struct {
 	inbound <-chan wire.Packet
 	// outbound channel is sent messages that are destined for the remote peer
 	// to which the channel is bound.
-	outbound chan<- wire.Msg
+	outbound chan<- Envelope
+	// urgent channel is sent messages that are destined for the remote peer,
+	// and that should be written before messages on the outbound channel.
+	urgent chan<- Envelope
+	// rateLimiter restricts how quickly messages can be sent to the remote
+	// peer.
+	rateLimiter *rate.Limiter
+	// inFlight bounds the messages that have been sent to the remote peer,
+	// but whose outcome is not yet known.
+	inFlight *inFlight
 }
 
 type Msg struct {
@@ -46,6 +159,11 @@ type Client struct {
 
 	sharedChannelsMu *sync.RWMutex
 	sharedChannels   map[id.Signatory]*sharedChannel
+	shutdown         bool
+
+	rateLimiter *rate.Limiter
+	versions    *wireVersions
+	calls       *calls
 
 	inbound            chan Msg
 	receivers          chan receiver
@@ -54,35 +172,49 @@ type Client struct {
 }
 
 func NewClient(opts Options, self id.Signatory) *Client {
-	return &Client{
+	client := &Client{
 		opts: opts,
 		self: self,
 
 		sharedChannelsMu: new(sync.RWMutex),
 		sharedChannels:   map[id.Signatory]*sharedChannel{},
 
+		rateLimiter: rate.NewLimiter(opts.GlobalSendRateLimit, opts.maxSize()),
+		versions:    newWireVersions(opts.WireVersionSelector),
+		calls:       newCalls(),
+
 		inbound:            make(chan Msg),
 		receivers:          make(chan receiver),
 		receiversRunningMu: new(sync.Mutex),
 		receiversRunning:   false,
 	}
+	client.opts.borrowers = newBorrowers(opts.MaxMessageSize, client.noReceivers, client.kill)
+	return client
 }
 
-func (client *Client) Bind(remote id.Signatory) {
+// Bind a Channel to a remote peer, creating it if it does not exist, and
+// otherwise incrementing its references. ErrShutdown is returned, and no
+// Channel is bound, once the Client has been shutdown.
+func (client *Client) Bind(remote id.Signatory) error {
 	client.sharedChannelsMu.Lock()
 	defer client.sharedChannelsMu.Unlock()
 
+	if client.shutdown {
+		return ErrShutdown
+	}
+
 	shared, ok := client.sharedChannels[remote]
 	if ok {
 		shared.rc++
-		return
+		return nil
 	}
 
 	inbound := make(chan wire.Packet, client.opts.InboundBufferSize)
-	outbound := make(chan wire.Msg, client.opts.OutboundBufferSize)
+	outbound := make(chan Envelope, client.opts.OutboundBufferSize)
+	urgent := make(chan Envelope, client.opts.OutboundBufferSize)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	ch := New(client.opts, remote, inbound, outbound)
+	ch := NewWithUrgent(client.opts, remote, inbound, outbound, urgent)
 	go func() {
 		if err := ch.Run(ctx); err != nil {
 			if !errors.Is(err, context.Canceled) {
@@ -96,6 +228,14 @@ func (client *Client) Bind(remote id.Signatory) {
 			case <-ctx.Done():
 				return
 			case packet := <-inbound:
+				packet = client.traceReceive(remote, packet)
+				if client.opts.MessageObserver != nil {
+					client.opts.MessageObserver.ObserveReceive(remote, packet.Msg)
+				}
+				if packet.Msg.Type == wire.MsgTypeResp {
+					client.receiveResp(remote, packet.Msg)
+					continue
+				}
 				select {
 				case <-ctx.Done():
 					return
@@ -111,7 +251,12 @@ func (client *Client) Bind(remote id.Signatory) {
 		cancel:   cancel,
 		inbound:  inbound,
 		outbound: outbound,
+		urgent:   urgent,
+
+		rateLimiter: rate.NewLimiter(client.opts.SendRateLimit, client.opts.maxSize()),
+		inFlight:    newInFlight(client.opts.MaxInFlightMessages, client.opts.MaxInFlightBytes),
 	}
+	return nil
 }
 
 func (client *Client) Unbind(remote id.Signatory) {
@@ -159,22 +304,276 @@ func (client *Client) Attach(ctx context.Context, remote id.Signatory, conn net.
 }
 
 func (client *Client) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	return client.SendWithPriority(ctx, remote, msg, PriorityNormal)
+}
+
+// SendWithPriority sends a message to a remote peer. Messages with a high
+// priority skip ahead of messages with a normal priority that are waiting to be
+// written to the same remote peer. Messages with the same priority are written
+// in the order that they are sent.
+func (client *Client) SendWithPriority(ctx context.Context, remote id.Signatory, msg wire.Msg, priority Priority) error {
+	return client.SendWithOptions(ctx, remote, msg, DefaultSendOptions().WithPriority(priority))
+}
+
+// SendWithOptions sends a message to a remote peer, using SendOptions to
+// override the priority, timeout, and blocking behaviour of this message only.
+// If the SendOptions have an OnOutcome callback, it is called once the outcome
+// of sending the message is known (see wire.Outcome).
+func (client *Client) SendWithOptions(ctx context.Context, remote id.Signatory, msg wire.Msg, opts SendOptions) error {
+	env := Envelope{Msg: msg, OnOutcome: opts.OnOutcome}
 	client.sharedChannelsMu.RLock()
+	if client.shutdown {
+		client.sharedChannelsMu.RUnlock()
+		env.Notify(wire.OutcomeDropped)
+		return ErrShutdown
+	}
 	shared, ok := client.sharedChannels[remote]
 	if !ok {
 		client.sharedChannelsMu.RUnlock()
+		env.Notify(wire.OutcomeDropped)
 		return fmt.Errorf("channel not found: %v", remote)
 	}
 	client.sharedChannelsMu.RUnlock()
+	env, err := client.versions.apply(remote, env)
+	if err != nil {
+		env.Notify(wire.OutcomeDropped)
+		return err
+	}
+	env = client.traceSend(remote, env)
+	if client.opts.MessageObserver != nil {
+		client.opts.MessageObserver.ObserveSend(remote, env.Msg)
+	}
 
+	// Check the rate limit for the remote peer before checking the global
+	// rate limit, so that one remote peer that is being sent too many messages
+	// cannot use up the global rate limit.
+	now := time.Now()
+	n := env.Msg.SizeHint()
+	r := shared.rateLimiter.ReserveN(now, n)
+	if !r.OK() || r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		env.Notify(wire.OutcomeDropped)
+		return RateLimitError{Remote: remote}
+	}
+	global := client.rateLimiter.ReserveN(now, n)
+	if !global.OK() || global.DelayFrom(now) > 0 {
+		global.CancelAt(now)
+		r.CancelAt(now)
+		env.Notify(wire.OutcomeDropped)
+		return RateLimitError{Remote: remote, Global: true}
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	// Wait for room in the in-flight window of the remote peer. Once the
+	// message is tracked, notifying it of its outcome releases its room.
+	if err := shared.inFlight.acquire(ctx, n, opts.DropIfFull); err != nil {
+		r.CancelAt(now)
+		global.CancelAt(now)
+		if errors.Is(err, ErrOutboundFull) {
+			env.Notify(wire.OutcomeDropped)
+			return err
+		}
+		env.Notify(wire.OutcomeExpired)
+		return fmt.Errorf("sending message %w", err)
+	}
+	env = shared.inFlight.track(env, n)
+
+	outbound := shared.outbound
+	if opts.Priority >= PriorityHigh {
+		outbound = shared.urgent
+	}
+	if opts.DropIfFull {
+		select {
+		case outbound <- env:
+			return nil
+		default:
+			r.CancelAt(now)
+			global.CancelAt(now)
+			env.Notify(wire.OutcomeDropped)
+			return ErrOutboundFull
+		}
+	}
 	select {
 	case <-ctx.Done():
+		env.Notify(wire.OutcomeExpired)
 		return fmt.Errorf("sending message %w", ctx.Err())
-	case shared.outbound <- msg:
+	case outbound <- env:
 		return nil
 	}
 }
 
+// Shutdown the Client gracefully. New messages will no longer be accepted for
+// sending, and the Client will wait for all Channels to flush their outbound
+// messages (see the Flush method exposed by Channels). Once all Channels have
+// been flushed, or the context is done, all Channels are stopped, regardless of
+// their references. An error is returned if the context is done before all
+// Channels have been flushed, in which case some outbound messages might have
+// been dropped (or persisted, if a MessageQueue is being used).
+func (client *Client) Shutdown(ctx context.Context) error {
+	client.sharedChannelsMu.Lock()
+	client.shutdown = true
+	sharedChannels := make(map[id.Signatory]*sharedChannel, len(client.sharedChannels))
+	for remote, shared := range client.sharedChannels {
+		sharedChannels[remote] = shared
+	}
+	client.sharedChannelsMu.Unlock()
+
+	errs := make(chan error, len(sharedChannels))
+	for remote, shared := range sharedChannels {
+		go func(remote id.Signatory, shared *sharedChannel) {
+			if err := shared.ch.Flush(ctx); err != nil {
+				errs <- fmt.Errorf("flushing %v: %w", remote, err)
+				return
+			}
+			errs <- nil
+		}(remote, shared)
+	}
+	var err error
+	for range sharedChannels {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	client.sharedChannelsMu.Lock()
+	defer client.sharedChannelsMu.Unlock()
+
+	for remote, shared := range client.sharedChannels {
+		shared.cancel()
+		delete(client.sharedChannels, remote)
+	}
+	return err
+}
+
+// Connections returns a snapshot of all network connections that are currently
+// attached to the Channels of the Client, in no particular order.
+func (client *Client) Connections() []ConnInfo {
+	client.sharedChannelsMu.RLock()
+	defer client.sharedChannelsMu.RUnlock()
+
+	conns := make([]ConnInfo, 0, len(client.sharedChannels))
+	for _, shared := range client.sharedChannels {
+		if info, ok := shared.ch.ConnInfo(); ok {
+			info.WireVersion = client.WireVersion(info.Remote)
+			conns = append(conns, info)
+		}
+	}
+	return conns
+}
+
+// WireVersionStats returns a snapshot of the outcomes of messages sent using
+// each wire version, keyed by version. It is empty unless a
+// WireVersionSelector is set (see Options.WithWireVersionSelector).
+func (client *Client) WireVersionStats() map[uint16]WireVersionStats {
+	return client.versions.snapshot()
+}
+
+// WireVersion returns the wire version that is selected for messages sent to a
+// remote peer on the default stream. It returns zero if no WireVersionSelector
+// is set, in which case messages are sent using their own version.
+func (client *Client) WireVersion(remote id.Signatory) uint16 {
+	if client.versions.selector == nil {
+		return 0
+	}
+	return client.versions.selector(remote)
+}
+
+// CheckMessageQueue returns an error if the MessageQueue used by the Client
+// cannot persist messages. MessageQueues that do not expose a Check method (see
+// FileMessageQueue) are assumed to be usable.
+func (client *Client) CheckMessageQueue() error {
+	checker, ok := client.opts.MessageQueue.(interface{ Check() error })
+	if !ok {
+		return nil
+	}
+	return checker.Check()
+}
+
+// SendOnStream sends a message to a remote peer on a stream. Streams allow many
+// independent flows of messages to share the network connection to a remote
+// peer, and are demultiplexed by the remote peer using ReceiveStream. Messages
+// older than wire.MsgVersion2 are sent using wire.MsgVersion2, because older
+// versions cannot represent streams.
+func (client *Client) SendOnStream(ctx context.Context, remote id.Signatory, stream uint16, msg wire.Msg) error {
+	if msg.Version < wire.MsgVersion2 {
+		msg.Version = wire.MsgVersion2
+	}
+	msg.Stream = stream
+	return client.Send(ctx, remote, msg)
+}
+
+// ReceiveStream is the same as Receive, except that only messages sent on the
+// given stream are passed to the receiver. Each stream receiver is called from
+// its own goroutine, with up to InboundBufferSize messages buffered, so a slow
+// receiver for one stream does not block the delivery of messages on other
+// streams. Receivers registered using Receive are still passed all messages,
+// including those sent on streams.
+func (client *Client) ReceiveStream(ctx context.Context, stream uint16, f func(id.Signatory, wire.Packet) error) {
+	queue := make(chan Msg, client.opts.InboundBufferSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-queue:
+				if err := f(msg.From, msg.Packet); err != nil {
+					client.kill(msg.From, err)
+				}
+			}
+		}
+	}()
+	client.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		if packet.Msg.Version < wire.MsgVersion2 || packet.Msg.Stream != stream {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case queue <- Msg{Packet: packet, From: from}:
+		}
+		return nil
+	})
+}
+
+// kill the Channel to a remote peer, because a receiver returned an error.
+// When a channel is killed, its context will be cancelled, its underlying
+// network connections will be dropped, and sending will fail. A killed channel
+// can only be revived by completely unbinding all references, and binding a
+// new reference.
+func (client *Client) kill(remote id.Signatory, err error) {
+	client.opts.Logger.Error("filter", zap.String("remote", remote.String()), zap.Error(err))
+	client.sharedChannelsMu.Lock()
+	defer client.sharedChannelsMu.Unlock()
+	if shared, ok := client.sharedChannels[remote]; ok {
+		shared.cancel()
+	}
+}
+
+// ReceiveBorrowed is the same as Receive, except that the data of messages is
+// not copied before being passed to the receiver. Instead, the receiver is
+// lent the buffer into which the message was read, and must Release the
+// BorrowedPacket when it is done with it. The receiver is called synchronously
+// by the Channel that read the message, so it blocks the reading of further
+// messages from the remote peer, and it should return quickly. This is useful
+// for high-throughput receivers that process messages synchronously. If there
+// are no receivers registered using Receive (or ReceiveStream), messages are
+// never copied.
+func (client *Client) ReceiveBorrowed(ctx context.Context, f func(id.Signatory, *BorrowedPacket) error) {
+	client.opts.borrowers.add(ctx, f)
+}
+
+// noReceivers returns true if no receivers are registered using Receive.
+func (client *Client) noReceivers() bool {
+	client.receiversRunningMu.Lock()
+	defer client.receiversRunningMu.Unlock()
+
+	return !client.receiversRunning
+}
+
 func (client *Client) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) error) {
 	client.receiversRunningMu.Lock()
 	if client.receiversRunning {
@@ -205,18 +604,7 @@ func (client *Client) Receive(ctx context.Context, f func(id.Signatory, wire.Pac
 						// deletion.
 					default:
 						if err := receiver.f(msg.From, msg.Packet); err != nil {
-							// When a channel is killed, its context will be
-							// cancelled, its underlying network connections
-							// will be dropped, and sending will fail. A killed
-							// channel can only be revived by completely
-							// unbinding all references, and binding a new
-							// reference.
-							client.opts.Logger.Error("filter", zap.String("remote", msg.From.String()), zap.Error(err))
-							client.sharedChannelsMu.Lock()
-							if shared, ok := client.sharedChannels[msg.From]; ok {
-								shared.cancel()
-							}
-							client.sharedChannelsMu.Unlock()
+							client.kill(msg.From, err)
 						}
 						receivers[marker] = receiver
 						marker++
@@ -3,6 +3,9 @@ package channel_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/renproject/aw/channel"
@@ -192,4 +195,672 @@ var _ = Describe("Client", func() {
 			Expect(local.Attach(ctx, remotePrivKey.Signatory(), nil, nil, nil)).To(HaveOccurred())
 		})
 	})
+
+	Context("when shutting down", func() {
+		It("should flush pending messages and then reject new messages", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions().WithOutboundBufferSize(10),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			received := make(chan wire.Msg, 10)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+
+			// Send messages before there is any attached network connection,
+			// so that they are still pending when shutting down.
+			n := 5
+			for i := 0; i < n; i++ {
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte{byte(i)}})).To(Succeed())
+			}
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 10*time.Second)
+			defer shutdownCancel()
+			Expect(local.Shutdown(shutdownCtx)).To(Succeed())
+
+			for i := 0; i < n; i++ {
+				Eventually(received, 10*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte{byte(i)}})))
+			}
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{})).To(MatchError(channel.ErrShutdown))
+			Expect(local.Bind(remotePrivKey.Signatory())).To(MatchError(channel.ErrShutdown))
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{})).To(MatchError(channel.ErrShutdown))
+		})
+
+		It("should return an error if pending messages cannot be flushed", func() {
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions().WithOutboundBufferSize(1),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			Expect(local.Send(context.Background(), remotePrivKey.Signatory(), wire.Msg{})).To(Succeed())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Expect(local.Shutdown(ctx)).To(HaveOccurred())
+		})
+	})
+
+	Context("when sending faster than the rate limit", func() {
+		It("should reject messages to the remote peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithMaxMessageSize(64).
+					WithMaxFragmentedMessageSize(128).
+					WithOutboundBufferSize(10).
+					WithSendRateLimit(1),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote)
+			defer local.Unbind(remote)
+
+			// The burst is the maximum fragmented message size.
+			msg := wire.Msg{Data: make([]byte, 70)}
+			Expect(local.Send(ctx, remote, msg)).To(Succeed())
+			Expect(local.Send(ctx, remote, msg)).To(MatchError(channel.RateLimitError{Remote: remote}))
+		})
+
+		It("should reject messages to all remote peers when the global limit is exceeded", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote1 := id.NewPrivKey().Signatory()
+			remote2 := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithMaxMessageSize(64).
+					WithMaxFragmentedMessageSize(128).
+					WithOutboundBufferSize(10).
+					WithGlobalSendRateLimit(1),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote1)
+			defer local.Unbind(remote1)
+			local.Bind(remote2)
+			defer local.Unbind(remote2)
+
+			// The burst is the maximum fragmented message size.
+			msg := wire.Msg{Data: make([]byte, 70)}
+			Expect(local.Send(ctx, remote1, msg)).To(Succeed())
+			Expect(local.Send(ctx, remote2, msg)).To(MatchError(channel.RateLimitError{Remote: remote2, Global: true}))
+		})
+	})
+
+	Context("when receiving on streams", func() {
+		It("should not block other streams when one stream receiver is slow", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(
+				channel.DefaultOptions().WithInboundBufferSize(10),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			// The receiver for the first stream never returns.
+			remote.ReceiveStream(ctx, 1, func(from id.Signatory, packet wire.Packet) error {
+				<-ctx.Done()
+				return nil
+			})
+			received := make(chan wire.Msg, 1)
+			remote.ReceiveStream(ctx, 2, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			for i := 0; i < 3; i++ {
+				Expect(local.SendOnStream(ctx, remotePrivKey.Signatory(), 1, wire.Msg{Data: []byte("slow")})).To(Succeed())
+			}
+			Expect(local.SendOnStream(ctx, remotePrivKey.Signatory(), 2, wire.Msg{Data: []byte("fast")})).To(Succeed())
+
+			var msg wire.Msg
+			Eventually(received, 10*time.Second).Should(Receive(&msg))
+			Expect(msg.Version).To(Equal(wire.MsgVersion2))
+			Expect(msg.Stream).To(Equal(uint16(2)))
+			Expect(msg.Data).To(Equal([]byte("fast")))
+
+			// Newer versions are not downgraded.
+			Expect(local.SendOnStream(ctx, remotePrivKey.Signatory(), 2, wire.Msg{Version: wire.MsgVersion3, Data: []byte("newer")})).To(Succeed())
+			Eventually(received, 10*time.Second).Should(Receive(&msg))
+			Expect(msg.Version).To(Equal(wire.MsgVersion3))
+			Expect(msg.Data).To(Equal([]byte("newer")))
+		})
+	})
+
+	Context("when inspecting connections", func() {
+		It("should return a snapshot of all attached connections", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			Expect(local.Connections()).To(BeEmpty())
+
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			received := make(chan wire.Msg, 1)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+			Eventually(received, 10*time.Second).Should(Receive())
+
+			conns := local.Connections()
+			Expect(conns).To(HaveLen(1))
+			Expect(conns[0].Remote).To(Equal(remotePrivKey.Signatory()))
+			Expect(conns[0].Addr).ToNot(BeNil())
+			Expect(conns[0].BytesSent).To(BeNumerically(">", 0))
+			Expect(conns[0].QueueDepth).To(Equal(0))
+			Expect(conns[0].LastActivity).ToNot(BeTemporally("<", conns[0].AttachedAt))
+			Expect(conns[0].Encrypted).To(BeFalse())
+		})
+	})
+
+	Context("when sending with options", func() {
+		It("should drop messages or time out when the outbound queue is full", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().WithOutboundBufferSize(1),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote)
+			defer local.Unbind(remote)
+
+			// There is no attached network connection, so the first message
+			// fills the outbound queue.
+			Expect(local.Send(ctx, remote, wire.Msg{})).To(Succeed())
+
+			opts := channel.DefaultSendOptions().WithDropIfFull(true)
+			Expect(local.SendWithOptions(ctx, remote, wire.Msg{}, opts)).To(MatchError(channel.ErrOutboundFull))
+
+			opts = channel.DefaultSendOptions().WithTimeout(100 * time.Millisecond)
+			start := time.Now()
+			Expect(local.SendWithOptions(ctx, remote, wire.Msg{}, opts)).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	Context("when sending messages with outcome callbacks", func() {
+		It("should notify the outcome of every message", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			outcomes := make(chan wire.Outcome, 10)
+			msg := wire.Msg{}
+			notify := channel.DefaultSendOptions().WithOnOutcome(func(outcome wire.Outcome) { outcomes <- outcome })
+
+			local := channel.NewClient(
+				channel.DefaultOptions().WithOutboundBufferSize(1),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+
+			// There is no attached network connection, so the first message
+			// fills the outbound queue.
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, notify)).To(Succeed())
+			Consistently(outcomes, 100*time.Millisecond).ShouldNot(Receive())
+
+			opts := notify.WithDropIfFull(true)
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, opts)).ToNot(Succeed())
+			Expect(outcomes).To(Receive(Equal(wire.OutcomeDropped)))
+
+			opts = notify.WithTimeout(10 * time.Millisecond)
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, opts)).ToNot(Succeed())
+			Expect(outcomes).To(Receive(Equal(wire.OutcomeExpired)))
+
+			// Unbinding stops the Channel before the queued message has been
+			// written.
+			local.Unbind(remotePrivKey.Signatory())
+			Eventually(outcomes).Should(Receive(Equal(wire.OutcomeLost)))
+
+			// Once a network connection is attached, messages are written.
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, notify)).To(Succeed())
+			Eventually(outcomes, 10*time.Second).Should(Receive(Equal(wire.OutcomeWritten)))
+		})
+	})
+
+	Context("when the in-flight window of a remote peer is full", func() {
+		It("should wait until messages leave the window", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithOutboundBufferSize(10).
+					WithMaxInFlight(2, 0),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			// There is no attached network connection, so messages stay in
+			// flight, even though there is room in the outbound queue.
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), msg)).To(Succeed())
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), msg)).To(Succeed())
+
+			opts := channel.DefaultSendOptions().WithDropIfFull(true)
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, opts)).To(MatchError(channel.ErrOutboundFull))
+			opts = channel.DefaultSendOptions().WithTimeout(10 * time.Millisecond)
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, opts)).To(MatchError(context.DeadlineExceeded))
+
+			// Once a network connection is attached, the messages are written
+			// and there is room for more.
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+			received := make(chan wire.Msg, 3)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			opts = channel.DefaultSendOptions().WithTimeout(10 * time.Second)
+			Expect(local.SendWithOptions(ctx, remotePrivKey.Signatory(), msg, opts)).To(Succeed())
+			for i := 0; i < 3; i++ {
+				Eventually(received, 10*time.Second).Should(Receive(Equal(msg)))
+			}
+		})
+	})
+
+	Context("when selecting wire versions for remote peers", func() {
+		It("should send using the selected version and collect stats", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithWireVersionSelector(func(id.Signatory) uint16 { return wire.MsgVersion2 }),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+			received := make(chan wire.Msg, 2)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			// Messages are sent using the selected version, whatever their
+			// stream.
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), msg)).To(Succeed())
+			Eventually(received, 10*time.Second).Should(Receive(Equal(wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, Data: []byte("hello")})))
+			Expect(local.SendOnStream(ctx, remotePrivKey.Signatory(), 7, msg)).To(Succeed())
+			Eventually(received, 10*time.Second).Should(Receive(Equal(wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, Stream: 7, Data: []byte("hello")})))
+
+			Eventually(func() uint64 { return local.WireVersionStats()[wire.MsgVersion2].Written }, 5*time.Second).Should(Equal(uint64(2)))
+			stats := local.WireVersionStats()
+			Expect(stats).To(HaveLen(1))
+			Expect(stats[wire.MsgVersion2].Sent).To(Equal(uint64(2)))
+			Expect(stats[wire.MsgVersion2].Failed).To(Equal(uint64(0)))
+			Expect(stats[wire.MsgVersion2].Latency.Count).To(Equal(uint64(2)))
+		})
+
+		It("should not send messages that need a newer version than the selected version", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithOutboundBufferSize(1).
+					WithWireVersionSelector(func(id.Signatory) uint16 { return wire.MsgVersion4 }),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote)
+			defer local.Unbind(remote)
+
+			outcomes := make(chan wire.Outcome, 1)
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: []byte("hello"), Headers: []wire.Header{{Type: 1, Value: []byte("value")}}}
+			err := local.SendWithOptions(ctx, remote, msg, channel.DefaultSendOptions().WithOnOutcome(func(outcome wire.Outcome) { outcomes <- outcome }))
+			Expect(err).To(MatchError(channel.WireVersionError{Remote: remote, Version: wire.MsgVersion4, Required: wire.MsgVersion5}))
+			Expect(outcomes).To(Receive(Equal(wire.OutcomeDropped)))
+
+			msg.Headers = nil
+			Expect(local.Send(ctx, remote, msg)).To(Succeed())
+		})
+
+		It("should not send messages on a stream if the selected version cannot represent it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			remote := id.NewPrivKey().Signatory()
+			local := channel.NewClient(
+				channel.DefaultOptions().
+					WithOutboundBufferSize(1).
+					WithWireVersionSelector(func(id.Signatory) uint16 { return wire.MsgVersion1 }),
+				id.NewPrivKey().Signatory())
+			local.Bind(remote)
+			defer local.Unbind(remote)
+
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+			Expect(local.SendOnStream(ctx, remote, 7, msg)).To(MatchError(channel.WireVersionError{Remote: remote, Version: wire.MsgVersion1, Required: wire.MsgVersion2}))
+			Expect(local.Send(ctx, remote, msg)).To(Succeed())
+		})
+
+		It("should select a stable fraction of remote peers for the canary", func() {
+			sigs := make([]id.Signatory, 1000)
+			for i := range sigs {
+				sigs[i] = id.NewPrivKey().Signatory()
+			}
+			none := channel.CanaryWireVersion(0)
+			all := channel.CanaryWireVersion(1)
+			half := channel.CanaryWireVersion(0.5)
+			canaries := 0
+			for _, sig := range sigs {
+				Expect(none(sig)).To(Equal(wire.MsgVersion1))
+				Expect(all(sig)).To(Equal(wire.MsgVersion2))
+				Expect(half(sig)).To(Equal(half(sig)))
+				if half(sig) == wire.MsgVersion2 {
+					canaries++
+				}
+			}
+			Expect(canaries).To(BeNumerically("~", 500, 100))
+		})
+	})
+
+	Context("when receiving borrowed packets", func() {
+		It("should not re-use buffers until they are released", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			// Only borrowed receivers are registered, so messages are never
+			// copied.
+			borrowed := make(chan *channel.BorrowedPacket, 10)
+			remote.ReceiveBorrowed(ctx, func(from id.Signatory, packet *channel.BorrowedPacket) error {
+				borrowed <- packet
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			// The first packet is not released while the second packet is
+			// received, so it must not be overwritten.
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte("first")})).To(Succeed())
+			var first *channel.BorrowedPacket
+			Eventually(borrowed, 10*time.Second).Should(Receive(&first))
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: []byte("second")})).To(Succeed())
+			var second *channel.BorrowedPacket
+			Eventually(borrowed, 10*time.Second).Should(Receive(&second))
+			Expect(first.Msg.Data).To(Equal([]byte("first")))
+			Expect(second.Msg.Data).To(Equal([]byte("second")))
+			first.Release()
+			first.Release()
+			second.Release()
+
+			for i := 0; i < 5; i++ {
+				data := []byte(fmt.Sprintf("message %v", i))
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: data})).To(Succeed())
+				var packet *channel.BorrowedPacket
+				Eventually(borrowed, 10*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal(data))
+				packet.Release()
+			}
+		})
+
+		It("should copy messages for other receivers", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions(),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			borrowed := make(chan []byte, 10)
+			remote.ReceiveBorrowed(ctx, func(from id.Signatory, packet *channel.BorrowedPacket) error {
+				defer packet.Release()
+				borrowed <- append([]byte{}, packet.Msg.Data...)
+				return nil
+			})
+			received := make(chan wire.Packet, 10)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			for i := 0; i < 5; i++ {
+				data := []byte(fmt.Sprintf("message %v", i))
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: data})).To(Succeed())
+				Eventually(borrowed, 10*time.Second).Should(Receive(Equal(data)))
+				var packet wire.Packet
+				Eventually(received, 10*time.Second).Should(Receive(&packet))
+				Expect(packet.Msg.Data).To(Equal(data))
+			}
+		})
+	})
+
+	Context("when responding to messages", func() {
+		It("should handle messages concurrently and respond in order", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions().WithMaxConcurrentHandlersPerConn(4),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			// Earlier messages take longer to handle, so that responses would
+			// be sent out of order if they were sent as soon as they were
+			// ready.
+			running, maxRunning := int64(0), int64(0)
+			remote.Respond(ctx, func(from id.Signatory, packet wire.Packet) ([]wire.Msg, error) {
+				n := atomic.AddInt64(&running, 1)
+				defer atomic.AddInt64(&running, -1)
+				for {
+					max := atomic.LoadInt64(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+						break
+					}
+				}
+				i := binary.BigEndian.Uint64(packet.Msg.Data)
+				time.Sleep(time.Duration(4-i) * 100 * time.Millisecond)
+				return []wire.Msg{{Data: packet.Msg.Data}}, nil
+			})
+			received := make(chan uint64, 4)
+			local.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- binary.BigEndian.Uint64(packet.Msg.Data)
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			for i := uint64(0); i < 4; i++ {
+				data := [8]byte{}
+				binary.BigEndian.PutUint64(data[:], i)
+				Expect(local.Send(ctx, remotePrivKey.Signatory(), wire.Msg{Data: data[:]})).To(Succeed())
+			}
+			for i := uint64(0); i < 4; i++ {
+				Eventually(received, 10*time.Second).Should(Receive(Equal(i)))
+			}
+			Expect(atomic.LoadInt64(&maxRunning)).To(BeNumerically(">", 1))
+		})
+	})
+
+	Context("when calling a remote peer", func() {
+		It("should match responses to requests", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+			remote := channel.NewClient(
+				channel.DefaultOptions().WithMaxConcurrentHandlersPerConn(4),
+				remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			remote.HandleCalls(ctx, func(from id.Signatory, req wire.Req) ([]byte, error) {
+				Expect(from).To(Equal(localPrivKey.Signatory()))
+				if string(req.Data) == "fail" {
+					return nil, fmt.Errorf("failed")
+				}
+				return append([]byte("echo "), req.Data...), nil
+			})
+			// Responses are never passed to receivers.
+			received := make(chan wire.Msg, 1)
+			local.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			done := make(chan struct{})
+			for i := 0; i < 4; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					defer func() { done <- struct{}{} }()
+					data := []byte(fmt.Sprintf("%v", i))
+					resp, err := local.Call(ctx, remotePrivKey.Signatory(), wire.Req{Data: data})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(resp.Data).To(Equal(append([]byte("echo "), data...)))
+				}(i)
+			}
+			for i := 0; i < 4; i++ {
+				Eventually(done, 10*time.Second).Should(Receive())
+			}
+
+			_, err := local.Call(ctx, remotePrivKey.Signatory(), wire.Req{Data: []byte("fail")})
+			callErr := channel.CallError{}
+			Expect(errors.As(err, &callErr)).To(BeTrue())
+			Expect(callErr.Reason).To(Equal("failed"))
+			Consistently(received).ShouldNot(Receive())
+		})
+
+		It("should return an error if the context is done before the response", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			local := channel.NewClient(
+				channel.DefaultOptions(),
+				localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			callCtx, callCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer callCancel()
+			_, err := local.Call(callCtx, remotePrivKey.Signatory(), wire.Req{Data: []byte("hello")})
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,116 @@
+package channel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// ConnInfo is a snapshot of the network connection that is attached to a
+// Channel. It is intended for debugging endpoints and dashboards.
+type ConnInfo struct {
+	// Remote peer at the other end of the network connection.
+	Remote id.Signatory
+	// Addr of the remote end of the network connection.
+	Addr net.Addr
+	// AttachedAt is the time at which the network connection was attached.
+	AttachedAt time.Time
+	// LastActivity is the last time at which bytes were read from, or written
+	// to, the network connection.
+	LastActivity time.Time
+	// QueueDepth is the number of outbound messages that are waiting to be
+	// written to the remote peer.
+	QueueDepth int
+	// BytesSent is the number of bytes written to the network connection,
+	// including encoding overhead.
+	BytesSent uint64
+	// BytesReceived is the number of bytes read from the network connection,
+	// including encoding overhead.
+	BytesReceived uint64
+	// Encrypted is true if the network connection is encrypted by its
+	// encoder, in which case Session is the statistics of its session.
+	Encrypted bool
+	Session   codec.SessionStats
+	// WireVersion selected for messages sent to the remote peer, or zero if
+	// messages are sent using their own version (see Client.WireVersion). It
+	// is only set by Client.Connections.
+	WireVersion uint16
+}
+
+// connStats are updated by the read and write loops of a Channel while a
+// network connection is attached. The 64-bit fields are first, because they
+// are accessed atomically.
+type connStats struct {
+	bytesSent     uint64
+	bytesReceived uint64
+	lastActivity  int64 // Unix nanoseconds.
+
+	addr       net.Addr
+	attachedAt time.Time
+	enc        codec.Encoder
+}
+
+func newConnStats(addr net.Addr, enc codec.Encoder) *connStats {
+	now := time.Now()
+	return &connStats{
+		lastActivity: now.UnixNano(),
+		addr:         addr,
+		attachedAt:   now,
+		enc:          enc,
+	}
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	io.Writer
+	stats *connStats
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddUint64(&w.stats.bytesSent, uint64(n))
+	atomic.StoreInt64(&w.stats.lastActivity, time.Now().UnixNano())
+	return n, err
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	stats *connStats
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddUint64(&r.stats.bytesReceived, uint64(n))
+	atomic.StoreInt64(&r.stats.lastActivity, time.Now().UnixNano())
+	return n, err
+}
+
+// ConnInfo returns a snapshot of the network connection that is currently
+// attached to the Channel, and false if there is no attached network
+// connection.
+func (ch *Channel) ConnInfo() (ConnInfo, bool) {
+	ch.connMu.Lock()
+	stats := ch.conn
+	ch.connMu.Unlock()
+
+	if stats == nil {
+		return ConnInfo{}, false
+	}
+	session, encrypted := codec.Stats(stats.enc)
+	return ConnInfo{
+		Remote:        ch.remote,
+		Addr:          stats.addr,
+		AttachedAt:    stats.attachedAt,
+		LastActivity:  time.Unix(0, atomic.LoadInt64(&stats.lastActivity)),
+		QueueDepth:    len(ch.outbound) + len(ch.urgent),
+		BytesSent:     atomic.LoadUint64(&stats.bytesSent),
+		BytesReceived: atomic.LoadUint64(&stats.bytesReceived),
+		Encrypted:     encrypted,
+		Session:       session,
+	}, true
+}
@@ -0,0 +1,100 @@
+package channel
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// DeliveryMode defines what a Channel does with a message that it was writing
+// when the network connection faulted. The message might, or might not, have
+// been received by the remote peer.
+type DeliveryMode uint8
+
+// Enumerate all DeliveryMode values.
+const (
+	// DeliveryResend messages are written again when a new network connection
+	// is attached. No nonces are written, so the remote peer receives the
+	// message twice if it was received before the network connection faulted.
+	// It is the default (see DefaultDeliveryMode), because all remote peers
+	// can read the messages that are written.
+	DeliveryResend = DeliveryMode(0)
+	// DeliveryAtLeastOnce messages are written again when a new network
+	// connection is attached. Messages are preceded by nonces, so that the
+	// receiving Channel can drop messages that it has already received.
+	DeliveryAtLeastOnce = DeliveryMode(1)
+	// DeliveryAtMostOnce messages are dropped, and their senders are notified
+	// that they were lost. This is useful for messages that must not be
+	// received twice by remote peers that do not deduplicate messages.
+	DeliveryAtMostOnce = DeliveryMode(2)
+)
+
+// String returns a human-readable representation of the DeliveryMode.
+func (mode DeliveryMode) String() string {
+	switch mode {
+	case DeliveryResend:
+		return "resend"
+	case DeliveryAtLeastOnce:
+		return "at-least-once"
+	case DeliveryAtMostOnce:
+		return "at-most-once"
+	default:
+		return "unknown"
+	}
+}
+
+// nonces generates the nonces of messages written by a Channel. The first nonce
+// is random, so that a new Channel to the same remote peer is unlikely to reuse
+// nonces that were recently seen by the remote peer. Zero is never generated,
+// because it is the nonce of messages that do not have one.
+type nonces uint64
+
+func newNonces() nonces {
+	return nonces(rand.Uint64())
+}
+
+// next returns the next nonce.
+func (n *nonces) next() uint64 {
+	if *n++; *n == 0 {
+		*n++
+	}
+	return uint64(*n)
+}
+
+// numRecentNonces is the number of recently received nonces that are
+// remembered. A message is only written more than once when its network
+// connection faults, and draining connections can still deliver a few messages
+// after a new connection is attached, so only a few nonces are needed.
+const numRecentNonces = 64
+
+// recentNonces remembers the nonces of recently received messages. It is safe
+// for concurrent use, because a draining reader and a new reader can be
+// receiving messages at the same time.
+type recentNonces struct {
+	mu     *sync.Mutex
+	next   int
+	nonces [numRecentNonces]uint64
+}
+
+func newRecentNonces() *recentNonces {
+	return &recentNonces{mu: new(sync.Mutex)}
+}
+
+// seen returns true if the nonce has been recently seen, otherwise it
+// remembers the nonce and returns false. The zero nonce is never seen.
+func (recent *recentNonces) seen(nonce uint64) bool {
+	if nonce == 0 {
+		return false
+	}
+
+	recent.mu.Lock()
+	defer recent.mu.Unlock()
+
+	for _, n := range recent.nonces {
+		if n == nonce {
+			return true
+		}
+	}
+	recent.nonces[recent.next] = nonce
+	recent.next = (recent.next + 1) % numRecentNonces
+	return false
+}
@@ -0,0 +1,21 @@
+package channel
+
+import "github.com/renproject/aw/wire"
+
+// An Envelope is a message on an outbound messaging channel of a Channel,
+// together with an optional callback that is called once with the final
+// Outcome of sending the message (see SendOptions.WithOnOutcome). The callback
+// is never sent on-the-wire, and is not preserved when the message is
+// persisted. It is called synchronously by the Channel, so it should return
+// quickly.
+type Envelope struct {
+	Msg       wire.Msg
+	OnOutcome func(wire.Outcome)
+}
+
+// Notify the OnOutcome callback of the Envelope, if there is one.
+func (env Envelope) Notify(outcome wire.Outcome) {
+	if env.OnOutcome != nil {
+		env.OnOutcome(outcome)
+	}
+}
@@ -0,0 +1,68 @@
+package channel
+
+import (
+	"math/bits"
+)
+
+// A sizeHistogram counts observed message sizes in power-of-two buckets. It is
+// used to adaptively size buffers, so that connections which only ever see
+// small messages do not hold on to buffers large enough for the maximum message
+// size.
+type sizeHistogram struct {
+	n       int
+	buckets [numSizeBuckets]int
+}
+
+// numSizeBuckets is enough to cover all message sizes up to 128TB, which is far
+// beyond any practical maximum message size.
+const numSizeBuckets = 48
+
+// observe a message size.
+func (h *sizeHistogram) observe(size int) {
+	h.n++
+	h.buckets[bucketOf(size)]++
+}
+
+// percentile returns the smallest power of two that is greater than, or equal
+// to, the given percentage of observed message sizes. It returns zero if no
+// sizes have been observed.
+func (h *sizeHistogram) percentile(p int) int {
+	if h.n == 0 {
+		return 0
+	}
+	target := (h.n*p + 99) / 100
+	seen := 0
+	for i, count := range h.buckets {
+		if seen += count; seen >= target {
+			return 1 << i
+		}
+	}
+	return 1 << (numSizeBuckets - 1)
+}
+
+// reset all observations.
+func (h *sizeHistogram) reset() {
+	*h = sizeHistogram{}
+}
+
+func bucketOf(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	if b := bits.Len(uint(size - 1)); b < numSizeBuckets {
+		return b
+	}
+	return numSizeBuckets - 1
+}
+
+// clampBufferSize rounds a size up to the next power of two, and then restricts
+// it to be within the given bounds.
+func clampBufferSize(size, min, max int) int {
+	if size <= min {
+		return min
+	}
+	if size = 1 << bucketOf(size); size > max {
+		return max
+	}
+	return size
+}
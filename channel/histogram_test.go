@@ -0,0 +1,41 @@
+package channel
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Size histogram", func() {
+	Context("when no sizes have been observed", func() {
+		It("should return zero", func() {
+			h := sizeHistogram{}
+			Expect(h.percentile(90)).To(Equal(0))
+		})
+	})
+
+	Context("when sizes have been observed", func() {
+		It("should return the power of two that covers the percentile", func() {
+			h := sizeHistogram{}
+			for i := 0; i < 95; i++ {
+				h.observe(100)
+			}
+			for i := 0; i < 5; i++ {
+				h.observe(100000)
+			}
+			Expect(h.percentile(90)).To(Equal(128))
+			Expect(h.percentile(100)).To(Equal(131072))
+
+			h.reset()
+			Expect(h.percentile(90)).To(Equal(0))
+		})
+	})
+
+	Context("when clamping buffer sizes", func() {
+		It("should round up and stay within bounds", func() {
+			Expect(clampBufferSize(0, 4096, 1<<20)).To(Equal(4096))
+			Expect(clampBufferSize(5000, 4096, 1<<20)).To(Equal(8192))
+			Expect(clampBufferSize(8192, 4096, 1<<20)).To(Equal(8192))
+			Expect(clampBufferSize(1<<30, 4096, 1<<20)).To(Equal(1 << 20))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package channel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+)
+
+// inFlight bounds the messages, and bytes, that have been sent to a remote
+// peer but whose outcome is not yet known (see wire.Outcome). This bounds the
+// memory held for a slow remote peer, because messages that are waiting to be
+// written (or written again) are counted until they are written, dropped,
+// persisted, or lost. A message is always allowed when nothing is in flight,
+// even if it is larger than the maximum number of bytes.
+type inFlight struct {
+	maxMsgs  int
+	maxBytes int
+
+	mu    *sync.Mutex
+	msgs  int
+	bytes int
+	// room is closed, and replaced, whenever messages leave the window, so
+	// that senders waiting for room can check again.
+	room chan struct{}
+}
+
+func newInFlight(maxMsgs, maxBytes int) *inFlight {
+	return &inFlight{
+		maxMsgs:  maxMsgs,
+		maxBytes: maxBytes,
+
+		mu:   new(sync.Mutex),
+		room: make(chan struct{}),
+	}
+}
+
+// tryAcquire room for a message of the given size. It returns false, and a
+// channel that is closed when there might be room, if there is no room.
+func (window *inFlight) tryAcquire(size int) (bool, <-chan struct{}) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	if window.msgs > 0 {
+		if window.maxMsgs > 0 && window.msgs+1 > window.maxMsgs {
+			return false, window.room
+		}
+		if window.maxBytes > 0 && window.bytes+size > window.maxBytes {
+			return false, window.room
+		}
+	}
+	window.msgs++
+	window.bytes += size
+	return true, nil
+}
+
+// acquire room for a message of the given size, waiting until there is room or
+// the context is done. If drop is true, it does not wait.
+func (window *inFlight) acquire(ctx context.Context, size int, drop bool) error {
+	for {
+		ok, room := window.tryAcquire(size)
+		if ok {
+			return nil
+		}
+		if drop {
+			return ErrOutboundFull
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-room:
+		}
+	}
+}
+
+// release the room held by a message of the given size.
+func (window *inFlight) release(size int) {
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	window.msgs--
+	window.bytes -= size
+	close(window.room)
+	window.room = make(chan struct{})
+}
+
+// track the message, so that its room is released once its outcome is known.
+// The OnOutcome callback of the Envelope is wrapped, and still called.
+func (window *inFlight) track(env Envelope, size int) Envelope {
+	onOutcome := env.OnOutcome
+	env.OnOutcome = func(outcome wire.Outcome) {
+		window.release(size)
+		if onOutcome != nil {
+			onOutcome(outcome)
+		}
+	}
+	return env
+}
@@ -0,0 +1,38 @@
+package channel
+
+import (
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// A MessageObserver is notified about every message that is sent, or
+// received, by a Client. It is intended for counting messages in a metrics
+// system. Messages that are only used by Channels (such as keep-alive
+// messages) are not observed. Methods are called synchronously from the
+// goroutines that send and receive messages, so implementations should
+// return quickly, and must not keep the message.
+type MessageObserver interface {
+	// ObserveSend is called when a message is sent to a remote peer, before
+	// it is rate limited or queued.
+	ObserveSend(remote id.Signatory, msg wire.Msg)
+	// ObserveReceive is called when a message is received from a remote
+	// peer, before it is passed to receivers.
+	ObserveReceive(remote id.Signatory, msg wire.Msg)
+}
+
+// A CorruptMessageListener is notified about every message that is received
+// by a Channel, but cannot be read, because it cannot be authenticated (see
+// codec.AuthenticationError), or because it cannot be unmarshaled. Remote
+// peers that send corrupt messages are either faulty or malicious, so the
+// listener is intended for scoring them down, or banning them. The header is
+// a copy of the first bytes of the message (at most codec.MaxHeaderSize
+// bytes), so it can be kept. Methods are called synchronously from the
+// goroutine that reads messages, so implementations should return quickly.
+type CorruptMessageListener interface {
+	// DidReceiveCorruptMessage is called when a message that cannot be read
+	// is received from a remote peer. Messages that cannot be authenticated
+	// close the network connection, because the remote peer can no longer be
+	// trusted to be in sync with the session. Messages that cannot be
+	// unmarshaled are dropped.
+	DidReceiveCorruptMessage(remote id.Signatory, header []byte, err error)
+}
@@ -3,26 +3,78 @@ package channel
 import (
 	"time"
 
+	"github.com/renproject/aw/options"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
 
 var (
-	DefaultDrainTimeout       = 30 * time.Second
-	DefaultMaxMessageSize     = 4 * 1024 * 1024         // 4MB
-	DefaultRateLimit          = rate.Limit(1024 * 1024) // 1MB per second
-	DefaultInboundBufferSize  = 0
-	DefaultOutboundBufferSize = 0
+	DefaultDrainTimeout             = 30 * time.Second
+	DefaultMaxMessageSize           = 4 * 1024 * 1024         // 4MB
+	DefaultRateLimit                = rate.Limit(1024 * 1024) // 1MB per second
+	DefaultInboundBufferSize        = 0
+	DefaultOutboundBufferSize       = 0
+	DefaultMinBufferSize            = 4 * 1024 // 4KB
+	DefaultBufferIdleTimeout        = time.Minute
+	DefaultSendRateLimit            = rate.Inf
+	DefaultGlobalSendRateLimit      = rate.Inf
+	DefaultKeepAliveInterval        = time.Duration(0)
+	DefaultRekeyInterval            = time.Duration(0)
+	DefaultRekeyBytes               = 0
+	DefaultDeliveryMode             = DeliveryResend
+	DefaultMessageRateLimit         = rate.Inf
+	DefaultMessageBurst             = 0
+	DefaultMaxInFlightMessages      = 1024
+	DefaultMaxInFlightBytes         = 4 * DefaultMaxMessageSize // 16MB
+	DefaultCompressionThreshold     = 1024                      // 1KB
+	DefaultMaxFragmentedMessageSize = 64 * 1024 * 1024          // 64MB
+	DefaultMaxReassemblyBytes       = DefaultMaxFragmentedMessageSize
+	DefaultReassemblyTimeout        = 30 * time.Second
+	DefaultMaxBatchBytes            = 64 * 1024 // 64KB
+
+	DefaultMaxConcurrentHandlersPerConn = 1
 )
 
 // Options for parameterizing the behaviour of a Channel.
 type Options struct {
-	Logger             *zap.Logger
-	DrainTimeout       time.Duration
-	MaxMessageSize     int
-	RateLimit          rate.Limit
-	InboundBufferSize  int
-	OutboundBufferSize int
+	Logger                   *zap.Logger
+	DrainTimeout             time.Duration
+	MaxMessageSize           int
+	RateLimit                rate.Limit
+	InboundBufferSize        int
+	OutboundBufferSize       int
+	MessageQueue             MessageQueue
+	MinBufferSize            int
+	BufferIdleTimeout        time.Duration
+	SendRateLimit            rate.Limit
+	GlobalSendRateLimit      rate.Limit
+	KeepAliveInterval        time.Duration
+	RekeyInterval            time.Duration
+	RekeyBytes               int
+	TimingObserver           TimingObserver
+	TimingSampleRate         float64
+	DeliveryMode             DeliveryMode
+	MessageRateLimit         rate.Limit
+	MessageBurst             int
+	MaxInFlightMessages      int
+	MaxInFlightBytes         int
+	WireVersionSelector      WireVersionSelector
+	MessageObserver          MessageObserver
+	CorruptMessageListener   CorruptMessageListener
+	Tracer                   Tracer
+	CompressionThreshold     int
+	MaxFragmentedMessageSize int
+	MaxReassemblyBytes       int
+	ReassemblyTimeout        time.Duration
+	MaxBatchBytes            int
+	ContentType              wire.ContentType
+
+	MaxConcurrentHandlersPerConn int
+
+	// borrowers are set by Clients for the Channels that they bind.
+	borrowers *borrowers
 }
 
 // DefaultOptions returns Options with sane defaults.
@@ -32,12 +84,32 @@ func DefaultOptions() Options {
 		panic(err)
 	}
 	return Options{
-		Logger:             logger,
-		DrainTimeout:       DefaultDrainTimeout,
-		MaxMessageSize:     DefaultMaxMessageSize,
-		RateLimit:          DefaultRateLimit,
-		InboundBufferSize:  DefaultInboundBufferSize,
-		OutboundBufferSize: DefaultOutboundBufferSize,
+		Logger:                   logger,
+		DrainTimeout:             DefaultDrainTimeout,
+		MaxMessageSize:           DefaultMaxMessageSize,
+		RateLimit:                DefaultRateLimit,
+		InboundBufferSize:        DefaultInboundBufferSize,
+		OutboundBufferSize:       DefaultOutboundBufferSize,
+		MinBufferSize:            DefaultMinBufferSize,
+		BufferIdleTimeout:        DefaultBufferIdleTimeout,
+		SendRateLimit:            DefaultSendRateLimit,
+		GlobalSendRateLimit:      DefaultGlobalSendRateLimit,
+		KeepAliveInterval:        DefaultKeepAliveInterval,
+		RekeyInterval:            DefaultRekeyInterval,
+		RekeyBytes:               DefaultRekeyBytes,
+		DeliveryMode:             DefaultDeliveryMode,
+		MessageRateLimit:         DefaultMessageRateLimit,
+		MessageBurst:             DefaultMessageBurst,
+		MaxInFlightMessages:      DefaultMaxInFlightMessages,
+		MaxInFlightBytes:         DefaultMaxInFlightBytes,
+		CompressionThreshold:     DefaultCompressionThreshold,
+		MaxFragmentedMessageSize: DefaultMaxFragmentedMessageSize,
+		MaxReassemblyBytes:       DefaultMaxReassemblyBytes,
+		ReassemblyTimeout:        DefaultReassemblyTimeout,
+		MaxBatchBytes:            DefaultMaxBatchBytes,
+		ContentType:              wire.ContentTypeSurge,
+
+		MaxConcurrentHandlersPerConn: DefaultMaxConcurrentHandlersPerConn,
 	}
 }
 
@@ -59,8 +131,8 @@ func (opts Options) WithDrainTimeout(timeout time.Duration) Options {
 
 // WithMaxMessageSize sets the maximum number of bytes that a channel will read
 // at one time. This number restricts the maximum message size that remote peers
-// can send, defines the buffer size used for unmarshalling messages, and
-// defines the rate limit burst.
+// can send, defines the buffer size used for unmarshalling messages, bounds the
+// size of adaptive write buffers, and defines the rate limit burst.
 func (opts Options) WithMaxMessageSize(maxMessageSize int) Options {
 	opts.MaxMessageSize = maxMessageSize
 	return opts
@@ -74,6 +146,34 @@ func (opts Options) WithRateLimit(rateLimit rate.Limit) Options {
 	return opts
 }
 
+// WithMessageRateLimit sets the messages-per-second rate limit, and burst, that
+// will be enforced on the messages received from each remote peer. Each remote
+// peer can send up to burst messages at once, and this allowance refills at
+// the rate limit, one message at a time. The allowance belongs to the remote
+// peer, rather than its network connection, so reconnecting does not refill
+// it. If a remote peer exceeds this limit, then its network connection will be
+// closed. Keep-alive messages are not counted. By default, there is no limit.
+func (opts Options) WithMessageRateLimit(rateLimit rate.Limit, burst int) Options {
+	opts.MessageRateLimit = rateLimit
+	opts.MessageBurst = burst
+	return opts
+}
+
+// WithMaxInFlight sets the maximum number of messages, and bytes, that a
+// Client will hold for each remote peer while their outcome is not yet known
+// (see wire.Outcome). Messages count towards this maximum from when they are
+// sent until they are written, dropped, persisted, or lost, so a slow remote
+// peer holds a bounded amount of memory. Once the maximum is reached, sending
+// blocks (or fails with ErrOutboundFull, see SendOptions.DropIfFull) until
+// there is room. One message is always allowed, even if it is larger than the
+// maximum number of bytes. A non-positive maximum means that there is no
+// maximum.
+func (opts Options) WithMaxInFlight(msgs, bytes int) Options {
+	opts.MaxInFlightMessages = msgs
+	opts.MaxInFlightBytes = bytes
+	return opts
+}
+
 // WithInboundBufferSize defines the number of inbound messages that can be
 // buffered in memory before back-pressure will prevent the buffering of new
 // inbound messages.
@@ -89,3 +189,267 @@ func (opts Options) WithOutboundBufferSize(size int) Options {
 	opts.OutboundBufferSize = size
 	return opts
 }
+
+// WithMessageQueue sets the MessageQueue used to persist outbound messages that
+// have not been written when a Channel stops running. These messages will be
+// written by the next Channel that is run for the same remote peer. By
+// default, no MessageQueue is used and such messages are dropped.
+func (opts Options) WithMessageQueue(queue MessageQueue) Options {
+	opts.MessageQueue = queue
+	return opts
+}
+
+// WithMinBufferSize sets the smallest size of the buffers used for reading from,
+// and writing to, network connections. Write buffers grow, up to the maximum
+// message size, to fit the 90th percentile of recently written message sizes.
+func (opts Options) WithMinBufferSize(size int) Options {
+	opts.MinBufferSize = size
+	return opts
+}
+
+// WithBufferIdleTimeout sets the duration after which a Channel that has not
+// written any messages will forget the message sizes it has observed, and
+// shrink its write buffers back to the minimum buffer size.
+func (opts Options) WithBufferIdleTimeout(timeout time.Duration) Options {
+	opts.BufferIdleTimeout = timeout
+	return opts
+}
+
+// WithSendRateLimit sets the bytes-per-second rate limit that a Client enforces
+// on the messages being sent to each remote peer. The burst is the maximum
+// fragmented message size, or the maximum message size if it is larger (see
+// WithMaxFragmentedMessageSize). Messages that would exceed this limit are rejected with a
+// RateLimitError, instead of being sent. By default, there is no limit.
+func (opts Options) WithSendRateLimit(rateLimit rate.Limit) Options {
+	opts.SendRateLimit = rateLimit
+	return opts
+}
+
+// WithGlobalSendRateLimit sets the bytes-per-second rate limit that a Client
+// enforces on the messages being sent to all remote peers combined. The burst
+// is the same as the burst of WithSendRateLimit. Messages that would exceed
+// this limit are rejected with a RateLimitError, instead of being sent. By
+// default, there is no limit.
+func (opts Options) WithGlobalSendRateLimit(rateLimit rate.Limit) Options {
+	opts.GlobalSendRateLimit = rateLimit
+	return opts
+}
+
+// WithKeepAliveInterval sets the longest duration that an attached network
+// connection can be idle before the Channel writes a keep-alive message to it.
+// This stops middleboxes (such as NATs) from silently dropping idle network
+// connections, and detects dead network connections early, because writing to
+// them will fail. Keep-alive messages are dropped by the receiving Channel. A
+// non-positive interval disables keep-alive messages, which is the default.
+func (opts Options) WithKeepAliveInterval(interval time.Duration) Options {
+	opts.KeepAliveInterval = interval
+	return opts
+}
+
+// WithRekeyInterval sets how long an attached network connection can use one
+// key before the Channel rotates the key of its encoder (see
+// codec.RekeyEncoder). Before rotating, the Channel writes a rekey message, so
+// that the receiving Channel rotates the key of its decoder at the same point.
+// This bounds how many messages are exposed by the compromise of one key. Keys
+// are only rotated before writing a message, so idle network connections are
+// not rekeyed. Both peers must support rekey messages. A non-positive interval
+// disables rekeying by time, which is the default.
+func (opts Options) WithRekeyInterval(interval time.Duration) Options {
+	opts.RekeyInterval = interval
+	return opts
+}
+
+// WithRekeyBytes sets how many bytes an attached network connection can write
+// using one key before the Channel rotates the key of its encoder (see
+// WithRekeyInterval). A non-positive number disables rekeying by bytes, which
+// is the default.
+func (opts Options) WithRekeyBytes(n int) Options {
+	opts.RekeyBytes = n
+	return opts
+}
+
+// WithTimingObserver sets the TimingObserver that is given a breakdown of the
+// time spent reading and writing messages, and the fraction of messages that
+// are sampled (between 0 and 1). By default, there is no TimingObserver and
+// no timings are measured.
+func (opts Options) WithTimingObserver(observer TimingObserver, sampleRate float64) Options {
+	opts.TimingObserver = observer
+	opts.TimingSampleRate = sampleRate
+	return opts
+}
+
+// WithDeliveryMode sets the DeliveryMode used for messages that were being
+// written when their network connection faulted. By default, messages are
+// written again, without nonces. Delivering messages at least once should only
+// be enabled when all remote peers can read nonces, so that the receiving
+// Channel can drop duplicates.
+func (opts Options) WithDeliveryMode(mode DeliveryMode) Options {
+	opts.DeliveryMode = mode
+	return opts
+}
+
+// WithWireVersionSelector sets the WireVersionSelector used by a Client to
+// choose the wire version of messages sent to each remote peer (see
+// CanaryWireVersion). While a WireVersionSelector is set, the Client collects
+// WireVersionStats for each version (see Client.WireVersionStats). Receiving
+// Channels accept all versions, regardless of this option. By default, there
+// is no WireVersionSelector, and messages are sent using the version set by
+// the sender.
+func (opts Options) WithWireVersionSelector(selector WireVersionSelector) Options {
+	opts.WireVersionSelector = selector
+	return opts
+}
+
+// WithMessageObserver sets the MessageObserver that is notified about every
+// message sent, or received, by a Client. By default, there is no
+// MessageObserver.
+func (opts Options) WithMessageObserver(observer MessageObserver) Options {
+	opts.MessageObserver = observer
+	return opts
+}
+
+// WithCorruptMessageListener sets the CorruptMessageListener that is notified
+// about every message received by a Channel that cannot be authenticated, or
+// unmarshaled. By default, there is no CorruptMessageListener, and corrupt
+// messages are only logged.
+func (opts Options) WithCorruptMessageListener(listener CorruptMessageListener) Options {
+	opts.CorruptMessageListener = listener
+	return opts
+}
+
+// WithTracer sets the Tracer used to start spans for messages sent, and
+// received, by a Client, and for dials and handshakes by the Transport that
+// uses the Client. The TraceContexts of messages are only sent to remote peers
+// that are selected for wire.MsgVersion3 (see WithWireVersionSelector). By
+// default, there is no Tracer.
+func (opts Options) WithTracer(tracer Tracer) Options {
+	opts.Tracer = tracer
+	return opts
+}
+
+// WithCompressionThreshold sets the minimum size of the data of messages that
+// are compressed before they are written. Only messages that are sent using
+// wire.MsgVersion4 are compressed, so compression is only used with remote
+// peers that have negotiated it (see WithWireVersionSelector). Smaller
+// messages are not worth the time spent compressing them. Zero disables
+// compression. By default, the threshold is 1KB.
+func (opts Options) WithCompressionThreshold(threshold int) Options {
+	opts.CompressionThreshold = threshold
+	return opts
+}
+
+// WithMaxFragmentedMessageSize sets the maximum size of messages that are
+// larger than the maximum message size. These messages are written as
+// fragments that are no larger than the maximum message size, and are
+// reassembled by the remote peer (see wire.Fragment). Only wire.MsgVersion4
+// (or later) messages are fragmented, because older remote peers cannot
+// reassemble them, so large messages of older versions are dropped when they
+// are written. Messages that are larger than this maximum are dropped when
+// they are written, and rejected when they are reassembled, so both peers
+// should use the same maximum. Fragments count against the rate
+// limit of the remote peer like any other message (see WithRateLimit). Zero
+// disables fragmentation. By default, the maximum is 64MB.
+func (opts Options) WithMaxFragmentedMessageSize(size int) Options {
+	opts.MaxFragmentedMessageSize = size
+	return opts
+}
+
+// maxSize returns the maximum size of messages, whether or not they are
+// fragmented.
+func (opts Options) maxSize() int {
+	if opts.MaxFragmentedMessageSize > opts.MaxMessageSize {
+		return opts.MaxFragmentedMessageSize
+	}
+	return opts.MaxMessageSize
+}
+
+// WithMaxReassemblyBytes sets the maximum number of bytes used by each network
+// connection to reassemble fragmented messages (see
+// WithMaxFragmentedMessageSize). Fragments of new messages are dropped while
+// the messages being reassembled use this many bytes. By default, the maximum
+// is the same as the maximum size of fragmented messages.
+func (opts Options) WithMaxReassemblyBytes(n int) Options {
+	opts.MaxReassemblyBytes = n
+	return opts
+}
+
+// WithReassemblyTimeout sets how long a Channel waits for all of the fragments
+// of a fragmented message, after reading the first one. If the fragments are
+// not all read before the timeout, the message is dropped. By default, the
+// timeout is 30 seconds.
+func (opts Options) WithReassemblyTimeout(timeout time.Duration) Options {
+	opts.ReassemblyTimeout = timeout
+	return opts
+}
+
+// WithMaxBatchBytes sets the maximum size of batches of messages. When
+// messages are waiting to be written, they are written together as one batch,
+// and flushed once, instead of being written and flushed one at a time (see
+// wire.Batch). Only messages that are sent using wire.MsgVersion5 (or later)
+// are batched, because older remote peers cannot read batches. Batches are
+// never larger than the maximum message size. Zero disables batching. By
+// default, the maximum is 64KB.
+func (opts Options) WithMaxBatchBytes(n int) Options {
+	opts.MaxBatchBytes = n
+	return opts
+}
+
+// WithContentType sets the encoding of the messages that are written to a
+// network connection before the remote peer has written anything to it.
+// Afterwards, messages are written using the encoding of the last message
+// that the remote peer wrote, so that remote peers that do not speak surge
+// (see wire.ContentType) can read them. Messages of all content types are
+// always read. Fragments and batches carry messages that are encoded using the
+// same encoding. Messages that are larger than the maximum message size once
+// they are encoded are fragmented (see WithMaxFragmentedMessageSize), or
+// dropped. By default, messages are encoded using surge.
+func (opts Options) WithContentType(contentType wire.ContentType) Options {
+	opts.ContentType = contentType
+	return opts
+}
+
+// WithMaxConcurrentHandlersPerConn sets the maximum number of messages from
+// each remote peer that a Responder handles concurrently (see
+// Client.Respond). Responses are always sent in the order that messages were
+// received. By default, messages are handled one at a time.
+func (opts Options) WithMaxConcurrentHandlersPerConn(max int) Options {
+	opts.MaxConcurrentHandlersPerConn = max
+	return opts
+}
+
+// An Option changes Options. Options are passed to NewClientWith, so that new
+// options can be added without changing its signature.
+type Option func(Options) Options
+
+// With returns the Options changed by each Option, in order.
+func (opts Options) With(changes ...Option) Options {
+	for _, change := range changes {
+		opts = change(opts)
+	}
+	return opts
+}
+
+// FromOptions returns an Option that replaces all Options. It adapts Options
+// that were built using the With methods.
+func FromOptions(opts Options) Option {
+	return func(Options) Options { return opts }
+}
+
+// DecodeOptions returns an Option that decodes JSON configuration on top of
+// Options (see options.Decode). Keys that do not match an option are ignored.
+func DecodeOptions(data []byte) (Option, error) {
+	decode, err := options.Compile(data, &Options{})
+	if err != nil {
+		return nil, err
+	}
+	return func(opts Options) Options {
+		decode(&opts)
+		return opts
+	}, nil
+}
+
+// NewClientWith returns a Client that uses the DefaultOptions, changed by the
+// Options.
+func NewClientWith(self id.Signatory, changes ...Option) *Client {
+	return NewClient(DefaultOptions().With(changes...), self)
+}
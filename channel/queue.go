@@ -0,0 +1,312 @@
+package channel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+)
+
+// A MessageQueue persists outbound messages that a Channel was unable to write
+// before it stopped running. When a new Channel is run for the same remote
+// peer, it pops the persisted messages and writes them before any other
+// outbound messages. This allows pending messages to survive the Channel being
+// unbound, and (depending on the implementation) process restarts.
+type MessageQueue interface {
+	// Push messages destined for a remote peer to the back of its queue.
+	Push(remote id.Signatory, msgs []wire.Msg) error
+	// Pop all messages destined for a remote peer, in the order in which they
+	// were pushed. The messages are removed from the queue.
+	Pop(remote id.Signatory) ([]wire.Msg, error)
+}
+
+var (
+	// DefaultMaxQueuedMessages is the default maximum number of messages that a
+	// FileMessageQueue persists for each remote peer.
+	DefaultMaxQueuedMessages = 4096
+	// DefaultMaxQueuedBytes is the default maximum number of bytes that a
+	// FileMessageQueue persists for each remote peer.
+	DefaultMaxQueuedBytes = 64 * 1024 * 1024
+)
+
+// FileMessageQueue implements the MessageQueue interface using one append-only
+// file per remote peer. Every push is synced to disk before returning, so
+// messages survive process restarts. The messages queued for each remote peer
+// are bounded (see SetLimits), and the oldest messages are dropped when a push
+// would exceed the bounds.
+type FileMessageQueue struct {
+	dir string
+
+	mu          *sync.Mutex
+	maxMessages int
+	maxBytes    int
+	// sizes of the files of remote peers, which are loaded when the file is
+	// first pushed to, and forgotten when it is popped.
+	sizes map[id.Signatory]queueSize
+}
+
+// queueSize is the number of messages, and bytes, in the file of a remote
+// peer.
+type queueSize struct {
+	msgs  int
+	bytes int
+}
+
+// NewFileMessageQueue returns a FileMessageQueue that stores its files in the
+// given directory. The directory is created if it does not exist.
+func NewFileMessageQueue(dir string) (*FileMessageQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create queue directory: %w", err)
+	}
+	return &FileMessageQueue{
+		dir: dir,
+
+		mu:          new(sync.Mutex),
+		maxMessages: DefaultMaxQueuedMessages,
+		maxBytes:    DefaultMaxQueuedBytes,
+		sizes:       map[id.Signatory]queueSize{},
+	}, nil
+}
+
+// SetLimits sets the maximum number of messages, and the maximum number of
+// bytes, that are persisted for each remote peer. A limit that is not positive
+// is unbounded.
+func (q *FileMessageQueue) SetLimits(maxMessages, maxBytes int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxMessages = maxMessages
+	q.maxBytes = maxBytes
+}
+
+// Check that files can be created, written, and synced to disk in the directory
+// of the FileMessageQueue.
+func (q *FileMessageQueue) Check() error {
+	f, err := ioutil.TempFile(q.dir, ".check-")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write([]byte{0}); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	return nil
+}
+
+// Push messages to the end of the file associated with the remote peer. If the
+// file would exceed the limits, the oldest messages are dropped, and the file
+// is rewritten to a temporary file that replaces it once it has been synced to
+// disk, so that a crash while rewriting does not lose the queue.
+func (q *FileMessageQueue) Push(remote id.Signatory, msgs []wire.Msg) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	entries := make([][]byte, 0, len(msgs))
+	pushed := 0
+	for _, msg := range msgs {
+		size := msg.SizeHint() + surge.SizeHintBytes(msg.SyncData)
+		entry := make([]byte, size)
+		buf, rem, err := msg.Marshal(entry, size)
+		if err != nil {
+			return fmt.Errorf("marshal: %w", err)
+		}
+		if buf, _, err = surge.MarshalBytes(msg.SyncData, buf, rem); err != nil {
+			return fmt.Errorf("marshal sync data: %w", err)
+		}
+		entry = entry[:len(entry)-len(buf)]
+		entries = append(entries, entry)
+		pushed += len(entry)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size, err := q.sizeLocked(remote)
+	if err != nil {
+		return err
+	}
+	size.msgs += len(entries)
+	size.bytes += pushed
+	if q.withinLimitsLocked(size) {
+		if err := q.appendLocked(remote, entries); err != nil {
+			return err
+		}
+		q.sizes[remote] = size
+		return nil
+	}
+
+	data, err := q.readLocked(remote)
+	if err != nil {
+		return err
+	}
+	_, existing := decodeQueue(data)
+	entries = append(existing, entries...)
+	size = queueSize{msgs: len(entries)}
+	for _, entry := range entries {
+		size.bytes += len(entry)
+	}
+	for len(entries) > 0 && !q.withinLimitsLocked(size) {
+		size.msgs--
+		size.bytes -= len(entries[0])
+		entries = entries[1:]
+	}
+	if err := q.rewriteLocked(remote, entries); err != nil {
+		return err
+	}
+	q.sizes[remote] = size
+	return nil
+}
+
+// Pop all messages from the file associated with the remote peer, and then
+// remove the file. If the file is truncated (for example, because the process
+// crashed part way through a push), then all complete messages before the
+// truncation are returned.
+func (q *FileMessageQueue) Pop(remote id.Signatory) ([]wire.Msg, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := q.readLocked(remote)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	msgs, _ := decodeQueue(data)
+
+	delete(q.sizes, remote)
+	if err := os.Remove(q.path(remote)); err != nil {
+		return msgs, fmt.Errorf("remove: %w", err)
+	}
+	return msgs, nil
+}
+
+func (q *FileMessageQueue) withinLimitsLocked(size queueSize) bool {
+	return (q.maxMessages <= 0 || size.msgs <= q.maxMessages) &&
+		(q.maxBytes <= 0 || size.bytes <= q.maxBytes)
+}
+
+// sizeLocked returns the size of the file of the remote peer, decoding the file
+// if its size is not known yet.
+func (q *FileMessageQueue) sizeLocked(remote id.Signatory) (queueSize, error) {
+	if size, ok := q.sizes[remote]; ok {
+		return size, nil
+	}
+	data, err := q.readLocked(remote)
+	if err != nil {
+		return queueSize{}, err
+	}
+	_, entries := decodeQueue(data)
+	size := queueSize{msgs: len(entries)}
+	for _, entry := range entries {
+		size.bytes += len(entry)
+	}
+	// Messages appended after a truncated message could not be decoded, so
+	// the truncated message is removed first.
+	if size.bytes < len(data) {
+		if err := q.rewriteLocked(remote, entries); err != nil {
+			return queueSize{}, err
+		}
+	}
+	return size, nil
+}
+
+// readLocked returns the contents of the file of the remote peer, or nil if it
+// does not exist.
+func (q *FileMessageQueue) readLocked(remote id.Signatory) ([]byte, error) {
+	data, err := ioutil.ReadFile(q.path(remote))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read: %w", err)
+	}
+	return data, nil
+}
+
+func (q *FileMessageQueue) appendLocked(remote id.Signatory, entries [][]byte) error {
+	f, err := os.OpenFile(q.path(remote), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	for _, entry := range entries {
+		if _, err := f.Write(entry); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	return nil
+}
+
+func (q *FileMessageQueue) rewriteLocked(remote id.Signatory, entries [][]byte) error {
+	f, err := ioutil.TempFile(q.dir, ".rewrite-")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, entry := range entries {
+		if _, err := f.Write(entry); err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(f.Name(), q.path(remote)); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	return nil
+}
+
+func (q *FileMessageQueue) path(remote id.Signatory) string {
+	return filepath.Join(q.dir, remote.String())
+}
+
+// decodeQueue decodes the messages in a file, and returns them together with
+// their encodings. Every message has its own decoding budget, so the number of
+// messages in a file is not limited by the budget. Decoding stops at the first
+// message that cannot be decoded.
+func decodeQueue(data []byte) ([]wire.Msg, [][]byte) {
+	msgs := []wire.Msg{}
+	entries := [][]byte{}
+	buf := data
+	for len(buf) > 0 {
+		entry := buf
+		msg := wire.Msg{}
+		var rem int
+		var err error
+		if buf, rem, err = msg.Unmarshal(buf, surge.MaxBytes); err != nil {
+			break
+		}
+		if buf, _, err = surge.UnmarshalBytes(&msg.SyncData, buf, rem); err != nil {
+			break
+		}
+		if len(msg.SyncData) == 0 {
+			msg.SyncData = nil
+		}
+		msgs = append(msgs, msg)
+		entries = append(entries, entry[:len(entry)-len(buf)])
+	}
+	return msgs, entries
+}
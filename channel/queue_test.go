@@ -0,0 +1,170 @@
+package channel_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Message queue", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "aw-queue")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Context("when pushing messages", func() {
+		It("should pop them in order after re-opening the queue", func() {
+			remote := id.NewPrivKey().Signatory()
+			msgs := []wire.Msg{
+				{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("first")},
+				{Version: wire.MsgVersion1, Type: wire.MsgTypeSync, Data: []byte("second"), SyncData: []byte("content")},
+			}
+
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queue.Push(remote, msgs[:1])).To(Succeed())
+			Expect(queue.Push(remote, msgs[1:])).To(Succeed())
+
+			queue, err = channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			popped, err := queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(Equal(msgs))
+
+			popped, err = queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(BeEmpty())
+		})
+	})
+
+	Context("when more messages are pushed than fit in one decoding budget", func() {
+		It("should pop all of them", func() {
+			remote := id.NewPrivKey().Signatory()
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			queue.SetLimits(0, 0)
+
+			msgs := make([]wire.Msg, 3)
+			for i := range msgs {
+				msgs[i] = wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSync, Data: []byte{byte(i)}, SyncData: make([]byte, 30*1024*1024)}
+			}
+			Expect(queue.Push(remote, msgs)).To(Succeed())
+
+			popped, err := queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(HaveLen(len(msgs)))
+			for i := range popped {
+				Expect(popped[i].Data).To(Equal(msgs[i].Data))
+			}
+		})
+	})
+
+	Context("when pushing more messages than the limits", func() {
+		It("should drop the oldest messages", func() {
+			remote := id.NewPrivKey().Signatory()
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			queue.SetLimits(2, 0)
+
+			msgs := make([]wire.Msg, 5)
+			for i := range msgs {
+				msgs[i] = wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}}
+				Expect(queue.Push(remote, msgs[i:i+1])).To(Succeed())
+			}
+			popped, err := queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(Equal(msgs[3:]))
+
+			queue.SetLimits(0, 3*msgs[0].SizeHint()+1)
+			Expect(queue.Push(remote, msgs)).To(Succeed())
+			popped, err = queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(HaveLen(2))
+			Expect(popped).To(Equal(msgs[3:]))
+		})
+	})
+
+	Context("when the file of a remote peer is truncated", func() {
+		It("should keep the complete messages, and the messages pushed after them", func() {
+			remote := id.NewPrivKey().Signatory()
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			msgs := []wire.Msg{
+				{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("first")},
+				{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("second")},
+			}
+			Expect(queue.Push(remote, msgs[:1])).To(Succeed())
+
+			f, err := os.OpenFile(filepath.Join(dir, remote.String()), os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = f.Write([]byte{0, 1, 0})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			queue, err = channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(queue.Push(remote, msgs[1:])).To(Succeed())
+			popped, err := queue.Pop(remote)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(popped).To(Equal(msgs))
+		})
+	})
+
+	Context("when a channel is unbound before it is attached", func() {
+		It("should send the pending messages once the channel is re-bound and attached", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			opts := channel.DefaultOptions().
+				WithOutboundBufferSize(1).
+				WithMessageQueue(queue)
+
+			local := channel.NewClient(opts, localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("pending")}
+			Expect(local.Send(ctx, remotePrivKey.Signatory(), msg)).To(Succeed())
+			local.Unbind(remotePrivKey.Signatory())
+			time.Sleep(100 * time.Millisecond)
+
+			local = channel.NewClient(opts, localPrivKey.Signatory())
+			local.Bind(remotePrivKey.Signatory())
+			defer local.Unbind(remotePrivKey.Signatory())
+
+			remote := channel.NewClient(channel.DefaultOptions(), remotePrivKey.Signatory())
+			remote.Bind(localPrivKey.Signatory())
+			defer remote.Unbind(localPrivKey.Signatory())
+
+			received := make(chan wire.Msg, 1)
+			remote.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+
+			port := listen(ctx, remote, remotePrivKey.Signatory(), localPrivKey.Signatory())
+			dial(ctx, local, localPrivKey.Signatory(), remotePrivKey.Signatory(), port, time.Minute)
+
+			Eventually(received, 10*time.Second).Should(Receive(Equal(msg)))
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package channel
+
+import (
+	"context"
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// A Responder handles a message received from a remote peer, and returns the
+// messages (if any) that should be sent back to the remote peer in response.
+// If an error is returned, the Channel to the remote peer is killed, the same
+// as for receivers registered using Receive.
+type Responder func(from id.Signatory, packet wire.Packet) ([]wire.Msg, error)
+
+// Respond registers a Responder. Unlike receivers registered using Receive,
+// which handle one message at a time, up to MaxConcurrentHandlersPerConn
+// messages from each remote peer are handled concurrently (see
+// Options.WithMaxConcurrentHandlersPerConn). Responses are still sent in the
+// order that the messages were received, so a slow message delays the
+// responses to the messages after it, but not their handling. Once the
+// maximum is reached, receiving waits for the oldest message from the remote
+// peer to be responded to, which applies back-pressure in the same way as a
+// slow receiver.
+func (client *Client) Respond(ctx context.Context, f Responder) {
+	max := client.opts.MaxConcurrentHandlersPerConn
+	if max < 1 {
+		max = 1
+	}
+
+	pipelinesMu := new(sync.Mutex)
+	pipelines := map[id.Signatory]*pipeline{}
+
+	client.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		pipelinesMu.Lock()
+		p, ok := pipelines[from]
+		if !ok {
+			p = &pipeline{
+				pending: 0,
+				slots:   make(chan struct{}, max),
+				order:   make(chan chan response, max),
+			}
+			pipelines[from] = p
+			go client.respond(ctx, from, p, func() bool {
+				// The pipeline is forgotten once it has nothing pending, so
+				// that remote peers that stop sending messages do not hold a
+				// goroutine.
+				pipelinesMu.Lock()
+				defer pipelinesMu.Unlock()
+
+				p.pending--
+				if p.pending == 0 {
+					delete(pipelines, from)
+					return true
+				}
+				return false
+			})
+		}
+		p.pending++
+		pipelinesMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case p.slots <- struct{}{}:
+		}
+		done := make(chan response, 1)
+		p.order <- done
+		go func() {
+			msgs, err := f(from, packet)
+			done <- response{msgs: msgs, err: err, trace: packet.Msg.Trace}
+		}()
+		return nil
+	})
+}
+
+// pipeline of the messages from one remote peer that are being handled by a
+// Responder.
+type pipeline struct {
+	// pending is the number of messages that have been received, but not yet
+	// responded to. It is guarded by the mutex of the pipelines.
+	pending int
+	// slots bounds the number of messages that are handled concurrently.
+	slots chan struct{}
+	// order of the responses, which is the order of the messages.
+	order chan chan response
+}
+
+type response struct {
+	msgs []wire.Msg
+	err  error
+
+	// trace of the message that was responded to, which is inherited by
+	// responses that are not part of a trace, so that the round trip is one
+	// trace.
+	trace wire.TraceContext
+}
+
+// respond to the messages in a pipeline, in order, until the pipeline is done.
+func (client *Client) respond(ctx context.Context, remote id.Signatory, p *pipeline, done func() bool) {
+	for {
+		var r response
+		select {
+		case <-ctx.Done():
+			return
+		case next := <-p.order:
+			select {
+			case <-ctx.Done():
+				return
+			case r = <-next:
+			}
+		}
+
+		if r.err != nil {
+			client.kill(remote, r.err)
+		} else {
+			for _, msg := range r.msgs {
+				if !msg.Trace.IsValid() {
+					msg.Trace = r.trace
+				}
+				if err := client.Send(ctx, remote, msg); err != nil {
+					client.opts.Logger.Debug("respond", zap.String("remote", remote.String()), zap.Error(err))
+				}
+			}
+		}
+		<-p.slots
+		if done() {
+			return
+		}
+	}
+}
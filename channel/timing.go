@@ -0,0 +1,168 @@
+package channel
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// WriteTimings is a breakdown of the time spent writing one message to a
+// network connection.
+type WriteTimings struct {
+	// Marshal is the time spent marshaling the message to binary.
+	Marshal time.Duration
+	// Encode is the time spent encoding the message (for example, encrypting
+	// it), excluding time spent in system calls.
+	Encode time.Duration
+	// Syscall is the time spent writing to the network connection.
+	Syscall time.Duration
+}
+
+// ReadTimings is a breakdown of the time spent reading one message from a
+// network connection. Time spent waiting for the message to begin arriving is
+// not included.
+type ReadTimings struct {
+	// Syscall is the time spent reading from the network connection.
+	Syscall time.Duration
+	// Decode is the time spent decoding the message (for example, decrypting
+	// it), excluding time spent in system calls.
+	Decode time.Duration
+	// Unmarshal is the time spent unmarshaling the message from binary.
+	Unmarshal time.Duration
+}
+
+// A TimingObserver is given a breakdown of the time spent reading and writing
+// sampled messages. Methods are called synchronously from the read and write
+// loops of Channels, so implementations should return quickly.
+type TimingObserver interface {
+	ObserveWrite(WriteTimings)
+	ObserveRead(ReadTimings)
+}
+
+// A DurationHistogram counts durations in buckets. The upper bound of bucket i
+// is 2^i microseconds, except for the last bucket, which is unbounded.
+type DurationHistogram struct {
+	Buckets [24]uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// Observe adds a duration to the histogram. It is not safe for concurrent use.
+func (h *DurationHistogram) Observe(d time.Duration) {
+	i := 0
+	if us := d.Microseconds(); us > 1 {
+		i = bits.Len64(uint64(us - 1))
+	}
+	if i >= len(h.Buckets) {
+		i = len(h.Buckets) - 1
+	}
+	h.Buckets[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Names of the histograms in a TimingHistograms snapshot.
+const (
+	TimingWriteMarshal  = "write/marshal"
+	TimingWriteEncode   = "write/encode"
+	TimingWriteSyscall  = "write/syscall"
+	TimingReadSyscall   = "read/syscall"
+	TimingReadDecode    = "read/decode"
+	TimingReadUnmarshal = "read/unmarshal"
+)
+
+// TimingHistograms implements the TimingObserver interface by aggregating
+// timings into DurationHistograms, which can be exported to a metrics system
+// by periodically taking snapshots. It is safe for concurrent use.
+type TimingHistograms struct {
+	histsMu *sync.Mutex
+	hists   map[string]*DurationHistogram
+}
+
+// NewTimingHistograms returns empty TimingHistograms.
+func NewTimingHistograms() *TimingHistograms {
+	return &TimingHistograms{
+		histsMu: new(sync.Mutex),
+		hists: map[string]*DurationHistogram{
+			TimingWriteMarshal:  {},
+			TimingWriteEncode:   {},
+			TimingWriteSyscall:  {},
+			TimingReadSyscall:   {},
+			TimingReadDecode:    {},
+			TimingReadUnmarshal: {},
+		},
+	}
+}
+
+// ObserveWrite adds the write timings to the histograms.
+func (t *TimingHistograms) ObserveWrite(timings WriteTimings) {
+	t.histsMu.Lock()
+	defer t.histsMu.Unlock()
+
+	t.hists[TimingWriteMarshal].Observe(timings.Marshal)
+	t.hists[TimingWriteEncode].Observe(timings.Encode)
+	t.hists[TimingWriteSyscall].Observe(timings.Syscall)
+}
+
+// ObserveRead adds the read timings to the histograms.
+func (t *TimingHistograms) ObserveRead(timings ReadTimings) {
+	t.histsMu.Lock()
+	defer t.histsMu.Unlock()
+
+	t.hists[TimingReadSyscall].Observe(timings.Syscall)
+	t.hists[TimingReadDecode].Observe(timings.Decode)
+	t.hists[TimingReadUnmarshal].Observe(timings.Unmarshal)
+}
+
+// Snapshot returns a copy of all histograms, keyed by name.
+func (t *TimingHistograms) Snapshot() map[string]DurationHistogram {
+	t.histsMu.Lock()
+	defer t.histsMu.Unlock()
+
+	snapshot := make(map[string]DurationHistogram, len(t.hists))
+	for name, hist := range t.hists {
+		snapshot[name] = *hist
+	}
+	return snapshot
+}
+
+// timedWriter accumulates the time spent writing to the underlying writer.
+type timedWriter struct {
+	io.Writer
+	d time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.Writer.Write(p)
+	w.d += time.Since(start)
+	return n, err
+}
+
+// timedReader accumulates the time spent reading from the underlying reader,
+// excluding the first read after being reset. The first read usually blocks
+// until the next message begins to arrive, so the time at which it returns is
+// recorded instead.
+type timedReader struct {
+	io.Reader
+	first time.Time
+	d     time.Duration
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	if r.first.IsZero() {
+		n, err := r.Reader.Read(p)
+		r.first = time.Now()
+		return n, err
+	}
+	start := time.Now()
+	n, err := r.Reader.Read(p)
+	r.d += time.Since(start)
+	return n, err
+}
+
+func (r *timedReader) reset() {
+	r.first = time.Time{}
+	r.d = 0
+}
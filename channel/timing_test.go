@@ -0,0 +1,67 @@
+package channel_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timings", func() {
+	Context("when observing timings", func() {
+		It("should observe every sampled message that is read and written", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			localPrivKey := id.NewPrivKey()
+			remotePrivKey := id.NewPrivKey()
+			timings := channel.NewTimingHistograms()
+
+			localOutbound := make(chan channel.Envelope)
+			local := channel.New(
+				channel.DefaultOptions().WithTimingObserver(timings, 1),
+				remotePrivKey.Signatory(),
+				make(chan wire.Packet),
+				localOutbound)
+			go local.Run(ctx)
+
+			remoteInbound := make(chan wire.Packet)
+			remote := channel.New(
+				channel.DefaultOptions().WithTimingObserver(timings, 1),
+				localPrivKey.Signatory(),
+				remoteInbound,
+				make(chan channel.Envelope))
+			go remote.Run(ctx)
+
+			localConn, remoteConn := net.Pipe()
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+			go local.Attach(ctx, remotePrivKey.Signatory(), localConn, enc, dec)
+			go remote.Attach(ctx, localPrivKey.Signatory(), remoteConn, enc, dec)
+
+			n := 10
+			for i := 0; i < n; i++ {
+				localOutbound <- channel.Envelope{Msg: wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte{byte(i)}}}
+				Eventually(remoteInbound, 5*time.Second).Should(Receive())
+			}
+
+			// The remote peer can receive the last message before the local
+			// peer has finished observing the time spent writing it.
+			names := []string{
+				channel.TimingWriteMarshal, channel.TimingWriteEncode, channel.TimingWriteSyscall,
+				channel.TimingReadSyscall, channel.TimingReadDecode, channel.TimingReadUnmarshal,
+			}
+			for _, name := range names {
+				name := name
+				Eventually(func() uint64 { return timings.Snapshot()[name].Count }).Should(Equal(uint64(n)))
+			}
+		})
+	})
+})
@@ -0,0 +1,105 @@
+package channel
+
+import (
+	"fmt"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// Names of the spans started by Clients, and Transports, using a Tracer.
+const (
+	// SpanDial covers dialing a remote peer, from the first attempt until a
+	// network connection completes the handshake, or dialing stops.
+	SpanDial = "aw.dial"
+	// SpanHandshake covers the handshake of a network connection.
+	SpanHandshake = "aw.handshake"
+	// SpanWrite covers sending a message, from when it is sent until its
+	// final Outcome is known (see Envelope).
+	SpanWrite = "aw.write"
+	// SpanReceive marks the receiving of a message, before it is passed to
+	// receivers. Receivers can continue the trace from the TraceContext of
+	// the message.
+	SpanReceive = "aw.receive"
+)
+
+// A Tracer starts the spans of distributed traces. It is intended for adapting
+// a tracing system (such as OpenTelemetry) to Clients and Transports, so that
+// messages can be followed from peer to peer. Methods are called synchronously
+// from the goroutines that send and receive messages, so implementations
+// should return quickly.
+type Tracer interface {
+	// StartSpan starts a span that involves a remote peer. The remote peer is
+	// the zero Signatory if it is not yet known (for example, during the
+	// handshake of an accepted network connection). The parent is the zero
+	// TraceContext if the span has no parent, in which case the Tracer decides
+	// whether to start a new trace.
+	StartSpan(name string, remote id.Signatory, parent wire.TraceContext) Span
+}
+
+// A Span is a span that was started by a Tracer.
+type Span interface {
+	// Context returns the TraceContext of the span, which is propagated to
+	// remote peers. It returns the zero TraceContext if the span is not part
+	// of a trace.
+	Context() wire.TraceContext
+	// End the span. The error is nil if the span was successful.
+	End(err error)
+}
+
+// OutcomeError is the error with which the SpanWrite of a message ends, if the
+// message was not written.
+type OutcomeError struct {
+	Outcome wire.Outcome
+}
+
+// Error implements the error interface.
+func (err OutcomeError) Error() string {
+	return fmt.Sprintf("message %v", err.Outcome)
+}
+
+// traceSend starts the SpanWrite of a message, if there is a Tracer, and
+// returns the message with its TraceContext set to the span. The span ends
+// when the message is notified of its outcome. The TraceContext is only
+// propagated to the remote peer if the message is sent using wire.MsgVersion3
+// (see WithWireVersionSelector).
+func (client *Client) traceSend(remote id.Signatory, env Envelope) Envelope {
+	if client.opts.Tracer == nil {
+		return env
+	}
+	span := client.opts.Tracer.StartSpan(SpanWrite, remote, env.Msg.Trace)
+	env.Msg.Trace = span.Context()
+
+	onOutcome := env.OnOutcome
+	env.OnOutcome = func(outcome wire.Outcome) {
+		switch outcome {
+		case wire.OutcomeWritten, wire.OutcomePersisted:
+			span.End(nil)
+		default:
+			span.End(OutcomeError{Outcome: outcome})
+		}
+		if onOutcome != nil {
+			onOutcome(outcome)
+		}
+	}
+	return env
+}
+
+// traceReceive marks the receiving of a message, if there is a Tracer and the
+// message is part of a trace, and returns the packet with its TraceContext set
+// to the SpanReceive.
+func (client *Client) traceReceive(remote id.Signatory, packet wire.Packet) wire.Packet {
+	if client.opts.Tracer == nil || !packet.Msg.Trace.IsValid() {
+		return packet
+	}
+	span := client.opts.Tracer.StartSpan(SpanReceive, remote, packet.Msg.Trace)
+	packet.Msg.Trace = span.Context()
+	span.End(nil)
+	return packet
+}
+
+// Tracer returns the Tracer used by the Client, or nil if there is none (see
+// Options.WithTracer).
+func (client *Client) Tracer() Tracer {
+	return client.opts.Tracer
+}
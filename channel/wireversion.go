@@ -0,0 +1,171 @@
+package channel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// A WireVersionSelector returns the wire version (see wire.MsgVersion1 to
+// wire.MsgVersion5) that should be used for messages sent to a remote peer. It
+// allows versions to be run side by side, so that a new version can be rolled
+// out to a subset of remote peers before it becomes the default. It is called
+// for every message, so it should return quickly.
+type WireVersionSelector func(remote id.Signatory) uint16
+
+// CanaryWireVersion returns a WireVersionSelector that selects
+// wire.MsgVersion2 for a fraction (between 0 and 1) of remote peers, and
+// wire.MsgVersion1 for all others. Remote peers are selected by their
+// signatory, so the same remote peers are selected by every Client, and across
+// restarts.
+func CanaryWireVersion(fraction float64) WireVersionSelector {
+	if fraction <= 0 {
+		return func(id.Signatory) uint16 { return wire.MsgVersion1 }
+	}
+	if fraction >= 1 {
+		return func(id.Signatory) uint16 { return wire.MsgVersion2 }
+	}
+	threshold := uint64(fraction * math.MaxUint64)
+	return func(remote id.Signatory) uint16 {
+		if binary.BigEndian.Uint64(remote[:8]) < threshold {
+			return wire.MsgVersion2
+		}
+		return wire.MsgVersion1
+	}
+}
+
+// A WireVersionError is returned when sending a message to a remote peer, if
+// the wire version selected for the remote peer is older than the version
+// needed to send the trace, compression, or headers of the message (see
+// wire.Msg). The message is not sent, because the fields would otherwise be
+// dropped, or misread by the remote peer.
+type WireVersionError struct {
+	Remote   id.Signatory
+	Version  uint16
+	Required uint16
+}
+
+// Error implements the error interface.
+func (err WireVersionError) Error() string {
+	return fmt.Sprintf("sending to %v: wire version %v is selected, but version %v is required", err.Remote, err.Version, err.Required)
+}
+
+// WireVersionStats are the outcomes of messages sent using one wire version.
+// Comparing the WireVersionStats of each version shows whether a new version
+// has a higher error rate, or latency, than the old version.
+type WireVersionStats struct {
+	// Sent is the number of messages sent.
+	Sent uint64
+	// Written is the number of messages that were written to a network
+	// connection.
+	Written uint64
+	// Failed is the number of messages that were dropped, expired, or lost.
+	Failed uint64
+	// Latency is the time from sending messages to writing them.
+	Latency DurationHistogram
+}
+
+// wireVersions selects the wire version of messages sent by a Client, and
+// collects WireVersionStats for each version.
+type wireVersions struct {
+	selector WireVersionSelector
+
+	mu    *sync.Mutex
+	stats map[uint16]*WireVersionStats
+}
+
+func newWireVersions(selector WireVersionSelector) *wireVersions {
+	return &wireVersions{
+		selector: selector,
+
+		mu:    new(sync.Mutex),
+		stats: map[uint16]*WireVersionStats{},
+	}
+}
+
+// apply the selected wire version to a message that is being sent to a remote
+// peer. A WireVersionError is returned if the selected version cannot
+// represent the trace, compression, headers, or stream of the message.
+// The OnOutcome callback of the Envelope is wrapped, so that its outcome is
+// counted, and still called.
+func (versions *wireVersions) apply(remote id.Signatory, env Envelope) (Envelope, error) {
+	if versions.selector == nil {
+		return env, nil
+	}
+	msg := &env.Msg
+	switch version := versions.selector(remote); version {
+	case wire.MsgVersion1, wire.MsgVersion2, wire.MsgVersion3, wire.MsgVersion4, wire.MsgVersion5:
+		if required := requiredVersion(*msg); version < required {
+			return env, WireVersionError{Remote: remote, Version: version, Required: required}
+		}
+		msg.Version = version
+	}
+
+	version := msg.Version
+	versions.mu.Lock()
+	versions.statsOf(version).Sent++
+	versions.mu.Unlock()
+
+	sent := time.Now()
+	onOutcome := env.OnOutcome
+	env.OnOutcome = func(outcome wire.Outcome) {
+		versions.mu.Lock()
+		stats := versions.statsOf(version)
+		switch outcome {
+		case wire.OutcomeWritten:
+			stats.Written++
+			stats.Latency.Observe(time.Since(sent))
+		case wire.OutcomeDropped, wire.OutcomeExpired, wire.OutcomeLost:
+			stats.Failed++
+		}
+		versions.mu.Unlock()
+		if onOutcome != nil {
+			onOutcome(outcome)
+		}
+	}
+	return env, nil
+}
+
+// requiredVersion returns the oldest wire version that can represent the
+// trace, compression, headers, and stream of a message.
+func requiredVersion(msg wire.Msg) uint16 {
+	switch {
+	case len(msg.Headers) > 0:
+		return wire.MsgVersion5
+	case msg.Compression != wire.CompressionNone:
+		return wire.MsgVersion4
+	case msg.Trace.IsValid():
+		return wire.MsgVersion3
+	case msg.Stream != 0:
+		return wire.MsgVersion2
+	default:
+		return wire.MsgVersion1
+	}
+}
+
+// statsOf returns the WireVersionStats of a version. It must be called while
+// holding the mutex.
+func (versions *wireVersions) statsOf(version uint16) *WireVersionStats {
+	stats, ok := versions.stats[version]
+	if !ok {
+		stats = new(WireVersionStats)
+		versions.stats[version] = stats
+	}
+	return stats
+}
+
+func (versions *wireVersions) snapshot() map[uint16]WireVersionStats {
+	versions.mu.Lock()
+	defer versions.mu.Unlock()
+
+	snapshot := make(map[uint16]WireVersionStats, len(versions.stats))
+	for version, stats := range versions.stats {
+		snapshot[version] = *stats
+	}
+	return snapshot
+}
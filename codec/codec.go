@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -11,3 +12,38 @@ type Encoder func(w io.Writer, buf []byte) (int, error)
 // A Decoder is a function the decodes bytes from an I/O reader into a byte
 // slice. It returns the number of bytes read, and errors that happen.
 type Decoder func(r io.Reader, buf []byte) (int, error)
+
+// MaxHeaderSize is the maximum number of bytes of sealed data that are kept by
+// an AuthenticationError.
+const MaxHeaderSize = 32
+
+// An AuthenticationError is returned by Decoders when sealed data cannot be
+// opened, because it was corrupted, or because it was not sealed using the
+// expected key and nonce. The Header is a copy of the first bytes of the
+// sealed data (at most MaxHeaderSize bytes), as they were read from the
+// network connection.
+type AuthenticationError struct {
+	Header []byte
+	Err    error
+}
+
+// NewAuthenticationError returns an AuthenticationError with a copy of the
+// header of the sealed data.
+func NewAuthenticationError(sealed []byte, err error) *AuthenticationError {
+	if len(sealed) > MaxHeaderSize {
+		sealed = sealed[:MaxHeaderSize]
+	}
+	header := make([]byte, len(sealed))
+	copy(header, sealed)
+	return &AuthenticationError{Header: header, Err: err}
+}
+
+// Error implements the error interface.
+func (err *AuthenticationError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", err.Err)
+}
+
+// Unwrap returns the error returned by the AEAD.
+func (err *AuthenticationError) Unwrap() error {
+	return err.Err
+}
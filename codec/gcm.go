@@ -28,6 +28,15 @@ func (nonce gcmNonce) next() {
 
 }
 
+// bytes returns the nonce as a big-endian integer, left-padded with zeros to
+// the size of the nonces of the AEAD.
+func (nonce gcmNonce) bytes(size int) []byte {
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf[size-12:size-8], nonce.top)
+	binary.BigEndian.PutUint64(buf[size-8:], nonce.bottom)
+	return buf
+}
+
 func (nonce gcmNonce) succ() {
 	nonce.bottom++
 	// If bottom overflows, increment top by 1
@@ -45,28 +54,44 @@ func (nonce gcmNonce) pred() {
 }
 
 // A GCMSession stores the state of a GCM authenticated/encrypted session. This
-// includes the read/write nonces, memory buffers, and the GCM cipher itself.
+// includes the read/write nonces, memory buffers, and the GCM ciphers
+// themselves. Both directions begin with the same key, but their keys are
+// rotated independently (see RekeyEncoder and RekeyDecoder). Despite its name,
+// the session can use the AEAD of any CipherSuite.
 type GCMSession struct {
-	gcm        cipher.AEAD
+	counters SessionCounters
+	suite    CipherSuite
+
+	readKey    [32]byte
+	readGCM    cipher.AEAD
 	readNonce  gcmNonce
+	writeKey   [32]byte
+	writeGCM   cipher.AEAD
 	writeNonce gcmNonce
 }
 
 // NewGCMSession accepts a symmetric secret key and returns a new GCMSession
 // that is configured using the symmetric secret key.
 func NewGCMSession(key [32]byte, self, remote id.Signatory) (*GCMSession, error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return &GCMSession{}, fmt.Errorf("creating aes cipher: %v", err)
-	}
-	gcm, err := cipher.NewGCM(block)
+	return NewGCMSessionWithCipherSuite(key, self, remote, CipherSuiteAESGCM)
+}
+
+// NewGCMSessionWithCipherSuite is the same as NewGCMSession, but uses the AEAD
+// of the cipher suite instead of AES-GCM.
+func NewGCMSessionWithCipherSuite(key [32]byte, self, remote id.Signatory, suite CipherSuite) (*GCMSession, error) {
+	gcm, err := NewAEAD(suite, key)
 	if err != nil {
-		return &GCMSession{}, fmt.Errorf("creating gcm cipher: %v", err)
+		return &GCMSession{}, err
 	}
 
 	gcmSession := &GCMSession{
-		gcm:        gcm,
+		suite: suite,
+
+		readKey:    key,
+		readGCM:    gcm,
 		readNonce:  gcmNonce{},
+		writeKey:   key,
+		writeGCM:   gcm,
 		writeNonce: gcmNonce{},
 	}
 
@@ -82,18 +107,48 @@ func NewGCMSession(key [32]byte, self, remote id.Signatory) (*GCMSession, error)
 	return gcmSession, nil
 }
 
+// Stats returns the statistics of the session. It is safe to call while the
+// session is being used.
+func (session *GCMSession) Stats() SessionStats {
+	return session.counters.Stats(session.suite)
+}
+
+func newGCM(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm cipher: %v", err)
+	}
+	return gcm, nil
+}
+
 // GCMEncoder accepts a GCMSession and an encoder that wraps data encryption
 func GCMEncoder(session *GCMSession, enc Encoder) Encoder {
 	return func(w io.Writer, buf []byte) (int, error) {
-		nonceBuf := [12]byte{}
-		binary.BigEndian.PutUint32(nonceBuf[:4], session.writeNonce.top)
-		binary.BigEndian.PutUint64(nonceBuf[4:], session.writeNonce.bottom)
+		if AcceptStats(w, session.Stats) {
+			return 0, nil
+		}
+		if AcceptRekey(w) {
+			key := NextKey(session.writeKey)
+			gcm, err := NewAEAD(session.suite, key)
+			if err != nil {
+				return 0, err
+			}
+			session.writeKey, session.writeGCM = key, gcm
+			session.counters.RekeyedEncoder()
+			return 0, nil
+		}
+		nonceBuf := session.writeNonce.bytes(session.writeGCM.NonceSize())
 		session.writeNonce.next()
-		encoded := session.gcm.Seal(nil, nonceBuf[:], buf, nil)
+		encoded := session.writeGCM.Seal(nil, nonceBuf, buf, nil)
 		_, err := enc(w, encoded)
 		if err != nil {
 			return 0, fmt.Errorf("encoding sealed data: %v", err)
 		}
+		session.counters.Encrypted(len(buf))
 		return len(buf), nil
 	}
 }
@@ -101,6 +156,16 @@ func GCMEncoder(session *GCMSession, enc Encoder) Encoder {
 // GCMDEcoder accepts a GCMSession and a decoder that wraps data decryption
 func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 	return func(r io.Reader, buf []byte) (int, error) {
+		if AcceptRekey(r) {
+			key := NextKey(session.readKey)
+			gcm, err := NewAEAD(session.suite, key)
+			if err != nil {
+				return 0, err
+			}
+			session.readKey, session.readGCM = key, gcm
+			session.counters.RekeyedDecoder()
+			return 0, nil
+		}
 		extendedSize := len(buf) + 16
 		if cap(buf) < extendedSize {
 			return 0, fmt.Errorf("decoding data: buffer too small, expected buffer capacity %v, got buffer capacity %v", extendedSize, cap(buf))
@@ -110,16 +175,15 @@ func GCMDecoder(session *GCMSession, dec Decoder) Decoder {
 		if err != nil {
 			return n, fmt.Errorf("decoding data: %v", err)
 		}
-		nonceBuf := [12]byte{}
-		binary.BigEndian.PutUint32(nonceBuf[:4], session.readNonce.top)
-		binary.BigEndian.PutUint64(nonceBuf[4:], session.readNonce.bottom)
+		nonceBuf := session.readNonce.bytes(session.readGCM.NonceSize())
 		session.readNonce.next()
-		decrypted, err := session.gcm.Open(nil, nonceBuf[:], buf[:n], nil)
+		decrypted, err := session.readGCM.Open(nil, nonceBuf, buf[:n], nil)
 
 		if err != nil {
-			return 0, fmt.Errorf("opening sealed data: %v", err)
+			return 0, fmt.Errorf("opening sealed data: %w", NewAuthenticationError(buf[:n], err))
 		}
 		copy(buf, decrypted)
+		session.counters.Decrypted(len(decrypted))
 
 		return len(decrypted), nil
 	}
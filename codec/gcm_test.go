@@ -2,6 +2,7 @@ package codec_test
 
 import (
 	"bytes"
+	"errors"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"github.com/renproject/aw/codec"
@@ -50,4 +51,150 @@ var _ = Describe("GCM Codec", func() {
 
 		})
 	})
+
+	Context("when rotating keys", func() {
+		It("should only decode messages once both keys have been rotated", func() {
+			var key [32]byte
+			rand.Read(key[:])
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			gcmSession1, err := codec.NewGCMSession(key, privKey1.Signatory(), privKey2.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			gcmSession2, err := codec.NewGCMSession(key, privKey2.Signatory(), privKey1.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(gcmSession1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(gcmSession2, codec.PlainDecoder))
+
+			Expect(codec.RekeyEncoder(enc)).To(BeTrue())
+			var rw bytes.Buffer
+			_, err = enc(&rw, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			var buf [64]byte
+			_, err = dec(bytes.NewReader(rw.Bytes()), buf[:])
+			Expect(err).To(HaveOccurred())
+
+			Expect(codec.RekeyDecoder(dec)).To(BeTrue())
+			n, err := dec(&rw, buf[:])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("hello"))
+		})
+
+		It("should not be supported by plain encoders and decoders", func() {
+			Expect(codec.RekeyEncoder(codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder))).To(BeFalse())
+			Expect(codec.RekeyDecoder(codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))).To(BeFalse())
+		})
+	})
+
+	Context("when the sealed data is corrupted", func() {
+		It("should return an authentication error with the header of the sealed data", func() {
+			var key [32]byte
+			rand.Read(key[:])
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			gcmSession1, err := codec.NewGCMSession(key, privKey1.Signatory(), privKey2.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			gcmSession2, err := codec.NewGCMSession(key, privKey2.Signatory(), privKey1.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(gcmSession1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(gcmSession2, codec.PlainDecoder))
+
+			var rw bytes.Buffer
+			_, err = enc(&rw, bytes.Repeat([]byte("hello"), 16))
+			Expect(err).ToNot(HaveOccurred())
+			sealed := rw.Bytes()
+			sealed[len(sealed)-1] ^= 1
+
+			var buf [128]byte
+			_, err = dec(&rw, buf[:])
+			authErr := new(codec.AuthenticationError)
+			Expect(errors.As(err, &authErr)).To(BeTrue())
+			Expect(authErr.Header).To(Equal(sealed[4 : 4+codec.MaxHeaderSize]))
+		})
+	})
+
+	Context("when using other cipher suites", func() {
+		It("should successfully transmit messages, and reject messages from other cipher suites", func() {
+			var key [32]byte
+			rand.Read(key[:])
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			for _, suite := range []codec.CipherSuite{codec.CipherSuiteAESGCM, codec.CipherSuiteChaCha20Poly1305, codec.CipherSuiteXChaCha20Poly1305} {
+				session1, err := codec.NewGCMSessionWithCipherSuite(key, privKey1.Signatory(), privKey2.Signatory(), suite)
+				Expect(err).ToNot(HaveOccurred())
+				session2, err := codec.NewGCMSessionWithCipherSuite(key, privKey2.Signatory(), privKey1.Signatory(), suite)
+				Expect(err).ToNot(HaveOccurred())
+				enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+				dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+				var rw bytes.Buffer
+				_, err = enc(&rw, []byte(suite.String()))
+				Expect(err).ToNot(HaveOccurred())
+				var buf [4086]byte
+				n, err := dec(&rw, buf[:])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(buf[:n])).To(Equal(suite.String()))
+			}
+
+			session1, err := codec.NewGCMSessionWithCipherSuite(key, privKey1.Signatory(), privKey2.Signatory(), codec.CipherSuiteChaCha20Poly1305)
+			Expect(err).ToNot(HaveOccurred())
+			session2, err := codec.NewGCMSession(key, privKey2.Signatory(), privKey1.Signatory())
+			Expect(err).ToNot(HaveOccurred())
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+			var rw bytes.Buffer
+			_, err = enc(&rw, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			var buf [4086]byte
+			_, err = dec(&rw, buf[:])
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when using an unknown cipher suite", func() {
+		It("should return an error", func() {
+			_, err := codec.NewGCMSessionWithCipherSuite([32]byte{}, id.Signatory{}, id.Signatory{}, codec.CipherSuite(42))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when inspecting the statistics of a session", func() {
+		It("should count the data encrypted and decrypted since the last rekey", func() {
+			var key [32]byte
+			rand.Read(key[:])
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			session1, err := codec.NewGCMSessionWithCipherSuite(key, privKey1.Signatory(), privKey2.Signatory(), codec.CipherSuiteChaCha20Poly1305)
+			Expect(err).ToNot(HaveOccurred())
+			session2, err := codec.NewGCMSessionWithCipherSuite(key, privKey2.Signatory(), privKey1.Signatory(), codec.CipherSuiteChaCha20Poly1305)
+			Expect(err).ToNot(HaveOccurred())
+			enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.GCMEncoder(session1, codec.PlainEncoder))
+			dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.GCMDecoder(session2, codec.PlainDecoder))
+
+			var rw bytes.Buffer
+			var buf [4086]byte
+			for i := 0; i < 3; i++ {
+				_, err = enc(&rw, []byte("hello"))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = dec(&rw, buf[:])
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(codec.RekeyEncoder(enc)).To(BeTrue())
+			_, err = enc(&rw, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+
+			stats, ok := codec.Stats(enc)
+			Expect(ok).To(BeTrue())
+			Expect(stats).To(Equal(codec.SessionStats{
+				CipherSuite:                 codec.CipherSuiteChaCha20Poly1305,
+				BytesEncrypted:              20,
+				MessagesEncryptedSinceRekey: 1,
+				Rekeys:                      1,
+			}))
+			Expect(session2.Stats().BytesDecrypted).To(Equal(uint64(15)))
+			Expect(session2.Stats().MessagesDecryptedSinceRekey).To(Equal(uint64(3)))
+
+			_, ok = codec.Stats(codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder))
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
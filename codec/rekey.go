@@ -0,0 +1,79 @@
+package codec
+
+import (
+	"crypto/sha256"
+)
+
+// rekeyRequest is given to encoders, and decoders, instead of a writer, or
+// reader, to ask them to rotate their key. Encoders and decoders that wrap
+// other encoders and decoders pass it along like any other writer, or reader,
+// so the request reaches the encoders and decoders that do the encryption.
+type rekeyRequest struct {
+	accepted bool
+}
+
+// Write discards the bytes written by encoders that do not encrypt anything
+// (for example, the length prefix of a LengthPrefixEncoder).
+func (req *rekeyRequest) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Read fills the buffer with zeros for decoders that do not decrypt anything
+// (for example, the length prefix of a LengthPrefixDecoder, which means that
+// the wrapped decoder is asked to decode zero bytes).
+func (req *rekeyRequest) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// RekeyEncoder asks the encoder to rotate its key, so that everything it
+// encodes afterwards is encrypted with the next key of its session. It returns
+// false if the encoder does not support rotating its key (for example, because
+// it does not encrypt anything). The remote peer must rotate the key of its
+// decoder at the same point in the stream, so the encoder must only be rekeyed
+// once the remote peer has been told (see wire.MsgTypeRekey).
+func RekeyEncoder(enc Encoder) bool {
+	req := &rekeyRequest{}
+	if _, err := enc(req, nil); err != nil {
+		return false
+	}
+	return req.accepted
+}
+
+// RekeyDecoder asks the decoder to rotate its key, so that everything it
+// decodes afterwards is decrypted with the next key of its session. It returns
+// false if the decoder does not support rotating its key.
+func RekeyDecoder(dec Decoder) bool {
+	req := &rekeyRequest{}
+	if _, err := dec(req, make([]byte, 0, 64)); err != nil {
+		return false
+	}
+	return req.accepted
+}
+
+// AcceptRekey returns true if the writer, or reader, given to an encoder, or
+// decoder, is a request to rotate its key, in which case the encoder, or
+// decoder, must rotate its key instead of encoding, or decoding, anything.
+// Encoders and decoders that encrypt data should support rotating their keys,
+// so that long-lived network connections do not use one key forever.
+func AcceptRekey(rw interface{}) bool {
+	req, ok := rw.(*rekeyRequest)
+	if ok {
+		req.accepted = true
+	}
+	return ok
+}
+
+// NextKey derives the next key of a session from its current key. Keys are
+// derived using a one-way function, so the compromise of a key does not
+// compromise the keys that were used before it.
+func NextKey(key [32]byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("aw rekey"))
+	h.Write(key[:])
+	next := [32]byte{}
+	h.Sum(next[:0])
+	return next
+}
@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"sync/atomic"
+)
+
+// SessionStats are the statistics of an encrypted session.
+type SessionStats struct {
+	// CipherSuite used to encrypt the session.
+	CipherSuite CipherSuite
+	// BytesEncrypted is the number of plaintext bytes that have been
+	// encrypted, and BytesDecrypted is the number of plaintext bytes that have
+	// been decrypted.
+	BytesEncrypted uint64
+	BytesDecrypted uint64
+	// MessagesEncryptedSinceRekey is the number of messages that have been
+	// encrypted since the key of the encoder was last rotated, and
+	// MessagesDecryptedSinceRekey is the same for the decoder.
+	MessagesEncryptedSinceRekey uint64
+	MessagesDecryptedSinceRekey uint64
+	// Rekeys is the number of times that the keys of the encoder, or decoder,
+	// have been rotated.
+	Rekeys uint64
+}
+
+// SessionCounters count the data encrypted, and decrypted, by a session. They
+// are safe for concurrent use, so that they can be read while the session is
+// being used.
+type SessionCounters struct {
+	bytesEncrypted    uint64
+	bytesDecrypted    uint64
+	messagesEncrypted uint64
+	messagesDecrypted uint64
+	rekeys            uint64
+}
+
+// Encrypted counts a message of n plaintext bytes that has been encrypted.
+func (counters *SessionCounters) Encrypted(n int) {
+	atomic.AddUint64(&counters.bytesEncrypted, uint64(n))
+	atomic.AddUint64(&counters.messagesEncrypted, 1)
+}
+
+// Decrypted counts a message of n plaintext bytes that has been decrypted.
+func (counters *SessionCounters) Decrypted(n int) {
+	atomic.AddUint64(&counters.bytesDecrypted, uint64(n))
+	atomic.AddUint64(&counters.messagesDecrypted, 1)
+}
+
+// RekeyedEncoder counts the rotation of the key of the encoder.
+func (counters *SessionCounters) RekeyedEncoder() {
+	atomic.StoreUint64(&counters.messagesEncrypted, 0)
+	atomic.AddUint64(&counters.rekeys, 1)
+}
+
+// RekeyedDecoder counts the rotation of the key of the decoder.
+func (counters *SessionCounters) RekeyedDecoder() {
+	atomic.StoreUint64(&counters.messagesDecrypted, 0)
+	atomic.AddUint64(&counters.rekeys, 1)
+}
+
+// Stats returns a snapshot of the counters.
+func (counters *SessionCounters) Stats(suite CipherSuite) SessionStats {
+	return SessionStats{
+		CipherSuite:                 suite,
+		BytesEncrypted:              atomic.LoadUint64(&counters.bytesEncrypted),
+		BytesDecrypted:              atomic.LoadUint64(&counters.bytesDecrypted),
+		MessagesEncryptedSinceRekey: atomic.LoadUint64(&counters.messagesEncrypted),
+		MessagesDecryptedSinceRekey: atomic.LoadUint64(&counters.messagesDecrypted),
+		Rekeys:                      atomic.LoadUint64(&counters.rekeys),
+	}
+}
+
+// statsRequest is given to encoders instead of a writer to ask them for the
+// statistics of their session (see rekeyRequest).
+type statsRequest struct {
+	stats    SessionStats
+	accepted bool
+}
+
+// Write discards the bytes written by encoders that do not encrypt anything.
+func (req *statsRequest) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Stats returns the statistics of the session of an encoder. It returns false
+// if the encoder does not encrypt anything. It is safe to call while the
+// encoder is being used.
+func Stats(enc Encoder) (SessionStats, bool) {
+	req := &statsRequest{}
+	if _, err := enc(req, nil); err != nil {
+		return SessionStats{}, false
+	}
+	return req.stats, req.accepted
+}
+
+// AcceptStats returns true if the writer given to an encoder is a request for
+// the statistics of its session, in which case the encoder must call the stats
+// function instead of encoding anything.
+func AcceptStats(w interface{}, stats func() SessionStats) bool {
+	req, ok := w.(*statsRequest)
+	if ok {
+		req.stats = stats()
+		req.accepted = true
+	}
+	return ok
+}
@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A CipherSuite identifies the AEAD used to encrypt a session. All cipher
+// suites use 32 byte keys, and 16 byte authentication tags.
+type CipherSuite uint8
+
+const (
+	// CipherSuiteNone is not a valid cipher suite. It is used to pad lists of
+	// cipher suites.
+	CipherSuiteNone = CipherSuite(0)
+	// CipherSuiteAESGCM uses AES-256 in GCM mode. It is the fastest cipher
+	// suite on nodes with hardware support for AES (for example, AES-NI).
+	CipherSuiteAESGCM = CipherSuite(1)
+	// CipherSuiteChaCha20Poly1305 uses ChaCha20-Poly1305 (see RFC 8439). It is
+	// the fastest cipher suite on nodes without hardware support for AES
+	// (for example, many ARM nodes).
+	CipherSuiteChaCha20Poly1305 = CipherSuite(2)
+	// CipherSuiteXChaCha20Poly1305 uses ChaCha20-Poly1305 with 24 byte
+	// nonces.
+	CipherSuiteXChaCha20Poly1305 = CipherSuite(3)
+)
+
+// String implements the Stringer interface.
+func (suite CipherSuite) String() string {
+	switch suite {
+	case CipherSuiteNone:
+		return "none"
+	case CipherSuiteAESGCM:
+		return "aes-gcm"
+	case CipherSuiteChaCha20Poly1305:
+		return "chacha20-poly1305"
+	case CipherSuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(suite))
+	}
+}
+
+// NewAEAD returns the AEAD of the cipher suite, using the key.
+func NewAEAD(suite CipherSuite, key [32]byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherSuiteAESGCM:
+		return newGCM(key)
+	case CipherSuiteChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key[:])
+		if err != nil {
+			return nil, fmt.Errorf("creating chacha20-poly1305 cipher: %v", err)
+		}
+		return aead, nil
+	case CipherSuiteXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(key[:])
+		if err != nil {
+			return nil, fmt.Errorf("creating xchacha20-poly1305 cipher: %v", err)
+		}
+		return aead, nil
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite %v", suite)
+	}
+}
@@ -0,0 +1,527 @@
+// Package contentsync synchronises content, identified by its hash, between
+// peers. Peers announce the IDs of the content that they hold (using push
+// messages), and other peers pull the content from the peers that announced
+// it, or from random peers when nobody has announced it. Content is pulled
+// from many peers at once, and is only accepted if it matches its hash, so
+// that blocks and state can be propagated quickly without trusting any one
+// peer.
+package contentsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoPeers is returned when content is announced, or pulled, but there
+	// are no peers in the table.
+	ErrNoPeers = errors.New("no peers")
+	// ErrNotFound is returned when content could not be pulled from any of
+	// the peers that were asked for it.
+	ErrNotFound = errors.New("content not found")
+)
+
+// ContentID returns the ID of content, which is its SHA-256 hash.
+func ContentID(content []byte) id.Hash {
+	return id.NewHash(content)
+}
+
+// Statuses of responses to pulls. Responses carry the content ID, followed by
+// the status, and carry the content only if the remote peer holds it, so that
+// empty content can be told apart from content that is not held.
+const (
+	statusNotHeld = byte(0)
+	statusHeld    = byte(1)
+)
+
+// announcement is a content ID that has been announced by remote peers.
+type announcement struct {
+	// holders that announced the content ID, from least to most recent.
+	holders []id.Signatory
+	at      time.Time
+}
+
+// announced is a content ID, and the time at which it was announced. It is
+// stale if the content ID has been announced again since, or forgotten.
+type announced struct {
+	contentID id.Hash
+	at        time.Time
+}
+
+// response to a pull, from a remote peer. The content is only set when the
+// remote peer holds the content.
+type response struct {
+	from    id.Signatory
+	held    bool
+	content []byte
+}
+
+// pull is a call to Pull that is waiting for responses.
+type pull struct {
+	responses chan response
+}
+
+// A Syncer announces content to, and pulls content from, remote peers. Content
+// is stored in, and served from, a ContentResolver using the bytes of its
+// content ID as the key.
+type Syncer struct {
+	opts      Options
+	transport *transport.Transport
+	resolver  dht.ContentResolver
+
+	// order of announcements, from least to most recent. Content IDs are
+	// appended every time that they are announced, so that the least recent
+	// announcement is always found at the front without scanning, and stale
+	// entries are skipped.
+	announcementsMu *sync.Mutex
+	announcements   map[id.Hash]*announcement
+	order           []announced
+
+	pullsMu *sync.Mutex
+	pulls   map[id.Hash]map[*pull]struct{}
+
+	// pullLimiter bounds the number of pulls that are answered for each
+	// remote peer.
+	pullLimiter *policy.SignatoryLimiter
+}
+
+// New returns a Syncer that stores, and serves, content using the
+// ContentResolver.
+func New(opts Options, transport *transport.Transport, resolver dht.ContentResolver) *Syncer {
+	return &Syncer{
+		opts:      opts,
+		transport: transport,
+		resolver:  resolver,
+
+		announcementsMu: new(sync.Mutex),
+		announcements:   map[id.Hash]*announcement{},
+		order:           []announced{},
+
+		pullsMu: new(sync.Mutex),
+		pulls:   map[id.Hash]map[*pull]struct{}{},
+
+		pullLimiter: policy.NewSignatoryLimiter(opts.PullRateLimit, opts.PullBurst),
+	}
+}
+
+// Run the Syncer until the context is done. It must be running for content to
+// be announced, pulled, or served.
+func (s *Syncer) Run(ctx context.Context) {
+	s.transport.ReceiveStream(ctx, s.opts.Stream, func(from id.Signatory, packet wire.Packet) error {
+		s.didReceive(ctx, from, packet.Msg)
+		return nil
+	})
+
+	interval := s.opts.AnnouncementAge / 2
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.expire(time.Now())
+		}
+	}
+}
+
+// Announce content IDs to a random fanout of peers, so that they know to pull
+// the content from the local peer. The content must already be in the
+// ContentResolver. Content IDs are announced in batches of at most
+// MaxAnnouncedIDs. An error is returned if a batch could not be announced to
+// any of the peers.
+func (s *Syncer) Announce(ctx context.Context, contentIDs ...id.Hash) error {
+	if len(contentIDs) == 0 {
+		return nil
+	}
+	peers := s.transport.Table().RandomPeers(s.opts.Fanout)
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+	batchSize := s.opts.MaxAnnouncedIDs
+	if batchSize <= 0 {
+		batchSize = len(contentIDs)
+	}
+	for len(contentIDs) > 0 {
+		n := batchSize
+		if n > len(contentIDs) {
+			n = len(contentIDs)
+		}
+		if err := s.announce(ctx, peers, contentIDs[:n]); err != nil {
+			return err
+		}
+		contentIDs = contentIDs[n:]
+	}
+	return nil
+}
+
+// announce one batch of content IDs to the peers.
+func (s *Syncer) announce(ctx context.Context, peers []id.Signatory, contentIDs []id.Hash) error {
+	data := make([]byte, 0, len(contentIDs)*len(id.Hash{}))
+	for _, contentID := range contentIDs {
+		data = append(data, contentID[:]...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	defer cancel()
+	errs := s.transport.SendToMany(ctx, peers, s.msg(wire.MsgTypePush, data, nil))
+	for peer, err := range errs {
+		s.opts.Logger.Debug("announce", zap.String("peer", peer.String()), zap.Error(err))
+	}
+	if len(errs) == len(peers) {
+		for _, err := range errs {
+			return fmt.Errorf("announcing to %v peers: %w", len(peers), err)
+		}
+	}
+	return nil
+}
+
+// Pull content from remote peers, and insert it into the ContentResolver.
+// Content that is already in the ContentResolver is returned immediately.
+// Otherwise, the peers that announced the content are asked first (most
+// recent first), followed by random peers, with Concurrency peers being asked
+// at once. The content from the first peer that responds with content that
+// matches the content ID is returned.
+func (s *Syncer) Pull(ctx context.Context, contentID id.Hash) ([]byte, error) {
+	if content, ok := s.resolver.QueryContent(contentID[:]); ok {
+		return content, nil
+	}
+	candidates := s.candidates(contentID)
+	if len(candidates) == 0 {
+		return nil, ErrNoPeers
+	}
+
+	p := &pull{responses: make(chan response, len(candidates))}
+	s.pullsMu.Lock()
+	if s.pulls[contentID] == nil {
+		s.pulls[contentID] = map[*pull]struct{}{}
+	}
+	s.pulls[contentID][p] = struct{}{}
+	s.pullsMu.Unlock()
+	defer func() {
+		s.pullsMu.Lock()
+		delete(s.pulls[contentID], p)
+		if len(s.pulls[contentID]) == 0 {
+			delete(s.pulls, contentID)
+		}
+		s.pullsMu.Unlock()
+	}()
+
+	// Responses from peers that were asked in earlier rounds are still
+	// accepted, because they might only be slow.
+	asked := make(map[id.Signatory]struct{}, len(candidates))
+	for len(candidates) > 0 {
+		n := s.opts.Concurrency
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		round := candidates[:n]
+		candidates = candidates[n:]
+
+		waiting := make(map[id.Signatory]struct{}, len(round))
+		for _, peer := range round {
+			asked[peer] = struct{}{}
+			waiting[peer] = struct{}{}
+		}
+		content, err := s.pullRound(ctx, contentID, round, asked, waiting, p)
+		if err != nil {
+			return nil, err
+		}
+		if content != nil {
+			s.resolver.InsertContent(contentID[:], content)
+			return content, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// pullRound asks peers for content, and waits until one of the peers that
+// have been asked responds with the content, all peers in the round have
+// responded without it, or the timeout has passed. It returns nil content if
+// the content was not received.
+func (s *Syncer) pullRound(ctx context.Context, contentID id.Hash, round []id.Signatory, asked, waiting map[id.Signatory]struct{}, p *pull) ([]byte, error) {
+	timer := time.NewTimer(s.opts.Timeout)
+	defer timer.Stop()
+
+	sendCtx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+	errs := s.transport.SendToMany(sendCtx, round, s.msg(wire.MsgTypePull, contentID[:], nil))
+	cancel()
+	for peer, err := range errs {
+		s.opts.Logger.Debug("pull", zap.String("peer", peer.String()), zap.Error(err))
+		delete(waiting, peer)
+	}
+
+	for len(waiting) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, nil
+		case resp := <-p.responses:
+			if _, ok := asked[resp.from]; !ok {
+				continue
+			}
+			delete(waiting, resp.from)
+			if !resp.held {
+				continue
+			}
+			if ContentID(resp.content) != contentID {
+				s.opts.Logger.Warn("pull", zap.String("peer", resp.from.String()), zap.String("id", contentID.String()), zap.Error(fmt.Errorf("content does not match its hash")))
+				s.forget(contentID, resp.from)
+				continue
+			}
+			if resp.content == nil {
+				// Empty content is held, and must not be mistaken for content
+				// that was not received.
+				return []byte{}, nil
+			}
+			return resp.content, nil
+		}
+	}
+	return nil, nil
+}
+
+// Holders returns the remote peers that have announced the content ID, from
+// most to least recent.
+func (s *Syncer) Holders(contentID id.Hash) []id.Signatory {
+	s.announcementsMu.Lock()
+	defer s.announcementsMu.Unlock()
+
+	a, ok := s.announcements[contentID]
+	if !ok {
+		return nil
+	}
+	holders := make([]id.Signatory, len(a.holders))
+	for i := range a.holders {
+		holders[i] = a.holders[len(a.holders)-1-i]
+	}
+	return holders
+}
+
+// candidates returns the peers from which content is pulled, in order: the
+// holders of the content, followed by up to Concurrency random peers that are
+// not holders.
+func (s *Syncer) candidates(contentID id.Hash) []id.Signatory {
+	self := s.transport.Self()
+	holders := s.Holders(contentID)
+	seen := make(map[id.Signatory]struct{}, len(holders))
+	candidates := make([]id.Signatory, 0, len(holders)+s.opts.Concurrency)
+	for _, peer := range holders {
+		seen[peer] = struct{}{}
+		candidates = append(candidates, peer)
+	}
+	// Holders can be chosen randomly too, so enough random peers are chosen
+	// to skip all of them.
+	random := 0
+	for _, peer := range s.transport.Table().RandomPeers(s.opts.Concurrency + len(holders)) {
+		if random == s.opts.Concurrency {
+			break
+		}
+		if _, ok := seen[peer]; ok || peer.Equal(&self) {
+			continue
+		}
+		candidates = append(candidates, peer)
+		random++
+	}
+	return candidates
+}
+
+// remember that a remote peer announced a content ID.
+func (s *Syncer) remember(contentID id.Hash, from id.Signatory, now time.Time) {
+	s.announcementsMu.Lock()
+	defer s.announcementsMu.Unlock()
+
+	a, ok := s.announcements[contentID]
+	if !ok {
+		if len(s.announcements) >= s.opts.MaxAnnouncements {
+			s.evictLocked()
+		}
+		a = &announcement{}
+		s.announcements[contentID] = a
+	}
+	for i, holder := range a.holders {
+		if holder.Equal(&from) {
+			a.holders = append(a.holders[:i], a.holders[i+1:]...)
+			break
+		}
+	}
+	a.holders = append(a.holders, from)
+	if len(a.holders) > s.opts.MaxHolders {
+		a.holders = a.holders[len(a.holders)-s.opts.MaxHolders:]
+	}
+	a.at = now
+
+	s.order = append(s.order, announced{contentID: contentID, at: now})
+	if len(s.order) > 2*len(s.announcements) {
+		s.compactLocked()
+	}
+}
+
+// forget that a remote peer announced a content ID, because it responded with
+// content that does not match the content ID.
+func (s *Syncer) forget(contentID id.Hash, from id.Signatory) {
+	s.announcementsMu.Lock()
+	defer s.announcementsMu.Unlock()
+
+	a, ok := s.announcements[contentID]
+	if !ok {
+		return
+	}
+	for i, holder := range a.holders {
+		if holder.Equal(&from) {
+			a.holders = append(a.holders[:i], a.holders[i+1:]...)
+			break
+		}
+	}
+	if len(a.holders) == 0 {
+		delete(s.announcements, contentID)
+	}
+}
+
+// evictLocked forgets the content ID that was announced least recently.
+func (s *Syncer) evictLocked() {
+	for len(s.order) > 0 {
+		entry := s.popLocked()
+		if s.isLiveLocked(entry) {
+			delete(s.announcements, entry.contentID)
+			return
+		}
+	}
+}
+
+// expire the content IDs that were announced longer ago than the announcement
+// age.
+func (s *Syncer) expire(now time.Time) {
+	s.announcementsMu.Lock()
+	defer s.announcementsMu.Unlock()
+
+	for len(s.order) > 0 {
+		entry := s.order[0]
+		live := s.isLiveLocked(entry)
+		if live && now.Sub(entry.at) <= s.opts.AnnouncementAge {
+			return
+		}
+		s.popLocked()
+		if live {
+			delete(s.announcements, entry.contentID)
+		}
+	}
+}
+
+// isLiveLocked returns true if the entry is the latest announcement of its
+// content ID.
+func (s *Syncer) isLiveLocked(entry announced) bool {
+	a, ok := s.announcements[entry.contentID]
+	return ok && a.at.Equal(entry.at)
+}
+
+// popLocked removes the least recent entry from the order, and returns it.
+func (s *Syncer) popLocked() announced {
+	entry := s.order[0]
+	s.order[0] = announced{}
+	s.order = s.order[1:]
+	return entry
+}
+
+// compactLocked removes the stale entries from the order.
+func (s *Syncer) compactLocked() {
+	order := make([]announced, 0, len(s.announcements))
+	for _, entry := range s.order {
+		if s.isLiveLocked(entry) {
+			order = append(order, entry)
+		}
+	}
+	s.order = order
+}
+
+func (s *Syncer) msg(msgType uint16, data, syncData []byte) wire.Msg {
+	return wire.Msg{
+		Version:  wire.MsgVersion2,
+		Stream:   s.opts.Stream,
+		Type:     msgType,
+		Data:     data,
+		SyncData: syncData,
+	}
+}
+
+func (s *Syncer) didReceive(ctx context.Context, from id.Signatory, msg wire.Msg) {
+	switch msg.Type {
+	case wire.MsgTypePush:
+		if len(msg.Data) == 0 || len(msg.Data)%len(id.Hash{}) != 0 {
+			s.opts.Logger.Debug("announce", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed announcement")))
+			return
+		}
+		if n := len(msg.Data) / len(id.Hash{}); s.opts.MaxAnnouncedIDs > 0 && n > s.opts.MaxAnnouncedIDs {
+			s.opts.Logger.Debug("announce", zap.String("peer", from.String()), zap.Error(fmt.Errorf("too many content IDs: expected at most %v, got %v", s.opts.MaxAnnouncedIDs, n)))
+			return
+		}
+		now := time.Now()
+		for i := 0; i < len(msg.Data); i += len(id.Hash{}) {
+			var contentID id.Hash
+			copy(contentID[:], msg.Data[i:])
+			s.remember(contentID, from, now)
+		}
+
+	case wire.MsgTypePull:
+		if len(msg.Data) != len(id.Hash{}) {
+			s.opts.Logger.Debug("pull", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed pull")))
+			return
+		}
+		if !s.pullLimiter.Allow(from) {
+			s.opts.Logger.Debug("pull", zap.String("peer", from.String()), zap.Error(fmt.Errorf("pull rate limit exceeded")))
+			return
+		}
+		// Peers that do not hold the content still respond, so that the
+		// pulling peer can move on without waiting for the timeout.
+		content, ok := s.resolver.QueryContent(msg.Data)
+		status := statusHeld
+		if !ok {
+			content, status = nil, statusNotHeld
+		}
+		data := make([]byte, 0, len(id.Hash{})+1)
+		data = append(data, msg.Data...)
+		data = append(data, status)
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+			defer cancel()
+			if err := s.transport.Send(ctx, from, s.msg(wire.MsgTypeSync, data, content)); err != nil {
+				s.opts.Logger.Debug("sync", zap.String("peer", from.String()), zap.Error(err))
+			}
+		}()
+
+	case wire.MsgTypeSync:
+		if len(msg.Data) != len(id.Hash{})+1 || msg.Data[len(id.Hash{})] > statusHeld {
+			s.opts.Logger.Debug("sync", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed sync")))
+			return
+		}
+		var contentID id.Hash
+		copy(contentID[:], msg.Data)
+		held := msg.Data[len(id.Hash{})] == statusHeld
+
+		s.pullsMu.Lock()
+		defer s.pullsMu.Unlock()
+		for p := range s.pulls[contentID] {
+			select {
+			case p.responses <- response{from: from, held: held, content: msg.SyncData}:
+			default:
+			}
+		}
+
+	default:
+		s.opts.Logger.Debug("contentsync", zap.String("peer", from.String()), zap.Error(fmt.Errorf("unknown message type: %v", msg.Type)))
+	}
+}
@@ -0,0 +1,13 @@
+package contentsync_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestContentSync(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ContentSync Suite")
+}
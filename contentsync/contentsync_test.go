@@ -0,0 +1,266 @@
+package contentsync_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/renproject/aw/contentsync"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/transport/transporttest"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Content sync", func() {
+	setup := func(ctx context.Context, n int) []*transport.Transport {
+		transports := transporttest.New(ctx, n)
+		transporttest.ConnectAll(transports)
+		return transports
+	}
+
+	newResolver := func() dht.ContentResolver {
+		return dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil)
+	}
+
+	// corruptResolver holds every content ID, but always responds with the
+	// wrong content.
+	corruptResolver := dht.CallbackContentResolver{
+		QueryContentCallback: func([]byte) ([]byte, bool) {
+			return []byte("corrupt"), true
+		},
+	}
+
+	run := func(ctx context.Context, opts contentsync.Options, transport *transport.Transport, resolver dht.ContentResolver) *contentsync.Syncer {
+		syncer := contentsync.New(opts, transport, resolver)
+		go syncer.Run(ctx)
+		return syncer
+	}
+
+	Context("when content is announced", func() {
+		It("should be pulled from the peer that announced it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 3)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop())
+			resolvers := []dht.ContentResolver{newResolver(), newResolver(), newResolver()}
+			syncers := make([]*contentsync.Syncer, len(transports))
+			for i := range transports {
+				syncers[i] = run(ctx, opts, transports[i], resolvers[i])
+			}
+
+			content := []byte("block")
+			contentID := contentsync.ContentID(content)
+			resolvers[0].InsertContent(contentID[:], content)
+			Expect(syncers[0].Announce(ctx, contentID)).To(Succeed())
+			Eventually(func() []id.Signatory { return syncers[1].Holders(contentID) }).Should(Equal([]id.Signatory{transports[0].Self()}))
+			Eventually(func() []id.Signatory { return syncers[2].Holders(contentID) }).Should(Equal([]id.Signatory{transports[0].Self()}))
+
+			pulled, err := syncers[1].Pull(ctx, contentID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pulled).To(Equal(content))
+			stored, ok := resolvers[1].QueryContent(contentID[:])
+			Expect(ok).To(BeTrue())
+			Expect(stored).To(Equal(content))
+		})
+	})
+
+	Context("when a peer responds with content that does not match its hash", func() {
+		It("should be rejected, and the content pulled from the next peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 3)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithConcurrency(1)
+			honest := newResolver()
+			corrupt := run(ctx, opts, transports[0], corruptResolver)
+			run(ctx, opts, transports[1], honest)
+			syncer := run(ctx, opts, transports[2], newResolver())
+
+			content := []byte("block")
+			contentID := contentsync.ContentID(content)
+			honest.InsertContent(contentID[:], content)
+			Expect(corrupt.Announce(ctx, contentID)).To(Succeed())
+			Eventually(func() []id.Signatory { return syncer.Holders(contentID) }).Should(HaveLen(1))
+
+			pulled, err := syncer.Pull(ctx, contentID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pulled).To(Equal(content))
+			Expect(syncer.Holders(contentID)).To(BeEmpty())
+		})
+	})
+
+	Context("when pulling from many peers at once", func() {
+		It("should not wait for peers that do not respond", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The first peer is not running a Syncer, so it never responds.
+			transports := setup(ctx, 3)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithConcurrency(2).WithTimeout(10 * time.Second)
+			honest := newResolver()
+			run(ctx, opts, transports[1], honest)
+			syncer := run(ctx, opts, transports[2], newResolver())
+
+			content := []byte("block")
+			contentID := contentsync.ContentID(content)
+			honest.InsertContent(contentID[:], content)
+
+			start := time.Now()
+			pulled, err := syncer.Pull(ctx, contentID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pulled).To(Equal(content))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+
+	Context("when no peer holds the content", func() {
+		It("should return an error without waiting for the timeout", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 3)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithTimeout(10 * time.Second)
+			syncers := make([]*contentsync.Syncer, len(transports))
+			for i := range transports {
+				syncers[i] = run(ctx, opts, transports[i], newResolver())
+			}
+
+			start := time.Now()
+			_, err := syncers[0].Pull(ctx, contentsync.ContentID([]byte("block")))
+			Expect(err).To(MatchError(contentsync.ErrNotFound))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+
+	Context("when the content is empty", func() {
+		It("should be pulled, and not mistaken for content that is not held", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 2)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithTimeout(10 * time.Second)
+			holder := newResolver()
+			run(ctx, opts, transports[0], holder)
+			syncer := run(ctx, opts, transports[1], newResolver())
+
+			contentID := contentsync.ContentID([]byte{})
+			holder.InsertContent(contentID[:], []byte{})
+			pulled, err := syncer.Pull(ctx, contentID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pulled).To(Equal([]byte{}))
+		})
+	})
+
+	Context("when many content IDs are announced", func() {
+		It("should announce them in batches, and drop announcements with too many content IDs", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 2)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithMaxAnnouncedIDs(2)
+			announcer := run(ctx, opts, transports[0], newResolver())
+			syncer := run(ctx, opts, transports[1], newResolver())
+
+			contentIDs := make([]id.Hash, 5)
+			for i := range contentIDs {
+				contentIDs[i] = contentsync.ContentID([]byte{byte(i)})
+			}
+			Expect(announcer.Announce(ctx, contentIDs...)).To(Succeed())
+			for _, contentID := range contentIDs {
+				Eventually(func() []id.Signatory { return syncer.Holders(contentID) }).Should(Equal([]id.Signatory{transports[0].Self()}))
+			}
+
+			data := []byte{}
+			tooMany := make([]id.Hash, 3)
+			for i := range tooMany {
+				tooMany[i] = contentsync.ContentID([]byte{byte(i), 1})
+				data = append(data, tooMany[i][:]...)
+			}
+			Expect(transports[0].SendOnStream(ctx, transports[1].Self(), contentsync.DefaultStream, wire.Msg{Type: wire.MsgTypePush, Data: data})).To(Succeed())
+			sentinel := contentsync.ContentID([]byte("sentinel"))
+			Expect(announcer.Announce(ctx, sentinel)).To(Succeed())
+			Eventually(func() []id.Signatory { return syncer.Holders(sentinel) }).Should(HaveLen(1))
+			for _, contentID := range tooMany {
+				Expect(syncer.Holders(contentID)).To(BeEmpty())
+			}
+		})
+	})
+
+	Context("when there are too many announcements", func() {
+		It("should forget the content ID that was announced least recently", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 2)
+			opts := contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithMaxAnnouncements(2)
+			announcer := run(ctx, opts, transports[0], newResolver())
+			syncer := run(ctx, opts, transports[1], newResolver())
+
+			a, b, c := contentsync.ContentID([]byte("a")), contentsync.ContentID([]byte("b")), contentsync.ContentID([]byte("c"))
+			for _, contentID := range []id.Hash{a, b, a, c} {
+				Expect(announcer.Announce(ctx, contentID)).To(Succeed())
+			}
+			Eventually(func() []id.Signatory { return syncer.Holders(c) }).Should(HaveLen(1))
+			Expect(syncer.Holders(a)).To(HaveLen(1))
+			Expect(syncer.Holders(b)).To(BeEmpty())
+		})
+	})
+
+	Context("when the announcement age is too short to be halved", func() {
+		It("should run without expiring announcements", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			transports := setup(ctx, 1)
+			syncer := contentsync.New(contentsync.DefaultOptions().WithLogger(zap.NewNop()).WithAnnouncementAge(time.Nanosecond), transports[0], newResolver())
+			syncer.Run(ctx)
+		})
+	})
+
+	Context("when a peer pulls too often", func() {
+		It("should not answer the pulls that exceed the rate limit", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 2)
+			opts := contentsync.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithTimeout(500*time.Millisecond).
+				WithPullRateLimit(rate.Every(time.Hour), 1)
+			holder := newResolver()
+			run(ctx, opts, transports[0], holder)
+			syncer := run(ctx, opts, transports[1], newResolver())
+
+			contents := [][]byte{[]byte("a"), []byte("b")}
+			for _, content := range contents {
+				contentID := contentsync.ContentID(content)
+				holder.InsertContent(contentID[:], content)
+			}
+			pulled, err := syncer.Pull(ctx, contentsync.ContentID(contents[0]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pulled).To(Equal(contents[0]))
+			_, err = syncer.Pull(ctx, contentsync.ContentID(contents[1]))
+			Expect(err).To(MatchError(contentsync.ErrNotFound))
+		})
+	})
+
+	Context("when there are no peers", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := setup(ctx, 1)
+			syncer := contentsync.New(contentsync.DefaultOptions().WithLogger(zap.NewNop()), transports[0], newResolver())
+			Expect(syncer.Announce(ctx, contentsync.ContentID([]byte("block")))).To(MatchError(contentsync.ErrNoPeers))
+			_, err := syncer.Pull(ctx, contentsync.ContentID([]byte("block")))
+			Expect(err).To(MatchError(contentsync.ErrNoPeers))
+		})
+	})
+})
@@ -0,0 +1,139 @@
+package contentsync
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// DefaultStream is high, so that it does not collide with the streams
+	// chosen by applications, or with the transfer and gossip streams.
+	DefaultStream           = uint16(0xFFF2)
+	DefaultFanout           = 8
+	DefaultConcurrency      = 3
+	DefaultTimeout          = 5 * time.Second
+	DefaultMaxHolders       = 16
+	DefaultMaxAnnouncements = 4096
+	DefaultAnnouncementAge  = 5 * time.Minute
+	DefaultMaxAnnouncedIDs  = 64
+	DefaultPullRateLimit    = rate.Limit(16)
+	DefaultPullBurst        = 64
+)
+
+// Options for synchronising content between peers.
+type Options struct {
+	Logger           *zap.Logger
+	Stream           uint16
+	Fanout           int
+	Concurrency      int
+	Timeout          time.Duration
+	MaxHolders       int
+	MaxAnnouncements int
+	AnnouncementAge  time.Duration
+	MaxAnnouncedIDs  int
+	PullRateLimit    rate.Limit
+	PullBurst        int
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return Options{
+		Logger:           logger,
+		Stream:           DefaultStream,
+		Fanout:           DefaultFanout,
+		Concurrency:      DefaultConcurrency,
+		Timeout:          DefaultTimeout,
+		MaxHolders:       DefaultMaxHolders,
+		MaxAnnouncements: DefaultMaxAnnouncements,
+		AnnouncementAge:  DefaultAnnouncementAge,
+		MaxAnnouncedIDs:  DefaultMaxAnnouncedIDs,
+		PullRateLimit:    DefaultPullRateLimit,
+		PullBurst:        DefaultPullBurst,
+	}
+}
+
+// WithLogger sets the Logger used for logging all errors, warnings, information,
+// debug traces, and so on.
+func (opts Options) WithLogger(logger *zap.Logger) Options {
+	opts.Logger = logger
+	return opts
+}
+
+// WithStream sets the stream on which content is announced, and pulled. All
+// peers must use the same stream.
+func (opts Options) WithStream(stream uint16) Options {
+	opts.Stream = stream
+	return opts
+}
+
+// WithFanout sets the number of random peers to which content IDs are
+// announced.
+func (opts Options) WithFanout(fanout int) Options {
+	opts.Fanout = fanout
+	return opts
+}
+
+// WithConcurrency sets the number of peers from which content is pulled at
+// once. Content is returned as soon as one of them responds with content that
+// matches its hash, and the next peers are only asked if none of them do.
+func (opts Options) WithConcurrency(concurrency int) Options {
+	opts.Concurrency = concurrency
+	return opts
+}
+
+// WithTimeout sets how long to wait for the peers that are being pulled from
+// before moving on to the next peers.
+func (opts Options) WithTimeout(timeout time.Duration) Options {
+	opts.Timeout = timeout
+	return opts
+}
+
+// WithMaxHolders sets the maximum number of peers that are remembered as
+// holding a content ID. The peers that announced the content ID most recently
+// are kept.
+func (opts Options) WithMaxHolders(maxHolders int) Options {
+	opts.MaxHolders = maxHolders
+	return opts
+}
+
+// WithMaxAnnouncements sets the maximum number of announced content IDs that
+// are remembered. When there are too many, the content ID that was announced
+// least recently is forgotten.
+func (opts Options) WithMaxAnnouncements(maxAnnouncements int) Options {
+	opts.MaxAnnouncements = maxAnnouncements
+	return opts
+}
+
+// WithAnnouncementAge sets how long announced content IDs are remembered. They
+// are expired at every half of the age. If the age is too short to be halved,
+// they are never expired, and are only forgotten to make room for new content
+// IDs (see WithMaxAnnouncements).
+func (opts Options) WithAnnouncementAge(age time.Duration) Options {
+	opts.AnnouncementAge = age
+	return opts
+}
+
+// WithMaxAnnouncedIDs sets the maximum number of content IDs in one
+// announcement. Content IDs are announced in batches of at most this many, and
+// announcements from remote peers that have more are dropped. All peers must
+// use the same maximum, or a larger one.
+func (opts Options) WithMaxAnnouncedIDs(max int) Options {
+	opts.MaxAnnouncedIDs = max
+	return opts
+}
+
+// WithPullRateLimit sets the number of pulls that are answered for each remote
+// peer per second, and the number of pulls that can be answered in a burst.
+// Pulls that exceed the limit are dropped, so remote peers that pull too often
+// wait for their timeout before moving on to other peers.
+func (opts Options) WithPullRateLimit(limit rate.Limit, burst int) Options {
+	opts.PullRateLimit = limit
+	opts.PullBurst = burst
+	return opts
+}
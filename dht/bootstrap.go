@@ -0,0 +1,263 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+var (
+	// DefaultBootstrapBackoff is the default backoff between failed bootstrap
+	// attempts.
+	DefaultBootstrapBackoff = policy.MaxTimeout(time.Minute, policy.ExponentialBackoff(2, policy.ConstantTimeout(time.Second)))
+	// DefaultBootstrapPullTimeout is the default time allowed for pulling the
+	// peer list of each seed.
+	DefaultBootstrapPullTimeout = 10 * time.Second
+	// DefaultBootstrapMaxAttempts is the default maximum number of bootstrap
+	// attempts. Zero means that attempts are made until the context is done.
+	DefaultBootstrapMaxAttempts = 0
+	// DefaultBootstrapMinPeers is the default number of peers below which the
+	// table is bootstrapped again.
+	DefaultBootstrapMinPeers = 8
+	// DefaultBootstrapCheckInterval is the default interval at which the
+	// number of peers in the table is checked.
+	DefaultBootstrapCheckInterval = time.Minute
+)
+
+// ErrBootstrapFailed is returned when no seed could be pulled within the
+// maximum number of bootstrap attempts.
+var ErrBootstrapFailed = errors.New("bootstrap failed")
+
+// A PullFunc returns the peer list of a seed (for example, by pinging it and
+// waiting for its ping ack). The seed is in the table when the PullFunc is
+// called, so it can be dialed by its signatory.
+type PullFunc func(ctx context.Context, seed id.Signatory) ([]wire.SignatoryAndAddress, error)
+
+// BootstrapperOptions for parameterising the behaviour of the Bootstrapper.
+type BootstrapperOptions struct {
+	Logger                 *zap.Logger
+	Backoff                policy.Timeout
+	PullTimeout            time.Duration
+	MaxAttempts            int
+	MinPeers               int
+	CheckInterval          time.Duration
+	RequireSignedAddresses bool
+}
+
+// DefaultBootstrapperOptions returns the default BootstrapperOptions.
+func DefaultBootstrapperOptions() BootstrapperOptions {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return BootstrapperOptions{
+		Logger:        logger,
+		Backoff:       DefaultBootstrapBackoff,
+		PullTimeout:   DefaultBootstrapPullTimeout,
+		MaxAttempts:   DefaultBootstrapMaxAttempts,
+		MinPeers:      DefaultBootstrapMinPeers,
+		CheckInterval: DefaultBootstrapCheckInterval,
+	}
+}
+
+// WithLogger sets the logger.
+func (opts BootstrapperOptions) WithLogger(logger *zap.Logger) BootstrapperOptions {
+	opts.Logger = logger
+	return opts
+}
+
+// WithBackoff sets the backoff between failed bootstrap attempts. The attempt
+// passed to the Timeout is the number of attempts that have failed so far.
+func (opts BootstrapperOptions) WithBackoff(backoff policy.Timeout) BootstrapperOptions {
+	opts.Backoff = backoff
+	return opts
+}
+
+// WithPullTimeout sets the time allowed for pulling the peer list of each
+// seed, so that seeds that never answer do not stall an attempt. If it is not
+// positive, pulls are only bounded by the context.
+func (opts BootstrapperOptions) WithPullTimeout(timeout time.Duration) BootstrapperOptions {
+	opts.PullTimeout = timeout
+	return opts
+}
+
+// WithMaxAttempts sets the maximum number of attempts made by one bootstrap.
+// If it is not positive, attempts are made until the context is done.
+func (opts BootstrapperOptions) WithMaxAttempts(maxAttempts int) BootstrapperOptions {
+	opts.MaxAttempts = maxAttempts
+	return opts
+}
+
+// WithMinPeers sets the number of peers below which the table is bootstrapped
+// again when running the Bootstrapper. Seeds are counted as peers.
+func (opts BootstrapperOptions) WithMinPeers(minPeers int) BootstrapperOptions {
+	opts.MinPeers = minPeers
+	return opts
+}
+
+// WithCheckInterval sets the interval at which the number of peers in the
+// table is checked when running the Bootstrapper.
+func (opts BootstrapperOptions) WithCheckInterval(interval time.Duration) BootstrapperOptions {
+	opts.CheckInterval = interval
+	return opts
+}
+
+// WithRequireSignedAddresses drops entries with unsigned network addresses
+// from the peer lists of seeds. The network addresses of seeds are trusted,
+// and are always added.
+func (opts BootstrapperOptions) WithRequireSignedAddresses(require bool) BootstrapperOptions {
+	opts.RequireSignedAddresses = require
+	return opts
+}
+
+// The Bootstrapper populates a Table from a list of seeds. The seeds are
+// added to the table, and their peer lists are pulled, verified, and added to
+// the table. Failed attempts are retried with a backoff, and the table is
+// bootstrapped again whenever it shrinks below a minimum number of peers.
+type Bootstrapper struct {
+	opts  BootstrapperOptions
+	table Table
+	seeds []wire.SignatoryAndAddress
+	pull  PullFunc
+
+	// bootstrapMu stops concurrent bootstraps from pulling the same seeds.
+	bootstrapMu *sync.Mutex
+}
+
+// NewBootstrapper returns a Bootstrapper that populates the table from the
+// seeds, using the PullFunc to pull their peer lists.
+func NewBootstrapper(opts BootstrapperOptions, table Table, seeds []wire.SignatoryAndAddress, pull PullFunc) *Bootstrapper {
+	copied := make([]wire.SignatoryAndAddress, len(seeds))
+	copy(copied, seeds)
+	return &Bootstrapper{
+		opts:  opts,
+		table: table,
+		seeds: copied,
+		pull:  pull,
+
+		bootstrapMu: new(sync.Mutex),
+	}
+}
+
+// Bootstrap the table, and return the number of entries from the peer lists
+// of seeds that were added to it. An attempt succeeds when at least one seed
+// is pulled. Failed attempts are retried after the backoff, until the maximum
+// number of attempts is made (in which case ErrBootstrapFailed is returned),
+// or the context is done.
+func (b *Bootstrapper) Bootstrap(ctx context.Context) (int, error) {
+	b.bootstrapMu.Lock()
+	defer b.bootstrapMu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		added, pulled := b.attempt(ctx)
+		if pulled {
+			b.opts.Logger.Debug("bootstrapped", zap.Int("attempts", attempt+1), zap.Int("added", added))
+			return added, nil
+		}
+		if b.opts.MaxAttempts > 0 && attempt+1 >= b.opts.MaxAttempts {
+			return 0, fmt.Errorf("%w: no seed pulled after %v attempts", ErrBootstrapFailed, attempt+1)
+		}
+
+		timer := time.NewTimer(b.opts.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Run the Bootstrapper until the context is done. The table is bootstrapped
+// immediately, and then again whenever the number of peers in the table is
+// found to be below the minimum. The number of peers is checked when peers
+// are removed from the table, and at the check interval (in case PeerEvents
+// are dropped).
+func (b *Bootstrapper) Run(ctx context.Context) {
+	events := make(chan PeerEvent, 64)
+	unsubscribe := b.table.Subscribe(events)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(b.opts.CheckInterval)
+	defer ticker.Stop()
+
+	shrunk := true
+	for {
+		if shrunk {
+			if _, err := b.Bootstrap(ctx); err != nil {
+				b.opts.Logger.Warn("bootstrapping", zap.Error(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Type != PeerRemoved {
+				shrunk = false
+				continue
+			}
+		case <-ticker.C:
+		}
+		shrunk = b.table.NumPeers() < b.opts.MinPeers
+	}
+}
+
+// attempt to pull every seed, and return the number of entries that were
+// added to the table, and whether at least one seed was pulled. Seeds are
+// pulled concurrently, each within the pull timeout.
+func (b *Bootstrapper) attempt(ctx context.Context) (int, bool) {
+	self := b.table.Self()
+	for _, seed := range b.seeds {
+		if !seed.Signatory.Equal(&self) {
+			b.table.AddPeer(seed.Signatory, seed.Address)
+		}
+	}
+
+	mu := new(sync.Mutex)
+	added, pulled := 0, false
+	wg := new(sync.WaitGroup)
+	for _, seed := range b.seeds {
+		if seed.Signatory.Equal(&self) {
+			continue
+		}
+		wg.Add(1)
+		go func(seed wire.SignatoryAndAddress) {
+			defer wg.Done()
+
+			list, err := b.pullSeed(ctx, seed.Signatory)
+			if err != nil {
+				b.opts.Logger.Debug("pulling seed", zap.String("seed", seed.Signatory.String()), zap.Error(err))
+				return
+			}
+			entries := wire.VerifyPeerList(list, self, b.opts.RequireSignedAddresses, nil)
+			for _, entry := range entries {
+				b.table.AddPeerAddresses(entry.Signatory, entry.Addresses)
+			}
+			b.opts.Logger.Debug("pulled seed", zap.String("seed", seed.Signatory.String()), zap.Int("received", len(list)), zap.Int("added", len(entries)))
+
+			mu.Lock()
+			defer mu.Unlock()
+			added += len(entries)
+			pulled = true
+		}(seed)
+	}
+	wg.Wait()
+	return added, pulled
+}
+
+// pullSeed pulls the peer list of a seed within the pull timeout.
+func (b *Bootstrapper) pullSeed(ctx context.Context, seed id.Signatory) ([]wire.SignatoryAndAddress, error) {
+	if b.opts.PullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.opts.PullTimeout)
+		defer cancel()
+	}
+	return b.pull(ctx, seed)
+}
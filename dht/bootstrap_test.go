@@ -0,0 +1,177 @@
+package dht_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bootstrapper", func() {
+	opts := func() dht.BootstrapperOptions {
+		return dht.DefaultBootstrapperOptions().
+			WithLogger(zap.NewNop()).
+			WithBackoff(policy.ConstantTimeout(10 * time.Millisecond))
+	}
+
+	Context("when a seed can be pulled", func() {
+		It("should add the seeds, and the verified entries of their peer lists", func() {
+			self := id.NewPrivKey().Signatory()
+			table := dht.NewInMemTable(self)
+			seed := wire.SignatoryAndAddress{
+				Signatory: id.NewPrivKey().Signatory(),
+				Address:   wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1),
+			}
+
+			signer := id.NewPrivKey()
+			signed := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 1)
+			Expect(signed.Sign(signer)).To(Succeed())
+			forged := wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3002", 1)
+			Expect(forged.Sign(id.NewPrivKey())).To(Succeed())
+			unsigned := wire.SignatoryAndAddress{
+				Signatory: id.NewPrivKey().Signatory(),
+				Address:   wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3003", 1),
+			}
+			forger := id.NewPrivKey().Signatory()
+			list := []wire.SignatoryAndAddress{
+				{Signatory: self, Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3004", 1)},
+				{Signatory: signer.Signatory(), Address: signed},
+				{Signatory: forger, Address: forged},
+				unsigned,
+			}
+			pull := func(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+				Expect(remote).To(Equal(seed.Signatory))
+				return list, nil
+			}
+
+			bootstrapper := dht.NewBootstrapper(opts().WithRequireSignedAddresses(true), table, []wire.SignatoryAndAddress{seed}, pull)
+			added, err := bootstrapper.Bootstrap(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(added).To(Equal(1))
+			Expect(table.NumPeers()).To(Equal(2))
+			addr, ok := table.PeerAddress(seed.Signatory)
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(seed.Address))
+			addr, ok = table.PeerAddress(signer.Signatory())
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(signed))
+			_, ok = table.PeerAddress(forger)
+			Expect(ok).To(BeFalse())
+
+			bootstrapper = dht.NewBootstrapper(opts(), table, []wire.SignatoryAndAddress{seed}, pull)
+			added, err = bootstrapper.Bootstrap(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(added).To(Equal(2))
+			_, ok = table.PeerAddress(unsigned.Signatory)
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when pulling seeds fails", func() {
+		It("should retry with the backoff until a seed is pulled", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			seeds := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1)},
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 1)},
+			}
+			pulls := int64(0)
+			pull := func(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+				if atomic.AddInt64(&pulls, 1) <= 5 {
+					return nil, fmt.Errorf("offline")
+				}
+				return nil, nil
+			}
+
+			bootstrapper := dht.NewBootstrapper(opts(), table, seeds, pull)
+			_, err := bootstrapper.Bootstrap(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(atomic.LoadInt64(&pulls)).To(Equal(int64(6)))
+			Expect(table.NumPeers()).To(Equal(2))
+		})
+
+		It("should pull seeds concurrently, and give up on seeds after the pull timeout", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			seeds := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1)},
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 1)},
+			}
+			other := wire.SignatoryAndAddress{
+				Signatory: id.NewPrivKey().Signatory(),
+				Address:   wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3002", 1),
+			}
+			pull := func(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+				if remote == seeds[0].Signatory {
+					// The first seed never answers.
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return []wire.SignatoryAndAddress{other}, nil
+			}
+
+			bootstrapper := dht.NewBootstrapper(opts().WithPullTimeout(100*time.Millisecond), table, seeds, pull)
+			start := time.Now()
+			added, err := bootstrapper.Bootstrap(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(added).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(table.NumPeers()).To(Equal(3))
+		})
+
+		It("should give up after the maximum number of attempts", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			seeds := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1)},
+			}
+			pulls := int64(0)
+			pull := func(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+				atomic.AddInt64(&pulls, 1)
+				return nil, fmt.Errorf("offline")
+			}
+
+			bootstrapper := dht.NewBootstrapper(opts().WithMaxAttempts(3), table, seeds, pull)
+			_, err := bootstrapper.Bootstrap(context.Background())
+			Expect(errors.Is(err, dht.ErrBootstrapFailed)).To(BeTrue())
+			Expect(atomic.LoadInt64(&pulls)).To(Equal(int64(3)))
+		})
+	})
+
+	Context("when running", func() {
+		It("should bootstrap again as soon as the table shrinks below the minimum", func() {
+			table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+			seeds := []wire.SignatoryAndAddress{
+				{Signatory: id.NewPrivKey().Signatory(), Address: wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1)},
+			}
+			other := wire.SignatoryAndAddress{
+				Signatory: id.NewPrivKey().Signatory(),
+				Address:   wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 1),
+			}
+			pulls := int64(0)
+			pull := func(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+				atomic.AddInt64(&pulls, 1)
+				return []wire.SignatoryAndAddress{other}, nil
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			bootstrapper := dht.NewBootstrapper(opts().WithMinPeers(2).WithCheckInterval(time.Hour), table, seeds, pull)
+			go bootstrapper.Run(ctx)
+
+			Eventually(table.NumPeers).Should(Equal(2))
+			Consistently(func() int64 { return atomic.LoadInt64(&pulls) }, 100*time.Millisecond).Should(Equal(int64(1)))
+
+			table.DeletePeer(other.Signatory)
+			Eventually(table.NumPeers).Should(Equal(2))
+			Expect(atomic.LoadInt64(&pulls)).To(Equal(int64(2)))
+		})
+	})
+})
@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"sync"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// PeerEventType is the type of change to a peer in a Table.
+type PeerEventType uint8
+
+// Enumerate all valid PeerEventType values.
+const (
+	// PeerAdded events are delivered when a peer that was not in the table is
+	// added to it.
+	PeerAdded = PeerEventType(1)
+	// PeerUpdated events are delivered when the network addresses of a peer
+	// in the table are replaced by network addresses that supersede them.
+	PeerUpdated = PeerEventType(2)
+	// PeerRemoved events are delivered when a peer is deleted from the table
+	// (for example, because it has expired).
+	PeerRemoved = PeerEventType(3)
+)
+
+// String implements the Stringer interface.
+func (ty PeerEventType) String() string {
+	switch ty {
+	case PeerAdded:
+		return "added"
+	case PeerUpdated:
+		return "updated"
+	case PeerRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// A PeerEvent is a change to a peer in a Table. The Addresses are the network
+// addresses of the peer after the change, in order of priority, and are nil
+// for PeerRemoved events. They are shared by all subscribers, so they must not
+// be modified.
+type PeerEvent struct {
+	Type      PeerEventType
+	Peer      id.Signatory
+	Addresses []wire.Address
+}
+
+// subscribers to the PeerEvents of a table.
+type subscribers struct {
+	mu   *sync.Mutex
+	next uint64
+	chs  map[uint64]chan<- PeerEvent
+}
+
+func newSubscribers() subscribers {
+	return subscribers{
+		mu:  new(sync.Mutex),
+		chs: map[uint64]chan<- PeerEvent{},
+	}
+}
+
+// subscribe a channel, and return a function that unsubscribes it.
+func (subs *subscribers) subscribe(ch chan<- PeerEvent) func() {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	key := subs.next
+	subs.next++
+	subs.chs[key] = ch
+	return func() {
+		subs.mu.Lock()
+		defer subs.mu.Unlock()
+
+		delete(subs.chs, key)
+	}
+}
+
+// publish the event to all subscribers, without waiting for them. Events are
+// dropped for subscribers that have no room in their channels.
+func (subs *subscribers) publish(event PeerEvent) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+
+	for _, ch := range subs.chs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
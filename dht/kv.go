@@ -0,0 +1,282 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotFound is returned by a KV when a key does not exist.
+var ErrNotFound = errors.New("not found")
+
+// A KV is a persistent key-value store. It is intentionally small, so that it
+// can be implemented by adapting embedded databases (such as BoltDB, Badger,
+// or LevelDB) without much effort. Keys and values passed to a KV can be
+// modified after the call returns, and keys and values returned by a KV can
+// be modified by the caller.
+type KV interface {
+	// Get the value of a key. It returns ErrNotFound if the key does not
+	// exist.
+	Get(key []byte) ([]byte, error)
+	// Put a value for a key, replacing the value that already exists.
+	Put(key, value []byte) error
+	// Delete a key. Deleting a key that does not exist is not an error.
+	Delete(key []byte) error
+	// Iterate over all keys with a prefix, in ascending order. Iteration stops
+	// at the first error returned by the function, and the error is returned.
+	// The KV must not be modified during iteration.
+	Iterate(prefix []byte, f func(key, value []byte) error) error
+}
+
+// Operations recorded by the log of a FileKV.
+const (
+	fileKVPut    = byte(1)
+	fileKVDelete = byte(2)
+)
+
+// fileKVHeaderSize is the size of the checksum, operation, key length, and
+// value length of a record in the log of a FileKV.
+const fileKVHeaderSize = 4 + 1 + 4 + 4
+
+// FileKV implements the KV interface using an append-only log file. Every
+// record in the log is checksummed and synced to disk before returning, and
+// all keys are held in memory. When the log is opened, records are replayed
+// until the first record that is truncated or corrupt (for example, because
+// the process crashed part way through a write), and the log is truncated to
+// the end of the last good record. The log is compacted when it is opened,
+// and whenever most of its records have been replaced or deleted.
+type FileKV struct {
+	path string
+
+	mu      *sync.Mutex
+	f       *os.File
+	values  map[string][]byte
+	records int
+}
+
+// NewFileKV opens the FileKV stored in the file at the given path, recovering
+// and compacting its log. The file, and its directory, are created if they do
+// not exist.
+func NewFileKV(path string) (*FileKV, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("create kv directory: %w", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	values := map[string][]byte{}
+	for len(data) > 0 {
+		op, key, value, n := readFileKVRecord(data)
+		if n == 0 {
+			break
+		}
+		switch op {
+		case fileKVPut:
+			values[string(key)] = value
+		case fileKVDelete:
+			delete(values, string(key))
+		}
+		data = data[n:]
+	}
+
+	kv := &FileKV{
+		path: path,
+
+		mu:     new(sync.Mutex),
+		values: values,
+	}
+	if err := kv.compact(); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// Close the log file. The FileKV must not be used after it is closed.
+func (kv *FileKV) Close() error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.f.Close()
+}
+
+// Get the value of a key.
+func (kv *FileKV) Get(key []byte) ([]byte, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	value, ok := kv.values[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+// Put a value for a key, and sync it to disk.
+func (kv *FileKV) Put(key, value []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if err := kv.append(fileKVPut, key, value); err != nil {
+		return err
+	}
+	kv.values[string(key)] = append([]byte{}, value...)
+	return kv.maybeCompact()
+}
+
+// Delete a key, and sync the deletion to disk.
+func (kv *FileKV) Delete(key []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, ok := kv.values[string(key)]; !ok {
+		return nil
+	}
+	if err := kv.append(fileKVDelete, key, nil); err != nil {
+		return err
+	}
+	delete(kv.values, string(key))
+	return kv.maybeCompact()
+}
+
+// Iterate over all keys with a prefix, in ascending order.
+func (kv *FileKV) Iterate(prefix []byte, f func(key, value []byte) error) error {
+	kv.mu.Lock()
+	keys := make([]string, 0, len(kv.values))
+	for key := range kv.values {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	values := make([][]byte, len(keys))
+	sort.Strings(keys)
+	for i, key := range keys {
+		values[i] = append([]byte{}, kv.values[key]...)
+	}
+	kv.mu.Unlock()
+
+	for i, key := range keys {
+		if err := f([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kv *FileKV) append(op byte, key, value []byte) error {
+	if _, err := kv.f.Write(fileKVRecord(op, key, value)); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if err := kv.f.Sync(); err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	kv.records++
+	return nil
+}
+
+// maybeCompact compacts the log when less than half of its records are live.
+// The mutex must be held.
+func (kv *FileKV) maybeCompact() error {
+	if kv.records < 2*len(kv.values) || kv.records < 64 {
+		return nil
+	}
+	return kv.compact()
+}
+
+// compact writes all live values to a temporary file, syncs it to disk, and
+// renames it over the log. A crash at any point leaves either the old log or
+// the new log in place. The mutex must be held (or the FileKV must not be
+// shared yet).
+func (kv *FileKV) compact() error {
+	keys := make([]string, 0, len(kv.values))
+	for key := range kv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(kv.path), ".compact-")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	for _, key := range keys {
+		if _, err := tmp.Write(fileKVRecord(fileKVPut, []byte(key), kv.values[key])); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), kv.path); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(kv.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	f, err := os.OpenFile(kv.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	if kv.f != nil {
+		kv.f.Close()
+	}
+	kv.f = f
+	kv.records = len(keys)
+	return nil
+}
+
+// fileKVRecord returns a checksummed record. The checksum covers the
+// operation, the lengths, the key, and the value.
+func fileKVRecord(op byte, key, value []byte) []byte {
+	record := make([]byte, fileKVHeaderSize+len(key)+len(value))
+	record[4] = op
+	binary.BigEndian.PutUint32(record[5:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:], uint32(len(value)))
+	copy(record[fileKVHeaderSize:], key)
+	copy(record[fileKVHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// readFileKVRecord reads the record at the start of the data. It returns the
+// number of bytes in the record, or zero if the record is truncated or
+// corrupt.
+func readFileKVRecord(data []byte) (byte, []byte, []byte, int) {
+	if len(data) < fileKVHeaderSize {
+		return 0, nil, nil, 0
+	}
+	keyLen := uint64(binary.BigEndian.Uint32(data[5:]))
+	valueLen := uint64(binary.BigEndian.Uint32(data[9:]))
+	n := uint64(fileKVHeaderSize) + keyLen + valueLen
+	if uint64(len(data)) < n {
+		return 0, nil, nil, 0
+	}
+	if crc32.ChecksumIEEE(data[4:n]) != binary.BigEndian.Uint32(data) {
+		return 0, nil, nil, 0
+	}
+	key := data[fileKVHeaderSize : fileKVHeaderSize+keyLen]
+	value := append([]byte{}, data[fileKVHeaderSize+keyLen:n]...)
+	return data[4], key, value, int(n)
+}
+
+// Force FileKV to implement the KV interface, and the io.Closer interface.
+var (
+	_ KV        = &FileKV{}
+	_ io.Closer = &FileKV{}
+)
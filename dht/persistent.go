@@ -0,0 +1,252 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+	"go.uber.org/zap"
+)
+
+// Force PersistentTable to implement the Table interface.
+var _ Table = &PersistentTable{}
+
+// SchemaVersion is the version of the schema used by PersistentTables to store
+// peers, subnets, and groups in a KV. It is incremented whenever the schema
+// changes, and a migration from the previous version is added.
+const SchemaVersion = uint32(1)
+
+// ErrSchemaVersion is returned when a KV was written using a schema that is
+// newer than SchemaVersion, and so it cannot be read.
+var ErrSchemaVersion = errors.New("unknown schema version")
+
+// Keys, and key prefixes, of the schema.
+var (
+	keySchemaVersion = []byte("version")
+	prefixPeer       = []byte("peer/")
+	prefixSubnet     = []byte("subnet/")
+	prefixGroup      = []byte("group/")
+)
+
+// migrations[v] migrates a KV from version v of the schema to version v+1.
+var migrations = []func(KV) error{
+	// Version 0 is a KV that has never been used by a PersistentTable, so
+	// there is nothing to migrate.
+	func(KV) error { return nil },
+}
+
+// Migrate a KV to the SchemaVersion, by running all migrations from the
+// version of the schema that is stored in the KV. The version is stored after
+// every migration, so a migration that is interrupted (for example, by a
+// crash) is run again when the KV is next migrated. Migrations must be
+// idempotent.
+func Migrate(kv KV) error {
+	version := uint32(0)
+	value, err := kv.Get(keySchemaVersion)
+	switch {
+	case err == nil:
+		if len(value) != 4 {
+			return fmt.Errorf("bad schema version: expected 4 bytes, got %v bytes", len(value))
+		}
+		version = binary.BigEndian.Uint32(value)
+	case !errors.Is(err, ErrNotFound):
+		return fmt.Errorf("get schema version: %w", err)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("%w: expected at most %v, got %v", ErrSchemaVersion, SchemaVersion, version)
+	}
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](kv); err != nil {
+			return fmt.Errorf("migrate from schema version %v: %w", version, err)
+		}
+		value := [4]byte{}
+		binary.BigEndian.PutUint32(value[:], version+1)
+		if err := kv.Put(keySchemaVersion, value[:]); err != nil {
+			return fmt.Errorf("put schema version: %w", err)
+		}
+	}
+	return nil
+}
+
+// PersistentTable implements the Table using an InMemTable that writes peers,
+// subnets, and groups through to a KV. When a PersistentTable is created, it
+// restores them from the KV, so that a restarted node does not need to
+// bootstrap its table from scratch. Expiries are not persisted, because they
+// are relative to the lifetime of the process.
+//
+// Errors returned by the KV are logged, instead of being returned, because the
+// Table interface does not return errors. The in-memory table is always
+// updated, so a faulty KV only causes peers and subnets to be lost on restart.
+type PersistentTable struct {
+	*InMemTable
+
+	kv     KV
+	logger *zap.Logger
+}
+
+// NewPersistentTable migrates the KV to the SchemaVersion, and returns a
+// PersistentTable that is restored from it.
+func NewPersistentTable(self id.Signatory, kv KV, logger *zap.Logger) (*PersistentTable, error) {
+	if err := Migrate(kv); err != nil {
+		return nil, err
+	}
+	table := &PersistentTable{
+		InMemTable: NewInMemTable(self),
+
+		kv:     kv,
+		logger: logger,
+	}
+
+	err := kv.Iterate(prefixPeer, func(key, value []byte) error {
+		peerID := id.Signatory{}
+		if len(key) != len(prefixPeer)+len(peerID) {
+			return fmt.Errorf("bad peer key: %x", key)
+		}
+		copy(peerID[:], key[len(prefixPeer):])
+		addrs := []wire.Address{}
+		if err := surge.FromBinary(&addrs, value); err != nil {
+			return fmt.Errorf("unmarshal addresses of %v: %w", peerID, err)
+		}
+		table.InMemTable.AddPeerAddresses(peerID, addrs)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore peers: %w", err)
+	}
+
+	err = kv.Iterate(prefixSubnet, func(key, value []byte) error {
+		if len(value)%len(id.Signatory{}) != 0 {
+			return fmt.Errorf("bad subnet: %v bytes", len(value))
+		}
+		signatories := make([]id.Signatory, len(value)/len(id.Signatory{}))
+		for i := range signatories {
+			copy(signatories[i][:], value[i*len(id.Signatory{}):])
+		}
+		table.InMemTable.AddSubnet(signatories)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore subnets: %w", err)
+	}
+
+	err = kv.Iterate(prefixGroup, func(key, value []byte) error {
+		group, peerID := id.Hash{}, id.Signatory{}
+		if len(key) != len(prefixGroup)+len(group)+len(peerID) {
+			return fmt.Errorf("bad group key: %x", key)
+		}
+		copy(group[:], key[len(prefixGroup):])
+		copy(peerID[:], key[len(prefixGroup)+len(group):])
+		table.InMemTable.AddToGroup(peerID, group)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore groups: %w", err)
+	}
+	return table, nil
+}
+
+// AddPeer to the table, and to the KV if its network address is accepted.
+func (table *PersistentTable) AddPeer(peerID id.Signatory, peerAddr wire.Address) {
+	table.AddPeerAddresses(peerID, []wire.Address{peerAddr})
+}
+
+// AddPeerAddresses to the table, and to the KV if its network addresses are
+// accepted. Peers that are evicted to make room for it are deleted from the KV.
+// Network addresses that only differ from the stored ones in their nonces (and
+// signatures) are not written to the KV again, because peers refresh their
+// addresses often, and every write to the KV is synced to disk. The stored
+// addresses are still valid, and are superseded once the peer is seen again.
+func (table *PersistentTable) AddPeerAddresses(peerID id.Signatory, peerAddrs []wire.Address) {
+	accepted, changed, evicted := table.InMemTable.updatePeer(peerID, peerAddrs)
+	for _, evictedID := range evicted {
+		if err := table.kv.Delete(peerKey(evictedID)); err != nil {
+			table.logger.Error("delete peer", zap.String("peer", evictedID.String()), zap.Error(err))
+		}
+	}
+	if !accepted || !changed {
+		return
+	}
+	value, err := surge.ToBinary(peerAddrs)
+	if err != nil {
+		table.logger.Error("marshal addresses", zap.String("peer", peerID.String()), zap.Error(err))
+	} else if err := table.kv.Put(peerKey(peerID), value); err != nil {
+		table.logger.Error("put peer", zap.String("peer", peerID.String()), zap.Error(err))
+	}
+}
+
+// DeletePeer from the table, and from the KV.
+func (table *PersistentTable) DeletePeer(peerID id.Signatory) {
+	if err := table.kv.Delete(peerKey(peerID)); err != nil {
+		table.logger.Error("delete peer", zap.String("peer", peerID.String()), zap.Error(err))
+	}
+	table.InMemTable.DeletePeer(peerID)
+}
+
+// HandleExpired deletes the peer from the table, and from the KV, if it has
+// expired.
+func (table *PersistentTable) HandleExpired(peerID id.Signatory) bool {
+	expired := table.InMemTable.HandleExpired(peerID)
+	if expired {
+		if err := table.kv.Delete(peerKey(peerID)); err != nil {
+			table.logger.Error("delete peer", zap.String("peer", peerID.String()), zap.Error(err))
+		}
+	}
+	return expired
+}
+
+// AddSubnet to the table, and to the KV. The signatories are stored in the
+// order in which they are given, because the order determines the hash of the
+// subnet.
+func (table *PersistentTable) AddSubnet(signatories []id.Signatory) id.Hash {
+	hash := id.NewMerkleHashFromSignatories(signatories)
+	value := make([]byte, 0, len(signatories)*len(id.Signatory{}))
+	for _, signatory := range signatories {
+		value = append(value, signatory[:]...)
+	}
+	if err := table.kv.Put(subnetKey(hash), value); err != nil {
+		table.logger.Error("put subnet", zap.String("subnet", hash.String()), zap.Error(err))
+	}
+	return table.InMemTable.AddSubnet(signatories)
+}
+
+// DeleteSubnet from the table, and from the KV.
+func (table *PersistentTable) DeleteSubnet(hash id.Hash) {
+	if err := table.kv.Delete(subnetKey(hash)); err != nil {
+		table.logger.Error("delete subnet", zap.String("subnet", hash.String()), zap.Error(err))
+	}
+	table.InMemTable.DeleteSubnet(hash)
+}
+
+// AddToGroup tags the peer with the group ID in the table, and in the KV.
+func (table *PersistentTable) AddToGroup(peerID id.Signatory, group id.Hash) {
+	if err := table.kv.Put(groupKey(group, peerID), []byte{}); err != nil {
+		table.logger.Error("put group", zap.String("group", group.String()), zap.String("peer", peerID.String()), zap.Error(err))
+	}
+	table.InMemTable.AddToGroup(peerID, group)
+}
+
+// RemoveFromGroup removes the tag of the group ID from the peer in the table,
+// and in the KV.
+func (table *PersistentTable) RemoveFromGroup(peerID id.Signatory, group id.Hash) {
+	if err := table.kv.Delete(groupKey(group, peerID)); err != nil {
+		table.logger.Error("delete group", zap.String("group", group.String()), zap.String("peer", peerID.String()), zap.Error(err))
+	}
+	table.InMemTable.RemoveFromGroup(peerID, group)
+}
+
+func peerKey(peerID id.Signatory) []byte {
+	return append(append([]byte{}, prefixPeer...), peerID[:]...)
+}
+
+func subnetKey(hash id.Hash) []byte {
+	return append(append([]byte{}, prefixSubnet...), hash[:]...)
+}
+
+// groupKey is prefixed by the group ID, so that the members of a group are
+// adjacent in the KV.
+func groupKey(group id.Hash, peerID id.Signatory) []byte {
+	return append(append(append([]byte{}, prefixGroup...), group[:]...), peerID[:]...)
+}
@@ -0,0 +1,256 @@
+package dht_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// countingKV counts the values that are put to a KV.
+type countingKV struct {
+	dht.KV
+	puts int
+}
+
+func (kv *countingKV) Put(key, value []byte) error {
+	kv.puts++
+	return kv.KV.Put(key, value)
+}
+
+var _ = Describe("Persistence", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "dht-")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("FileKV", func() {
+		Context("when reopening the file", func() {
+			It("should return the values that were put, and not the values that were deleted", func() {
+				path := filepath.Join(dir, "kv")
+				kv, err := dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(kv.Put([]byte("a/1"), []byte("one"))).To(Succeed())
+				Expect(kv.Put([]byte("a/2"), []byte("two"))).To(Succeed())
+				Expect(kv.Put([]byte("b/1"), []byte("three"))).To(Succeed())
+				Expect(kv.Put([]byte("a/1"), []byte("four"))).To(Succeed())
+				Expect(kv.Delete([]byte("a/2"))).To(Succeed())
+				Expect(kv.Close()).To(Succeed())
+
+				kv, err = dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				value, err := kv.Get([]byte("a/1"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal([]byte("four")))
+				_, err = kv.Get([]byte("a/2"))
+				Expect(errors.Is(err, dht.ErrNotFound)).To(BeTrue())
+
+				keys := []string{}
+				Expect(kv.Iterate([]byte("a/"), func(key, value []byte) error {
+					keys = append(keys, string(key))
+					return nil
+				})).To(Succeed())
+				Expect(keys).To(Equal([]string{"a/1"}))
+			})
+		})
+
+		Context("when the file ends with a partial record", func() {
+			It("should recover all complete records, and keep working", func() {
+				path := filepath.Join(dir, "kv")
+				kv, err := dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(kv.Put([]byte("key"), []byte("value"))).To(Succeed())
+				Expect(kv.Close()).To(Succeed())
+
+				// Simulate a crash part way through a write.
+				f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = f.Write([]byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x00})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.Close()).To(Succeed())
+
+				kv, err = dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				value, err := kv.Get([]byte("key"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal([]byte("value")))
+				Expect(kv.Put([]byte("other"), []byte("value"))).To(Succeed())
+				Expect(kv.Close()).To(Succeed())
+
+				kv, err = dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				value, err = kv.Get([]byte("other"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal([]byte("value")))
+			})
+		})
+
+		Context("when most records have been replaced", func() {
+			It("should compact the file", func() {
+				path := filepath.Join(dir, "kv")
+				kv, err := dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				value := make([]byte, 1024)
+				for i := 0; i < 1000; i++ {
+					Expect(kv.Put([]byte("key"), value)).To(Succeed())
+				}
+				info, err := os.Stat(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(info.Size()).To(BeNumerically("<", 100*1024))
+			})
+		})
+	})
+
+	Describe("PersistentTable", func() {
+		Context("when the table is restarted", func() {
+			It("should restore its peers and subnets", func() {
+				self := id.NewPrivKey().Signatory()
+				path := filepath.Join(dir, "table")
+				kv, err := dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				table, err := dht.NewPersistentTable(self, kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+
+				signatories := make([]id.Signatory, 10)
+				for i := range signatories {
+					signatories[i] = id.NewPrivKey().Signatory()
+					table.AddPeer(signatories[i], wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", uint64(i)))
+				}
+				table.DeletePeer(signatories[0])
+				many := []wire.Address{
+					wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 100),
+					wire.NewUnsignedAddress(wire.WebSocket, "127.0.0.1:3001", 100),
+				}
+				table.AddPeerAddresses(signatories[2], many)
+				shard := id.NewHash([]byte("shard"))
+				table.AddToGroup(signatories[1], shard)
+				table.AddToGroup(signatories[2], shard)
+				table.RemoveFromGroup(signatories[2], shard)
+				hash := table.AddSubnet(signatories[5:])
+				deleted := table.AddSubnet(signatories[:5])
+				table.DeleteSubnet(deleted)
+				Expect(kv.Close()).To(Succeed())
+
+				kv, err = dht.NewFileKV(path)
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				restored, err := dht.NewPersistentTable(self, kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(restored.NumPeers()).To(Equal(9))
+				Expect(restored.Peers(9)).To(Equal(table.Peers(9)))
+				_, ok := restored.PeerAddress(signatories[0])
+				Expect(ok).To(BeFalse())
+				addr, ok := restored.PeerAddress(signatories[1])
+				Expect(ok).To(BeTrue())
+				Expect(addr).To(Equal(wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1)))
+				addrs, ok := restored.PeerAddresses(signatories[2])
+				Expect(ok).To(BeTrue())
+				Expect(addrs).To(Equal(many))
+				Expect(restored.PeersInGroup(shard, 10)).To(Equal([]id.Signatory{signatories[1]}))
+				Expect(restored.Subnet(hash)).To(Equal(table.Subnet(hash)))
+				Expect(restored.Subnet(deleted)).To(BeEmpty())
+			})
+		})
+
+		Context("when peers are evicted to make room for new peers", func() {
+			It("should delete them from the store", func() {
+				kv, err := dht.NewFileKV(filepath.Join(dir, "table"))
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+
+				table, err := dht.NewPersistentTable(id.NewPrivKey().Signatory(), kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+				table.SetMaxPeers(1, nil)
+				failed, fresh := id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()
+				table.AddPeer(failed, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1))
+				table.Seen(failed)
+				for i := 0; i < dht.ScoreEvictionFailures; i++ {
+					table.Failed(failed)
+				}
+				table.AddPeer(fresh, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 1))
+
+				restored, err := dht.NewPersistentTable(id.NewPrivKey().Signatory(), kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(restored.Peers(2)).To(Equal([]id.Signatory{fresh}))
+			})
+		})
+
+		Context("when the network addresses of a peer are refreshed", func() {
+			It("should only write them to the store when they change", func() {
+				fileKV, err := dht.NewFileKV(filepath.Join(dir, "table"))
+				Expect(err).ToNot(HaveOccurred())
+				defer fileKV.Close()
+				kv := &countingKV{KV: fileKV}
+
+				table, err := dht.NewPersistentTable(id.NewPrivKey().Signatory(), kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+				peerID := id.NewPrivKey().Signatory()
+				kv.puts = 0
+				table.AddPeer(peerID, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 1))
+				Expect(kv.puts).To(Equal(1))
+
+				// Only the nonce is newer.
+				table.AddPeer(peerID, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3000", 2))
+				Expect(kv.puts).To(Equal(1))
+				addr, ok := table.PeerAddress(peerID)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Nonce).To(Equal(uint64(2)))
+
+				table.AddPeer(peerID, wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:3001", 3))
+				Expect(kv.puts).To(Equal(2))
+
+				restored, err := dht.NewPersistentTable(id.NewPrivKey().Signatory(), kv, zap.NewNop())
+				Expect(err).ToNot(HaveOccurred())
+				addr, ok = restored.PeerAddress(peerID)
+				Expect(ok).To(BeTrue())
+				Expect(addr.Value).To(Equal("127.0.0.1:3001"))
+			})
+		})
+
+		Context("when the schema version is newer than the supported version", func() {
+			It("should return an error", func() {
+				kv, err := dht.NewFileKV(filepath.Join(dir, "table"))
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				version := [4]byte{}
+				binary.BigEndian.PutUint32(version[:], dht.SchemaVersion+1)
+				Expect(kv.Put([]byte("version"), version[:])).To(Succeed())
+
+				_, err = dht.NewPersistentTable(id.NewPrivKey().Signatory(), kv, zap.NewNop())
+				Expect(errors.Is(err, dht.ErrSchemaVersion)).To(BeTrue())
+			})
+		})
+
+		Context("when the store has never been used", func() {
+			It("should migrate it to the current schema version", func() {
+				kv, err := dht.NewFileKV(filepath.Join(dir, "table"))
+				Expect(err).ToNot(HaveOccurred())
+				defer kv.Close()
+				Expect(dht.Migrate(kv)).To(Succeed())
+
+				value, err := kv.Get([]byte("version"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(binary.BigEndian.Uint32(value)).To(Equal(dht.SchemaVersion))
+			})
+		})
+	})
+})
@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"math"
+	"time"
+
+	"github.com/renproject/id"
+)
+
+// ScoreEvictionFailures is the number of failures since a peer was last seen
+// after which the DefaultScore allows a peer that has been seen to be evicted.
+const ScoreEvictionFailures = 3
+
+// A ScoreFunc scores a peer in a Table by its Liveness. Peers with higher
+// scores are more valuable. When a Table with a maximum number of peers is
+// full, the peer with the lowest score is evicted to make room for a new peer,
+// but only if its score is negative, and otherwise the new peer is dropped.
+type ScoreFunc func(peer id.Signatory, liveness Liveness, now time.Time) float64
+
+// DefaultScore is the default ScoreFunc. Peers that have never been seen score
+// below every peer that has been seen, so spraying the table with fake network
+// addresses can only evict other peers that have never been seen. Peers that
+// have been seen score below zero, and can be evicted, only after failing
+// ScoreEvictionFailures times since they were last seen.
+//
+// Within these tiers, peers gain score logarithmically with their uptime (the
+// time since they were added), and lose score logarithmically with the time
+// since they were last seen, so long-lived peers that are still alive score
+// highest. Every failure, and every 100 milliseconds of latency, cost one
+// point.
+func DefaultScore(peer id.Signatory, liveness Liveness, now time.Time) float64 {
+	uptime := math.Max(now.Sub(liveness.Added).Seconds(), 0)
+	silence := math.Max(now.Sub(liveness.LastSeen).Seconds(), 0)
+	if !liveness.Seen {
+		// Peers that have waited longest to be seen are evicted first.
+		return -2 + squash(-math.Log1p(silence)-float64(liveness.Failures))/2
+	}
+	score := squash(math.Log1p(uptime) -
+		math.Log1p(silence) -
+		float64(liveness.Failures) -
+		liveness.Latency.Seconds()*10)
+	if liveness.Failures >= ScoreEvictionFailures {
+		return -1 + score/2
+	}
+	return score
+}
+
+// squash maps scores onto the range from zero to one, keeping their order, so
+// that they can be tiered.
+func squash(x float64) float64 {
+	return 0.5 + math.Atan(x)/math.Pi
+}
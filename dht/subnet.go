@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"github.com/renproject/id"
+)
+
+// A SubnetObserver is notified about changes to the subnets that are stored in
+// a table, and about changes to the liveness of the members of these subnets. A
+// member is live when the table has a network address for it. This can be used
+// by applications (such as consensus layers) to react to changes in the
+// connectivity of a subnet. Methods are called synchronously by the table, after
+// the change has been applied, so implementations should return quickly.
+type SubnetObserver interface {
+	// OnSubnetAdded is called when a new subnet is added to the table.
+	OnSubnetAdded(subnet id.Hash, members []id.Signatory)
+	// OnSubnetDeleted is called when a subnet is deleted from the table.
+	OnSubnetDeleted(subnet id.Hash, members []id.Signatory)
+	// OnMemberUp is called for every subnet to which a peer belongs when the
+	// peer is added to the table.
+	OnMemberUp(subnet id.Hash, member id.Signatory)
+	// OnMemberDown is called for every subnet to which a peer belongs when the
+	// peer is deleted from the table (for example, because it has expired).
+	OnMemberDown(subnet id.Hash, member id.Signatory)
+}
+
+// CallbackSubnetObserver implements the SubnetObserver interface by delegating
+// all logic to callback functions. Callbacks that are nil are ignored.
+type CallbackSubnetObserver struct {
+	OnSubnetAddedCallback   func(id.Hash, []id.Signatory)
+	OnSubnetDeletedCallback func(id.Hash, []id.Signatory)
+	OnMemberUpCallback      func(id.Hash, id.Signatory)
+	OnMemberDownCallback    func(id.Hash, id.Signatory)
+}
+
+// OnSubnetAdded will delegate the implementation to the OnSubnetAddedCallback.
+func (observer CallbackSubnetObserver) OnSubnetAdded(subnet id.Hash, members []id.Signatory) {
+	if observer.OnSubnetAddedCallback != nil {
+		observer.OnSubnetAddedCallback(subnet, members)
+	}
+}
+
+// OnSubnetDeleted will delegate the implementation to the
+// OnSubnetDeletedCallback.
+func (observer CallbackSubnetObserver) OnSubnetDeleted(subnet id.Hash, members []id.Signatory) {
+	if observer.OnSubnetDeletedCallback != nil {
+		observer.OnSubnetDeletedCallback(subnet, members)
+	}
+}
+
+// OnMemberUp will delegate the implementation to the OnMemberUpCallback.
+func (observer CallbackSubnetObserver) OnMemberUp(subnet id.Hash, member id.Signatory) {
+	if observer.OnMemberUpCallback != nil {
+		observer.OnMemberUpCallback(subnet, member)
+	}
+}
+
+// OnMemberDown will delegate the implementation to the OnMemberDownCallback.
+func (observer CallbackSubnetObserver) OnMemberDown(subnet id.Hash, member id.Signatory) {
+	if observer.OnMemberDownCallback != nil {
+		observer.OnMemberDownCallback(subnet, member)
+	}
+}
@@ -1,6 +1,9 @@
 package dht
 
 import (
+	"bytes"
+	"math"
+	"math/bits"
 	"math/rand"
 	"sort"
 	"sync"
@@ -18,6 +21,23 @@ type Expiry struct {
 	timestamp        time.Time
 }
 
+// Liveness of a peer in a Table. LastSeen is the last time that the peer was
+// seen to be alive, or the time that it was added to the Table if it has not
+// been seen since, and Seen is whether it has been seen at all. Failures is the
+// number of failed attempts to reach the peer since it was last seen. Added is
+// the time that the peer was added to the Table, and Latency is the smoothed
+// round-trip time to the peer, or zero if it has not been measured. Throughput
+// is the smoothed number of bytes per second observed from the peer, or zero if
+// it has not been measured.
+type Liveness struct {
+	LastSeen   time.Time
+	Seen       bool
+	Failures   int
+	Added      time.Time
+	Latency    time.Duration
+	Throughput float64
+}
+
 // A Table is responsible for keeping tack of peers, their network addresses,
 // and the subnet to which they belong.
 type Table interface {
@@ -26,12 +46,25 @@ type Table interface {
 	// to exist.
 	Self() id.Signatory
 
-	// AddPeer to the table with an associate network address.
+	// AddPeer to the table with an associate network address. If the peer is
+	// already in the table, its network address is only replaced if the new
+	// network address supersedes it (see wire.Address.Supersedes), so that
+	// stale, or unsigned, network addresses cannot replace newer, or signed,
+	// ones.
 	AddPeer(id.Signatory, wire.Address)
+	// AddPeerAddresses to the table, in order of priority. This is the same as
+	// AddPeer, except that all network addresses are replaced together, and
+	// only if the first network address supersedes the first network address
+	// in the table. Empty lists are ignored.
+	AddPeerAddresses(id.Signatory, []wire.Address)
 	// DeletePeer from the table.
 	DeletePeer(id.Signatory)
 	// PeerAddress returns the network address associated with the given peer.
+	// If the peer has many network addresses, it returns the first.
 	PeerAddress(id.Signatory) (wire.Address, bool)
+	// PeerAddresses returns all network addresses associated with the given
+	// peer, in order of priority.
+	PeerAddresses(id.Signatory) ([]wire.Address, bool)
 
 	// Peers returns the n closest peers to the local peer, using XORing as the
 	// measure of distance between two peers.
@@ -43,6 +76,16 @@ type Table interface {
 	// addresses in the table.
 	NumPeers() int
 
+	// Closest returns the k closest peers to the target, using XORing as the
+	// measure of distance between two peers. Only the buckets that can hold
+	// the closest peers are scanned.
+	Closest(target id.Signatory, k int) []id.Signatory
+	// RefreshTargets returns one random target in the range of every bucket
+	// that has not been looked up, or updated, within the maximum age, and
+	// marks the buckets as refreshed. Looking up the targets (for example, by
+	// pinging the closest peers to them) keeps the buckets populated.
+	RefreshTargets(maxAge time.Duration) []id.Signatory
+
 	// HandleExpired returns whether a signatory has expired. It checks whether
 	// an Expiry exists for the signatory, and if it does, has it expired?
 	// If found expired, it deletes the peer from the table
@@ -52,6 +95,28 @@ type Table interface {
 	// DeleteExpiry from the table
 	DeleteExpiry(id.Signatory)
 
+	// Seen records that a peer in the table is alive, and resets its
+	// failures.
+	Seen(id.Signatory)
+	// Failed records a failed attempt to reach a peer in the table.
+	Failed(id.Signatory)
+	// Liveness returns the Liveness of a peer in the table.
+	Liveness(id.Signatory) (Liveness, bool)
+	// StalePeers returns the peers that have not been seen for at least the
+	// given duration.
+	StalePeers(time.Duration) []id.Signatory
+	// ObserveLatency records a round-trip time to a peer in the table (for
+	// example, from a ping to its ping ack).
+	ObserveLatency(id.Signatory, time.Duration)
+	// ObserveThroughput records that a number of bytes were received from a
+	// peer in the table over a duration (for example, the bytes read from
+	// the network connection to the peer over a sampling period).
+	ObserveThroughput(peer id.Signatory, bytes int, duration time.Duration)
+	// FastestPeers returns the n peers with the lowest latency. Peers whose
+	// latency has not been measured come last, in order of their XOR distance
+	// from the local peer.
+	FastestPeers(int) []id.Signatory
+
 	// AddSubnet to the table. This returns a subnet hash that can be used to
 	// read/delete the subnet. It is the merkle root hash of the peers in the
 	// subnet.
@@ -61,23 +126,66 @@ type Table interface {
 	DeleteSubnet(id.Hash)
 	// Subnet returns the peers from the table.
 	Subnet(id.Hash) []id.Signatory
+
+	// AddToGroup tags a peer with a group ID (for example, the ID of a shard
+	// to which the peer belongs). A peer can be in many groups. Peers can be
+	// tagged before they are added to the table, and stay tagged when they
+	// are deleted from the table.
+	AddToGroup(peer id.Signatory, group id.Hash)
+	// RemoveFromGroup removes the tag of a group ID from a peer.
+	RemoveFromGroup(peer id.Signatory, group id.Hash)
+	// Groups returns the group IDs with which a peer is tagged.
+	Groups(id.Signatory) []id.Hash
+	// PeersInGroup returns the n closest peers to the local peer that are in
+	// the table, and are tagged with the group ID, using XORing as the measure
+	// of distance between two peers.
+	PeersInGroup(group id.Hash, n int) []id.Signatory
+
+	// Subscribe a channel to the PeerEvents of the table, and return a
+	// function that unsubscribes it. Events are delivered after the changes
+	// are applied, without waiting for the subscriber, so events that do not
+	// fit in the channel are dropped. Subscribers should use buffered
+	// channels, and receive from them promptly.
+	Subscribe(chan<- PeerEvent) func()
 }
 
-// InMemTable implements the Table using in-memory storage.
+// NumBuckets is the number of buckets in a Table. Bucket i holds the peers
+// whose XOR distance from the local peer has exactly i leading zero bits, so
+// peers in higher buckets are closer to the local peer.
+const NumBuckets = 8 * len(id.Signatory{})
+
+// InMemTable implements the Table using in-memory storage. Peers are kept in
+// Kademlia-style buckets (see NumBuckets), and every bucket is sorted by XOR
+// distance from the local peer. Buckets are not bounded, but the total number
+// of peers can be (see SetMaxPeers).
 type InMemTable struct {
 	self id.Signatory
 
-	sortedMu *sync.RWMutex
-	sorted   []id.Signatory
+	limitMu  *sync.Mutex
+	maxPeers int
+	score    ScoreFunc
+
+	bucketsMu *sync.RWMutex
+	buckets   [NumBuckets][]id.Signatory
+	refreshed [NumBuckets]time.Time
 
 	addrsBySignatoryMu *sync.Mutex
-	addrsBySignatory   map[id.Signatory]wire.Address
+	addrsBySignatory   map[id.Signatory][]wire.Address
 
 	expiryBySignatoryMu *sync.Mutex
 	expiryBySignatory   map[id.Signatory]Expiry
 
+	livenessBySignatoryMu *sync.Mutex
+	livenessBySignatory   map[id.Signatory]Liveness
+
 	subnetsByHashMu *sync.Mutex
 	subnetsByHash   map[id.Hash][]id.Signatory
+	subnetObserver  SubnetObserver
+
+	groupsMu *sync.Mutex
+	groups   map[id.Hash]map[id.Signatory]struct{}
+
+	subscribers subscribers
 
 	randObj *rand.Rand
 }
@@ -86,18 +194,29 @@ func NewInMemTable(self id.Signatory) *InMemTable {
 	return &InMemTable{
 		self: self,
 
-		sortedMu: new(sync.RWMutex),
-		sorted:   []id.Signatory{},
+		limitMu:  new(sync.Mutex),
+		maxPeers: 0,
+		score:    DefaultScore,
+
+		bucketsMu: new(sync.RWMutex),
 
 		addrsBySignatoryMu: new(sync.Mutex),
-		addrsBySignatory:   map[id.Signatory]wire.Address{},
+		addrsBySignatory:   map[id.Signatory][]wire.Address{},
 
 		expiryBySignatoryMu: new(sync.Mutex),
 		expiryBySignatory:   map[id.Signatory]Expiry{},
 
+		livenessBySignatoryMu: new(sync.Mutex),
+		livenessBySignatory:   map[id.Signatory]Liveness{},
+
 		subnetsByHashMu: new(sync.Mutex),
 		subnetsByHash:   map[id.Hash][]id.Signatory{},
 
+		groupsMu: new(sync.Mutex),
+		groups:   map[id.Hash]map[id.Signatory]struct{}{},
+
+		subscribers: newSubscribers(),
+
 		randObj: rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
@@ -106,68 +225,240 @@ func (table *InMemTable) Self() id.Signatory {
 	return table.self
 }
 
+// SetSubnetObserver sets the SubnetObserver that is notified when subnets are
+// added and deleted, and when members of subnets are added and deleted. A nil
+// observer disables notifications.
+func (table *InMemTable) SetSubnetObserver(observer SubnetObserver) {
+	table.subnetsByHashMu.Lock()
+	defer table.subnetsByHashMu.Unlock()
+
+	table.subnetObserver = observer
+}
+
+// SetMaxPeers bounds the number of peers in the table, so that remote peers
+// cannot exhaust memory, or crowd out good peers, by spraying the table with
+// fake network addresses. When the table is full, adding a new peer evicts
+// the peer with the lowest score, if its score is negative, and otherwise the
+// new peer is dropped. A nil ScoreFunc uses the
+// DefaultScore. A maximum that is not positive disables the bound. Peers that
+// are already in the table are not evicted until a new peer is added.
+func (table *InMemTable) SetMaxPeers(maxPeers int, score ScoreFunc) {
+	table.limitMu.Lock()
+	defer table.limitMu.Unlock()
+
+	if score == nil {
+		score = DefaultScore
+	}
+	table.maxPeers = maxPeers
+	table.score = score
+}
+
 func (table *InMemTable) AddPeer(peerID id.Signatory, peerAddr wire.Address) {
-	table.sortedMu.Lock()
+	table.updatePeer(peerID, []wire.Address{peerAddr})
+}
+
+func (table *InMemTable) AddPeerAddresses(peerID id.Signatory, peerAddrs []wire.Address) {
+	table.updatePeer(peerID, peerAddrs)
+}
+
+// updatePeer adds the peer, and returns whether its network addresses were
+// accepted, whether they changed (other than their nonces and signatures),
+// and the peers that were evicted to make room for it.
+func (table *InMemTable) updatePeer(peerID id.Signatory, peerAddrs []wire.Address) (bool, bool, []id.Signatory) {
+	if len(peerAddrs) == 0 {
+		return false, false, nil
+	}
+	copied := make([]wire.Address, len(peerAddrs))
+	copy(copied, peerAddrs)
+	accepted, added, changed, evicted := table.addPeer(peerID, copied)
+	for _, evictedID := range evicted {
+		table.deleted(evictedID)
+	}
+	if added {
+		now := time.Now()
+		table.livenessBySignatoryMu.Lock()
+		table.livenessBySignatory[peerID] = Liveness{LastSeen: now, Added: now}
+		table.livenessBySignatoryMu.Unlock()
+
+		table.notifyMembers(peerID, SubnetObserver.OnMemberUp)
+	}
+	if accepted {
+		event := PeerEvent{Type: PeerUpdated, Peer: peerID, Addresses: make([]wire.Address, len(copied))}
+		if added {
+			event.Type = PeerAdded
+		}
+		copy(event.Addresses, copied)
+		table.subscribers.publish(event)
+	}
+	return accepted, changed, evicted
+}
+
+// addPeer returns whether the network addresses were accepted, whether the
+// peer was not already in the table, whether its network addresses changed
+// (other than their nonces and signatures), and the peers that were evicted
+// to make room for it.
+func (table *InMemTable) addPeer(peerID id.Signatory, peerAddrs []wire.Address) (bool, bool, bool, []id.Signatory) {
+	table.limitMu.Lock()
+	maxPeers, score := table.maxPeers, table.score
+	table.limitMu.Unlock()
+
+	table.bucketsMu.Lock()
 	table.addrsBySignatoryMu.Lock()
 
-	defer table.sortedMu.Unlock()
+	defer table.bucketsMu.Unlock()
 	defer table.addrsBySignatoryMu.Unlock()
 
 	if table.self.Equal(&peerID) {
-		return
+		return false, false, false, nil
 	}
 
-	_, ok := table.addrsBySignatory[peerID]
+	current, ok := table.addrsBySignatory[peerID]
+	if ok && !peerAddrs[0].Supersedes(&current[0]) {
+		return false, false, false, nil
+	}
+	changed := !ok || !sameEndpoints(current, peerAddrs)
+
+	var evicted []id.Signatory
+	if !ok && maxPeers > 0 && len(table.addrsBySignatory) >= maxPeers {
+		evictedID, evict := table.lowestScoreLocked(score)
+		if !evict {
+			return false, false, false, nil
+		}
+		table.removeLocked(evictedID)
+		evicted = append(evicted, evictedID)
+	}
 
 	// Insert into the map to allow for address lookup using the signatory.
-	table.addrsBySignatory[peerID] = peerAddr
+	table.addrsBySignatory[peerID] = peerAddrs
 
-	// Insert into the sorted signatories list based on its XOR distance from our
-	// own address.
+	// Insert into its bucket, based on its XOR distance from our own address.
 	if !ok {
-		i := sort.Search(len(table.sorted), func(i int) bool {
-			return table.isCloser(peerID, table.sorted[i])
+		b := commonPrefixLen(table.self, peerID)
+		bucket := table.buckets[b]
+		i := sort.Search(len(bucket), func(i int) bool {
+			return table.isCloser(peerID, bucket[i])
 		})
-		table.sorted = append(table.sorted, id.Signatory{})
-		copy(table.sorted[i+1:], table.sorted[i:])
-		table.sorted[i] = peerID
+		bucket = append(bucket, id.Signatory{})
+		copy(bucket[i+1:], bucket[i:])
+		bucket[i] = peerID
+		table.buckets[b] = bucket
+		table.refreshed[b] = time.Now()
+	}
+	return true, !ok, changed, evicted
+}
+
+// sameEndpoints returns true if the network addresses have the same protocols
+// and values, in the same order, no matter their nonces and signatures.
+func sameEndpoints(addrs, others []wire.Address) bool {
+	if len(addrs) != len(others) {
+		return false
+	}
+	for i := range addrs {
+		if addrs[i].Protocol != others[i].Protocol || addrs[i].Value != others[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// lowestScoreLocked returns the peer with the lowest score, and whether its
+// score is negative. It must be called while holding the locks for the
+// buckets, and for the network addresses.
+func (table *InMemTable) lowestScoreLocked(score ScoreFunc) (id.Signatory, bool) {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	now := time.Now()
+	lowest, lowestScore, found := id.Signatory{}, math.Inf(1), false
+	for peerID := range table.addrsBySignatory {
+		if peerScore := score(peerID, table.livenessBySignatory[peerID], now); peerScore < lowestScore {
+			lowest, lowestScore, found = peerID, peerScore, true
+		}
 	}
+	return lowest, found && lowestScore < 0
 }
 
 func (table *InMemTable) DeletePeer(peerID id.Signatory) {
-	table.sortedMu.Lock()
+	if table.deletePeer(peerID) {
+		table.deleted(peerID)
+	}
+}
+
+// deleted cleans up after a peer has been deleted from the buckets and the
+// network addresses, and notifies observers and subscribers.
+func (table *InMemTable) deleted(peerID id.Signatory) {
+	table.livenessBySignatoryMu.Lock()
+	delete(table.livenessBySignatory, peerID)
+	table.livenessBySignatoryMu.Unlock()
+
+	table.notifyMembers(peerID, SubnetObserver.OnMemberDown)
+	table.subscribers.publish(PeerEvent{Type: PeerRemoved, Peer: peerID})
+}
+
+func (table *InMemTable) Subscribe(ch chan<- PeerEvent) func() {
+	return table.subscribers.subscribe(ch)
+}
+
+func (table *InMemTable) deletePeer(peerID id.Signatory) bool {
+	table.bucketsMu.Lock()
 	table.addrsBySignatoryMu.Lock()
 
-	defer table.sortedMu.Unlock()
+	defer table.bucketsMu.Unlock()
 	defer table.addrsBySignatoryMu.Unlock()
 
+	return table.removeLocked(peerID)
+}
+
+// removeLocked removes the peer from the buckets, and from the network
+// addresses, and returns whether it was in the table. It must be called while
+// holding the locks for both.
+func (table *InMemTable) removeLocked(peerID id.Signatory) bool {
 	// Delete from the map.
+	_, ok := table.addrsBySignatory[peerID]
 	delete(table.addrsBySignatory, peerID)
 
-	// Delete from the sorted list.
-	numAddrs := len(table.sorted)
-	i := sort.Search(numAddrs, func(i int) bool {
-		return table.isCloser(peerID, table.sorted[i])
-	})
-
-	removeIndex := i - 1
-	if removeIndex >= 0 {
-		table.sorted = append(table.sorted[:removeIndex], table.sorted[removeIndex+1:]...)
+	// Delete from its bucket.
+	if ok {
+		b := commonPrefixLen(table.self, peerID)
+		bucket := table.buckets[b]
+		i := sort.Search(len(bucket), func(i int) bool {
+			return !table.isCloser(bucket[i], peerID)
+		})
+		if i < len(bucket) && bucket[i].Equal(&peerID) {
+			table.buckets[b] = append(bucket[:i], bucket[i+1:]...)
+		}
 	}
+	return ok
 }
 
 func (table *InMemTable) PeerAddress(peerID id.Signatory) (wire.Address, bool) {
 	table.addrsBySignatoryMu.Lock()
 	defer table.addrsBySignatoryMu.Unlock()
 
-	addr, ok := table.addrsBySignatory[peerID]
-	return addr, ok
+	addrs, ok := table.addrsBySignatory[peerID]
+	if !ok {
+		return wire.Address{}, false
+	}
+	return addrs[0], true
+}
+
+func (table *InMemTable) PeerAddresses(peerID id.Signatory) ([]wire.Address, bool) {
+	table.addrsBySignatoryMu.Lock()
+	defer table.addrsBySignatoryMu.Unlock()
+
+	addrs, ok := table.addrsBySignatory[peerID]
+	if !ok {
+		return nil, false
+	}
+	copied := make([]wire.Address, len(addrs))
+	copy(copied, addrs)
+	return copied, true
 }
 
 // Peers returns the n closest peer IDs.
 func (table *InMemTable) Peers(n int) []id.Signatory {
-	table.sortedMu.RLock()
-	defer table.sortedMu.RUnlock()
+	table.bucketsMu.RLock()
+	defer table.bucketsMu.RUnlock()
 
 	if n <= 0 {
 		// For values of n that are less than, or equal to, zero, return an
@@ -176,16 +467,20 @@ func (table *InMemTable) Peers(n int) []id.Signatory {
 		return []id.Signatory{}
 	}
 
-	sigs := make([]id.Signatory, min(n, len(table.sorted)))
-	copy(sigs, table.sorted)
+	// Peers in higher buckets are closer than all peers in lower buckets.
+	sigs := make([]id.Signatory, 0, min(n, table.numSorted()))
+	for b := NumBuckets - 1; b >= 0 && len(sigs) < n; b-- {
+		bucket := table.buckets[b]
+		sigs = append(sigs, bucket[:min(n-len(sigs), len(bucket))]...)
+	}
 	return sigs
 }
 
 // RandomPeers returns n random peer IDs
 func (table *InMemTable) RandomPeers(n int) []id.Signatory {
-	table.sortedMu.RLock()
-	defer table.sortedMu.RUnlock()
-	m := len(table.sorted)
+	table.bucketsMu.RLock()
+	defer table.bucketsMu.RUnlock()
+	m := table.numSorted()
 
 	if n <= 0 {
 		// For values of n that are less than, or equal to, zero, return an
@@ -194,8 +489,10 @@ func (table *InMemTable) RandomPeers(n int) []id.Signatory {
 		return []id.Signatory{}
 	}
 	if n >= m {
-		sigs := make([]id.Signatory, m)
-		copy(sigs, table.sorted)
+		sigs := make([]id.Signatory, 0, m)
+		for b := NumBuckets - 1; b >= 0; b-- {
+			sigs = append(sigs, table.buckets[b]...)
+		}
 		return sigs
 	}
 
@@ -207,7 +504,7 @@ func (table *InMemTable) RandomPeers(n int) []id.Signatory {
 		shuffled := make([]id.Signatory, n)
 		indexPerm := rand.Perm(m)
 		for i := 0; i < n; i++ {
-			shuffled[i] = table.sorted[indexPerm[i]]
+			shuffled[i] = table.at(indexPerm[i])
 		}
 		return shuffled
 	}
@@ -219,11 +516,11 @@ func (table *InMemTable) RandomPeers(n int) []id.Signatory {
 		index := table.randObj.Intn(i)
 		if _, ok := set[index]; !ok {
 			set[index] = struct{}{}
-			randomSelection = append(randomSelection, table.sorted[index])
+			randomSelection = append(randomSelection, table.at(index))
 			continue
 		}
 		set[i] = struct{}{}
-		randomSelection = append(randomSelection, table.sorted[i])
+		randomSelection = append(randomSelection, table.at(i))
 	}
 	return randomSelection
 }
@@ -235,19 +532,104 @@ func (table *InMemTable) NumPeers() int {
 	return len(table.addrsBySignatory)
 }
 
+// Closest returns the k closest peers to the target. The bucket of the target
+// holds all peers that are closer to it than the peers in any other bucket.
+// After that, the peers in all higher buckets are equally close to the target
+// in their leading bits, so they are compared using their full distance.
+// After that, peers in lower buckets are further from the target the lower
+// their bucket.
+func (table *InMemTable) Closest(target id.Signatory, k int) []id.Signatory {
+	if k <= 0 {
+		return []id.Signatory{}
+	}
+
+	table.bucketsMu.Lock()
+	defer table.bucketsMu.Unlock()
+
+	t := commonPrefixLen(table.self, target)
+	if t < NumBuckets {
+		table.refreshed[t] = time.Now()
+	}
+
+	closest := make([]id.Signatory, 0, min(k, table.numSorted()))
+	appendSorted := func(candidates []id.Signatory) {
+		sort.Slice(candidates, func(i, j int) bool {
+			return isCloser(target, candidates[i], candidates[j])
+		})
+		closest = append(closest, candidates[:min(k-len(closest), len(candidates))]...)
+	}
+	if t < NumBuckets {
+		appendSorted(append([]id.Signatory{}, table.buckets[t]...))
+	}
+	if len(closest) < k {
+		higher := []id.Signatory{}
+		for b := t + 1; b < NumBuckets; b++ {
+			higher = append(higher, table.buckets[b]...)
+		}
+		appendSorted(higher)
+	}
+	for b := min(t, NumBuckets) - 1; b >= 0 && len(closest) < k; b-- {
+		// Peers in lower buckets are sorted by their distance from the local
+		// peer, which is not the same as their distance from the target.
+		appendSorted(append([]id.Signatory{}, table.buckets[b]...))
+	}
+	return closest
+}
+
+// RefreshTargets returns one random target in the range of every stale bucket,
+// from the lowest bucket to the bucket above the highest bucket that holds a
+// peer. Buckets above that are almost certainly empty in the network, and so
+// are not refreshed.
+func (table *InMemTable) RefreshTargets(maxAge time.Duration) []id.Signatory {
+	table.bucketsMu.Lock()
+	defer table.bucketsMu.Unlock()
+
+	highest := -1
+	for b := NumBuckets - 1; b >= 0; b-- {
+		if len(table.buckets[b]) > 0 {
+			highest = b
+			break
+		}
+	}
+
+	now := time.Now()
+	targets := []id.Signatory{}
+	for b := 0; b <= highest+1 && b < NumBuckets; b++ {
+		if now.Sub(table.refreshed[b]) < maxAge {
+			continue
+		}
+		table.refreshed[b] = now
+		targets = append(targets, table.randomInBucket(b))
+	}
+	return targets
+}
+
 func (table *InMemTable) HandleExpired(peerID id.Signatory) bool {
 	table.expiryBySignatoryMu.Lock()
-	defer table.expiryBySignatoryMu.Unlock()
 	expiry, ok := table.expiryBySignatory[peerID]
 	if !ok {
+		table.expiryBySignatoryMu.Unlock()
 		return false
 	}
 	expired := (time.Now().Sub(expiry.timestamp)) > expiry.minimumExpiryAge
-	if expired {
-		table.DeletePeer(peerID)
-		delete(table.expiryBySignatory, peerID)
+	if !expired {
+		table.expiryBySignatoryMu.Unlock()
+		return false
 	}
-	return expired
+	// The peer is removed while still holding the lock, so that a concurrent
+	// call to DeleteExpiry and AddExpiry (for example, after the peer has been
+	// dialed again) cannot be followed by the removal of a peer that is no
+	// longer expired.
+	delete(table.expiryBySignatory, peerID)
+	removed := table.deletePeer(peerID)
+	table.expiryBySignatoryMu.Unlock()
+
+	// Observers are notified after releasing the lock, so that the
+	// SubnetObserver can safely use the table.
+	if removed {
+		table.deleted(peerID)
+	}
+	return true
 }
 
 func (table *InMemTable) AddExpiry(peerID id.Signatory, duration time.Duration) {
@@ -273,6 +655,122 @@ func (table *InMemTable) DeleteExpiry(peerID id.Signatory) {
 	delete(table.expiryBySignatory, peerID)
 }
 
+// Seen records that a peer is alive. Peers that are not in the table are
+// ignored.
+func (table *InMemTable) Seen(peerID id.Signatory) {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	if liveness, ok := table.livenessBySignatory[peerID]; ok {
+		liveness.LastSeen = time.Now()
+		liveness.Seen = true
+		liveness.Failures = 0
+		table.livenessBySignatory[peerID] = liveness
+	}
+}
+
+// Failed records a failed attempt to reach a peer. Peers that are not in the
+// table are ignored.
+func (table *InMemTable) Failed(peerID id.Signatory) {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	if liveness, ok := table.livenessBySignatory[peerID]; ok {
+		liveness.Failures++
+		table.livenessBySignatory[peerID] = liveness
+	}
+}
+
+// ObserveLatency updates the smoothed round-trip time to the peer, in the same
+// way as TCP (see RFC 6298).
+func (table *InMemTable) ObserveLatency(peerID id.Signatory, rtt time.Duration) {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	if liveness, ok := table.livenessBySignatory[peerID]; ok {
+		if liveness.Latency == 0 {
+			liveness.Latency = rtt
+		} else {
+			liveness.Latency = (7*liveness.Latency + rtt) / 8
+		}
+		table.livenessBySignatory[peerID] = liveness
+	}
+}
+
+// ObserveThroughput updates the smoothed throughput of the peer, in the same
+// way as the smoothed round-trip time. Observations over durations that are
+// not positive are ignored.
+func (table *InMemTable) ObserveThroughput(peerID id.Signatory, bytes int, duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	throughput := float64(bytes) / duration.Seconds()
+
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	if liveness, ok := table.livenessBySignatory[peerID]; ok {
+		if liveness.Throughput == 0 {
+			liveness.Throughput = throughput
+		} else {
+			liveness.Throughput = (7*liveness.Throughput + throughput) / 8
+		}
+		table.livenessBySignatory[peerID] = liveness
+	}
+}
+
+func (table *InMemTable) FastestPeers(n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+	peers := table.Peers(table.NumPeers())
+
+	table.livenessBySignatoryMu.Lock()
+	latencies := make(map[id.Signatory]time.Duration, len(peers))
+	for _, peerID := range peers {
+		latencies[peerID] = table.livenessBySignatory[peerID].Latency
+	}
+	table.livenessBySignatoryMu.Unlock()
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		fst, snd := latencies[peers[i]], latencies[peers[j]]
+		if fst == 0 || snd == 0 {
+			return snd == 0 && fst != 0
+		}
+		return fst < snd
+	})
+	return peers[:min(n, len(peers))]
+}
+
+// Liveness returns the Liveness of a peer, and true, or false if the peer is
+// not in the table.
+func (table *InMemTable) Liveness(peerID id.Signatory) (Liveness, bool) {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	liveness, ok := table.livenessBySignatory[peerID]
+	return liveness, ok
+}
+
+// StalePeers returns the peers that have not been seen for at least the given
+// duration, from the longest unseen to the most recently seen.
+func (table *InMemTable) StalePeers(age time.Duration) []id.Signatory {
+	table.livenessBySignatoryMu.Lock()
+	defer table.livenessBySignatoryMu.Unlock()
+
+	now := time.Now()
+	stale := []id.Signatory{}
+	for peerID, liveness := range table.livenessBySignatory {
+		if now.Sub(liveness.LastSeen) >= age {
+			stale = append(stale, peerID)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return table.livenessBySignatory[stale[i]].LastSeen.Before(table.livenessBySignatory[stale[j]].LastSeen)
+	})
+	return stale
+}
+
 func (table *InMemTable) AddSubnet(signatories []id.Signatory) id.Hash {
 	copied := make([]id.Signatory, len(signatories))
 	copy(copied, signatories)
@@ -290,17 +788,31 @@ func (table *InMemTable) AddSubnet(signatories []id.Signatory) id.Hash {
 	hash := id.NewMerkleHashFromSignatories(signatories)
 
 	table.subnetsByHashMu.Lock()
-	defer table.subnetsByHashMu.Unlock()
-
+	_, ok := table.subnetsByHash[hash]
 	table.subnetsByHash[hash] = copied
+	observer := table.subnetObserver
+	table.subnetsByHashMu.Unlock()
+
+	if !ok && observer != nil {
+		members := make([]id.Signatory, len(copied))
+		copy(members, copied)
+		observer.OnSubnetAdded(hash, members)
+	}
 	return hash
 }
 
 func (table *InMemTable) DeleteSubnet(hash id.Hash) {
 	table.subnetsByHashMu.Lock()
-	defer table.subnetsByHashMu.Unlock()
-
+	members, ok := table.subnetsByHash[hash]
 	delete(table.subnetsByHash, hash)
+	observer := table.subnetObserver
+	table.subnetsByHashMu.Unlock()
+
+	if ok && observer != nil {
+		copied := make([]id.Signatory, len(members))
+		copy(copied, members)
+		observer.OnSubnetDeleted(hash, copied)
+	}
 }
 
 func (table *InMemTable) Subnet(hash id.Hash) []id.Signatory {
@@ -316,10 +828,150 @@ func (table *InMemTable) Subnet(hash id.Hash) []id.Signatory {
 	return copied
 }
 
+func (table *InMemTable) AddToGroup(peerID id.Signatory, group id.Hash) {
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+
+	members, ok := table.groups[group]
+	if !ok {
+		members = map[id.Signatory]struct{}{}
+		table.groups[group] = members
+	}
+	members[peerID] = struct{}{}
+}
+
+func (table *InMemTable) RemoveFromGroup(peerID id.Signatory, group id.Hash) {
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+
+	members, ok := table.groups[group]
+	if !ok {
+		return
+	}
+	delete(members, peerID)
+	if len(members) == 0 {
+		delete(table.groups, group)
+	}
+}
+
+// Groups returns the group IDs of the peer, sorted by their bytes.
+func (table *InMemTable) Groups(peerID id.Signatory) []id.Hash {
+	table.groupsMu.Lock()
+	defer table.groupsMu.Unlock()
+
+	groups := []id.Hash{}
+	for group, members := range table.groups {
+		if _, ok := members[peerID]; ok {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return bytes.Compare(groups[i][:], groups[j][:]) < 0
+	})
+	return groups
+}
+
+func (table *InMemTable) PeersInGroup(group id.Hash, n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+
+	table.groupsMu.Lock()
+	members := make([]id.Signatory, 0, len(table.groups[group]))
+	for member := range table.groups[group] {
+		members = append(members, member)
+	}
+	table.groupsMu.Unlock()
+
+	// Only peers that are in the table can be reached, so tagged peers that
+	// have not been added (or have been deleted) are skipped.
+	table.addrsBySignatoryMu.Lock()
+	peers := members[:0]
+	for _, member := range members {
+		if _, ok := table.addrsBySignatory[member]; ok {
+			peers = append(peers, member)
+		}
+	}
+	table.addrsBySignatoryMu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return table.isCloser(peers[i], peers[j])
+	})
+	return peers[:min(n, len(peers))]
+}
+
+// notifyMembers calls the SubnetObserver once for every subnet to which the
+// member belongs.
+func (table *InMemTable) notifyMembers(member id.Signatory, notify func(SubnetObserver, id.Hash, id.Signatory)) {
+	table.subnetsByHashMu.Lock()
+	observer := table.subnetObserver
+	subnets := []id.Hash{}
+	if observer != nil {
+		for hash, members := range table.subnetsByHash {
+			for _, m := range members {
+				if m.Equal(&member) {
+					subnets = append(subnets, hash)
+					break
+				}
+			}
+		}
+	}
+	table.subnetsByHashMu.Unlock()
+
+	for _, hash := range subnets {
+		notify(observer, hash, member)
+	}
+}
+
 func (table *InMemTable) isCloser(fst, snd id.Signatory) bool {
-	for b := 0; b < 32; b++ {
-		d1 := table.self[b] ^ fst[b]
-		d2 := table.self[b] ^ snd[b]
+	return isCloser(table.self, fst, snd)
+}
+
+// numSorted returns the number of peers in all buckets. The buckets mutex must
+// be held.
+func (table *InMemTable) numSorted() int {
+	n := 0
+	for b := range table.buckets {
+		n += len(table.buckets[b])
+	}
+	return n
+}
+
+// at returns the peer at an index in the list of all peers, sorted by their
+// distance from the local peer. The buckets mutex must be held.
+func (table *InMemTable) at(i int) id.Signatory {
+	for b := NumBuckets - 1; b >= 0; b-- {
+		if i < len(table.buckets[b]) {
+			return table.buckets[b][i]
+		}
+		i -= len(table.buckets[b])
+	}
+	panic("index out of range")
+}
+
+// randomInBucket returns a random signatory in the range of a bucket. It has
+// the same leading b bits as the local peer, and a different bit after them.
+// The buckets mutex must be held.
+func (table *InMemTable) randomInBucket(b int) id.Signatory {
+	target := id.Signatory{}
+	table.randObj.Read(target[:])
+	for i := 0; i < b/8; i++ {
+		target[i] = table.self[i]
+	}
+	// The mask covers the bits of the byte that must be equal to the local
+	// peer, and the bit that must be different.
+	mask := byte(0xff) << (7 - uint(b%8))
+	bit := byte(0x80) >> uint(b%8)
+	target[b/8] = (table.self[b/8]^bit)&mask | target[b/8]&^mask
+	return target
+}
+
+// isCloser returns whether the first signatory is closer to the identity than
+// the second signatory, using XORing as the measure of distance.
+func isCloser(identity, fst, snd id.Signatory) bool {
+	for b := 0; b < len(identity); b++ {
+		d1 := identity[b] ^ fst[b]
+		d2 := identity[b] ^ snd[b]
 		if d1 < d2 {
 			return true
 		}
@@ -330,6 +982,18 @@ func (table *InMemTable) isCloser(fst, snd id.Signatory) bool {
 	return false
 }
 
+// commonPrefixLen returns the number of leading bits that are equal in both
+// signatories, which is the bucket that one holds the other in. It returns
+// NumBuckets if the signatories are equal.
+func commonPrefixLen(fst, snd id.Signatory) int {
+	for i := range fst {
+		if x := fst[i] ^ snd[i]; x != 0 {
+			return 8*i + bits.LeadingZeros8(x)
+		}
+	}
+	return NumBuckets
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -296,6 +296,336 @@ var _ = Describe("DHT", func() {
 			})
 		})
 
+		Context("when querying the closest peers to a target", func() {
+			It("should return the same peers as sorting all peers by their distance from the target", func() {
+				f := func(seed int64) bool {
+					table, _ := initDHT()
+					numPeers := rand.Intn(200)
+					for i := 0; i < numPeers; i++ {
+						addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+						table.AddPeer(id.NewPrivKey().Signatory(), addr)
+					}
+					target := id.NewPrivKey().Signatory()
+					k := rand.Intn(numPeers + 10)
+
+					expected := table.Peers(numPeers)
+					dhtutil.SortSignatories(target, expected)
+					if k < len(expected) {
+						expected = expected[:k]
+					}
+					Expect(table.Closest(target, k)).To(Equal(expected))
+					return true
+				}
+				Expect(quick.Check(f, nil)).To(Succeed())
+			})
+		})
+
+		Context("when refreshing buckets", func() {
+			It("should return targets in the range of stale buckets, once", func() {
+				table, identity := initDHT()
+				for i := 0; i < 100; i++ {
+					addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+					table.AddPeer(id.NewPrivKey().Signatory(), addr)
+				}
+
+				// Buckets were updated when peers were added to them, so only
+				// the empty buckets are stale.
+				stale := table.RefreshTargets(time.Hour)
+				targets := table.RefreshTargets(0)
+				Expect(len(stale)).To(BeNumerically("<", len(targets)))
+				Expect(targets).ToNot(BeEmpty())
+				for b, target := range targets {
+					// The target of bucket b shares exactly b leading bits
+					// with the local peer.
+					prefix := 0
+					for prefix < 8*len(target) && (target[prefix/8]^identity[prefix/8])&(0x80>>uint(prefix%8)) == 0 {
+						prefix++
+					}
+					Expect(prefix).To(Equal(b))
+				}
+				Expect(table.RefreshTargets(time.Hour)).To(BeEmpty())
+			})
+		})
+
+		Context("when adding a peer that is already in the table", func() {
+			It("should reject stale, and unsigned, network addresses", func() {
+				table, _ := initDHT()
+				privKey := id.NewPrivKey()
+				addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 2)
+				table.AddPeer(privKey.Signatory(), addr)
+
+				stale := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", 1)
+				table.AddPeer(privKey.Signatory(), stale)
+				current, _ := table.PeerAddress(privKey.Signatory())
+				Expect(current).To(Equal(addr))
+
+				// Signed network addresses replace unsigned network addresses,
+				// even when their nonce is smaller.
+				signed := wire.NewUnsignedAddress(wire.TCP, "172.16.254.3:3000", 1)
+				Expect(signed.Sign(privKey)).To(Succeed())
+				table.AddPeer(privKey.Signatory(), signed)
+				current, _ = table.PeerAddress(privKey.Signatory())
+				Expect(current).To(Equal(signed))
+
+				unsigned := wire.NewUnsignedAddress(wire.TCP, "172.16.254.4:3000", 100)
+				table.AddPeer(privKey.Signatory(), unsigned)
+				current, _ = table.PeerAddress(privKey.Signatory())
+				Expect(current).To(Equal(signed))
+			})
+		})
+
+		Context("when adding a peer with many network addresses", func() {
+			It("should return them in order, and replace them together", func() {
+				table, _ := initDHT()
+				sig := id.NewPrivKey().Signatory()
+				addrs := []wire.Address{
+					wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1),
+					wire.NewUnsignedAddress(wire.WebSocket, "172.16.254.1:3001", 1),
+					wire.NewUnsignedAddress(wire.TCP, "[2001:db8::1]:3000", 1),
+				}
+				table.AddPeerAddresses(sig, addrs)
+				current, ok := table.PeerAddresses(sig)
+				Expect(ok).To(BeTrue())
+				Expect(current).To(Equal(addrs))
+				first, ok := table.PeerAddress(sig)
+				Expect(ok).To(BeTrue())
+				Expect(first).To(Equal(addrs[0]))
+
+				// Modifying the returned list does not modify the table.
+				current[0] = wire.Address{}
+				current, _ = table.PeerAddresses(sig)
+				Expect(current).To(Equal(addrs))
+
+				newer := wire.NewUnsignedAddress(wire.TCP, "172.16.254.2:3000", 2)
+				table.AddPeer(sig, newer)
+				current, _ = table.PeerAddresses(sig)
+				Expect(current).To(Equal([]wire.Address{newer}))
+
+				table.AddPeerAddresses(sig, addrs)
+				table.AddPeerAddresses(sig, nil)
+				current, _ = table.PeerAddresses(sig)
+				Expect(current).To(Equal([]wire.Address{newer}))
+			})
+		})
+
+		Context("when tagging peers with groups", func() {
+			It("should return the closest peers in the table that are in the group", func() {
+				table, self := initDHT()
+				shard, other := id.NewHash([]byte("shard")), id.NewHash([]byte("other"))
+				sigs := make([]id.Signatory, 10)
+				for i := range sigs {
+					sigs[i] = id.NewPrivKey().Signatory()
+					table.AddPeer(sigs[i], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+					if i%2 == 0 {
+						table.AddToGroup(sigs[i], shard)
+					}
+				}
+				table.AddToGroup(sigs[0], other)
+				Expect(table.Groups(sigs[1])).To(BeEmpty())
+				Expect(table.Groups(sigs[0])).To(ConsistOf(shard, other))
+
+				members := table.PeersInGroup(shard, 10)
+				Expect(members).To(ConsistOf(sigs[0], sigs[2], sigs[4], sigs[6], sigs[8]))
+				Expect(dhtutil.IsSorted(self, members)).To(BeTrue())
+				Expect(table.PeersInGroup(shard, 2)).To(Equal(members[:2]))
+				Expect(table.PeersInGroup(shard, 0)).To(BeEmpty())
+
+				// Peers that are not in the table are not returned, but stay
+				// tagged.
+				table.DeletePeer(sigs[0])
+				Expect(table.PeersInGroup(shard, 10)).To(HaveLen(4))
+				Expect(table.PeersInGroup(other, 10)).To(BeEmpty())
+				table.AddPeer(sigs[0], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 2))
+				Expect(table.PeersInGroup(other, 10)).To(Equal([]id.Signatory{sigs[0]}))
+
+				table.RemoveFromGroup(sigs[2], shard)
+				Expect(table.PeersInGroup(shard, 10)).To(HaveLen(4))
+				Expect(table.Groups(sigs[2])).To(BeEmpty())
+			})
+		})
+
+		Context("when subscribing to changes", func() {
+			It("should deliver an event for every change until unsubscribed", func() {
+				table, _ := initDHT()
+				events := make(chan dht.PeerEvent, 10)
+				unsubscribe := table.Subscribe(events)
+
+				sig := id.NewPrivKey().Signatory()
+				addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1)
+				newer := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", 2)
+				table.AddPeer(sig, addr)
+				table.AddPeer(sig, addr)
+				table.AddPeer(sig, newer)
+				table.DeletePeer(sig)
+				table.DeletePeer(sig)
+
+				Expect(<-events).To(Equal(dht.PeerEvent{Type: dht.PeerAdded, Peer: sig, Addresses: []wire.Address{addr}}))
+				Expect(<-events).To(Equal(dht.PeerEvent{Type: dht.PeerUpdated, Peer: sig, Addresses: []wire.Address{newer}}))
+				Expect(<-events).To(Equal(dht.PeerEvent{Type: dht.PeerRemoved, Peer: sig}))
+				Expect(events).ToNot(Receive())
+
+				unsubscribe()
+				table.AddPeer(sig, addr)
+				Expect(events).ToNot(Receive())
+			})
+
+			It("should drop events that do not fit in the channel", func() {
+				table, _ := initDHT()
+				events := make(chan dht.PeerEvent, 1)
+				defer table.Subscribe(events)()
+
+				table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				table.AddPeer(id.NewPrivKey().Signatory(), wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				Expect(table.NumPeers()).To(Equal(2))
+				Expect(events).To(Receive())
+				Expect(events).ToNot(Receive())
+			})
+		})
+
+		Context("when tracking the liveness of peers", func() {
+			It("should count failures until the peer is seen, and return stale peers", func() {
+				table, _ := initDHT()
+				stale := id.NewPrivKey().Signatory()
+				live := id.NewPrivKey().Signatory()
+				addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+				table.AddPeer(stale, addr)
+				table.AddPeer(live, addr)
+
+				table.Failed(stale)
+				table.Failed(stale)
+				liveness, ok := table.Liveness(stale)
+				Expect(ok).To(BeTrue())
+				Expect(liveness.Failures).To(Equal(2))
+
+				time.Sleep(10 * time.Millisecond)
+				table.Seen(live)
+				Expect(table.StalePeers(10 * time.Millisecond)).To(Equal([]id.Signatory{stale}))
+				Expect(table.StalePeers(0)).To(Equal([]id.Signatory{stale, live}))
+
+				table.Seen(stale)
+				liveness, _ = table.Liveness(stale)
+				Expect(liveness.Failures).To(Equal(0))
+
+				table.DeletePeer(stale)
+				_, ok = table.Liveness(stale)
+				Expect(ok).To(BeFalse())
+				table.Seen(stale)
+				_, ok = table.Liveness(stale)
+				Expect(ok).To(BeFalse())
+			})
+
+			It("should smooth the observed latency, and keep it when the peer is seen", func() {
+				table, _ := initDHT()
+				sig := id.NewPrivKey().Signatory()
+				table.AddPeer(sig, wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				liveness, _ := table.Liveness(sig)
+				Expect(liveness.Latency).To(Equal(time.Duration(0)))
+				Expect(liveness.Added).To(Equal(liveness.LastSeen))
+				Expect(liveness.Seen).To(BeFalse())
+
+				table.ObserveLatency(sig, 80*time.Millisecond)
+				table.ObserveLatency(sig, 160*time.Millisecond)
+				table.Seen(sig)
+				liveness, _ = table.Liveness(sig)
+				Expect(liveness.Latency).To(Equal(90 * time.Millisecond))
+				Expect(liveness.LastSeen.After(liveness.Added)).To(BeTrue())
+				Expect(liveness.Seen).To(BeTrue())
+			})
+		})
+
+		Context("when measuring the speed of peers", func() {
+			It("should smooth the throughput, and return the fastest peers first", func() {
+				table, self := initDHT()
+				sigs := make([]id.Signatory, 5)
+				for i := range sigs {
+					sigs[i] = id.NewPrivKey().Signatory()
+					table.AddPeer(sigs[i], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				}
+
+				table.ObserveThroughput(sigs[0], 1000, time.Second)
+				table.ObserveThroughput(sigs[0], 1000, 100*time.Millisecond)
+				table.ObserveThroughput(sigs[0], 1000, 0)
+				liveness, _ := table.Liveness(sigs[0])
+				Expect(liveness.Throughput).To(Equal(2125.0))
+
+				table.ObserveLatency(sigs[3], 30*time.Millisecond)
+				table.ObserveLatency(sigs[1], 10*time.Millisecond)
+				table.ObserveLatency(sigs[4], 20*time.Millisecond)
+				fastest := table.FastestPeers(5)
+				Expect(fastest[:3]).To(Equal([]id.Signatory{sigs[1], sigs[4], sigs[3]}))
+				Expect(fastest[3:]).To(ConsistOf(sigs[0], sigs[2]))
+				Expect(dhtutil.IsSorted(self, fastest[3:])).To(BeTrue())
+				Expect(table.FastestPeers(2)).To(Equal([]id.Signatory{sigs[1], sigs[4]}))
+				Expect(table.FastestPeers(0)).To(BeEmpty())
+			})
+		})
+
+		Context("when the number of peers is bounded", func() {
+			It("should evict the peer with the lowest score, if it is negative", func() {
+				table := dht.NewInMemTable(id.NewPrivKey().Signatory())
+				table.SetMaxPeers(3, nil)
+				events := make(chan dht.PeerEvent, 10)
+				defer table.Subscribe(events)()
+
+				sigs := make([]id.Signatory, 3)
+				for i := range sigs {
+					sigs[i] = id.NewPrivKey().Signatory()
+					table.AddPeer(sigs[i], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", 1))
+				}
+				time.Sleep(10 * time.Millisecond)
+				for i := range sigs {
+					table.Seen(sigs[i])
+				}
+
+				// Peers that have been seen score higher than new peers, so a
+				// new peer is dropped.
+				sprayed := id.NewPrivKey().Signatory()
+				table.AddPeer(sprayed, wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3000", 1))
+				Expect(table.NumPeers()).To(Equal(3))
+				_, ok := table.PeerAddress(sprayed)
+				Expect(ok).To(BeFalse())
+
+				// Peers that have been seen are only evicted after repeated
+				// failures.
+				table.ObserveLatency(sigs[1], time.Second)
+				table.Failed(sigs[1])
+				for i := 0; i < dht.ScoreEvictionFailures; i++ {
+					table.Failed(sigs[2])
+				}
+				fresh := id.NewPrivKey().Signatory()
+				table.AddPeer(fresh, wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3000", 1))
+				Expect(table.NumPeers()).To(Equal(3))
+				Expect(table.Peers(3)).To(ConsistOf(sigs[0], sigs[1], fresh))
+				_, ok = table.Liveness(sigs[2])
+				Expect(ok).To(BeFalse())
+
+				// Peers that have never been seen score below every peer that
+				// has been seen, so they are evicted first.
+				for i := 0; i < dht.ScoreEvictionFailures; i++ {
+					table.Failed(sigs[1])
+				}
+				table.AddPeer(sprayed, wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3000", 1))
+				Expect(table.Peers(3)).To(ConsistOf(sigs[0], sigs[1], sprayed))
+
+				// Updating peers that are in the table does not evict peers.
+				table.AddPeer(sigs[0], wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3001", 2))
+				Expect(table.Peers(3)).To(ConsistOf(sigs[0], sigs[1], sprayed))
+
+				for i := 0; i < 3; i++ {
+					<-events
+				}
+				Expect(<-events).To(Equal(dht.PeerEvent{Type: dht.PeerRemoved, Peer: sigs[2]}))
+				Expect((<-events).Peer).To(Equal(fresh))
+				Expect(<-events).To(Equal(dht.PeerEvent{Type: dht.PeerRemoved, Peer: fresh}))
+				Expect((<-events).Peer).To(Equal(sprayed))
+
+				// Removing the bound allows the table to grow.
+				table.SetMaxPeers(0, nil)
+				table.AddPeer(fresh, wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3000", 1))
+				Expect(table.NumPeers()).To(Equal(4))
+			})
+		})
+
 		Measure("Adding 10000 addresses to distributed hash table", func(b Benchmarker) {
 			table, _ := initDHT()
 			signatories := make([]id.Signatory, 0)
@@ -388,6 +718,58 @@ var _ = Describe("DHT", func() {
 				Expect(len(signatories)).To(Equal(0))
 			})
 		})
+
+		Context("when observing subnets", func() {
+			It("should notify about subnets and the liveness of their members", func() {
+				self := id.NewPrivKey().Signatory()
+				table := dht.NewInMemTable(self)
+
+				type event struct {
+					kind   string
+					subnet id.Hash
+					member id.Signatory
+				}
+				events := []event{}
+				table.SetSubnetObserver(dht.CallbackSubnetObserver{
+					OnSubnetAddedCallback: func(subnet id.Hash, members []id.Signatory) {
+						events = append(events, event{kind: "added", subnet: subnet})
+					},
+					OnSubnetDeletedCallback: func(subnet id.Hash, members []id.Signatory) {
+						events = append(events, event{kind: "deleted", subnet: subnet})
+					},
+					OnMemberUpCallback: func(subnet id.Hash, member id.Signatory) {
+						events = append(events, event{kind: "up", subnet: subnet, member: member})
+					},
+					OnMemberDownCallback: func(subnet id.Hash, member id.Signatory) {
+						events = append(events, event{kind: "down", subnet: subnet, member: member})
+					},
+				})
+
+				member := id.NewPrivKey().Signatory()
+				other := id.NewPrivKey().Signatory()
+				hash := table.AddSubnet([]id.Signatory{member})
+				table.AddSubnet([]id.Signatory{member})
+
+				addr := wire.NewUnsignedAddress(wire.TCP, "172.16.254.1:3000", uint64(time.Now().UnixNano()))
+				table.AddPeer(member, addr)
+				table.AddPeer(member, addr)
+				table.AddPeer(other, addr)
+
+				table.AddExpiry(member, 0)
+				time.Sleep(time.Millisecond)
+				Expect(table.HandleExpired(member)).To(BeTrue())
+
+				table.DeleteSubnet(hash)
+				table.DeleteSubnet(hash)
+
+				Expect(events).To(Equal([]event{
+					{kind: "added", subnet: hash},
+					{kind: "up", subnet: hash, member: member},
+					{kind: "down", subnet: hash, member: member},
+					{kind: "deleted", subnet: hash},
+				}))
+			})
+		})
 	})
 })
 
@@ -0,0 +1,100 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/renproject/id"
+)
+
+// cacheEntry is a payload that has been seen.
+type cacheEntry struct {
+	data []byte
+	at   time.Time
+}
+
+// cache remembers the payloads that have been seen, bounded by count and by
+// age. Payloads are forgotten in the order that they were seen, so the oldest
+// payload is always at the front of the order.
+type cache struct {
+	mu      *sync.Mutex
+	maxSize int
+	maxAge  time.Duration
+	entries map[id.Hash]cacheEntry
+	order   []id.Hash
+}
+
+func newCache(maxSize int, maxAge time.Duration) *cache {
+	return &cache{
+		mu:      new(sync.Mutex),
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		entries: map[id.Hash]cacheEntry{},
+		order:   []id.Hash{},
+	}
+}
+
+// insert a payload, and return false if it has already been seen.
+func (c *cache) insert(hash id.Hash, data []byte, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expireLocked(now)
+	if _, ok := c.entries[hash]; ok {
+		return false
+	}
+	c.entries[hash] = cacheEntry{data: data, at: now}
+	c.order = append(c.order, hash)
+	for len(c.order) > c.maxSize {
+		c.popLocked()
+	}
+	return true
+}
+
+// expire the payloads that are older than the maximum age.
+func (c *cache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expireLocked(now)
+}
+
+// hashes returns the hashes of all payloads, from oldest to newest.
+func (c *cache) hashes() []id.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes := make([]id.Hash, len(c.order))
+	copy(hashes, c.order)
+	return hashes
+}
+
+// missing returns the payloads whose hashes are not in the set, from oldest to
+// newest. At most max payloads are returned, unless max is not positive.
+func (c *cache) missing(set map[id.Hash]struct{}, max int) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	missing := [][]byte{}
+	for _, hash := range c.order {
+		if max > 0 && len(missing) >= max {
+			break
+		}
+		if _, ok := set[hash]; !ok {
+			missing = append(missing, c.entries[hash].data)
+		}
+	}
+	return missing
+}
+
+func (c *cache) expireLocked(now time.Time) {
+	for len(c.order) > 0 && now.Sub(c.entries[c.order[0]].at) > c.maxAge {
+		c.popLocked()
+	}
+}
+
+func (c *cache) popLocked() {
+	delete(c.entries, c.order[0])
+	c.order[0] = id.Hash{}
+	c.order = c.order[1:]
+}
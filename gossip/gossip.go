@@ -0,0 +1,246 @@
+// Package gossip spreads payloads to all peers in the network. Payloads are
+// pushed to a random fanout of peers, which relay them to their own random
+// fanout until their TTL is exhausted. Peers remember the payloads that they
+// have seen, so that duplicates are dropped, and periodically send a digest of
+// them to a random peer, which pushes back the payloads that are missing from
+// the digest (anti-entropy), so that payloads that were lost by pushes still
+// reach every peer.
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// Kinds of messages sent on the gossip stream. Every message begins with its
+// kind.
+const (
+	// kindPush carries a payload. It is followed by the TTL of the payload,
+	// and the payload.
+	kindPush = byte(1)
+	// kindDigest is sent during anti-entropy rounds. It is followed by the
+	// 32 byte hashes of the payloads that are remembered by the sending peer.
+	kindDigest = byte(2)
+)
+
+// ErrNoPeers is returned when a payload is gossiped, but there are no peers in
+// the table to which it can be pushed.
+var ErrNoPeers = errors.New("no peers")
+
+// A PushError is returned when a payload is gossiped, but could not be pushed
+// to any of the peers that were chosen. Errs holds the error of every peer.
+type PushError struct {
+	Errs map[id.Signatory]error
+}
+
+// Error implements the error interface.
+func (err PushError) Error() string {
+	reasons := make([]string, 0, len(err.Errs))
+	for peer, peerErr := range err.Errs {
+		reasons = append(reasons, fmt.Sprintf("%v: %v", peer, peerErr))
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("pushing to %v peers: %v", len(err.Errs), strings.Join(reasons, "; "))
+}
+
+// A Listener is called once for every payload that is delivered, whether it
+// was pushed, or pulled during an anti-entropy round. It is called from the
+// receiving goroutine, so it must not block.
+type Listener func(from id.Signatory, data []byte)
+
+// A Gossiper spreads payloads to, and receives payloads from, remote peers.
+// Payloads are identified by their hash, so payloads that are equal are only
+// delivered once (as long as they are remembered).
+type Gossiper struct {
+	opts      Options
+	transport *transport.Transport
+	listener  Listener
+	cache     *cache
+
+	// digestLimiter bounds the number of anti-entropy digests that are
+	// answered for each remote peer.
+	digestLimiter *policy.SignatoryLimiter
+}
+
+// New returns a Gossiper that delivers payloads to the Listener. A nil Listener
+// ignores payloads, but they are still relayed.
+func New(opts Options, transport *transport.Transport, listener Listener) *Gossiper {
+	return &Gossiper{
+		opts:      opts,
+		transport: transport,
+		listener:  listener,
+		cache:     newCache(opts.CacheSize, opts.CacheAge),
+
+		digestLimiter: policy.NewSignatoryLimiter(opts.DigestRateLimit, opts.DigestBurst),
+	}
+}
+
+// Run the Gossiper until the context is done. It must be running for payloads
+// to be received, relayed, and pulled.
+func (g *Gossiper) Run(ctx context.Context) {
+	g.transport.ReceiveStream(ctx, g.opts.Stream, func(from id.Signatory, packet wire.Packet) error {
+		g.didReceive(ctx, from, packet.Msg.Data)
+		return nil
+	})
+
+	if g.opts.AntiEntropyInterval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(g.opts.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.cache.expire(time.Now())
+			g.antiEntropy(ctx)
+		}
+	}
+}
+
+// Gossip a payload to the network. The payload is pushed to a random fanout of
+// peers, and a PushError is returned if it could not be pushed to any of them.
+// Gossiping a payload that has already been seen pushes it again, so that it
+// can be used to retry.
+func (g *Gossiper) Gossip(ctx context.Context, data []byte) error {
+	g.cache.insert(id.NewHash(data), data, time.Now())
+
+	peers := g.transport.Table().RandomPeers(g.opts.Fanout)
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+	if errs := g.push(ctx, peers, g.opts.TTL, data); len(errs) == len(peers) {
+		return PushError{Errs: errs}
+	}
+	return nil
+}
+
+// push a payload to many remote peers, and return the errors of the pushes
+// that failed.
+func (g *Gossiper) push(ctx context.Context, to []id.Signatory, ttl uint8, data []byte) map[id.Signatory]error {
+	msg := make([]byte, 0, 2+len(data))
+	msg = append(msg, kindPush, ttl)
+	msg = append(msg, data...)
+
+	ctx, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+	defer cancel()
+	errs := g.transport.SendToMany(ctx, to, wire.Msg{
+		Version: wire.MsgVersion2,
+		Stream:  g.opts.Stream,
+		Type:    wire.MsgTypeSend,
+		Data:    msg,
+	})
+	for peer, err := range errs {
+		g.opts.Logger.Debug("gossip", zap.String("peer", peer.String()), zap.Error(err))
+	}
+	return errs
+}
+
+// antiEntropy sends a digest of the remembered payloads to a random peer.
+func (g *Gossiper) antiEntropy(ctx context.Context) {
+	peers := g.transport.Table().RandomPeers(1)
+	if len(peers) == 0 {
+		return
+	}
+	hashes := g.cache.hashes()
+	msg := make([]byte, 0, 1+len(hashes)*len(id.Hash{}))
+	msg = append(msg, kindDigest)
+	for _, hash := range hashes {
+		msg = append(msg, hash[:]...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+	defer cancel()
+	if err := g.transport.SendOnStream(ctx, peers[0], g.opts.Stream, wire.Msg{Type: wire.MsgTypeSend, Data: msg}); err != nil {
+		g.opts.Logger.Debug("gossip", zap.String("peer", peers[0].String()), zap.Error(err))
+	}
+}
+
+func (g *Gossiper) didReceive(ctx context.Context, from id.Signatory, data []byte) {
+	if len(data) == 0 {
+		g.opts.Logger.Debug("gossip", zap.String("peer", from.String()), zap.Error(fmt.Errorf("empty message")))
+		return
+	}
+
+	switch kind, body := data[0], data[1:]; kind {
+	case kindPush:
+		if len(body) < 1 {
+			g.opts.Logger.Debug("gossip", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed push")))
+			return
+		}
+		ttl, payload := body[0], body[1:]
+		if !g.cache.insert(id.NewHash(payload), payload, time.Now()) {
+			return
+		}
+		if g.listener != nil {
+			g.listener(from, payload)
+		}
+		if ttl > 0 {
+			go g.relay(ctx, from, ttl-1, payload)
+		}
+
+	case kindDigest:
+		if len(body)%len(id.Hash{}) != 0 {
+			g.opts.Logger.Debug("gossip", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed digest")))
+			return
+		}
+		if !g.digestLimiter.Allow(from) {
+			g.opts.Logger.Debug("gossip", zap.String("peer", from.String()), zap.Error(fmt.Errorf("digest rate limit exceeded")))
+			return
+		}
+		set := make(map[id.Hash]struct{}, len(body)/len(id.Hash{}))
+		for i := 0; i < len(body); i += len(id.Hash{}) {
+			var hash id.Hash
+			copy(hash[:], body[i:])
+			set[hash] = struct{}{}
+		}
+		missing := g.cache.missing(set, g.opts.MaxDigestPayloads)
+		if len(missing) == 0 {
+			return
+		}
+		// Pushes that answer a digest are not relayed, because the remote
+		// peer is the only peer that is known to be missing them.
+		go func() {
+			for _, payload := range missing {
+				if errs := g.push(ctx, []id.Signatory{from}, 0, payload); len(errs) > 0 {
+					return
+				}
+			}
+		}()
+
+	default:
+		g.opts.Logger.Debug("gossip", zap.String("peer", from.String()), zap.Error(fmt.Errorf("unknown message kind: %v", kind)))
+	}
+}
+
+// relay a payload to a random fanout of peers, excluding the peer from which
+// it was received.
+func (g *Gossiper) relay(ctx context.Context, from id.Signatory, ttl uint8, data []byte) {
+	peers := g.transport.Table().RandomPeers(g.opts.Fanout + 1)
+	to := make([]id.Signatory, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Equal(&from) {
+			continue
+		}
+		to = append(to, peer)
+	}
+	if len(to) > g.opts.Fanout {
+		to = to[:g.opts.Fanout]
+	}
+	if len(to) == 0 {
+		return
+	}
+	g.push(ctx, to, ttl, data)
+}
@@ -0,0 +1,205 @@
+package gossip_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/gossip"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/transport/transporttest"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// deliveries counts the payloads delivered to a Listener.
+type deliveries struct {
+	mu     *sync.Mutex
+	counts map[string]int
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{mu: new(sync.Mutex), counts: map[string]int{}}
+}
+
+func (d *deliveries) listen(from id.Signatory, data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.counts[string(data)]++
+}
+
+func (d *deliveries) count(data []byte) func() int {
+	return func() int {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return d.counts[string(data)]
+	}
+}
+
+var _ = Describe("Gossip", func() {
+	run := func(ctx context.Context, transports []*transport.Transport, opts gossip.Options) ([]*gossip.Gossiper, []*deliveries) {
+		transporttest.ConnectAll(transports)
+		gossipers := make([]*gossip.Gossiper, len(transports))
+		delivered := make([]*deliveries, len(transports))
+		for i := range transports {
+			delivered[i] = newDeliveries()
+			gossipers[i] = gossip.New(opts, transports[i], delivered[i].listen)
+			go gossipers[i].Run(ctx)
+		}
+		return gossipers, delivered
+	}
+
+	Context("when gossipping a payload to every peer", func() {
+		It("should be delivered to every peer exactly once", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 8)
+			opts := gossip.DefaultOptions().WithLogger(zap.NewNop()).WithFanout(len(transports) - 1)
+			gossipers, delivered := run(ctx, transports, opts)
+
+			data := []byte("hello")
+			Expect(gossipers[0].Gossip(ctx, data)).To(Succeed())
+			for i := 1; i < len(transports); i++ {
+				Eventually(delivered[i].count(data), 5*time.Second).Should(Equal(1))
+			}
+			Expect(delivered[0].count(data)()).To(Equal(0))
+
+			// Gossipping the payload again pushes it again, but it is not
+			// delivered again.
+			Expect(gossipers[0].Gossip(ctx, data)).To(Succeed())
+			for i := 1; i < len(transports); i++ {
+				Consistently(delivered[i].count(data), 100*time.Millisecond).Should(Equal(1))
+			}
+		})
+	})
+
+	Context("when gossipping a payload to a small fanout", func() {
+		It("should be relayed, and pulled, until every peer has it", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 8)
+			opts := gossip.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithFanout(1).
+				WithTTL(2).
+				WithAntiEntropyInterval(100 * time.Millisecond)
+			gossipers, delivered := run(ctx, transports, opts)
+
+			data := []byte("hello")
+			Expect(gossipers[0].Gossip(ctx, data)).To(Succeed())
+			for i := 1; i < len(transports); i++ {
+				Eventually(delivered[i].count(data), 10*time.Second).Should(Equal(1))
+			}
+			for i := 1; i < len(transports); i++ {
+				Consistently(delivered[i].count(data), 100*time.Millisecond).Should(Equal(1))
+			}
+		})
+	})
+
+	Context("when there are no peers", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 1)
+			gossiper := gossip.New(gossip.DefaultOptions().WithLogger(zap.NewNop()), transports[0], nil)
+			Expect(gossiper.Gossip(ctx, []byte("hello"))).To(MatchError(gossip.ErrNoPeers))
+		})
+	})
+
+	Context("when no peer can be pushed to", func() {
+		It("should return the error of every peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 1)
+			unreachable := id.NewPrivKey().Signatory()
+			transports[0].Table().AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:13581", uint64(time.Now().UnixNano())))
+			gossiper := gossip.New(gossip.DefaultOptions().WithLogger(zap.NewNop()).WithTimeout(200*time.Millisecond), transports[0], nil)
+
+			err := gossiper.Gossip(ctx, []byte("hello"))
+			pushErr := gossip.PushError{}
+			Expect(errors.As(err, &pushErr)).To(BeTrue())
+			Expect(pushErr.Errs).To(HaveKey(unreachable))
+		})
+	})
+
+	Context("when a peer sends digests", func() {
+		It("should push back a bounded number of payloads, and drop digests that exceed the rate limit", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 2)
+			opts := gossip.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithAntiEntropyInterval(0).
+				WithMaxDigestPayloads(2).
+				WithDigestRateLimit(rate.Every(time.Hour), 1)
+			delivered := newDeliveries()
+			gossipers := []*gossip.Gossiper{
+				gossip.New(opts, transports[0], nil),
+				gossip.New(opts, transports[1], delivered.listen),
+			}
+			for i := range gossipers {
+				go gossipers[i].Run(ctx)
+			}
+
+			// Payloads are remembered even if there are no peers to which
+			// they can be pushed.
+			payloads := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+			for _, payload := range payloads {
+				Expect(gossipers[0].Gossip(ctx, payload)).To(MatchError(gossip.ErrNoPeers))
+			}
+			transporttest.Connect(transports[0], transports[1])
+
+			// An empty digest is missing every payload.
+			digest := wire.Msg{Type: wire.MsgTypeSend, Data: []byte{2}}
+			Expect(transports[1].SendOnStream(ctx, transports[0].Self(), gossip.DefaultStream, digest)).To(Succeed())
+			Eventually(delivered.count(payloads[1]), 5*time.Second).Should(Equal(1))
+			Expect(delivered.count(payloads[0])()).To(Equal(1))
+
+			Expect(transports[1].SendOnStream(ctx, transports[0].Self(), gossip.DefaultStream, digest)).To(Succeed())
+			for _, payload := range payloads[2:] {
+				Consistently(delivered.count(payload), 200*time.Millisecond).Should(Equal(0))
+			}
+		})
+	})
+
+	Context("when a peer joins after a payload was gossipped", func() {
+		It("should pull the payload during an anti-entropy round", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			transports := transporttest.New(ctx, 3)
+			transporttest.Connect(transports[0], transports[1])
+			opts := gossip.DefaultOptions().WithLogger(zap.NewNop()).WithAntiEntropyInterval(100 * time.Millisecond)
+			delivered := make([]*deliveries, len(transports))
+			gossipers := make([]*gossip.Gossiper, len(transports))
+			for i := range transports {
+				delivered[i] = newDeliveries()
+				gossipers[i] = gossip.New(opts, transports[i], delivered[i].listen)
+			}
+			go gossipers[0].Run(ctx)
+			go gossipers[1].Run(ctx)
+
+			data := []byte("hello")
+			Expect(gossipers[0].Gossip(ctx, data)).To(Succeed())
+			Eventually(delivered[1].count(data)).Should(Equal(1))
+
+			transporttest.Connect(transports[2], transports[0])
+			go gossipers[2].Run(ctx)
+			Eventually(delivered[2].count(data), 5*time.Second).Should(Equal(1))
+			Consistently(delivered[2].count(data), 500*time.Millisecond).Should(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,141 @@
+package gossip
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+var (
+	// DefaultStream is high, so that it does not collide with the streams
+	// chosen by applications, or with the transfer stream.
+	DefaultStream              = uint16(0xFFF1)
+	DefaultFanout              = 4
+	DefaultTTL                 = uint8(8)
+	DefaultCacheSize           = 4096
+	DefaultCacheAge            = 5 * time.Minute
+	DefaultAntiEntropyInterval = 10 * time.Second
+	DefaultTimeout             = 5 * time.Second
+	DefaultDigestRateLimit     = rate.Limit(1)
+	DefaultDigestBurst         = 4
+	DefaultMaxDigestPayloads   = 256
+)
+
+// Options for gossiping payloads between peers.
+type Options struct {
+	Logger              *zap.Logger
+	Stream              uint16
+	Fanout              int
+	TTL                 uint8
+	CacheSize           int
+	CacheAge            time.Duration
+	AntiEntropyInterval time.Duration
+	Timeout             time.Duration
+	DigestRateLimit     rate.Limit
+	DigestBurst         int
+	MaxDigestPayloads   int
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return Options{
+		Logger:              logger,
+		Stream:              DefaultStream,
+		Fanout:              DefaultFanout,
+		TTL:                 DefaultTTL,
+		CacheSize:           DefaultCacheSize,
+		CacheAge:            DefaultCacheAge,
+		AntiEntropyInterval: DefaultAntiEntropyInterval,
+		Timeout:             DefaultTimeout,
+		DigestRateLimit:     DefaultDigestRateLimit,
+		DigestBurst:         DefaultDigestBurst,
+		MaxDigestPayloads:   DefaultMaxDigestPayloads,
+	}
+}
+
+// WithLogger sets the Logger used for logging all errors, warnings, information,
+// debug traces, and so on.
+func (opts Options) WithLogger(logger *zap.Logger) Options {
+	opts.Logger = logger
+	return opts
+}
+
+// WithStream sets the stream on which payloads are gossiped. All peers must
+// use the same stream.
+func (opts Options) WithStream(stream uint16) Options {
+	opts.Stream = stream
+	return opts
+}
+
+// WithFanout sets the number of random peers to which a payload is pushed
+// when it is gossiped, and when it is relayed.
+func (opts Options) WithFanout(fanout int) Options {
+	opts.Fanout = fanout
+	return opts
+}
+
+// WithTTL sets the number of times that a payload is relayed after it is
+// gossiped. A TTL of zero pushes payloads to the fanout only.
+func (opts Options) WithTTL(ttl uint8) Options {
+	opts.TTL = ttl
+	return opts
+}
+
+// WithCacheSize sets the maximum number of payloads that are remembered, so
+// that duplicates are dropped, and so that they can be pulled by remote peers
+// during anti-entropy rounds. It also bounds the size of anti-entropy digests
+// (32 bytes per payload).
+func (opts Options) WithCacheSize(size int) Options {
+	opts.CacheSize = size
+	return opts
+}
+
+// WithCacheAge sets how long payloads are remembered. Payloads that are
+// received again after they have been forgotten are delivered again, so the
+// age must be longer than the time that a payload takes to spread.
+func (opts Options) WithCacheAge(age time.Duration) Options {
+	opts.CacheAge = age
+	return opts
+}
+
+// WithAntiEntropyInterval sets how often a random peer is sent a digest of the
+// remembered payloads, so that it can push back the payloads that are missing
+// (for example, because pushes were lost, or because the local peer was
+// offline). An interval that is not positive disables anti-entropy.
+func (opts Options) WithAntiEntropyInterval(interval time.Duration) Options {
+	opts.AntiEntropyInterval = interval
+	return opts
+}
+
+// WithTimeout sets how long pushes, and digests, wait to be sent.
+func (opts Options) WithTimeout(timeout time.Duration) Options {
+	opts.Timeout = timeout
+	return opts
+}
+
+// WithDigestRateLimit sets the number of anti-entropy digests that are answered
+// for each remote peer per second, and the number of digests that can be
+// answered in a burst. Digests that exceed the limit are dropped, because
+// every digest can cause many payloads to be pushed back. Remote peers send
+// one digest to a random peer every anti-entropy interval, so the limit only
+// needs to allow for a few remote peers choosing the same peer.
+func (opts Options) WithDigestRateLimit(limit rate.Limit, burst int) Options {
+	opts.DigestRateLimit = limit
+	opts.DigestBurst = burst
+	return opts
+}
+
+// WithMaxDigestPayloads sets the maximum number of payloads that are pushed
+// back in answer to one anti-entropy digest. The oldest missing payloads are
+// pushed first, and the others are pushed in answer to later digests. A
+// non-positive maximum does not bound the payloads, so that an empty digest
+// pushes back every remembered payload.
+func (opts Options) WithMaxDigestPayloads(max int) Options {
+	opts.MaxDigestPayloads = max
+	return opts
+}
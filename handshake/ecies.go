@@ -18,7 +18,23 @@ import (
 const sizeOfSecretKey = 32
 const sizeOfEncryptedSecretKey = 145 // 113-byte encryption header + 32-byte secret key
 
+// ECIES returns a Handshake that authenticates both peers by having them
+// decrypt secret keys encrypted to their public keys, and then encrypts the
+// session using AES-GCM. It is the same as ECIESWithOptions, except that no
+// cipher suite is negotiated, so it is compatible with peers that do not
+// negotiate cipher suites.
 func ECIES(privKey *id.PrivKey) Handshake {
+	return ECIESWithOptions(privKey, Options{})
+}
+
+// ECIESWithOptions is the same as ECIES, but once both peers are
+// authenticated, they negotiate the cipher suite and wire version of the
+// session (see Options.WithCipherSuites and Options.WithVersions). The
+// negotiation is bound into the key of the session, and both peers confirm
+// that they derived the same key before the handshake completes, so a
+// man-in-the-middle cannot downgrade the session. Both peers must use
+// ECIESWithOptions.
+func ECIESWithOptions(privKey *id.PrivKey, opts Options) Handshake {
 	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
 		// Channel for passing errors from the writing goroutine to the reading
 		// goroutine (which has the ability to return the error).
@@ -144,18 +160,18 @@ func ECIES(privKey *id.PrivKey) Handshake {
 		}
 
 		// Build the session key, and use this to build GCM encoders/decoders.
-		sessionKey := [sizeOfSecretKey]byte{}
+		key := [sizeOfSecretKey]byte{}
 		for i := 0; i < sizeOfSecretKey; i++ {
-			sessionKey[i] = localSecretKey[i] ^ remoteSecretKey[i]
+			key[i] = localSecretKey[i] ^ remoteSecretKey[i]
 		}
 
 		self := id.NewSignatory(localPubKey)
 		remote := id.NewSignatory(&remotePubKey)
-		gcmSession, err := codec.NewGCMSession(sessionKey, self, remote)
+		enc, dec, err = establish(conn, key, self, remote, enc, dec, opts)
 		if err != nil {
-			return nil, nil, id.Signatory{}, fmt.Errorf("establish gcm session: %v", err)
+			return nil, nil, id.Signatory{}, err
 		}
-		return codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), remote, nil
+		return enc, dec, remote, nil
 	}
 }
 
@@ -1 +1,182 @@
 package handshake_test
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ECIES", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	type result struct {
+		enc codec.Encoder
+		dec codec.Decoder
+		err error
+	}
+
+	handshakeBoth := func(h1, h2 handshake.Handshake) (result, result) {
+		conn1, conn2 := net.Pipe()
+		results := make(chan result, 1)
+		go func() {
+			enc1, dec1, _, err := h1(conn1, enc, dec)
+			results <- result{enc1, dec1, err}
+		}()
+		enc2, dec2, _, err := h2(conn2, enc, dec)
+		r2 := result{enc2, dec2, err}
+		r1 := <-results
+		if r1.err != nil || r2.err != nil {
+			conn1.Close()
+			conn2.Close()
+			return r1, r2
+		}
+
+		// Send a message from the first peer to the second peer.
+		go func() {
+			defer conn1.Close()
+			_, err := r1.enc(conn1, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		defer conn2.Close()
+		buf := [5 + 128]byte{}
+		n, err := r2.dec(conn2, buf[:5])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("hello"))
+		return r1, r2
+	}
+
+	Context("when negotiating cipher suites", func() {
+		It("should establish a session when a cipher suite is supported by both peers", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			for _, suites := range [][]codec.CipherSuite{
+				handshake.DefaultCipherSuites,
+				{codec.CipherSuiteChaCha20Poly1305},
+				{codec.CipherSuiteXChaCha20Poly1305, codec.CipherSuiteAESGCM},
+			} {
+				r1, r2 := handshakeBoth(
+					handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions().WithCipherSuites(suites...)),
+					handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions()),
+				)
+				Expect(r1.err).ToNot(HaveOccurred())
+				Expect(r2.err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("should fail when no cipher suite is supported by both peers", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			r1, r2 := handshakeBoth(
+				handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions().WithCipherSuites(codec.CipherSuiteAESGCM)),
+				handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions().WithCipherSuites(codec.CipherSuiteChaCha20Poly1305)),
+			)
+			Expect(errors.Is(r1.err, handshake.ErrNoCommonCipherSuite) || errors.Is(r2.err, handshake.ErrNoCommonCipherSuite)).To(BeTrue())
+		})
+	})
+
+	Context("when neither peer negotiates cipher suites", func() {
+		It("should establish an AES-GCM session", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			r1, r2 := handshakeBoth(handshake.ECIES(privKey1), handshake.ECIES(privKey2))
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when negotiating wire versions", func() {
+		It("should store the highest wire version supported by both peers", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			table1 := handshake.NewVersionTable()
+			table2 := handshake.NewVersionTable()
+			r1, r2 := handshakeBoth(
+				handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions().WithVersions(wire.MsgVersion1, wire.MsgVersion2).WithVersionTable(table1)),
+				handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions().WithVersionTable(table2)),
+			)
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+			Expect(table1.Version(privKey2.Signatory())).To(Equal(wire.MsgVersion2))
+			Expect(table2.Version(privKey1.Signatory())).To(Equal(wire.MsgVersion2))
+		})
+
+		It("should not store a wire version when either peer does not support any", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			table := handshake.NewVersionTable()
+			r1, r2 := handshakeBoth(
+				handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions().WithVersions()),
+				handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions().WithVersionTable(table)),
+			)
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+			Expect(table.Version(privKey1.Signatory())).To(Equal(uint16(0)))
+		})
+
+		It("should fail when no wire version is supported by both peers", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			r1, r2 := handshakeBoth(
+				handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions().WithVersions(wire.MsgVersion1)),
+				handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions().WithVersions(wire.MsgVersion2)),
+			)
+			Expect(errors.Is(r1.err, handshake.ErrNoCommonVersion) || errors.Is(r2.err, handshake.ErrNoCommonVersion)).To(BeTrue())
+		})
+	})
+
+	Context("when a man-in-the-middle tampers with the negotiation", func() {
+		It("should fail", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			table := handshake.NewVersionTable()
+
+			// Relay messages between the peers, but tamper with the sealed
+			// negotiation message (24 bytes, and a 16 byte tag) from the
+			// first peer.
+			conn1, proxy1 := net.Pipe()
+			proxy2, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			go func() {
+				defer proxy2.Close()
+				buf := make([]byte, 4096)
+				for {
+					n, err := proxy1.Read(buf)
+					if err != nil {
+						return
+					}
+					if n == 40 {
+						buf[n-1] ^= 0xFF
+					}
+					if _, err := proxy2.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer proxy1.Close()
+				io.Copy(proxy1, proxy2)
+			}()
+
+			errs := make(chan error, 1)
+			go func() {
+				_, _, _, err := handshake.ECIESWithOptions(privKey1, handshake.DefaultOptions())(conn1, enc, dec)
+				errs <- err
+			}()
+			_, _, _, err := handshake.ECIESWithOptions(privKey2, handshake.DefaultOptions().WithVersionTable(table))(conn2, enc, dec)
+			Expect(err).To(HaveOccurred())
+			conn2.Close()
+			Expect(<-errs).To(HaveOccurred())
+			Expect(table.Version(privKey1.Signatory())).To(Equal(uint16(0)))
+		})
+	})
+})
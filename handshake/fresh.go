@@ -0,0 +1,262 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+var (
+	DefaultMaxClockSkew       = 30 * time.Second
+	DefaultNonceCacheCapacity = 65536
+	DefaultMaxNoncesPerPeer   = 1024
+)
+
+var (
+	// ErrStaleTimestamp is returned when the timestamp of the remote peer is
+	// not within the maximum clock skew of the local clock.
+	ErrStaleTimestamp = errors.New("timestamp outside of clock skew window")
+	// ErrReplayedNonce is returned when the nonce of the remote peer has
+	// already been seen within the clock skew window.
+	ErrReplayedNonce = errors.New("nonce has already been seen")
+	// ErrNonceCacheFull is returned when the nonce of the remote peer cannot be
+	// remembered, because the cache, or the share of the cache for the remote
+	// peer, is full of nonces that have not expired.
+	ErrNonceCacheFull = errors.New("nonce cache is full")
+)
+
+// freshMsgSize is the size of a timestamp (in nanoseconds since the Unix
+// epoch), a nonce, and a signature over both.
+const freshMsgSize = 8 + 32 + 65
+
+// NonceCacheOptions for parameterising the behaviour of a NonceCache.
+type NonceCacheOptions struct {
+	MaxClockSkew     time.Duration
+	Capacity         int
+	MaxNoncesPerPeer int
+	Now              func() time.Time
+}
+
+// DefaultNonceCacheOptions returns NonceCacheOptions with sensible defaults.
+func DefaultNonceCacheOptions() NonceCacheOptions {
+	return NonceCacheOptions{
+		MaxClockSkew:     DefaultMaxClockSkew,
+		Capacity:         DefaultNonceCacheCapacity,
+		MaxNoncesPerPeer: DefaultMaxNoncesPerPeer,
+		Now:              time.Now,
+	}
+}
+
+// WithMaxClockSkew sets the maximum difference between the timestamp of a
+// remote peer and the local clock. Nonces are remembered for this long after
+// their timestamp, so larger skews need larger capacities.
+func (opts NonceCacheOptions) WithMaxClockSkew(skew time.Duration) NonceCacheOptions {
+	opts.MaxClockSkew = skew
+	return opts
+}
+
+// WithCapacity sets the maximum number of unexpired nonces that are
+// remembered. Handshakes are rejected while the cache is full.
+func (opts NonceCacheOptions) WithCapacity(capacity int) NonceCacheOptions {
+	opts.Capacity = capacity
+	return opts
+}
+
+// WithMaxNoncesPerPeer sets the maximum number of unexpired nonces that are
+// remembered for each remote peer. Handshakes with a remote peer are rejected
+// while it has this many nonces in the cache, so that one remote peer cannot
+// fill the cache and stop handshakes with other remote peers.
+func (opts NonceCacheOptions) WithMaxNoncesPerPeer(max int) NonceCacheOptions {
+	opts.MaxNoncesPerPeer = max
+	return opts
+}
+
+// WithNow sets the clock used to check timestamps. This is mostly useful for
+// testing.
+func (opts NonceCacheOptions) WithNow(now func() time.Time) NonceCacheOptions {
+	opts.Now = now
+	return opts
+}
+
+// NonceCache remembers the nonces of handshakes until their timestamps are
+// too old to be accepted, so that a nonce cannot be accepted twice. It is
+// safe for concurrent use, and should be shared by all handshakes of a peer.
+type NonceCache struct {
+	opts NonceCacheOptions
+
+	noncesMu *sync.Mutex
+	nonces   map[id.Signatory]map[[32]byte]time.Time
+	len      int
+}
+
+// NewNonceCache returns an empty NonceCache.
+func NewNonceCache(opts NonceCacheOptions) *NonceCache {
+	return &NonceCache{
+		opts: opts,
+
+		noncesMu: new(sync.Mutex),
+		nonces:   map[id.Signatory]map[[32]byte]time.Time{},
+	}
+}
+
+// Insert a nonce from a remote peer, and its timestamp, into the cache. An
+// error is returned if the timestamp is not within the clock skew window, if
+// the nonce has already been inserted for the remote peer, or if the cache is
+// full (see ErrNonceCacheFull). Nonces are only compared with those of the same
+// remote peer, because the remote peer signs its nonce together with its
+// recipient.
+func (cache *NonceCache) Insert(remote id.Signatory, nonce [32]byte, timestamp time.Time) error {
+	now := cache.opts.Now()
+	if timestamp.Before(now.Add(-cache.opts.MaxClockSkew)) || timestamp.After(now.Add(cache.opts.MaxClockSkew)) {
+		return ErrStaleTimestamp
+	}
+
+	cache.noncesMu.Lock()
+	defer cache.noncesMu.Unlock()
+
+	if _, ok := cache.nonces[remote][nonce]; ok {
+		return ErrReplayedNonce
+	}
+	if len(cache.nonces[remote]) >= cache.opts.MaxNoncesPerPeer {
+		cache.pruneRemote(remote, now)
+		if len(cache.nonces[remote]) >= cache.opts.MaxNoncesPerPeer {
+			return ErrNonceCacheFull
+		}
+	}
+	if cache.len >= cache.opts.Capacity {
+		cache.prune(now)
+		if cache.len >= cache.opts.Capacity {
+			return ErrNonceCacheFull
+		}
+	}
+	nonces, ok := cache.nonces[remote]
+	if !ok {
+		nonces = map[[32]byte]time.Time{}
+		cache.nonces[remote] = nonces
+	}
+	// Nonces can be forgotten once their timestamp is outside the window,
+	// because they will be rejected as stale instead.
+	nonces[nonce] = timestamp.Add(cache.opts.MaxClockSkew)
+	cache.len++
+	return nil
+}
+
+// Len returns the number of nonces in the cache, including those that have
+// expired but have not yet been pruned.
+func (cache *NonceCache) Len() int {
+	cache.noncesMu.Lock()
+	defer cache.noncesMu.Unlock()
+
+	return cache.len
+}
+
+func (cache *NonceCache) prune(now time.Time) {
+	for remote := range cache.nonces {
+		cache.pruneRemote(remote, now)
+	}
+}
+
+func (cache *NonceCache) pruneRemote(remote id.Signatory, now time.Time) {
+	nonces := cache.nonces[remote]
+	for nonce, expiry := range nonces {
+		if now.After(expiry) {
+			delete(nonces, nonce)
+			cache.len--
+		}
+	}
+	if len(nonces) == 0 {
+		delete(cache.nonces, remote)
+	}
+}
+
+// Fresh returns a Handshake that runs the wrapped Handshake, and then has both
+// peers prove that the session is new. Each peer sends the current time and a
+// random nonce, signed together with the identity of the remote peer, over the
+// encoder and decoder returned by the wrapped Handshake. The signature must be
+// from the remote peer identified by the wrapped Handshake, its timestamp must
+// be within the clock skew window, and its nonce must not be in the cache.
+// This means that captured handshake transcripts cannot be replayed to open an
+// authenticated session, even if the wrapped Handshake would allow it. Both
+// peers must use Fresh.
+func Fresh(signer Signer, cache *NonceCache, h Handshake) Handshake {
+	self := id.NewSignatory(signer.PubKey())
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+
+		nonce := [32]byte{}
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return nil, nil, remote, fmt.Errorf("generate nonce: %v", err)
+		}
+		timestamp := cache.opts.Now()
+		hash := freshHash(timestamp.UnixNano(), nonce, remote)
+		sig, err := signer.Sign(&hash)
+		if err != nil {
+			return nil, nil, remote, fmt.Errorf("sign nonce: %v", err)
+		}
+		msg := [freshMsgSize]byte{}
+		binary.BigEndian.PutUint64(msg[:8], uint64(timestamp.UnixNano()))
+		copy(msg[8:40], nonce[:])
+		copy(msg[40:], sig[:])
+
+		// Write concurrently, because both peers write before they read, and
+		// the network connection might not be buffered.
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := enc(conn, msg[:])
+			errCh <- err
+		}()
+		remoteMsg := [freshMsgSize + 128]byte{}
+		n, err := dec(conn, remoteMsg[:freshMsgSize])
+		if err != nil {
+			return nil, nil, remote, fmt.Errorf("decoding remote nonce: %v", err)
+		}
+		if n != freshMsgSize {
+			return nil, nil, remote, fmt.Errorf("decoding remote nonce: expected %v bytes, got %v bytes", freshMsgSize, n)
+		}
+		if err := <-errCh; err != nil {
+			return nil, nil, remote, fmt.Errorf("encoding local nonce: %v", err)
+		}
+
+		remoteTimestamp := int64(binary.BigEndian.Uint64(remoteMsg[:8]))
+		remoteNonce := [32]byte{}
+		copy(remoteNonce[:], remoteMsg[8:40])
+		remoteSig := id.Signature{}
+		copy(remoteSig[:], remoteMsg[40:freshMsgSize])
+		remoteHash := freshHash(remoteTimestamp, remoteNonce, self)
+		signatory, err := remoteSig.Signatory(&remoteHash)
+		if err != nil {
+			return nil, nil, remote, fmt.Errorf("verify remote nonce: %v", err)
+		}
+		if !signatory.Equal(&remote) {
+			return nil, nil, remote, fmt.Errorf("verify remote nonce: expected %v, got %v", remote, signatory)
+		}
+		if err := cache.Insert(remote, remoteNonce, time.Unix(0, remoteTimestamp)); err != nil {
+			return nil, nil, remote, fmt.Errorf("verify remote nonce from %v: %w", remote, err)
+		}
+		return enc, dec, remote, nil
+	}
+}
+
+// freshHash returns the hash that is signed by a peer to prove that a session
+// with the recipient is new.
+func freshHash(timestamp int64, nonce [32]byte, recipient id.Signatory) id.Hash {
+	h := sha256.New()
+	h.Write([]byte("aw fresh"))
+	binary.Write(h, binary.BigEndian, timestamp)
+	h.Write(nonce[:])
+	h.Write(recipient[:])
+	hash := id.Hash{}
+	h.Sum(hash[:0])
+	return hash
+}
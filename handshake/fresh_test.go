@@ -0,0 +1,168 @@
+package handshake_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// recordingConn records everything that is written to the network connection.
+type recordingConn struct {
+	net.Conn
+	written *bytes.Buffer
+}
+
+func (conn recordingConn) Write(p []byte) (int, error) {
+	conn.written.Write(p)
+	return conn.Conn.Write(p)
+}
+
+// tcpPipe returns both ends of a loopback TCP connection, which is buffered by
+// the operating system (unlike net.Pipe).
+func tcpPipe() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer listener.Close()
+	conn1, err := net.Dial("tcp", listener.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	conn2, err := listener.Accept()
+	Expect(err).ToNot(HaveOccurred())
+	return conn1, conn2
+}
+
+var _ = Describe("Fresh", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	run := func(h handshake.Handshake, conn net.Conn) <-chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, _, _, err := h(conn, enc, dec)
+			errs <- err
+		}()
+		return errs
+	}
+
+	Context("when both peers use the handshake", func() {
+		It("should identify both peers", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			cache1 := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions())
+			cache2 := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions())
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			h1 := handshake.Fresh(privKey1, cache1, handshake.ECIES(privKey1))
+			h2 := handshake.Fresh(privKey2, cache2, handshake.ECIES(privKey2))
+			errs1 := run(h1, conn1)
+			_, _, remote, err := h2(conn2, enc, dec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errs1).ToNot(HaveOccurred())
+			Expect(remote).To(Equal(privKey1.Signatory()))
+			Expect(cache1.Len()).To(Equal(1))
+			Expect(cache2.Len()).To(Equal(1))
+		})
+	})
+
+	Context("when a handshake transcript is replayed", func() {
+		It("should reject the replayed nonce", func() {
+			client := id.NewPrivKey()
+			server := id.NewPrivKey()
+			cache := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions())
+
+			// Record an honest handshake. The insecure handshake would
+			// accept the replayed transcript by itself.
+			conn1, conn2 := tcpPipe()
+			transcript := new(bytes.Buffer)
+			errs := run(handshake.Fresh(client, handshake.NewNonceCache(handshake.DefaultNonceCacheOptions()), handshake.Insecure(client.Signatory())), recordingConn{Conn: conn1, written: transcript})
+			_, _, _, err := handshake.Fresh(server, cache, handshake.Insecure(server.Signatory()))(conn2, enc, dec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errs).ToNot(HaveOccurred())
+			conn1.Close()
+			conn2.Close()
+
+			// Replay the transcript of the client.
+			conn1, conn2 = tcpPipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			go io.Copy(ioutil.Discard, conn1)
+			go conn1.Write(transcript.Bytes())
+			_, _, _, err = handshake.Fresh(server, cache, handshake.Insecure(server.Signatory()))(conn2, enc, dec)
+			Expect(errors.Is(err, handshake.ErrReplayedNonce)).To(BeTrue())
+		})
+	})
+
+	Context("when the clocks of the peers are too far apart", func() {
+		It("should reject the stale timestamp", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			cache1 := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions())
+			cache2 := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions().WithNow(func() time.Time {
+				return time.Now().Add(time.Minute)
+			}))
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			errs1 := run(handshake.Fresh(privKey1, cache1, handshake.ECIES(privKey1)), conn1)
+			_, _, _, err := handshake.Fresh(privKey2, cache2, handshake.ECIES(privKey2))(conn2, enc, dec)
+			Expect(errors.Is(err, handshake.ErrStaleTimestamp)).To(BeTrue())
+			Expect(errors.Is(<-errs1, handshake.ErrStaleTimestamp)).To(BeTrue())
+		})
+	})
+
+	Context("when the nonce cache is full", func() {
+		It("should reject nonces until old nonces expire", func() {
+			now := time.Now()
+			cache := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions().
+				WithMaxClockSkew(time.Second).
+				WithCapacity(2).
+				WithNow(func() time.Time { return now }))
+			remote1 := id.NewPrivKey().Signatory()
+			remote2 := id.NewPrivKey().Signatory()
+
+			Expect(cache.Insert(remote1, [32]byte{1}, now)).To(Succeed())
+			Expect(cache.Insert(remote1, [32]byte{1}, now)).To(MatchError(handshake.ErrReplayedNonce))
+			Expect(cache.Insert(remote2, [32]byte{2}, now)).To(Succeed())
+			Expect(cache.Insert(remote2, [32]byte{3}, now)).To(MatchError(handshake.ErrNonceCacheFull))
+
+			now = now.Add(2 * time.Second)
+			Expect(cache.Insert(remote1, [32]byte{1}, now.Add(-2*time.Second))).To(MatchError(handshake.ErrStaleTimestamp))
+			Expect(cache.Insert(remote2, [32]byte{3}, now)).To(Succeed())
+			Expect(cache.Len()).To(Equal(1))
+		})
+	})
+
+	Context("when a remote peer has too many nonces in the cache", func() {
+		It("should only reject the nonces of that remote peer", func() {
+			now := time.Now()
+			cache := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions().
+				WithMaxClockSkew(time.Second).
+				WithMaxNoncesPerPeer(2).
+				WithNow(func() time.Time { return now }))
+			remote1 := id.NewPrivKey().Signatory()
+			remote2 := id.NewPrivKey().Signatory()
+
+			Expect(cache.Insert(remote1, [32]byte{1}, now)).To(Succeed())
+			Expect(cache.Insert(remote1, [32]byte{2}, now)).To(Succeed())
+			Expect(cache.Insert(remote1, [32]byte{3}, now)).To(MatchError(handshake.ErrNonceCacheFull))
+			Expect(cache.Insert(remote2, [32]byte{1}, now)).To(Succeed())
+			Expect(cache.Insert(remote2, [32]byte{3}, now)).To(Succeed())
+
+			now = now.Add(2 * time.Second)
+			Expect(cache.Insert(remote1, [32]byte{3}, now)).To(Succeed())
+			Expect(cache.Len()).To(Equal(3))
+		})
+	})
+})
@@ -0,0 +1,143 @@
+package handshake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+var DefaultMembershipTimeout = 5 * time.Second
+
+var (
+	// ErrNotMember is returned when the remote peer is not a member of the
+	// group.
+	ErrNotMember = errors.New("remote peer is not a member")
+	// ErrMembershipRejected is returned when the remote peer does not consider
+	// the local peer to be a member of the group.
+	ErrMembershipRejected = errors.New("local peer is not a member of the remote peer's group")
+)
+
+// Membership of a group of peers (for example, a dynamic validator set). It
+// might need to query a remote service, so it accepts a context.
+type Membership interface {
+	IsMember(ctx context.Context, signatory id.Signatory) (bool, error)
+}
+
+// MembershipFunc is a function that implements the Membership interface.
+type MembershipFunc func(ctx context.Context, signatory id.Signatory) (bool, error)
+
+// IsMember implements the Membership interface.
+func (f MembershipFunc) IsMember(ctx context.Context, signatory id.Signatory) (bool, error) {
+	return f(ctx, signatory)
+}
+
+// CachedMembership wraps a Membership, and caches its results until the epoch
+// changes (see SetEpoch). Errors are not cached. It is safe for concurrent
+// use.
+type CachedMembership struct {
+	membership Membership
+
+	membersMu *sync.Mutex
+	epoch     uint64
+	members   map[id.Signatory]bool
+}
+
+// NewCachedMembership returns a CachedMembership at epoch zero.
+func NewCachedMembership(membership Membership) *CachedMembership {
+	return &CachedMembership{
+		membership: membership,
+
+		membersMu: new(sync.Mutex),
+		epoch:     0,
+		members:   map[id.Signatory]bool{},
+	}
+}
+
+// IsMember implements the Membership interface.
+func (cache *CachedMembership) IsMember(ctx context.Context, signatory id.Signatory) (bool, error) {
+	cache.membersMu.Lock()
+	epoch := cache.epoch
+	isMember, ok := cache.members[signatory]
+	cache.membersMu.Unlock()
+	if ok {
+		return isMember, nil
+	}
+
+	isMember, err := cache.membership.IsMember(ctx, signatory)
+	if err != nil {
+		return false, err
+	}
+
+	cache.membersMu.Lock()
+	defer cache.membersMu.Unlock()
+
+	// Only cache the result if the epoch has not changed while waiting for
+	// it, because it might be from the previous epoch.
+	if cache.epoch == epoch {
+		cache.members[signatory] = isMember
+	}
+	return isMember, nil
+}
+
+// SetEpoch sets the current epoch. If it is different from the previous
+// epoch, all cached results are forgotten.
+func (cache *CachedMembership) SetEpoch(epoch uint64) {
+	cache.membersMu.Lock()
+	defer cache.membersMu.Unlock()
+
+	if cache.epoch != epoch {
+		cache.epoch = epoch
+		cache.members = map[id.Signatory]bool{}
+	}
+}
+
+// Epoch returns the current epoch.
+func (cache *CachedMembership) Epoch() uint64 {
+	cache.membersMu.Lock()
+	defer cache.membersMu.Unlock()
+
+	return cache.epoch
+}
+
+// RequireMembership returns a Handshake that runs the wrapped Handshake, and
+// then checks that the remote peer is a member of the group, waiting at most
+// the timeout. Both peers then tell each other whether they accept the other,
+// so that the handshake fails on both sides if either peer is not a member of
+// the other's group. Both peers must use RequireMembership.
+func RequireMembership(membership Membership, timeout time.Duration, h Handshake) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		isMember, err := membership.IsMember(ctx, remote)
+		cancel()
+		if err != nil {
+			return nil, nil, remote, fmt.Errorf("checking membership of %v: %v", remote, err)
+		}
+
+		verdict := [1]byte{}
+		if isMember {
+			verdict[0] = 1
+		}
+		remoteVerdict := [1]byte{}
+		if err := exchange(conn, enc, dec, verdict[:], remoteVerdict[:]); err != nil {
+			return nil, nil, remote, fmt.Errorf("exchange membership: %v", err)
+		}
+		if !isMember {
+			return nil, nil, remote, fmt.Errorf("checking membership of %v: %w", remote, ErrNotMember)
+		}
+		if remoteVerdict[0] != 1 {
+			return nil, nil, remote, fmt.Errorf("checking membership with %v: %w", remote, ErrMembershipRejected)
+		}
+		return enc, dec, remote, nil
+	}
+}
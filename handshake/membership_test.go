@@ -0,0 +1,124 @@
+package handshake_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Membership", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	run := func(h1, h2 handshake.Handshake) (error, error) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+		errs := make(chan error, 1)
+		go func() {
+			_, _, _, err := h1(conn1, enc, dec)
+			conn1.Close()
+			errs <- err
+		}()
+		_, _, _, err := h2(conn2, enc, dec)
+		conn2.Close()
+		return <-errs, err
+	}
+
+	members := func(signatories ...id.Signatory) handshake.MembershipFunc {
+		return func(ctx context.Context, signatory id.Signatory) (bool, error) {
+			for _, member := range signatories {
+				if member.Equal(&signatory) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+
+	Context("when both peers are members", func() {
+		It("should complete the handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			membership := members(privKey1.Signatory(), privKey2.Signatory())
+			err1, err2 := run(
+				handshake.RequireMembership(membership, time.Second, handshake.ECIES(privKey1)),
+				handshake.RequireMembership(membership, time.Second, handshake.ECIES(privKey2)),
+			)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when one peer is not a member", func() {
+		It("should fail the handshake on both sides", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			membership := members(privKey2.Signatory())
+			err1, err2 := run(
+				handshake.RequireMembership(membership, time.Second, handshake.ECIES(privKey1)),
+				handshake.RequireMembership(membership, time.Second, handshake.ECIES(privKey2)),
+			)
+			Expect(errors.Is(err1, handshake.ErrMembershipRejected)).To(BeTrue())
+			Expect(errors.Is(err2, handshake.ErrNotMember)).To(BeTrue())
+		})
+	})
+
+	Context("when membership cannot be checked", func() {
+		It("should fail the handshake once the timeout has passed", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			slow := handshake.MembershipFunc(func(ctx context.Context, signatory id.Signatory) (bool, error) {
+				<-ctx.Done()
+				return false, ctx.Err()
+			})
+			err1, err2 := run(
+				handshake.RequireMembership(members(privKey2.Signatory()), time.Second, handshake.ECIES(privKey1)),
+				handshake.RequireMembership(slow, 10*time.Millisecond, handshake.ECIES(privKey2)),
+			)
+			Expect(err1).To(HaveOccurred())
+			Expect(err2).To(MatchError(ContainSubstring("deadline exceeded")))
+		})
+	})
+
+	Context("when caching membership", func() {
+		It("should only forget results when the epoch changes", func() {
+			signatory := id.NewPrivKey().Signatory()
+			calls := int64(0)
+			isMember := int64(1)
+			cache := handshake.NewCachedMembership(handshake.MembershipFunc(func(ctx context.Context, signatory id.Signatory) (bool, error) {
+				atomic.AddInt64(&calls, 1)
+				return atomic.LoadInt64(&isMember) == 1, nil
+			}))
+
+			for i := 0; i < 3; i++ {
+				ok, err := cache.IsMember(context.Background(), signatory)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+			}
+			Expect(atomic.LoadInt64(&calls)).To(Equal(int64(1)))
+
+			atomic.StoreInt64(&isMember, 0)
+			cache.SetEpoch(0)
+			ok, err := cache.IsMember(context.Background(), signatory)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			cache.SetEpoch(1)
+			Expect(cache.Epoch()).To(Equal(uint64(1)))
+			ok, err = cache.IsMember(context.Background(), signatory)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(atomic.LoadInt64(&calls)).To(Equal(int64(2)))
+		})
+	})
+})
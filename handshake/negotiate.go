@@ -0,0 +1,226 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// maxCipherSuites is the maximum number of cipher suites that can be sent
+// during negotiation. Lists of cipher suites are padded to this size, so that
+// they can be decoded without a length prefix.
+const maxCipherSuites = 8
+
+// maxVersions is the maximum number of wire versions that can be sent during
+// negotiation. Lists of wire versions are padded to this size.
+const maxVersions = 8
+
+// negotiationMsgSize is the size of a list of cipher suites, followed by a
+// list of wire versions.
+const negotiationMsgSize = maxCipherSuites + 2*maxVersions
+
+var (
+	// ErrNoCommonCipherSuite is returned when the local and remote peers do
+	// not support any of the same cipher suites.
+	ErrNoCommonCipherSuite = errors.New("no common cipher suite")
+	// ErrNoCommonVersion is returned when the local and remote peers both
+	// support wire versions, but not any of the same wire versions.
+	ErrNoCommonVersion = errors.New("no common wire version")
+)
+
+// A VersionTable stores the wire version negotiated with each remote peer. It
+// is safe for concurrent use, and should be shared by all handshakes of a
+// peer.
+type VersionTable struct {
+	versionsMu *sync.Mutex
+	versions   map[id.Signatory]uint16
+}
+
+// NewVersionTable returns an empty VersionTable.
+func NewVersionTable() *VersionTable {
+	return &VersionTable{
+		versionsMu: new(sync.Mutex),
+		versions:   map[id.Signatory]uint16{},
+	}
+}
+
+// Version returns the wire version negotiated with a remote peer, or zero if
+// no wire version has been negotiated. It can be used as the
+// channel.WireVersionSelector of a Client, so that messages are sent using the
+// negotiated wire version.
+//
+//	opts.WithWireVersionSelector(table.Version)
+func (table *VersionTable) Version(remote id.Signatory) uint16 {
+	table.versionsMu.Lock()
+	defer table.versionsMu.Unlock()
+
+	return table.versions[remote]
+}
+
+func (table *VersionTable) insert(remote id.Signatory, version uint16) {
+	table.versionsMu.Lock()
+	defer table.versionsMu.Unlock()
+
+	if version == 0 {
+		delete(table.versions, remote)
+		return
+	}
+	table.versions[remote] = version
+}
+
+// establish the session with a remote peer, once both peers have agreed on a
+// key, and return its encoder and decoder. If there are cipher suites in the
+// Options, then the cipher suite and wire version of the session are
+// negotiated using an AES-GCM session with the key, and the negotiated wire
+// version is stored in the VersionTable of the Options. Otherwise, the session
+// uses AES-GCM with the key.
+func establish(conn net.Conn, key [32]byte, self, remote id.Signatory, enc codec.Encoder, dec codec.Decoder, opts Options) (codec.Encoder, codec.Decoder, error) {
+	gcmSession, err := codec.NewGCMSession(key, self, remote)
+	if err != nil {
+		return nil, nil, fmt.Errorf("establish gcm session: %v", err)
+	}
+	if opts.CipherSuites == nil {
+		return codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), nil
+	}
+
+	n, err := negotiate(conn, codec.GCMEncoder(gcmSession, enc), codec.GCMDecoder(gcmSession, dec), self, remote, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("negotiate: %w", err)
+	}
+	session, err := codec.NewGCMSessionWithCipherSuite(sessionKey(key, n), self, remote, n.suite)
+	if err != nil {
+		return nil, nil, fmt.Errorf("establish %v session: %v", n.suite, err)
+	}
+	enc, dec = codec.GCMEncoder(session, enc), codec.GCMDecoder(session, dec)
+	if err := confirm(conn, enc, dec, n.transcript); err != nil {
+		return nil, nil, fmt.Errorf("confirm session: %v", err)
+	}
+	if opts.VersionTable != nil {
+		opts.VersionTable.insert(remote, n.version)
+	}
+	return enc, dec, nil
+}
+
+// negotiation is the outcome of negotiating with a remote peer.
+type negotiation struct {
+	suite   codec.CipherSuite
+	version uint16
+	// transcript is the hash of the negotiation messages of both peers.
+	transcript [32]byte
+}
+
+// negotiate sends the local cipher suites and wire versions to the remote
+// peer, and receives those of the remote peer, using the encoder and decoder of
+// an authenticated session. Both peers select the most preferred cipher suite,
+// of the peer with the lower signatory, that is supported by both peers, and
+// the highest wire version that is supported by both peers.
+func negotiate(conn net.Conn, enc codec.Encoder, dec codec.Decoder, self, remote id.Signatory, opts Options) (negotiation, error) {
+	if len(opts.CipherSuites) == 0 || len(opts.CipherSuites) > maxCipherSuites {
+		return negotiation{}, fmt.Errorf("expected between 1 and %v cipher suites, got %v", maxCipherSuites, len(opts.CipherSuites))
+	}
+	if len(opts.Versions) > maxVersions {
+		return negotiation{}, fmt.Errorf("expected at most %v wire versions, got %v", maxVersions, len(opts.Versions))
+	}
+	msg := [negotiationMsgSize]byte{}
+	for i, suite := range opts.CipherSuites {
+		msg[i] = byte(suite)
+	}
+	for i, version := range opts.Versions {
+		binary.BigEndian.PutUint16(msg[maxCipherSuites+2*i:], version)
+	}
+
+	remoteMsg := [negotiationMsgSize]byte{}
+	if err := exchange(conn, enc, dec, msg[:], remoteMsg[:]); err != nil {
+		return negotiation{}, err
+	}
+
+	// Order the messages by signatory, so that both peers agree on which
+	// preferences to follow, and on the transcript.
+	lower, higher := msg[:], remoteMsg[:]
+	if bytes.Compare(remote[:], self[:]) < 0 {
+		lower, higher = higher, lower
+	}
+	n := negotiation{transcript: negotiationTranscript(lower, higher)}
+
+	for _, suite := range lower[:maxCipherSuites] {
+		if suite != byte(codec.CipherSuiteNone) && bytes.IndexByte(higher[:maxCipherSuites], suite) >= 0 {
+			n.suite = codec.CipherSuite(suite)
+			break
+		}
+	}
+	if n.suite == codec.CipherSuiteNone {
+		return negotiation{}, ErrNoCommonCipherSuite
+	}
+
+	lowerVersions := versionsOf(lower[maxCipherSuites:])
+	higherVersions := versionsOf(higher[maxCipherSuites:])
+	for version := range lowerVersions {
+		if higherVersions[version] && version > n.version {
+			n.version = version
+		}
+	}
+	if n.version == 0 && len(lowerVersions) > 0 && len(higherVersions) > 0 {
+		return negotiation{}, ErrNoCommonVersion
+	}
+	return n, nil
+}
+
+// versionsOf returns the set of wire versions in a padded list of wire
+// versions.
+func versionsOf(buf []byte) map[uint16]bool {
+	versions := map[uint16]bool{}
+	for i := 0; i+1 < len(buf); i += 2 {
+		if version := binary.BigEndian.Uint16(buf[i:]); version != 0 {
+			versions[version] = true
+		}
+	}
+	return versions
+}
+
+func negotiationTranscript(lower, higher []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("aw negotiation"))
+	h.Write(lower)
+	h.Write(higher)
+	transcript := [32]byte{}
+	h.Sum(transcript[:0])
+	return transcript
+}
+
+// sessionKey derives the key of the session that uses the negotiated cipher
+// suite. The transcript of the negotiation is bound into the key, so if the
+// negotiation messages of either peer were tampered with (for example, to
+// downgrade the wire version), the peers would derive different keys, and
+// would not be able to decrypt each other's messages. It also ensures that
+// keys are never used with more than one AEAD.
+func sessionKey(key [32]byte, n negotiation) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("aw cipher suite"))
+	h.Write([]byte{byte(n.suite)})
+	h.Write(n.transcript[:])
+	h.Write(key[:])
+	derived := [32]byte{}
+	h.Sum(derived[:0])
+	return derived
+}
+
+// confirm that both peers derived the same session, by sending the transcript
+// using the encoder of the session, and receiving the transcript of the remote
+// peer using the decoder of the session.
+func confirm(conn net.Conn, enc codec.Encoder, dec codec.Decoder, transcript [32]byte) error {
+	remoteTranscript := [32]byte{}
+	if err := exchange(conn, enc, dec, transcript[:], remoteTranscript[:]); err != nil {
+		return err
+	}
+	if transcript != remoteTranscript {
+		return fmt.Errorf("transcripts do not match")
+	}
+	return nil
+}
@@ -0,0 +1,487 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+	"golang.org/x/crypto/curve25519"
+)
+
+// noiseProtocolName identifies the Noise protocol (see
+// https://noiseprotocol.org/noise.html). It is mixed into the handshake, so
+// that peers using different protocols never agree on keys.
+const noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+
+// noisePrologue is mixed into the handshake, so that the keys of aw peers are
+// not confused with the keys of other applications that use the same Noise
+// protocol.
+const noisePrologue = "aw"
+
+// noiseMaxMsgSize is the maximum size of a Noise message.
+const noiseMaxMsgSize = 65535
+
+// ErrNoiseSimultaneousKeys is returned when the local and remote peers choose
+// the same ephemeral key, which only happens when a peer is connected to
+// itself (or an attacker is reflecting its messages).
+var ErrNoiseSimultaneousKeys = errors.New("noise: remote ephemeral key is the local ephemeral key")
+
+// NoiseXX returns a Handshake that uses the Noise XX pattern, with X25519,
+// AES-GCM, and SHA-256. Unlike ECIES, the keys of a session are derived from
+// ephemeral keys, so recorded sessions cannot be decrypted even if the private
+// keys of the peers are later compromised (forward secrecy).
+//
+// Noise authenticates the static X25519 keys of the peers, but peers are
+// identified by their secp256k1 keys, so each peer also signs the hash of the
+// handshake with its private key. The signature is sent as the (encrypted)
+// payload of its static key, and the remote peer is identified by recovering
+// the signatory of the signature. Signing the hash binds the identity of each
+// peer to this handshake, so signatures cannot be replayed. The private key
+// can be kept outside of the process (see Signer).
+//
+// Handshakes are symmetric (both peers run the same function, without knowing
+// which of them dialed), but Noise needs an initiator and a responder. Both
+// peers begin by sending their ephemeral keys, which is the first message of
+// the XX pattern, and the peer with the lower ephemeral key becomes the
+// initiator.
+func NoiseXX(signer Signer) Handshake {
+	static := newNoiseKeyPair()
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		ephemeral := newNoiseKeyPair()
+		if ephemeral.err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate ephemeral key: %v", ephemeral.err)
+		}
+		if static.err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate static key: %v", static.err)
+		}
+
+		// Exchange ephemeral keys. Writing happens in the background, because
+		// writing might wait until the remote peer reads.
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(ephemeral.pub[:])
+			errCh <- err
+		}()
+		remoteEphemeral := [32]byte{}
+		if _, err := io.ReadFull(conn, remoteEphemeral[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("read remote ephemeral key: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("write local ephemeral key: %v", err)
+		}
+		cmp := bytes.Compare(ephemeral.pub[:], remoteEphemeral[:])
+		if cmp == 0 {
+			return nil, nil, id.Signatory{}, ErrNoiseSimultaneousKeys
+		}
+		initiator := cmp < 0
+
+		hs := noiseHandshakeState{
+			signer:          signer,
+			static:          static,
+			ephemeral:       ephemeral,
+			remoteEphemeral: remoteEphemeral,
+		}
+		hs.init(initiator)
+
+		var remote id.Signatory
+		var err error
+		if initiator {
+			remote, err = hs.initiate(conn)
+		} else {
+			remote, err = hs.respond(conn)
+		}
+		if err != nil {
+			return nil, nil, id.Signatory{}, err
+		}
+
+		// The first key encrypts messages from the initiator to the responder,
+		// and the second key encrypts messages the other way.
+		k1, k2 := hs.split()
+		write, read := k1, k2
+		if !initiator {
+			write, read = k2, k1
+		}
+		writeCipher, err := newNoiseCipherState(write)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("establish noise session: %v", err)
+		}
+		readCipher, err := newNoiseCipherState(read)
+		if err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("establish noise session: %v", err)
+		}
+		counters := new(codec.SessionCounters)
+		return noiseEncoder(writeCipher, counters, enc), noiseDecoder(readCipher, counters, dec), remote, nil
+	}
+}
+
+// noiseKeyPair is an X25519 key pair.
+type noiseKeyPair struct {
+	priv [32]byte
+	pub  [32]byte
+	err  error
+}
+
+func newNoiseKeyPair() noiseKeyPair {
+	kp := noiseKeyPair{}
+	if _, kp.err = rand.Read(kp.priv[:]); kp.err != nil {
+		return kp
+	}
+	pub, err := curve25519.X25519(kp.priv[:], curve25519.Basepoint)
+	if err != nil {
+		kp.err = err
+		return kp
+	}
+	copy(kp.pub[:], pub)
+	return kp
+}
+
+func (kp noiseKeyPair) dh(pub []byte) ([]byte, error) {
+	return curve25519.X25519(kp.priv[:], pub)
+}
+
+// noiseHandshakeState is the state of the XX pattern after the ephemeral keys
+// have been exchanged.
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+type noiseHandshakeState struct {
+	signer          Signer
+	static          noiseKeyPair
+	ephemeral       noiseKeyPair
+	remoteEphemeral [32]byte
+
+	ck [32]byte
+	h  [32]byte
+	cs *noiseCipherState
+}
+
+// init the symmetric state, and process the first message of the XX pattern
+// (which is the ephemeral key of the initiator).
+func (hs *noiseHandshakeState) init(initiator bool) {
+	copy(hs.h[:], noiseProtocolName)
+	hs.ck = hs.h
+	hs.mixHash([]byte(noisePrologue))
+	if initiator {
+		hs.mixHash(hs.ephemeral.pub[:])
+	} else {
+		hs.mixHash(hs.remoteEphemeral[:])
+	}
+	hs.mixHash(nil)
+}
+
+// initiate processes the second message, and writes the third message.
+func (hs *noiseHandshakeState) initiate(conn net.Conn) (id.Signatory, error) {
+	msg, err := readNoiseMsg(conn)
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("read noise message: %v", err)
+	}
+	hs.mixHash(hs.remoteEphemeral[:])
+	if err := hs.mixDH(hs.ephemeral, hs.remoteEphemeral[:]); err != nil {
+		return id.Signatory{}, err
+	}
+	remoteStatic, msg, err := hs.decryptAndHash(msg, 32)
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("decrypt remote static key: %v", err)
+	}
+	if err := hs.mixDH(hs.ephemeral, remoteStatic); err != nil {
+		return id.Signatory{}, err
+	}
+	remote, err := hs.readIdentity(msg)
+	if err != nil {
+		return id.Signatory{}, err
+	}
+
+	msg = hs.encryptAndHash(nil, hs.static.pub[:])
+	if err := hs.mixDH(hs.static, hs.remoteEphemeral[:]); err != nil {
+		return id.Signatory{}, err
+	}
+	if msg, err = hs.writeIdentity(msg); err != nil {
+		return id.Signatory{}, err
+	}
+	if err := writeNoiseMsg(conn, msg); err != nil {
+		return id.Signatory{}, fmt.Errorf("write noise message: %v", err)
+	}
+	return remote, nil
+}
+
+// respond writes the second message, and processes the third message.
+func (hs *noiseHandshakeState) respond(conn net.Conn) (id.Signatory, error) {
+	hs.mixHash(hs.ephemeral.pub[:])
+	if err := hs.mixDH(hs.ephemeral, hs.remoteEphemeral[:]); err != nil {
+		return id.Signatory{}, err
+	}
+	msg := hs.encryptAndHash(nil, hs.static.pub[:])
+	if err := hs.mixDH(hs.static, hs.remoteEphemeral[:]); err != nil {
+		return id.Signatory{}, err
+	}
+	msg, err := hs.writeIdentity(msg)
+	if err != nil {
+		return id.Signatory{}, err
+	}
+	if err := writeNoiseMsg(conn, msg); err != nil {
+		return id.Signatory{}, fmt.Errorf("write noise message: %v", err)
+	}
+
+	if msg, err = readNoiseMsg(conn); err != nil {
+		return id.Signatory{}, fmt.Errorf("read noise message: %v", err)
+	}
+	remoteStatic, msg, err := hs.decryptAndHash(msg, 32)
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("decrypt remote static key: %v", err)
+	}
+	if err := hs.mixDH(hs.ephemeral, remoteStatic); err != nil {
+		return id.Signatory{}, err
+	}
+	return hs.readIdentity(msg)
+}
+
+// writeIdentity appends the encrypted signature of the handshake hash to the
+// message.
+func (hs *noiseHandshakeState) writeIdentity(msg []byte) ([]byte, error) {
+	hash := id.Hash(hs.h)
+	sig, err := hs.signer.Sign(&hash)
+	if err != nil {
+		return nil, fmt.Errorf("sign handshake: %v", err)
+	}
+	return hs.encryptAndHash(msg, sig[:]), nil
+}
+
+// readIdentity decrypts the signature of the handshake hash from the rest of
+// the message, and returns its signatory.
+func (hs *noiseHandshakeState) readIdentity(msg []byte) (id.Signatory, error) {
+	hash := id.Hash(hs.h)
+	sigBytes, rest, err := hs.decryptAndHash(msg, len(id.Signature{}))
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("decrypt remote signature: %v", err)
+	}
+	if len(rest) != 0 {
+		return id.Signatory{}, fmt.Errorf("decrypt remote signature: %v unexpected bytes", len(rest))
+	}
+	sig := id.Signature{}
+	copy(sig[:], sigBytes)
+	remote, err := sig.Signatory(&hash)
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("verify remote signature: %v", err)
+	}
+	return remote, nil
+}
+
+func (hs *noiseHandshakeState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(hs.h[:])
+	h.Write(data)
+	h.Sum(hs.h[:0])
+}
+
+func (hs *noiseHandshakeState) mixKey(input []byte) error {
+	var k [32]byte
+	hs.ck, k = noiseHKDF(hs.ck[:], input)
+	cs, err := newNoiseCipherState(k)
+	if err != nil {
+		return err
+	}
+	hs.cs = cs
+	return nil
+}
+
+func (hs *noiseHandshakeState) mixDH(kp noiseKeyPair, pub []byte) error {
+	shared, err := kp.dh(pub)
+	if err != nil {
+		return fmt.Errorf("compute shared secret: %v", err)
+	}
+	return hs.mixKey(shared)
+}
+
+// encryptAndHash appends the encrypted plaintext to the message.
+func (hs *noiseHandshakeState) encryptAndHash(msg, plaintext []byte) []byte {
+	ciphertext := hs.cs.seal(nil, hs.h[:], plaintext)
+	hs.mixHash(ciphertext)
+	return append(msg, ciphertext...)
+}
+
+// decryptAndHash decrypts the plaintext of the given size from the beginning
+// of the message, and returns it together with the rest of the message.
+func (hs *noiseHandshakeState) decryptAndHash(msg []byte, size int) ([]byte, []byte, error) {
+	size += noiseTagSize
+	if len(msg) < size {
+		return nil, nil, fmt.Errorf("expected %v bytes, got %v bytes", size, len(msg))
+	}
+	plaintext, err := hs.cs.open(nil, hs.h[:], msg[:size])
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.mixHash(msg[:size])
+	return plaintext, msg[size:], nil
+}
+
+func (hs *noiseHandshakeState) split() ([32]byte, [32]byte) {
+	return noiseHKDF(hs.ck[:], nil)
+}
+
+// noiseHKDF derives two keys (see the HKDF function of the Noise
+// specification).
+func noiseHKDF(ck, input []byte) ([32]byte, [32]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(input)
+	prk := mac.Sum(nil)
+
+	var out1, out2 [32]byte
+	mac = hmac.New(sha256.New, prk)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+	return out1, out2
+}
+
+// noiseTagSize is the size of the authentication tag of AES-GCM.
+const noiseTagSize = 16
+
+// noiseCipherState encrypts messages with AES-GCM, using a counter as the
+// nonce.
+type noiseCipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipherState(key [32]byte) (*noiseCipherState, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm cipher: %v", err)
+	}
+	return &noiseCipherState{aead: aead}, nil
+}
+
+func (cs *noiseCipherState) nonce() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], cs.n)
+	cs.n++
+	return nonce
+}
+
+// rekey replaces the key with the first 32 bytes of the encryption of 32
+// zeros, using the maximum nonce (see the REKEY function of the Noise
+// specification). The nonce counter is not reset.
+func (cs *noiseCipherState) rekey() error {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], math.MaxUint64)
+	key := [32]byte{}
+	copy(key[:], cs.aead.Seal(nil, nonce, make([]byte, 32), nil))
+	next, err := newNoiseCipherState(key)
+	if err != nil {
+		return err
+	}
+	cs.aead = next.aead
+	return nil
+}
+
+func (cs *noiseCipherState) seal(dst, ad, plaintext []byte) []byte {
+	return cs.aead.Seal(dst, cs.nonce(), plaintext, ad)
+}
+
+func (cs *noiseCipherState) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	return cs.aead.Open(dst, cs.nonce(), ciphertext, ad)
+}
+
+// noiseEncoder wraps an encoder so that data is encrypted before it is
+// encoded.
+func noiseEncoder(cs *noiseCipherState, counters *codec.SessionCounters, enc codec.Encoder) codec.Encoder {
+	stats := func() codec.SessionStats { return counters.Stats(codec.CipherSuiteAESGCM) }
+	return func(w io.Writer, buf []byte) (int, error) {
+		if codec.AcceptStats(w, stats) {
+			return 0, nil
+		}
+		if codec.AcceptRekey(w) {
+			if err := cs.rekey(); err != nil {
+				return 0, err
+			}
+			counters.RekeyedEncoder()
+			return 0, nil
+		}
+		if _, err := enc(w, cs.seal(nil, nil, buf)); err != nil {
+			return 0, fmt.Errorf("encoding sealed data: %v", err)
+		}
+		counters.Encrypted(len(buf))
+		return len(buf), nil
+	}
+}
+
+// noiseDecoder wraps a decoder so that data is decrypted after it is decoded.
+// Like codec.GCMDecoder, the capacity of the buffer must leave room for the
+// authentication tag.
+func noiseDecoder(cs *noiseCipherState, counters *codec.SessionCounters, dec codec.Decoder) codec.Decoder {
+	return func(r io.Reader, buf []byte) (int, error) {
+		if codec.AcceptRekey(r) {
+			if err := cs.rekey(); err != nil {
+				return 0, err
+			}
+			counters.RekeyedDecoder()
+			return 0, nil
+		}
+		extendedSize := len(buf) + noiseTagSize
+		if cap(buf) < extendedSize {
+			return 0, fmt.Errorf("decoding data: buffer too small, expected buffer capacity %v, got buffer capacity %v", extendedSize, cap(buf))
+		}
+		buf = buf[:extendedSize]
+		n, err := dec(r, buf)
+		if err != nil {
+			return n, fmt.Errorf("decoding data: %v", err)
+		}
+		// The sealed data is opened in-place, and it is cleared if it cannot
+		// be opened, so its header is kept beforehand.
+		header := [codec.MaxHeaderSize]byte{}
+		copy(header[:], buf[:n])
+		decrypted, err := cs.open(buf[:0], nil, buf[:n])
+		if err != nil {
+			sealed := header[:]
+			if n < len(sealed) {
+				sealed = sealed[:n]
+			}
+			return 0, fmt.Errorf("opening sealed data: %w", codec.NewAuthenticationError(sealed, err))
+		}
+		counters.Decrypted(len(decrypted))
+		return len(decrypted), nil
+	}
+}
+
+func writeNoiseMsg(conn net.Conn, msg []byte) error {
+	if len(msg) > noiseMaxMsgSize {
+		return fmt.Errorf("message too large: %v bytes", len(msg))
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func readNoiseMsg(conn net.Conn) ([]byte, error) {
+	prefix := [2]byte{}
+	if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
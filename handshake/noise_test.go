@@ -0,0 +1,109 @@
+package handshake_test
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Noise XX", func() {
+	type result struct {
+		enc    codec.Encoder
+		dec    codec.Decoder
+		remote id.Signatory
+		err    error
+	}
+
+	run := func(h handshake.Handshake, conn net.Conn) <-chan result {
+		results := make(chan result, 1)
+		go func() {
+			enc, dec, remote, err := h(conn, codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder), codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder))
+			results <- result{enc, dec, remote, err}
+		}()
+		return results
+	}
+
+	Context("when both peers use the handshake", func() {
+		It("should identify both peers, and encrypt messages in both directions", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			results1 := run(handshake.NoiseXX(privKey1), conn1)
+			results2 := run(handshake.NoiseXX(privKey2), conn2)
+			r1, r2 := <-results1, <-results2
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+			Expect(r1.remote).To(Equal(privKey2.Signatory()))
+			Expect(r2.remote).To(Equal(privKey1.Signatory()))
+
+			for i := 0; i < 10; i++ {
+				roundTrip(r1.enc, conn1, r2.dec, conn2)
+				roundTrip(r2.enc, conn2, r1.dec, conn1)
+			}
+		})
+	})
+
+	Context("when messages are tampered with", func() {
+		It("should fail to decode them", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			results1 := run(handshake.NoiseXX(id.NewPrivKey()), conn1)
+			results2 := run(handshake.NoiseXX(id.NewPrivKey()), conn2)
+			r1, r2 := <-results1, <-results2
+			Expect(r1.err).ToNot(HaveOccurred())
+			Expect(r2.err).ToNot(HaveOccurred())
+
+			sealed := new(bytes.Buffer)
+			_, err := r1.enc(sealed, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			tampered := sealed.Bytes()
+			tampered[len(tampered)-1] ^= 1
+
+			buf := make([]byte, 5, 5+16)
+			_, err = r2.dec(bytes.NewReader(tampered), buf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the remote peer uses a different handshake", func() {
+		It("should fail", func() {
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			Expect(conn1.SetDeadline(time.Now().Add(time.Second))).To(Succeed())
+			Expect(conn2.SetDeadline(time.Now().Add(time.Second))).To(Succeed())
+
+			results1 := run(handshake.NoiseXX(id.NewPrivKey()), conn1)
+			results2 := run(handshake.ECIES(id.NewPrivKey()), conn2)
+			Expect((<-results1).err).To(HaveOccurred())
+			Expect((<-results2).err).To(HaveOccurred())
+		})
+	})
+})
+
+// roundTrip encodes a message to one network connection, and decodes it from
+// the other.
+func roundTrip(enc codec.Encoder, encConn net.Conn, dec codec.Decoder, decConn net.Conn) {
+	msg := []byte("hello")
+	go func() {
+		defer GinkgoRecover()
+		_, err := enc(encConn, msg)
+		Expect(err).ToNot(HaveOccurred())
+	}()
+	buf := make([]byte, len(msg), len(msg)+16)
+	n, err := dec(decConn, buf)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(buf[:n]).To(Equal(msg))
+}
@@ -50,6 +50,20 @@ func NewOncePool(opts OncePoolOptions) OncePool {
 	}
 }
 
+// Drop closes the connection that is being kept for a remote peer, if there is
+// one, and forgets about it. The next connection with the remote peer will be
+// kept, regardless of the minimum expiry age.
+func (pool *OncePool) Drop(remote id.Signatory) {
+	pool.connsMu.Lock()
+	defer pool.connsMu.Unlock()
+
+	if existingConn, ok := pool.conns[remote]; ok {
+		// Ignore the error, because we no longer need this connection.
+		_ = existingConn.conn.Close()
+		delete(pool.conns, remote)
+	}
+}
+
 func Once(self id.Signatory, pool *OncePool, h Handshake) Handshake {
 	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
 		enc, dec, remote, err := h(conn, enc, dec)
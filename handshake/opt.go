@@ -0,0 +1,67 @@
+package handshake
+
+import (
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/wire"
+)
+
+// DefaultCipherSuites are the cipher suites that are supported by default, in
+// order of preference.
+var DefaultCipherSuites = []codec.CipherSuite{
+	codec.CipherSuiteAESGCM,
+	codec.CipherSuiteChaCha20Poly1305,
+	codec.CipherSuiteXChaCha20Poly1305,
+}
+
+// DefaultVersions are the wire versions that are supported by default.
+var DefaultVersions = []uint16{
+	wire.MsgVersion1,
+	wire.MsgVersion2,
+	wire.MsgVersion3,
+	wire.MsgVersion4,
+	wire.MsgVersion5,
+}
+
+// Options for handshakes.
+type Options struct {
+	CipherSuites []codec.CipherSuite
+	Versions     []uint16
+	VersionTable *VersionTable
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{
+		CipherSuites: DefaultCipherSuites,
+		Versions:     DefaultVersions,
+		VersionTable: nil,
+	}
+}
+
+// WithCipherSuites sets the cipher suites that are supported, in order of
+// preference. The cipher suite of a session is the most preferred cipher
+// suite, of the peer with the lower signatory, that is supported by both
+// peers. Nodes without hardware support for AES should prefer
+// codec.CipherSuiteChaCha20Poly1305. At most 8 cipher suites can be
+// supported.
+func (opts Options) WithCipherSuites(suites ...codec.CipherSuite) Options {
+	opts.CipherSuites = suites
+	return opts
+}
+
+// WithVersions sets the wire versions that are supported. The wire version of
+// a session is the highest wire version that is supported by both peers. If
+// either peer does not support any wire versions, no wire version is
+// negotiated. At most 8 wire versions can be supported.
+func (opts Options) WithVersions(versions ...uint16) Options {
+	opts.Versions = versions
+	return opts
+}
+
+// WithVersionTable sets the VersionTable in which the wire version negotiated
+// with each remote peer is stored. By default, negotiated wire versions are
+// not stored.
+func (opts Options) WithVersionTable(table *VersionTable) Options {
+	opts.VersionTable = table
+	return opts
+}
@@ -0,0 +1,188 @@
+package handshake
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"sync/atomic"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+// DefaultMaxPuzzleDifficulty is the difficulty of the most difficult challenge
+// that will be solved by default. Solving it takes about 2^24 (16 million)
+// hashes.
+var DefaultMaxPuzzleDifficulty = uint8(24)
+
+var (
+	// ErrPuzzleTooDifficult is returned when the remote peer sends a
+	// challenge that is more difficult than the maximum difficulty.
+	ErrPuzzleTooDifficult = errors.New("puzzle too difficult")
+	// ErrPuzzleUnsolved is returned when the remote peer sends a solution
+	// that does not solve the challenge of the local peer.
+	ErrPuzzleUnsolved = errors.New("puzzle unsolved")
+	// ErrPuzzleMutual is returned when both peers demand work, in which case
+	// neither can solve the challenge of the other before its own challenge
+	// has been solved.
+	ErrPuzzleMutual = errors.New("puzzle demanded by both peers")
+)
+
+// A DifficultyPolicy returns the difficulty of the challenge sent to remote
+// peers, given the number of handshakes that are in progress (including the
+// handshake for which the difficulty is being chosen). The difficulty is the
+// number of leading zero bits that the solution must have, so each extra bit
+// doubles the expected work of the remote peer. Zero means no work.
+type DifficultyPolicy func(pending int) uint8
+
+// ConstantDifficulty returns a DifficultyPolicy that always returns the same
+// difficulty.
+func ConstantDifficulty(difficulty uint8) DifficultyPolicy {
+	return func(int) uint8 { return difficulty }
+}
+
+// ThresholdDifficulty returns a DifficultyPolicy that returns zero while the
+// number of handshakes in progress is at most the threshold, and the
+// difficulty otherwise. This allows peers to accept connections without any
+// work, until they are under load.
+func ThresholdDifficulty(threshold int, difficulty uint8) DifficultyPolicy {
+	return func(pending int) uint8 {
+		if pending > threshold {
+			return difficulty
+		}
+		return 0
+	}
+}
+
+// PuzzleOptions for parameterising the behaviour of a Puzzle handshake.
+type PuzzleOptions struct {
+	Difficulty    DifficultyPolicy
+	MaxDifficulty uint8
+}
+
+// DefaultPuzzleOptions returns PuzzleOptions that demand no work, and solve
+// challenges up to the DefaultMaxPuzzleDifficulty.
+func DefaultPuzzleOptions() PuzzleOptions {
+	return PuzzleOptions{
+		Difficulty:    ConstantDifficulty(0),
+		MaxDifficulty: DefaultMaxPuzzleDifficulty,
+	}
+}
+
+// WithDifficulty sets the DifficultyPolicy used to choose the difficulty of
+// challenges sent to remote peers. By default, no work is required.
+func (opts PuzzleOptions) WithDifficulty(policy DifficultyPolicy) PuzzleOptions {
+	opts.Difficulty = policy
+	return opts
+}
+
+// WithMaxDifficulty sets the maximum difficulty of challenges that will be
+// solved. Remote peers that send more difficult challenges are disconnected,
+// so that they cannot make the local peer do an unbounded amount of work.
+func (opts PuzzleOptions) WithMaxDifficulty(difficulty uint8) PuzzleOptions {
+	opts.MaxDifficulty = difficulty
+	return opts
+}
+
+// puzzleChallengeSize is the size of a difficulty, and a random seed.
+const puzzleChallengeSize = 1 + 32
+
+// Puzzle returns a Handshake that makes remote peers solve a hashcash puzzle
+// before running the wrapped Handshake, so that floods of connections are
+// expensive to mount. Each peer sends a challenge (a difficulty, chosen by the
+// DifficultyPolicy, and a random seed). A challenge is solved by finding a
+// nonce such that the SHA-256 hash of the seed and the nonce has at least as
+// many leading zero bits as the difficulty.
+//
+// A peer that demands work (usually, the peer that is accepting connections
+// while under load) never solves a challenge. It waits for the solution of
+// the remote peer, and verifies it, before doing anything else, so remote
+// peers cannot make it do work. A peer that does not demand work solves the
+// challenge of the remote peer (if it is no more difficult than the maximum
+// difficulty), and sends its solution first. If both peers demand work, the
+// handshake fails with ErrPuzzleMutual. Handshakes in which a peer is solving
+// a challenge count towards the handshakes that are in progress, so a peer
+// that is flooded with challenges begins demanding work (see
+// ThresholdDifficulty), and then stops solving them. The wrapped Handshake,
+// which is usually much more expensive, only runs once the solution has been
+// verified. Both peers must use Puzzle.
+func Puzzle(opts PuzzleOptions, h Handshake) Handshake {
+	pending := new(int64)
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		n := atomic.AddInt64(pending, 1)
+		defer atomic.AddInt64(pending, -1)
+
+		challenge := [puzzleChallengeSize]byte{}
+		challenge[0] = opts.Difficulty(int(n))
+		if _, err := rand.Read(challenge[1:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate puzzle seed: %v", err)
+		}
+		remoteChallenge := [puzzleChallengeSize]byte{}
+		if err := exchange(conn, enc, dec, challenge[:], remoteChallenge[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("exchange puzzle challenges: %v", err)
+		}
+
+		switch {
+		case challenge[0] > 0 && remoteChallenge[0] > 0:
+			return nil, nil, id.Signatory{}, ErrPuzzleMutual
+
+		case challenge[0] > 0:
+			// Verify the solution of the remote peer before sending anything
+			// else, and never solve the challenge of the remote peer (which
+			// has no difficulty).
+			remoteSolution := [8 + 128]byte{}
+			size, err := dec(conn, remoteSolution[:8])
+			if err != nil {
+				return nil, nil, id.Signatory{}, fmt.Errorf("decoding puzzle solution: %v", err)
+			}
+			if size != 8 || !puzzleSolved(challenge[1:], challenge[0], binary.BigEndian.Uint64(remoteSolution[:8])) {
+				return nil, nil, id.Signatory{}, ErrPuzzleUnsolved
+			}
+
+		case remoteChallenge[0] > 0:
+			if remoteChallenge[0] > opts.MaxDifficulty {
+				return nil, nil, id.Signatory{}, fmt.Errorf("solve puzzle of difficulty %v: %w", remoteChallenge[0], ErrPuzzleTooDifficult)
+			}
+			solution := [8]byte{}
+			binary.BigEndian.PutUint64(solution[:], solvePuzzle(remoteChallenge[1:], remoteChallenge[0]))
+			if _, err := enc(conn, solution[:]); err != nil {
+				return nil, nil, id.Signatory{}, fmt.Errorf("encoding puzzle solution: %v", err)
+			}
+		}
+		// When neither peer demands work, there is nothing to solve.
+		return h(conn, enc, dec)
+	}
+}
+
+// solvePuzzle returns the first nonce that solves the puzzle.
+func solvePuzzle(seed []byte, difficulty uint8) uint64 {
+	nonce := uint64(0)
+	for !puzzleSolved(seed, difficulty, nonce) {
+		nonce++
+	}
+	return nonce
+}
+
+// puzzleSolved returns true if the SHA-256 hash of the seed and the nonce has
+// at least as many leading zero bits as the difficulty.
+func puzzleSolved(seed []byte, difficulty uint8, nonce uint64) bool {
+	if difficulty == 0 {
+		return true
+	}
+	buf := [32 + 8]byte{}
+	copy(buf[:32], seed)
+	binary.BigEndian.PutUint64(buf[32:], nonce)
+	hash := sha256.Sum256(buf[:])
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= int(difficulty)
+}
@@ -0,0 +1,116 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Puzzle", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	run := func(h1, h2 handshake.Handshake) (error, error) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+		errs := make(chan error, 1)
+		go func() {
+			_, _, _, err := h1(conn1, enc, dec)
+			conn1.Close()
+			errs <- err
+		}()
+		_, _, _, err := h2(conn2, enc, dec)
+		conn2.Close()
+		return <-errs, err
+	}
+
+	Context("when the peer that does not demand work solves the puzzle", func() {
+		It("should run the wrapped handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			err1, err2 := run(
+				handshake.Puzzle(handshake.DefaultPuzzleOptions(), handshake.ECIES(privKey1)),
+				handshake.Puzzle(handshake.DefaultPuzzleOptions().WithDifficulty(handshake.ConstantDifficulty(12)), handshake.ECIES(privKey2)),
+			)
+			Expect(err1).ToNot(HaveOccurred())
+			Expect(err2).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when both peers demand work", func() {
+		It("should not solve either puzzle", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			opts := handshake.DefaultPuzzleOptions().WithDifficulty(handshake.ConstantDifficulty(12))
+			err1, err2 := run(
+				handshake.Puzzle(opts, handshake.ECIES(privKey1)),
+				handshake.Puzzle(opts, handshake.ECIES(privKey2)),
+			)
+			Expect(err1).To(MatchError(handshake.ErrPuzzleMutual))
+			Expect(err2).To(MatchError(handshake.ErrPuzzleMutual))
+		})
+	})
+
+	Context("when the remote peer sends a challenge that is too difficult", func() {
+		It("should not solve it", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			err1, err2 := run(
+				handshake.Puzzle(handshake.DefaultPuzzleOptions().WithMaxDifficulty(8), handshake.ECIES(privKey1)),
+				handshake.Puzzle(handshake.DefaultPuzzleOptions().WithDifficulty(handshake.ConstantDifficulty(64)), handshake.ECIES(privKey2)),
+			)
+			Expect(errors.Is(err1, handshake.ErrPuzzleTooDifficult)).To(BeTrue())
+			Expect(err2).To(HaveOccurred())
+		})
+	})
+
+	Context("when the remote peer does not solve the puzzle", func() {
+		It("should not run the wrapped handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			count := int64(0)
+			h := func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+				atomic.AddInt64(&count, 1)
+				return handshake.ECIES(privKey2)(conn, enc, dec)
+			}
+
+			// Send a challenge, and a solution, without doing any work.
+			cheat := func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+				buf := [33 + 128]byte{}
+				written := make(chan struct{})
+				go func() {
+					defer close(written)
+					enc(conn, make([]byte, 33))
+				}()
+				if _, err := dec(conn, buf[:33]); err != nil {
+					return nil, nil, id.Signatory{}, err
+				}
+				<-written
+				if _, err := enc(conn, make([]byte, 8)); err != nil {
+					return nil, nil, id.Signatory{}, err
+				}
+				return handshake.ECIES(privKey1)(conn, enc, dec)
+			}
+			_, err := run(cheat, handshake.Puzzle(handshake.DefaultPuzzleOptions().WithDifficulty(handshake.ConstantDifficulty(20)), h))
+			Expect(errors.Is(err, handshake.ErrPuzzleUnsolved)).To(BeTrue())
+			Expect(atomic.LoadInt64(&count)).To(Equal(int64(0)))
+		})
+	})
+
+	Context("when using a threshold difficulty", func() {
+		It("should only require work above the threshold", func() {
+			policy := handshake.ThresholdDifficulty(10, 16)
+			Expect(policy(1)).To(Equal(uint8(0)))
+			Expect(policy(10)).To(Equal(uint8(0)))
+			Expect(policy(11)).To(Equal(uint8(16)))
+		})
+	})
+})
@@ -0,0 +1,399 @@
+package handshake
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+)
+
+var (
+	DefaultTicketTTL      = 10 * time.Minute
+	DefaultTicketCapacity = 1024
+)
+
+const (
+	// ticketPlaintextSize is the size of the remote signatory, the resumption
+	// secret, and the expiry (in nanoseconds since the Unix epoch).
+	ticketPlaintextSize = 32 + 32 + 8
+	// ticketSize is the size of a sealed ticket, including its nonce and tag.
+	ticketSize = 12 + ticketPlaintextSize + 16
+	// resumeOfferSize is the size of a flag, a ticket, and a nonce.
+	resumeOfferSize = 1 + ticketSize + 32
+	// resumeAnswerSize is the size of a flag, and two proofs.
+	resumeAnswerSize = 1 + 32 + 32
+	// issueSize is the size of a ticket, and its resumption secret.
+	issueSize = ticketSize + 32
+)
+
+// TicketStoreOptions for parameterising the behaviour of a TicketStore.
+type TicketStoreOptions struct {
+	TTL      time.Duration
+	Capacity int
+	Now      func() time.Time
+}
+
+// DefaultTicketStoreOptions returns TicketStoreOptions with sensible defaults.
+func DefaultTicketStoreOptions() TicketStoreOptions {
+	return TicketStoreOptions{
+		TTL:      DefaultTicketTTL,
+		Capacity: DefaultTicketCapacity,
+		Now:      time.Now,
+	}
+}
+
+// WithTTL sets how long tickets can be used to resume sessions after they have
+// been issued.
+func (opts TicketStoreOptions) WithTTL(ttl time.Duration) TicketStoreOptions {
+	opts.TTL = ttl
+	return opts
+}
+
+// WithCapacity sets the maximum number of tickets, issued by remote peers, that
+// are held. Once the maximum is reached, expired tickets are forgotten, and
+// then the tickets that expire the soonest, so that new tickets can be held.
+func (opts TicketStoreOptions) WithCapacity(capacity int) TicketStoreOptions {
+	opts.Capacity = capacity
+	return opts
+}
+
+// WithNow sets the clock used to expire tickets. This is mostly useful for
+// testing.
+func (opts TicketStoreOptions) WithNow(now func() time.Time) TicketStoreOptions {
+	opts.Now = now
+	return opts
+}
+
+// heldTicket is a ticket that was issued by a remote peer.
+type heldTicket struct {
+	ticket [ticketSize]byte
+	secret [32]byte
+	remote id.Signatory
+	expiry time.Time
+}
+
+// A TicketStore issues tickets to remote peers, and holds the tickets issued
+// by remote peers, so that sessions can be resumed. Tickets are sealed using a
+// key that never leaves the TicketStore, and is not persisted, so tickets
+// issued before a restart cannot be used. It is safe for concurrent use, and
+// should be shared by all handshakes of a peer.
+type TicketStore struct {
+	opts TicketStoreOptions
+	aead cipher.AEAD
+
+	ticketsMu *sync.Mutex
+	tickets   map[string]heldTicket
+}
+
+// NewTicketStore returns a TicketStore, with a random key for sealing tickets.
+func NewTicketStore(opts TicketStoreOptions) (*TicketStore, error) {
+	key := [32]byte{}
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("generate ticket key: %v", err)
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("creating aes cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating gcm cipher: %v", err)
+	}
+	return &TicketStore{
+		opts: opts,
+		aead: aead,
+
+		ticketsMu: new(sync.Mutex),
+		tickets:   map[string]heldTicket{},
+	}, nil
+}
+
+// Len returns the number of tickets, issued by remote peers, that are held.
+func (store *TicketStore) Len() int {
+	store.ticketsMu.Lock()
+	defer store.ticketsMu.Unlock()
+
+	return len(store.tickets)
+}
+
+// issue a ticket to a remote peer, returning the ticket and its resumption
+// secret.
+func (store *TicketStore) issue(remote id.Signatory) ([ticketSize]byte, [32]byte, error) {
+	ticket := [ticketSize]byte{}
+	secret := [32]byte{}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return ticket, secret, fmt.Errorf("generate resumption secret: %v", err)
+	}
+	if _, err := rand.Read(ticket[:12]); err != nil {
+		return ticket, secret, fmt.Errorf("generate ticket nonce: %v", err)
+	}
+	plaintext := [ticketPlaintextSize]byte{}
+	copy(plaintext[:32], remote[:])
+	copy(plaintext[32:64], secret[:])
+	binary.BigEndian.PutUint64(plaintext[64:], uint64(store.opts.Now().Add(store.opts.TTL).UnixNano()))
+	store.aead.Seal(ticket[12:12], ticket[:12], plaintext[:], nil)
+	return ticket, secret, nil
+}
+
+// open a ticket that was issued by the TicketStore, returning the remote peer
+// to which it was issued, and its resumption secret.
+func (store *TicketStore) open(ticket []byte) (id.Signatory, [32]byte, bool) {
+	plaintext, err := store.aead.Open(nil, ticket[:12], ticket[12:], nil)
+	if err != nil {
+		return id.Signatory{}, [32]byte{}, false
+	}
+	expiry := time.Unix(0, int64(binary.BigEndian.Uint64(plaintext[64:])))
+	if store.opts.Now().After(expiry) {
+		return id.Signatory{}, [32]byte{}, false
+	}
+	remote, secret := id.Signatory{}, [32]byte{}
+	copy(remote[:], plaintext[:32])
+	copy(secret[:], plaintext[32:64])
+	return remote, secret, true
+}
+
+func (store *TicketStore) hold(addr string, ticket heldTicket) {
+	store.ticketsMu.Lock()
+	defer store.ticketsMu.Unlock()
+
+	if _, ok := store.tickets[addr]; !ok && len(store.tickets) >= store.opts.Capacity {
+		now := store.opts.Now()
+		soonest, found := "", false
+		for other, otherTicket := range store.tickets {
+			if now.After(otherTicket.expiry) {
+				delete(store.tickets, other)
+				continue
+			}
+			if !found || otherTicket.expiry.Before(store.tickets[soonest].expiry) {
+				soonest, found = other, true
+			}
+		}
+		if len(store.tickets) >= store.opts.Capacity {
+			delete(store.tickets, soonest)
+		}
+	}
+	store.tickets[addr] = ticket
+}
+
+func (store *TicketStore) held(addr string) (heldTicket, bool) {
+	store.ticketsMu.Lock()
+	defer store.ticketsMu.Unlock()
+
+	ticket, ok := store.tickets[addr]
+	if ok && store.opts.Now().After(ticket.expiry) {
+		delete(store.tickets, addr)
+		return heldTicket{}, false
+	}
+	return ticket, ok
+}
+
+func (store *TicketStore) drop(addr string) {
+	store.ticketsMu.Lock()
+	defer store.ticketsMu.Unlock()
+
+	delete(store.tickets, addr)
+}
+
+// Resume returns a Handshake that resumes sessions using tickets, and falls
+// back to the wrapped Handshake when no ticket can be used.
+//
+// After the wrapped Handshake, each peer issues a ticket to the remote peer,
+// which the remote peer holds for the address of the network connection. When
+// a peer reconnects to the same address before the ticket expires (see
+// TicketStoreOptions.WithTTL), it offers the ticket instead. Both peers send
+// their offers at the same time, and then prove that they know the resumption
+// secret of the ticket, so a session is resumed in one round trip, without
+// signatures or public key operations. The keys of resumed sessions are
+// derived from the resumption secret and random nonces from both peers, so
+// they are different for every session. Tickets are only held by the peer
+// that dials, because the addresses of accepted network connections change.
+// Both peers must use Resume.
+func Resume(self id.Signatory, store *TicketStore, h Handshake) Handshake {
+	return ResumeWithOptions(self, store, Options{}, h)
+}
+
+// ResumeWithOptions is the same as Resume, but resumed sessions negotiate their
+// cipher suite and wire version (see ECIESWithOptions), and store the
+// negotiated wire version in the VersionTable of the Options, so that they are
+// the same as sessions that were not resumed. The Options should be the same
+// as those of the wrapped Handshake. Both peers must use ResumeWithOptions.
+func ResumeWithOptions(self id.Signatory, store *TicketStore, opts Options, h Handshake) Handshake {
+	return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+		addr := conn.RemoteAddr().String()
+
+		// Offer a ticket, if one is held for the address.
+		offer := [resumeOfferSize]byte{}
+		ticket, offered := store.held(addr)
+		if offered {
+			offer[0] = 1
+			copy(offer[1:1+ticketSize], ticket.ticket[:])
+		}
+		if _, err := rand.Read(offer[1+ticketSize:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("generate resumption nonce: %v", err)
+		}
+		remoteOffer := [resumeOfferSize]byte{}
+		if err := exchange(conn, enc, dec, offer[:], remoteOffer[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("exchange resumption offers: %v", err)
+		}
+
+		// Accept the ticket of the remote peer, if it was issued by the local
+		// peer and has not expired. Both peers prove that they know the
+		// resumption secret of the tickets that they offer, and accept.
+		transcript := resumeTranscript(offer[:], remoteOffer[:])
+		answer := [resumeAnswerSize]byte{}
+		var acceptedRemote id.Signatory
+		var acceptedSecret [32]byte
+		accepted := false
+		if remoteOffer[0] == 1 {
+			acceptedRemote, acceptedSecret, accepted = store.open(remoteOffer[1 : 1+ticketSize])
+		}
+		if offered {
+			proof := resumeProof(ticket.secret, "offer", transcript)
+			copy(answer[1:33], proof[:])
+		}
+		if accepted {
+			answer[0] = 1
+			proof := resumeProof(acceptedSecret, "accept", transcript)
+			copy(answer[33:], proof[:])
+		}
+		remoteAnswer := [resumeAnswerSize]byte{}
+		if err := exchange(conn, enc, dec, answer[:], remoteAnswer[:]); err != nil {
+			return nil, nil, id.Signatory{}, fmt.Errorf("exchange resumption answers: %v", err)
+		}
+
+		// Check the proofs of the remote peer. Both peers have the same
+		// information, so they agree on which ticket (if any) is used.
+		remoteAccepted := false
+		if offered && remoteAnswer[0] == 1 {
+			proof := resumeProof(ticket.secret, "accept", transcript)
+			if !hmac.Equal(proof[:], remoteAnswer[33:]) {
+				return nil, nil, id.Signatory{}, fmt.Errorf("verify resumption: remote peer did not issue ticket")
+			}
+			remoteAccepted = true
+		}
+		if accepted {
+			proof := resumeProof(acceptedSecret, "offer", transcript)
+			if !hmac.Equal(proof[:], remoteAnswer[1:33]) {
+				return nil, nil, id.Signatory{}, fmt.Errorf("verify resumption: remote peer does not hold ticket")
+			}
+		}
+		if offered && !remoteAccepted {
+			store.drop(addr)
+		}
+
+		// When both tickets are accepted, use the lower ticket.
+		useOwn := remoteAccepted && (!accepted || bytes.Compare(offer[1:1+ticketSize], remoteOffer[1:1+ticketSize]) < 0)
+		switch {
+		case useOwn:
+			key := resumeKey(ticket.secret, offer[1+ticketSize:], remoteOffer[1+ticketSize:])
+			return resumeSession(conn, key, self, ticket.remote, enc, dec, opts)
+		case accepted:
+			key := resumeKey(acceptedSecret, remoteOffer[1+ticketSize:], offer[1+ticketSize:])
+			return resumeSession(conn, key, self, acceptedRemote, enc, dec, opts)
+		}
+
+		// Fall back to the wrapped Handshake, and then issue tickets for the
+		// next session.
+		enc, dec, remote, err := h(conn, enc, dec)
+		if err != nil {
+			return enc, dec, remote, err
+		}
+		issued, secret, err := store.issue(remote)
+		if err != nil {
+			return nil, nil, remote, err
+		}
+		msg := [issueSize]byte{}
+		copy(msg[:ticketSize], issued[:])
+		copy(msg[ticketSize:], secret[:])
+		remoteMsg := [issueSize]byte{}
+		if err := exchange(conn, enc, dec, msg[:], remoteMsg[:]); err != nil {
+			return nil, nil, remote, fmt.Errorf("exchange tickets: %v", err)
+		}
+		held := heldTicket{remote: remote, expiry: store.opts.Now().Add(store.opts.TTL)}
+		copy(held.ticket[:], remoteMsg[:ticketSize])
+		copy(held.secret[:], remoteMsg[ticketSize:])
+		store.hold(addr, held)
+		return enc, dec, remote, nil
+	}
+}
+
+// exchange sends a message to the remote peer, and receives a message of the
+// same size from the remote peer.
+func exchange(conn net.Conn, enc codec.Encoder, dec codec.Decoder, msg, remoteMsg []byte) error {
+	// Write concurrently, because both peers write before they read, and the
+	// network connection might not be buffered.
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := enc(conn, msg)
+		errCh <- err
+	}()
+	buf := make([]byte, len(remoteMsg), len(remoteMsg)+128)
+	n, err := dec(conn, buf)
+	if err != nil {
+		return fmt.Errorf("decoding: %v", err)
+	}
+	if n != len(remoteMsg) {
+		return fmt.Errorf("decoding: expected %v bytes, got %v bytes", len(remoteMsg), n)
+	}
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("encoding: %v", err)
+	}
+	copy(remoteMsg, buf)
+	return nil
+}
+
+// resumeSession returns the encoder and decoder of a resumed session.
+func resumeSession(conn net.Conn, key [32]byte, self, remote id.Signatory, enc codec.Encoder, dec codec.Decoder, opts Options) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+	enc, dec, err := establish(conn, key, self, remote, enc, dec, opts)
+	if err != nil {
+		return nil, nil, id.Signatory{}, fmt.Errorf("resume: %w", err)
+	}
+	return enc, dec, remote, nil
+}
+
+// resumeTranscript returns the hash of both offers, ordered so that both peers
+// compute the same hash.
+func resumeTranscript(offer, remoteOffer []byte) [32]byte {
+	if bytes.Compare(offer, remoteOffer) > 0 {
+		offer, remoteOffer = remoteOffer, offer
+	}
+	h := sha256.New()
+	h.Write([]byte("aw resume"))
+	h.Write(offer)
+	h.Write(remoteOffer)
+	transcript := [32]byte{}
+	h.Sum(transcript[:0])
+	return transcript
+}
+
+func resumeProof(secret [32]byte, role string, transcript [32]byte) [32]byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte(role))
+	mac.Write(transcript[:])
+	proof := [32]byte{}
+	mac.Sum(proof[:0])
+	return proof
+}
+
+// resumeKey derives the key of a resumed session from the resumption secret,
+// the nonce of the peer that offered the ticket, and the nonce of the peer
+// that issued it.
+func resumeKey(secret [32]byte, holderNonce, issuerNonce []byte) [32]byte {
+	mac := hmac.New(sha256.New, secret[:])
+	mac.Write([]byte("aw resume key"))
+	mac.Write(holderNonce)
+	mac.Write(issuerNonce)
+	key := [32]byte{}
+	mac.Sum(key[:0])
+	return key
+}
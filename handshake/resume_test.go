@@ -0,0 +1,229 @@
+package handshake_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// remoteAddrConn overrides the remote address of a network connection.
+type remoteAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (conn remoteAddrConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+var _ = Describe("Resume", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	// counted wraps a Handshake, and counts the number of times it is run.
+	counted := func(count *int64, h handshake.Handshake) handshake.Handshake {
+		return func(conn net.Conn, enc codec.Encoder, dec codec.Decoder) (codec.Encoder, codec.Decoder, id.Signatory, error) {
+			atomic.AddInt64(count, 1)
+			return h(conn, enc, dec)
+		}
+	}
+
+	newStore := func(opts handshake.TicketStoreOptions) *handshake.TicketStore {
+		store, err := handshake.NewTicketStore(opts)
+		Expect(err).ToNot(HaveOccurred())
+		return store
+	}
+
+	// connect runs both handshakes, checks the identities of both peers,
+	// and sends a message in both directions.
+	connect := func(h1, h2 handshake.Handshake, privKey1, privKey2 *id.PrivKey) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			enc1, dec1, remote, err := h1(conn1, enc, dec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote).To(Equal(privKey2.Signatory()))
+			_, err = enc1(conn1, []byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			buf := [5 + 128]byte{}
+			n, err := dec1(conn1, buf[:5])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(buf[:n])).To(Equal("world"))
+		}()
+		enc2, dec2, remote, err := h2(conn2, enc, dec)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(remote).To(Equal(privKey1.Signatory()))
+		buf := [5 + 128]byte{}
+		n, err := dec2(conn2, buf[:5])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("hello"))
+		_, err = enc2(conn2, []byte("world"))
+		Expect(err).ToNot(HaveOccurred())
+		<-done
+	}
+
+	Context("when reconnecting before the ticket expires", func() {
+		It("should resume the session without the wrapped handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			store1 := newStore(handshake.DefaultTicketStoreOptions())
+			store2 := newStore(handshake.DefaultTicketStoreOptions())
+			count := new(int64)
+			h1 := handshake.Resume(privKey1.Signatory(), store1, counted(count, handshake.ECIES(privKey1)))
+			h2 := handshake.Resume(privKey2.Signatory(), store2, counted(count, handshake.ECIES(privKey2)))
+
+			connect(h1, h2, privKey1, privKey2)
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(2)))
+			Expect(store1.Len()).To(Equal(1))
+			Expect(store2.Len()).To(Equal(1))
+
+			for i := 0; i < 3; i++ {
+				connect(h1, h2, privKey1, privKey2)
+			}
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(2)))
+		})
+	})
+
+	Context("when reconnecting with options", func() {
+		It("should negotiate the resumed session, and store its wire version", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			store1 := newStore(handshake.DefaultTicketStoreOptions())
+			store2 := newStore(handshake.DefaultTicketStoreOptions())
+			count := new(int64)
+			resume := func(table1, table2 *handshake.VersionTable) (handshake.Handshake, handshake.Handshake) {
+				opts1 := handshake.DefaultOptions().WithVersionTable(table1)
+				opts2 := handshake.DefaultOptions().WithVersionTable(table2)
+				return handshake.ResumeWithOptions(privKey1.Signatory(), store1, opts1, counted(count, handshake.ECIESWithOptions(privKey1, opts1))),
+					handshake.ResumeWithOptions(privKey2.Signatory(), store2, opts2, counted(count, handshake.ECIESWithOptions(privKey2, opts2)))
+			}
+
+			h1, h2 := resume(handshake.NewVersionTable(), handshake.NewVersionTable())
+			connect(h1, h2, privKey1, privKey2)
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(2)))
+
+			table1, table2 := handshake.NewVersionTable(), handshake.NewVersionTable()
+			h1, h2 = resume(table1, table2)
+			connect(h1, h2, privKey1, privKey2)
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(2)))
+			latest := handshake.DefaultVersions[len(handshake.DefaultVersions)-1]
+			Expect(table1.Version(privKey2.Signatory())).To(Equal(latest))
+			Expect(table2.Version(privKey1.Signatory())).To(Equal(latest))
+		})
+	})
+
+	Context("when more tickets are issued than can be held", func() {
+		It("should forget the tickets that expire the soonest", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			store1 := newStore(handshake.DefaultTicketStoreOptions().WithCapacity(2))
+			h1 := handshake.Resume(privKey1.Signatory(), store1, handshake.ECIES(privKey1))
+
+			for _, addr := range []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"} {
+				// The remote peer does not hold a ticket, so a ticket is
+				// issued for every address.
+				h2 := handshake.Resume(privKey2.Signatory(), newStore(handshake.DefaultTicketStoreOptions()), handshake.ECIES(privKey2))
+				conn1, conn2 := net.Pipe()
+				raddr, err := net.ResolveTCPAddr("tcp", addr)
+				Expect(err).ToNot(HaveOccurred())
+				errs := make(chan error, 1)
+				go func() {
+					_, _, _, err := h1(remoteAddrConn{Conn: conn1, addr: raddr}, enc, dec)
+					errs <- err
+				}()
+				_, _, _, err = h2(conn2, enc, dec)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(<-errs).ToNot(HaveOccurred())
+				conn1.Close()
+				conn2.Close()
+			}
+			Expect(store1.Len()).To(Equal(2))
+		})
+	})
+
+	Context("when reconnecting after the ticket expires", func() {
+		It("should fall back to the wrapped handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			now := time.Now()
+			opts := handshake.DefaultTicketStoreOptions().WithTTL(time.Minute).WithNow(func() time.Time { return now })
+			count := new(int64)
+			h1 := handshake.Resume(privKey1.Signatory(), newStore(opts), counted(count, handshake.ECIES(privKey1)))
+			h2 := handshake.Resume(privKey2.Signatory(), newStore(opts), counted(count, handshake.ECIES(privKey2)))
+
+			connect(h1, h2, privKey1, privKey2)
+			now = now.Add(2 * time.Minute)
+			connect(h1, h2, privKey1, privKey2)
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(4)))
+		})
+	})
+
+	Context("when the issuer of the ticket has restarted", func() {
+		It("should fall back to the wrapped handshake", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			store1 := newStore(handshake.DefaultTicketStoreOptions())
+			count := new(int64)
+			h1 := handshake.Resume(privKey1.Signatory(), store1, counted(count, handshake.ECIES(privKey1)))
+
+			connect(h1, handshake.Resume(privKey2.Signatory(), newStore(handshake.DefaultTicketStoreOptions()), counted(count, handshake.ECIES(privKey2))), privKey1, privKey2)
+			connect(h1, handshake.Resume(privKey2.Signatory(), newStore(handshake.DefaultTicketStoreOptions()), counted(count, handshake.ECIES(privKey2))), privKey1, privKey2)
+			Expect(atomic.LoadInt64(count)).To(Equal(int64(4)))
+			Expect(store1.Len()).To(Equal(1))
+		})
+	})
+
+	Context("when a resumption offer is replayed", func() {
+		It("should reject the offer", func() {
+			privKey1 := id.NewPrivKey()
+			privKey2 := id.NewPrivKey()
+			store1 := newStore(handshake.DefaultTicketStoreOptions())
+			store2 := newStore(handshake.DefaultTicketStoreOptions())
+			h2 := handshake.Resume(privKey2.Signatory(), store2, handshake.ECIES(privKey2))
+			connect(handshake.Resume(privKey1.Signatory(), store1, handshake.ECIES(privKey1)), h2, privKey1, privKey2)
+
+			// Record the resumption offer of the first peer.
+			conn1, conn2 := net.Pipe()
+			transcript := new(bytes.Buffer)
+			errs := make(chan error, 1)
+			go func() {
+				_, _, _, err := handshake.Resume(privKey1.Signatory(), store1, handshake.ECIES(privKey1))(recordingConn{Conn: conn1, written: transcript}, enc, dec)
+				errs <- err
+			}()
+			_, _, _, err := h2(conn2, enc, dec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-errs).ToNot(HaveOccurred())
+			conn1.Close()
+			conn2.Close()
+
+			// Replay the offer, without knowing the resumption secret.
+			offer := transcript.Bytes()[:4+1+100+32]
+			answer := append([]byte{0, 0, 0, 65}, make([]byte, 65)...)
+			conn1, conn2 = net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+			go io.Copy(ioutil.Discard, conn1)
+			go func() {
+				conn1.Write(offer)
+				conn1.Write(answer)
+			}()
+			_, _, _, err = h2(conn2, enc, dec)
+			Expect(err).To(MatchError(ContainSubstring("does not hold ticket")))
+		})
+	})
+})
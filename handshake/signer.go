@@ -0,0 +1,20 @@
+package handshake
+
+import (
+	"github.com/renproject/id"
+)
+
+// A Signer signs digests on behalf of a node identity, without exposing its
+// private key. This allows node identities to be kept in hardware security
+// modules, TPMs, or cloud key management services. An *id.PrivKey is a
+// Signer.
+//
+// Only handshakes that authenticate peers using signatures (NoiseXX, and
+// Fresh) accept a Signer. ECIES needs to decrypt using the private key, so it
+// still needs an *id.PrivKey.
+type Signer interface {
+	// Sign a 32 byte digest, returning a recoverable secp256k1 signature.
+	Sign(digest *id.Hash) (id.Signature, error)
+	// PubKey returns the public key of the node identity.
+	PubKey() *id.PubKey
+}
@@ -0,0 +1,86 @@
+package handshake_test
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// remoteSigner is a Signer that does not expose its private key, like a
+// hardware security module.
+type remoteSigner struct {
+	privKey *id.PrivKey
+	signed  *int64
+	err     error
+}
+
+func (signer remoteSigner) Sign(digest *id.Hash) (id.Signature, error) {
+	atomic.AddInt64(signer.signed, 1)
+	if signer.err != nil {
+		return id.Signature{}, signer.err
+	}
+	return signer.privKey.Sign(digest)
+}
+
+func (signer remoteSigner) PubKey() *id.PubKey {
+	return signer.privKey.PubKey()
+}
+
+var _ = Describe("Signer", func() {
+	enc := codec.LengthPrefixEncoder(codec.PlainEncoder, codec.PlainEncoder)
+	dec := codec.LengthPrefixDecoder(codec.PlainDecoder, codec.PlainDecoder)
+
+	Context("when handshaking using Signers", func() {
+		It("should identify both peers using the public keys of the Signers", func() {
+			signer1 := remoteSigner{privKey: id.NewPrivKey(), signed: new(int64)}
+			signer2 := remoteSigner{privKey: id.NewPrivKey(), signed: new(int64)}
+			cache := handshake.NewNonceCache(handshake.DefaultNonceCacheOptions())
+			conn1, conn2 := net.Pipe()
+			defer conn1.Close()
+			defer conn2.Close()
+
+			remotes := make(chan id.Signatory, 1)
+			go func() {
+				defer GinkgoRecover()
+				_, _, remote, err := handshake.Fresh(signer1, cache, handshake.NoiseXX(signer1))(conn1, enc, dec)
+				Expect(err).ToNot(HaveOccurred())
+				remotes <- remote
+			}()
+			_, _, remote, err := handshake.Fresh(signer2, cache, handshake.NoiseXX(signer2))(conn2, enc, dec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(remote).To(Equal(signer1.privKey.Signatory()))
+			Expect(<-remotes).To(Equal(signer2.privKey.Signatory()))
+
+			// Each peer signs once for the Noise handshake, and once for its
+			// nonce.
+			Expect(atomic.LoadInt64(signer1.signed)).To(Equal(int64(2)))
+			Expect(atomic.LoadInt64(signer2.signed)).To(Equal(int64(2)))
+		})
+	})
+
+	Context("when a Signer fails to sign", func() {
+		It("should return an error", func() {
+			signer1 := remoteSigner{privKey: id.NewPrivKey(), signed: new(int64), err: errors.New("device unavailable")}
+			signer2 := remoteSigner{privKey: id.NewPrivKey(), signed: new(int64)}
+			conn1, conn2 := net.Pipe()
+
+			errs := make(chan error, 1)
+			go func() {
+				_, _, _, err := handshake.NoiseXX(signer1)(conn1, enc, dec)
+				conn1.Close()
+				errs <- err
+			}()
+			_, _, _, err := handshake.NoiseXX(signer2)(conn2, enc, dec)
+			conn2.Close()
+			Expect(err).To(HaveOccurred())
+			Expect(<-errs).To(MatchError(ContainSubstring("device unavailable")))
+		})
+	})
+})
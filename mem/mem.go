@@ -0,0 +1,173 @@
+// Package mem implements network connections that never leave the process, so
+// that Transports (and the peers, DHTs, and gossip built on them) can be
+// tested without binding to ports, and without depending on the timing of the
+// network stack of the operating system.
+//
+// Transports are connected to a Network using its Listeners and Dialers.
+//
+//	network := mem.NewNetwork()
+//	listener, err := network.Listen("peer-1:3000")
+//	t := transport.New(transport.DefaultOptions().WithListener(listener).WithDialer(network.Dialer("peer-1:3000")), self, client, h, table)
+//
+// Addresses are not resolved, so the addresses of remote peers in the table of
+// a Transport only need to match the addresses of their Listeners (although
+// they must still be of the form "host:port").
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/renproject/aw/tcp"
+)
+
+// DefaultAcceptBacklog is the number of dialed network connections that can be
+// waiting to be accepted before dialing waits.
+var DefaultAcceptBacklog = 64
+
+var (
+	// ErrConnRefused is returned when dialing an address at which nothing is
+	// listening.
+	ErrConnRefused = errors.New("connection refused")
+	// ErrAddrInUse is returned when listening at an address at which
+	// something is already listening.
+	ErrAddrInUse = errors.New("address already in use")
+)
+
+// A Network of Listeners that can be dialed. It is safe for concurrent use.
+type Network struct {
+	listenersMu *sync.Mutex
+	listeners   map[string]*Listener
+}
+
+// NewNetwork returns a Network without any Listeners.
+func NewNetwork() *Network {
+	return &Network{
+		listenersMu: new(sync.Mutex),
+		listeners:   map[string]*Listener{},
+	}
+}
+
+// Listen at an address, until the Listener is closed.
+func (network *Network) Listen(address string) (*Listener, error) {
+	network.listenersMu.Lock()
+	defer network.listenersMu.Unlock()
+
+	if _, ok := network.listeners[address]; ok {
+		return nil, fmt.Errorf("listening at %v: %w", address, ErrAddrInUse)
+	}
+	listener := &Listener{
+		network: network,
+		addr:    Addr(address),
+
+		accept:    make(chan net.Conn, DefaultAcceptBacklog),
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	network.listeners[address] = listener
+	return listener, nil
+}
+
+// Dialer returns a tcp.DialFunc that dials the Listeners of the Network,
+// regardless of the network that it is given. The local address is the
+// address of dialed network connections, as seen by the Listeners (for
+// example, by rate limits), so it should be unique to the dialing peer.
+func (network *Network) Dialer(local string) tcp.DialFunc {
+	return func(ctx context.Context, _, address string) (net.Conn, error) {
+		network.listenersMu.Lock()
+		listener, ok := network.listeners[address]
+		network.listenersMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("dialing %v: %w", address, ErrConnRefused)
+		}
+
+		client, server := net.Pipe()
+		select {
+		case <-ctx.Done():
+			client.Close()
+			server.Close()
+			return nil, fmt.Errorf("dialing %v: %w", address, ctx.Err())
+		case <-listener.closed:
+			client.Close()
+			server.Close()
+			return nil, fmt.Errorf("dialing %v: %w", address, ErrConnRefused)
+		case listener.accept <- &conn{Conn: server, local: listener.addr, remote: Addr(local)}:
+			return &conn{Conn: client, local: Addr(local), remote: listener.addr}, nil
+		}
+	}
+}
+
+// A Listener accepts network connections that are dialed within its Network.
+// It implements the net.Listener interface.
+type Listener struct {
+	network *Network
+	addr    Addr
+
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// Accept the next network connection.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	case conn := <-listener.accept:
+		return conn, nil
+	}
+}
+
+// Close the Listener, so that its address can be listened at again. Network
+// connections that have already been accepted are not closed.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+
+		listener.network.listenersMu.Lock()
+		defer listener.network.listenersMu.Unlock()
+
+		if listener.network.listeners[string(listener.addr)] == listener {
+			delete(listener.network.listeners, string(listener.addr))
+		}
+	})
+	return nil
+}
+
+// Addr returns the address at which the Listener is listening.
+func (listener *Listener) Addr() net.Addr {
+	return listener.addr
+}
+
+// conn is one end of a synchronous, in-memory network connection (see
+// net.Pipe), with the addresses of its Network.
+type conn struct {
+	net.Conn
+
+	local  Addr
+	remote Addr
+}
+
+func (conn *conn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Addr is the address of a Listener, or Dialer, in a Network.
+type Addr string
+
+// Network implements the net.Addr interface.
+func (addr Addr) Network() string {
+	return "mem"
+}
+
+// String implements the net.Addr interface.
+func (addr Addr) String() string {
+	return string(addr)
+}
@@ -0,0 +1,139 @@
+package mem_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/mem"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network", func() {
+	Context("when dialing a listener", func() {
+		It("should connect the dialer and the listener", func() {
+			network := mem.NewNetwork()
+			listener, err := network.Listen("server")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+
+			conn, err := network.Dialer("client")(context.Background(), "tcp", "server")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.LocalAddr().String()).To(Equal("client"))
+			Expect(conn.RemoteAddr().String()).To(Equal("server"))
+
+			_, err = conn.Write([]byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			echoed := make([]byte, 5)
+			_, err = io.ReadFull(conn, echoed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(echoed)).To(Equal("hello"))
+		})
+	})
+
+	Context("when nothing is listening", func() {
+		It("should refuse to connect", func() {
+			network := mem.NewNetwork()
+			_, err := network.Dialer("client")(context.Background(), "tcp", "server")
+			Expect(errors.Is(err, mem.ErrConnRefused)).To(BeTrue())
+
+			listener, err := network.Listen("server")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listener.Close()).To(Succeed())
+			_, err = network.Dialer("client")(context.Background(), "tcp", "server")
+			Expect(errors.Is(err, mem.ErrConnRefused)).To(BeTrue())
+		})
+	})
+
+	Context("when something is already listening", func() {
+		It("should return an error", func() {
+			network := mem.NewNetwork()
+			listener, err := network.Listen("server")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = network.Listen("server")
+			Expect(errors.Is(err, mem.ErrAddrInUse)).To(BeTrue())
+
+			Expect(listener.Close()).To(Succeed())
+			_, err = network.Listen("server")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("when used by Transports", func() {
+		It("should send messages between all of them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			n := 5
+			network := mem.NewNetwork()
+			transports := make([]*transport.Transport, n)
+			received := make([]chan wire.Msg, n)
+			for i := range transports {
+				address := fmt.Sprintf("peer-%v:3000", i)
+				listener, err := network.Listen(address)
+				Expect(err).ToNot(HaveOccurred())
+
+				privKey := id.NewPrivKey()
+				transports[i] = transport.New(
+					transport.DefaultOptions().
+						WithLogger(zap.NewNop()).
+						WithListener(listener).
+						WithDialer(network.Dialer(address)),
+					privKey.Signatory(),
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), privKey.Signatory()),
+					handshake.ECIES(privKey),
+					dht.NewInMemTable(privKey.Signatory()),
+				)
+				received[i] = make(chan wire.Msg, n)
+				go transports[i].Receive(ctx, func(i int) func(id.Signatory, wire.Packet) error {
+					return func(from id.Signatory, packet wire.Packet) error {
+						received[i] <- packet.Msg
+						return nil
+					}
+				}(i))
+				go transports[i].Run(ctx)
+			}
+			for i := range transports {
+				for j := range transports {
+					if i != j {
+						transports[i].Table().AddPeer(transports[j].Self(), wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("peer-%v:3000", j), uint64(time.Now().UnixNano())))
+					}
+				}
+			}
+
+			for i := range transports {
+				for j := range transports {
+					if i != j {
+						Expect(transports[i].Send(ctx, transports[j].Self(), wire.Msg{Data: []byte(fmt.Sprintf("%v", i))})).To(Succeed())
+					}
+				}
+			}
+			for j := range transports {
+				for k := 0; k < n-1; k++ {
+					Eventually(received[j], 5*time.Second).Should(Receive())
+				}
+			}
+		})
+	})
+})
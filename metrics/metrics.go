@@ -0,0 +1,351 @@
+// Package metrics collects metrics about a Transport, and the Client that it
+// uses, and exposes them to Prometheus using its text exposition format.
+//
+// Metrics are collected in two ways. Events (such as dials, sessions, and
+// messages) are counted by hooks, so Metrics must be set as the ConnObserver
+// of the Transport, and as the MessageObserver (and optionally the
+// TimingObserver) of the Client. Everything else (such as accept stats,
+// resource limits, and queue depths) is read from snapshots of the Transport
+// when Metrics are scraped, so the Transport must be given to Collect.
+//
+//	m := metrics.New()
+//	client := channel.NewClient(channel.DefaultOptions().WithMessageObserver(m).WithTimingObserver(m, 0.01), self)
+//	t := transport.New(transport.DefaultOptions().WithConnObserver(m), self, client, h, table)
+//	m.Collect(t)
+//	http.Handle("/metrics", m)
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// Metrics counts the events of a Transport, and its Client, and exports them,
+// together with snapshots of the Transport, to Prometheus. It implements the
+// transport.ConnObserver, transport.SessionObserver, channel.MessageObserver,
+// and channel.TimingObserver interfaces, and the http.Handler interface. It is
+// safe for concurrent use.
+type Metrics struct {
+	timings *channel.TimingHistograms
+
+	mu            *sync.Mutex
+	transport     *transport.Transport
+	dials         map[string]uint64
+	sessions      map[string]uint64
+	handshakes    map[string]*channel.DurationHistogram
+	closed        uint64
+	expired       uint64
+	sent          map[uint16]uint64
+	sentBytes     map[uint16]uint64
+	received      map[uint16]uint64
+	receivedBytes map[uint16]uint64
+}
+
+// New returns Metrics that have not counted any events.
+func New() *Metrics {
+	return &Metrics{
+		timings: channel.NewTimingHistograms(),
+
+		mu:            new(sync.Mutex),
+		dials:         map[string]uint64{},
+		sessions:      map[string]uint64{},
+		handshakes:    map[string]*channel.DurationHistogram{},
+		sent:          map[uint16]uint64{},
+		sentBytes:     map[uint16]uint64{},
+		received:      map[uint16]uint64{},
+		receivedBytes: map[uint16]uint64{},
+	}
+}
+
+// Collect snapshots of the Transport, and its Client, whenever the Metrics are
+// scraped.
+func (m *Metrics) Collect(t *transport.Transport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.transport = t
+}
+
+// OnDialSuccess implements the transport.ConnObserver interface.
+func (m *Metrics) OnDialSuccess(remote id.Signatory, addr net.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dials["success"]++
+}
+
+// OnDialFailure implements the transport.ConnObserver interface.
+func (m *Metrics) OnDialFailure(remote id.Signatory, addr wire.Address, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dials["failure"]++
+}
+
+// OnConnClosed implements the transport.ConnObserver interface.
+func (m *Metrics) OnConnClosed(remote id.Signatory, addr net.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed++
+}
+
+// OnExpired implements the transport.ConnObserver interface.
+func (m *Metrics) OnExpired(remote id.Signatory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expired++
+}
+
+// OnSessionEstablished implements the transport.SessionObserver interface.
+func (m *Metrics) OnSessionEstablished(info transport.SessionInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	direction := "outbound"
+	if info.Inbound {
+		direction = "inbound"
+	}
+	m.sessions[direction]++
+	if _, ok := m.handshakes[direction]; !ok {
+		m.handshakes[direction] = new(channel.DurationHistogram)
+	}
+	m.handshakes[direction].Observe(info.Handshake)
+}
+
+// ObserveSend implements the channel.MessageObserver interface.
+func (m *Metrics) ObserveSend(remote id.Signatory, msg wire.Msg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent[msg.Type]++
+	m.sentBytes[msg.Type] += uint64(len(msg.Data))
+}
+
+// ObserveReceive implements the channel.MessageObserver interface.
+func (m *Metrics) ObserveReceive(remote id.Signatory, msg wire.Msg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.received[msg.Type]++
+	m.receivedBytes[msg.Type] += uint64(len(msg.Data))
+}
+
+// ObserveWrite implements the channel.TimingObserver interface.
+func (m *Metrics) ObserveWrite(timings channel.WriteTimings) {
+	m.timings.ObserveWrite(timings)
+}
+
+// ObserveRead implements the channel.TimingObserver interface.
+func (m *Metrics) ObserveRead(timings channel.ReadTimings) {
+	m.timings.ObserveRead(timings)
+}
+
+// ServeHTTP writes the Metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := m.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Write the Metrics in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	m.mu.Lock()
+	t := m.transport
+	e.counters("aw_dials_total", "Dials that completed the handshake, or failed.", "result", m.dials)
+	e.counters("aw_sessions_total", "Sessions that completed the handshake.", "direction", m.sessions)
+	handshakes := make(map[string]channel.DurationHistogram, len(m.handshakes))
+	for direction, hist := range m.handshakes {
+		handshakes[direction] = *hist
+	}
+	e.histograms("aw_handshake_seconds", "Time taken by handshakes that succeeded, by direction.", "direction", handshakes)
+	e.counter("aw_conns_closed_total", "Network connections that were closed.", m.closed)
+	e.counter("aw_peers_expired_total", "Remote peers that were removed after failing to dial them.", m.expired)
+	e.counters("aw_messages_sent_total", "Messages sent, by type.", "type", byType(m.sent))
+	e.counters("aw_message_bytes_sent_total", "Bytes of message data sent, by type.", "type", byType(m.sentBytes))
+	e.counters("aw_messages_received_total", "Messages received, by type.", "type", byType(m.received))
+	e.counters("aw_message_bytes_received_total", "Bytes of message data received, by type.", "type", byType(m.receivedBytes))
+	m.mu.Unlock()
+
+	e.histograms("aw_io_seconds", "Time spent reading and writing sampled messages, by stage.", "stage", m.timings.Snapshot())
+
+	if t != nil {
+		accepts := t.AcceptStats()
+		e.gauge("aw_accept_backlog", "Inbound network connections that are not yet rejected or attached.", float64(accepts.Backlog))
+		e.gauge("aw_accept_handshaking", "Inbound network connections that are doing the handshake.", float64(accepts.Handshaking))
+		e.counters("aw_accept_rejects_total", "Inbound network connections that were rejected, by reason.", "reason", accepts.Rejects)
+		e.histograms("aw_accept_handshake_seconds", "Time from accepting inbound network connections to completing their handshake.", "", map[string]channel.DurationHistogram{"": accepts.HandshakeLatency})
+
+		resources := t.ResourceStats()
+		e.gauges("aw_resources_in_use", "Resources in use, by resource.", "resource", resources.InUse)
+		e.counters("aw_resource_limit_exceeded_total", "Times that the limit of a resource was exceeded, by resource.", "resource", resources.Exceeded)
+
+		conns := t.Client().Connections()
+		queued := 0
+		for _, conn := range conns {
+			queued += conn.QueueDepth
+		}
+		e.gauge("aw_connections", "Network connections attached to Channels.", float64(len(conns)))
+		e.gauge("aw_queue_depth", "Outbound messages waiting to be written, across all Channels.", float64(queued))
+
+		sessions := map[string]int{}
+		encrypted := map[string]int{}
+		decrypted := map[string]int{}
+		for _, conn := range conns {
+			if !conn.Encrypted {
+				continue
+			}
+			suite := conn.Session.CipherSuite.String()
+			sessions[suite]++
+			encrypted[suite] += int(conn.Session.BytesEncrypted)
+			decrypted[suite] += int(conn.Session.BytesDecrypted)
+		}
+		e.gauges("aw_sessions", "Encrypted sessions attached to Channels, by cipher suite.", "cipher", sessions)
+		e.gauges("aw_session_bytes_encrypted", "Bytes encrypted by the sessions attached to Channels, by cipher suite.", "cipher", encrypted)
+		e.gauges("aw_session_bytes_decrypted", "Bytes decrypted by the sessions attached to Channels, by cipher suite.", "cipher", decrypted)
+
+		versions := map[string]channel.DurationHistogram{}
+		for version, stats := range t.Client().WireVersionStats() {
+			versions[strconv.Itoa(int(version))] = stats.Latency
+		}
+		e.histograms("aw_send_latency_seconds", "Time from sending messages to writing them, by wire version.", "version", versions)
+	}
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// msgTypeNames are the label values of the message types that are known.
+var msgTypeNames = map[uint16]string{
+	wire.MsgTypePush:          "push",
+	wire.MsgTypePull:          "pull",
+	wire.MsgTypeSync:          "sync",
+	wire.MsgTypeSend:          "send",
+	wire.MsgTypePing:          "ping",
+	wire.MsgTypePingAck:       "ping-ack",
+	wire.MsgTypeAddressUpdate: "address-update",
+	wire.MsgTypeMaintenance:   "maintenance",
+	wire.MsgTypeGoingAway:     "going-away",
+
+	wire.MsgTypeRecentContent:    "recent-content",
+	wire.MsgTypeRecentContentAck: "recent-content-ack",
+	wire.MsgTypeReq:              "req",
+	wire.MsgTypeResp:             "resp",
+}
+
+func byType(counts map[uint16]uint64) map[string]uint64 {
+	labelled := make(map[string]uint64, len(counts))
+	for msgType, n := range counts {
+		name, ok := msgTypeNames[msgType]
+		if !ok {
+			name = strconv.Itoa(int(msgType))
+		}
+		labelled[name] += n
+	}
+	return labelled
+}
+
+// encoder writes metric families in the Prometheus text exposition format.
+// The first error is kept, and all writes after it are skipped.
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) printf(format string, args ...interface{}) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
+
+func (e *encoder) family(name, typ, help string) {
+	e.printf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+func (e *encoder) counter(name, help string, value uint64) {
+	e.family(name, "counter", help)
+	e.printf("%v %v\n", name, value)
+}
+
+func (e *encoder) counters(name, help, label string, values map[string]uint64) {
+	e.family(name, "counter", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.printf("%v{%v=%q} %v\n", name, label, key, values[key])
+	}
+}
+
+func (e *encoder) gauge(name, help string, value float64) {
+	e.family(name, "gauge", help)
+	e.printf("%v %v\n", name, value)
+}
+
+func (e *encoder) gauges(name, help, label string, values map[string]int) {
+	e.family(name, "gauge", help)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		e.printf("%v{%v=%q} %v\n", name, label, key, values[key])
+	}
+}
+
+// histograms writes DurationHistograms, whose upper bounds are converted to
+// seconds. If the label is empty, there must be at most one histogram.
+func (e *encoder) histograms(name, help, label string, hists map[string]channel.DurationHistogram) {
+	e.family(name, "histogram", help)
+	keys := make([]string, 0, len(hists))
+	for key := range hists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := hists[key]
+		labels := ""
+		if label != "" {
+			labels = fmt.Sprintf("%v=%q,", label, key)
+		}
+		cumulative := uint64(0)
+		for i, n := range hist.Buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(hist.Buckets)-1 {
+				le = strconv.FormatFloat(float64(uint64(1)<<i)/1e6, 'g', -1, 64)
+			}
+			e.printf("%v_bucket{%vle=%q} %v\n", name, labels, le, cumulative)
+		}
+		labels = trimComma(labels)
+		e.printf("%v_sum%v %v\n", name, labels, hist.Sum.Seconds())
+		e.printf("%v_count%v %v\n", name, labels, hist.Count)
+	}
+}
+
+// trimComma turns the labels written before the le label into a label set.
+func trimComma(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
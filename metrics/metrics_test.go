@@ -0,0 +1,77 @@
+package metrics_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/metrics"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	Context("when events are observed", func() {
+		It("should count them", func() {
+			m := metrics.New()
+			remote := id.NewPrivKey().Signatory()
+			m.OnDialSuccess(remote, nil)
+			m.OnDialFailure(remote, wire.Address{}, fmt.Errorf("refused"))
+			m.OnDialFailure(remote, wire.Address{}, fmt.Errorf("refused"))
+			m.OnSessionEstablished(transport.SessionInfo{Remote: remote, Inbound: true, Handshake: 3 * time.Millisecond})
+			m.ObserveSend(remote, wire.Msg{Type: wire.MsgTypePush, Data: []byte("hello")})
+			m.ObserveReceive(remote, wire.Msg{Type: 42, Data: []byte("hi")})
+			m.ObserveWrite(channel.WriteTimings{Syscall: 3 * time.Microsecond})
+
+			buf := new(bytes.Buffer)
+			Expect(m.Write(buf)).To(Succeed())
+			Expect(buf.String()).To(ContainSubstring("# TYPE aw_dials_total counter\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_dials_total{result="failure"} 2` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_dials_total{result="success"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_sessions_total{direction="inbound"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_handshake_seconds_count{direction="inbound"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_messages_sent_total{type="push"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_message_bytes_sent_total{type="push"} 5` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_messages_received_total{type="42"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_io_seconds_bucket{stage="write/syscall",le="2e-06"} 0` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_io_seconds_bucket{stage="write/syscall",le="4e-06"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_io_seconds_bucket{stage="write/syscall",le="+Inf"} 1` + "\n"))
+			Expect(buf.String()).To(ContainSubstring(`aw_io_seconds_count{stage="write/syscall"} 1` + "\n"))
+		})
+	})
+
+	Context("when collecting a transport", func() {
+		It("should export its snapshots when scraped", func() {
+			m := metrics.New()
+			privKey := id.NewPrivKey()
+			t := transport.New(
+				transport.DefaultOptions().
+					WithLogger(zap.NewNop()).
+					WithConnObserver(m),
+				privKey.Signatory(),
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()).WithMessageObserver(m), privKey.Signatory()),
+				handshake.ECIES(privKey),
+				dht.NewInMemTable(privKey.Signatory()),
+			)
+			m.Collect(t)
+
+			recorder := httptest.NewRecorder()
+			m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Code).To(Equal(200))
+			Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+			Expect(recorder.Body.String()).To(ContainSubstring("aw_accept_backlog 0\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring("aw_connections 0\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`aw_accept_handshake_seconds_bucket{le="+Inf"} 0` + "\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring("aw_accept_handshake_seconds_count 0\n"))
+		})
+	})
+})
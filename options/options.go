@@ -0,0 +1,210 @@
+// Package options decodes options structs (such as channel.Options,
+// transport.Options, and peer.Options) from JSON configuration, in a way that
+// is compatible with configuration written for other versions.
+//
+// Configuration is a JSON object whose keys are the names of option fields,
+// matched case-insensitively. Fields that are not in the configuration keep
+// their current values, so configuration is decoded on top of defaults. Keys
+// that do not match a field are ignored, so configuration written for a newer
+// version, which has more options, can still be decoded by an older version.
+//
+//	{"ClientTimeout": "5s", "MaxInboundConns": 100, "OncePoolOptions": {"MinimumExpiryAge": "1m"}}
+//
+// Only fields that are booleans, numbers, strings, durations, or structs of
+// these, can be decoded. Durations are strings in the format accepted by
+// time.ParseDuration. Rate limits can also be the string "inf".
+package options
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	limitType    = reflect.TypeOf(rate.Limit(0))
+)
+
+// Decode the JSON configuration on top of the options struct that dst points
+// to. If an error is returned, dst might have been partially modified.
+func Decode(data []byte, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("decoding options: expected pointer to struct, got %T", dst)
+	}
+	return decodeStruct(data, v.Elem(), "")
+}
+
+// Unknown returns the keys of the JSON configuration that do not match a field
+// of the options struct that dst points to. It is useful for warning about
+// typos, or about options that are not supported by this version.
+func Unknown(data []byte, dst interface{}) ([]string, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("decoding options: expected pointer to struct, got %T", dst)
+	}
+	return unknownKeys(data, v.Elem().Type(), "")
+}
+
+// Compile checks that the JSON configuration can be decoded on top of the
+// options struct that dst points to, and returns a function that decodes it on
+// top of other options structs of the same type. Decoding can only fail
+// because of the type of the options struct, so the function cannot fail. It
+// is used to build functional options (such as channel.DecodeOptions).
+func Compile(data []byte, dst interface{}) (func(dst interface{}), error) {
+	if err := Decode(data, dst); err != nil {
+		return nil, err
+	}
+	return func(dst interface{}) {
+		// The configuration has already been decoded without error.
+		_ = Decode(data, dst)
+	}, nil
+}
+
+func decodeStruct(data []byte, v reflect.Value, path string) error {
+	object, err := decodeObject(data, path)
+	if err != nil {
+		return err
+	}
+	return decodeFields(object, v, path)
+}
+
+func decodeFields(object map[string]json.RawMessage, v reflect.Value, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		// The fields of embedded structs are promoted, so they are decoded
+		// from the same object, and can also be decoded from a nested object.
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := decodeFields(object, v.Field(i), path); err != nil {
+				return err
+			}
+			if raw, ok := lookup(object, field.Name); ok {
+				if err := decodeStruct(raw, v.Field(i), path+field.Name+"."); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		raw, ok := lookup(object, field.Name)
+		if !ok {
+			continue
+		}
+		if err := decodeField(raw, v.Field(i), path+field.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeField(raw json.RawMessage, v reflect.Value, path string) error {
+	switch {
+	case v.Type() == durationType:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return fmt.Errorf("decoding %v: expected duration string: %v", path, err)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("decoding %v: %v", path, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+
+	case v.Type() == limitType && strings.EqualFold(string(bytes.Trim(raw, `"`)), "inf"):
+		v.SetFloat(math.MaxFloat64)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if err := json.Unmarshal(raw, v.Addr().Interface()); err != nil {
+			return fmt.Errorf("decoding %v: %v", path, err)
+		}
+		return nil
+	case reflect.Struct:
+		return decodeStruct(raw, v, path+".")
+	default:
+		return fmt.Errorf("decoding %v: %v options cannot be decoded", path, v.Type())
+	}
+}
+
+func unknownKeys(data []byte, t reflect.Type, path string) ([]string, error) {
+	object, err := decodeObject(data, path)
+	if err != nil {
+		return nil, err
+	}
+	unknown := []string{}
+	for key, raw := range object {
+		field, ok := fieldByName(t, key)
+		if !ok {
+			unknown = append(unknown, path+key)
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			nested, err := unknownKeys(raw, field.Type, path+field.Name+".")
+			if err != nil {
+				return nil, err
+			}
+			unknown = append(unknown, nested...)
+		}
+	}
+	return unknown, nil
+}
+
+func decodeObject(data []byte, path string) (map[string]json.RawMessage, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		if path == "" {
+			return nil, fmt.Errorf("decoding options: %v", err)
+		}
+		return nil, fmt.Errorf("decoding %v: %v", strings.TrimSuffix(path, "."), err)
+	}
+	return object, nil
+}
+
+// lookup the value of a field in an object, ignoring case.
+func lookup(object map[string]json.RawMessage, name string) (json.RawMessage, bool) {
+	if raw, ok := object[name]; ok {
+		return raw, true
+	}
+	for key, raw := range object {
+		if strings.EqualFold(key, name) {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// fieldByName returns the exported field, including promoted fields, with
+// the name, ignoring case.
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if strings.EqualFold(field.Name, name) {
+			return field, true
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if promoted, ok := fieldByName(field.Type, name); ok {
+				return promoted, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,93 @@
+package options_test
+
+import (
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/options"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Options", func() {
+	Context("when decoding configuration", func() {
+		It("should only change the options that are configured", func() {
+			opts := transport.DefaultOptions().WithLogger(zap.NewNop())
+			Expect(options.Decode([]byte(`{
+				"clientTimeout": "5s",
+				"MaxInboundConns": 100,
+				"HandshakeRateLimit": "inf",
+				"OncePoolOptions": {"MinimumExpiryAge": "1m"}
+			}`), &opts)).To(Succeed())
+
+			Expect(opts.ClientTimeout).To(Equal(5 * time.Second))
+			Expect(opts.MaxInboundConns).To(Equal(100))
+			Expect(opts.HandshakeRateLimit).To(Equal(rate.Inf))
+			Expect(opts.OncePoolOptions.MinimumExpiryAge).To(Equal(time.Minute))
+			Expect(opts.ServerTimeout).To(Equal(transport.DefaultServerTimeout))
+			Expect(opts.Logger).ToNot(BeNil())
+		})
+
+		It("should decode the options of embedded structs", func() {
+			opts := peer.DefaultOptions()
+			Expect(options.Decode([]byte(`{"PushBurst": 10, "DiscoveryOptions": {"PingTimePeriod": "2s"}}`), &opts)).To(Succeed())
+			Expect(opts.GossiperOptions.PushBurst).To(Equal(10))
+			Expect(opts.DiscoveryOptions.PingTimePeriod).To(Equal(2 * time.Second))
+		})
+
+		It("should ignore options that are unknown", func() {
+			data := []byte(`{"MaxMessageSize": 1024, "NotYetAnOption": true}`)
+			opts := channel.DefaultOptions()
+			Expect(options.Decode(data, &opts)).To(Succeed())
+			Expect(opts.MaxMessageSize).To(Equal(1024))
+
+			unknown, err := options.Unknown(data, &opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unknown).To(Equal([]string{"NotYetAnOption"}))
+		})
+
+		It("should return an error for options that cannot be decoded", func() {
+			opts := transport.DefaultOptions()
+			Expect(options.Decode([]byte(`{"Logger": {}}`), &opts)).ToNot(Succeed())
+			Expect(options.Decode([]byte(`{"ClientTimeout": 5}`), &opts)).ToNot(Succeed())
+			Expect(options.Decode([]byte(`{"Port": 70000}`), &opts)).ToNot(Succeed())
+			Expect(options.Decode([]byte(`{"MaxInboundConns": {"Nested": 1}}`), &opts)).ToNot(Succeed())
+		})
+	})
+
+	Context("when compiling configuration", func() {
+		It("should check it once, and decode it on top of other options", func() {
+			_, err := options.Compile([]byte(`{"ClientTimeout": 5}`), &transport.Options{})
+			Expect(err).To(HaveOccurred())
+
+			decode, err := options.Compile([]byte(`{"ClientTimeout": "5s"}`), &transport.Options{})
+			Expect(err).ToNot(HaveOccurred())
+			opts := transport.DefaultOptions()
+			decode(&opts)
+			Expect(opts.ClientTimeout).To(Equal(5 * time.Second))
+			Expect(opts.ServerTimeout).To(Equal(transport.DefaultServerTimeout))
+		})
+	})
+
+	Context("when constructing with functional options", func() {
+		It("should apply the options in order, on top of the defaults", func() {
+			decoded, err := channel.DecodeOptions([]byte(`{"MaxMessageSize": 1024}`))
+			Expect(err).ToNot(HaveOccurred())
+			opts := channel.DefaultOptions().With(
+				channel.FromOptions(channel.DefaultOptions().WithLogger(zap.NewNop()).WithMaxMessageSize(512)),
+				decoded,
+				func(opts channel.Options) channel.Options { return opts.WithKeepAliveInterval(time.Second) },
+			)
+			Expect(opts.MaxMessageSize).To(Equal(1024))
+			Expect(opts.KeepAliveInterval).To(Equal(time.Second))
+
+			_, err = transport.DecodeOptions([]byte(`{"ClientTimeout": "forever"}`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,353 @@
+package peer
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+	"go.uber.org/zap"
+)
+
+// CatchUpProgress reports how far a Gossiper has caught up with recently
+// gossiped content.
+type CatchUpProgress struct {
+	// Peers that were asked for their recently gossiped content.
+	Peers int
+	// Responded is the number of peers that responded. Peers that do not
+	// respond within the gossip timeout are skipped.
+	Responded int
+	// Wanted is the number of recently gossiped content IDs that were not
+	// known locally, and have been pulled.
+	Wanted int
+	// Received is the number of wanted content IDs for which content has been
+	// received.
+	Received int
+	// Missed is the number of wanted content IDs for which content could not
+	// be pulled from any of the peers that responded with them.
+	Missed int
+}
+
+// recentContent is content that was recently gossiped.
+type recentContent struct {
+	contentID []byte
+	subnet    id.Hash
+}
+
+// catchUp is the state shared between a call to CatchUp and the handling of
+// messages received while it is running.
+type catchUp struct {
+	peers    map[id.Signatory]struct{}
+	acks     chan recentContentAck
+	received chan string
+	done     chan struct{}
+}
+
+// recentContentAck is a response from one of the peers being caught up with,
+// or the error that prevented the peer from being asked.
+type recentContentAck struct {
+	from       id.Signatory
+	contentIDs [][]byte
+	err        error
+}
+
+// wantedContent is content that is being pulled while catching up.
+type wantedContent struct {
+	from     []id.Signatory
+	deadline time.Time
+}
+
+// CatchUp with recently gossiped content by asking the given remote peers (or,
+// if there are none, random remote peers) for the content IDs that they have
+// recently gossiped, and pulling the content that is not known locally. Peers
+// should be given in order of preference (for example, pinned peers first),
+// because content is pulled from the first peer that responds with it, and
+// then from the other peers that responded with it if pulling fails. Content
+// that is caught up with is not gossiped further.
+//
+// The progress function, if not nil, is called whenever progress is made. It
+// returns once all content has been received or missed, and an error if the
+// context is done first. Only one call to CatchUp can run at once.
+func (g *Gossiper) CatchUp(ctx context.Context, peers []id.Signatory, progress func(CatchUpProgress)) (CatchUpProgress, error) {
+	if len(peers) == 0 {
+		peers = g.transport.Table().Peers(g.opts.Alpha)
+	}
+	c := &catchUp{
+		peers:    make(map[id.Signatory]struct{}, len(peers)),
+		acks:     make(chan recentContentAck, len(peers)),
+		received: make(chan string, 64),
+		done:     make(chan struct{}),
+	}
+	for _, peer := range peers {
+		c.peers[peer] = struct{}{}
+	}
+
+	g.catchUpMu.Lock()
+	if g.catchUp != nil {
+		g.catchUpMu.Unlock()
+		return CatchUpProgress{}, ErrCatchUpInProgress
+	}
+	g.catchUp = c
+	g.catchUpMu.Unlock()
+
+	wanted := map[string]bool{}
+	defer func() {
+		close(c.done)
+
+		g.catchUpMu.Lock()
+		g.catchUp = nil
+		g.catchUpMu.Unlock()
+
+		for contentID := range wanted {
+			g.filter.Deny([]byte(contentID))
+		}
+	}()
+
+	p := CatchUpProgress{Peers: len(c.peers)}
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	report()
+
+	for peer := range c.peers {
+		peer := peer
+		go func() {
+			innerCtx, cancel := context.WithTimeout(ctx, g.opts.Timeout)
+			defer cancel()
+
+			if err := g.transport.Send(innerCtx, peer, wire.Msg{
+				Version: wire.MsgVersion1,
+				Type:    wire.MsgTypeRecentContent,
+				To:      id.Hash(peer),
+			}); err != nil {
+				select {
+				case c.acks <- recentContentAck{from: peer, err: err}:
+				case <-c.done:
+				}
+			}
+		}()
+	}
+
+	responded := map[id.Signatory]struct{}{}
+	respondDeadline := time.Now().Add(g.opts.Timeout)
+	pending := map[string]*wantedContent{}
+
+	ticker := time.NewTicker(g.opts.Timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		waiting := len(responded) < len(c.peers) && time.Now().Before(respondDeadline)
+		if !waiting && len(pending) == 0 {
+			return p, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return p, ctx.Err()
+
+		case ack := <-c.acks:
+			if _, ok := responded[ack.from]; ok {
+				continue
+			}
+			responded[ack.from] = struct{}{}
+			if ack.err != nil {
+				g.opts.Logger.Debug("catching up", zap.String("peer", ack.from.String()), zap.Error(ack.err))
+				continue
+			}
+			p.Responded++
+			for _, contentID := range ack.contentIDs {
+				if w, ok := pending[string(contentID)]; ok {
+					w.from = append(w.from, ack.from)
+					continue
+				}
+				if wanted[string(contentID)] || g.hasContent(contentID) {
+					continue
+				}
+				wanted[string(contentID)] = true
+				pending[string(contentID)] = &wantedContent{from: []id.Signatory{ack.from}, deadline: time.Now().Add(g.opts.Timeout)}
+				p.Wanted++
+
+				// Content that is caught up with is not expected by the
+				// filter, because it was not pushed.
+				g.filter.Allow(contentID)
+				go g.pull(ack.from, contentID)
+			}
+			report()
+
+		case contentID := <-c.received:
+			if _, ok := pending[contentID]; !ok {
+				continue
+			}
+			delete(pending, contentID)
+			p.Received++
+			report()
+
+		case now := <-ticker.C:
+			changed := false
+			for contentID, w := range pending {
+				if now.Before(w.deadline) {
+					continue
+				}
+				changed = true
+				if g.hasContent([]byte(contentID)) {
+					// The content was inserted by something other than a
+					// synchronisation message.
+					delete(pending, contentID)
+					p.Received++
+					continue
+				}
+				w.from = w.from[1:]
+				if len(w.from) == 0 {
+					g.opts.Logger.Debug("catching up", zap.String("id", base64.RawURLEncoding.EncodeToString([]byte(contentID))), zap.Error(fmt.Errorf("content not received")))
+					delete(pending, contentID)
+					p.Missed++
+					continue
+				}
+				w.deadline = now.Add(g.opts.Timeout)
+				go g.pull(w.from[0], []byte(contentID))
+			}
+			if changed {
+				report()
+			}
+		}
+	}
+}
+
+// hasContent returns true if the content is known locally.
+func (g *Gossiper) hasContent(contentID []byte) bool {
+	g.resolverMu.RLock()
+	defer g.resolverMu.RUnlock()
+
+	if g.resolver == nil {
+		return false
+	}
+	_, ok := g.resolver.QueryContent(contentID)
+	return ok
+}
+
+// pull content from a remote peer. The content must already be allowed by the
+// filter.
+func (g *Gossiper) pull(from id.Signatory, contentID []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
+	defer cancel()
+
+	if err := g.transport.Send(ctx, from, wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypePull,
+		To:      id.Hash(from),
+		Data:    contentID,
+	}); err != nil {
+		g.opts.Logger.Error("pull", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(contentID)), zap.Error(err))
+	}
+}
+
+// didCatchUp is called whenever content is received in a synchronisation
+// message, so that a running call to CatchUp can make progress.
+func (g *Gossiper) didCatchUp(contentID []byte) {
+	g.catchUpMu.Lock()
+	c := g.catchUp
+	g.catchUpMu.Unlock()
+
+	if c == nil {
+		return
+	}
+	select {
+	case c.received <- string(contentID):
+	case <-c.done:
+	}
+}
+
+// rememberRecent remembers that the content was recently gossiped, so that it
+// can be sent to remote peers that are catching up. The oldest content is
+// forgotten once RecentContentSize content IDs are remembered.
+func (g *Gossiper) rememberRecent(contentID []byte, subnet id.Hash) {
+	size := g.opts.RecentContentSize
+	if size <= 0 {
+		return
+	}
+
+	g.recentMu.Lock()
+	defer g.recentMu.Unlock()
+
+	if _, ok := g.recentOk[string(contentID)]; ok {
+		return
+	}
+	recent := recentContent{contentID: append([]byte(nil), contentID...), subnet: subnet}
+	if len(g.recent) < size {
+		g.recent = append(g.recent, recent)
+	} else {
+		delete(g.recentOk, string(g.recent[g.recentAt].contentID))
+		g.recent[g.recentAt] = recent
+	}
+	g.recentOk[string(contentID)] = struct{}{}
+	g.recentAt = (g.recentAt + 1) % size
+}
+
+// recentContentIDs returns the content IDs that were recently gossiped in
+// subnets for which the remote peer is authorized, most recent first.
+func (g *Gossiper) recentContentIDs(peer id.Signatory) [][]byte {
+	g.recentMu.Lock()
+	defer g.recentMu.Unlock()
+
+	n := len(g.recent)
+	contentIDs := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		recent := g.recent[((g.recentAt-1-i)%n+n)%n]
+		if err := g.authorize(recent.subnet, peer); err != nil {
+			continue
+		}
+		contentIDs = append(contentIDs, recent.contentID)
+	}
+	return contentIDs
+}
+
+func (g *Gossiper) didReceiveRecentContent(from id.Signatory) {
+	data, err := surge.ToBinary(g.recentContentIDs(from))
+	if err != nil {
+		g.opts.Logger.Error("marshaling recent content", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
+	defer cancel()
+
+	if err := g.transport.Send(ctx, from, wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeRecentContentAck,
+		To:      id.Hash(from),
+		Data:    data,
+	}); err != nil {
+		g.opts.Logger.Debug("acking recent content", zap.String("peer", from.String()), zap.Error(err))
+	}
+}
+
+func (g *Gossiper) didReceiveRecentContentAck(from id.Signatory, msg wire.Msg) error {
+	g.catchUpMu.Lock()
+	c := g.catchUp
+	g.catchUpMu.Unlock()
+
+	if c == nil {
+		return nil
+	}
+	if _, ok := c.peers[from]; !ok {
+		return nil
+	}
+
+	contentIDs := [][]byte{}
+	if err := surge.FromBinary(&contentIDs, msg.Data); err != nil {
+		return fmt.Errorf("bad recent content ack: %v", err)
+	}
+	if len(contentIDs) > g.opts.RecentContentSize {
+		contentIDs = contentIDs[:g.opts.RecentContentSize]
+	}
+	select {
+	case c.acks <- recentContentAck{from: from, contentIDs: contentIDs}:
+	case <-c.done:
+	}
+	return nil
+}
@@ -3,10 +3,13 @@ package peer
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/renproject/aw/channel"
 	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/policy"
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
@@ -21,9 +24,29 @@ type Gossiper struct {
 
 	subnetsMu *sync.Mutex
 	subnets   map[string]id.Hash
+	pushes    map[string]wire.Msg
 
 	resolverMu *sync.RWMutex
 	resolver   dht.ContentResolver
+
+	pushLimiter *policy.SignatoryLimiter
+
+	privateMu *sync.Mutex
+	private   map[string]privateContent
+
+	recentMu *sync.Mutex
+	recent   []recentContent
+	recentAt int
+	recentOk map[string]struct{}
+
+	catchUpMu *sync.Mutex
+	catchUp   *catchUp
+}
+
+// privateContent is content that was recently gossiped in a private subnet.
+type privateContent struct {
+	subnet  id.Hash
+	expires time.Time
 }
 
 func NewGossiper(opts GossiperOptions, filter *channel.SyncFilter, transport *transport.Transport) *Gossiper {
@@ -35,9 +58,20 @@ func NewGossiper(opts GossiperOptions, filter *channel.SyncFilter, transport *tr
 
 		subnetsMu: new(sync.Mutex),
 		subnets:   make(map[string]id.Hash, 1024),
+		pushes:    make(map[string]wire.Msg, 1024),
 
 		resolverMu: new(sync.RWMutex),
 		resolver:   nil,
+
+		pushLimiter: policy.NewSignatoryLimiter(opts.PushRateLimit, opts.PushBurst),
+
+		privateMu: new(sync.Mutex),
+		private:   map[string]privateContent{},
+
+		recentMu: new(sync.Mutex),
+		recentOk: map[string]struct{}{},
+
+		catchUpMu: new(sync.Mutex),
 	}
 }
 
@@ -48,24 +82,85 @@ func (g *Gossiper) Resolve(resolver dht.ContentResolver) {
 	g.resolver = resolver
 }
 
+// Gossip content to a subnet. The subnet is either the hash of a subnet in
+// the table, or a group ID with which peers are tagged in the table (see
+// dht.Table.AddToGroup). A nil subnet is the DefaultSubnet.
 func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) {
+	g.gossip(ctx, contentID, subnet, nil)
+}
+
+// gossip content to a random subset of peers. If the content was announced by
+// a push from a remote peer, then the Hops, and the signature, of that push
+// are relayed. Otherwise, the content is new, and pushes for it are sent with
+// a new TTL, and are signed.
+func (g *Gossiper) gossip(ctx context.Context, contentID []byte, subnet *id.Hash, relayed *wire.Msg) {
 	if subnet == nil {
 		subnet = &DefaultSubnet
 	}
 
 	recipients := []id.Signatory{}
 	if subnet.Equal(&DefaultSubnet) {
-		recipients = g.transport.Table().Peers(g.opts.Alpha)
+		if g.opts.Locality.Zone == nil {
+			recipients = g.transport.Table().Peers(g.opts.Alpha)
+		} else {
+			// All peers are candidates, so that enough local and remote
+			// peers can be found.
+			recipients = g.transport.Table().Peers(g.transport.Table().NumPeers())
+		}
 	} else {
-		if recipients = g.transport.Table().Subnet(*subnet); len(recipients) > g.opts.Alpha {
-			recipients = recipients[:g.opts.Alpha]
+		members := g.transport.Table().Subnet(*subnet)
+		if len(members) == 0 {
+			// Subnets can also be groups of peers (for example, shards) that
+			// are tagged in the table.
+			members = g.transport.Table().PeersInGroup(*subnet, g.transport.Table().NumPeers())
 		}
+		recipients = g.authorizedRecipients(*subnet, members)
+		g.rememberPrivate(contentID, *subnet)
 	}
+	g.rememberRecent(contentID, *subnet)
+	recipients = g.withoutGoingAway(recipients)
+	recipients = g.opts.Locality.Select(recipients, g.opts.Alpha)
 
 	msg := wire.Msg{Version: wire.MsgVersion1, To: *subnet, Type: wire.MsgTypePush, Data: contentID}
+	if relayed != nil {
+		// Pushes from remote peers that do not send Hops are relayed with a
+		// new TTL, so that they are still bounded from here on.
+		if hops, ok := relayed.Hops(); ok {
+			msg = msg.WithHops(hops)
+		} else if g.opts.GossipTTL > 0 {
+			msg = msg.WithHops(wire.Hops{TTL: g.opts.GossipTTL})
+		}
+		if signature, ok := relayed.Header(wire.HeaderTypeSignature); ok {
+			msg = msg.WithHeader(wire.HeaderTypeSignature, signature)
+		}
+	} else {
+		if g.opts.GossipTTL > 0 {
+			msg = msg.WithHops(wire.Hops{TTL: g.opts.GossipTTL})
+		}
+		if g.opts.Signer != nil {
+			signed, err := msg.Sign(g.opts.Signer)
+			if err != nil {
+				g.opts.Logger.Error("push", zap.String("id", base64.RawURLEncoding.EncodeToString(contentID)), zap.Error(err))
+			} else {
+				msg = signed
+			}
+		}
+	}
+	_, signed := msg.Header(wire.HeaderTypeSignature)
 	wg := new(sync.WaitGroup)
 	for i := range recipients {
 		recipient := recipients[i]
+		msg := msg
+		if g.transport.Client().WireVersion(recipient) < wire.MsgVersion5 {
+			// Signed content is not pushed to remote peers that cannot
+			// carry its signature, because they would relay it as if it
+			// was unsigned. Other Headers, like the Hops, are optional.
+			if signed {
+				g.opts.Logger.Debug("push", zap.String("id", base64.RawURLEncoding.EncodeToString(contentID)), zap.String("recipient", recipient.String()), zap.String("reason", "signature unsupported"))
+				continue
+			}
+			msg.Headers = nil
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -80,10 +175,22 @@ func (g *Gossiper) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash
 	wg.Wait()
 }
 
+// withoutGoingAway removes recipients that have announced that they are about
+// to drain, because content pushed to them is likely to be lost.
+func (g *Gossiper) withoutGoingAway(recipients []id.Signatory) []id.Signatory {
+	filtered := make([]id.Signatory, 0, len(recipients))
+	for _, recipient := range recipients {
+		if _, ok := g.transport.IsGoingAway(recipient); !ok {
+			filtered = append(filtered, recipient)
+		}
+	}
+	return filtered
+}
+
 func (g *Gossiper) DidReceiveMessage(from id.Signatory, msg wire.Msg) error {
 	switch msg.Type {
 	case wire.MsgTypePush:
-		g.didReceivePush(from, msg)
+		return g.didReceivePush(from, msg)
 	case wire.MsgTypePull:
 		g.didReceivePull(from, msg)
 	case wire.MsgTypeSync:
@@ -92,13 +199,21 @@ func (g *Gossiper) DidReceiveMessage(from id.Signatory, msg wire.Msg) error {
 			return nil
 		}
 		g.didReceiveSync(from, msg)
+	case wire.MsgTypeRecentContent:
+		g.didReceiveRecentContent(from)
+	case wire.MsgTypeRecentContentAck:
+		return g.didReceiveRecentContentAck(from, msg)
 	}
 	return nil
 }
 
-func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
+func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) error {
 	if len(msg.Data) == 0 {
-		return
+		return nil
+	}
+	if err := g.authorize(msg.To, from); err != nil {
+		g.opts.Logger.Warn("push", zap.String("peer", from.String()), zap.Error(err))
+		return nil
 	}
 
 	// Check whether the content is already known. This can cause performance
@@ -106,14 +221,37 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 	g.resolverMu.RLock()
 	if g.resolver == nil {
 		g.resolverMu.RUnlock()
-		return
+		return nil
 	}
 	if _, ok := g.resolver.QueryContent(msg.Data); ok {
 		g.resolverMu.RUnlock()
-		return
+		return nil
 	}
 	g.resolverMu.RUnlock()
 
+	// Pushes are relayed with the signature of the peer that first pushed the
+	// content, so pushes with signatures that cannot be attributed to anyone
+	// are not relayed.
+	origin, err := msg.Signatory()
+	switch {
+	case errors.Is(err, wire.ErrUnsigned):
+		origin = from
+	case err != nil:
+		g.opts.Logger.Warn("push", zap.String("peer", from.String()), zap.Error(err))
+		return nil
+	}
+
+	// Only pushes for new content are rate limited, because these are the
+	// pushes that cause the content to be pulled and then forwarded to other
+	// peers. The limit applies to the peer that first pushed the content, so
+	// that peers relaying content from many others are not limited. Pushes
+	// over the limit are dropped, instead of killing the Channel to the peer
+	// that relayed them.
+	if !g.pushLimiter.Allow(origin) {
+		g.opts.Logger.Debug("push rate limit exceeded", zap.String("peer", from.String()), zap.String("origin", origin.String()))
+		return nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
 
 	// Later, we will probably receive a synchronisation message for the content
@@ -121,7 +259,11 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 	// to propagate the content later.
 	g.subnetsMu.Lock()
 	g.subnets[string(msg.Data)] = msg.To
+	g.pushes[string(msg.Data)] = msg
 	g.subnetsMu.Unlock()
+	if !msg.To.Equal(&DefaultSubnet) {
+		g.rememberPrivate(msg.Data, msg.To)
+	}
 
 	// We are expecting a synchronisation message, because we are about to send
 	// out a pull message. So, we need to allow the content in the filter.
@@ -137,6 +279,7 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 
 		g.subnetsMu.Lock()
 		delete(g.subnets, string(msg.Data))
+		delete(g.pushes, string(msg.Data))
 		g.subnetsMu.Unlock()
 
 		g.filter.Deny(msg.Data)
@@ -149,14 +292,84 @@ func (g *Gossiper) didReceivePush(from id.Signatory, msg wire.Msg) {
 		Data:    msg.Data,
 	}); err != nil {
 		g.opts.Logger.Error("pull", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(msg.Data)), zap.Error(err))
+	}
+	return nil
+}
+
+// authorize returns nil if the peer is allowed to take part in gossip for the
+// subnet.
+func (g *Gossiper) authorize(subnet id.Hash, peer id.Signatory) error {
+	if g.opts.SubnetAuthorizer == nil || subnet.Equal(&DefaultSubnet) {
+		return nil
+	}
+	return g.opts.SubnetAuthorizer.AuthorizeSubnet(subnet, peer)
+}
+
+// authorizedRecipients returns the recipients that are allowed to take part in
+// gossip for the subnet.
+func (g *Gossiper) authorizedRecipients(subnet id.Hash, recipients []id.Signatory) []id.Signatory {
+	if g.opts.SubnetAuthorizer == nil {
+		return recipients
+	}
+	authorized := make([]id.Signatory, 0, len(recipients))
+	for _, recipient := range recipients {
+		if err := g.authorize(subnet, recipient); err != nil {
+			g.opts.Logger.Debug("skipping recipient", zap.String("peer", recipient.String()), zap.Error(err))
+			continue
+		}
+		authorized = append(authorized, recipient)
+	}
+	return authorized
+}
+
+// rememberPrivate remembers that the content is being gossiped in a subnet, so
+// that pulls for the content can be authorized.
+func (g *Gossiper) rememberPrivate(contentID []byte, subnet id.Hash) {
+	if g.opts.SubnetAuthorizer == nil {
 		return
 	}
+
+	now := time.Now()
+
+	g.privateMu.Lock()
+	defer g.privateMu.Unlock()
+
+	// Forget about content that has expired before remembering new content.
+	// This bounds the memory used by content that is no longer being
+	// gossiped.
+	if _, ok := g.private[string(contentID)]; !ok {
+		for content, private := range g.private {
+			if now.After(private.expires) {
+				delete(g.private, content)
+			}
+		}
+	}
+	g.private[string(contentID)] = privateContent{subnet: subnet, expires: now.Add(g.opts.PrivateContentTTL)}
+}
+
+// privateSubnet returns the subnet in which the content was recently gossiped,
+// and false if the content was not recently gossiped in a subnet.
+func (g *Gossiper) privateSubnet(contentID []byte) (id.Hash, bool) {
+	g.privateMu.Lock()
+	defer g.privateMu.Unlock()
+
+	private, ok := g.private[string(contentID)]
+	if !ok || time.Now().After(private.expires) {
+		return id.Hash{}, false
+	}
+	return private.subnet, true
 }
 
 func (g *Gossiper) didReceivePull(from id.Signatory, msg wire.Msg) {
 	if len(msg.Data) == 0 {
 		return
 	}
+	if subnet, ok := g.privateSubnet(msg.Data); ok {
+		if err := g.authorize(subnet, from); err != nil {
+			g.opts.Logger.Warn("pull", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(msg.Data)), zap.Error(err))
+			return
+		}
+	}
 
 	var content []byte
 	var contentOk bool
@@ -212,8 +425,11 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 	g.resolver.InsertContent(msg.Data, msg.SyncData)
 	g.resolverMu.RUnlock()
 
+	g.didCatchUp(msg.Data)
+
 	g.subnetsMu.Lock()
 	subnet, ok := g.subnets[string(msg.Data)]
+	push := g.pushes[string(msg.Data)]
 	g.subnetsMu.Unlock()
 
 	if !ok {
@@ -225,5 +441,10 @@ func (g *Gossiper) didReceiveSync(from id.Signatory, msg wire.Msg) {
 	ctx, cancel := context.WithTimeout(context.Background(), g.opts.Timeout)
 	defer cancel()
 
-	g.Gossip(ctx, msg.Data, &subnet)
+	// The push is relayed with the TTL that remained when it was received.
+	if hops, ok := push.Hops(); ok && hops.TTL == 0 {
+		g.opts.Logger.Debug("gossip ttl expired", zap.String("peer", from.String()), zap.String("id", base64.RawURLEncoding.EncodeToString(msg.Data)))
+		return
+	}
+	g.gossip(ctx, msg.Data, &subnet, &push)
 }
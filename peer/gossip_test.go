@@ -8,7 +8,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
 	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 	"go.uber.org/zap"
@@ -120,4 +124,319 @@ var _ = Describe("Gossip", func() {
 			Expect(strings.Contains(string(buf[:n]), "message authentication failed")).To(BeFalse())
 		})
 	})
+
+	Context("When gossipping to a group", func() {
+		It("should only send to peers tagged with the group", func() {
+			opts, peers, tables, contentResolvers, _, _ := setup(3)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			for i := 1; i < 3; i++ {
+				tables[0].AddPeer(opts[i].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 3333+i), uint64(time.Now().UnixNano())))
+				tables[i].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+			}
+			shard := id.NewHash([]byte("shard"))
+			tables[0].AddToGroup(opts[1].PrivKey.Signatory(), shard)
+
+			content := []byte("Hi from the shard")
+			contentID := id.NewHash(content)
+			contentResolvers[0].InsertContent(contentID[:], content)
+			peers[0].Gossip(ctx, contentID[:], &shard)
+
+			Eventually(func() bool {
+				_, ok := contentResolvers[1].QueryContent(contentID[:])
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			Consistently(func() bool {
+				_, ok := contentResolvers[2].QueryContent(contentID[:])
+				return ok
+			}, time.Second).Should(BeFalse())
+		})
+	})
+
+	Context("When a remote peer pushes too much new content", func() {
+		It("should drop pushes once the push rate limit of their origin is exceeded", func() {
+			privKey := id.NewPrivKey()
+			self := privKey.Signatory()
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(privKey),
+				dht.NewInMemTable(self))
+			filter := channel.NewSyncFilter()
+			gossiper := peer.NewGossiper(
+				peer.DefaultGossiperOptions().
+					WithLogger(zap.NewNop()).
+					WithPushRateLimit(0.001, 2),
+				filter,
+				t)
+			resolver := dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil)
+			gossiper.Resolve(resolver)
+
+			contentID := func(content string) []byte {
+				hash := id.NewHash([]byte(content))
+				return hash[:]
+			}
+			push := func(content string) wire.Msg {
+				return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePush, To: peer.DefaultSubnet, Data: contentID(content)}
+			}
+			// Content is only pulled, and so its synchronisation message is
+			// only expected, if its push was accepted.
+			accepted := func(content string) bool {
+				return !filter.Filter(self, wire.Msg{Type: wire.MsgTypeSync, Data: contentID(content)})
+			}
+
+			remote := id.NewPrivKey().Signatory()
+			other := id.NewPrivKey().Signatory()
+			Expect(gossiper.DidReceiveMessage(remote, push("a"))).To(Succeed())
+			Expect(gossiper.DidReceiveMessage(remote, push("b"))).To(Succeed())
+			Expect(gossiper.DidReceiveMessage(remote, push("c"))).To(Succeed())
+			Expect(accepted("a")).To(BeTrue())
+			Expect(accepted("b")).To(BeTrue())
+			Expect(accepted("c")).To(BeFalse())
+
+			// Pushes for content that is already known are not limited.
+			resolver.InsertContent(contentID("known"), []byte("known"))
+			Expect(gossiper.DidReceiveMessage(remote, push("known"))).To(Succeed())
+
+			// Other remote peers have their own limit.
+			Expect(gossiper.DidReceiveMessage(other, push("d"))).To(Succeed())
+			Expect(accepted("d")).To(BeTrue())
+
+			// Signed pushes are limited by the peer that signed them, not by
+			// the remote peer that relayed them.
+			origin := id.NewPrivKey()
+			signed, err := push("e").Sign(origin)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gossiper.DidReceiveMessage(remote, signed)).To(Succeed())
+			Expect(accepted("e")).To(BeTrue())
+			for _, content := range []string{"f", "g"} {
+				signed, err := push(content).Sign(origin)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gossiper.DidReceiveMessage(other, signed)).To(Succeed())
+			}
+			Expect(accepted("f")).To(BeTrue())
+			Expect(accepted("g")).To(BeFalse())
+		})
+	})
+
+	Context("When a subnet is private", func() {
+		It("should only accept credentials signed by the owner", func() {
+			owner := id.NewPrivKey()
+			member := id.NewPrivKey().Signatory()
+			subnet := id.NewHash([]byte("private"))
+
+			creds := peer.NewSubnetCredentials()
+			credential, err := peer.NewSubnetCredential(owner, subnet, member)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds.Add(credential)).ToNot(Succeed())
+			Expect(creds.AuthorizeSubnet(subnet, member)).To(Succeed())
+
+			creds.SetOwner(subnet, owner.Signatory())
+			Expect(creds.AuthorizeSubnet(subnet, member)).To(MatchError(ContainSubstring(peer.ErrSubnetUnauthorized.Error())))
+			Expect(creds.AuthorizeSubnet(subnet, owner.Signatory())).To(Succeed())
+
+			forged, err := peer.NewSubnetCredential(id.NewPrivKey(), subnet, member)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds.Add(forged)).ToNot(Succeed())
+
+			Expect(creds.Add(credential)).To(Succeed())
+			Expect(creds.AuthorizeSubnet(subnet, member)).To(Succeed())
+
+			creds.Remove(subnet, member)
+			Expect(creds.AuthorizeSubnet(subnet, member)).ToNot(Succeed())
+		})
+
+		It("should ignore pushes from peers that are not authorized", func() {
+			privKey := id.NewPrivKey()
+			self := privKey.Signatory()
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(privKey),
+				dht.NewInMemTable(self))
+
+			owner := id.NewPrivKey()
+			member := id.NewPrivKey().Signatory()
+			outsider := id.NewPrivKey().Signatory()
+			subnet := id.NewHash([]byte("private"))
+			creds := peer.NewSubnetCredentials()
+			creds.SetOwner(subnet, owner.Signatory())
+			credential, err := peer.NewSubnetCredential(owner, subnet, member)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(creds.Add(credential)).To(Succeed())
+
+			filter := channel.NewSyncFilter()
+			gossiper := peer.NewGossiper(
+				peer.DefaultGossiperOptions().
+					WithLogger(zap.NewNop()).
+					WithSubnetAuthorizer(creds),
+				filter,
+				t)
+			gossiper.Resolve(dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil))
+
+			// Only pushes that are accepted cause synchronisation messages for
+			// the content to be allowed through the filter.
+			push := func(from id.Signatory, content string, subnet id.Hash) bool {
+				contentID := id.NewHash([]byte(content))
+				Expect(gossiper.DidReceiveMessage(from, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePush, To: subnet, Data: contentID[:]})).To(Succeed())
+				return !filter.Filter(from, wire.Msg{Type: wire.MsgTypeSync, Data: contentID[:]})
+			}
+			Expect(push(outsider, "a", subnet)).To(BeFalse())
+			Expect(push(member, "b", subnet)).To(BeTrue())
+			Expect(push(owner.Signatory(), "c", subnet)).To(BeTrue())
+
+			// The default subnet is public.
+			Expect(push(outsider, "d", peer.DefaultSubnet)).To(BeTrue())
+		})
+	})
+
+	Context("When a push is signed", func() {
+		It("should ignore pushes with signatures that cannot be attributed", func() {
+			privKey := id.NewPrivKey()
+			self := privKey.Signatory()
+			t := transport.New(
+				transport.DefaultOptions().WithLogger(zap.NewNop()),
+				self,
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self),
+				handshake.ECIES(privKey),
+				dht.NewInMemTable(self))
+
+			filter := channel.NewSyncFilter()
+			gossiper := peer.NewGossiper(peer.DefaultGossiperOptions().WithLogger(zap.NewNop()), filter, t)
+			gossiper.Resolve(dht.NewDoubleCacheContentResolver(dht.DefaultDoubleCacheContentResolverOptions(), nil))
+
+			from := id.NewPrivKey().Signatory()
+			origin := id.NewPrivKey()
+			push := func(content string, sign func(wire.Msg) wire.Msg) bool {
+				contentID := id.NewHash([]byte(content))
+				msg := sign(wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypePush, To: peer.DefaultSubnet, Data: contentID[:]})
+				Expect(gossiper.DidReceiveMessage(from, msg)).To(Succeed())
+				return !filter.Filter(from, wire.Msg{Type: wire.MsgTypeSync, Data: contentID[:]})
+			}
+			Expect(push("unsigned", func(msg wire.Msg) wire.Msg { return msg })).To(BeTrue())
+			Expect(push("signed", func(msg wire.Msg) wire.Msg {
+				signed, err := msg.Sign(origin)
+				Expect(err).ToNot(HaveOccurred())
+				return signed
+			})).To(BeTrue())
+			Expect(push("malformed", func(msg wire.Msg) wire.Msg {
+				return msg.WithHeader(wire.HeaderTypeSignature, make([]byte, 65))
+			})).To(BeFalse())
+		})
+	})
+
+	Context("When pushes are signed", func() {
+		It("should only push to remote peers that can carry the signature", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			privKeys := []*id.PrivKey{id.NewPrivKey(), id.NewPrivKey(), id.NewPrivKey()}
+			// Only the first remote peer can carry Headers.
+			selector := func(remote id.Signatory) uint16 {
+				if remote == privKeys[1].Signatory() {
+					return wire.MsgVersion5
+				}
+				return wire.MsgVersion4
+			}
+			transports := make([]*transport.Transport, len(privKeys))
+			pushes := make([]chan wire.Msg, len(privKeys))
+			for i := range transports {
+				self := privKeys[i].Signatory()
+				transports[i] = transport.New(
+					transport.DefaultOptions().WithLogger(zap.NewNop()).WithPort(uint16(13570+i)),
+					self,
+					channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()).WithWireVersionSelector(selector), self),
+					handshake.ECIES(privKeys[i]),
+					dht.NewInMemTable(self))
+				pushes[i] = make(chan wire.Msg, 1)
+				i := i
+				transports[i].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					if packet.Msg.Type == wire.MsgTypePush {
+						pushes[i] <- packet.Msg
+					}
+					return nil
+				})
+				go transports[i].Run(ctx)
+			}
+			for i := 1; i < len(transports); i++ {
+				transports[0].Table().AddPeer(privKeys[i].Signatory(), wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("localhost:%v", 13570+i), uint64(time.Now().UnixNano())))
+			}
+
+			gossiper := peer.NewGossiper(
+				peer.DefaultGossiperOptions().
+					WithLogger(zap.NewNop()).
+					WithSigner(privKeys[0]),
+				channel.NewSyncFilter(),
+				transports[0])
+			contentID := id.NewHash([]byte("signed"))
+			gossiper.Gossip(ctx, contentID[:], nil)
+
+			var push wire.Msg
+			Eventually(pushes[1], 5*time.Second).Should(Receive(&push))
+			Expect(push.Verify(privKeys[0].Signatory())).To(Succeed())
+			Consistently(pushes[2], 500*time.Millisecond).ShouldNot(Receive())
+
+			// Unsigned pushes are sent to every remote peer, without the
+			// Headers that cannot be carried.
+			unsigned := peer.NewGossiper(peer.DefaultGossiperOptions().WithLogger(zap.NewNop()), channel.NewSyncFilter(), transports[0])
+			contentID = id.NewHash([]byte("unsigned"))
+			unsigned.Gossip(ctx, contentID[:], nil)
+			for i := 1; i < len(transports); i++ {
+				Eventually(pushes[i], 5*time.Second).Should(Receive(&push))
+				Expect(push.Data).To(Equal(contentID[:]))
+			}
+			Expect(push.Headers).To(BeEmpty())
+		})
+	})
+
+	Context("When a restarted peer catches up", func() {
+		It("should pull the content that was recently gossiped by its pinned peers", func() {
+			opts, peers, tables, contentResolvers, _, _ := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+
+			// The first peer gossips content before it knows about any other
+			// peers, so the content only reaches the second peer by catching
+			// up.
+			n := 20
+			for i := 0; i < n; i++ {
+				content := fmt.Sprintf("content %v", i)
+				contentID := id.NewHash([]byte(content))
+				contentResolvers[0].InsertContent(contentID[:], []byte(content))
+				peers[0].Gossip(ctx, contentID[:], &peer.DefaultSubnet)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(),
+				wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			reports := []peer.CatchUpProgress{}
+			progress, err := peers[1].CatchUp(ctx, []id.Signatory{opts[0].PrivKey.Signatory()}, func(p peer.CatchUpProgress) {
+				reports = append(reports, p)
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(progress).To(Equal(peer.CatchUpProgress{Peers: 1, Responded: 1, Wanted: n, Received: n}))
+			Expect(reports[len(reports)-1]).To(Equal(progress))
+			for i := 0; i < n; i++ {
+				content := fmt.Sprintf("content %v", i)
+				contentID := id.NewHash([]byte(content))
+				synced, ok := contentResolvers[1].QueryContent(contentID[:])
+				Expect(ok).To(BeTrue())
+				Expect(synced).To(Equal([]byte(content)))
+			}
+
+			// Content that is already known is not pulled again.
+			progress, err = peers[1].CatchUp(ctx, []id.Signatory{opts[0].PrivKey.Signatory()}, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(progress).To(Equal(peer.CatchUpProgress{Peers: 1, Responded: 1}))
+		})
+	})
 })
@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/id"
+
+	"go.uber.org/zap"
+)
+
+// An EvictionObserver is notified when the janitor evicts a remote peer from
+// the table, because it has been unreachable for longer than the eviction
+// timeout (see DiscoveryOptions.WithPeerEvictionTimeout). Methods are called
+// synchronously by the janitor, so implementations should return quickly.
+type EvictionObserver interface {
+	// OnEvicted is called after the remote peer has been deleted from the
+	// table, with its Liveness from just before it was deleted.
+	OnEvicted(remote id.Signatory, liveness dht.Liveness)
+}
+
+// CallbackEvictionObserver implements the EvictionObserver interface by
+// delegating to a callback function.
+type CallbackEvictionObserver func(id.Signatory, dht.Liveness)
+
+// OnEvicted calls the callback function.
+func (observer CallbackEvictionObserver) OnEvicted(remote id.Signatory, liveness dht.Liveness) {
+	observer(remote, liveness)
+}
+
+// EvictStalePeers runs the janitor until the context is done. Every stale peer
+// age (see DiscoveryOptions.WithStalePeerAge), remote peers that have not been
+// seen for at least that long are pinged, and every unanswered ping counts as
+// a failure. Remote peers that have failed, and that have not been seen for
+// the eviction timeout, are deleted from the table. Remote peers that are
+// connected are known to be alive, and remote peers that are in maintenance,
+// or going away, are expected to be unreachable, so none of them are pinged or
+// evicted. Stale peers are pinged concurrently, at most alpha at a time (see
+// DiscoveryOptions.WithAlpha), so that unreachable peers do not delay the
+// pings of the others.
+func (dc *DiscoveryClient) EvictStalePeers(ctx context.Context) {
+	if dc.opts.StalePeerAge <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(dc.opts.StalePeerAge)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		dc.evictStalePeers(ctx)
+	}
+}
+
+func (dc *DiscoveryClient) evictStalePeers(ctx context.Context) {
+	table := dc.transport.Table()
+	alpha := dc.opts.Alpha
+	if alpha <= 0 {
+		alpha = 1
+	}
+	sem := make(chan struct{}, alpha)
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+
+	for _, remote := range table.StalePeers(dc.opts.StalePeerAge) {
+		if dc.transport.IsConnected(remote) {
+			table.Seen(remote)
+			continue
+		}
+		if _, ok := dc.transport.IsGoingAway(remote); ok || dc.transport.InMaintenance(remote) {
+			continue
+		}
+
+		liveness, ok := table.Liveness(remote)
+		if !ok {
+			continue
+		}
+		if liveness.Failures > 0 && time.Since(liveness.LastSeen) >= dc.opts.PeerEvictionTimeout {
+			table.DeletePeer(remote)
+			dc.opts.Logger.Debug("evicted", zap.String("peer", remote.String()), zap.Time("last seen", liveness.LastSeen), zap.Int("failures", liveness.Failures))
+			if dc.opts.EvictionObserver != nil {
+				dc.opts.EvictionObserver.OnEvicted(remote, liveness)
+			}
+			continue
+		}
+
+		// The ping counts as a failure until the remote peer acknowledges it,
+		// which resets its failures.
+		table.Failed(remote)
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(remote id.Signatory) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			innerCtx, innerCancel := context.WithTimeout(ctx, dc.opts.PingTimePeriod)
+			defer innerCancel()
+			if err := dc.sendPing(innerCtx, remote, dc.pingMsg()); err != nil {
+				dc.opts.Logger.Debug("pinging stale peer", zap.String("peer", remote.String()), zap.Error(err))
+			}
+		}(remote)
+	}
+}
@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"math"
+
+	"github.com/renproject/id"
+)
+
+// A ZoneFunc returns the zone of a peer (for example, its datacenter or
+// region), and false if the zone of the peer is not known. Peers with unknown
+// zones are treated as remote.
+type ZoneFunc func(id.Signatory) (string, bool)
+
+// StaticZones returns a ZoneFunc that looks up zones from a fixed map, usually
+// loaded from configuration. The map is copied.
+func StaticZones(zones map[id.Signatory]string) ZoneFunc {
+	copied := make(map[id.Signatory]string, len(zones))
+	for peer, zone := range zones {
+		copied[peer] = zone
+	}
+	return func(peer id.Signatory) (string, bool) {
+		zone, ok := copied[peer]
+		return zone, ok
+	}
+}
+
+// Locality is used to bias the selection of peers towards peers that are in
+// the same zone as the local peer, while still selecting some peers from other
+// zones to preserve global connectivity. This reduces the bandwidth that is
+// used between zones, which is usually more expensive.
+type Locality struct {
+	// LocalZone is the zone of the local peer.
+	LocalZone string
+	// Zone returns the zone of remote peers. If it is nil, peers are selected
+	// without regard for locality.
+	Zone ZoneFunc
+	// LocalRatio is the fraction of selected peers that should be in the local
+	// zone. For example, a ratio of 0.75 when selecting 4 peers will select 3
+	// local peers and 1 remote peer, if there are enough of each.
+	LocalRatio float64
+}
+
+// Select n peers from the candidates. The candidates are expected to be in
+// order of preference, and this order is preserved within the local and remote
+// peers that are selected. If there are not enough local (or remote) peers to
+// satisfy the ratio, the remaining peers are selected from the other zones (or
+// the local zone).
+func (locality Locality) Select(candidates []id.Signatory, n int) []id.Signatory {
+	if n <= 0 {
+		return []id.Signatory{}
+	}
+	if locality.Zone == nil || len(candidates) <= n {
+		if len(candidates) > n {
+			candidates = candidates[:n]
+		}
+		selected := make([]id.Signatory, len(candidates))
+		copy(selected, candidates)
+		return selected
+	}
+
+	local := make([]id.Signatory, 0, len(candidates))
+	remote := make([]id.Signatory, 0, len(candidates))
+	for _, candidate := range candidates {
+		if zone, ok := locality.Zone(candidate); ok && zone == locality.LocalZone {
+			local = append(local, candidate)
+		} else {
+			remote = append(remote, candidate)
+		}
+	}
+
+	numLocal := int(math.Round(locality.LocalRatio * float64(n)))
+	if numLocal > len(local) {
+		numLocal = len(local)
+	}
+	if numRemote := n - numLocal; numRemote > len(remote) {
+		numLocal = n - len(remote)
+	}
+
+	selected := make([]id.Signatory, 0, n)
+	selected = append(selected, local[:numLocal]...)
+	selected = append(selected, remote[:n-numLocal]...)
+	return selected
+}
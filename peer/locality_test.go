@@ -0,0 +1,72 @@
+package peer_test
+
+import (
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Locality", func() {
+	newSignatories := func(n int) []id.Signatory {
+		sigs := make([]id.Signatory, n)
+		for i := range sigs {
+			sigs[i] = id.NewPrivKey().Signatory()
+		}
+		return sigs
+	}
+
+	Context("when there is no zone function", func() {
+		It("should select the first n candidates", func() {
+			candidates := newSignatories(5)
+			Expect(peer.Locality{}.Select(candidates, 3)).To(Equal(candidates[:3]))
+			Expect(peer.Locality{}.Select(candidates, 10)).To(Equal(candidates))
+		})
+	})
+
+	Context("when there are enough local and remote candidates", func() {
+		It("should select local and remote peers in the configured ratio", func() {
+			local := newSignatories(4)
+			remote := newSignatories(4)
+			zones := map[id.Signatory]string{}
+			for _, sig := range local {
+				zones[sig] = "us-east"
+			}
+			for _, sig := range remote {
+				zones[sig] = "eu-west"
+			}
+			candidates := []id.Signatory{remote[0], local[0], remote[1], local[1], local[2], remote[2], local[3], remote[3]}
+
+			locality := peer.Locality{LocalZone: "us-east", Zone: peer.StaticZones(zones), LocalRatio: 0.75}
+			Expect(locality.Select(candidates, 4)).To(Equal([]id.Signatory{local[0], local[1], local[2], remote[0]}))
+		})
+	})
+
+	Context("when there are not enough local candidates", func() {
+		It("should fill the remaining selection with remote peers", func() {
+			local := newSignatories(1)
+			remote := newSignatories(4)
+			zones := map[id.Signatory]string{local[0]: "us-east"}
+			candidates := append(append([]id.Signatory{}, remote...), local...)
+
+			locality := peer.Locality{LocalZone: "us-east", Zone: peer.StaticZones(zones), LocalRatio: 0.75}
+			Expect(locality.Select(candidates, 4)).To(Equal([]id.Signatory{local[0], remote[0], remote[1], remote[2]}))
+		})
+	})
+
+	Context("when there are not enough remote candidates", func() {
+		It("should fill the remaining selection with local peers", func() {
+			local := newSignatories(4)
+			remote := newSignatories(1)
+			zones := map[id.Signatory]string{}
+			for _, sig := range local {
+				zones[sig] = "us-east"
+			}
+			candidates := append(append([]id.Signatory{}, remote...), local...)
+
+			locality := peer.Locality{LocalZone: "us-east", Zone: peer.StaticZones(zones), LocalRatio: 0.25}
+			Expect(locality.Select(candidates, 4)).To(Equal([]id.Signatory{local[0], local[1], local[2], remote[0]}))
+		})
+	})
+})
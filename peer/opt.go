@@ -3,8 +3,13 @@ package peer
 import (
 	"time"
 
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/options"
+	"github.com/renproject/aw/transport"
 	"github.com/renproject/id"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 type SyncerOptions struct {
@@ -41,9 +46,20 @@ func (opts SyncerOptions) WithWiggleTimeout(timeout time.Duration) SyncerOptions
 }
 
 type GossiperOptions struct {
-	Logger  *zap.Logger
-	Alpha   int
-	Timeout time.Duration
+	Logger        *zap.Logger
+	Alpha         int
+	Timeout       time.Duration
+	PushRateLimit rate.Limit
+	PushBurst     int
+	Locality      Locality
+
+	SubnetAuthorizer  SubnetAuthorizer
+	PrivateContentTTL time.Duration
+
+	RecentContentSize int
+
+	GossipTTL uint8
+	Signer    handshake.Signer
 }
 
 func DefaultGossiperOptions() GossiperOptions {
@@ -52,9 +68,17 @@ func DefaultGossiperOptions() GossiperOptions {
 		panic(err)
 	}
 	return GossiperOptions{
-		Logger:  logger,
-		Alpha:   DefaultAlpha,
-		Timeout: DefaultTimeout,
+		Logger:        logger,
+		Alpha:         DefaultAlpha,
+		Timeout:       DefaultTimeout,
+		PushRateLimit: DefaultPushRateLimit,
+		PushBurst:     DefaultPushBurst,
+
+		PrivateContentTTL: DefaultPrivateContentTTL,
+
+		RecentContentSize: DefaultRecentContentSize,
+
+		GossipTTL: DefaultGossipTTL,
 	}
 }
 
@@ -73,11 +97,93 @@ func (opts GossiperOptions) WithTimeout(timeout time.Duration) GossiperOptions {
 	return opts
 }
 
+// WithLocality sets the Locality used to bias the selection of peers to which
+// content is gossiped. By default, locality is ignored.
+func (opts GossiperOptions) WithLocality(locality Locality) GossiperOptions {
+	opts.Locality = locality
+	return opts
+}
+
+// WithPushRateLimit sets the number of pushes for new content that will be
+// accepted, and forwarded, from each origin per second, and the number of such
+// pushes that can be accepted in a burst. The origin of a signed push is the
+// peer that signed it, and the origin of an unsigned push is the remote peer
+// that sent it. Pushes over the limit are dropped. By default, there is no
+// limit.
+func (opts GossiperOptions) WithPushRateLimit(limit rate.Limit, burst int) GossiperOptions {
+	opts.PushRateLimit = limit
+	opts.PushBurst = burst
+	return opts
+}
+
+// WithSubnetAuthorizer sets the SubnetAuthorizer used to restrict gossip for
+// private subnets to authorized peers. By default, all peers are authorized for
+// all subnets.
+func (opts GossiperOptions) WithSubnetAuthorizer(authorizer SubnetAuthorizer) GossiperOptions {
+	opts.SubnetAuthorizer = authorizer
+	return opts
+}
+
+// WithPrivateContentTTL sets how long content is remembered as belonging to a
+// private subnet after it was last gossiped. While it is remembered, pulls for
+// the content are only answered for peers that are authorized for the subnet.
+func (opts GossiperOptions) WithPrivateContentTTL(ttl time.Duration) GossiperOptions {
+	opts.PrivateContentTTL = ttl
+	return opts
+}
+
+// WithRecentContentSize sets the number of recently gossiped content IDs that
+// are remembered, and sent to remote peers that are catching up. It is also the
+// maximum number of content IDs that are accepted from each remote peer when
+// catching up. A non-positive size disables remembering content IDs.
+func (opts GossiperOptions) WithRecentContentSize(size int) GossiperOptions {
+	opts.RecentContentSize = size
+	return opts
+}
+
+// WithGossipTTL sets the number of times that gossip for new content can be
+// relayed between peers (see wire.Hops). Peers never relay gossip whose TTL
+// has expired, so gossip storms are bounded even if peers keep forgetting the
+// content. A TTL of zero sends gossip without a TTL, which is not bounded.
+func (opts GossiperOptions) WithGossipTTL(ttl uint8) GossiperOptions {
+	opts.GossipTTL = ttl
+	return opts
+}
+
+// WithSigner sets the Signer of the identity used to sign pushes for content
+// that is gossiped by this peer (see wire.Msg.Sign). Peers that relay the
+// content keep the signature, so that the content can be attributed to this
+// peer by peers that are not connected to it. Signed pushes are only sent to
+// remote peers whose selected wire version is wire.MsgVersion5 (or later),
+// because older versions cannot carry the signature (see
+// channel.Options.WithWireVersionSelector). By default, pushes are not
+// signed.
+func (opts GossiperOptions) WithSigner(signer handshake.Signer) GossiperOptions {
+	opts.Signer = signer
+	return opts
+}
+
 type DiscoveryOptions struct {
 	Logger           *zap.Logger
 	Alpha            int
 	MaxExpectedPeers int
 	PingTimePeriod   time.Duration
+	Locality         Locality
+
+	MaxMaintenanceWindow time.Duration
+
+	MaxConcurrentPeerLists int
+	PeerQuarantine         time.Duration
+	BucketRefreshInterval  time.Duration
+
+	StalePeerAge        time.Duration
+	PeerEvictionTimeout time.Duration
+	EvictionObserver    EvictionObserver
+
+	RequireSignedAddresses bool
+
+	MaxPeers  int
+	PeerScore dht.ScoreFunc
 }
 
 func DefaultDiscoveryOptions() DiscoveryOptions {
@@ -90,6 +196,15 @@ func DefaultDiscoveryOptions() DiscoveryOptions {
 		Alpha:            DefaultAlpha,
 		MaxExpectedPeers: DefaultAlpha,
 		PingTimePeriod:   DefaultTimeout,
+
+		MaxMaintenanceWindow: DefaultMaxMaintenanceWindow,
+
+		MaxConcurrentPeerLists: DefaultMaxConcurrentPeerLists,
+		PeerQuarantine:         DefaultPeerQuarantine,
+		BucketRefreshInterval:  DefaultBucketRefreshInterval,
+
+		StalePeerAge:        DefaultStalePeerAge,
+		PeerEvictionTimeout: DefaultPeerEvictionTimeout,
 	}
 }
 
@@ -113,6 +228,96 @@ func (opts DiscoveryOptions) WithPingTimePeriod(period time.Duration) DiscoveryO
 	return opts
 }
 
+// WithLocality sets the Locality used to bias the selection of peers that are
+// pinged during discovery. By default, locality is ignored.
+func (opts DiscoveryOptions) WithLocality(locality Locality) DiscoveryOptions {
+	opts.Locality = locality
+	return opts
+}
+
+// WithMaxMaintenanceWindow sets the longest maintenance window that will be
+// expected of a remote peer. Longer windows are shortened, so that remote
+// peers cannot avoid expiry indefinitely.
+func (opts DiscoveryOptions) WithMaxMaintenanceWindow(window time.Duration) DiscoveryOptions {
+	opts.MaxMaintenanceWindow = window
+	return opts
+}
+
+// WithMaxConcurrentPeerLists sets the maximum number of peer lists, received
+// in response to pings, that are validated and added to the table
+// concurrently. Peer lists are processed off the goroutine that received them,
+// so that long peer lists do not stall the receiving of other messages. Peer
+// lists that arrive while the maximum is reached are dropped, because peer
+// lists are received again on the next ping.
+func (opts DiscoveryOptions) WithMaxConcurrentPeerLists(max int) DiscoveryOptions {
+	opts.MaxConcurrentPeerLists = max
+	return opts
+}
+
+// WithPeerQuarantine sets how long remote peers that are learned from peer
+// lists are quarantined. A quarantined remote peer is removed from the table
+// the first time that dialing it fails after the quarantine, unless a network
+// connection to it has been established. A non-positive duration disables
+// quarantine.
+func (opts DiscoveryOptions) WithPeerQuarantine(quarantine time.Duration) DiscoveryOptions {
+	opts.PeerQuarantine = quarantine
+	return opts
+}
+
+// WithBucketRefreshInterval sets how long a bucket of the table can go without
+// being looked up, or updated, before it is refreshed. During discovery, the
+// closest peer to a random target in the range of every stale bucket is
+// pinged, so that peers in that bucket are learned from its response. A
+// non-positive interval refreshes every bucket on every round of pings.
+func (opts DiscoveryOptions) WithBucketRefreshInterval(interval time.Duration) DiscoveryOptions {
+	opts.BucketRefreshInterval = interval
+	return opts
+}
+
+// WithStalePeerAge sets how long a remote peer can go without being seen
+// before it is pinged by the janitor (see Peer.EvictStalePeers). The janitor
+// also runs this often. A non-positive age disables the janitor.
+func (opts DiscoveryOptions) WithStalePeerAge(age time.Duration) DiscoveryOptions {
+	opts.StalePeerAge = age
+	return opts
+}
+
+// WithPeerEvictionTimeout sets how long a remote peer can be unreachable
+// before it is evicted from the table by the janitor.
+func (opts DiscoveryOptions) WithPeerEvictionTimeout(timeout time.Duration) DiscoveryOptions {
+	opts.PeerEvictionTimeout = timeout
+	return opts
+}
+
+// WithEvictionObserver sets the EvictionObserver that is notified when the
+// janitor evicts a remote peer. By default, there is no EvictionObserver.
+func (opts DiscoveryOptions) WithEvictionObserver(observer EvictionObserver) DiscoveryOptions {
+	opts.EvictionObserver = observer
+	return opts
+}
+
+// WithRequireSignedAddresses sets whether entries of peer lists must have
+// signed network addresses. Unsigned network addresses are relayed by the
+// remote peer that sent the peer list, and can be forged by it. By default,
+// unsigned network addresses are accepted, because not all peers sign their
+// network addresses.
+func (opts DiscoveryOptions) WithRequireSignedAddresses(require bool) DiscoveryOptions {
+	opts.RequireSignedAddresses = require
+	return opts
+}
+
+// WithMaxPeers bounds the number of remote peers in the table, so that remote
+// peers cannot exhaust memory, or crowd out good peers, by spraying peer lists
+// with fake network addresses (see dht.InMemTable.SetMaxPeers). When the table
+// is full, new remote peers only evict remote peers that have never been seen,
+// or that have failed repeatedly. A nil ScoreFunc uses the dht.DefaultScore.
+// By default, the table is not bounded.
+func (opts DiscoveryOptions) WithMaxPeers(max int, score dht.ScoreFunc) DiscoveryOptions {
+	opts.MaxPeers = max
+	opts.PeerScore = score
+	return opts
+}
+
 type Options struct {
 	SyncerOptions
 	GossiperOptions
@@ -120,6 +325,8 @@ type Options struct {
 
 	Logger  *zap.Logger
 	PrivKey *id.PrivKey
+
+	MinFileDescriptors uint64
 }
 
 func DefaultOptions() Options {
@@ -135,6 +342,8 @@ func DefaultOptions() Options {
 
 		Logger:  logger,
 		PrivKey: privKey,
+
+		MinFileDescriptors: DefaultMinFileDescriptors,
 	}
 }
 
@@ -153,6 +362,20 @@ func (opts Options) WithDiscoveryOptions(discoveryOptions DiscoveryOptions) Opti
 	return opts
 }
 
+// WithLocality sets the Locality used by both gossiping and discovery.
+func (opts Options) WithLocality(locality Locality) Options {
+	opts.GossiperOptions.Locality = locality
+	opts.DiscoveryOptions.Locality = locality
+	return opts
+}
+
+// WithMaxPeers bounds the number of remote peers in the table of the Peer (see
+// DiscoveryOptions.WithMaxPeers).
+func (opts Options) WithMaxPeers(max int, score dht.ScoreFunc) Options {
+	opts.DiscoveryOptions = opts.DiscoveryOptions.WithMaxPeers(max, score)
+	return opts
+}
+
 func (opts Options) WithLogger(logger *zap.Logger) Options {
 	opts.Logger = logger
 	return opts
@@ -162,3 +385,48 @@ func (opts Options) WithPrivKey(privKey *id.PrivKey) Options {
 	opts.PrivKey = privKey
 	return opts
 }
+
+// WithMinFileDescriptors sets the minimum limit on open file descriptors that
+// is accepted by the self-test (see Peer.SelfTest). Every connection needs a
+// file descriptor, so this should be comfortably above the expected number of
+// connected peers.
+func (opts Options) WithMinFileDescriptors(min uint64) Options {
+	opts.MinFileDescriptors = min
+	return opts
+}
+
+// An Option changes Options. Options are passed to NewWith, so that new
+// options can be added without changing its signature.
+type Option func(Options) Options
+
+// With returns the Options changed by each Option, in order.
+func (opts Options) With(changes ...Option) Options {
+	for _, change := range changes {
+		opts = change(opts)
+	}
+	return opts
+}
+
+// FromOptions returns an Option that replaces all Options. It adapts Options
+// that were built using the With methods.
+func FromOptions(opts Options) Option {
+	return func(Options) Options { return opts }
+}
+
+// DecodeOptions returns an Option that decodes JSON configuration on top of
+// Options (see options.Decode). Keys that do not match an option are ignored.
+func DecodeOptions(data []byte) (Option, error) {
+	decode, err := options.Compile(data, &Options{})
+	if err != nil {
+		return nil, err
+	}
+	return func(opts Options) Options {
+		decode(&opts)
+		return opts
+	}, nil
+}
+
+// NewWith returns a Peer that uses the DefaultOptions, changed by the Options.
+func NewWith(transport *transport.Transport, changes ...Option) *Peer {
+	return New(DefaultOptions().With(changes...), transport)
+}
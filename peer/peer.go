@@ -11,6 +11,7 @@ import (
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -18,10 +19,32 @@ var (
 	DefaultAlpha         = 5
 	DefaultTimeout       = time.Second
 	DefaultGossipTimeout = 3 * time.Second
+	DefaultPushRateLimit = rate.Inf
+	DefaultPushBurst     = 0
+
+	DefaultPrivateContentTTL = time.Minute
+	DefaultGossipTTL         = uint8(16)
+	DefaultRecentContentSize = 1024
+
+	DefaultMaxMaintenanceWindow = 10 * time.Minute
+
+	DefaultMaxConcurrentPeerLists = 4
+	DefaultPeerQuarantine         = time.Minute
+	DefaultBucketRefreshInterval  = time.Hour
+	DefaultStalePeerAge           = time.Minute
+	DefaultPeerEvictionTimeout    = 10 * time.Minute
+
+	DefaultMinFileDescriptors = uint64(1024)
 )
 
+// MaxDrainReasonLen is the maximum length, in bytes, of the reason given when
+// announcing that a Peer is about to drain.
+const MaxDrainReasonLen = 256
+
 var (
-	ErrPeerNotFound = errors.New("peer not found")
+	ErrPeerNotFound       = errors.New("peer not found")
+	ErrSubnetUnauthorized = errors.New("subnet unauthorized")
+	ErrCatchUpInProgress  = errors.New("catch up in progress")
 )
 
 type Peer struct {
@@ -59,14 +82,62 @@ func (p *Peer) Transport() *transport.Transport {
 	return p.transport
 }
 
-func (p *Peer) Link(remote id.Signatory) {
-	p.transport.Link(remote)
+func (p *Peer) Link(remote id.Signatory) error {
+	return p.transport.Link(remote)
 }
 
 func (p *Peer) Unlink(remote id.Signatory) {
 	p.transport.Unlink(remote)
 }
 
+// Reconnect closes the current network connection with a remote peer, and
+// dials it again (see transport.Transport.Reconnect).
+func (p *Peer) Reconnect(ctx context.Context, remote id.Signatory) error {
+	return p.transport.Reconnect(ctx, remote)
+}
+
+// UpdateAddress signs a new network address for the local peer, and pushes it
+// to all remote peers that are currently connected.
+func (p *Peer) UpdateAddress(ctx context.Context, addr wire.Address) error {
+	if err := addr.Sign(p.opts.PrivKey); err != nil {
+		return fmt.Errorf("signing address: %v", err)
+	}
+	return p.discoveryClient.PushAddress(ctx, addr)
+}
+
+// UpdateAddresses signs new network addresses for the local peer (for example,
+// TCP and WebSocket, or IPv4 and IPv6), and pushes them to all remote peers
+// that are currently connected. The addresses are in order of priority, and
+// must all have the same nonce.
+func (p *Peer) UpdateAddresses(ctx context.Context, addrs []wire.Address) error {
+	for i := range addrs {
+		if err := addrs[i].Sign(p.opts.PrivKey); err != nil {
+			return fmt.Errorf("signing address: %v", err)
+		}
+	}
+	return p.discoveryClient.PushAddresses(ctx, addrs)
+}
+
+// ScheduleMaintenance marks a maintenance window for the local peer, and
+// notifies all remote peers that are currently connected, so that they expect
+// the local peer to be briefly unavailable (for example, while it restarts).
+func (p *Peer) ScheduleMaintenance(ctx context.Context, window time.Duration) error {
+	return p.discoveryClient.ScheduleMaintenance(ctx, window)
+}
+
+// Drain the Peer gracefully before a restart (see transport.Transport.Drain).
+func (p *Peer) Drain(ctx context.Context) error {
+	return p.transport.Drain(ctx)
+}
+
+// AnnounceDraining notifies all remote peers that are currently connected that
+// the Peer expects to begin draining after the given duration, and why, so
+// that they can send traffic to other remote peers instead. It should be
+// followed by a call to Drain.
+func (p *Peer) AnnounceDraining(ctx context.Context, reason string, eta time.Duration) error {
+	return p.discoveryClient.AnnounceDraining(ctx, reason, eta)
+}
+
 func (p *Peer) Ping(ctx context.Context) error {
 	return fmt.Errorf("unimplemented")
 }
@@ -75,6 +146,14 @@ func (p *Peer) Send(ctx context.Context, to id.Signatory, msg wire.Msg) error {
 	return p.transport.Send(ctx, to, msg)
 }
 
+func (p *Peer) SendWithPriority(ctx context.Context, to id.Signatory, msg wire.Msg, priority channel.Priority) error {
+	return p.transport.SendWithPriority(ctx, to, msg, priority)
+}
+
+func (p *Peer) SendWithOptions(ctx context.Context, to id.Signatory, msg wire.Msg, opts channel.SendOptions) error {
+	return p.transport.SendWithOptions(ctx, to, msg, opts)
+}
+
 func (p *Peer) Sync(ctx context.Context, contentID []byte, hint *id.Signatory) ([]byte, error) {
 	return p.syncer.Sync(ctx, contentID, hint)
 }
@@ -83,12 +162,40 @@ func (p *Peer) Gossip(ctx context.Context, contentID []byte, subnet *id.Hash) {
 	p.gossiper.Gossip(ctx, contentID, subnet)
 }
 
+// CatchUp pulls recently gossiped content from the given remote peers (see
+// Gossiper.CatchUp). It should be called after Run, but before the Peer begins
+// gossiping, so that a restarted Peer does not have to wait for gossip to
+// reach it.
+func (p *Peer) CatchUp(ctx context.Context, peers []id.Signatory, progress func(CatchUpProgress)) (CatchUpProgress, error) {
+	return p.gossiper.CatchUp(ctx, peers, progress)
+}
+
+// Bootstrapper returns a dht.Bootstrapper that populates the table of the
+// Peer from the seeds, by pinging them and adding the peer lists from their
+// ping acks (see DiscoveryClient.Pull). The Peer must be running.
+func (p *Peer) Bootstrapper(opts dht.BootstrapperOptions, seeds []wire.SignatoryAndAddress) *dht.Bootstrapper {
+	return dht.NewBootstrapper(opts, p.transport.Table(), seeds, p.discoveryClient.Pull)
+}
+
 func (p *Peer) DiscoverPeers(ctx context.Context) {
 	p.discoveryClient.DiscoverPeers(ctx)
 }
 
+// EvictStalePeers pings stale remote peers, and evicts the ones that have been
+// unreachable for too long, until the context is done (see
+// DiscoveryClient.EvictStalePeers).
+func (p *Peer) EvictStalePeers(ctx context.Context) {
+	p.discoveryClient.EvictStalePeers(ctx)
+}
+
 func (p *Peer) Run(ctx context.Context) {
 	p.transport.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+		// Messages sent on streams belong to their stream receivers (for
+		// example, the contentsync package sends push and pull messages on its
+		// own stream), so they must not be mistaken for gossip.
+		if packet.Msg.Version >= wire.MsgVersion2 && packet.Msg.Stream != 0 {
+			return nil
+		}
 		// TODO(ross): Think about merging the syncer and the gossiper.
 		if err := p.syncer.DidReceiveMessage(from, packet.Msg); err != nil {
 			return err
@@ -108,6 +215,18 @@ func (p *Peer) Receive(ctx context.Context, f func(id.Signatory, wire.Packet) er
 	p.transport.Receive(ctx, f)
 }
 
+func (p *Peer) ReceiveBorrowed(ctx context.Context, f func(id.Signatory, *channel.BorrowedPacket) error) {
+	p.transport.ReceiveBorrowed(ctx, f)
+}
+
+func (p *Peer) SendOnStream(ctx context.Context, to id.Signatory, stream uint16, msg wire.Msg) error {
+	return p.transport.SendOnStream(ctx, to, stream, msg)
+}
+
+func (p *Peer) ReceiveStream(ctx context.Context, stream uint16, f func(id.Signatory, wire.Packet) error) {
+	p.transport.ReceiveStream(ctx, stream, f)
+}
+
 func (p *Peer) Resolve(ctx context.Context, contentResolver dht.ContentResolver) {
 	p.gossiper.Resolve(contentResolver)
 }
@@ -5,8 +5,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
@@ -19,24 +21,142 @@ type DiscoveryClient struct {
 	opts DiscoveryOptions
 
 	transport *transport.Transport
+
+	// peerLists bounds the number of peer lists that are processed
+	// concurrently.
+	peerLists chan struct{}
+
+	// pulls are waiting for the next ping ack from a remote peer (see Pull).
+	pullsMu *sync.Mutex
+	pulls   map[id.Signatory][]chan []wire.SignatoryAndAddress
+
+	// pings are the times at which pings were sent to remote peers, so that
+	// the latency to them can be measured from their ping acks.
+	pingsMu *sync.Mutex
+	pings   map[id.Signatory]time.Time
+
+	// reads are the number of bytes that had been read from the network
+	// connections to remote peers when they were last sampled, so that the
+	// throughput of remote peers can be measured over the time between
+	// samples.
+	readsMu *sync.Mutex
+	reads   map[id.Signatory]readSample
+}
+
+// A readSample is the number of bytes that had been read from a network
+// connection at a point in time.
+type readSample struct {
+	attachedAt time.Time
+	bytes      uint64
+	at         time.Time
+}
+
+// A boundedTable is a dht.Table whose number of peers can be bounded (see
+// dht.InMemTable.SetMaxPeers).
+type boundedTable interface {
+	SetMaxPeers(maxPeers int, score dht.ScoreFunc)
 }
 
 func NewDiscoveryClient(opts DiscoveryOptions, transport *transport.Transport) *DiscoveryClient {
+	maxPeerLists := opts.MaxConcurrentPeerLists
+	if maxPeerLists < 1 {
+		maxPeerLists = 1
+	}
+	if opts.MaxPeers > 0 {
+		if table, ok := transport.Table().(boundedTable); ok {
+			table.SetMaxPeers(opts.MaxPeers, opts.PeerScore)
+		} else {
+			opts.Logger.Warn("table cannot be bounded", zap.Int("max peers", opts.MaxPeers))
+		}
+	}
 	return &DiscoveryClient{
 		opts:      opts,
 		transport: transport,
+
+		peerLists: make(chan struct{}, maxPeerLists),
+
+		pullsMu: new(sync.Mutex),
+		pulls:   map[id.Signatory][]chan []wire.SignatoryAndAddress{},
+
+		pingsMu: new(sync.Mutex),
+		pings:   map[id.Signatory]time.Time{},
+
+		readsMu: new(sync.Mutex),
+		reads:   map[id.Signatory]readSample{},
 	}
 }
 
-func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
+// pingMsg returns a ping message, which carries the port on which the local
+// peer is listening.
+func (dc *DiscoveryClient) pingMsg() wire.Msg {
 	var pingData [2]byte
 	binary.LittleEndian.PutUint16(pingData[:], dc.transport.Port())
 
-	msg := wire.Msg{
+	return wire.Msg{
 		Version: wire.MsgVersion1,
 		Type:    wire.MsgTypePing,
 		Data:    pingData[:],
 	}
+}
+
+// sendPing sends a ping message to a remote peer, and remembers when it was
+// sent. Pings that are not acknowledged within the ping time period are
+// forgotten.
+func (dc *DiscoveryClient) sendPing(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	msg.To = id.Hash(remote)
+	if err := dc.transport.Send(ctx, remote, msg); err != nil {
+		return err
+	}
+
+	dc.pingsMu.Lock()
+	defer dc.pingsMu.Unlock()
+
+	now := time.Now()
+	for sig, sent := range dc.pings {
+		if now.Sub(sent) > dc.opts.PingTimePeriod {
+			delete(dc.pings, sig)
+		}
+	}
+	dc.pings[remote] = now
+	return nil
+}
+
+// observePingAck records the time since the last ping was sent to the remote
+// peer in the table as its latency (see dht.Table.ObserveLatency).
+func (dc *DiscoveryClient) observePingAck(remote id.Signatory) {
+	dc.pingsMu.Lock()
+	sent, ok := dc.pings[remote]
+	delete(dc.pings, remote)
+	dc.pingsMu.Unlock()
+
+	if rtt := time.Since(sent); ok && rtt <= dc.opts.PingTimePeriod {
+		dc.transport.Table().ObserveLatency(remote, rtt)
+	}
+}
+
+// sampleThroughput records the number of bytes read from the network
+// connection to every remote peer in the table since the last sample as its
+// throughput over the time between the samples (see
+// dht.Table.ObserveThroughput). Network connections that were replaced since
+// the last sample are not measured until the next sample.
+func (dc *DiscoveryClient) sampleThroughput() {
+	dc.readsMu.Lock()
+	defer dc.readsMu.Unlock()
+
+	now := time.Now()
+	reads := make(map[id.Signatory]readSample, len(dc.reads))
+	for _, conn := range dc.transport.Client().Connections() {
+		sample := readSample{attachedAt: conn.AttachedAt, bytes: conn.BytesReceived, at: now}
+		if last, ok := dc.reads[conn.Remote]; ok && last.attachedAt.Equal(sample.attachedAt) && sample.bytes >= last.bytes {
+			dc.transport.Table().ObserveThroughput(conn.Remote, int(sample.bytes-last.bytes), now.Sub(last.at))
+		}
+		reads[conn.Remote] = sample
+	}
+	dc.reads = reads
+}
+
+func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
+	msg := dc.pingMsg()
 
 	ticker := time.NewTicker(dc.opts.PingTimePeriod)
 	defer ticker.Stop()
@@ -45,12 +165,26 @@ func (dc *DiscoveryClient) DiscoverPeers(ctx context.Context) {
 	sendDuration := dc.opts.PingTimePeriod / time.Duration(alpha)
 Outer:
 	for {
-		for _, sig := range dc.transport.Table().Peers(alpha) {
+		// Pings are sent once per time period, so the throughput of remote
+		// peers is measured over about the same period.
+		dc.sampleThroughput()
+
+		peers := []id.Signatory{}
+		if dc.opts.Locality.Zone == nil {
+			peers = dc.transport.Table().Peers(alpha)
+		} else {
+			peers = dc.opts.Locality.Select(dc.transport.Table().Peers(dc.transport.Table().NumPeers()), alpha)
+		}
+		peers = dc.appendRefreshPeers(peers)
+		for _, sig := range peers {
+			if dc.transport.InMaintenance(sig) {
+				// Avoid dialing peers during maintenance windows.
+				continue
+			}
 			err := func() error {
 				innerCtx, innerCancel := context.WithTimeout(ctx, sendDuration)
 				defer innerCancel()
-				msg.To = id.Hash(sig)
-				return dc.transport.Send(innerCtx, sig, msg)
+				return dc.sendPing(innerCtx, sig, msg)
 			}()
 			if err != nil {
 				dc.opts.Logger.Debug("pinging", zap.Error(err))
@@ -72,7 +206,72 @@ Outer:
 	}
 }
 
+// Pull pings a remote peer, and returns the peer list from its ping ack,
+// without validating it. The peer list is also added to the table in the
+// same way as during discovery. It implements dht.PullFunc, so that it can be
+// used to bootstrap the table from seeds (see dht.Bootstrapper).
+func (dc *DiscoveryClient) Pull(ctx context.Context, remote id.Signatory) ([]wire.SignatoryAndAddress, error) {
+	ack := make(chan []wire.SignatoryAndAddress, 1)
+	dc.pullsMu.Lock()
+	dc.pulls[remote] = append(dc.pulls[remote], ack)
+	dc.pullsMu.Unlock()
+	defer func() {
+		dc.pullsMu.Lock()
+		defer dc.pullsMu.Unlock()
+		acks := dc.pulls[remote]
+		for i := range acks {
+			if acks[i] == ack {
+				acks = append(acks[:i], acks[i+1:]...)
+				break
+			}
+		}
+		if len(acks) == 0 {
+			delete(dc.pulls, remote)
+		} else {
+			dc.pulls[remote] = acks
+		}
+	}()
+
+	if err := dc.sendPing(ctx, remote, dc.pingMsg()); err != nil {
+		return nil, fmt.Errorf("pinging %v: %w", remote, err)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("pulling %v: %w", remote, ctx.Err())
+	case list := <-ack:
+		return list, nil
+	}
+}
+
+// appendRefreshPeers appends the closest peer to the target of every stale
+// bucket (see dht.Table.RefreshTargets), unless it is already in the list of
+// peers that will be pinged.
+func (dc *DiscoveryClient) appendRefreshPeers(peers []id.Signatory) []id.Signatory {
+	table := dc.transport.Table()
+	for _, target := range table.RefreshTargets(dc.opts.BucketRefreshInterval) {
+		closest := table.Closest(target, 1)
+		if len(closest) == 0 {
+			continue
+		}
+		found := false
+		for _, sig := range peers {
+			if sig.Equal(&closest[0]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			peers = append(peers, closest[0])
+		}
+	}
+	return peers
+}
+
 func (dc *DiscoveryClient) DidReceiveMessage(from id.Signatory, ipAddr net.Addr, msg wire.Msg) error {
+	// Every message from a remote peer shows that it is alive.
+	dc.transport.Table().Seen(from)
+	dc.transport.ForgetGoingAway(from)
+
 	switch msg.Type {
 	case wire.MsgTypePing:
 		if err := dc.didReceivePing(from, ipAddr, msg); err != nil {
@@ -82,6 +281,144 @@ func (dc *DiscoveryClient) DidReceiveMessage(from id.Signatory, ipAddr net.Addr,
 		if err := dc.didReceivePingAck(from, msg); err != nil {
 			return err
 		}
+	case wire.MsgTypeAddressUpdate:
+		if err := dc.didReceiveAddressUpdate(from, msg); err != nil {
+			return err
+		}
+	case wire.MsgTypeAddressesUpdate:
+		if err := dc.didReceiveAddressesUpdate(from, msg); err != nil {
+			return err
+		}
+	case wire.MsgTypeMaintenance:
+		if err := dc.didReceiveMaintenance(from, msg); err != nil {
+			return err
+		}
+	case wire.MsgTypeGoingAway:
+		if err := dc.didReceiveGoingAway(from, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushAddress sends a new network address for the local peer to all remote
+// peers that are currently connected, so that they can update their tables
+// immediately, instead of waiting for the previous network address to expire.
+// The Address must be signed by the local peer, and must have a greater nonce
+// than the previous Address, otherwise it will be ignored by remote peers.
+func (dc *DiscoveryClient) PushAddress(ctx context.Context, addr wire.Address) error {
+	addrBytes, err := surge.ToBinary(addr)
+	if err != nil {
+		return fmt.Errorf("bad address update: %v", err)
+	}
+	msg := wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeAddressUpdate,
+		Data:    addrBytes,
+	}
+	dc.pushToConnected(ctx, msg)
+	return nil
+}
+
+// PushAddresses sends new network addresses for the local peer, in order of
+// priority, to all remote peers that are currently connected. The Addresses
+// must be signed by the local peer, and must all have the same nonce, which
+// must be greater than the nonce of the previous Addresses, otherwise they
+// will be ignored by remote peers (see wire.VerifyAddresses).
+func (dc *DiscoveryClient) PushAddresses(ctx context.Context, addrs []wire.Address) error {
+	if err := wire.VerifyAddresses(addrs, dc.transport.Self()); err != nil {
+		return fmt.Errorf("bad addresses update: %v", err)
+	}
+	addrsBytes, err := surge.ToBinary(addrs)
+	if err != nil {
+		return fmt.Errorf("bad addresses update: %v", err)
+	}
+	msg := wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeAddressesUpdate,
+		Data:    addrsBytes,
+	}
+	dc.pushToConnected(ctx, msg)
+	return nil
+}
+
+// pushToConnected sends the message to all remote peers that are currently
+// connected, and logs failures.
+func (dc *DiscoveryClient) pushToConnected(ctx context.Context, msg wire.Msg) {
+	table := dc.transport.Table()
+	remotes := []id.Signatory{}
+	for _, sig := range table.Peers(table.NumPeers()) {
+		if dc.transport.IsConnected(sig) {
+			remotes = append(remotes, sig)
+		}
+	}
+	for remote, err := range dc.transport.SendToMany(ctx, remotes, msg) {
+		dc.opts.Logger.Debug("pushing address", zap.String("peer", remote.String()), zap.Error(err))
+	}
+}
+
+// ScheduleMaintenance marks a maintenance window for the local peer, and sends
+// it to all remote peers that are currently connected. During the window,
+// neither the local peer nor the remote peers will expire each other when
+// dialing fails, or ping each other during discovery.
+func (dc *DiscoveryClient) ScheduleMaintenance(ctx context.Context, window time.Duration) error {
+	if window <= 0 {
+		return fmt.Errorf("bad maintenance window: %v", window)
+	}
+	dc.transport.ScheduleMaintenance(window)
+
+	var windowData [8]byte
+	binary.BigEndian.PutUint64(windowData[:], uint64(window/time.Millisecond))
+	msg := wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeMaintenance,
+		Data:    windowData[:],
+	}
+
+	table := dc.transport.Table()
+	remotes := []id.Signatory{}
+	for _, sig := range table.Peers(table.NumPeers()) {
+		if dc.transport.IsConnected(sig) {
+			remotes = append(remotes, sig)
+		}
+	}
+	for remote, err := range dc.transport.SendToMany(ctx, remotes, msg) {
+		dc.opts.Logger.Debug("scheduling maintenance", zap.String("peer", remote.String()), zap.Error(err))
+	}
+	return nil
+}
+
+// AnnounceDraining sends an announcement to all remote peers that are
+// currently connected, telling them that the local peer expects to begin
+// draining after the given duration, and why. Remote peers stop gossiping to
+// the local peer, and do not expire it while it is unavailable, for at most
+// the announced duration plus the longest maintenance window. The reason is
+// truncated to MaxDrainReasonLen bytes.
+func (dc *DiscoveryClient) AnnounceDraining(ctx context.Context, reason string, eta time.Duration) error {
+	if eta < 0 {
+		return fmt.Errorf("bad drain eta: %v", eta)
+	}
+	if len(reason) > MaxDrainReasonLen {
+		reason = reason[:MaxDrainReasonLen]
+	}
+	data := make([]byte, 8+len(reason))
+	binary.BigEndian.PutUint64(data, uint64(eta/time.Millisecond))
+	copy(data[8:], reason)
+	msg := wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeGoingAway,
+		Data:    data,
+	}
+
+	table := dc.transport.Table()
+	remotes := []id.Signatory{}
+	for _, sig := range table.Peers(table.NumPeers()) {
+		if dc.transport.IsConnected(sig) {
+			remotes = append(remotes, sig)
+		}
+	}
+	for remote, err := range dc.transport.SendToMany(ctx, remotes, msg) {
+		dc.opts.Logger.Debug("announcing drain", zap.String("peer", remote.String()), zap.Error(err))
 	}
 	return nil
 }
@@ -103,13 +440,17 @@ func (dc *DiscoveryClient) didReceivePing(from id.Signatory, ipAddr net.Addr, ms
 	peers := dc.transport.Table().Peers(dc.opts.MaxExpectedPeers)
 	addrAndSig := make([]wire.SignatoryAndAddress, 0, len(peers))
 	for _, sig := range peers {
-		addr, addrOk := dc.transport.Table().PeerAddress(sig)
-		if !addrOk {
+		addrs, addrsOk := dc.transport.Table().PeerAddresses(sig)
+		if !addrsOk {
 			dc.opts.Logger.DPanic("acking ping", zap.String("peer", "does not exist in table"))
 			continue
 		}
-		sigAndAddr := wire.SignatoryAndAddress{Signatory: sig, Address: addr}
-		addrAndSig = append(addrAndSig, sigAndAddr)
+		// Peers with many network addresses have one entry per network
+		// address, in order of priority.
+		for _, addr := range addrs {
+			sigAndAddr := wire.SignatoryAndAddress{Signatory: sig, Address: addr}
+			addrAndSig = append(addrAndSig, sigAndAddr)
+		}
 	}
 
 	addrAndSigBytes, err := surge.ToBinary(addrAndSig)
@@ -134,9 +475,98 @@ func (dc *DiscoveryClient) didReceivePingAck(from id.Signatory, msg wire.Msg) er
 	if err != nil {
 		return fmt.Errorf("bad ping ack: %v", err)
 	}
+	dc.observePingAck(from)
+
+	dc.pullsMu.Lock()
+	for _, ack := range dc.pulls[from] {
+		select {
+		case ack <- slice:
+		default:
+		}
+	}
+	dc.pullsMu.Unlock()
+
+	select {
+	case dc.peerLists <- struct{}{}:
+	default:
+		dc.opts.Logger.Debug("dropping peer list", zap.String("peer", from.String()), zap.Int("received", len(slice)))
+		return nil
+	}
+	go func() {
+		defer func() { <-dc.peerLists }()
+		dc.addPeerList(from, slice)
+	}()
+	return nil
+}
 
-	for _, x := range slice {
-		dc.transport.Table().AddPeer(x.Signatory, x.Address)
+func (dc *DiscoveryClient) didReceiveAddressUpdate(from id.Signatory, msg wire.Msg) error {
+	addr := wire.Address{}
+	if err := surge.FromBinary(&addr, msg.Data); err != nil {
+		return fmt.Errorf("bad address update: %v", err)
+	}
+	if err := addr.Verify(from); err != nil {
+		return fmt.Errorf("bad address update: %v", err)
+	}
+
+	// Ignore updates that do not supersede the current network address. This
+	// prevents old updates from being replayed. Signed updates always replace
+	// unsigned network addresses (for example, the network address observed
+	// when the remote peer pinged us).
+	if current, ok := dc.transport.Table().PeerAddress(from); ok && !addr.Supersedes(&current) {
+		return nil
+	}
+	dc.transport.Table().AddPeer(from, addr)
+	return nil
+}
+
+func (dc *DiscoveryClient) didReceiveAddressesUpdate(from id.Signatory, msg wire.Msg) error {
+	addrs := []wire.Address{}
+	if err := surge.FromBinary(&addrs, msg.Data); err != nil {
+		return fmt.Errorf("bad addresses update: %v", err)
+	}
+	if err := wire.VerifyAddresses(addrs, from); err != nil {
+		return fmt.Errorf("bad addresses update: %v", err)
+	}
+
+	// Ignore updates that do not supersede the current network addresses, in
+	// the same way as single address updates.
+	if current, ok := dc.transport.Table().PeerAddress(from); ok && !addrs[0].Supersedes(&current) {
+		return nil
+	}
+	dc.transport.Table().AddPeerAddresses(from, addrs)
+	return nil
+}
+
+func (dc *DiscoveryClient) didReceiveMaintenance(from id.Signatory, msg wire.Msg) error {
+	if dataLen := len(msg.Data); dataLen != 8 {
+		return fmt.Errorf("malformed window received in maintenance message. expected: 8 bytes, received: %v bytes", dataLen)
+	}
+	window := dc.opts.MaxMaintenanceWindow
+	if millis := binary.BigEndian.Uint64(msg.Data); millis < uint64(window/time.Millisecond) {
+		window = time.Duration(millis) * time.Millisecond
+	}
+	dc.transport.ExpectMaintenance(from, window)
+	return nil
+}
+
+func (dc *DiscoveryClient) didReceiveGoingAway(from id.Signatory, msg wire.Msg) error {
+	// Peers that are going away are expected to be unavailable while they
+	// restart, for at most the longest maintenance window. Announcements made
+	// ahead of draining extend the window by the time until draining begins.
+	eta := time.Duration(0)
+	reason := ""
+	if len(msg.Data) > 0 {
+		if dataLen := len(msg.Data); dataLen < 8 || dataLen > 8+MaxDrainReasonLen {
+			return fmt.Errorf("malformed going away message. expected: 8 to %v bytes, received: %v bytes", 8+MaxDrainReasonLen, dataLen)
+		}
+		if millis := binary.BigEndian.Uint64(msg.Data); millis < uint64(dc.opts.MaxMaintenanceWindow/time.Millisecond) {
+			eta = time.Duration(millis) * time.Millisecond
+		} else {
+			eta = dc.opts.MaxMaintenanceWindow
+		}
+		reason = string(msg.Data[8:])
 	}
+	dc.transport.ExpectGoingAway(from, transport.GoingAway{Reason: reason, At: time.Now().Add(eta)})
+	dc.transport.ExpectMaintenance(from, eta+dc.opts.MaxMaintenanceWindow)
 	return nil
 }
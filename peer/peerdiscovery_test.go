@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"go.uber.org/zap"
+	"net"
 	"time"
 
 	"github.com/renproject/aw/dht"
@@ -12,6 +13,7 @@ import (
 	"github.com/renproject/aw/transport"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
+	"github.com/renproject/surge"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -193,4 +195,395 @@ var _ = Describe("Peer Discovery", func() {
 			}(ctx)
 		})
 	})
+
+	Context("when a peer updates its address", func() {
+		It("should update the tables of connected peers", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).To(Succeed())
+			Eventually(func() bool { return transports[0].IsConnected(peers[1].ID()) }).Should(BeTrue())
+
+			addr := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", uint64(time.Now().UnixNano()))
+			Expect(peers[0].UpdateAddress(ctx, addr)).To(Succeed())
+			Eventually(func() string {
+				addr, _ := tables[1].PeerAddress(peers[0].ID())
+				return addr.Value
+			}, 5*time.Second).Should(Equal("10.0.0.1:3333"))
+		})
+
+		It("should reject updates that are not signed by the peer, and ignore stale updates", func() {
+			privKey := id.NewPrivKey()
+			_, _, tables, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()), transports[0])
+
+			update := func(addr wire.Address) wire.Msg {
+				data, err := surge.ToBinary(addr)
+				Expect(err).ToNot(HaveOccurred())
+				return wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeAddressUpdate, Data: data}
+			}
+
+			newer := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 2)
+			Expect(newer.Sign(id.NewPrivKey())).To(Succeed())
+			Expect(dc.DidReceiveMessage(privKey.Signatory(), nil, update(newer))).ToNot(Succeed())
+
+			Expect(newer.Sign(privKey)).To(Succeed())
+			Expect(dc.DidReceiveMessage(privKey.Signatory(), nil, update(newer))).To(Succeed())
+
+			older := wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 1)
+			Expect(older.Sign(privKey)).To(Succeed())
+			Expect(dc.DidReceiveMessage(privKey.Signatory(), nil, update(older))).To(Succeed())
+
+			addr, ok := tables[0].PeerAddress(privKey.Signatory())
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(newer))
+		})
+
+		It("should update all network addresses of peers with many network addresses", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).To(Succeed())
+			Eventually(func() bool { return transports[0].IsConnected(peers[1].ID()) }).Should(BeTrue())
+
+			nonce := uint64(time.Now().UnixNano())
+			addrs := []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", nonce),
+				wire.NewUnsignedAddress(wire.WebSocket, "10.0.0.1:3334", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "[2001:db8::1]:3333", nonce),
+			}
+			Expect(peers[0].UpdateAddresses(ctx, addrs)).To(Succeed())
+			Eventually(func() []wire.Address {
+				addrs, _ := tables[1].PeerAddresses(peers[0].ID())
+				return addrs
+			}, 5*time.Second).Should(Equal(addrs))
+
+			Expect(peers[0].UpdateAddresses(ctx, []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", nonce+1),
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", nonce+2),
+			})).ToNot(Succeed())
+		})
+	})
+
+	Context("when a pinged peer acknowledges the ping", func() {
+		It("should record the latency and throughput of the peer", func() {
+			opts, peers, tables, _, _, _ := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			go peers[0].DiscoverPeers(ctx)
+
+			Eventually(func() time.Duration {
+				liveness, _ := tables[0].Liveness(opts[1].PrivKey.Signatory())
+				return liveness.Latency
+			}, 5*time.Second).Should(BeNumerically(">", 0))
+
+			// Throughput is measured from the bytes read from the network
+			// connection between discovery rounds.
+			Eventually(func() float64 {
+				liveness, _ := tables[0].Liveness(opts[1].PrivKey.Signatory())
+				return liveness.Throughput
+			}, 5*time.Second).Should(BeNumerically(">", 0))
+			Expect(tables[0].FastestPeers(1)).To(Equal([]id.Signatory{opts[1].PrivKey.Signatory()}))
+		})
+	})
+
+	Context("when bootstrapping from a seed", func() {
+		It("should add the seed and the peers that it knows", func() {
+			opts, peers, tables, _, _, _ := setup(3)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[1].AddPeer(opts[2].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3335", uint64(time.Now().UnixNano())))
+
+			seed := wire.SignatoryAndAddress{
+				Signatory: opts[1].PrivKey.Signatory(),
+				Address:   wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())),
+			}
+			bootstrapper := peers[0].Bootstrapper(dht.DefaultBootstrapperOptions().WithLogger(zap.NewNop()).WithMaxAttempts(3), []wire.SignatoryAndAddress{seed})
+			added, err := bootstrapper.Bootstrap(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(added).To(Equal(1))
+			_, ok := tables[0].PeerAddress(opts[1].PrivKey.Signatory())
+			Expect(ok).To(BeTrue())
+			_, ok = tables[0].PeerAddress(opts[2].PrivKey.Signatory())
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when receiving a peer list", func() {
+		It("should add valid entries, and quarantine new remote peers", func() {
+			_, _, tables, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()).WithPeerQuarantine(100*time.Millisecond), transports[0])
+
+			signed := id.NewPrivKey()
+			signedAddr := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1)
+			Expect(signedAddr.Sign(signed)).To(Succeed())
+			forged := id.NewPrivKey()
+			forgedAddr := wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 1)
+			Expect(forgedAddr.Sign(id.NewPrivKey())).To(Succeed())
+			duplicated := id.NewPrivKey().Signatory()
+			known := id.NewPrivKey().Signatory()
+			knownAddr := wire.NewUnsignedAddress(wire.TCP, "10.0.0.4:3333", 5)
+			tables[0].AddPeer(known, knownAddr)
+
+			data, err := surge.ToBinary([]wire.SignatoryAndAddress{
+				{Signatory: signed.Signatory(), Address: signedAddr},
+				{Signatory: forged.Signatory(), Address: forgedAddr},
+				{Signatory: duplicated, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.3:3333", 2)},
+				{Signatory: duplicated, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.3:4444", 1)},
+				{Signatory: transports[0].Self(), Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.5:3333", 1)},
+				{Signatory: known, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.4:4444", 3)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dc.DidReceiveMessage(id.NewPrivKey().Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data})).To(Succeed())
+
+			Eventually(tables[0].NumPeers, 5*time.Second).Should(Equal(3))
+			addr, ok := tables[0].PeerAddress(signed.Signatory())
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(signedAddr))
+			_, ok = tables[0].PeerAddress(forged.Signatory())
+			Expect(ok).To(BeFalse())
+			addr, ok = tables[0].PeerAddress(duplicated)
+			Expect(ok).To(BeTrue())
+			Expect(addr.Value).To(Equal("10.0.0.3:3333"))
+			addr, ok = tables[0].PeerAddress(known)
+			Expect(ok).To(BeTrue())
+			Expect(addr).To(Equal(knownAddr))
+
+			// Only the remote peers that were not already known are
+			// quarantined.
+			time.Sleep(200 * time.Millisecond)
+			Expect(tables[0].HandleExpired(signed.Signatory())).To(BeTrue())
+			Expect(tables[0].HandleExpired(duplicated)).To(BeTrue())
+			Expect(tables[0].HandleExpired(known)).To(BeFalse())
+		})
+
+		It("should not evict remote peers that have been seen, if the table is bounded", func() {
+			_, _, tables, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()).WithMaxPeers(3, nil), transports[0])
+
+			seen := []id.Signatory{id.NewPrivKey().Signatory(), id.NewPrivKey().Signatory()}
+			for i := range seen {
+				tables[0].AddPeer(seen[i], wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("10.0.0.%v:3333", i+1), 1))
+				tables[0].Seen(seen[i])
+			}
+
+			sprayed := make([]wire.SignatoryAndAddress, 10)
+			for i := range sprayed {
+				sprayed[i] = wire.SignatoryAndAddress{
+					Signatory: id.NewPrivKey().Signatory(),
+					Address:   wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("10.0.1.%v:3333", i+1), 1),
+				}
+			}
+			data, err := surge.ToBinary(sprayed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dc.DidReceiveMessage(id.NewPrivKey().Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data})).To(Succeed())
+
+			Eventually(tables[0].NumPeers, 5*time.Second).Should(Equal(3))
+			Consistently(func() []id.Signatory { return tables[0].Peers(3) }, 200*time.Millisecond).Should(ContainElements(seen[0], seen[1]))
+		})
+
+		It("should drop entries with unsigned addresses, if signed addresses are required", func() {
+			_, _, tables, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()).WithRequireSignedAddresses(true), transports[0])
+
+			signed := id.NewPrivKey()
+			signedAddr := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1)
+			Expect(signedAddr.Sign(signed)).To(Succeed())
+			unsigned := id.NewPrivKey().Signatory()
+
+			data, err := surge.ToBinary([]wire.SignatoryAndAddress{
+				{Signatory: signed.Signatory(), Address: signedAddr},
+				{Signatory: unsigned, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 1)},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dc.DidReceiveMessage(id.NewPrivKey().Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data})).To(Succeed())
+
+			Eventually(tables[0].NumPeers, 5*time.Second).Should(Equal(1))
+			_, ok := tables[0].PeerAddress(signed.Signatory())
+			Expect(ok).To(BeTrue())
+			Consistently(tables[0].NumPeers).Should(Equal(1))
+		})
+
+		It("should keep signed entries with the same nonce together, in order", func() {
+			_, _, tables, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()), transports[0])
+
+			privKey := id.NewPrivKey()
+			addrs := []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1),
+				wire.NewUnsignedAddress(wire.WebSocket, "10.0.0.1:3334", 1),
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 0),
+			}
+			for i := range addrs {
+				Expect(addrs[i].Sign(privKey)).To(Succeed())
+			}
+
+			data, err := surge.ToBinary([]wire.SignatoryAndAddress{
+				{Signatory: privKey.Signatory(), Address: addrs[0]},
+				{Signatory: privKey.Signatory(), Address: addrs[2]},
+				{Signatory: privKey.Signatory(), Address: addrs[1]},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dc.DidReceiveMessage(id.NewPrivKey().Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypePingAck, Data: data})).To(Succeed())
+
+			Eventually(func() []wire.Address {
+				addrs, _ := tables[0].PeerAddresses(privKey.Signatory())
+				return addrs
+			}, 5*time.Second).Should(Equal(addrs[:2]))
+		})
+	})
+
+	Context("when a peer drains", func() {
+		It("should stop accepting connections and notify connected peers", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).To(Succeed())
+			Eventually(func() bool { return transports[1].IsConnected(peers[0].ID()) }).Should(BeTrue())
+
+			Expect(peers[1].Drain(ctx)).To(Succeed())
+			Eventually(func() bool { return transports[0].InMaintenance(peers[1].ID()) }, 5*time.Second).Should(BeTrue())
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", "localhost:3334")
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}, 5*time.Second).Should(HaveOccurred())
+			Expect(peers[1].Send(ctx, peers[0].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).ToNot(Succeed())
+		})
+	})
+
+	Context("when a peer announces that it is draining", func() {
+		It("should notify connected peers, which stop gossiping to it", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			pushes := make(chan wire.Msg, 10)
+			peers[1].Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				if packet.Msg.Type == wire.MsgTypePush {
+					pushes <- packet.Msg
+				}
+				return nil
+			})
+			peers[0].Gossip(ctx, []byte("before"), nil)
+			Eventually(pushes, 5*time.Second).Should(Receive())
+			Eventually(func() bool { return transports[1].IsConnected(peers[0].ID()) }).Should(BeTrue())
+
+			Expect(peers[1].AnnounceDraining(ctx, "upgrade", time.Minute)).To(Succeed())
+			Eventually(func() bool {
+				_, ok := transports[0].IsGoingAway(peers[1].ID())
+				return ok
+			}, 5*time.Second).Should(BeTrue())
+			announcement, _ := transports[0].IsGoingAway(peers[1].ID())
+			Expect(announcement.Reason).To(Equal("upgrade"))
+			Expect(announcement.At).To(BeTemporally("~", time.Now().Add(time.Minute), 5*time.Second))
+			Expect(transports[0].InMaintenance(peers[1].ID())).To(BeTrue())
+
+			peers[0].Gossip(ctx, []byte("after"), nil)
+			Consistently(pushes).ShouldNot(Receive())
+		})
+	})
+
+	Context("when a remote peer is unreachable", func() {
+		It("should evict it, and keep remote peers that answer pings", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			unreachable := id.NewPrivKey().Signatory()
+			tables[0].AddPeer(unreachable, wire.NewUnsignedAddress(wire.TCP, "localhost:1", uint64(time.Now().UnixNano())))
+
+			evicted := make(chan id.Signatory, 2)
+			dc := peer.NewDiscoveryClient(
+				peer.DefaultDiscoveryOptions().
+					WithLogger(zap.NewNop()).
+					WithStalePeerAge(100*time.Millisecond).
+					WithPeerEvictionTimeout(500*time.Millisecond).
+					WithEvictionObserver(peer.CallbackEvictionObserver(func(remote id.Signatory, liveness dht.Liveness) {
+						Expect(liveness.Failures).To(BeNumerically(">", 0))
+						evicted <- remote
+					})),
+				transports[0])
+			go dc.EvictStalePeers(ctx)
+
+			var remote id.Signatory
+			Eventually(evicted, 5*time.Second).Should(Receive(&remote))
+			Expect(remote).To(Equal(unreachable))
+			_, ok := tables[0].PeerAddress(unreachable)
+			Expect(ok).To(BeFalse())
+			Consistently(evicted, time.Second).ShouldNot(Receive())
+			_, ok = tables[0].PeerAddress(peers[1].ID())
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("when a peer schedules maintenance", func() {
+		It("should notify connected peers", func() {
+			opts, peers, tables, _, _, transports := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+			tables[0].AddPeer(opts[1].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano())))
+			tables[1].AddPeer(opts[0].PrivKey.Signatory(), wire.NewUnsignedAddress(wire.TCP, "localhost:3333", uint64(time.Now().UnixNano())))
+
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).To(Succeed())
+			Eventually(func() bool { return transports[0].IsConnected(peers[1].ID()) }).Should(BeTrue())
+
+			Expect(transports[1].InMaintenance(peers[0].ID())).To(BeFalse())
+			Expect(peers[0].ScheduleMaintenance(ctx, time.Minute)).To(Succeed())
+			Expect(transports[0].InMaintenance(peers[1].ID())).To(BeTrue())
+			Eventually(func() bool { return transports[1].InMaintenance(peers[0].ID()) }, 5*time.Second).Should(BeTrue())
+		})
+
+		It("should shorten windows that are too long, and reject malformed windows", func() {
+			privKey := id.NewPrivKey()
+			_, _, _, _, _, transports := setup(1)
+			dc := peer.NewDiscoveryClient(peer.DefaultDiscoveryOptions().WithLogger(zap.NewNop()).WithMaxMaintenanceWindow(100*time.Millisecond), transports[0])
+
+			Expect(dc.DidReceiveMessage(privKey.Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeMaintenance, Data: []byte{1}})).ToNot(Succeed())
+			Expect(transports[0].InMaintenance(privKey.Signatory())).To(BeFalse())
+
+			data := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+			Expect(dc.DidReceiveMessage(privKey.Signatory(), nil, wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeMaintenance, Data: data})).To(Succeed())
+			Expect(transports[0].InMaintenance(privKey.Signatory())).To(BeTrue())
+			Eventually(func() bool { return transports[0].InMaintenance(privKey.Signatory()) }, time.Second).Should(BeFalse())
+		})
+	})
 })
@@ -0,0 +1,31 @@
+package peer
+
+import (
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	"go.uber.org/zap"
+)
+
+// addPeerList validates the entries of a peer list received from a remote
+// peer, and adds the valid entries to the table. Validation recovers the
+// signatories of signed addresses, which is slow for long peer lists, so it
+// is done off the goroutine that received the peer list.
+func (dc *DiscoveryClient) addPeerList(from id.Signatory, list []wire.SignatoryAndAddress) {
+	table := dc.transport.Table()
+	added, quarantined := 0, 0
+	for _, x := range wire.VerifyPeerList(list, table.Self(), dc.opts.RequireSignedAddresses, table.PeerAddress) {
+		_, known := table.PeerAddress(x.Signatory)
+		table.AddPeerAddresses(x.Signatory, x.Addresses)
+		added++
+
+		// Remote peers that were learned second-hand are quarantined: the
+		// first time that dialing them fails after the quarantine, they are
+		// removed from the table. Connecting to them ends the quarantine.
+		if !known && dc.opts.PeerQuarantine > 0 {
+			table.AddExpiry(x.Signatory, dc.opts.PeerQuarantine)
+			quarantined++
+		}
+	}
+	dc.opts.Logger.Debug("peer list", zap.String("peer", from.String()), zap.Int("received", len(list)), zap.Int("added", added), zap.Int("quarantined", quarantined))
+}
@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Names of the checks in a SelfTestReport.
+const (
+	CheckListener        = "listener"
+	CheckLoopback        = "loopback"
+	CheckClock           = "clock"
+	CheckFileDescriptors = "file-descriptors"
+	CheckPersistence     = "persistence"
+)
+
+// minClockTime is the earliest wall clock time that is considered sane. Address
+// nonces are timestamps, so a clock that is far in the past would cause the
+// addresses signed by the local peer to be ignored in favour of older ones.
+var minClockTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// A SelfTestCheck is the result of one check done by a self-test.
+type SelfTestCheck struct {
+	Name     string
+	Err      error
+	Duration time.Duration
+}
+
+// A SelfTestReport contains the results of all checks done by a self-test, in
+// the order in which they were done.
+type SelfTestReport struct {
+	Checks []SelfTestCheck
+}
+
+// Err returns an error describing all failed checks, or nil if all checks
+// passed.
+func (report SelfTestReport) Err() error {
+	failed := []string{}
+	for _, check := range report.Checks {
+		if check.Err != nil {
+			failed = append(failed, fmt.Sprintf("%v: %v", check.Name, check.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("self-test failed: %v", strings.Join(failed, "; "))
+}
+
+// SelfTest checks that the Peer is configured in a way that will allow it to
+// join the network. It checks that the listener can be bound, that the Peer can
+// dial and handshake with itself, that the wall clock is sane, that the file
+// descriptor limit is high enough, and that outbound messages can be persisted.
+// All checks are done, even if some of them fail. SelfTest should be called
+// before running the Peer, otherwise the listener check will fail because the
+// Peer already holds the binding.
+func (p *Peer) SelfTest(ctx context.Context) SelfTestReport {
+	report := SelfTestReport{}
+	check := func(name string, f func() error) {
+		start := time.Now()
+		err := f()
+		report.Checks = append(report.Checks, SelfTestCheck{
+			Name:     name,
+			Err:      err,
+			Duration: time.Since(start),
+		})
+	}
+
+	check(CheckListener, p.transport.CheckListener)
+	check(CheckLoopback, func() error {
+		return p.transport.CheckLoopback(ctx)
+	})
+	check(CheckClock, func() error {
+		if now := time.Now(); now.Before(minClockTime) {
+			return fmt.Errorf("wall clock is %v, expected at least %v", now.UTC(), minClockTime)
+		}
+		return nil
+	})
+	check(CheckFileDescriptors, func() error {
+		limit, ok, err := fileDescriptorLimit()
+		if err != nil || !ok {
+			return err
+		}
+		if limit < p.opts.MinFileDescriptors {
+			return fmt.Errorf("limit is %v, expected at least %v", limit, p.opts.MinFileDescriptors)
+		}
+		return nil
+	})
+	check(CheckPersistence, p.transport.Client().CheckMessageQueue)
+
+	return report
+}
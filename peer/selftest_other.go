@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package peer
+
+// fileDescriptorLimit is not supported on this platform, so the limit is
+// reported as unknown.
+func fileDescriptorLimit() (uint64, bool, error) {
+	return 0, false, nil
+}
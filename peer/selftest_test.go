@@ -0,0 +1,82 @@
+package peer_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/transport"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Self-test", func() {
+	newPeer := func(port uint16, queue channel.MessageQueue) *peer.Peer {
+		opts := peer.DefaultOptions().WithLogger(zap.NewNop()).WithMinFileDescriptors(1)
+		self := opts.PrivKey.Signatory()
+		client := channel.NewClient(
+			channel.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithMessageQueue(queue),
+			self)
+		t := transport.New(
+			transport.DefaultOptions().
+				WithLogger(zap.NewNop()).
+				WithPort(port),
+			self,
+			client,
+			handshake.ECIES(opts.PrivKey),
+			dht.NewInMemTable(self))
+		return peer.New(opts, t)
+	}
+
+	Context("when the peer is configured correctly", func() {
+		It("should pass all checks", func() {
+			dir, err := ioutil.TempDir("", "selftest")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			queue, err := channel.NewFileMessageQueue(dir)
+			Expect(err).ToNot(HaveOccurred())
+
+			report := newPeer(13409, queue).SelfTest(context.Background())
+			Expect(report.Err()).ToNot(HaveOccurred())
+
+			names := []string{}
+			for _, check := range report.Checks {
+				names = append(names, check.Name)
+			}
+			Expect(names).To(Equal([]string{
+				peer.CheckListener,
+				peer.CheckLoopback,
+				peer.CheckClock,
+				peer.CheckFileDescriptors,
+				peer.CheckPersistence,
+			}))
+		})
+	})
+
+	Context("when the port is already bound", func() {
+		It("should fail the listener check", func() {
+			listener, err := net.Listen("tcp", "localhost:13410")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			report := newPeer(13410, nil).SelfTest(context.Background())
+			Expect(report.Err()).To(HaveOccurred())
+			for _, check := range report.Checks {
+				if check.Name == peer.CheckListener {
+					Expect(check.Err).To(HaveOccurred())
+				} else {
+					Expect(check.Err).ToNot(HaveOccurred())
+				}
+			}
+		})
+	})
+})
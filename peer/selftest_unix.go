@@ -0,0 +1,19 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package peer
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// fileDescriptorLimit returns the soft limit on the number of open file
+// descriptors.
+func fileDescriptorLimit() (uint64, bool, error) {
+	rlimit := syscall.Rlimit{}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, false, fmt.Errorf("getrlimit: %w", err)
+	}
+	return uint64(rlimit.Cur), true, nil
+}
@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// A Snapshot is a view of the state of a Peer at one point in time. It is
+// intended for monitoring tools that track how the network evolves, by taking
+// snapshots periodically and comparing them (see Diff).
+type Snapshot struct {
+	// Time at which the Snapshot was taken.
+	Time time.Time
+	// Self is the local peer.
+	Self id.Signatory
+	// Peers are the entries in the table, keyed by remote peer.
+	Peers map[id.Signatory]wire.Address
+	// Connections are the network connections that are attached, keyed by
+	// remote peer.
+	Connections map[id.Signatory]channel.ConnInfo
+}
+
+// Snapshot returns a Snapshot of the Peer. The table and the connections are
+// each copied while holding their own locks, so each is consistent with
+// itself, but a remote peer might connect or be added to the table between
+// the two copies.
+func (p *Peer) Snapshot() Snapshot {
+	table := p.transport.Table()
+	peers := table.Peers(table.NumPeers())
+	snapshot := Snapshot{
+		Time:        time.Now(),
+		Self:        p.ID(),
+		Peers:       make(map[id.Signatory]wire.Address, len(peers)),
+		Connections: map[id.Signatory]channel.ConnInfo{},
+	}
+	for _, remote := range peers {
+		if addr, ok := table.PeerAddress(remote); ok {
+			snapshot.Peers[remote] = addr
+		}
+	}
+	for _, info := range p.transport.Client().Connections() {
+		snapshot.Connections[info.Remote] = info
+	}
+	return snapshot
+}
+
+// A SnapshotDiff is the set of changes between two Snapshots. Each list of
+// remote peers is sorted, so that equal SnapshotDiffs are deeply equal.
+type SnapshotDiff struct {
+	// PeersAdded are the remote peers that were added to the table.
+	PeersAdded []id.Signatory
+	// PeersRemoved are the remote peers that were removed from the table.
+	PeersRemoved []id.Signatory
+	// AddressesChanged are the remote peers whose address in the table
+	// changed.
+	AddressesChanged []id.Signatory
+	// Connected are the remote peers to which a network connection was
+	// attached.
+	Connected []id.Signatory
+	// Disconnected are the remote peers whose network connection was dropped.
+	Disconnected []id.Signatory
+	// Reconnected are the remote peers whose network connection was replaced
+	// by a new one.
+	Reconnected []id.Signatory
+}
+
+// Empty returns true if there are no changes.
+func (diff SnapshotDiff) Empty() bool {
+	return len(diff.PeersAdded) == 0 &&
+		len(diff.PeersRemoved) == 0 &&
+		len(diff.AddressesChanged) == 0 &&
+		len(diff.Connected) == 0 &&
+		len(diff.Disconnected) == 0 &&
+		len(diff.Reconnected) == 0
+}
+
+// Diff returns the changes from Snapshot a to Snapshot b.
+func Diff(a, b Snapshot) SnapshotDiff {
+	diff := SnapshotDiff{}
+	for remote, addr := range b.Peers {
+		prev, ok := a.Peers[remote]
+		switch {
+		case !ok:
+			diff.PeersAdded = append(diff.PeersAdded, remote)
+		case !prev.Equal(&addr):
+			diff.AddressesChanged = append(diff.AddressesChanged, remote)
+		}
+	}
+	for remote := range a.Peers {
+		if _, ok := b.Peers[remote]; !ok {
+			diff.PeersRemoved = append(diff.PeersRemoved, remote)
+		}
+	}
+	for remote, info := range b.Connections {
+		prev, ok := a.Connections[remote]
+		switch {
+		case !ok:
+			diff.Connected = append(diff.Connected, remote)
+		case !prev.AttachedAt.Equal(info.AttachedAt):
+			diff.Reconnected = append(diff.Reconnected, remote)
+		}
+	}
+	for remote := range a.Connections {
+		if _, ok := b.Connections[remote]; !ok {
+			diff.Disconnected = append(diff.Disconnected, remote)
+		}
+	}
+
+	sortSignatories(diff.PeersAdded)
+	sortSignatories(diff.PeersRemoved)
+	sortSignatories(diff.AddressesChanged)
+	sortSignatories(diff.Connected)
+	sortSignatories(diff.Disconnected)
+	sortSignatories(diff.Reconnected)
+	return diff
+}
+
+func sortSignatories(sigs []id.Signatory) {
+	sort.Slice(sigs, func(i, j int) bool {
+		return bytes.Compare(sigs[i][:], sigs[j][:]) < 0
+	})
+}
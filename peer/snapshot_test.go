@@ -0,0 +1,92 @@
+package peer_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/peer"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot", func() {
+	Context("when a peer connects to another peer", func() {
+		It("should include the table entry and the connection", func() {
+			_, peers, tables, _, _, _ := setup(2)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			for i := range peers {
+				go peers[i].Run(ctx)
+			}
+
+			before := peers[0].Snapshot()
+			Expect(before.Self).To(Equal(peers[0].ID()))
+			Expect(before.Peers).To(BeEmpty())
+			Expect(before.Connections).To(BeEmpty())
+
+			addr := wire.NewUnsignedAddress(wire.TCP, "localhost:3334", uint64(time.Now().UnixNano()))
+			tables[0].AddPeer(peers[1].ID(), addr)
+			Expect(peers[0].Send(ctx, peers[1].ID(), wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend})).To(Succeed())
+			Eventually(func() int { return len(peers[0].Snapshot().Connections) }, 5*time.Second).Should(Equal(1))
+
+			after := peers[0].Snapshot()
+			Expect(after.Peers).To(HaveKeyWithValue(peers[1].ID(), addr))
+			Expect(after.Connections).To(HaveKey(peers[1].ID()))
+
+			diff := peer.Diff(before, after)
+			Expect(diff.PeersAdded).To(Equal([]id.Signatory{peers[1].ID()}))
+			Expect(diff.Connected).To(Equal([]id.Signatory{peers[1].ID()}))
+			Expect(diff.Disconnected).To(BeEmpty())
+			Expect(peer.Diff(after, after).Empty()).To(BeTrue())
+		})
+	})
+
+	Context("when diffing snapshots", func() {
+		It("should report all changes", func() {
+			sigs := make([]id.Signatory, 5)
+			for i := range sigs {
+				sigs[i] = id.NewPrivKey().Signatory()
+			}
+			addr := func(value string) wire.Address {
+				return wire.NewUnsignedAddress(wire.TCP, value, 1)
+			}
+			now := time.Now()
+
+			a := peer.Snapshot{
+				Peers: map[id.Signatory]wire.Address{
+					sigs[0]: addr("10.0.0.1:3333"),
+					sigs[1]: addr("10.0.0.2:3333"),
+					sigs[2]: addr("10.0.0.3:3333"),
+				},
+				Connections: map[id.Signatory]channel.ConnInfo{
+					sigs[0]: {Remote: sigs[0], AttachedAt: now},
+					sigs[1]: {Remote: sigs[1], AttachedAt: now},
+				},
+			}
+			b := peer.Snapshot{
+				Peers: map[id.Signatory]wire.Address{
+					sigs[1]: addr("10.0.0.2:3333"),
+					sigs[2]: addr("10.0.0.4:3333"),
+					sigs[3]: addr("10.0.0.5:3333"),
+				},
+				Connections: map[id.Signatory]channel.ConnInfo{
+					sigs[1]: {Remote: sigs[1], AttachedAt: now.Add(time.Second)},
+					sigs[3]: {Remote: sigs[3], AttachedAt: now},
+				},
+			}
+
+			diff := peer.Diff(a, b)
+			Expect(diff.Empty()).To(BeFalse())
+			Expect(diff.PeersAdded).To(Equal([]id.Signatory{sigs[3]}))
+			Expect(diff.PeersRemoved).To(Equal([]id.Signatory{sigs[0]}))
+			Expect(diff.AddressesChanged).To(Equal([]id.Signatory{sigs[2]}))
+			Expect(diff.Connected).To(Equal([]id.Signatory{sigs[3]}))
+			Expect(diff.Disconnected).To(Equal([]id.Signatory{sigs[0]}))
+			Expect(diff.Reconnected).To(Equal([]id.Signatory{sigs[1]}))
+		})
+	})
+})
@@ -0,0 +1,146 @@
+package peer
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/id"
+)
+
+// A SubnetAuthorizer decides which peers are allowed to take part in gossip
+// for a subnet. Gossipers will not push content for a subnet to peers that are
+// not authorized, will ignore pushes for a subnet from peers that are not
+// authorized, and will not respond to pulls from peers that are not authorized
+// for the subnet of the content being pulled. Gossip for the default subnet is
+// never restricted, so the SubnetAuthorizer is not consulted for it.
+type SubnetAuthorizer interface {
+	// AuthorizeSubnet returns nil if the peer is allowed to take part in
+	// gossip for the subnet.
+	AuthorizeSubnet(subnet id.Hash, peer id.Signatory) error
+}
+
+// A SubnetCredential is a signature from the owner of a private subnet that
+// grants membership of the subnet to a peer.
+type SubnetCredential struct {
+	Subnet    id.Hash      `json:"subnet"`
+	Member    id.Signatory `json:"member"`
+	Signature id.Signature `json:"signature"`
+}
+
+// NewSubnetCredential returns a SubnetCredential, signed by the owner of the
+// subnet, that grants membership of the subnet to the member.
+func NewSubnetCredential(owner *id.PrivKey, subnet id.Hash, member id.Signatory) (SubnetCredential, error) {
+	credential := SubnetCredential{Subnet: subnet, Member: member}
+	hash := credential.Hash()
+	signature, err := crypto.Sign(hash[:], (*ecdsa.PrivateKey)(owner))
+	if err != nil {
+		return SubnetCredential{}, fmt.Errorf("signing credential hash: %v", err)
+	}
+	if n := copy(credential.Signature[:], signature); n != len(credential.Signature) {
+		return SubnetCredential{}, fmt.Errorf("copying signature: expected n=%v, got n=%v", len(credential.Signature), n)
+	}
+	return credential, nil
+}
+
+// Hash returns the hash of the SubnetCredential that is signed by the owner of
+// the subnet.
+func (credential SubnetCredential) Hash() id.Hash {
+	data := make([]byte, 0, len(credential.Subnet)+len(credential.Member))
+	data = append(data, credential.Subnet[:]...)
+	data = append(data, credential.Member[:]...)
+	return sha256.Sum256(data)
+}
+
+// Verify that the SubnetCredential was signed by the owner.
+func (credential SubnetCredential) Verify(owner id.Signatory) error {
+	hash := credential.Hash()
+	verifiedPubKey, err := crypto.SigToPub(hash[:], credential.Signature[:])
+	if err != nil {
+		return fmt.Errorf("identifying credential signature: %v", err)
+	}
+	verifiedSignatory := id.NewSignatory((*id.PubKey)(verifiedPubKey))
+	if !owner.Equal(&verifiedSignatory) {
+		return fmt.Errorf("verifying credential signatory: expected %v, got %v", owner, verifiedSignatory)
+	}
+	return nil
+}
+
+// SubnetCredentials implements the SubnetAuthorizer interface using
+// SubnetCredentials. Subnets become private when their owner is set, and from
+// then on only peers with a credential signed by the owner (and the owner
+// itself) are authorized. Subnets without an owner are public. It is safe for
+// concurrent use.
+type SubnetCredentials struct {
+	mu          *sync.RWMutex
+	owners      map[id.Hash]id.Signatory
+	credentials map[id.Hash]map[id.Signatory]SubnetCredential
+}
+
+// NewSubnetCredentials returns SubnetCredentials without any private subnets.
+func NewSubnetCredentials() *SubnetCredentials {
+	return &SubnetCredentials{
+		mu:          new(sync.RWMutex),
+		owners:      map[id.Hash]id.Signatory{},
+		credentials: map[id.Hash]map[id.Signatory]SubnetCredential{},
+	}
+}
+
+// SetOwner makes the subnet private, and sets its owner. Credentials that were
+// signed by a previous owner are forgotten.
+func (creds *SubnetCredentials) SetOwner(subnet id.Hash, owner id.Signatory) {
+	creds.mu.Lock()
+	defer creds.mu.Unlock()
+
+	if previous, ok := creds.owners[subnet]; ok && !previous.Equal(&owner) {
+		delete(creds.credentials, subnet)
+	}
+	creds.owners[subnet] = owner
+}
+
+// Add a SubnetCredential. An error is returned if the subnet is not private,
+// or if the SubnetCredential was not signed by the owner of the subnet.
+func (creds *SubnetCredentials) Add(credential SubnetCredential) error {
+	creds.mu.Lock()
+	defer creds.mu.Unlock()
+
+	owner, ok := creds.owners[credential.Subnet]
+	if !ok {
+		return fmt.Errorf("subnet %v is not private", credential.Subnet)
+	}
+	if err := credential.Verify(owner); err != nil {
+		return err
+	}
+	if _, ok := creds.credentials[credential.Subnet]; !ok {
+		creds.credentials[credential.Subnet] = map[id.Signatory]SubnetCredential{}
+	}
+	creds.credentials[credential.Subnet][credential.Member] = credential
+	return nil
+}
+
+// Remove the SubnetCredential of a member of a subnet, revoking its
+// membership.
+func (creds *SubnetCredentials) Remove(subnet id.Hash, member id.Signatory) {
+	creds.mu.Lock()
+	defer creds.mu.Unlock()
+
+	delete(creds.credentials[subnet], member)
+}
+
+// AuthorizeSubnet returns nil if the subnet is public, if the peer is the
+// owner of the subnet, or if the peer has a SubnetCredential for the subnet.
+func (creds *SubnetCredentials) AuthorizeSubnet(subnet id.Hash, peer id.Signatory) error {
+	creds.mu.RLock()
+	defer creds.mu.RUnlock()
+
+	owner, ok := creds.owners[subnet]
+	if !ok || owner.Equal(&peer) {
+		return nil
+	}
+	if _, ok := creds.credentials[subnet][peer]; ok {
+		return nil
+	}
+	return fmt.Errorf("%w: %v in %v", ErrSubnetUnauthorized, peer, subnet)
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/renproject/id"
+	"golang.org/x/time/rate"
+)
+
+// A SignatoryLimiter rate limits the events from each Signatory (for example,
+// the messages from each remote peer) independently. Signatories that have been
+// quiet for long enough that their limiters are full again are forgotten, which
+// bounds the memory used by Signatories that come and go. It is safe for
+// concurrent use.
+type SignatoryLimiter struct {
+	limit rate.Limit
+	burst int
+
+	limitersMu *sync.Mutex
+	limiters   map[id.Signatory]signatoryLimiter
+}
+
+type signatoryLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewSignatoryLimiter returns a SignatoryLimiter that allows a number of events
+// per second from each Signatory, and a number of such events in a burst. A
+// limit of rate.Inf allows all events.
+func NewSignatoryLimiter(limit rate.Limit, burst int) *SignatoryLimiter {
+	return &SignatoryLimiter{
+		limit: limit,
+		burst: burst,
+
+		limitersMu: new(sync.Mutex),
+		limiters:   map[id.Signatory]signatoryLimiter{},
+	}
+}
+
+// Allow returns true if an event from the Signatory is within its rate limit.
+func (l *SignatoryLimiter) Allow(signatory id.Signatory) bool {
+	if l.limit == rate.Inf {
+		return true
+	}
+
+	now := time.Now()
+
+	l.limitersMu.Lock()
+	defer l.limitersMu.Unlock()
+
+	sl, ok := l.limiters[signatory]
+	if !ok {
+		// Before adding a new Signatory, forget the Signatories whose
+		// limiters are full again.
+		if l.limit > 0 {
+			refill := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+			for other, sl := range l.limiters {
+				if now.Sub(sl.lastSeen) > refill {
+					delete(l.limiters, other)
+				}
+			}
+		}
+		sl.limiter = rate.NewLimiter(l.limit, l.burst)
+	}
+	sl.lastSeen = now
+	l.limiters[signatory] = sl
+	return sl.limiter.AllowN(now, 1)
+}
+
+// Len returns the number of Signatories that are remembered.
+func (l *SignatoryLimiter) Len() int {
+	l.limitersMu.Lock()
+	defer l.limitersMu.Unlock()
+
+	return len(l.limiters)
+}
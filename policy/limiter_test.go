@@ -0,0 +1,52 @@
+package policy_test
+
+import (
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/id"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signatory limiter", func() {
+	Context("when a Signatory exceeds its burst", func() {
+		It("should only deny events from that Signatory", func() {
+			limiter := policy.NewSignatoryLimiter(0.001, 2)
+			signatory := id.NewPrivKey().Signatory()
+			other := id.NewPrivKey().Signatory()
+
+			Expect(limiter.Allow(signatory)).To(BeTrue())
+			Expect(limiter.Allow(signatory)).To(BeTrue())
+			Expect(limiter.Allow(signatory)).To(BeFalse())
+			Expect(limiter.Allow(other)).To(BeTrue())
+		})
+	})
+
+	Context("when the limit is infinite", func() {
+		It("should allow all events without remembering Signatories", func() {
+			limiter := policy.NewSignatoryLimiter(rate.Inf, 0)
+			signatory := id.NewPrivKey().Signatory()
+			for i := 0; i < 10; i++ {
+				Expect(limiter.Allow(signatory)).To(BeTrue())
+			}
+			Expect(limiter.Len()).To(Equal(0))
+		})
+	})
+
+	Context("when Signatories have been quiet until their limiters are full", func() {
+		It("should forget them once a new Signatory is seen", func() {
+			limiter := policy.NewSignatoryLimiter(100, 1)
+			for i := 0; i < 10; i++ {
+				Expect(limiter.Allow(id.NewPrivKey().Signatory())).To(BeTrue())
+			}
+			Expect(limiter.Len()).To(Equal(10))
+
+			time.Sleep(50 * time.Millisecond)
+			Expect(limiter.Allow(id.NewPrivKey().Signatory())).To(BeTrue())
+			Expect(limiter.Len()).To(Equal(1))
+		})
+	})
+})
@@ -35,9 +35,12 @@
 //	one := policy.ConstantTimeout(time.Second)
 //	// Create a policy to scale this constant timeout by 60% with every attempt.
 //	backoff := policy.LinearBackoff(1.6, one)
+//	// Create a policy to randomly spread this backoff by up to 20% in either
+//	// direction, so that many peers do not all retry at the same time.
+//	jitter := policy.Jitter(0.2, backoff)
 //	// Create a policy to clamp the Timeout to an upper bound of one minute, no
 //	// matter how many attempts there have been.
-//	max := policy.MaxTimeout(time.Minute, backoff)
+//	max := policy.MaxTimeout(time.Minute, jitter)
 //
 // The policy functions available by default (of course, the programmer is free
 // to implement their own policy functions) are quite simple. But, by providing
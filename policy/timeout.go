@@ -2,6 +2,7 @@ package policy
 
 import (
 	"math"
+	"math/rand"
 	"time"
 )
 
@@ -18,11 +19,12 @@ func ConstantTimeout(duration time.Duration) Timeout {
 }
 
 // MaxTimeout returns a Timeout function that restricts another Timeout function
-// to return a maximum duration.
+// to return a maximum duration. Negative durations, which can only be the
+// result of an overflow, are also restricted to the maximum.
 func MaxTimeout(duration time.Duration, timeout Timeout) Timeout {
 	return func(attempt int) time.Duration {
 		customTimeout := timeout(attempt)
-		if customTimeout > duration {
+		if customTimeout > duration || customTimeout < 0 {
 			return duration
 		}
 		return customTimeout
@@ -30,18 +32,45 @@ func MaxTimeout(duration time.Duration, timeout Timeout) Timeout {
 }
 
 // LinearBackoff returns a Timeout function that scales the duration returned by
-// another Timeout function linearly with respect to the attempt.
+// another Timeout function linearly with respect to the attempt. The duration
+// saturates at the maximum duration, instead of overflowing.
 func LinearBackoff(rate float64, timeout Timeout) Timeout {
 	return func(attempt int) time.Duration {
-		return time.Duration(rate*float64(attempt)) * timeout(attempt)
+		return saturate(rate * float64(attempt) * float64(timeout(attempt)))
 	}
 }
 
 // ExponentialBackoff returns a Timeout function that scales the duration
 // returned by another Timeout function exponentially with respect to the
-// attempt.
+// attempt. The duration saturates at the maximum duration, instead of
+// overflowing.
 func ExponentialBackoff(rate float64, timeout Timeout) Timeout {
 	return func(attempt int) time.Duration {
-		return time.Duration(math.Pow(rate, float64(attempt))) * timeout(attempt)
+		return saturate(math.Pow(rate, float64(attempt)) * float64(timeout(attempt)))
 	}
 }
+
+// Jitter returns a Timeout function that randomly scales the duration returned
+// by another Timeout function by up to the given fraction in either direction.
+// For example, a fraction of 0.2 will return durations between 80% and 120% of
+// the wrapped duration. This is useful for spreading out retries from many
+// peers that failed at the same time.
+func Jitter(fraction float64, timeout Timeout) Timeout {
+	return func(attempt int) time.Duration {
+		scale := 1 + fraction*(2*rand.Float64()-1)
+		return saturate(scale * float64(timeout(attempt)))
+	}
+}
+
+// saturate converts a number of nanoseconds to a duration. Numbers that are
+// too large to be represented, including infinity and NaN (for example, an
+// infinite scale of a zero duration), become the maximum duration.
+func saturate(ns float64) time.Duration {
+	if math.IsNaN(ns) || ns >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	if ns <= math.MinInt64 {
+		return math.MinInt64
+	}
+	return time.Duration(ns)
+}
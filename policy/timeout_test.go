@@ -1 +1,69 @@
 package policy_test
+
+import (
+	"math"
+	"time"
+
+	"github.com/renproject/aw/policy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Timeout", func() {
+	Context("when using exponential backoff", func() {
+		It("should scale by fractional rates", func() {
+			backoff := policy.ExponentialBackoff(1.5, policy.ConstantTimeout(time.Second))
+			Expect(backoff(1)).To(Equal(1500 * time.Millisecond))
+			Expect(backoff(2)).To(Equal(2250 * time.Millisecond))
+		})
+
+		It("should saturate instead of overflowing", func() {
+			backoff := policy.ExponentialBackoff(1.6, policy.ConstantTimeout(100*time.Millisecond))
+			Expect(backoff(100)).To(Equal(time.Duration(math.MaxInt64)))
+			Expect(backoff(10000)).To(Equal(time.Duration(math.MaxInt64)))
+			Expect(policy.ExponentialBackoff(2, policy.ConstantTimeout(0))(10000)).To(Equal(time.Duration(math.MaxInt64)))
+		})
+	})
+
+	Context("when using linear backoff", func() {
+		It("should scale by fractional rates", func() {
+			backoff := policy.LinearBackoff(1.5, policy.ConstantTimeout(time.Second))
+			Expect(backoff(1)).To(Equal(1500 * time.Millisecond))
+			Expect(backoff(2)).To(Equal(3000 * time.Millisecond))
+		})
+
+		It("should saturate instead of overflowing", func() {
+			backoff := policy.LinearBackoff(1e300, policy.ConstantTimeout(time.Second))
+			Expect(backoff(1)).To(Equal(time.Duration(math.MaxInt64)))
+		})
+	})
+
+	Context("when restricting a timeout to a maximum", func() {
+		It("should restrict negative durations to the maximum", func() {
+			timeout := policy.MaxTimeout(time.Second, policy.ConstantTimeout(-time.Second))
+			Expect(timeout(1)).To(Equal(time.Second))
+		})
+	})
+
+	Context("when using jitter", func() {
+		It("should stay within the fraction of the wrapped timeout", func() {
+			jitter := policy.Jitter(0.2, policy.ConstantTimeout(time.Second))
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 100; i++ {
+				d := jitter(i)
+				Expect(d).To(BeNumerically(">=", 800*time.Millisecond))
+				Expect(d).To(BeNumerically("<=", 1200*time.Millisecond))
+				seen[d] = true
+			}
+			Expect(len(seen)).To(BeNumerically(">", 1))
+		})
+
+		It("should saturate instead of overflowing", func() {
+			jitter := policy.Jitter(0.2, policy.ConstantTimeout(math.MaxInt64))
+			for i := 0; i < 100; i++ {
+				Expect(jitter(i)).To(BeNumerically(">", 0))
+			}
+		})
+	})
+})
@@ -0,0 +1,178 @@
+package tcp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultDualStackDelay is the delay between connection attempts recommended
+// by RFC 8305.
+var DefaultDualStackDelay = 250 * time.Millisecond
+
+// A DialFunc dials a network address.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// DualStackDialer returns a DialFunc that implements "Happy Eyeballs" (see RFC
+// 8305). When the host of the address resolves to more than one IP address,
+// connection attempts are made concurrently, alternating between IPv6 and IPv4
+// addresses (starting with IPv6). Each attempt is started after the previous
+// attempt fails, or after the delay passes, whichever happens first. The first
+// connection to be established is returned, and all others are closed.
+func DualStackDialer(delay time.Duration) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer := new(net.Dialer)
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ipAddrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %v", host)
+		}
+		ips := interleaveIPs(ipAddrs)
+		if len(ips) == 1 {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+		}
+
+		return race(ctx, len(ips), delay, func(ctx context.Context, i int) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ips[i].String(), port))
+		})
+	}
+}
+
+// FallbackDialer returns a DialFunc that dials the network address, and then
+// each of the fallback network addresses in order, until a connection is
+// established (for example, the other network addresses that are advertised
+// by a remote peer). When the delay is positive, connection attempts are
+// raced in the same way as the DualStackDialer: each attempt is started after
+// the previous attempt fails, or after the delay passes, whichever happens
+// first. Otherwise, each attempt is only started after the previous attempt
+// fails. By default (when the DialFunc is nil), a net.Dialer is used. Every
+// network address is dialed using the same network, so the fallback network
+// addresses must only include network addresses that the DialFunc can dial
+// using that network.
+func FallbackDialer(dial DialFunc, fallbacks []string, delay time.Duration) DialFunc {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		addresses := append([]string{address}, fallbacks...)
+		if delay > 0 {
+			return race(ctx, len(addresses), delay, func(ctx context.Context, i int) (net.Conn, error) {
+				return dial(ctx, network, addresses[i])
+			})
+		}
+		var lastErr error
+		for _, address := range addresses {
+			conn, err := dial(ctx, network, address)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, lastErr
+	}
+}
+
+// race makes n connection attempts concurrently, and returns the first
+// connection to be established. Each attempt is started after the previous
+// attempt fails, or after the delay passes, whichever happens first. All other
+// connections are closed.
+func race(ctx context.Context, n int, delay time.Duration, dial func(context.Context, int) (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, n)
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	next, pending := 0, 0
+	attempt := func() {
+		i := next
+		next++
+		pending++
+		go func() {
+			conn, err := dial(attemptCtx, i)
+			results <- result{conn: conn, err: err}
+		}()
+	}
+
+	attempt()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		var timerC <-chan time.Time
+		if next < n {
+			timerC = timer.C
+		}
+		select {
+		case <-timerC:
+			attempt()
+			timer.Reset(delay)
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close connections from the attempts that are still
+				// pending, in case they succeed before being cancelled.
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if r := <-results; r.err == nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < n {
+				// Start the next attempt as soon as an attempt fails.
+				attempt()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+// interleaveIPs orders IP addresses by alternating between IPv6 and IPv4
+// addresses, starting with IPv6, and otherwise preserving the order of the
+// resolver.
+func interleaveIPs(ipAddrs []net.IPAddr) []net.IPAddr {
+	v4, v6 := []net.IPAddr{}, []net.IPAddr{}
+	for _, ipAddr := range ipAddrs {
+		if ipAddr.IP.To4() != nil {
+			v4 = append(v4, ipAddr)
+		} else {
+			v6 = append(v6, ipAddr)
+		}
+	}
+	ips := make([]net.IPAddr, 0, len(ipAddrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ips = append(ips, v6[i])
+		}
+		if i < len(v4) {
+			ips = append(ips, v4[i])
+		}
+	}
+	return ips
+}
@@ -0,0 +1,83 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// IdleTimeout wraps a network connection so that it is closed once nothing has
+// been read from it for the timeout, in which case the onIdle function (if it
+// is not nil) is also called. This reclaims network connections from remote
+// peers that connect, but then send nothing (for example, "slow loris"
+// clients), without affecting remote peers that are active. Only time spent
+// reading counts, so the network connection is never idle while nothing is
+// reading from it. Read deadlines that are set explicitly are still respected,
+// whenever they are earlier than the idle deadline. A non-positive timeout
+// does not wrap the network connection.
+func IdleTimeout(conn net.Conn, timeout time.Duration, onIdle func()) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, timeout: timeout, onIdle: onIdle, deadlineMu: new(sync.Mutex)}
+}
+
+type idleConn struct {
+	net.Conn
+
+	timeout time.Duration
+	onIdle  func()
+	idle    sync.Once
+
+	// deadline is the read deadline that was set explicitly, if any.
+	deadlineMu *sync.Mutex
+	deadline   time.Time
+}
+
+// Read from the network connection, closing it if nothing is read before the
+// idle deadline.
+func (conn *idleConn) Read(p []byte) (int, error) {
+	idleDeadline := time.Now().Add(conn.timeout)
+	deadline := idleDeadline
+	conn.deadlineMu.Lock()
+	if !conn.deadline.IsZero() && conn.deadline.Before(deadline) {
+		deadline = conn.deadline
+	}
+	conn.deadlineMu.Unlock()
+
+	if err := conn.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	n, err := conn.Conn.Read(p)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(idleDeadline) {
+		// The idle deadline was reached, rather than a deadline that was set
+		// explicitly.
+		conn.idle.Do(func() {
+			conn.Conn.Close()
+			if conn.onIdle != nil {
+				conn.onIdle()
+			}
+		})
+	}
+	return n, err
+}
+
+// SetDeadline sets the read and write deadlines of the network connection.
+func (conn *idleConn) SetDeadline(t time.Time) error {
+	conn.deadlineMu.Lock()
+	conn.deadline = t
+	conn.deadlineMu.Unlock()
+
+	return conn.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the network connection.
+func (conn *idleConn) SetReadDeadline(t time.Time) error {
+	conn.deadlineMu.Lock()
+	conn.deadline = t
+	conn.deadlineMu.Unlock()
+
+	return conn.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,82 @@
+package tcp_test
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("IdleTimeout", func() {
+	Context("when the timeout is not positive", func() {
+		It("should not wrap the network connection", func() {
+			conn, _ := net.Pipe()
+			defer conn.Close()
+			Expect(tcp.IdleTimeout(conn, 0, nil)).To(Equal(conn))
+		})
+	})
+
+	Context("when the remote peer keeps sending", func() {
+		It("should not time out", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.IdleTimeout(local, 200*time.Millisecond, nil)
+			defer conn.Close()
+
+			go func() {
+				for i := 0; i < 5; i++ {
+					time.Sleep(100 * time.Millisecond)
+					if _, err := remote.Write([]byte{byte(i)}); err != nil {
+						return
+					}
+				}
+			}()
+
+			buf := make([]byte, 1)
+			for i := 0; i < 5; i++ {
+				_, err := conn.Read(buf)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(buf[0]).To(Equal(byte(i)))
+			}
+		})
+	})
+
+	Context("when the remote peer sends nothing", func() {
+		It("should close the network connection", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			idle := make(chan struct{})
+			conn := tcp.IdleTimeout(local, 200*time.Millisecond, func() { close(idle) })
+			defer conn.Close()
+
+			start := time.Now()
+			_, err := conn.Read(make([]byte, 1))
+			Expect(err).To(MatchError(os.ErrDeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			Expect(idle).To(BeClosed())
+
+			// The remote end sees that the network connection was closed.
+			_, err = remote.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should respect earlier deadlines", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			idle := make(chan struct{})
+			conn := tcp.IdleTimeout(local, time.Minute, func() { close(idle) })
+			defer conn.Close()
+
+			Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			start := time.Now()
+			_, err := conn.Read(make([]byte, 1))
+			Expect(err).To(MatchError(os.ErrDeadlineExceeded))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+			Expect(idle).ToNot(BeClosed())
+		})
+	})
+})
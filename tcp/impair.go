@@ -0,0 +1,249 @@
+package tcp
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRetransmitDelay is the minimum retransmission timeout used by Linux.
+var DefaultRetransmitDelay = 200 * time.Millisecond
+
+// impairedQueueSize is the number of reads, or writes, that can be delayed at
+// once by an impaired network connection, before reading from, or writing to,
+// the network connection waits.
+const impairedQueueSize = 64
+
+// impairedReadSize is the maximum number of bytes read at once by an impaired
+// network connection.
+const impairedReadSize = 32 * 1024
+
+// An Impairment describes artificial network conditions, such as those of a
+// WAN, to inject into a network connection. It is intended for testing how
+// applications behave under realistic network conditions, and must not be
+// used in production.
+type Impairment struct {
+	// Latency added to all bytes.
+	Latency time.Duration
+	// Jitter is the maximum random latency added on top of Latency. Bytes
+	// are never reordered, so bytes with less jitter wait for the bytes
+	// before them.
+	Jitter time.Duration
+	// Loss is the probability, between 0 and 1, that bytes are lost. Lost
+	// bytes would be retransmitted by TCP, so they are delayed by an extra
+	// RetransmitDelay instead of being dropped.
+	Loss float64
+	// RetransmitDelay added to lost bytes. If it is zero, the
+	// DefaultRetransmitDelay is used.
+	RetransmitDelay time.Duration
+}
+
+func (impairment Impairment) enabled() bool {
+	return impairment.Latency > 0 || impairment.Jitter > 0 || impairment.Loss > 0
+}
+
+func (impairment Impairment) delay() time.Duration {
+	delay := impairment.Latency
+	if impairment.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(impairment.Jitter)))
+	}
+	if impairment.Loss > 0 && rand.Float64() < impairment.Loss {
+		if impairment.RetransmitDelay > 0 {
+			delay += impairment.RetransmitDelay
+		} else {
+			delay += DefaultRetransmitDelay
+		}
+	}
+	return delay
+}
+
+// Impair wraps a network connection so that the bytes written to it, and the
+// bytes read from it, are delayed according to their Impairments. Delayed
+// bytes are buffered, like they would be by the network, so writing does not
+// wait for the delay unless too many writes are buffered. If neither
+// Impairment does anything, the network connection is returned unchanged.
+func Impair(conn net.Conn, writes, reads Impairment) net.Conn {
+	if !writes.enabled() && !reads.enabled() {
+		return conn
+	}
+	impairedConn := &impairedConn{
+		Conn:      conn,
+		writes:    writes,
+		reads:     reads,
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+
+		writeMu:     new(sync.Mutex),
+		writeFailed: make(chan struct{}),
+
+		readMu: new(sync.Mutex),
+	}
+	if writes.enabled() {
+		impairedConn.writeQueue = make(chan impairedBytes, impairedQueueSize)
+		go impairedConn.writeInBackground()
+	}
+	if reads.enabled() {
+		impairedConn.readQueue = make(chan impairedBytes, impairedQueueSize)
+		go impairedConn.readInBackground()
+	}
+	return impairedConn
+}
+
+// impairedBytes are bytes that cannot be used until they are due.
+type impairedBytes struct {
+	data []byte
+	err  error
+	due  time.Time
+}
+
+type impairedConn struct {
+	net.Conn
+
+	writes Impairment
+	reads  Impairment
+
+	closed    chan struct{}
+	closeOnce *sync.Once
+
+	// writeQueue is nil if writes are not impaired. When writing to the
+	// network connection fails, the error is stored, and writeFailed is
+	// closed.
+	writeMu     *sync.Mutex
+	writeQueue  chan impairedBytes
+	writeDue    time.Time
+	writeErr    error
+	writeFailed chan struct{}
+
+	// readQueue is nil if reads are not impaired. Bytes from the queue that
+	// have not yet been read are kept in readBuf.
+	readMu    *sync.Mutex
+	readQueue chan impairedBytes
+	readDue   time.Time
+	readBuf   []byte
+	readErr   error
+}
+
+// Write the bytes to the network connection once they are due. The bytes are
+// copied, so that they can be reused by the caller.
+func (conn *impairedConn) Write(p []byte) (int, error) {
+	if conn.writeQueue == nil {
+		return conn.Conn.Write(p)
+	}
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+
+	due := time.Now().Add(conn.writes.delay())
+	if due.Before(conn.writeDue) {
+		due = conn.writeDue
+	}
+	conn.writeDue = due
+
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	case <-conn.writeFailed:
+		return 0, conn.writeErr
+	case conn.writeQueue <- impairedBytes{data: append([]byte(nil), p...), due: due}:
+		return len(p), nil
+	}
+}
+
+func (conn *impairedConn) writeInBackground() {
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case b := <-conn.writeQueue:
+			if !conn.waitUntil(b.due) {
+				return
+			}
+			if _, err := conn.Conn.Write(b.data); err != nil {
+				conn.writeErr = err
+				close(conn.writeFailed)
+				return
+			}
+		}
+	}
+}
+
+// Read bytes from the network connection once they are due. Errors are
+// returned after the bytes that were read before them.
+func (conn *impairedConn) Read(p []byte) (int, error) {
+	if conn.readQueue == nil {
+		return conn.Conn.Read(p)
+	}
+
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	if len(conn.readBuf) == 0 && conn.readErr == nil {
+		select {
+		case <-conn.closed:
+			return 0, net.ErrClosed
+		case b := <-conn.readQueue:
+			if !conn.waitUntil(b.due) {
+				return 0, net.ErrClosed
+			}
+			conn.readBuf, conn.readErr = b.data, b.err
+		}
+	}
+	n := copy(p, conn.readBuf)
+	conn.readBuf = conn.readBuf[n:]
+	if len(conn.readBuf) == 0 && conn.readErr != nil {
+		err := conn.readErr
+		conn.readErr = nil
+		return n, err
+	}
+	return n, nil
+}
+
+func (conn *impairedConn) readInBackground() {
+	for {
+		buf := make([]byte, impairedReadSize)
+		n, err := conn.Conn.Read(buf)
+
+		due := time.Now().Add(conn.reads.delay())
+		if due.Before(conn.readDue) {
+			due = conn.readDue
+		}
+		conn.readDue = due
+
+		select {
+		case <-conn.closed:
+			return
+		case conn.readQueue <- impairedBytes{data: buf[:n], err: err, due: due}:
+		}
+		// Reading can continue after a deadline is exceeded, because the
+		// deadline can be changed.
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			return
+		}
+	}
+}
+
+// waitUntil the time, returning false if the network connection is closed
+// first.
+func (conn *impairedConn) waitUntil(due time.Time) bool {
+	wait := time.Until(due)
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-conn.closed:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Close the network connection. Bytes that are not yet due are dropped.
+func (conn *impairedConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return conn.Conn.Close()
+}
@@ -0,0 +1,81 @@
+package tcp_test
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Impair", func() {
+	Context("when there is no impairment", func() {
+		It("should not wrap the network connection", func() {
+			conn, _ := net.Pipe()
+			defer conn.Close()
+			Expect(tcp.Impair(conn, tcp.Impairment{}, tcp.Impairment{})).To(Equal(conn))
+		})
+	})
+
+	Context("when writes are impaired", func() {
+		It("should delay the bytes without blocking the writer, or reordering them", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Impair(local, tcp.Impairment{Latency: 200 * time.Millisecond, Jitter: 100 * time.Millisecond}, tcp.Impairment{})
+			defer conn.Close()
+
+			start := time.Now()
+			for i := 0; i < 10; i++ {
+				_, err := conn.Write([]byte{byte(i)})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+
+			data := make([]byte, 10)
+			_, err := io.ReadFull(remote, data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		})
+	})
+
+	Context("when reads are impaired", func() {
+		It("should delay the bytes", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Impair(local, tcp.Impairment{}, tcp.Impairment{Latency: 200 * time.Millisecond})
+			defer conn.Close()
+
+			start := time.Now()
+			go remote.Write([]byte("hello"))
+			data := make([]byte, 5)
+			_, err := io.ReadFull(conn, data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal("hello"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+
+			remote.Close()
+			_, err = conn.Read(data)
+			Expect(err).To(Equal(io.EOF))
+		})
+	})
+
+	Context("when bytes are lost", func() {
+		It("should delay them until they are retransmitted", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Impair(local, tcp.Impairment{Loss: 1, RetransmitDelay: 300 * time.Millisecond}, tcp.Impairment{})
+			defer conn.Close()
+
+			start := time.Now()
+			_, err := conn.Write([]byte("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = io.ReadFull(remote, make([]byte, 5))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+	})
+})
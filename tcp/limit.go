@@ -0,0 +1,244 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitPolicy defines what a ConnLimiter does when a network connection is
+// accepted while the maximum number of network connections are open.
+type LimitPolicy uint8
+
+// Enumerate all LimitPolicy values.
+const (
+	// LimitReject closes new network connections immediately.
+	LimitReject LimitPolicy = iota
+	// LimitBlock stops accepting network connections until an open network
+	// connection is closed. New network connections wait in the backlog of
+	// the listener.
+	LimitBlock
+	// LimitEvictIdle closes the open network connection that has been idle
+	// for the longest time, to make room for the new network connection.
+	LimitEvictIdle
+)
+
+// String implements the Stringer interface.
+func (policy LimitPolicy) String() string {
+	switch policy {
+	case LimitReject:
+		return "reject"
+	case LimitBlock:
+		return "block"
+	case LimitEvictIdle:
+		return "evict-idle"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnLimitStats is a snapshot of a ConnLimiter.
+type ConnLimitStats struct {
+	// Conns is the number of network connections that are open.
+	Conns int
+	// Max is the maximum number of network connections that can be open.
+	Max int
+	// Rejected is the number of network connections that have been closed
+	// immediately, because the limit was reached.
+	Rejected uint64
+	// Evicted is the number of idle network connections that have been closed
+	// to make room for new ones.
+	Evicted uint64
+}
+
+// A ConnLimiter limits the number of network connections that can be accepted
+// by its listeners, and kept open, at once. A ConnLimiter can be shared by
+// many listeners, in which case the limit applies to all of them together.
+type ConnLimiter struct {
+	// The 64-bit fields are first, because they are accessed atomically.
+	rejected uint64
+	evicted  uint64
+
+	max    int
+	policy LimitPolicy
+
+	// slots has one value for each network connection that is open.
+	slots chan struct{}
+
+	connsMu *sync.Mutex
+	conns   map[*limitedConn]struct{}
+}
+
+// NewConnLimiter returns a ConnLimiter that allows at most the maximum number
+// of network connections to be open at once, and applies the policy when the
+// limit is reached.
+func NewConnLimiter(max int, policy LimitPolicy) *ConnLimiter {
+	if max < 1 {
+		max = 1
+	}
+	return &ConnLimiter{
+		max:    max,
+		policy: policy,
+
+		slots: make(chan struct{}, max),
+
+		connsMu: new(sync.Mutex),
+		conns:   map[*limitedConn]struct{}{},
+	}
+}
+
+// Listener wraps a listener so that the network connections it accepts are
+// limited.
+func (limiter *ConnLimiter) Listener(listener net.Listener) net.Listener {
+	return &limitedListener{
+		Listener: listener,
+		limiter:  limiter,
+		done:     make(chan struct{}),
+	}
+}
+
+// Stats returns a snapshot of the ConnLimiter.
+func (limiter *ConnLimiter) Stats() ConnLimitStats {
+	return ConnLimitStats{
+		Conns:    len(limiter.slots),
+		Max:      limiter.max,
+		Rejected: atomic.LoadUint64(&limiter.rejected),
+		Evicted:  atomic.LoadUint64(&limiter.evicted),
+	}
+}
+
+// evictIdle closes the open network connection that has been idle for the
+// longest time. It returns false if there are no open network connections.
+func (limiter *ConnLimiter) evictIdle() bool {
+	limiter.connsMu.Lock()
+	var idlest *limitedConn
+	for conn := range limiter.conns {
+		if idlest == nil || atomic.LoadInt64(&conn.lastActivity) < atomic.LoadInt64(&idlest.lastActivity) {
+			idlest = conn
+		}
+	}
+	limiter.connsMu.Unlock()
+
+	if idlest == nil {
+		return false
+	}
+	atomic.AddUint64(&limiter.evicted, 1)
+	idlest.Close()
+	return true
+}
+
+func (limiter *ConnLimiter) track(conn net.Conn) net.Conn {
+	limitedConn := &limitedConn{
+		Conn:         conn,
+		limiter:      limiter,
+		lastActivity: time.Now().UnixNano(),
+	}
+
+	limiter.connsMu.Lock()
+	defer limiter.connsMu.Unlock()
+
+	limiter.conns[limitedConn] = struct{}{}
+	return limitedConn
+}
+
+func (limiter *ConnLimiter) release(conn *limitedConn) {
+	limiter.connsMu.Lock()
+	delete(limiter.conns, conn)
+	limiter.connsMu.Unlock()
+
+	<-limiter.slots
+}
+
+type limitedListener struct {
+	net.Listener
+
+	limiter   *ConnLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next network connection that is allowed by the
+// ConnLimiter.
+func (listener *limitedListener) Accept() (net.Conn, error) {
+	limiter := listener.limiter
+	for {
+		if limiter.policy == LimitBlock {
+			select {
+			case limiter.slots <- struct{}{}:
+			case <-listener.done:
+				return nil, net.ErrClosed
+			}
+			conn, err := listener.Listener.Accept()
+			if err != nil {
+				<-limiter.slots
+				return nil, err
+			}
+			return limiter.track(conn), nil
+		}
+
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case limiter.slots <- struct{}{}:
+			return limiter.track(conn), nil
+		default:
+		}
+
+		if limiter.policy == LimitEvictIdle && limiter.evictIdle() {
+			// The evicted network connection releases its slot when it is
+			// closed, but other listeners sharing the ConnLimiter might take
+			// it first.
+			select {
+			case limiter.slots <- struct{}{}:
+				return limiter.track(conn), nil
+			default:
+			}
+		}
+		atomic.AddUint64(&limiter.rejected, 1)
+		conn.Close()
+	}
+}
+
+// Close the listener, and stop waiting for network connections to be closed.
+func (listener *limitedListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.done) })
+	return listener.Listener.Close()
+}
+
+// limitedConn releases its slot in the ConnLimiter when it is closed, and
+// tracks its last activity so that idle network connections can be evicted.
+type limitedConn struct {
+	lastActivity int64 // Unix nanoseconds.
+
+	net.Conn
+
+	limiter   *ConnLimiter
+	closeOnce sync.Once
+}
+
+func (conn *limitedConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (conn *limitedConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Close the network connection, and release its slot. Closing more than once
+// only releases the slot once.
+func (conn *limitedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(func() { conn.limiter.release(conn) })
+	return err
+}
@@ -0,0 +1,105 @@
+package tcp_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConnLimiter", func() {
+	// accept network connections from a limited listener until it is closed,
+	// sending them to the returned channel.
+	accept := func(limiter *tcp.ConnLimiter) (net.Listener, chan net.Conn) {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		listener = limiter.Listener(listener)
+		conns := make(chan net.Conn, 10)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conns <- conn
+			}
+		}()
+		return listener, conns
+	}
+
+	dial := func(listener net.Listener) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	Context("when the policy is to reject", func() {
+		It("should close new network connections once the limit is reached", func() {
+			limiter := tcp.NewConnLimiter(1, tcp.LimitReject)
+			listener, conns := accept(limiter)
+			defer listener.Close()
+
+			defer dial(listener).Close()
+			Eventually(conns).Should(Receive())
+			defer dial(listener).Close()
+			Eventually(func() uint64 { return limiter.Stats().Rejected }).Should(Equal(uint64(1)))
+			Consistently(conns).ShouldNot(Receive())
+			Expect(limiter.Stats().Conns).To(Equal(1))
+		})
+	})
+
+	Context("when the policy is to block", func() {
+		It("should accept new network connections once an open one is closed", func() {
+			limiter := tcp.NewConnLimiter(1, tcp.LimitBlock)
+			listener, conns := accept(limiter)
+			defer listener.Close()
+
+			defer dial(listener).Close()
+			var first net.Conn
+			Eventually(conns).Should(Receive(&first))
+			defer dial(listener).Close()
+			Consistently(conns).ShouldNot(Receive())
+
+			first.Close()
+			Eventually(conns).Should(Receive())
+			Expect(limiter.Stats().Conns).To(Equal(1))
+			Expect(limiter.Stats().Rejected).To(Equal(uint64(0)))
+		})
+	})
+
+	Context("when the policy is to evict idle network connections", func() {
+		It("should close the network connection that has been idle for the longest time", func() {
+			limiter := tcp.NewConnLimiter(2, tcp.LimitEvictIdle)
+			listener, conns := accept(limiter)
+			defer listener.Close()
+
+			defer dial(listener).Close()
+			var idle net.Conn
+			Eventually(conns).Should(Receive(&idle))
+			active := dial(listener)
+			defer active.Close()
+			var activeConn net.Conn
+			Eventually(conns).Should(Receive(&activeConn))
+
+			// Make the second network connection active.
+			time.Sleep(10 * time.Millisecond)
+			_, err := active.Write([]byte{1})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = activeConn.Read(make([]byte, 1))
+			Expect(err).ToNot(HaveOccurred())
+
+			defer dial(listener).Close()
+			Eventually(conns).Should(Receive())
+			Expect(limiter.Stats().Evicted).To(Equal(uint64(1)))
+			Expect(limiter.Stats().Conns).To(Equal(2))
+
+			_, err = idle.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+			_, err = activeConn.Write([]byte{1})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
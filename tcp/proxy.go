@@ -0,0 +1,244 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature is the signature that begins every PROXY protocol v2
+// header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header, including
+// the trailing CRLF.
+const proxyV1MaxLen = 107
+
+// ProxyProtocol wraps a listener so that every network connection that it
+// accepts must begin with a PROXY protocol (v1 or v2) header, such as those
+// sent by HAProxy or an AWS NLB. The header is consumed, and the network
+// connection reports the address of the original client as its remote
+// address, so that logging, rate limiting, and filtering see the original
+// client instead of the load balancer. Headers for local connections (such as
+// health checks) keep the remote address of the network connection.
+//
+// Headers are read in the background, so a slow client does not block
+// Accept, but they must be read before the timeout. Network connections that
+// do not begin with a valid header are closed, and an error is returned from
+// Accept. Only use this listener when all network connections arrive through
+// a load balancer, because clients that connect directly can set their own
+// headers.
+func ProxyProtocol(listener net.Listener, timeout time.Duration) net.Listener {
+	proxyListener := &proxyListener{
+		Listener: listener,
+		timeout:  timeout,
+
+		accepted: make(chan proxyAccept),
+		done:     make(chan struct{}),
+		doneOnce: new(sync.Once),
+	}
+	go proxyListener.acceptInBackground()
+	return proxyListener
+}
+
+type proxyAccept struct {
+	conn net.Conn
+	err  error
+}
+
+type proxyListener struct {
+	net.Listener
+
+	timeout time.Duration
+
+	accepted chan proxyAccept
+	done     chan struct{}
+	doneOnce *sync.Once
+}
+
+// Accept waits for the next network connection that has sent a valid header.
+func (listener *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.done:
+		return nil, net.ErrClosed
+	case accepted := <-listener.accepted:
+		return accepted.conn, accepted.err
+	}
+}
+
+// Close the listener. Network connections that finish sending their headers
+// after the listener is closed are also closed.
+func (listener *proxyListener) Close() error {
+	listener.doneOnce.Do(func() { close(listener.done) })
+	return listener.Listener.Close()
+}
+
+func (listener *proxyListener) acceptInBackground() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			listener.deliver(proxyAccept{err: err})
+			select {
+			case <-listener.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			proxyConn, err := readProxyHeader(conn, listener.timeout)
+			if err != nil {
+				conn.Close()
+				listener.deliver(proxyAccept{err: fmt.Errorf("proxy protocol from %v: %w", conn.RemoteAddr(), err)})
+				return
+			}
+			if !listener.deliver(proxyAccept{conn: proxyConn}) {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// deliver the result of accepting a network connection, returning false if
+// the listener was closed first.
+func (listener *proxyListener) deliver(accepted proxyAccept) bool {
+	select {
+	case <-listener.done:
+		return false
+	case listener.accepted <- accepted:
+		return true
+	}
+}
+
+type proxyConn struct {
+	net.Conn
+
+	remoteAddr net.Addr
+}
+
+// RemoteAddr returns the address of the original client.
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// readProxyHeader reads the PROXY protocol header from the beginning of a
+// network connection. No bytes after the header are read. If the header does
+// not carry the address of a client, the network connection is returned
+// unchanged.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// The shortest v1 header ("PROXY UNKNOWN\r\n") is longer than the v2
+	// signature, so it is always safe to read this many bytes.
+	prefix := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	var addr net.Addr
+	var err error
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		addr, err = readProxyV2(conn)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		addr, err = readProxyV1(conn, prefix)
+	default:
+		return nil, fmt.Errorf("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remoteAddr: addr}, nil
+}
+
+// readProxyV1 reads the remainder of a v1 header, which is a line of text,
+// one byte at a time so that nothing after the header is read.
+func readProxyV1(conn net.Conn, prefix []byte) (net.Addr, error) {
+	line := append(make([]byte, 0, proxyV1MaxLen), prefix...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("v1 header is too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("malformed v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the remainder of a v2 header, which is binary.
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	if version := head[0] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %v", version)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+
+	switch command := head[0] & 0x0F; command {
+	case 0x0:
+		// The network connection was made by the load balancer itself.
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %v", command)
+	}
+
+	// Only TCP over IPv4 and IPv6 carry an address that is useful. Addresses
+	// are followed by optional TLVs, which are ignored.
+	switch head[1] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("malformed v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:4]...)), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("malformed v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, body[0:16]...)), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,111 @@
+package tcp_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ProxyProtocol", func() {
+	listen := func() net.Listener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		return tcp.ProxyProtocol(listener, time.Second)
+	}
+
+	dial := func(listener net.Listener, header []byte) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write(append(header, []byte("hello")...))
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	accept := func(listener net.Listener) net.Conn {
+		conn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+
+		// The bytes after the header are not consumed.
+		data := make([]byte, 5)
+		_, err = io.ReadFull(conn, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("hello"))
+		return conn
+	}
+
+	Context("when a network connection sends a v1 header", func() {
+		It("should report the address of the original client", func() {
+			listener := listen()
+			defer listener.Close()
+
+			client := dial(listener, []byte("PROXY TCP4 203.0.113.7 198.51.100.1 56324 18514\r\n"))
+			defer client.Close()
+			conn := accept(listener)
+			defer conn.Close()
+			Expect(conn.RemoteAddr().String()).To(Equal("203.0.113.7:56324"))
+		})
+	})
+
+	Context("when a network connection sends a v2 header", func() {
+		It("should report the address of the original client", func() {
+			listener := listen()
+			defer listener.Close()
+
+			header := []byte("\r\n\r\n\x00\r\nQUIT\n")
+			header = append(header, 0x21, 0x21, 0, 36)
+			header = append(header, net.ParseIP("2001:db8::7")...)
+			header = append(header, net.ParseIP("2001:db8::1")...)
+			header = append(header, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(header[len(header)-4:], 56324)
+			binary.BigEndian.PutUint16(header[len(header)-2:], 18514)
+
+			client := dial(listener, header)
+			defer client.Close()
+			conn := accept(listener)
+			defer conn.Close()
+			Expect(conn.RemoteAddr().String()).To(Equal("[2001:db8::7]:56324"))
+		})
+
+		It("should keep the remote address of local network connections", func() {
+			listener := listen()
+			defer listener.Close()
+
+			client := dial(listener, append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0, 0))
+			defer client.Close()
+			conn := accept(listener)
+			defer conn.Close()
+			Expect(conn.RemoteAddr().String()).To(Equal(client.LocalAddr().String()))
+		})
+	})
+
+	Context("when a network connection does not send a header", func() {
+		It("should close it without blocking other network connections", func() {
+			listener := listen()
+			defer listener.Close()
+
+			// A slow client that never sends a header does not block a
+			// client that does.
+			slow, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer slow.Close()
+			client := dial(listener, []byte("PROXY UNKNOWN\r\n"))
+			defer client.Close()
+			conn := accept(listener)
+			defer conn.Close()
+			Expect(conn.RemoteAddr().String()).To(Equal(client.LocalAddr().String()))
+
+			bad := dial(listener, []byte("GET / HTTP/1.1\r\n"))
+			defer bad.Close()
+			_, err = listener.Accept()
+			Expect(err).To(HaveOccurred())
+			_, err = bad.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,237 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default tarpit options.
+var (
+	DefaultTarpitThreshold = 5
+	DefaultTarpitWindow    = time.Minute
+	DefaultTarpitMaxConns  = 64
+	DefaultTarpitInterval  = 10 * time.Second
+	DefaultTarpitDuration  = 5 * time.Minute
+)
+
+// TarpitOptions for parameterising the behaviour of a Tarpit.
+type TarpitOptions struct {
+	Threshold int
+	Window    time.Duration
+	MaxConns  int
+	Interval  time.Duration
+	Duration  time.Duration
+}
+
+// DefaultTarpitOptions returns TarpitOptions with sensible defaults.
+func DefaultTarpitOptions() TarpitOptions {
+	return TarpitOptions{
+		Threshold: DefaultTarpitThreshold,
+		Window:    DefaultTarpitWindow,
+		MaxConns:  DefaultTarpitMaxConns,
+		Interval:  DefaultTarpitInterval,
+		Duration:  DefaultTarpitDuration,
+	}
+}
+
+// WithThreshold sets the number of failures, within the window, after which
+// connections from an IP address are tarpitted.
+func (opts TarpitOptions) WithThreshold(threshold int) TarpitOptions {
+	opts.Threshold = threshold
+	return opts
+}
+
+// WithWindow sets the duration for which failures are remembered. An IP
+// address that has not failed within this window is no longer tarpitted. While
+// the Tarpit is running, failures are forgotten at every window.
+func (opts TarpitOptions) WithWindow(window time.Duration) TarpitOptions {
+	opts.Window = window
+	return opts
+}
+
+// WithMaxConns sets the maximum number of connections that can be held in the
+// tarpit at once. Once this is reached, connections from suspect IP addresses
+// are closed immediately.
+func (opts TarpitOptions) WithMaxConns(maxConns int) TarpitOptions {
+	opts.MaxConns = maxConns
+	return opts
+}
+
+// WithInterval sets how often a single byte is written to a tarpitted
+// connection to keep the remote end waiting. If the interval is not positive,
+// tarpitted connections are held without being written to.
+func (opts TarpitOptions) WithInterval(interval time.Duration) TarpitOptions {
+	opts.Interval = interval
+	return opts
+}
+
+// WithDuration sets how long a connection is held in the tarpit before it is
+// released.
+func (opts TarpitOptions) WithDuration(duration time.Duration) TarpitOptions {
+	opts.Duration = duration
+	return opts
+}
+
+type tarpitFailures struct {
+	n     int
+	since time.Time
+}
+
+// A Tarpit tracks IP addresses that repeatedly fail validation (for example,
+// by failing handshakes), and holds connections from these IP addresses open
+// while responding extremely slowly. This wastes the resources of scanners,
+// without consuming more than a bounded number of local connections.
+type Tarpit struct {
+	opts TarpitOptions
+
+	mu       *sync.Mutex
+	failures map[string]tarpitFailures
+	conns    int
+}
+
+// NewTarpit returns an empty Tarpit.
+func NewTarpit(opts TarpitOptions) *Tarpit {
+	return &Tarpit{
+		opts: opts,
+
+		mu:       new(sync.Mutex),
+		failures: map[string]tarpitFailures{},
+	}
+}
+
+// Fail records a failed validation from the IP address of a remote peer.
+func (tarpit *Tarpit) Fail(addr net.Addr) {
+	ip := ipOf(addr)
+	now := time.Now()
+
+	tarpit.mu.Lock()
+	defer tarpit.mu.Unlock()
+
+	f, ok := tarpit.failures[ip]
+	if !ok || now.Sub(f.since) > tarpit.opts.Window {
+		// Forget failures that happened outside of the window. Before adding
+		// a new IP address, we take the opportunity to drop all expired IP
+		// addresses so that the map cannot grow without bound.
+		if !ok {
+			tarpit.prune(now)
+		}
+		f = tarpitFailures{since: now}
+	}
+	f.n++
+	tarpit.failures[ip] = f
+}
+
+// Run the Tarpit until the context is done. At every window, the failures of IP
+// addresses that have not failed within the window are forgotten, so that IP
+// addresses that stop failing do not stay in memory until another IP address
+// fails.
+func (tarpit *Tarpit) Run(ctx context.Context) {
+	if tarpit.opts.Window <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(tarpit.opts.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tarpit.mu.Lock()
+			tarpit.prune(now)
+			tarpit.mu.Unlock()
+		}
+	}
+}
+
+// Len returns the number of IP addresses whose failures are remembered.
+func (tarpit *Tarpit) Len() int {
+	tarpit.mu.Lock()
+	defer tarpit.mu.Unlock()
+
+	return len(tarpit.failures)
+}
+
+// prune the failures that happened outside of the window. It must be called
+// while holding the mutex.
+func (tarpit *Tarpit) prune(now time.Time) {
+	for ip, f := range tarpit.failures {
+		if now.Sub(f.since) > tarpit.opts.Window {
+			delete(tarpit.failures, ip)
+		}
+	}
+}
+
+// Suspect returns true if the IP address of a remote peer has failed at least
+// the threshold number of times within the window.
+func (tarpit *Tarpit) Suspect(addr net.Addr) bool {
+	if tarpit.opts.Threshold <= 0 {
+		return false
+	}
+
+	tarpit.mu.Lock()
+	defer tarpit.mu.Unlock()
+
+	f, ok := tarpit.failures[ipOf(addr)]
+	return ok && f.n >= tarpit.opts.Threshold && time.Since(f.since) <= tarpit.opts.Window
+}
+
+// Hold a connection in the tarpit, writing one byte at every interval, until
+// the duration has passed, the context is done, or the connection faults. It
+// returns false, without blocking, if the tarpit is full. The connection is not
+// closed.
+func (tarpit *Tarpit) Hold(ctx context.Context, conn net.Conn) bool {
+	tarpit.mu.Lock()
+	if tarpit.conns >= tarpit.opts.MaxConns {
+		tarpit.mu.Unlock()
+		return false
+	}
+	tarpit.conns++
+	tarpit.mu.Unlock()
+
+	defer func() {
+		tarpit.mu.Lock()
+		tarpit.conns--
+		tarpit.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, tarpit.opts.Duration)
+	defer cancel()
+
+	// Unblock any pending write as soon as the tarpit is done with the
+	// connection.
+	go func() {
+		<-ctx.Done()
+		conn.SetWriteDeadline(time.Now())
+	}()
+
+	var tick <-chan time.Time
+	if tarpit.opts.Interval > 0 {
+		ticker := time.NewTicker(tarpit.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-tick:
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return true
+			}
+		}
+	}
+}
+
+func ipOf(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,103 @@
+package tcp_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tarpit", func() {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	otherPort := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4321}
+	otherIP := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}
+
+	Context("when an IP address fails repeatedly", func() {
+		It("should become a suspect after the threshold", func() {
+			tarpit := tcp.NewTarpit(tcp.DefaultTarpitOptions().WithThreshold(3))
+			for i := 0; i < 2; i++ {
+				tarpit.Fail(addr)
+				Expect(tarpit.Suspect(addr)).To(BeFalse())
+			}
+			tarpit.Fail(otherPort)
+			Expect(tarpit.Suspect(addr)).To(BeTrue())
+			Expect(tarpit.Suspect(otherIP)).To(BeFalse())
+		})
+
+		It("should forget failures outside of the window", func() {
+			tarpit := tcp.NewTarpit(tcp.DefaultTarpitOptions().WithThreshold(1).WithWindow(50 * time.Millisecond))
+			tarpit.Fail(addr)
+			Expect(tarpit.Suspect(addr)).To(BeTrue())
+			time.Sleep(100 * time.Millisecond)
+			Expect(tarpit.Suspect(addr)).To(BeFalse())
+		})
+
+		It("should forget IP addresses outside of the window while running", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tarpit := tcp.NewTarpit(tcp.DefaultTarpitOptions().WithWindow(50 * time.Millisecond))
+			go tarpit.Run(ctx)
+			tarpit.Fail(addr)
+			tarpit.Fail(otherIP)
+			Expect(tarpit.Len()).To(Equal(2))
+			Eventually(tarpit.Len).Should(Equal(0))
+		})
+	})
+
+	Context("when holding connections", func() {
+		It("should trickle bytes and respect the maximum number of connections", func() {
+			tarpit := tcp.NewTarpit(tcp.DefaultTarpitOptions().
+				WithMaxConns(1).
+				WithInterval(10 * time.Millisecond).
+				WithDuration(time.Minute))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			held := make(chan bool, 1)
+			go func() {
+				held <- tarpit.Hold(ctx, local)
+			}()
+
+			// Receive some bytes from the tarpit.
+			buf := make([]byte, 2)
+			_, err := remote.Read(buf[:1])
+			Expect(err).ToNot(HaveOccurred())
+			_, err = remote.Read(buf[1:])
+			Expect(err).ToNot(HaveOccurred())
+
+			// The tarpit is full, so other connections are rejected.
+			other, _ := net.Pipe()
+			Expect(tarpit.Hold(ctx, other)).To(BeFalse())
+
+			cancel()
+			go ioutil.ReadAll(remote)
+			Eventually(held).Should(Receive(BeTrue()))
+		})
+
+		It("should hold connections without writing to them if there is no interval", func() {
+			tarpit := tcp.NewTarpit(tcp.DefaultTarpitOptions().
+				WithInterval(0).
+				WithDuration(100 * time.Millisecond))
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			Expect(tarpit.Hold(context.Background(), local)).To(BeTrue())
+			Expect(remote.SetReadDeadline(time.Now().Add(50 * time.Millisecond))).To(Succeed())
+			_, err := remote.Read(make([]byte, 1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -16,20 +17,21 @@ import (
 // their own background goroutines that run the handle function, and then
 // clean-up the connection. This function blocks until the context is done.
 func Listen(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	return ListenWithLimit(ctx, address, nil, handle, handleErr, allow)
+}
+
+// ListenWithLimit is the same as Listen, but the number of network connections
+// that are accepted and held open at once is limited by the ConnLimiter. By
+// default (when the ConnLimiter is nil), there is no limit.
+func ListenWithLimit(ctx context.Context, address string, limiter *ConnLimiter, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
 	// Create a TCP listener from given address and return an error if unable to do so
 	listener, err := new(net.ListenConfig).Listen(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
-
-	// The 'ctx' we passed to Listen() will not unblock `Listener.Accept()` if
-	// context exceeding the deadline. We need to manually close the listener
-	// to stop `Listener.Accept()` from blocking.
-	// See https://github.com/golang/go/issues/28120
-	go func() {
-		<- ctx.Done()
-		listener.Close()
-	}()
+	if limiter != nil {
+		listener = limiter.Listener(listener)
+	}
 	return ListenWithListener(ctx, listener, handle, handleErr, allow)
 }
 
@@ -37,7 +39,8 @@ func Listen(ctx context.Context, address string, handle func(net.Conn), handleEr
 // address, it accepts an already constructed listener.
 //
 // NOTE: The listener passed to this function will be closed when the given
-// context finishes.
+// context finishes. If the listener is closed for any other reason, then this
+// function returns an error that wraps net.ErrClosed.
 func ListenWithListener(ctx context.Context, listener net.Listener, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
 	if handle == nil {
 		return fmt.Errorf("nil handle function")
@@ -49,6 +52,14 @@ func ListenWithListener(ctx context.Context, listener net.Listener, handle func(
 
 	defer listener.Close()
 
+	// The 'ctx' being done will not unblock `Listener.Accept()`. We need to
+	// manually close the listener to stop `Listener.Accept()` from blocking.
+	// See https://github.com/golang/go/issues/28120
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -58,6 +69,14 @@ func ListenWithListener(ctx context.Context, listener net.Listener, handle func(
 
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The listener will never accept another connection, so
+				// there is no point in trying again.
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return fmt.Errorf("accept connection: %w", err)
+			}
 			handleErr(fmt.Errorf("accept connection: %w", err))
 			continue
 		}
@@ -105,7 +124,24 @@ func ListenerWithAssignedPort(ctx context.Context, ip string) (net.Listener, int
 // blocks until the connection is handled (and the handle function returns).
 // This function will clean-up the connection.
 func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
-	dialer := new(net.Dialer)
+	return DialWithBackoff(ctx, address, handle, handleErr, timeout, nil)
+}
+
+// DialWithBackoff is the same as Dial, but after a failed dial attempt it waits
+// for the duration returned by the backoff function before making the next
+// attempt. By default (when the backoff function is nil), the next attempt is
+// made once the timeout of the failed attempt has passed.
+func DialWithBackoff(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration, backoff func(int) time.Duration) error {
+	return DialUsing(ctx, nil, address, handle, handleErr, timeout, backoff)
+}
+
+// DialUsing is the same as DialWithBackoff, but uses the DialFunc to make each
+// dial attempt (for example, see DualStackDialer). By default (when the DialFunc
+// is nil), a net.Dialer is used.
+func DialUsing(ctx context.Context, dial DialFunc, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration, backoff func(int) time.Duration) error {
+	if dial == nil {
+		dial = new(net.Dialer).DialContext
+	}
 
 	if handle == nil {
 		return fmt.Errorf("nil handle function")
@@ -127,11 +163,19 @@ func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr
 		}
 
 		dialCtx, dialCancel := context.WithTimeout(ctx, timeout(attempt))
-		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		conn, err := dial(dialCtx, "tcp", address)
 		if err != nil {
 			handleErr(err)
-			<-dialCtx.Done()
+			if backoff == nil {
+				<-dialCtx.Done()
+				dialCancel()
+				continue
+			}
 			dialCancel()
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff(attempt)):
+			}
 			continue
 		}
 		dialCancel()
@@ -211,4 +211,85 @@ var _ = Describe("TCP", func() {
 			}
 		})
 	})
+
+	Context("when the listener is closed by the caller", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, _, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			done := make(chan error, 1)
+			go func() {
+				done <- tcp.ListenWithListener(ctx, listener, func(net.Conn) {}, nil, nil)
+			}()
+
+			Expect(listener.Close()).To(Succeed())
+			var listenErr error
+			Eventually(done, 5*time.Second).Should(Receive(&listenErr))
+			Expect(listenErr).To(MatchError(net.ErrClosed))
+		})
+	})
+
+	Context("when dialing with the dual-stack dialer", func() {
+		It("should connect to the listener", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			accepted := make(chan struct{}, 1)
+			go tcp.ListenWithListener(ctx, listener, func(conn net.Conn) { accepted <- struct{}{} }, nil, nil)
+
+			// The delay between attempts is long enough that the test will
+			// only pass if failed attempts (for example, to an IPv6 address
+			// that is not being listened on) immediately start the next
+			// attempt.
+			dial := tcp.DualStackDialer(time.Hour)
+			dialed := make(chan net.Addr, 1)
+			Expect(tcp.DialUsing(
+				ctx,
+				dial,
+				fmt.Sprintf("localhost:%v", port),
+				func(conn net.Conn) { dialed <- conn.RemoteAddr() },
+				nil,
+				policy.ConstantTimeout(time.Second),
+				nil)).To(Succeed())
+			Expect((<-dialed).String()).To(Equal(fmt.Sprintf("127.0.0.1:%v", port)))
+			Eventually(accepted).Should(Receive())
+		})
+	})
+
+	Context("when dialing with the fallback dialer", func() {
+		for _, delay := range []time.Duration{0, time.Hour} {
+			delay := delay
+			It(fmt.Sprintf("should connect to the first fallback that is listening (delay=%v)", delay), func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				// Find a port that is not being listened on.
+				closed, closedPort, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(closed.Close()).To(Succeed())
+
+				listener, port, err := tcp.ListenerWithAssignedPort(ctx, "127.0.0.1")
+				Expect(err).ToNot(HaveOccurred())
+				accepted := make(chan struct{}, 1)
+				go tcp.ListenWithListener(ctx, listener, func(conn net.Conn) { accepted <- struct{}{} }, nil, nil)
+
+				dial := tcp.FallbackDialer(nil, []string{fmt.Sprintf("127.0.0.1:%v", port)}, delay)
+				dialed := make(chan net.Addr, 1)
+				Expect(tcp.DialUsing(
+					ctx,
+					dial,
+					fmt.Sprintf("127.0.0.1:%v", closedPort),
+					func(conn net.Conn) { dialed <- conn.RemoteAddr() },
+					nil,
+					policy.ConstantTimeout(time.Second),
+					nil)).To(Succeed())
+				Expect((<-dialed).String()).To(Equal(fmt.Sprintf("127.0.0.1:%v", port)))
+				Eventually(accepted).Should(Receive())
+			})
+		}
+	})
 })
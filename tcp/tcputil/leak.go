@@ -0,0 +1,123 @@
+// Package tcputil provides helpers for testing code that uses network
+// connections.
+package tcputil
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// A LeakDetector scans all bytes written to network connections for plaintext
+// markers. Tests send messages that contain the markers, and then check that
+// no marker was written, to guard against regressions where a code path
+// writes messages without encrypting them.
+type LeakDetector struct {
+	markers [][]byte
+
+	mu      *sync.Mutex
+	written int
+	leaks   [][]byte
+}
+
+// NewLeakDetector returns a LeakDetector for the given plaintext markers.
+// Markers should be long, and random, so that they cannot appear in encrypted
+// bytes by chance.
+func NewLeakDetector(markers ...[]byte) *LeakDetector {
+	return &LeakDetector{
+		markers: markers,
+
+		mu: new(sync.Mutex),
+	}
+}
+
+// Conn wraps a network connection so that all bytes written to it are
+// scanned for plaintext markers.
+func (detector *LeakDetector) Conn(conn net.Conn) net.Conn {
+	maxLen := 0
+	for _, marker := range detector.markers {
+		if len(marker) > maxLen {
+			maxLen = len(marker)
+		}
+	}
+	return &leakConn{Conn: conn, detector: detector, tailLen: maxLen - 1}
+}
+
+// Listener wraps a network listener so that all network connections that it
+// accepts are wrapped by the LeakDetector.
+func (detector *LeakDetector) Listener(listener net.Listener) net.Listener {
+	return &leakListener{Listener: listener, detector: detector}
+}
+
+// Written returns the number of bytes that have been written, and scanned.
+func (detector *LeakDetector) Written() int {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	return detector.written
+}
+
+// Err returns an error if any plaintext marker has been written, otherwise it
+// returns nil.
+func (detector *LeakDetector) Err() error {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	if len(detector.leaks) == 0 {
+		return nil
+	}
+	return fmt.Errorf("leaked %v plaintext markers: first leaked %q", len(detector.leaks), detector.leaks[0])
+}
+
+// scan bytes that were written, together with the tail of the bytes that were
+// previously written, so that markers split across writes are detected.
+func (detector *LeakDetector) scan(p []byte, n int) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	detector.written += n
+	for _, marker := range detector.markers {
+		if len(marker) > 0 && bytes.Contains(p, marker) {
+			detector.leaks = append(detector.leaks, marker)
+		}
+	}
+}
+
+type leakConn struct {
+	net.Conn
+
+	detector *LeakDetector
+	tailLen  int
+
+	// tail of the bytes that were previously written. Writes to a network
+	// connection are not concurrent, so it is not guarded by a mutex.
+	tail []byte
+}
+
+func (conn *leakConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	if n > 0 {
+		window := append(conn.tail, p[:n]...)
+		conn.detector.scan(window, n)
+		if len(window) > conn.tailLen {
+			window = window[len(window)-conn.tailLen:]
+		}
+		conn.tail = append(conn.tail[:0], window...)
+	}
+	return n, err
+}
+
+type leakListener struct {
+	net.Listener
+
+	detector *LeakDetector
+}
+
+func (listener *leakListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return listener.detector.Conn(conn), nil
+}
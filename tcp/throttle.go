@@ -0,0 +1,194 @@
+package tcp
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minThrottleBurst is the smallest number of bytes that a throttled network
+// connection will read, or write, at once. Smaller bursts would cause too many
+// small reads and writes when the limit is low.
+const minThrottleBurst = 4 * 1024
+
+// Throttle wraps a network connection so that reading from it, and writing to
+// it, are each limited to a number of bytes per second. Unlike the rate limits
+// enforced by Channels, which close network connections that exceed them,
+// throttled network connections wait until the bytes are allowed. This stops
+// one remote peer from using all of the bandwidth of a constrained link. A
+// limit of rate.Inf (or a non-positive limit) does not throttle that direction.
+func Throttle(conn net.Conn, readLimit, writeLimit rate.Limit) net.Conn {
+	if !throttled(readLimit) && !throttled(writeLimit) {
+		return conn
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	throttledConn := &throttledConn{Conn: conn, ctx: ctx, cancel: cancel}
+	throttledConn.setLimits(readLimit, writeLimit)
+	return throttledConn
+}
+
+// A ThrottleGroup throttles many network connections, each to the same
+// limits. Unlike Throttle, the limits can be changed while the network
+// connections are open, and the change applies to all of them.
+type ThrottleGroup struct {
+	mu         *sync.Mutex
+	readLimit  rate.Limit
+	writeLimit rate.Limit
+	conns      map[*throttledConn]struct{}
+}
+
+// NewThrottleGroup returns a ThrottleGroup with the given limits. A limit of
+// rate.Inf (or a non-positive limit) does not throttle that direction.
+func NewThrottleGroup(readLimit, writeLimit rate.Limit) *ThrottleGroup {
+	return &ThrottleGroup{
+		mu:         new(sync.Mutex),
+		readLimit:  readLimit,
+		writeLimit: writeLimit,
+		conns:      map[*throttledConn]struct{}{},
+	}
+}
+
+// Throttle wraps a network connection so that it is throttled to the limits
+// of the group until it is closed. The network connection is wrapped even
+// when it is not throttled, so that limits can be set later.
+func (group *ThrottleGroup) Throttle(conn net.Conn) net.Conn {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	throttledConn := &throttledConn{Conn: conn, ctx: ctx, cancel: cancel, group: group}
+	throttledConn.setLimits(group.readLimit, group.writeLimit)
+	group.conns[throttledConn] = struct{}{}
+	return throttledConn
+}
+
+// SetLimits changes the limits of the group, and of all network connections
+// in the group that are open. Reads and writes that are already waiting
+// finish waiting at the old limits.
+func (group *ThrottleGroup) SetLimits(readLimit, writeLimit rate.Limit) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	group.readLimit = readLimit
+	group.writeLimit = writeLimit
+	for conn := range group.conns {
+		conn.setLimits(readLimit, writeLimit)
+	}
+}
+
+func (group *ThrottleGroup) remove(conn *throttledConn) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	delete(group.conns, conn)
+}
+
+func newThrottleLimiter(limit rate.Limit) *rate.Limiter {
+	if !throttled(limit) {
+		return nil
+	}
+	return rate.NewLimiter(limit, throttleBurst(limit))
+}
+
+func throttled(limit rate.Limit) bool {
+	return limit > 0 && limit != rate.Inf
+}
+
+func throttleBurst(limit rate.Limit) int {
+	if burst := int(limit); burst > minThrottleBurst {
+		return burst
+	}
+	return minThrottleBurst
+}
+
+type throttledConn struct {
+	net.Conn
+
+	// ctx is cancelled when the network connection is closed, so that reads
+	// and writes do not keep waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// group is the ThrottleGroup of the network connection, if any. It can
+	// replace the limiters at any time.
+	group *ThrottleGroup
+
+	limitersMu *sync.Mutex
+	reads      *rate.Limiter
+	writes     *rate.Limiter
+}
+
+func (conn *throttledConn) setLimits(readLimit, writeLimit rate.Limit) {
+	if conn.limitersMu == nil {
+		conn.limitersMu = new(sync.Mutex)
+	}
+	conn.limitersMu.Lock()
+	defer conn.limitersMu.Unlock()
+
+	conn.reads = newThrottleLimiter(readLimit)
+	conn.writes = newThrottleLimiter(writeLimit)
+}
+
+func (conn *throttledConn) limiters() (reads, writes *rate.Limiter) {
+	conn.limitersMu.Lock()
+	defer conn.limitersMu.Unlock()
+
+	return conn.reads, conn.writes
+}
+
+// Read at most one burst from the network connection, and then wait until the
+// bytes that were read are allowed.
+func (conn *throttledConn) Read(p []byte) (int, error) {
+	reads, _ := conn.limiters()
+	if reads == nil {
+		return conn.Conn.Read(p)
+	}
+	if len(p) > reads.Burst() {
+		p = p[:reads.Burst()]
+	}
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		if waitErr := reads.WaitN(conn.ctx, n); waitErr != nil && err == nil {
+			err = net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+// Write to the network connection, one burst at a time, waiting until each
+// burst is allowed before writing it.
+func (conn *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		_, writes := conn.limiters()
+		if writes == nil {
+			n, err := conn.Conn.Write(p)
+			return written + n, err
+		}
+		chunk := p
+		if len(chunk) > writes.Burst() {
+			chunk = chunk[:writes.Burst()]
+		}
+		if err := writes.WaitN(conn.ctx, len(chunk)); err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := conn.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close the network connection, and stop waiting.
+func (conn *throttledConn) Close() error {
+	conn.cancel()
+	if conn.group != nil {
+		conn.group.remove(conn)
+	}
+	return conn.Conn.Close()
+}
@@ -0,0 +1,108 @@
+package tcp_test
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/tcp"
+	"golang.org/x/time/rate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Throttle", func() {
+	Context("when the limit is infinite", func() {
+		It("should not wrap the network connection", func() {
+			conn, _ := net.Pipe()
+			defer conn.Close()
+			Expect(tcp.Throttle(conn, rate.Inf, 0)).To(Equal(conn))
+		})
+	})
+
+	Context("when writing more than the limit", func() {
+		It("should wait until the bytes are allowed", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Throttle(local, rate.Inf, 32*1024)
+			defer conn.Close()
+
+			go io.Copy(io.Discard, remote)
+
+			// The first burst is allowed immediately, and the second burst is
+			// allowed after one second.
+			start := time.Now()
+			n, err := conn.Write(make([]byte, 64*1024))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(64 * 1024))
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+
+	Context("when reading more than the limit", func() {
+		It("should wait until the bytes are allowed", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Throttle(local, 32*1024, rate.Inf)
+			defer conn.Close()
+
+			go remote.Write(make([]byte, 96*1024))
+
+			start := time.Now()
+			_, err := io.ReadFull(conn, make([]byte, 96*1024))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 1900*time.Millisecond))
+		})
+	})
+
+	Context("when the network connection is closed while waiting", func() {
+		It("should stop waiting", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := tcp.Throttle(local, rate.Inf, 1)
+
+			go io.Copy(io.Discard, remote)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				conn.Close()
+			}()
+
+			start := time.Now()
+			_, err := conn.Write(make([]byte, 64*1024))
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+})
+
+var _ = Describe("ThrottleGroup", func() {
+	Context("when the limits are changed", func() {
+		It("should throttle network connections that are open", func() {
+			group := tcp.NewThrottleGroup(rate.Inf, rate.Inf)
+			local, remote := net.Pipe()
+			defer remote.Close()
+			conn := group.Throttle(local)
+			defer conn.Close()
+
+			go io.Copy(io.Discard, remote)
+
+			start := time.Now()
+			_, err := conn.Write(make([]byte, 64*1024))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+
+			group.SetLimits(rate.Inf, 32*1024)
+			start = time.Now()
+			_, err = conn.Write(make([]byte, 64*1024))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+
+			group.SetLimits(rate.Inf, rate.Inf)
+			start = time.Now()
+			_, err = conn.Write(make([]byte, 64*1024))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// DefaultStream is high, so that it does not collide with the streams
+	// chosen by applications.
+	DefaultStream        = uint16(0xFFF0)
+	DefaultChunkSize     = 64 * 1024 // 64KB
+	DefaultWindow        = 16
+	DefaultAckTimeout    = 5 * time.Second
+	DefaultResumeTimeout = time.Minute
+)
+
+// Options for transferring blobs of bytes between peers.
+type Options struct {
+	Logger        *zap.Logger
+	Stream        uint16
+	ChunkSize     int
+	Window        int
+	AckTimeout    time.Duration
+	ResumeTimeout time.Duration
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		panic(err)
+	}
+	return Options{
+		Logger:        logger,
+		Stream:        DefaultStream,
+		ChunkSize:     DefaultChunkSize,
+		Window:        DefaultWindow,
+		AckTimeout:    DefaultAckTimeout,
+		ResumeTimeout: DefaultResumeTimeout,
+	}
+}
+
+// WithLogger sets the Logger used for logging all errors, warnings, information,
+// debug traces, and so on.
+func (opts Options) WithLogger(logger *zap.Logger) Options {
+	opts.Logger = logger
+	return opts
+}
+
+// WithStream sets the stream on which transfers are sent. Both peers must use
+// the same stream.
+func (opts Options) WithStream(stream uint16) Options {
+	opts.Stream = stream
+	return opts
+}
+
+// WithChunkSize sets the maximum number of bytes sent in one message. It must
+// be smaller than the maximum message size of the Channels between peers.
+func (opts Options) WithChunkSize(size int) Options {
+	opts.ChunkSize = size
+	return opts
+}
+
+// WithWindow sets the number of chunks that can be sent before they are
+// acknowledged by the receiving peer.
+func (opts Options) WithWindow(window int) Options {
+	opts.Window = window
+	return opts
+}
+
+// WithAckTimeout sets how long a sending peer waits for an acknowledgement
+// before assuming that chunks were lost (usually, because the network
+// connection was lost), and resuming the transfer from the last byte received.
+func (opts Options) WithAckTimeout(timeout time.Duration) Options {
+	opts.AckTimeout = timeout
+	return opts
+}
+
+// WithResumeTimeout sets how long a receiving peer keeps an incomplete
+// transfer, without receiving any chunks for it, before giving up on it. The
+// outcome of a transfer that has ended is remembered for as long. A
+// non-positive timeout means that transfers, and their outcomes, are kept
+// forever.
+func (opts Options) WithResumeTimeout(timeout time.Duration) Options {
+	opts.ResumeTimeout = timeout
+	return opts
+}
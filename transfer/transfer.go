@@ -0,0 +1,622 @@
+// Package transfer sends blobs of bytes, which are too large to send in one
+// message, between peers. Blobs are split into chunks, which are sent on a
+// dedicated stream with flow control. Transfers resume from the last byte
+// received when a network connection is lost, and the integrity of the blob
+// is verified by the receiving peer before it is accepted. Blobs that cannot
+// be read more than once (for example, multi-gigabyte snapshots that are
+// generated while they are sent) can be streamed, without holding more than
+// the window of unacknowledged chunks in memory.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// Kinds of messages sent on the transfer stream. Every message begins with
+// its kind, and the ID of its transfer.
+const (
+	// kindOffer is sent by the sending peer to begin, or resume, a transfer.
+	// It is followed by the 8 byte big-endian size of the blob, and its
+	// SHA-256 digest. The digest is omitted when the blob is streamed, and is
+	// sent once all chunks have been acknowledged instead (see kindDigest).
+	kindOffer = byte(1)
+	// kindAck is sent by the receiving peer to acknowledge chunks. It is
+	// followed by the 8 byte big-endian number of bytes received.
+	kindAck = byte(2)
+	// kindChunk is sent by the sending peer. It is followed by the 8 byte
+	// big-endian offset of the chunk, and the bytes of the chunk.
+	kindChunk = byte(3)
+	// kindDone is sent by the receiving peer when a transfer ends. It is
+	// followed by the status of the transfer.
+	kindDone = byte(4)
+	// kindDigest is sent by the sending peer once all chunks of a streamed
+	// blob have been acknowledged. It is followed by the SHA-256 digest of
+	// the blob.
+	kindDigest = byte(5)
+)
+
+// Statuses of transfers that have ended.
+const (
+	statusOK        = byte(0)
+	statusRejected  = byte(1)
+	statusCorrupted = byte(2)
+	statusFailed    = byte(3)
+)
+
+const headerLen = 1 + len(ID{})
+
+var (
+	// ErrRejected is returned when the receiving peer rejects a transfer.
+	ErrRejected = errors.New("transfer rejected")
+	// ErrCorrupted is returned when the bytes received do not match the
+	// digest of the blob.
+	ErrCorrupted = errors.New("transfer corrupted")
+	// ErrFailed is returned when the receiving peer could not write the bytes
+	// that it received.
+	ErrFailed = errors.New("transfer failed")
+	// ErrExpired is passed to a Sink when its transfer was not resumed before
+	// the resume timeout.
+	ErrExpired = errors.New("transfer expired")
+	// ErrNotResumable is returned when the receiving peer resumes a streamed
+	// transfer from bytes that are no longer held by the sending peer
+	// (usually, because the receiving peer expired the transfer).
+	ErrNotResumable = errors.New("transfer not resumable")
+)
+
+// An ID identifies a transfer. IDs are chosen randomly by the sending peer.
+type ID [16]byte
+
+// String returns the ID in hex.
+func (transfer ID) String() string {
+	return hex.EncodeToString(transfer[:])
+}
+
+// A Sink is written the bytes of a transfer, in order.
+type Sink interface {
+	io.Writer
+
+	// Done is called once the transfer ends. The error is nil if all bytes
+	// were written, and their integrity was verified. Otherwise, the bytes
+	// written must be discarded.
+	Done(err error)
+}
+
+// A Handler is called when a remote peer offers a blob of the given size. It
+// returns the Sink to which the blob is written, or an error to reject the
+// transfer.
+type Handler func(from id.Signatory, transfer ID, size uint64) (Sink, error)
+
+type key struct {
+	remote   id.Signatory
+	transfer ID
+}
+
+// outgoing is a transfer that is being sent.
+type outgoing struct {
+	acks chan uint64
+	done chan byte
+}
+
+// incoming is a transfer that is being received.
+type incoming struct {
+	sink   Sink
+	size   uint64
+	digest [sha256.Size]byte
+	// streamed is true until the digest of a streamed blob is received.
+	streamed bool
+
+	offset       uint64
+	hash         hash.Hash
+	lastActivity time.Time
+}
+
+// finished is a transfer that has ended. It is remembered for the resume
+// timeout, so that its status can be sent again if it was lost.
+type finished struct {
+	status byte
+	at     time.Time
+}
+
+// A Transferer sends blobs to, and receives blobs from, remote peers. Both
+// peers must be running a Transferer, because the sending peer needs to
+// receive acknowledgements.
+type Transferer struct {
+	opts      Options
+	transport *transport.Transport
+	handler   Handler
+
+	outgoingMu *sync.Mutex
+	outgoing   map[key]*outgoing
+
+	incomingMu *sync.Mutex
+	incoming   map[key]*incoming
+	finished   map[key]finished
+}
+
+// New returns a Transferer that receives blobs using the Handler. A nil
+// Handler rejects all blobs.
+func New(opts Options, transport *transport.Transport, handler Handler) *Transferer {
+	return &Transferer{
+		opts:      opts,
+		transport: transport,
+		handler:   handler,
+
+		outgoingMu: new(sync.Mutex),
+		outgoing:   map[key]*outgoing{},
+
+		incomingMu: new(sync.Mutex),
+		incoming:   map[key]*incoming{},
+		finished:   map[key]finished{},
+	}
+}
+
+// Run the Transferer until the context is done. It must be running for blobs
+// to be sent, or received.
+func (t *Transferer) Run(ctx context.Context) {
+	t.transport.ReceiveStream(ctx, t.opts.Stream, func(from id.Signatory, packet wire.Packet) error {
+		t.didReceive(ctx, from, packet.Msg.Data)
+		return nil
+	})
+
+	if t.opts.ResumeTimeout <= 0 {
+		// Transfers never expire.
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(t.opts.ResumeTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.expire()
+		}
+	}
+}
+
+// Send a blob of the given size to a remote peer, and wait until the remote
+// peer has received it, and verified its integrity. Chunks are read from the
+// blob as they are sent, and chunks can be read more than once when the
+// transfer is resumed, so the blob must not change until Send returns.
+func (t *Transferer) Send(ctx context.Context, to id.Signatory, blob io.ReaderAt, size uint64) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(blob, 0, int64(size))); err != nil {
+		return fmt.Errorf("hashing: %w", err)
+	}
+	var transfer ID
+	if _, err := rand.Read(transfer[:]); err != nil {
+		return fmt.Errorf("generating id: %w", err)
+	}
+	offer := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(offer, size)
+	offer = h.Sum(offer)
+
+	k := key{remote: to, transfer: transfer}
+	out := &outgoing{
+		acks: make(chan uint64, t.opts.Window+1),
+		done: make(chan byte, 1),
+	}
+	t.outgoingMu.Lock()
+	t.outgoing[k] = out
+	t.outgoingMu.Unlock()
+	defer func() {
+		t.outgoingMu.Lock()
+		delete(t.outgoing, k)
+		t.outgoingMu.Unlock()
+	}()
+
+	// While resuming, no chunks are sent until the remote peer acknowledges
+	// the offer with the number of bytes that it has received.
+	resuming := true
+	t.send(ctx, to, kindOffer, transfer, offer)
+
+	timer := time.NewTimer(t.opts.AckTimeout)
+	defer timer.Stop()
+
+	buf := make([]byte, 8+t.opts.ChunkSize)
+	window := uint64(t.opts.Window) * uint64(t.opts.ChunkSize)
+	next, acked := uint64(0), uint64(0)
+	for {
+		for !resuming && next < size && next < acked+window {
+			n := size - next
+			if n > uint64(t.opts.ChunkSize) {
+				n = uint64(t.opts.ChunkSize)
+			}
+			chunk := buf[:8+n]
+			binary.BigEndian.PutUint64(chunk, next)
+			if m, err := blob.ReadAt(chunk[8:], int64(next)); m < len(chunk[8:]) {
+				return fmt.Errorf("reading at %v: %w", next, err)
+			}
+			if err := t.send(ctx, to, kindChunk, transfer, chunk); err != nil {
+				// The chunk will be sent again after resuming.
+				break
+			}
+			next += n
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case status := <-out.done:
+			return statusErr(status)
+		case offset := <-out.acks:
+			if resuming {
+				next, resuming = offset, false
+			}
+			if offset > acked {
+				acked = offset
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(t.opts.AckTimeout)
+		case <-timer.C:
+			// Chunks, or their acknowledgements, were lost. Acknowledgements
+			// that are still buffered are stale, so they are dropped before
+			// offering again.
+			t.opts.Logger.Debug("resuming", zap.String("peer", to.String()), zap.String("transfer", transfer.String()), zap.Uint64("acked", acked))
+			for len(out.acks) > 0 {
+				<-out.acks
+			}
+			resuming = true
+			t.send(ctx, to, kindOffer, transfer, offer)
+			timer.Reset(t.opts.AckTimeout)
+		}
+	}
+}
+
+// SendStream is the same as Send, except that the blob is read from the reader
+// exactly once, as it is sent. At most one window of chunks that have not been
+// acknowledged is held in memory, so that the transfer can resume when the
+// network connection is lost, and the digest of the blob is sent once all of
+// its chunks have been acknowledged. An error is returned if the reader ends
+// before the given size.
+func (t *Transferer) SendStream(ctx context.Context, to id.Signatory, r io.Reader, size uint64) error {
+	var transfer ID
+	if _, err := rand.Read(transfer[:]); err != nil {
+		return fmt.Errorf("generating id: %w", err)
+	}
+	offer := make([]byte, 8)
+	binary.BigEndian.PutUint64(offer, size)
+
+	k := key{remote: to, transfer: transfer}
+	out := &outgoing{
+		acks: make(chan uint64, t.opts.Window+1),
+		done: make(chan byte, 1),
+	}
+	t.outgoingMu.Lock()
+	t.outgoing[k] = out
+	t.outgoingMu.Unlock()
+	defer func() {
+		t.outgoingMu.Lock()
+		delete(t.outgoing, k)
+		t.outgoingMu.Unlock()
+	}()
+
+	resuming := true
+	t.send(ctx, to, kindOffer, transfer, offer)
+
+	timer := time.NewTimer(t.opts.AckTimeout)
+	defer timer.Stop()
+
+	// The window holds the bytes from the last acknowledged byte up to the
+	// last byte read, so that they can be sent again after resuming.
+	h := sha256.New()
+	window := make([]byte, t.opts.Window*t.opts.ChunkSize)
+	chunk := make([]byte, 8+t.opts.ChunkSize)
+	next, acked, read := uint64(0), uint64(0), uint64(0)
+	for {
+		for !resuming && next < size && next < acked+uint64(len(window)) {
+			n := size - next
+			if n > uint64(t.opts.ChunkSize) {
+				n = uint64(t.opts.ChunkSize)
+			}
+			if read < next+n {
+				buf := window[read-acked : next+n-acked]
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return fmt.Errorf("reading at %v: %w", read, err)
+				}
+				h.Write(buf)
+				read = next + n
+			}
+			binary.BigEndian.PutUint64(chunk, next)
+			copy(chunk[8:], window[next-acked:next+n-acked])
+			if err := t.send(ctx, to, kindChunk, transfer, chunk[:8+n]); err != nil {
+				// The chunk will be sent again after resuming.
+				break
+			}
+			next += n
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case status := <-out.done:
+			return statusErr(status)
+		case offset := <-out.acks:
+			// Acknowledgements can arrive out of order, so older ones are
+			// ignored, unless the transfer is resuming from bytes that have
+			// already been dropped from the window.
+			if offset > read || (resuming && offset < acked) {
+				return fmt.Errorf("resuming at %v: %w", offset, ErrNotResumable)
+			}
+			if resuming {
+				next, resuming = offset, false
+			}
+			if offset > acked {
+				copy(window, window[offset-acked:read-acked])
+				acked = offset
+			}
+			if acked == size {
+				t.send(ctx, to, kindDigest, transfer, h.Sum(nil))
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(t.opts.AckTimeout)
+		case <-timer.C:
+			t.opts.Logger.Debug("resuming", zap.String("peer", to.String()), zap.String("transfer", transfer.String()), zap.Uint64("acked", acked))
+			for len(out.acks) > 0 {
+				<-out.acks
+			}
+			resuming = true
+			t.send(ctx, to, kindOffer, transfer, offer)
+			timer.Reset(t.opts.AckTimeout)
+		}
+	}
+}
+
+func (t *Transferer) send(ctx context.Context, to id.Signatory, kind byte, transfer ID, data []byte) error {
+	msg := make([]byte, 0, headerLen+len(data))
+	msg = append(msg, kind)
+	msg = append(msg, transfer[:]...)
+	msg = append(msg, data...)
+
+	ctx, cancel := context.WithTimeout(ctx, t.opts.AckTimeout)
+	defer cancel()
+	if err := t.transport.SendOnStream(ctx, to, t.opts.Stream, wire.Msg{Type: wire.MsgTypeSend, Data: msg}); err != nil {
+		t.opts.Logger.Debug("transfer", zap.String("peer", to.String()), zap.String("transfer", transfer.String()), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// reply to a remote peer without blocking the receiving goroutine.
+func (t *Transferer) reply(ctx context.Context, to id.Signatory, kind byte, transfer ID, data []byte) {
+	go t.send(ctx, to, kind, transfer, data)
+}
+
+func (t *Transferer) didReceive(ctx context.Context, from id.Signatory, data []byte) {
+	if len(data) < headerLen {
+		t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("message too short: %v bytes", len(data))))
+		return
+	}
+	var transfer ID
+	copy(transfer[:], data[1:headerLen])
+	k := key{remote: from, transfer: transfer}
+	body := data[headerLen:]
+
+	switch kind := data[0]; kind {
+	case kindOffer:
+		if len(body) != 8+sha256.Size && len(body) != 8 {
+			t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed offer")))
+			return
+		}
+		t.didReceiveOffer(ctx, k, binary.BigEndian.Uint64(body), body[8:])
+	case kindDigest:
+		if len(body) != sha256.Size {
+			t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed digest")))
+			return
+		}
+		t.didReceiveDigest(ctx, k, body)
+	case kindChunk:
+		if len(body) < 8 {
+			t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed chunk")))
+			return
+		}
+		t.didReceiveChunk(ctx, k, binary.BigEndian.Uint64(body), body[8:])
+	case kindAck:
+		if len(body) != 8 {
+			t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed ack")))
+			return
+		}
+		t.outgoingMu.Lock()
+		if out, ok := t.outgoing[k]; ok {
+			select {
+			case out.acks <- binary.BigEndian.Uint64(body):
+			default:
+			}
+		}
+		t.outgoingMu.Unlock()
+	case kindDone:
+		if len(body) != 1 {
+			t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("malformed done")))
+			return
+		}
+		t.outgoingMu.Lock()
+		if out, ok := t.outgoing[k]; ok {
+			select {
+			case out.done <- body[0]:
+			default:
+			}
+		}
+		t.outgoingMu.Unlock()
+	default:
+		t.opts.Logger.Debug("transfer", zap.String("peer", from.String()), zap.Error(fmt.Errorf("unknown kind %v", kind)))
+	}
+}
+
+func (t *Transferer) didReceiveOffer(ctx context.Context, k key, size uint64, digest []byte) {
+	t.incomingMu.Lock()
+	defer t.incomingMu.Unlock()
+
+	// The status, or acknowledgement, that answered a previous offer was
+	// lost, so it is sent again.
+	if f, ok := t.finished[k]; ok {
+		t.reply(ctx, k.remote, kindDone, k.transfer, []byte{f.status})
+		return
+	}
+	if in, ok := t.incoming[k]; ok {
+		in.lastActivity = time.Now()
+		t.reply(ctx, k.remote, kindAck, k.transfer, encodeOffset(in.offset))
+		return
+	}
+
+	if t.handler == nil {
+		t.finish(ctx, k, nil, statusRejected)
+		return
+	}
+	sink, err := t.handler(k.remote, k.transfer, size)
+	if err != nil {
+		t.opts.Logger.Debug("transfer", zap.String("peer", k.remote.String()), zap.String("transfer", k.transfer.String()), zap.Error(fmt.Errorf("rejected: %w", err)))
+		t.finish(ctx, k, nil, statusRejected)
+		return
+	}
+	in := &incoming{
+		sink:         sink,
+		size:         size,
+		streamed:     len(digest) == 0,
+		hash:         sha256.New(),
+		lastActivity: time.Now(),
+	}
+	copy(in.digest[:], digest)
+	if size == 0 && !in.streamed {
+		t.finish(ctx, k, in, in.verify())
+		return
+	}
+	t.incoming[k] = in
+	t.reply(ctx, k.remote, kindAck, k.transfer, encodeOffset(0))
+}
+
+func (t *Transferer) didReceiveChunk(ctx context.Context, k key, offset uint64, chunk []byte) {
+	t.incomingMu.Lock()
+	defer t.incomingMu.Unlock()
+
+	in, ok := t.incoming[k]
+	if !ok {
+		if f, ok := t.finished[k]; ok {
+			t.reply(ctx, k.remote, kindDone, k.transfer, []byte{f.status})
+		}
+		return
+	}
+	// Chunks that were sent before resuming can arrive out of order, and are
+	// dropped. The sending peer will send them again.
+	if offset != in.offset {
+		return
+	}
+	in.lastActivity = time.Now()
+	if in.offset+uint64(len(chunk)) > in.size {
+		t.finish(ctx, k, in, statusCorrupted)
+		return
+	}
+	if _, err := in.sink.Write(chunk); err != nil {
+		t.opts.Logger.Debug("transfer", zap.String("peer", k.remote.String()), zap.String("transfer", k.transfer.String()), zap.Error(fmt.Errorf("writing: %w", err)))
+		t.finish(ctx, k, in, statusFailed)
+		return
+	}
+	in.hash.Write(chunk)
+	in.offset += uint64(len(chunk))
+	if in.offset == in.size && !in.streamed {
+		t.finish(ctx, k, in, in.verify())
+		return
+	}
+	t.reply(ctx, k.remote, kindAck, k.transfer, encodeOffset(in.offset))
+}
+
+func (t *Transferer) didReceiveDigest(ctx context.Context, k key, digest []byte) {
+	t.incomingMu.Lock()
+	defer t.incomingMu.Unlock()
+
+	in, ok := t.incoming[k]
+	if !ok {
+		if f, ok := t.finished[k]; ok {
+			t.reply(ctx, k.remote, kindDone, k.transfer, []byte{f.status})
+		}
+		return
+	}
+	// The digest is only sent once all chunks have been acknowledged, so a
+	// digest that arrives early is ignored.
+	if !in.streamed || in.offset != in.size {
+		return
+	}
+	copy(in.digest[:], digest)
+	in.streamed = false
+	t.finish(ctx, k, in, in.verify())
+}
+
+// finish a transfer that is being received, and send its status to the
+// sending peer. It must be called while holding the incoming mutex.
+func (t *Transferer) finish(ctx context.Context, k key, in *incoming, status byte) {
+	delete(t.incoming, k)
+	t.finished[k] = finished{status: status, at: time.Now()}
+	if in != nil {
+		in.sink.Done(statusErr(status))
+	}
+	t.reply(ctx, k.remote, kindDone, k.transfer, []byte{status})
+}
+
+// expire transfers that have not been resumed, and forget transfers that
+// ended, before the resume timeout.
+func (t *Transferer) expire() {
+	t.incomingMu.Lock()
+	defer t.incomingMu.Unlock()
+
+	now := time.Now()
+	for k, in := range t.incoming {
+		if now.Sub(in.lastActivity) > t.opts.ResumeTimeout {
+			delete(t.incoming, k)
+			in.sink.Done(ErrExpired)
+			t.opts.Logger.Debug("transfer", zap.String("peer", k.remote.String()), zap.String("transfer", k.transfer.String()), zap.Error(ErrExpired))
+		}
+	}
+	for k, f := range t.finished {
+		if now.Sub(f.at) > t.opts.ResumeTimeout {
+			delete(t.finished, k)
+		}
+	}
+}
+
+func (in *incoming) verify() byte {
+	if !bytes.Equal(in.hash.Sum(nil), in.digest[:]) {
+		return statusCorrupted
+	}
+	return statusOK
+}
+
+func encodeOffset(offset uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, offset)
+	return data
+}
+
+func statusErr(status byte) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusRejected:
+		return ErrRejected
+	case statusCorrupted:
+		return ErrCorrupted
+	case statusFailed:
+		return ErrFailed
+	default:
+		return fmt.Errorf("unknown status %v", status)
+	}
+}
@@ -0,0 +1,222 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/transfer"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/transport/transporttest"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type bufferSink struct {
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+	writes int
+	done   chan error
+}
+
+func newBufferSink() *bufferSink {
+	return &bufferSink{mu: new(sync.Mutex), done: make(chan error, 1)}
+}
+
+func (sink *bufferSink) Write(p []byte) (int, error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.writes++
+	return sink.buf.Write(p)
+}
+
+func (sink *bufferSink) Writes() int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	return sink.writes
+}
+
+func (sink *bufferSink) Done(err error) {
+	sink.done <- err
+}
+
+// changingBlob returns different bytes after it has been read once.
+type changingBlob struct {
+	data []byte
+	read bool
+}
+
+func (blob *changingBlob) ReadAt(p []byte, off int64) (int, error) {
+	n := copy(p, blob.data[off:])
+	if blob.read {
+		for i := range p[:n] {
+			p[i] ^= 0xFF
+		}
+	}
+	if int(off)+n == len(blob.data) {
+		blob.read = true
+	}
+	return n, nil
+}
+
+var _ = Describe("Transfer", func() {
+	setup := func(ctx context.Context, opts transfer.Options, handler transfer.Handler) (*transport.Transport, *transfer.Transferer, *transfer.Transferer, id.Signatory) {
+		transports := transporttest.New(ctx, 2)
+		transporttest.Connect(transports[0], transports[1])
+
+		sender := transfer.New(opts, transports[0], nil)
+		receiver := transfer.New(opts, transports[1], handler)
+		go sender.Run(ctx)
+		go receiver.Run(ctx)
+		return transports[0], sender, receiver, transports[1].Self()
+	}
+
+	Context("when sending a blob", func() {
+		It("should be received in chunks, and verified", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sink := newBufferSink()
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop()).WithChunkSize(16 * 1024)
+			_, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				Expect(size).To(Equal(uint64(1024 * 1024)))
+				return sink, nil
+			})
+
+			blob := make([]byte, 1024*1024)
+			rand.Read(blob)
+			Expect(sender.Send(ctx, to, bytes.NewReader(blob), uint64(len(blob)))).To(Succeed())
+			Expect(<-sink.done).ToNot(HaveOccurred())
+			Expect(sink.Writes()).To(Equal(64))
+			Expect(sink.buf.Bytes()).To(Equal(blob))
+		})
+	})
+
+	Context("when the resume timeout is not positive", func() {
+		It("should still send blobs", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sink := newBufferSink()
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop()).WithResumeTimeout(0)
+			_, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				return sink, nil
+			})
+
+			blob := make([]byte, 1024)
+			rand.Read(blob)
+			Expect(sender.Send(ctx, to, bytes.NewReader(blob), uint64(len(blob)))).To(Succeed())
+			Expect(<-sink.done).ToNot(HaveOccurred())
+			Expect(sink.buf.Bytes()).To(Equal(blob))
+		})
+	})
+
+	Context("when the network connection is lost while sending", func() {
+		It("should resume from the last byte received", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sink := newBufferSink()
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop()).WithChunkSize(16 * 1024).WithWindow(2).WithAckTimeout(500 * time.Millisecond)
+			t1, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				return sink, nil
+			})
+
+			blob := make([]byte, 1024*1024)
+			rand.Read(blob)
+			go func() {
+				defer GinkgoRecover()
+				Eventually(sink.Writes, 10*time.Second).Should(BeNumerically(">", 0))
+				Expect(t1.Reconnect(ctx, to)).To(Succeed())
+			}()
+			Expect(sender.Send(ctx, to, bytes.NewReader(blob), uint64(len(blob)))).To(Succeed())
+			Expect(<-sink.done).ToNot(HaveOccurred())
+			Expect(sink.buf.Bytes()).To(Equal(blob))
+		})
+	})
+
+	Context("when streaming a blob", func() {
+		It("should be received, and verified, even if the network connection is lost", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sink := newBufferSink()
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop()).WithChunkSize(16 * 1024).WithWindow(2).WithAckTimeout(500 * time.Millisecond)
+			t1, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				return sink, nil
+			})
+
+			blob := make([]byte, 1024*1024)
+			rand.Read(blob)
+			go func() {
+				defer GinkgoRecover()
+				Eventually(sink.Writes, 10*time.Second).Should(BeNumerically(">", 0))
+				Expect(t1.Reconnect(ctx, to)).To(Succeed())
+			}()
+			// Hide the ReaderAt implementation, so that the blob can only be
+			// read once.
+			r := struct{ io.Reader }{bytes.NewReader(blob)}
+			Expect(sender.SendStream(ctx, to, r, uint64(len(blob)))).To(Succeed())
+			Expect(<-sink.done).ToNot(HaveOccurred())
+			Expect(sink.buf.Bytes()).To(Equal(blob))
+		})
+
+		Context("when the stream ends early", func() {
+			It("should return an error", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				opts := transfer.DefaultOptions().WithLogger(zap.NewNop())
+				_, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+					return newBufferSink(), nil
+				})
+
+				err := sender.SendStream(ctx, to, bytes.NewReader(make([]byte, 1024)), 2048)
+				Expect(errors.Is(err, io.ErrUnexpectedEOF)).To(BeTrue())
+			})
+		})
+	})
+
+	Context("when the blob is rejected", func() {
+		It("should return an error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop())
+			_, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				return nil, fmt.Errorf("too large: %v bytes", size)
+			})
+
+			err := sender.Send(ctx, to, bytes.NewReader(make([]byte, 1024)), 1024)
+			Expect(errors.Is(err, transfer.ErrRejected)).To(BeTrue())
+		})
+	})
+
+	Context("when the blob changes while sending", func() {
+		It("should fail to verify its integrity", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			sink := newBufferSink()
+			opts := transfer.DefaultOptions().WithLogger(zap.NewNop())
+			_, sender, _, to := setup(ctx, opts, func(from id.Signatory, transfer transfer.ID, size uint64) (transfer.Sink, error) {
+				return sink, nil
+			})
+
+			blob := &changingBlob{data: make([]byte, 1024)}
+			err := sender.Send(ctx, to, blob, uint64(len(blob.data)))
+			Expect(errors.Is(err, transfer.ErrCorrupted)).To(BeTrue())
+			Expect(<-sink.done).To(Equal(transfer.ErrCorrupted))
+		})
+	})
+})
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/tcp"
+)
+
+// Reasons for which inbound network connections are rejected by the accept
+// loop of a Transport.
+const (
+	RejectTarpit    = "tarpit"
+	RejectTLS       = "tls"
+	RejectHandshake = "handshake"
+	RejectDuplicate = "duplicate"
+	RejectSlots     = "slots"
+	RejectRateLimit = "rate-limit"
+	RejectFiltered  = "filtered"
+	RejectLimit     = "limit"
+)
+
+// AcceptStats is a snapshot of the accept loop of a Transport. It is intended
+// for exporting to a metrics system. When most of the backlog is handshaking,
+// and handshake latency is high, the Transport is likely to be CPU-bound on
+// cryptography. When most of the backlog is not yet handshaking, it is likely
+// to be network-bound (for example, waiting on TLS or tarpitted connections).
+type AcceptStats struct {
+	// Backlog is the number of inbound network connections that have been
+	// accepted, but have not yet been rejected or attached.
+	Backlog int
+	// Handshaking is the number of inbound network connections that are
+	// currently doing the handshake.
+	Handshaking int
+	// HandshakeLatency is the time from accepting inbound network connections
+	// to completing their handshake.
+	HandshakeLatency channel.DurationHistogram
+	// Rejects is the number of inbound network connections that have been
+	// rejected, keyed by reason.
+	Rejects map[string]uint64
+	// Limit is a snapshot of the limit on network connections (see
+	// Options.WithMaxConns). It is zero if there is no limit.
+	Limit tcp.ConnLimitStats
+}
+
+// acceptStats are updated by the accept loop of a Transport.
+type acceptStats struct {
+	mu          *sync.Mutex
+	backlog     int
+	handshaking int
+	latency     channel.DurationHistogram
+	rejects     map[string]uint64
+}
+
+func newAcceptStats() *acceptStats {
+	return &acceptStats{
+		mu:      new(sync.Mutex),
+		rejects: map[string]uint64{},
+	}
+}
+
+// accept an inbound network connection, adding it to the backlog. The time of
+// acceptance is returned.
+func (stats *acceptStats) accept() time.Time {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.backlog++
+	return time.Now()
+}
+
+// beginHandshake is called when the handshake of an inbound network connection
+// begins.
+func (stats *acceptStats) beginHandshake() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.handshaking++
+}
+
+// endHandshake is called when the handshake of an inbound network connection
+// ends. The latency since it was accepted is only observed if the handshake
+// succeeded.
+func (stats *acceptStats) endHandshake(accepted time.Time, err error) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.handshaking--
+	if err == nil {
+		stats.latency.Observe(time.Since(accepted))
+	}
+}
+
+// reject an inbound network connection, removing it from the backlog.
+func (stats *acceptStats) reject(reason string) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.backlog--
+	stats.rejects[reason]++
+}
+
+// done removes an inbound network connection from the backlog, once it has
+// been attached.
+func (stats *acceptStats) done() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.backlog--
+}
+
+func (stats *acceptStats) snapshot() AcceptStats {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	rejects := make(map[string]uint64, len(stats.rejects))
+	for reason, n := range stats.rejects {
+		rejects[reason] = n
+	}
+	return AcceptStats{
+		Backlog:          stats.backlog,
+		Handshaking:      stats.handshaking,
+		HandshakeLatency: stats.latency,
+		Rejects:          rejects,
+	}
+}
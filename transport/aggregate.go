@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// An aggregator de-duplicates log entries that are repeated frequently, such as
+// dial failures to a flapping peer. The first entry for a key is logged
+// immediately. Later entries for the same key are counted, and a single
+// summary entry is logged at the end of the aggregation period. Entries are
+// only aggregated if they have the same level, key and message.
+type aggregator struct {
+	logger *zap.Logger
+	period time.Duration
+
+	entriesMu *sync.Mutex
+	entries   map[aggregateKey]*aggregateEntry
+}
+
+// aggregateKey identifies entries that are aggregated together.
+type aggregateKey struct {
+	level zapcore.Level
+	key   string
+	msg   string
+}
+
+// aggregateEntry is the state of entries that are being aggregated. The fields
+// of the latest repeat are kept, so that the summary describes the latest
+// repeat, rather than the first entry (which has already been logged).
+type aggregateEntry struct {
+	repeated int
+	fields   []zap.Field
+}
+
+func newAggregator(logger *zap.Logger, period time.Duration) *aggregator {
+	return &aggregator{
+		logger: logger,
+		period: period,
+
+		entriesMu: new(sync.Mutex),
+		entries:   map[aggregateKey]*aggregateEntry{},
+	}
+}
+
+func (agg *aggregator) Debug(key, msg string, fields ...zap.Field) {
+	agg.log(zapcore.DebugLevel, key, msg, fields...)
+}
+
+func (agg *aggregator) Error(key, msg string, fields ...zap.Field) {
+	agg.log(zapcore.ErrorLevel, key, msg, fields...)
+}
+
+func (agg *aggregator) log(level zapcore.Level, key, msg string, fields ...zap.Field) {
+	if agg.period <= 0 {
+		if ce := agg.logger.Check(level, msg); ce != nil {
+			ce.Write(fields...)
+		}
+		return
+	}
+
+	k := aggregateKey{level: level, key: key, msg: msg}
+	agg.entriesMu.Lock()
+	if entry, ok := agg.entries[k]; ok {
+		entry.repeated++
+		entry.fields = fields
+		agg.entriesMu.Unlock()
+		return
+	}
+	agg.entries[k] = &aggregateEntry{}
+	agg.entriesMu.Unlock()
+
+	if ce := agg.logger.Check(level, msg); ce != nil {
+		ce.Write(fields...)
+	}
+	time.AfterFunc(agg.period, func() {
+		agg.entriesMu.Lock()
+		entry := agg.entries[k]
+		delete(agg.entries, k)
+		agg.entriesMu.Unlock()
+
+		// The first entry has already been logged, so only the repeats need
+		// to be summarised.
+		if entry.repeated > 0 {
+			if ce := agg.logger.Check(level, msg); ce != nil {
+				ce.Write(append(entry.fields[:len(entry.fields):len(entry.fields)], zap.Int("repeated", entry.repeated), zap.Duration("period", agg.period))...)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Log aggregation", func() {
+	Context("when the same entry is logged repeatedly", func() {
+		It("should log the first entry and then a summary", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			agg := newAggregator(zap.New(core), 100*time.Millisecond)
+
+			for i := 0; i < 10; i++ {
+				agg.Error("dial/a", "dial")
+			}
+			agg.Error("dial/b", "dial")
+			Expect(logs.Len()).To(Equal(2))
+
+			Eventually(logs.Len).Should(Equal(3))
+			summary := logs.FilterField(zap.Int("repeated", 9)).All()
+			Expect(summary).To(HaveLen(1))
+			Expect(summary[0].Message).To(Equal("dial"))
+		})
+	})
+
+	Context("when different entries are logged with the same key", func() {
+		It("should aggregate them separately", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			agg := newAggregator(zap.New(core), 100*time.Millisecond)
+
+			agg.Error("attach/a", "incoming attachment")
+			agg.Error("attach/a", "outgoing")
+			agg.Debug("attach/a", "outgoing")
+			Expect(logs.Len()).To(Equal(3))
+		})
+	})
+
+	Context("when repeats have different fields", func() {
+		It("should summarise them using the fields of the latest repeat", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			agg := newAggregator(zap.New(core), 100*time.Millisecond)
+
+			for i := 0; i < 3; i++ {
+				agg.Error("dial/a", "dial", zap.Int("attempt", i))
+			}
+			Eventually(logs.Len).Should(Equal(2))
+			summary := logs.FilterField(zap.Int("repeated", 2)).All()
+			Expect(summary).To(HaveLen(1))
+			Expect(summary[0].ContextMap()).To(HaveKeyWithValue("attempt", int64(2)))
+
+			// Once the summary has been logged, the next entry is logged
+			// immediately.
+			agg.Error("dial/a", "dial", zap.Int("attempt", 3))
+			Expect(logs.Len()).To(Equal(3))
+		})
+	})
+
+	Context("when aggregation is disabled", func() {
+		It("should log every entry", func() {
+			core, logs := observer.New(zapcore.DebugLevel)
+			agg := newAggregator(zap.New(core), 0)
+
+			for i := 0; i < 10; i++ {
+				agg.Debug("dial/a", "dial")
+			}
+			Expect(logs.Len()).To(Equal(10))
+		})
+	})
+})
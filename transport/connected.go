@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// ErrNotConnected is returned when sending to a remote peer that is not
+// connected, using a method that never dials.
+var ErrNotConnected = errors.New("not connected")
+
+// Connected returns the remote peers to which the Transport currently has an
+// attached network connection, whether it was dialed or accepted.
+func (t *Transport) Connected() []id.Signatory {
+	t.connsMu.RLock()
+	defer t.connsMu.RUnlock()
+
+	remotes := make([]id.Signatory, 0, len(t.conns))
+	for remote, n := range t.conns {
+		if n > 0 {
+			remotes = append(remotes, remote)
+		}
+	}
+	return remotes
+}
+
+// SendToConnected sends a message to a remote peer using the network
+// connection that is already attached, whether it was dialed or accepted. It
+// never dials, and the remote peer does not need to be in the table, so it can
+// reach remote peers behind NATs that have dialed the Transport, but cannot be
+// dialed back. Accepted network connections from remote peers that are not
+// linked are only kept for the server timeout, so remote peers that need to be
+// reached later should be linked (see Link). If the remote peer is not
+// connected, ErrNotConnected is returned.
+func (t *Transport) SendToConnected(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	if !t.IsConnected(remote) {
+		return fmt.Errorf("sending to %v: %w", remote, ErrNotConnected)
+	}
+	return t.client.Send(ctx, remote, msg)
+}
+
+// BroadcastToConnected sends a message to all remote peers that are currently
+// connected (see SendToConnected), in the same way as SendToMany. It returns
+// the errors for the remote peers to which the message could not be sent.
+func (t *Transport) BroadcastToConnected(ctx context.Context, msg wire.Msg) map[id.Signatory]error {
+	return t.sendToMany(ctx, t.Connected(), msg, t.SendToConnected)
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/renproject/id"
+)
+
+// goingAwayGracePeriod is how long after its announced time an announcement
+// that a remote peer is going away is remembered, if the remote peer is not
+// seen again before then.
+const goingAwayGracePeriod = 10 * time.Minute
+
+// goingAwayCap is the number of remote peers for which announcements that
+// they are going away are remembered.
+const goingAwayCap = 4096
+
+// A GoingAway is an announcement, by a remote peer, that it is about to drain
+// (for example, because it is shutting down for a restart).
+type GoingAway struct {
+	// Reason given by the remote peer, intended for logging.
+	Reason string
+	// At is the time at which the remote peer expects to begin draining.
+	At time.Time
+}
+
+// expired returns true if the announcement should no longer be remembered.
+func (announcement GoingAway) expired(now time.Time) bool {
+	return !now.Before(announcement.At.Add(goingAwayGracePeriod))
+}
+
+// ExpectGoingAway records an announcement that a remote peer is about to
+// drain. Until the remote peer is seen again after the announced time (see
+// ForgetGoingAway), or a grace period after the announced time has passed, it
+// is reported by IsGoingAway, so that applications can send traffic to other
+// remote peers instead of queuing messages that are likely to be lost. Only a
+// bounded number of announcements are remembered, and the ones that are due
+// the soonest are forgotten first.
+func (t *Transport) ExpectGoingAway(remote id.Signatory, announcement GoingAway) {
+	t.goingAwayMu.Lock()
+	defer t.goingAwayMu.Unlock()
+
+	if _, ok := t.goingAway[remote]; !ok && len(t.goingAway) >= goingAwayCap {
+		now := time.Now()
+		earliest, found := id.Signatory{}, false
+		for other, otherAnnouncement := range t.goingAway {
+			if otherAnnouncement.expired(now) {
+				delete(t.goingAway, other)
+				continue
+			}
+			if !found || otherAnnouncement.At.Before(t.goingAway[earliest].At) {
+				earliest, found = other, true
+			}
+		}
+		if len(t.goingAway) >= goingAwayCap {
+			delete(t.goingAway, earliest)
+		}
+	}
+	t.goingAway[remote] = announcement
+}
+
+// IsGoingAway returns the announcement made by a remote peer that it is about
+// to drain, and true, if there is one.
+func (t *Transport) IsGoingAway(remote id.Signatory) (GoingAway, bool) {
+	now := time.Now()
+
+	t.goingAwayMu.RLock()
+	announcement, ok := t.goingAway[remote]
+	t.goingAwayMu.RUnlock()
+
+	if ok && announcement.expired(now) {
+		// Forget about announcements that have expired.
+		t.goingAwayMu.Lock()
+		if announcement, ok := t.goingAway[remote]; ok && announcement.expired(now) {
+			delete(t.goingAway, remote)
+		}
+		t.goingAwayMu.Unlock()
+		return GoingAway{}, false
+	}
+	return announcement, ok
+}
+
+// ForgetGoingAway forgets the announcement made by a remote peer, if the time
+// at which it was going away has passed. It should be called whenever the
+// remote peer is seen to be alive (for example, when a message is received
+// from it), because a remote peer that is alive after draining has restarted.
+func (t *Transport) ForgetGoingAway(remote id.Signatory) {
+	t.goingAwayMu.Lock()
+	defer t.goingAwayMu.Unlock()
+
+	if announcement, ok := t.goingAway[remote]; ok && !time.Now().Before(announcement.At) {
+		delete(t.goingAway, remote)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !staging
+// +build !staging
+
+package transport
+
+// impairmentEnabled is false outside of staging builds, where the impairments
+// in the Options are ignored.
+const impairmentEnabled = false
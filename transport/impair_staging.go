@@ -0,0 +1,8 @@
+//go:build staging
+// +build staging
+
+package transport
+
+// impairmentEnabled is true in staging builds, where the impairments in the
+// Options are injected into network connections.
+const impairmentEnabled = true
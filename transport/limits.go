@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Resources of a Transport that can be limited.
+const (
+	// ResourceConnGoroutines are goroutines that hold a network connection,
+	// whether it was accepted or dialed.
+	ResourceConnGoroutines = "conn-goroutines"
+	// ResourceHandshakes are handshakes that are in progress, whether they
+	// are for accepted or dialed network connections.
+	ResourceHandshakes = "handshakes"
+	// ResourcePendingDials are dials that have not yet established a network
+	// connection.
+	ResourcePendingDials = "pending-dials"
+)
+
+// A LimitError is returned when using a resource of a Transport would exceed
+// its limit. The resource is not used.
+type LimitError struct {
+	Resource string
+	Limit    int
+}
+
+// Error implements the error interface.
+func (err LimitError) Error() string {
+	return fmt.Sprintf("%v limit of %v exceeded", err.Resource, err.Limit)
+}
+
+// ResourceStats is a snapshot of the resources used by a Transport. It is
+// intended for exporting to a metrics system.
+type ResourceStats struct {
+	// InUse is the number of each resource that is in use, keyed by resource.
+	InUse map[string]int
+	// Exceeded is the number of times that the limit of each resource was
+	// exceeded, keyed by resource.
+	Exceeded map[string]uint64
+}
+
+// resourceLimits enforces the limits on the resources of a Transport. Limits
+// are enforced centrally, so that every code path that uses a resource is
+// bounded by the same limit.
+type resourceLimits struct {
+	max map[string]int
+
+	mu       *sync.Mutex
+	inUse    map[string]int
+	exceeded map[string]uint64
+}
+
+func newResourceLimits(max map[string]int) *resourceLimits {
+	return &resourceLimits{
+		max: max,
+
+		mu:       new(sync.Mutex),
+		inUse:    map[string]int{},
+		exceeded: map[string]uint64{},
+	}
+}
+
+// acquire a resource, returning a LimitError if its limit would be exceeded.
+// A non-positive limit means that there is no limit. The returned function
+// releases the resource, and is safe to call more than once.
+func (limits *resourceLimits) acquire(resource string) (func(), error) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	if max := limits.max[resource]; max > 0 && limits.inUse[resource] >= max {
+		limits.exceeded[resource]++
+		return nil, LimitError{Resource: resource, Limit: max}
+	}
+	limits.inUse[resource]++
+
+	once := new(sync.Once)
+	return func() {
+		once.Do(func() {
+			limits.mu.Lock()
+			limits.inUse[resource]--
+			limits.mu.Unlock()
+		})
+	}, nil
+}
+
+func (limits *resourceLimits) snapshot() ResourceStats {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	stats := ResourceStats{
+		InUse:    make(map[string]int, len(limits.inUse)),
+		Exceeded: make(map[string]uint64, len(limits.exceeded)),
+	}
+	for resource, n := range limits.inUse {
+		stats.InUse[resource] = n
+	}
+	for resource, n := range limits.exceeded {
+		stats.Exceeded[resource] = n
+	}
+	return stats
+}
+
+// acquireForInbound acquires a resource for an inbound network connection. If
+// the limit of the resource is exceeded, the network connection is rejected,
+// and false is returned.
+func (t *Transport) acquireForInbound(resource, addr string) (func(), bool) {
+	release, err := t.limits.acquire(resource)
+	if err != nil {
+		t.accepts.reject(RejectLimit)
+		t.agg.Debug("limit/"+resource, "resource limit", zap.String("addr", addr), zap.Error(err))
+		return nil, false
+	}
+	return release, true
+}
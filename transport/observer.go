@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// A ConnObserver is notified about the lifecycle of network connections that
+// are managed by a Transport. This can be used to maintain peer health tables,
+// or to emit metrics. Methods are called synchronously from the goroutine that
+// is managing the connection, so implementations should return quickly.
+type ConnObserver interface {
+	// OnDialSuccess is called when a connection to a remote peer has been
+	// dialed and the handshake has succeeded.
+	OnDialSuccess(remote id.Signatory, addr net.Addr)
+	// OnDialFailure is called every time that a dial attempt to a remote peer
+	// fails.
+	OnDialFailure(remote id.Signatory, addr wire.Address, err error)
+	// OnConnClosed is called when a connection to a remote peer is dropped,
+	// regardless of whether the connection was dialed or accepted.
+	OnConnClosed(remote id.Signatory, addr net.Addr)
+	// OnExpired is called when the Transport gives up on dialing a remote
+	// peer, because it has been unreachable for longer than the expiry
+	// duration, and the remote peer is removed from the table.
+	OnExpired(remote id.Signatory)
+}
+
+// CallbackConnObserver implements the ConnObserver interface by delegating all
+// logic to callback functions. Callbacks that are nil are ignored.
+type CallbackConnObserver struct {
+	OnDialSuccessCallback func(id.Signatory, net.Addr)
+	OnDialFailureCallback func(id.Signatory, wire.Address, error)
+	OnConnClosedCallback  func(id.Signatory, net.Addr)
+	OnExpiredCallback     func(id.Signatory)
+
+	OnSessionEstablishedCallback func(SessionInfo)
+}
+
+// OnDialSuccess will delegate the implementation to the OnDialSuccessCallback.
+func (observer CallbackConnObserver) OnDialSuccess(remote id.Signatory, addr net.Addr) {
+	if observer.OnDialSuccessCallback != nil {
+		observer.OnDialSuccessCallback(remote, addr)
+	}
+}
+
+// OnDialFailure will delegate the implementation to the OnDialFailureCallback.
+func (observer CallbackConnObserver) OnDialFailure(remote id.Signatory, addr wire.Address, err error) {
+	if observer.OnDialFailureCallback != nil {
+		observer.OnDialFailureCallback(remote, addr, err)
+	}
+}
+
+// OnConnClosed will delegate the implementation to the OnConnClosedCallback.
+func (observer CallbackConnObserver) OnConnClosed(remote id.Signatory, addr net.Addr) {
+	if observer.OnConnClosedCallback != nil {
+		observer.OnConnClosedCallback(remote, addr)
+	}
+}
+
+// OnExpired will delegate the implementation to the OnExpiredCallback.
+func (observer CallbackConnObserver) OnExpired(remote id.Signatory) {
+	if observer.OnExpiredCallback != nil {
+		observer.OnExpiredCallback(remote)
+	}
+}
@@ -0,0 +1,187 @@
+package transport_test
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection observer", func() {
+	newTransport := func(opts transport.Options) *transport.Transport {
+		privKey := id.NewPrivKey()
+		self := privKey.Signatory()
+		client := channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), self)
+		return transport.New(
+			opts.WithLogger(zap.NewNop()),
+			self,
+			client,
+			handshake.ECIES(privKey),
+			dht.NewInMemTable(self),
+		)
+	}
+
+	Context("when dialing a remote peer that is online", func() {
+		It("should observe the dial and the closure of the connection", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dialed := make(chan id.Signatory, 1)
+			closed := make(chan id.Signatory, 1)
+			observer := transport.CallbackConnObserver{
+				OnDialSuccessCallback: func(remote id.Signatory, addr net.Addr) { dialed <- remote },
+				OnConnClosedCallback:  func(remote id.Signatory, addr net.Addr) { closed <- remote },
+			}
+
+			t1 := newTransport(transport.DefaultOptions().
+				WithPort(13400).
+				WithClientTimeout(500 * time.Millisecond).
+				WithConnObserver(observer))
+			t2 := newTransport(transport.DefaultOptions().WithPort(13401))
+			go t2.Run(ctx)
+
+			t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, "localhost:13401", uint64(time.Now().UnixNano())))
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{})).To(Succeed())
+
+			Eventually(dialed, 5*time.Second).Should(Receive(Equal(t2.Self())))
+			Eventually(closed, 5*time.Second).Should(Receive(Equal(t2.Self())))
+		})
+	})
+
+	Context("when dialing a remote peer with many network addresses", func() {
+		It("should fall back to the next network address when dialing fails", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dialed := make(chan net.Addr, 1)
+			observer := transport.CallbackConnObserver{
+				OnDialSuccessCallback: func(remote id.Signatory, addr net.Addr) { dialed <- addr },
+			}
+
+			t1 := newTransport(transport.DefaultOptions().
+				WithPort(13460).
+				WithClientTimeout(500 * time.Millisecond).
+				WithProtocolPreference(wire.TCP).
+				WithConnObserver(observer))
+			t2 := newTransport(transport.DefaultOptions().WithPort(13461))
+			go t2.Run(ctx)
+
+			// The WebSocket network address is advertised first, but TCP is
+			// preferred, so it is dialed last.
+			nonce := uint64(time.Now().UnixNano())
+			t1.Table().AddPeerAddresses(t2.Self(), []wire.Address{
+				wire.NewUnsignedAddress(wire.WebSocket, "127.0.0.1:13462", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13463", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13461", nonce),
+			})
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{})).To(Succeed())
+
+			var addr net.Addr
+			Eventually(dialed, 5*time.Second).Should(Receive(&addr))
+			Expect(addr.String()).To(Equal("127.0.0.1:13461"))
+		})
+
+		It("should only dial the network addresses with protocols that the dialer can dial", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			addrs := make(chan string, 10)
+			dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+				addrs <- address
+				return new(net.Dialer).DialContext(ctx, network, address)
+			}
+			t1 := newTransport(transport.DefaultOptions().
+				WithPort(13464).
+				WithDialer(dialer))
+			t2 := newTransport(transport.DefaultOptions().WithPort(13465))
+			go t2.Run(ctx)
+
+			// The WebSocket network address would accept a network connection
+			// over TCP, but it must not be dialed as one.
+			nonce := uint64(time.Now().UnixNano())
+			t1.Table().AddPeerAddresses(t2.Self(), []wire.Address{
+				wire.NewUnsignedAddress(wire.WebSocket, "127.0.0.1:13465", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13466", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13465", nonce),
+			})
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{})).To(Succeed())
+
+			Eventually(addrs, 5*time.Second).Should(Receive(Equal("127.0.0.1:13466")))
+			Eventually(addrs, 5*time.Second).Should(Receive(Equal("127.0.0.1:13465")))
+		})
+
+		It("should not fall back to network addresses with a different network", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			networks := make(chan string, 10)
+			addrs := make(chan string, 10)
+			dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+				networks <- network
+				addrs <- address
+				return new(net.Dialer).DialContext(ctx, network, address)
+			}
+			t1 := newTransport(transport.DefaultOptions().
+				WithPort(13467).
+				WithDialer(dialer, wire.TCP, wire.UDP))
+			t2 := newTransport(transport.DefaultOptions().WithPort(13468))
+			go t2.Run(ctx)
+
+			nonce := uint64(time.Now().UnixNano())
+			t1.Table().AddPeerAddresses(t2.Self(), []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13469", nonce),
+				wire.NewUnsignedAddress(wire.UDP, "127.0.0.1:13468", nonce),
+				wire.NewUnsignedAddress(wire.TCP, "127.0.0.1:13468", nonce),
+			})
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{})).To(Succeed())
+
+			Eventually(addrs, 5*time.Second).Should(Receive(Equal("127.0.0.1:13469")))
+			Eventually(addrs, 5*time.Second).Should(Receive(Equal("127.0.0.1:13468")))
+			Expect(networks).To(Receive(Equal("tcp")))
+			Expect(networks).To(Receive(Equal("tcp")))
+		})
+	})
+
+	Context("when dialing a remote peer that is offline", func() {
+		It("should observe the failures and the expiry of the remote peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			failed := make(chan error, 100)
+			expired := make(chan id.Signatory, 1)
+			observer := transport.CallbackConnObserver{
+				OnDialFailureCallback: func(remote id.Signatory, addr wire.Address, err error) {
+					select {
+					case failed <- err:
+					default:
+					}
+				},
+				OnExpiredCallback: func(remote id.Signatory) { expired <- remote },
+			}
+
+			t1 := newTransport(transport.DefaultOptions().
+				WithPort(13402).
+				WithDialBackoff(policy.ConstantTimeout(100 * time.Millisecond)).
+				WithExpiry(time.Second).
+				WithConnObserver(observer))
+
+			remote := id.NewPrivKey().Signatory()
+			t1.Table().AddPeer(remote, wire.NewUnsignedAddress(wire.TCP, "localhost:13403", uint64(time.Now().UnixNano())))
+			go t1.Send(ctx, remote, wire.Msg{})
+
+			Eventually(failed, 5*time.Second).Should(Receive(HaveOccurred()))
+			Eventually(expired, 10*time.Second).Should(Receive(Equal(remote)))
+		})
+	})
+})
@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"net"
+	"sync"
+
+	"github.com/renproject/id"
+)
+
+// A PeerFilter decides whether a Transport accepts inbound network connections
+// from a remote peer. It is consulted after the handshake, once the identity
+// of the remote peer is known. PeerFilters that also implement the AddrFilter
+// interface are consulted before the handshake too, so that unwanted network
+// connections can be dropped without spending time on cryptography.
+type PeerFilter interface {
+	AllowPeer(remote id.Signatory, addr net.Addr) bool
+}
+
+// An AddrFilter decides whether a Transport accepts an inbound network
+// connection from an address, before the handshake.
+type AddrFilter interface {
+	AllowAddr(addr net.Addr) bool
+}
+
+// PeerFilterFunc is a wrapper around a function that implements the PeerFilter
+// interface.
+type PeerFilterFunc func(id.Signatory, net.Addr) bool
+
+func (f PeerFilterFunc) AllowPeer(remote id.Signatory, addr net.Addr) bool {
+	return f(remote, addr)
+}
+
+// A SignatoryFilter is a PeerFilter that allows, or denies, a set of remote
+// peers. Remote peers can be added to, and removed from, the set while the
+// Transport is running, but existing network connections are not affected.
+type SignatoryFilter struct {
+	allow bool
+
+	signatoriesMu *sync.RWMutex
+	signatories   map[id.Signatory]struct{}
+}
+
+// NewAllowlist returns a SignatoryFilter that only allows the given remote
+// peers.
+func NewAllowlist(signatories ...id.Signatory) *SignatoryFilter {
+	return newSignatoryFilter(true, signatories)
+}
+
+// NewDenylist returns a SignatoryFilter that allows all remote peers, except
+// for the given remote peers.
+func NewDenylist(signatories ...id.Signatory) *SignatoryFilter {
+	return newSignatoryFilter(false, signatories)
+}
+
+func newSignatoryFilter(allow bool, signatories []id.Signatory) *SignatoryFilter {
+	f := &SignatoryFilter{
+		allow: allow,
+
+		signatoriesMu: new(sync.RWMutex),
+		signatories:   make(map[id.Signatory]struct{}, len(signatories)),
+	}
+	for _, signatory := range signatories {
+		f.signatories[signatory] = struct{}{}
+	}
+	return f
+}
+
+// Add a remote peer to the set.
+func (f *SignatoryFilter) Add(signatory id.Signatory) {
+	f.signatoriesMu.Lock()
+	defer f.signatoriesMu.Unlock()
+
+	f.signatories[signatory] = struct{}{}
+}
+
+// Remove a remote peer from the set.
+func (f *SignatoryFilter) Remove(signatory id.Signatory) {
+	f.signatoriesMu.Lock()
+	defer f.signatoriesMu.Unlock()
+
+	delete(f.signatories, signatory)
+}
+
+// AllowPeer implements the PeerFilter interface.
+func (f *SignatoryFilter) AllowPeer(remote id.Signatory, addr net.Addr) bool {
+	f.signatoriesMu.RLock()
+	defer f.signatoriesMu.RUnlock()
+
+	_, ok := f.signatories[remote]
+	return ok == f.allow
+}
@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/renproject/aw/policy"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// UpdateOptions changes the Options of a running Transport, without restarting
+// its listener. The update function is called with the current Options, and
+// only the following Options are taken from the result:
+//
+//   - ClientTimeout and ServerTimeout,
+//   - ServerIdleTimeout,
+//   - ClientMaxBytesPerSecond and ServerMaxBytesPerSecond,
+//   - HandshakeRateLimit and HandshakeBurst, and
+//   - PeerFilter.
+//
+// Byte rate limits apply immediately to network connections that are open, and
+// to new network connections. All other Options apply to new network
+// connections. Changing the handshake rate limit forgets the handshakes that
+// have already been counted against it. Changes to other Options are ignored.
+func (t *Transport) UpdateOptions(update func(Options) Options) {
+	t.reloadMu.Lock()
+	defer t.reloadMu.Unlock()
+
+	next := update(t.reload)
+	t.reload.ClientTimeout = next.ClientTimeout
+	t.reload.ServerTimeout = next.ServerTimeout
+	t.reload.ServerIdleTimeout = next.ServerIdleTimeout
+	t.reload.PeerFilter = next.PeerFilter
+
+	if next.ClientMaxBytesPerSecond != t.reload.ClientMaxBytesPerSecond {
+		t.reload.ClientMaxBytesPerSecond = next.ClientMaxBytesPerSecond
+		t.clientThrottle.SetLimits(next.ClientMaxBytesPerSecond, next.ClientMaxBytesPerSecond)
+	}
+	if next.ServerMaxBytesPerSecond != t.reload.ServerMaxBytesPerSecond {
+		t.reload.ServerMaxBytesPerSecond = next.ServerMaxBytesPerSecond
+		t.serverThrottle.SetLimits(next.ServerMaxBytesPerSecond, next.ServerMaxBytesPerSecond)
+	}
+	if next.HandshakeRateLimit != t.reload.HandshakeRateLimit || next.HandshakeBurst != t.reload.HandshakeBurst {
+		t.reload.HandshakeRateLimit = next.HandshakeRateLimit
+		t.reload.HandshakeBurst = next.HandshakeBurst
+		t.handshakeAllow = t.handshakeRateLimit(next.HandshakeRateLimit, next.HandshakeBurst)
+	}
+	t.opts.Logger.Info("options updated")
+}
+
+// options returns the current Options of the Transport, including changes
+// made by UpdateOptions. It must be used, instead of reading the Options
+// directly, for every Option that can be changed.
+func (t *Transport) options() Options {
+	t.reloadMu.RLock()
+	defer t.reloadMu.RUnlock()
+
+	return t.reload
+}
+
+// allowHandshake applies the current handshake rate limit to an inbound
+// network connection.
+func (t *Transport) allowHandshake(conn net.Conn) (error, policy.Cleanup) {
+	t.reloadMu.RLock()
+	allow := t.handshakeAllow
+	t.reloadMu.RUnlock()
+
+	if allow == nil {
+		return nil, nil
+	}
+	return allow(conn)
+}
+
+// handshakeRateLimit returns a policy that rate limits incoming connection
+// attempts from each IP address, or nil if there is no limit.
+func (t *Transport) handshakeRateLimit(limit rate.Limit, burst int) policy.Allow {
+	if limit == rate.Inf {
+		return nil
+	}
+	rateLimit := policy.RateLimit(limit, burst, handshakeRateLimitCap)
+	return func(conn net.Conn) (error, policy.Cleanup) {
+		err, cleanup := rateLimit(conn)
+		if err != nil {
+			t.accepts.accept()
+			t.accepts.reject(RejectRateLimit)
+			addr := conn.RemoteAddr().String()
+			host, _, _ := net.SplitHostPort(addr)
+			t.agg.Debug("ratelimit/"+host, "handshake rate limit", zap.String("addr", addr), zap.Error(err))
+		}
+		return err, cleanup
+	}
+}
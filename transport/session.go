@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// SessionInfo summarises a session: a network connection to a remote peer
+// that has completed its handshake, and is about to be attached. It is logged
+// once for every session, and is intended to be the one line that operators
+// need when diagnosing why two peers cannot talk.
+type SessionInfo struct {
+	Remote    id.Signatory
+	Addr      net.Addr
+	LocalAddr net.Addr
+	// Inbound is true if the network connection was accepted, and false if
+	// it was dialed.
+	Inbound bool
+	// Linked is true if the Transport is linked to the remote peer, in which
+	// case the session is kept alive.
+	Linked bool
+	// Transport is "tls" if the network connection is wrapped in TLS, and
+	// "tcp" otherwise. TLSVersion and TLSCipherSuite are empty unless the
+	// transport is "tls".
+	Transport      string
+	TLSVersion     string
+	TLSCipherSuite string
+	// ProxyProtocol is true if the address of the remote peer was read from
+	// a PROXY protocol header.
+	ProxyProtocol bool
+	// WireVersion selected for messages sent to the remote peer, or zero if
+	// messages are sent using their own version (see
+	// channel.Client.WireVersion).
+	WireVersion uint16
+	// CipherSuite used to encrypt the session, or empty if the handshake
+	// does not encrypt it (see codec.Stats).
+	CipherSuite string
+	// Handshake is how long the handshake took.
+	Handshake time.Duration
+}
+
+// A SessionObserver is notified about every session that is established by a
+// Transport. If the ConnObserver of a Transport also implements the
+// SessionObserver interface, then it is notified.
+type SessionObserver interface {
+	// OnSessionEstablished is called after the handshake of a network
+	// connection succeeds, and before it is attached.
+	OnSessionEstablished(info SessionInfo)
+}
+
+// OnSessionEstablished will delegate the implementation to the
+// OnSessionEstablishedCallback.
+func (observer CallbackConnObserver) OnSessionEstablished(info SessionInfo) {
+	if observer.OnSessionEstablishedCallback != nil {
+		observer.OnSessionEstablishedCallback(info)
+	}
+}
+
+// establishSession logs the SessionInfo of a network connection, and notifies
+// the SessionObserver, if there is one.
+func (t *Transport) establishSession(remote id.Signatory, conn net.Conn, enc codec.Encoder, inbound bool, handshake time.Duration) {
+	info := SessionInfo{
+		Remote:        remote,
+		Addr:          conn.RemoteAddr(),
+		LocalAddr:     conn.LocalAddr(),
+		Inbound:       inbound,
+		Linked:        t.IsLinked(remote),
+		Transport:     "tcp",
+		ProxyProtocol: inbound && t.opts.ProxyProtocol,
+		WireVersion:   t.client.WireVersion(remote),
+		Handshake:     handshake,
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.Transport = "tls"
+		info.TLSVersion = tlsVersionName(state.Version)
+		info.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	if stats, ok := codec.Stats(enc); ok {
+		info.CipherSuite = stats.CipherSuite.String()
+	}
+
+	fields := []zap.Field{
+		zap.String("remote", info.Remote.String()),
+		zap.Stringer("addr", info.Addr),
+		zap.Stringer("local", info.LocalAddr),
+		zap.Bool("inbound", info.Inbound),
+		zap.Bool("linked", info.Linked),
+		zap.String("transport", info.Transport),
+		zap.Uint16("wire", info.WireVersion),
+		zap.Duration("handshake", info.Handshake),
+	}
+	if info.CipherSuite != "" {
+		fields = append(fields, zap.String("session", info.CipherSuite))
+	}
+	if info.Transport == "tls" {
+		fields = append(fields, zap.String("tls", info.TLSVersion), zap.String("cipher", info.TLSCipherSuite))
+	}
+	if info.ProxyProtocol {
+		fields = append(fields, zap.Bool("proxy", true))
+	}
+	t.opts.Logger.Info("session", fields...)
+
+	if observer, ok := t.opts.ConnObserver.(SessionObserver); ok {
+		observer.OnSessionEstablished(info)
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return "unknown"
+	}
+}
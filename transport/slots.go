@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/id"
+)
+
+// inboundSlots limits the number of inbound network connections that can be
+// held at once. Some of the slots are reserved for allowlisted remote peers,
+// so that a flood of inbound connections from other remote peers can never
+// prevent them from connecting. Slots are acquired after the handshake, once
+// the identity of the remote peer is known.
+type inboundSlots struct {
+	max       int
+	reserved  int
+	allowlist map[id.Signatory]bool
+
+	connsMu *sync.Mutex
+	conns   int
+}
+
+func newInboundSlots(max, reserved int, allowlist map[id.Signatory]bool) *inboundSlots {
+	return &inboundSlots{
+		max:       max,
+		reserved:  reserved,
+		allowlist: allowlist,
+
+		connsMu: new(sync.Mutex),
+		conns:   0,
+	}
+}
+
+// acquire a slot for an inbound network connection from a remote peer. Remote
+// peers that are allowlisted can use any slot, but other remote peers cannot
+// use the reserved slots. The returned function releases the slot.
+func (slots *inboundSlots) acquire(remote id.Signatory) (func(), error) {
+	if slots.max <= 0 {
+		return func() {}, nil
+	}
+
+	max := slots.max
+	if !slots.allowlist[remote] {
+		max -= slots.reserved
+	}
+
+	slots.connsMu.Lock()
+	defer slots.connsMu.Unlock()
+
+	if slots.conns >= max {
+		return nil, policy.ErrMaxConnectionsExceeded
+	}
+	slots.conns++
+	return func() {
+		slots.connsMu.Lock()
+		slots.conns--
+		slots.connsMu.Unlock()
+	}, nil
+}
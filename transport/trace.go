@@ -0,0 +1,30 @@
+package transport
+
+import (
+	"errors"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+)
+
+// errDialStopped ends the channel.SpanDial of dials that stop before a network
+// connection completes the handshake.
+var errDialStopped = errors.New("dial stopped")
+
+// noSpan is used when the Client of the Transport has no Tracer.
+type noSpan struct{}
+
+func (noSpan) Context() wire.TraceContext { return wire.TraceContext{} }
+
+func (noSpan) End(error) {}
+
+// startSpan starts a span using the Tracer of the Client (see
+// channel.Options.WithTracer).
+func (t *Transport) startSpan(name string, remote id.Signatory, parent wire.TraceContext) channel.Span {
+	tracer := t.client.Tracer()
+	if tracer == nil {
+		return noSpan{}
+	}
+	return tracer.StartSpan(name, remote, parent)
+}
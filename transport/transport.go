@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -15,12 +16,14 @@ import (
 	"github.com/renproject/aw/channel"
 	"github.com/renproject/aw/codec"
 	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/options"
 	"github.com/renproject/aw/policy"
 	"github.com/renproject/aw/tcp"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 // Default options.
@@ -30,23 +33,89 @@ var (
 	DefaultEncoder       = codec.PlainEncoder
 	DefaultDecoder       = codec.PlainDecoder
 	DefaultDialTimeout   = policy.ConstantTimeout(time.Second)
+	DefaultDialBackoff   = policy.Jitter(0.2, policy.MaxTimeout(10*time.Second, policy.ExponentialBackoff(1.6, policy.ConstantTimeout(100*time.Millisecond))))
 	DefaultClientTimeout = 10 * time.Second
 	DefaultServerTimeout = 10 * time.Second
 	DefaultExpiryTimeout = time.Minute
+
+	DefaultServerIdleTimeout = time.Duration(0)
+
+	DefaultMaxConcurrentSends = 16
+	DefaultDualStack          = false
+	DefaultDialProtocols      = []wire.Protocol{wire.TCP}
+	DefaultAddressRaceDelay   = time.Duration(0)
+
+	DefaultClientMaxBytesPerSecond = rate.Inf
+	DefaultServerMaxBytesPerSecond = rate.Inf
+
+	DefaultHandshakeRateLimit = rate.Inf
+	DefaultHandshakeBurst     = 0
+
+	DefaultLogAggregationPeriod = time.Minute
 )
 
+// handshakeRateLimitCap is the number of IP addresses for which handshake rate
+// limits are remembered.
+const handshakeRateLimitCap = 64 * 1024
+
 // Options used to parameterise the behaviour of a Transport.
 type Options struct {
 	Logger          *zap.Logger
 	Host            string
 	Port            uint16
+	Listener        net.Listener
 	Encoder         codec.Encoder
 	Decoder         codec.Decoder
 	DialTimeout     policy.Timeout
+	DialBackoff     policy.Timeout
 	ClientTimeout   time.Duration
 	ServerTimeout   time.Duration
 	OncePoolOptions handshake.OncePoolOptions
 	ExpiryDuration  time.Duration
+
+	ServerIdleTimeout time.Duration
+	ProxyProtocol     bool
+
+	LogAggregationPeriod time.Duration
+
+	Tarpit        bool
+	TarpitOptions tcp.TarpitOptions
+
+	ConnObserver ConnObserver
+
+	MaxConcurrentSends int
+
+	ServerTLSConfig *tls.Config
+	ClientTLSConfig *tls.Config
+
+	MaxInboundConns          int
+	ReservedInboundConns     int
+	ReservedInboundAllowlist map[id.Signatory]bool
+
+	DualStack     bool
+	Dialer        tcp.DialFunc
+	DialProtocols []wire.Protocol
+
+	ProtocolPreference []wire.Protocol
+	AddressRaceDelay   time.Duration
+
+	ClientMaxBytesPerSecond rate.Limit
+	ServerMaxBytesPerSecond rate.Limit
+
+	SendImpairment    tcp.Impairment
+	ReceiveImpairment tcp.Impairment
+
+	MaxConns       int
+	MaxConnsPolicy tcp.LimitPolicy
+
+	MaxConnGoroutines int
+	MaxHandshakes     int
+	MaxPendingDials   int
+
+	HandshakeRateLimit rate.Limit
+	HandshakeBurst     int
+
+	PeerFilter PeerFilter
 }
 
 // DefaultOptions returns Options with sensible defaults.
@@ -62,10 +131,38 @@ func DefaultOptions() Options {
 		Encoder:         DefaultEncoder,
 		Decoder:         DefaultDecoder,
 		DialTimeout:     DefaultDialTimeout,
+		DialBackoff:     DefaultDialBackoff,
 		ClientTimeout:   DefaultClientTimeout,
 		ServerTimeout:   DefaultServerTimeout,
 		OncePoolOptions: handshake.DefaultOncePoolOptions(),
 		ExpiryDuration:  DefaultExpiryTimeout,
+
+		ServerIdleTimeout: DefaultServerIdleTimeout,
+		ProxyProtocol:     false,
+
+		LogAggregationPeriod: DefaultLogAggregationPeriod,
+
+		Tarpit:        false,
+		TarpitOptions: tcp.DefaultTarpitOptions(),
+
+		ConnObserver: CallbackConnObserver{},
+
+		MaxConcurrentSends: DefaultMaxConcurrentSends,
+
+		DualStack:     DefaultDualStack,
+		DialProtocols: DefaultDialProtocols,
+
+		AddressRaceDelay: DefaultAddressRaceDelay,
+
+		ClientMaxBytesPerSecond: DefaultClientMaxBytesPerSecond,
+		ServerMaxBytesPerSecond: DefaultServerMaxBytesPerSecond,
+
+		MaxConnGoroutines: 0,
+		MaxHandshakes:     0,
+		MaxPendingDials:   0,
+
+		HandshakeRateLimit: DefaultHandshakeRateLimit,
+		HandshakeBurst:     DefaultHandshakeBurst,
 	}
 }
 
@@ -84,6 +181,43 @@ func (opts Options) WithPort(port uint16) Options {
 	return opts
 }
 
+// WithListener sets the listener used to accept inbound network connections,
+// instead of binding a new listener to the host and port. This allows the
+// Transport to accept network connections from listeners that were created by
+// the caller (for example, using a net.ListenConfig), listeners on Unix domain
+// sockets, and listeners on file descriptors that were inherited from systemd
+// socket activation or a previous process. The host and port are still used
+// when advertising the Transport, so they should match the address of the
+// listener. The listener is closed once the Transport stops running, or begins
+// draining. If the caller closes the listener, then the Transport stops
+// running.
+func (opts Options) WithListener(listener net.Listener) Options {
+	opts.Listener = listener
+	return opts
+}
+
+// WithDialTimeout sets the Timeout policy that bounds each individual dial
+// attempt.
+func (opts Options) WithDialTimeout(timeout policy.Timeout) Options {
+	opts.DialTimeout = timeout
+	return opts
+}
+
+// WithDialBackoff sets the Timeout policy used to wait between failed dial
+// attempts to the same remote peer. The attempt count keeps increasing for as
+// long as the Transport is trying to reach the remote peer, so the backoff
+// should be clamped using policy.MaxTimeout. Jitter (see policy.Jitter) should
+// wrap the clamped backoff, to avoid many peers re-dialing a restarted peer at
+// the same time, even once they have all reached the clamp. Failures while the
+// remote peer is connected, or in its maintenance window, do not increase the
+// attempt count, and it is reset once a handshake succeeds. If
+// the backoff is nil, the next attempt is made as soon as the dial timeout of
+// the failed attempt has passed.
+func (opts Options) WithDialBackoff(backoff policy.Timeout) Options {
+	opts.DialBackoff = backoff
+	return opts
+}
+
 func (opts Options) WithClientTimeout(timeout time.Duration) Options {
 	opts.ClientTimeout = timeout
 	return opts
@@ -94,6 +228,29 @@ func (opts Options) WithServerTimeout(timeout time.Duration) Options {
 	return opts
 }
 
+// WithServerIdleTimeout sets how long an accepted network connection can go
+// without sending anything before it is closed (see tcp.IdleTimeout). This is
+// distinct from the server timeout, and also applies to remote peers that are
+// linked, so that network connections that complete the handshake but then go
+// quiet do not hold file descriptors forever. Remote peers that use keep-alive
+// messages (see channel.Options.WithKeepAliveInterval) with a shorter interval
+// are never idle. A non-positive timeout disables it, and this is the default.
+func (opts Options) WithServerIdleTimeout(timeout time.Duration) Options {
+	opts.ServerIdleTimeout = timeout
+	return opts
+}
+
+// WithProxyProtocol enables, or disables, reading a PROXY protocol header from
+// the beginning of every accepted network connection (see tcp.ProxyProtocol).
+// This allows the Transport to see the addresses of remote peers when it is
+// behind a load balancer (such as HAProxy, or an AWS NLB). Headers must be
+// read before the server timeout. Only enable this when all network
+// connections arrive through a load balancer. By default, it is disabled.
+func (opts Options) WithProxyProtocol(enabled bool) Options {
+	opts.ProxyProtocol = enabled
+	return opts
+}
+
 func (opts Options) WithOncePoolOptions(oncePoolOpts handshake.OncePoolOptions) Options {
 	opts.OncePoolOptions = oncePoolOpts
 	return opts
@@ -104,45 +261,377 @@ func (opts Options) WithExpiry(minimumDuration time.Duration) Options {
 	return opts
 }
 
+// WithLogAggregationPeriod sets the period over which repeated dial, handshake,
+// and attachment errors are aggregated. The first error for a remote peer (or
+// remote IP address) is logged immediately, and any repeats are summarised in
+// one entry at the end of the period. A non-positive period disables
+// aggregation.
+func (opts Options) WithLogAggregationPeriod(period time.Duration) Options {
+	opts.LogAggregationPeriod = period
+	return opts
+}
+
+// WithTarpit enables, or disables, tarpitting of inbound connections from IP
+// addresses that repeatedly fail the handshake. Instead of being handshaked,
+// connections from these IP addresses are held open and answered extremely
+// slowly (see tcp.Tarpit). By default, tarpitting is disabled.
+func (opts Options) WithTarpit(enabled bool) Options {
+	opts.Tarpit = enabled
+	return opts
+}
+
+// WithTarpitOptions sets the options used when tarpitting is enabled.
+func (opts Options) WithTarpitOptions(tarpitOpts tcp.TarpitOptions) Options {
+	opts.TarpitOptions = tarpitOpts
+	return opts
+}
+
+// WithConnObserver sets the ConnObserver that is notified when connections are
+// dialed, fail to be dialed, are closed, and when remote peers expire.
+func (opts Options) WithConnObserver(observer ConnObserver) Options {
+	opts.ConnObserver = observer
+	return opts
+}
+
+// WithMaxConcurrentSends sets the maximum number of remote peers to which
+// SendToMany will send concurrently. A non-positive value means that there is
+// no maximum.
+func (opts Options) WithMaxConcurrentSends(n int) Options {
+	opts.MaxConcurrentSends = n
+	return opts
+}
+
+// WithServerTLSConfig sets the TLS configuration used to wrap accepted network
+// connections. The TLS handshake is done before the handshake, which still
+// authenticates and encrypts the connection as usual. This is only needed for
+// deployments that require TLS (for example, for compliance). By default, TLS
+// is not used.
+func (opts Options) WithServerTLSConfig(config *tls.Config) Options {
+	opts.ServerTLSConfig = config
+	return opts
+}
+
+// WithMaxInboundConns sets the maximum number of inbound network connections
+// that can be held at once. Inbound network connections beyond this maximum
+// are dropped after the handshake. A non-positive maximum means that there is
+// no maximum, and this is the default.
+func (opts Options) WithMaxInboundConns(max int) Options {
+	opts.MaxInboundConns = max
+	return opts
+}
+
+// WithReservedInboundConns reserves some of the inbound network connection
+// slots (see WithMaxInboundConns) for the remote peers in the allowlist (for
+// example, fellow validators). Other remote peers can never use the reserved
+// slots, so they cannot lock out allowlisted remote peers by flooding the
+// Transport with inbound network connections. Allowlisted remote peers can use
+// any slot. The allowlist is copied.
+func (opts Options) WithReservedInboundConns(reserved int, allowlist []id.Signatory) Options {
+	opts.ReservedInboundConns = reserved
+	opts.ReservedInboundAllowlist = make(map[id.Signatory]bool, len(allowlist))
+	for _, remote := range allowlist {
+		opts.ReservedInboundAllowlist[remote] = true
+	}
+	return opts
+}
+
+// WithClientTLSConfig sets the TLS configuration used to wrap dialed network
+// connections (see WithServerTLSConfig). By default, TLS is not used.
+func (opts Options) WithClientTLSConfig(config *tls.Config) Options {
+	opts.ClientTLSConfig = config
+	return opts
+}
+
+// WithDualStack enables dialing remote peers using "Happy Eyeballs" (see
+// tcp.DualStackDialer). When the host of a remote peer resolves to both IPv4
+// and IPv6 addresses, staggered connection attempts are made to all of them
+// concurrently, and the first connection to be established is used. By
+// default, the standard library dialer is used.
+func (opts Options) WithDualStack(enabled bool) Options {
+	opts.DualStack = enabled
+	return opts
+}
+
+// WithDialer sets the tcp.DialFunc used to dial remote peers (for example, see
+// ws.Dialer and udp.Dialer), so that outbound network connections can use a
+// different network to inbound network connections. It takes precedence over
+// WithDualStack. By default, the standard library dialer is used. If protocols
+// are given, then only network addresses with those protocols are dialed (for
+// example, wire.WebSocket for ws.Dialer). Otherwise, only network addresses
+// with the DefaultDialProtocols are dialed.
+func (opts Options) WithDialer(dialer tcp.DialFunc, protocols ...wire.Protocol) Options {
+	opts.Dialer = dialer
+	if len(protocols) > 0 {
+		opts.DialProtocols = protocols
+	}
+	return opts
+}
+
+// WithProtocolPreference sets the order in which the network addresses of a
+// remote peer with more than one network address are dialed, by protocol.
+// Network addresses with protocols that appear earlier are dialed first, and
+// network addresses with protocols that do not appear are dialed last (see
+// wire.SortAddresses). By default, network addresses are dialed in the order
+// of priority advertised by the remote peer.
+func (opts Options) WithProtocolPreference(preference ...wire.Protocol) Options {
+	opts.ProtocolPreference = preference
+	return opts
+}
+
+// WithAddressRaceDelay races the network addresses of a remote peer with more
+// than one network address, starting a connection attempt to the next network
+// address after the delay passes (see tcp.FallbackDialer). By default, the
+// next network address is only dialed after dialing the previous one fails.
+func (opts Options) WithAddressRaceDelay(delay time.Duration) Options {
+	opts.AddressRaceDelay = delay
+	return opts
+}
+
+// WithClientMaxBytesPerSecond throttles each dialed network connection, so that
+// reading from it and writing to it are each limited to the given number of
+// bytes per second (see tcp.Throttle). This stops one remote peer from using
+// all of the bandwidth of a constrained link. By default, there is no limit.
+func (opts Options) WithClientMaxBytesPerSecond(limit rate.Limit) Options {
+	opts.ClientMaxBytesPerSecond = limit
+	return opts
+}
+
+// WithServerMaxBytesPerSecond throttles each accepted network connection (see
+// WithClientMaxBytesPerSecond). By default, there is no limit.
+func (opts Options) WithServerMaxBytesPerSecond(limit rate.Limit) Options {
+	opts.ServerMaxBytesPerSecond = limit
+	return opts
+}
+
+// WithImpairment injects artificial latency, jitter, and loss into the bytes
+// sent to, and received from, every network connection (see tcp.Impair), so
+// that applications can be tested under WAN conditions using their normal
+// deployment topology. Impairments are only injected when built with the
+// "staging" build tag, and are otherwise ignored, so that they cannot be
+// enabled in production by mistake. By default, there is no impairment.
+func (opts Options) WithImpairment(send, receive tcp.Impairment) Options {
+	opts.SendImpairment = send
+	opts.ReceiveImpairment = receive
+	return opts
+}
+
+// WithMaxConns sets the maximum number of network connections that can be
+// accepted and held open at once, and the policy applied when the maximum is
+// reached (see tcp.ConnLimiter). Unlike WithMaxInboundConns, this limit is
+// enforced before the handshake, so it also bounds the resources used by
+// network connections that never complete it. A non-positive maximum means
+// that there is no maximum, and this is the default.
+func (opts Options) WithMaxConns(max int, policy tcp.LimitPolicy) Options {
+	opts.MaxConns = max
+	opts.MaxConnsPolicy = policy
+	return opts
+}
+
+// WithMaxConnGoroutines sets the maximum number of goroutines that can hold a
+// network connection at once, whether the network connection was accepted or
+// dialed. Network connections that would exceed the maximum are closed
+// immediately. A non-positive maximum means that there is no maximum, and this
+// is the default.
+func (opts Options) WithMaxConnGoroutines(max int) Options {
+	opts.MaxConnGoroutines = max
+	return opts
+}
+
+// WithMaxHandshakes sets the maximum number of handshakes, for both accepted
+// and dialed network connections, that can be in progress at once. Network
+// connections that would exceed the maximum are closed without doing the
+// handshake, which bounds the time spent on cryptography. A non-positive
+// maximum means that there is no maximum, and this is the default.
+func (opts Options) WithMaxHandshakes(max int) Options {
+	opts.MaxHandshakes = max
+	return opts
+}
+
+// WithMaxPendingDials sets the maximum number of dials that can be waiting for
+// a network connection at once. Sending to a remote peer that would need a
+// dial that exceeds the maximum fails with a LimitError, instead of starting
+// another goroutine. A non-positive maximum means that there is no maximum,
+// and this is the default.
+func (opts Options) WithMaxPendingDials(max int) Options {
+	opts.MaxPendingDials = max
+	return opts
+}
+
+// WithHandshakeRateLimit sets the handshakes-per-second rate limit, and burst,
+// that will be enforced on the inbound network connections from each IP
+// address (see policy.RateLimit). Network connections that exceed this limit
+// are closed before the handshake begins, so that connection floods cannot
+// make the Transport spend its time on cryptography. To limit the messages
+// sent by each remote peer once it is connected, see
+// channel.Options.WithMessageRateLimit. By default, there is no limit.
+func (opts Options) WithHandshakeRateLimit(rateLimit rate.Limit, burst int) Options {
+	opts.HandshakeRateLimit = rateLimit
+	opts.HandshakeBurst = burst
+	return opts
+}
+
+// WithPeerFilter sets the PeerFilter that decides whether inbound network
+// connections are accepted from each remote peer (see NewAllowlist and
+// NewDenylist). Network connections from remote peers that are not allowed
+// are closed before they are attached to a Channel, so applications never see
+// their messages. By default, there is no PeerFilter, and all remote peers
+// are allowed.
+func (opts Options) WithPeerFilter(filter PeerFilter) Options {
+	opts.PeerFilter = filter
+	return opts
+}
+
 type Transport struct {
 	opts Options
 
-	self   id.Signatory
-	client *channel.Client
-	once   handshake.Handshake
+	self     id.Signatory
+	client   *channel.Client
+	oncePool *handshake.OncePool
+	h        handshake.Handshake
+	once     handshake.Handshake
+	agg      *aggregator
+	tarpit   *tcp.Tarpit
+	limiter  *tcp.ConnLimiter
+	inbound  *inboundSlots
+	accepts  *acceptStats
+	limits   *resourceLimits
+
+	// reload holds the Options that can be changed by UpdateOptions, and
+	// the state that is built from them.
+	reloadMu       *sync.RWMutex
+	reload         Options
+	handshakeAllow policy.Allow
+	clientThrottle *tcp.ThrottleGroup
+	serverThrottle *tcp.ThrottleGroup
 
 	linksMu *sync.RWMutex
 	links   map[id.Signatory]bool
+	redials map[id.Signatory]*redial
 
 	connsMu *sync.RWMutex
 	conns   map[id.Signatory]int64
 
+	maintenanceMu     *sync.RWMutex
+	maintenance       map[id.Signatory]time.Time
+	maintenanceWindow time.Time
+
+	// draining is closed when the Transport begins draining.
+	draining  chan struct{}
+	drainOnce *sync.Once
+
+	goingAwayMu *sync.RWMutex
+	goingAway   map[id.Signatory]GoingAway
+
 	table dht.Table
 }
 
+// An Option changes Options. Options are passed to NewWith, so that new
+// options can be added without changing its signature.
+type Option func(Options) Options
+
+// With returns the Options changed by each Option, in order.
+func (opts Options) With(changes ...Option) Options {
+	for _, change := range changes {
+		opts = change(opts)
+	}
+	return opts
+}
+
+// FromOptions returns an Option that replaces all Options. It adapts Options
+// that were built using the With methods.
+func FromOptions(opts Options) Option {
+	return func(Options) Options { return opts }
+}
+
+// DecodeOptions returns an Option that decodes JSON configuration on top of
+// Options (see options.Decode). Keys that do not match an option are ignored.
+func DecodeOptions(data []byte) (Option, error) {
+	decode, err := options.Compile(data, &Options{})
+	if err != nil {
+		return nil, err
+	}
+	return func(opts Options) Options {
+		decode(&opts)
+		return opts
+	}, nil
+}
+
+// NewWith returns a Transport that uses the DefaultOptions, changed by the
+// Options.
+func NewWith(self id.Signatory, client *channel.Client, h handshake.Handshake, table dht.Table, changes ...Option) *Transport {
+	return New(DefaultOptions().With(changes...), self, client, h, table)
+}
+
 func New(opts Options, self id.Signatory, client *channel.Client, h handshake.Handshake, table dht.Table) *Transport {
 	oncePool := handshake.NewOncePool(opts.OncePoolOptions)
-	return &Transport{
+	if opts.ConnObserver == nil {
+		opts.ConnObserver = CallbackConnObserver{}
+	}
+	var tarpit *tcp.Tarpit
+	if opts.Tarpit {
+		tarpit = tcp.NewTarpit(opts.TarpitOptions)
+	}
+	if !impairmentEnabled && (opts.SendImpairment != (tcp.Impairment{}) || opts.ReceiveImpairment != (tcp.Impairment{})) {
+		opts.Logger.Warn("impairment ignored: build with the staging tag to inject impairments")
+	}
+	var limiter *tcp.ConnLimiter
+	if opts.MaxConns > 0 {
+		limiter = tcp.NewConnLimiter(opts.MaxConns, opts.MaxConnsPolicy)
+	}
+	t := &Transport{
 		opts: opts,
 
-		self:   self,
-		client: client,
-		once:   handshake.Once(self, &oncePool, h),
+		self:     self,
+		client:   client,
+		oncePool: &oncePool,
+		h:        h,
+		once:     handshake.Once(self, &oncePool, h),
+		agg:      newAggregator(opts.Logger, opts.LogAggregationPeriod),
+		tarpit:   tarpit,
+		limiter:  limiter,
+		inbound:  newInboundSlots(opts.MaxInboundConns, opts.ReservedInboundConns, opts.ReservedInboundAllowlist),
+		accepts:  newAcceptStats(),
+		limits: newResourceLimits(map[string]int{
+			ResourceConnGoroutines: opts.MaxConnGoroutines,
+			ResourceHandshakes:     opts.MaxHandshakes,
+			ResourcePendingDials:   opts.MaxPendingDials,
+		}),
+
+		reloadMu:       new(sync.RWMutex),
+		reload:         opts,
+		clientThrottle: tcp.NewThrottleGroup(opts.ClientMaxBytesPerSecond, opts.ClientMaxBytesPerSecond),
+		serverThrottle: tcp.NewThrottleGroup(opts.ServerMaxBytesPerSecond, opts.ServerMaxBytesPerSecond),
 
 		linksMu: new(sync.RWMutex),
 		links:   map[id.Signatory]bool{},
+		redials: map[id.Signatory]*redial{},
 
 		connsMu: new(sync.RWMutex),
 		conns:   map[id.Signatory]int64{},
 
+		maintenanceMu: new(sync.RWMutex),
+		maintenance:   map[id.Signatory]time.Time{},
+
+		draining:  make(chan struct{}),
+		drainOnce: new(sync.Once),
+
+		goingAwayMu: new(sync.RWMutex),
+		goingAway:   map[id.Signatory]GoingAway{},
+
 		table: table,
 	}
+	t.handshakeAllow = t.handshakeRateLimit(opts.HandshakeRateLimit, opts.HandshakeBurst)
+	return t
 }
 
 func (t *Transport) Table() dht.Table {
 	return t.table
 }
 
+func (t *Transport) Client() *channel.Client {
+	return t.client
+}
+
 func (t *Transport) Self() id.Signatory {
 	return t.self
 }
@@ -156,44 +645,279 @@ func (t *Transport) Port() uint16 {
 }
 
 func (t *Transport) Send(ctx context.Context, remote id.Signatory, msg wire.Msg) error {
+	return t.SendWithPriority(ctx, remote, msg, channel.PriorityNormal)
+}
+
+// SendWithPriority is the same as Send, but messages with a high priority skip
+// ahead of messages with a normal priority that are waiting to be written to
+// the same remote peer (see channel.Client.SendWithPriority).
+func (t *Transport) SendWithPriority(ctx context.Context, remote id.Signatory, msg wire.Msg, priority channel.Priority) error {
+	return t.SendWithOptions(ctx, remote, msg, channel.DefaultSendOptions().WithPriority(priority))
+}
+
+// SendWithOptions is the same as Send, but the SendOptions override the
+// priority, timeout, and blocking behaviour of this message, and how hard the
+// Transport tries to dial the remote peer if it is not already connected (see
+// channel.SendOptions).
+func (t *Transport) SendWithOptions(ctx context.Context, remote id.Signatory, msg wire.Msg, opts channel.SendOptions) error {
 	remoteAddr, ok := t.table.PeerAddress(remote)
 	if !ok {
+		opts.Notify(wire.OutcomeDropped)
 		return fmt.Errorf("peer not found: %v", remote)
 	}
 
+	// Dialing continues in the background after returning, so it is bounded
+	// by its own timeout, derived from the context before it is bounded by
+	// the timeout of sending.
+	dialCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
 	if t.IsConnected(remote) {
 		t.opts.Logger.Debug("send", zap.Bool("connected", true), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-		return t.client.Send(ctx, remote, msg)
+		return t.client.SendWithOptions(ctx, remote, msg, opts)
+	}
+
+	releaseDial, err := t.limits.acquire(ResourcePendingDials)
+	if err != nil {
+		opts.Notify(wire.OutcomeDropped)
+		return err
 	}
 
 	if t.IsLinked(remote) {
 		t.opts.Logger.Debug("send", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-		go t.dial(ctx, remote, remoteAddr)
-		return t.client.Send(ctx, remote, msg)
+		go t.dialWithin(dialCtx, opts.Timeout, remote, remoteAddr, opts.MaxDialAttempts, releaseDial, msg.Trace)
+		return t.client.SendWithOptions(ctx, remote, msg, opts)
 	}
 
 	t.opts.Logger.Debug("send", zap.Bool("linked", false), zap.Bool("connected", false), zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
-	t.client.Bind(remote)
+	if err := t.client.Bind(remote); err != nil {
+		releaseDial()
+		opts.Notify(wire.OutcomeDropped)
+		return err
+	}
+	go func() {
+		defer t.client.Unbind(remote)
+		t.dialWithin(dialCtx, opts.Timeout, remote, remoteAddr, opts.MaxDialAttempts, releaseDial, msg.Trace)
+	}()
+	return t.client.SendWithOptions(ctx, remote, msg, opts)
+}
+
+// SendToMany sends a message to many remote peers concurrently, using existing
+// network connections where possible, and dialing new ones where necessary. At
+// most MaxConcurrentSends remote peers are sent to at the same time. It blocks
+// until the message has been sent to all remote peers, or the context is done,
+// and returns the errors for the remote peers to which the message could not
+// be sent. If the message was sent to all remote peers, the returned map is
+// empty.
+func (t *Transport) SendToMany(ctx context.Context, remotes []id.Signatory, msg wire.Msg) map[id.Signatory]error {
+	return t.sendToMany(ctx, remotes, msg, t.Send)
+}
+
+// sendToMany sends a message to many remote peers concurrently, using the send
+// function for each remote peer.
+func (t *Transport) sendToMany(ctx context.Context, remotes []id.Signatory, msg wire.Msg, send func(context.Context, id.Signatory, wire.Msg) error) map[id.Signatory]error {
+	var sem chan struct{}
+	if t.opts.MaxConcurrentSends > 0 {
+		sem = make(chan struct{}, t.opts.MaxConcurrentSends)
+	}
+
+	errsMu := new(sync.Mutex)
+	errs := map[id.Signatory]error{}
+
+	wg := new(sync.WaitGroup)
+	for i := range remotes {
+		remote := remotes[i]
+		if sem != nil {
+			select {
+			case <-ctx.Done():
+				errsMu.Lock()
+				errs[remote] = fmt.Errorf("sending message %w", ctx.Err())
+				errsMu.Unlock()
+				continue
+			case sem <- struct{}{}:
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := send(ctx, remote, msg); err != nil {
+				errsMu.Lock()
+				errs[remote] = err
+				errsMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// Reconnect closes the current network connection with a remote peer, and
+// immediately dials the remote peer again, without waiting for the network
+// connection to fault or expire. This is useful when the network path to the
+// remote peer is known to have changed. Messages that have been sent, but not
+// yet written, are kept by the Channel and are written once the new network
+// connection is attached. If the remote peer is linked, and a network
+// connection has been dialed to it, then that network connection is closed and
+// the same dialing loop dials it again, so that there is never more than one
+// dial at a time. The remote peer might still reject the new network
+// connection if it has recently accepted another one, in which case it is up
+// to the remote peer to dial back.
+func (t *Transport) Reconnect(ctx context.Context, remote id.Signatory) error {
+	remoteAddr, ok := t.table.PeerAddress(remote)
+	if !ok {
+		return fmt.Errorf("peer not found: %v", remote)
+	}
+
+	t.opts.Logger.Debug("reconnect", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
+	t.oncePool.Drop(remote)
+
+	if t.redial(remote) {
+		return nil
+	}
+
+	releaseDial, err := t.limits.acquire(ResourcePendingDials)
+	if err != nil {
+		return err
+	}
+
+	if t.IsLinked(remote) {
+		go t.dial(ctx, remote, remoteAddr, 0, releaseDial, wire.TraceContext{})
+		return nil
+	}
+	if err := t.client.Bind(remote); err != nil {
+		releaseDial()
+		return err
+	}
 	go func() {
 		defer t.client.Unbind(remote)
-		t.dial(ctx, remote, remoteAddr)
+		t.dial(ctx, remote, remoteAddr, 0, releaseDial, wire.TraceContext{})
 	}()
-	return t.client.Send(ctx, remote, msg)
+	return nil
+}
+
+// A redial is a network connection that has been dialed to a linked remote
+// peer. Closing it with a request to redial makes the dialing loop dial the
+// remote peer again, instead of returning.
+type redial struct {
+	close     context.CancelFunc
+	requested bool
+}
+
+// redial closes the network connection that has been dialed to a linked
+// remote peer, and requests that it be dialed again. It returns false if there
+// is no such network connection.
+func (t *Transport) redial(remote id.Signatory) bool {
+	t.linksMu.Lock()
+	defer t.linksMu.Unlock()
+
+	r, ok := t.redials[remote]
+	if !ok || !t.links[remote] {
+		return false
+	}
+	r.requested = true
+	r.close()
+	return true
+}
+
+// redialRequested returns true if Reconnect has closed the network connection,
+// and requested that it be dialed again.
+func (t *Transport) redialRequested(r *redial) bool {
+	if r == nil {
+		return false
+	}
+
+	t.linksMu.RLock()
+	defer t.linksMu.RUnlock()
+
+	return r.requested
+}
+
+// AcceptStats returns a snapshot of the accept loop, which can be used to tell
+// whether the Transport is spending most of its time on the cryptography of
+// handshakes, or waiting on the network.
+func (t *Transport) AcceptStats() AcceptStats {
+	stats := t.accepts.snapshot()
+	if t.limiter != nil {
+		stats.Limit = t.limiter.Stats()
+	}
+	return stats
+}
+
+// ResourceStats returns a snapshot of the resources used by the Transport, and
+// how often their limits were exceeded (see Options.WithMaxConnGoroutines,
+// Options.WithMaxHandshakes, and Options.WithMaxPendingDials).
+func (t *Transport) ResourceStats() ResourceStats {
+	return t.limits.snapshot()
 }
 
 func (t *Transport) Receive(ctx context.Context, receiver func(id.Signatory, wire.Packet) error) {
 	t.client.Receive(ctx, receiver)
 }
 
-func (t *Transport) Link(remote id.Signatory) {
+// ReceiveBorrowed registers a receiver that is lent the buffers into which
+// messages are read, instead of copies of their data (see
+// channel.Client.ReceiveBorrowed).
+func (t *Transport) ReceiveBorrowed(ctx context.Context, receiver func(id.Signatory, *channel.BorrowedPacket) error) {
+	t.client.ReceiveBorrowed(ctx, receiver)
+}
+
+// SendOnStream is the same as Send, but the message is sent on a stream (see
+// channel.Client.SendOnStream).
+func (t *Transport) SendOnStream(ctx context.Context, remote id.Signatory, stream uint16, msg wire.Msg) error {
+	if msg.Version < wire.MsgVersion2 {
+		msg.Version = wire.MsgVersion2
+	}
+	msg.Stream = stream
+	return t.Send(ctx, remote, msg)
+}
+
+// ReceiveStream is the same as Receive, but only messages sent on the given
+// stream are passed to the receiver (see channel.Client.ReceiveStream).
+func (t *Transport) ReceiveStream(ctx context.Context, stream uint16, receiver func(id.Signatory, wire.Packet) error) {
+	t.client.ReceiveStream(ctx, stream, receiver)
+}
+
+// Respond registers a Responder, which can handle many messages from the same
+// remote peer concurrently, but sends responses in order (see
+// channel.Client.Respond).
+func (t *Transport) Respond(ctx context.Context, responder channel.Responder) {
+	t.client.Respond(ctx, responder)
+}
+
+// Call sends a Req to a remote peer, dialing it if necessary, and waits for its
+// Resp (see channel.Client.Call).
+func (t *Transport) Call(ctx context.Context, remote id.Signatory, req wire.Req) (wire.Resp, error) {
+	return t.client.CallWith(ctx, remote, req, t.Send)
+}
+
+// HandleCalls registers a CallHandler for the Reqs sent by remote peers (see
+// channel.Client.HandleCalls).
+func (t *Transport) HandleCalls(ctx context.Context, handler channel.CallHandler) {
+	t.client.HandleCalls(ctx, handler)
+}
+
+// Link the Transport to a remote peer, so that network connections with it are
+// kept alive until it is unlinked. An error is returned if the Client has been
+// shutdown.
+func (t *Transport) Link(remote id.Signatory) error {
 	t.linksMu.Lock()
 	defer t.linksMu.Unlock()
 
 	if t.links[remote] {
-		return
+		return nil
+	}
+	if err := t.client.Bind(remote); err != nil {
+		return err
 	}
-	t.client.Bind(remote)
 	t.links[remote] = true
+	return nil
 }
 
 func (t *Transport) Unlink(remote id.Signatory) {
@@ -220,40 +944,312 @@ func (t *Transport) IsConnected(remote id.Signatory) bool {
 	return t.conns[remote] > 0
 }
 
+// ScheduleMaintenance marks a maintenance window for the local peer, starting
+// now. Until the window ends, the Transport avoids proactive churn: remote
+// peers that cannot be dialed are not expired from the table. Remote peers
+// should be told about the window (see ExpectMaintenance), so that they do not
+// mistake the brief unavailability of the local peer for a failure.
+func (t *Transport) ScheduleMaintenance(window time.Duration) {
+	t.maintenanceMu.Lock()
+	defer t.maintenanceMu.Unlock()
+
+	t.maintenanceWindow = time.Now().Add(window)
+}
+
+// ExpectMaintenance marks a maintenance window for a remote peer, starting now.
+// Until the window ends, the remote peer is expected to be briefly
+// unavailable, so it is not expired from the table when it cannot be dialed.
+func (t *Transport) ExpectMaintenance(remote id.Signatory, window time.Duration) {
+	t.maintenanceMu.Lock()
+	defer t.maintenanceMu.Unlock()
+
+	t.maintenance[remote] = time.Now().Add(window)
+}
+
+// InMaintenance returns true if the local peer, or the remote peer, is in a
+// maintenance window.
+func (t *Transport) InMaintenance(remote id.Signatory) bool {
+	now := time.Now()
+
+	t.maintenanceMu.RLock()
+	end, ok := t.maintenance[remote]
+	inMaintenance := now.Before(t.maintenanceWindow) || (ok && now.Before(end))
+	t.maintenanceMu.RUnlock()
+
+	if ok && !now.Before(end) {
+		// Forget about maintenance windows that have ended.
+		t.maintenanceMu.Lock()
+		if end, ok := t.maintenance[remote]; ok && !now.Before(end) {
+			delete(t.maintenance, remote)
+		}
+		t.maintenanceMu.Unlock()
+	}
+	return inMaintenance
+}
+
+// CheckListener returns an error if the Transport cannot bind to its host and
+// port. The Transport holds this binding while it is running, so this check
+// should be done before running the Transport.
+func (t *Transport) CheckListener() error {
+	if t.opts.Listener != nil {
+		// The listener has already been bound by the caller.
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port))
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// CheckLoopback binds a temporary listener to a port on the host of the
+// Transport, dials it, and handshakes with itself over the resulting network
+// connection. It returns an error if any of these steps fail, or if either side
+// of the handshake does not identify the other side as the local peer. The
+// check is bounded by the client timeout.
+func (t *Transport) CheckLoopback(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, t.options().ClientTimeout)
+	defer cancel()
+
+	listener, port, err := tcp.ListenerWithAssignedPort(ctx, t.opts.Host)
+	if err != nil {
+		return fmt.Errorf("listening: %w", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- fmt.Errorf("accepting: %w", err)
+			return
+		}
+		defer conn.Close()
+		accepted <- t.checkHandshake(ctx, conn)
+	}()
+
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", fmt.Sprintf("%v:%v", t.opts.Host, port))
+	if err != nil {
+		return fmt.Errorf("dialing: %w", err)
+	}
+	defer conn.Close()
+	if err := t.checkHandshake(ctx, conn); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-accepted:
+		return err
+	}
+}
+
+func (t *Transport) checkHandshake(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("setting deadline: %w", err)
+		}
+	}
+	_, _, remote, err := t.h(conn, t.opts.Encoder, t.opts.Decoder)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	if remote != t.self {
+		return fmt.Errorf("handshake: expected %v, got %v", t.self, remote)
+	}
+	return nil
+}
+
 func (t *Transport) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-t.draining:
+			// Stop listening, but keep running until the context is done.
+			<-ctx.Done()
+			return
 		default:
-			t.run(ctx)
+			if err := t.run(ctx); errors.Is(err, net.ErrClosed) && t.opts.Listener != nil {
+				// The listener from the Options was closed by the caller,
+				// and cannot be listened on again.
+				return
+			}
 		}
 	}
 }
 
-func (t *Transport) run(ctx context.Context) {
+// Drain the Transport gracefully, for example before a rolling restart. The
+// Transport stops accepting new network connections, and sends a
+// wire.MsgTypeGoingAway notice to all remote peers that are currently
+// connected. It then waits for all outbound messages to be written, and closes
+// all network connections (see channel.Client.Shutdown). An error is returned
+// if the context is done before all outbound messages have been written. The
+// Transport cannot be used to send messages after it has been drained.
+func (t *Transport) Drain(ctx context.Context) error {
+	t.drainOnce.Do(func() { close(t.draining) })
+
+	t.connsMu.RLock()
+	remotes := make([]id.Signatory, 0, len(t.conns))
+	for remote := range t.conns {
+		remotes = append(remotes, remote)
+	}
+	t.connsMu.RUnlock()
+
+	msg := wire.Msg{
+		Version: wire.MsgVersion1,
+		Type:    wire.MsgTypeGoingAway,
+	}
+	for remote, err := range t.SendToMany(ctx, remotes, msg) {
+		t.opts.Logger.Debug("going away", zap.String("remote", remote.String()), zap.Error(err))
+	}
+	return t.client.Shutdown(ctx)
+}
+
+func (t *Transport) run(ctx context.Context) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			t.opts.Logger.DPanic("recover", zap.Error(fmt.Errorf("%v", r)))
 		}
 	}()
 
-	// Listen for incoming connection attempts.
-	t.opts.Logger.Info("listening", zap.String("host", t.opts.Host), zap.Uint16("port", t.opts.Port))
-	err := tcp.Listen(
-		ctx,
-		fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port),
+	// Rate limit incoming connection attempts from each IP address. The
+	// limit is looked up for each attempt, because it can be changed.
+	allow := policy.Allow(t.allowHandshake)
+
+	// Stop listening when the Transport begins draining. Network connections
+	// that have already been accepted are not affected.
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-listenCtx.Done():
+		case <-t.draining:
+			cancel()
+		}
+	}()
+
+	if t.tarpit != nil {
+		go t.tarpit.Run(listenCtx)
+	}
+
+	// Listen for incoming connection attempts, using the listener from the
+	// Options if there is one.
+	listen := func(handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+		listener := t.opts.Listener
+		if listener == nil {
+			if !t.opts.ProxyProtocol {
+				t.opts.Logger.Info("listening", zap.String("host", t.opts.Host), zap.Uint16("port", t.opts.Port))
+				return tcp.ListenWithLimit(listenCtx, fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port), t.limiter, handle, handleErr, allow)
+			}
+			var err error
+			if listener, err = new(net.ListenConfig).Listen(listenCtx, "tcp", fmt.Sprintf("%v:%v", t.opts.Host, t.opts.Port)); err != nil {
+				return err
+			}
+		}
+		if t.limiter != nil {
+			listener = t.limiter.Listener(listener)
+		}
+		if t.opts.ProxyProtocol {
+			// Headers are read after the limit, so that network
+			// connections are counted while their headers are read.
+			listener = tcp.ProxyProtocol(listener, t.opts.ServerTimeout)
+		}
+		t.opts.Logger.Info("listening", zap.String("network", listener.Addr().Network()), zap.String("addr", listener.Addr().String()))
+		return tcp.ListenWithListener(listenCtx, listener, handle, handleErr, allow)
+	}
+	err = listen(
 		func(conn net.Conn) {
 			addr := conn.RemoteAddr().String()
+			accepted := t.accepts.accept()
+			opts := t.options()
+			releaseConn, ok := t.acquireForInbound(ResourceConnGoroutines, addr)
+			if !ok {
+				return
+			}
+			defer releaseConn()
+			if t.tarpit != nil && t.tarpit.Suspect(conn.RemoteAddr()) {
+				t.accepts.reject(RejectTarpit)
+				if t.tarpit.Hold(ctx, conn) {
+					t.opts.Logger.Debug("tarpitted", zap.String("addr", addr))
+				}
+				return
+			}
+			if addrFilter, ok := opts.PeerFilter.(AddrFilter); ok && !addrFilter.AllowAddr(conn.RemoteAddr()) {
+				t.accepts.reject(RejectFiltered)
+				host, _, _ := net.SplitHostPort(addr)
+				t.agg.Debug("filtered/"+host, "filtered", zap.String("addr", addr))
+				return
+			}
+			// Closing an idle network connection only faults the reading half
+			// of its Channel, so the attachment must also be canceled.
+			ctx, cancelIdle := context.WithCancel(ctx)
+			defer cancelIdle()
+			conn = tcp.IdleTimeout(conn, opts.ServerIdleTimeout, func() {
+				t.opts.Logger.Debug("idle", zap.Duration("timeout", opts.ServerIdleTimeout), zap.String("addr", addr))
+				cancelIdle()
+			})
+			conn = t.impair(conn)
+			conn = t.serverThrottle.Throttle(conn)
+			conn, err := wrapTLS(conn, t.opts.ServerTLSConfig, tls.Server, opts.ServerTimeout)
+			if err != nil {
+				t.accepts.reject(RejectTLS)
+				if t.tarpit != nil {
+					t.tarpit.Fail(conn.RemoteAddr())
+				}
+				host, _, _ := net.SplitHostPort(addr)
+				t.agg.Error("tls/"+host, "tls handshake", zap.String("addr", addr), zap.Error(err))
+				return
+			}
+			releaseHandshake, ok := t.acquireForInbound(ResourceHandshakes, addr)
+			if !ok {
+				return
+			}
+			t.accepts.beginHandshake()
+			// The remote peer is not known until the handshake completes.
+			handshakeSpan := t.startSpan(channel.SpanHandshake, id.Signatory{}, wire.TraceContext{})
+			handshakeStart := time.Now()
 			enc, dec, remote, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
+			handshakeDuration := time.Since(handshakeStart)
+			handshakeSpan.End(err)
+			t.accepts.endHandshake(accepted, err)
+			releaseHandshake()
 			if err != nil {
 				var e wire.NegligibleError
-				if !errors.As(err, &e) {
-					t.opts.Logger.Error("handshake", zap.String("addr", addr), zap.Error(err))
+				if errors.As(err, &e) {
+					t.accepts.reject(RejectDuplicate)
+				} else {
+					t.accepts.reject(RejectHandshake)
+					if t.tarpit != nil {
+						t.tarpit.Fail(conn.RemoteAddr())
+					}
+					host, _, _ := net.SplitHostPort(addr)
+					t.agg.Error("handshake/"+host, "handshake", zap.String("addr", addr), zap.Error(err))
 				}
 				return
 			}
 
+			if opts.PeerFilter != nil && !opts.PeerFilter.AllowPeer(remote, conn.RemoteAddr()) {
+				// The handshake kept the network connection, so it must be
+				// forgotten, otherwise it would stop the remote peer from
+				// connecting once it is allowed.
+				t.oncePool.Drop(remote)
+				t.accepts.reject(RejectFiltered)
+				t.agg.Debug("filtered/"+remote.String(), "filtered", zap.String("remote", remote.String()), zap.String("addr", addr))
+				return
+			}
+
+			release, err := t.inbound.acquire(remote)
+			if err != nil {
+				t.accepts.reject(RejectSlots)
+				t.agg.Error("slots/"+remote.String(), "inbound slots", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+				return
+			}
+			defer release()
+			t.accepts.done()
+			t.establishSession(remote, conn, enc, true, handshakeDuration)
+
 			enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
 			dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
 
@@ -269,11 +1265,12 @@ func (t *Transport) run(ctx context.Context) {
 				// connection is replaced, or the connection faults.
 				t.connect(remote)
 				defer t.disconnect(remote)
+				defer t.opts.ConnObserver.OnConnClosed(remote, conn.RemoteAddr())
 				if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
 					// If ctx is canceled, this usually means the entire transport has been shutdown
 					// and we can safely ignore all errors with client.Attach.
 					if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-						t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+						t.agg.Error("attach/"+remote.String(), "incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 					}
 				}
 				return
@@ -282,20 +1279,24 @@ func (t *Transport) run(ctx context.Context) {
 			// Otherwise, this connection should be short-lived. A Channel still
 			// needs to be created (because one probably does not exist), but a
 			// bounded time should be used.
-			ctx, cancel := context.WithTimeout(ctx, t.opts.ServerTimeout)
+			ctx, cancel := context.WithTimeout(ctx, opts.ServerTimeout)
 			defer cancel()
 
-			t.opts.Logger.Debug("accepted", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
-			defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+			t.opts.Logger.Debug("accepted", zap.Bool("linked", false), zap.Duration("timeout", opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+			defer t.opts.Logger.Debug("accepted: drop", zap.Bool("linked", false), zap.Duration("timeout", opts.ServerTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
 
-			t.client.Bind(remote)
+			if err := t.client.Bind(remote); err != nil {
+				t.opts.Logger.Debug("accepted: bind", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+				return
+			}
 			defer t.client.Unbind(remote)
 
 			t.connect(remote)
 			defer t.disconnect(remote)
+			defer t.opts.ConnObserver.OnConnClosed(remote, conn.RemoteAddr())
 			if err := t.client.Attach(ctx, remote, conn, enc, dec); err != nil {
 				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
-					t.opts.Logger.Error("incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					t.agg.Error("attach/"+remote.String(), "incoming attachment", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 				}
 			}
 		},
@@ -304,55 +1305,184 @@ func (t *Transport) run(ctx context.Context) {
 				t.opts.Logger.Error("listen", zap.Error(err))
 			}
 		},
-		nil)
+		allow)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
 			t.opts.Logger.Error("listen", zap.Error(err))
 		}
 	}
+	return err
 }
 
-func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAddr wire.Address) {
+// dialAddrs returns the network addresses that can be dialed to reach a
+// remote peer. Only network addresses with one of the DialProtocols can be
+// dialed, because the Dialer does not know how to dial any other protocol.
+// When the remote peer advertises more than one network address, and the
+// network address is the first one in the table, all of its network addresses
+// that can be dialed are returned in order of the protocol preference.
+// Otherwise, only the network address is returned (if it can be dialed), so
+// that dialing an explicit network address does not dial other network
+// addresses from the table. All of the network addresses are dialed using the
+// network of the first one (see tcp.FallbackDialer), so network addresses with
+// a different network are skipped.
+func (t *Transport) dialAddrs(remote id.Signatory, remoteAddr wire.Address) []string {
+	addrs, ok := t.table.PeerAddresses(remote)
+	if !ok || len(addrs) < 2 || !addrs[0].Equal(&remoteAddr) {
+		addrs = []wire.Address{remoteAddr}
+	}
+	dialAddrs := make([]string, 0, len(addrs))
+	dialNetwork := ""
+	for _, addr := range wire.SortAddresses(addrs, t.opts.ProtocolPreference) {
+		if !t.canDial(addr.Protocol) {
+			continue
+		}
+		network, dialAddr, err := addr.Dialable()
+		if err != nil {
+			continue
+		}
+		if len(dialAddrs) == 0 {
+			dialNetwork = network
+		} else if network != dialNetwork {
+			continue
+		}
+		dialAddrs = append(dialAddrs, dialAddr)
+	}
+	return dialAddrs
+}
+
+// canDial returns true if the protocol is one of the DialProtocols.
+func (t *Transport) canDial(protocol wire.Protocol) bool {
+	for _, p := range t.opts.DialProtocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// dialWithin is the same as dial, but also stops retrying once the timeout
+// has passed (if it is positive).
+func (t *Transport) dialWithin(retryCtx context.Context, timeout time.Duration, remote id.Signatory, remoteAddr wire.Address, maxAttempts int, releaseDial func(), trace wire.TraceContext) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		retryCtx, cancel = context.WithTimeout(retryCtx, timeout)
+		defer cancel()
+	}
+	t.dial(retryCtx, remote, remoteAddr, maxAttempts, releaseDial, trace)
+}
+
+// dial a remote peer, retrying until the retry context is done, the remote peer
+// expires, or the maximum number of failed attempts has been made (if the
+// maximum is positive). The pending dial is released once a network connection
+// has completed the handshake, or dialing stops.
+func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAddr wire.Address, maxAttempts int, releaseDial func(), trace wire.TraceContext) {
+	defer releaseDial()
+
 	// It is tempting to skip dialing if there is already a connection. However,
 	// it is desirable to be able to re-dial in the case that the network
 	// address has changed. As such, we do not do any skip checks, and assume
 	// that dial is only called when the caller is absolutely sure that a dial
 	// should happen.
 
-	if remoteAddr.Protocol != wire.TCP {
-		t.opts.Logger.Debug("skipping non-tcp address", zap.String("addr", remoteAddr.String()))
+	dialAddrs := t.dialAddrs(remote, remoteAddr)
+	if len(dialAddrs) == 0 {
+		t.opts.Logger.Debug("skipping undialable address", zap.String("addr", remoteAddr.String()))
 		return
 	}
+	dialAddr := dialAddrs[0]
+
+	// The span ends once the first network connection completes the
+	// handshake, even though dialing continues if it faults.
+	span := t.startSpan(channel.SpanDial, remote, trace)
+	endSpan := new(sync.Once)
+	defer endSpan.Do(func() { span.End(errDialStopped) })
+
+	// Count attempts across all iterations of the loop, so that the backoff
+	// between attempts does not reset every time the dial context expires.
+	// Like the expiry, the count only increases on failures that suggest the
+	// remote peer is offline. The count is only used by the dialing goroutine.
+	attempts := 0
+	var backoff policy.Timeout
+	if t.opts.DialBackoff != nil {
+		backoff = func(int) time.Duration {
+			return t.opts.DialBackoff(attempts)
+		}
+	}
+
+	dialer := t.opts.Dialer
+	if dialer == nil && t.opts.DualStack {
+		dialer = tcp.DualStackDialer(tcp.DefaultDualStackDelay)
+	}
+	if len(dialAddrs) > 1 {
+		dialer = tcp.FallbackDialer(dialer, dialAddrs[1:], t.opts.AddressRaceDelay)
+	}
 
+	failures := 0
 	exit := make(chan struct{})
 	for {
-		dialCtx, cancel := context.WithTimeout(context.Background(), t.opts.ClientTimeout)
+		clientTimeout := t.options().ClientTimeout
+		dialCtx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		var linked *redial
 
 		t.opts.Logger.Debug("dialing", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()))
 
-		err := tcp.Dial(
+		err := tcp.DialUsing(
 			dialCtx,
-			remoteAddr.Value,
+			dialer,
+			dialAddr,
 			func(conn net.Conn) {
 				addr := conn.RemoteAddr().String()
+				releaseConn, err := t.limits.acquire(ResourceConnGoroutines)
+				if err != nil {
+					t.agg.Debug("limit/"+ResourceConnGoroutines, "resource limit", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					return
+				}
+				defer releaseConn()
+				conn = t.impair(conn)
+				conn = t.clientThrottle.Throttle(conn)
+				conn, err = wrapTLS(conn, t.opts.ClientTLSConfig, tls.Client, clientTimeout)
+				if err != nil {
+					t.agg.Error("tls/"+remote.String(), "tls handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					return
+				}
+				releaseHandshake, err := t.limits.acquire(ResourceHandshakes)
+				if err != nil {
+					t.agg.Debug("limit/"+ResourceHandshakes, "resource limit", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					return
+				}
+				handshakeSpan := t.startSpan(channel.SpanHandshake, remote, span.Context())
+				handshakeStart := time.Now()
 				enc, dec, r, err := t.once(conn, t.opts.Encoder, t.opts.Decoder)
+				handshakeDuration := time.Since(handshakeStart)
+				releaseHandshake()
 				if err != nil {
+					handshakeSpan.End(err)
 					var e wire.NegligibleError
 					if !errors.As(err, &e) {
-						t.opts.Logger.Error("handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+						t.agg.Error("handshake/"+remote.String(), "handshake", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 					}
 					return
 				}
 				if !r.Equal(&remote) {
+					handshakeSpan.End(fmt.Errorf("bad remote"))
 					t.opts.Logger.Error("handshake", zap.String("expected", remote.String()), zap.String("got", r.String()), zap.Error(fmt.Errorf("bad remote")))
 					return
 				}
+				handshakeSpan.End(nil)
+				endSpan.Do(func() { span.End(nil) })
+
+				releaseDial()
+				attempts = 0
 
 				enc = codec.LengthPrefixEncoder(codec.PlainEncoder, enc)
 				dec = codec.LengthPrefixDecoder(codec.PlainDecoder, dec)
 
+				t.opts.ConnObserver.OnDialSuccess(remote, conn.RemoteAddr())
+				t.establishSession(remote, conn, enc, false, handshakeDuration)
+
 				t.connect(remote)
 				defer t.disconnect(remote)
+				defer t.opts.ConnObserver.OnConnClosed(remote, conn.RemoteAddr())
 
 				if t.IsLinked(remote) {
 					t.opts.Logger.Debug("dialed", zap.Bool("linked", true), zap.String("remote", remote.String()), zap.String("addr", addr))
@@ -363,30 +1493,64 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 					// is unlinked (or the network connection faults). To do this,
 					// we override the context and re-use it. Otherwise, the
 					// previously defined context will be used, which will
-					// eventually timeout.
-					dialCtx = context.Background()
+					// eventually timeout. Reconnect can cancel the context to
+					// close the network connection and have it re-dialed.
+					var closeConn context.CancelFunc
+					dialCtx, closeConn = context.WithCancel(context.Background())
+					defer closeConn()
+
+					t.linksMu.Lock()
+					linked = &redial{close: closeConn}
+					t.redials[remote] = linked
+					t.linksMu.Unlock()
+					defer func() {
+						t.linksMu.Lock()
+						if t.redials[remote] == linked {
+							delete(t.redials, remote)
+						}
+						t.linksMu.Unlock()
+					}()
 				} else {
-					t.opts.Logger.Debug("dialed", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ClientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
-					defer t.opts.Logger.Debug("dialed: drop", zap.Bool("linked", false), zap.Duration("timeout", t.opts.ClientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+					t.opts.Logger.Debug("dialed", zap.Bool("linked", false), zap.Duration("timeout", clientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
+					defer t.opts.Logger.Debug("dialed: drop", zap.Bool("linked", false), zap.Duration("timeout", clientTimeout), zap.String("remote", remote.String()), zap.String("addr", addr))
 				}
 
 				if err := t.client.Attach(dialCtx, remote, conn, enc, dec); err != nil {
-					// Context deadline exceeds means we decide to drop the
-					// connection and the error could be ignored.
-					if !errors.Is(err, context.DeadlineExceeded) {
-						t.opts.Logger.Error("outgoing", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
+					// Context deadline exceeds, or cancellation by Reconnect,
+					// means we decide to drop the connection and the error
+					// could be ignored.
+					if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+						t.agg.Error("attach/"+remote.String(), "outgoing", zap.String("remote", remote.String()), zap.String("addr", addr), zap.Error(err))
 					}
 				}
 			},
 			func(err error) {
-				t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
-				t.table.AddExpiry(remote, t.opts.ExpiryDuration)
-				if t.table.HandleExpired(remote) {
+				t.agg.Debug("dial/"+remote.String(), "dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
+				t.opts.ConnObserver.OnDialFailure(remote, remoteAddr, err)
+				if t.InMaintenance(remote) || t.IsConnected(remote) {
+					// Failures during a maintenance window are expected, so
+					// they do not count towards expiry. Neither do failures
+					// while the remote peer is connected (for example, when
+					// it can dial us, but we cannot dial it), because the
+					// remote peer is known to be alive.
+					t.table.DeleteExpiry(remote)
+				} else {
+					attempts++
+					t.table.AddExpiry(remote, t.opts.ExpiryDuration)
+					if t.table.HandleExpired(remote) {
+						t.opts.ConnObserver.OnExpired(remote)
+						close(exit)
+						cancel()
+						return
+					}
+				}
+				if failures++; maxAttempts > 0 && failures >= maxAttempts {
 					close(exit)
 					cancel()
 				}
 			},
-			t.opts.DialTimeout)
+			t.opts.DialTimeout,
+			backoff)
 		if err != nil {
 			t.opts.Logger.Debug("dial", zap.String("remote", remote.String()), zap.String("addr", remoteAddr.String()), zap.Error(err))
 			select {
@@ -394,14 +1558,24 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 				break
 			case <-retryCtx.Done():
 			case <-dialCtx.Done():
-				if !t.IsConnected(remote) {
-					// Cancel current dial context if restarting loop
-					cancel()
-					continue
+				// Exiting cancels the dial context, so both cases can be
+				// ready at the same time, in which case exiting wins.
+				select {
+				case <-exit:
+				default:
+					if !t.IsConnected(remote) {
+						// Cancel current dial context if restarting loop
+						cancel()
+						continue
+					}
 				}
 			}
 		} else {
 			t.table.DeleteExpiry(remote)
+			if t.redialRequested(linked) {
+				cancel()
+				continue
+			}
 		}
 
 		// Cancel last dial context before exiting
@@ -410,7 +1584,43 @@ func (t *Transport) dial(retryCtx context.Context, remote id.Signatory, remoteAd
 	}
 }
 
+// impair a network connection, if impairments are enabled in this build.
+func (t *Transport) impair(conn net.Conn) net.Conn {
+	if !impairmentEnabled {
+		return conn
+	}
+	return tcp.Impair(conn, t.opts.SendImpairment, t.opts.ReceiveImpairment)
+}
+
+// wrapTLS wraps a network connection in TLS, if a TLS configuration is given.
+// The TLS handshake is completed (bounded by the timeout) before returning, so
+// that TLS failures are not mistaken for failures of the handshake.
+func wrapTLS(conn net.Conn, config *tls.Config, wrap func(net.Conn, *tls.Config) *tls.Conn, timeout time.Duration) (net.Conn, error) {
+	if config == nil {
+		return conn, nil
+	}
+	tlsConn := wrap(conn, config)
+	if err := tlsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return conn, fmt.Errorf("setting deadline: %w", err)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return conn, err
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		return conn, fmt.Errorf("clearing deadline: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// connect records a network connection to a remote peer. Any expiry of the
+// remote peer is forgotten, because a remote peer that has just connected is
+// known to be alive, and its table entry should not expire because of dial
+// failures from before it connected. For the same reason, announcements that
+// the remote peer was going away are forgotten once they are due.
 func (t *Transport) connect(remote id.Signatory) {
+	t.table.DeleteExpiry(remote)
+	t.ForgetGoingAway(remote)
+
 	t.connsMu.Lock()
 	defer t.connsMu.Unlock()
 
@@ -2,12 +2,24 @@ package transport_test
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/renproject/aw/channel"
-	"github.com/renproject/aw/dht"
 	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/tcp/tcputil"
 	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/transport/transporttest"
 	"github.com/renproject/aw/wire"
 	"github.com/renproject/id"
 
@@ -17,44 +29,872 @@ import (
 
 var _ = Describe("Transport", func() {
 	Describe("Dial", func() {
+		Context("when using the default backoff", func() {
+			It("should wait for about ten seconds between attempts, however many have failed", func() {
+				for _, attempt := range []int{10, 53, 54, 1000} {
+					backoff := transport.DefaultDialBackoff(attempt)
+					Expect(backoff).To(BeNumerically(">=", 8*time.Second))
+					Expect(backoff).To(BeNumerically("<=", 12*time.Second))
+				}
+				seen := map[time.Duration]bool{}
+				for i := 0; i < 10; i++ {
+					seen[transport.DefaultDialBackoff(1000)] = true
+				}
+				Expect(len(seen)).To(BeNumerically(">", 1))
+			})
+		})
+
 		Context("when failing to connect to peer", func() {
 			It("should create an expiry and delete peer after expiration", func() {
-				privKey := id.NewPrivKey()
-				self := privKey.Signatory()
-				h := handshake.Filter(func(id.Signatory) error { return nil }, handshake.ECIES(privKey))
-				client := channel.NewClient(
-					channel.DefaultOptions(),
-					self)
-				table := dht.NewInMemTable(self)
-				transport := transport.New(
-					transport.DefaultOptions().
+				t := transporttest.NewTransport(
+					transporttest.Options().
 						WithClientTimeout(10*time.Second).
 						WithOncePoolOptions(handshake.DefaultOncePoolOptions().WithMinimumExpiryAge(10*time.Second)).
-						WithExpiry(5*time.Second).
-						WithPort(uint16(3333)),
-					self,
-					client,
-					h,
-					table,
+						WithDialBackoff(policy.ConstantTimeout(100*time.Millisecond)).
+						WithExpiry(5*time.Second),
+					transporttest.ClientOptions(),
 				)
 
-				privKey2 := id.NewPrivKey()
-				table.AddPeer(privKey2.Signatory(),
-					wire.NewUnsignedAddress(wire.TCP, ":3334", uint64(time.Now().UnixNano())))
-				_, ok := table.PeerAddress(privKey2.Signatory())
+				remote := id.NewPrivKey().Signatory()
+				t.Table().AddPeer(remote, transporttest.UnusedAddress())
+				_, ok := t.Table().PeerAddress(remote)
 				Expect(ok).To(BeTrue())
 
 				ctx, cancel := context.WithCancel(context.Background())
 				go func() {
-					transport.Send(ctx, privKey2.Signatory(), wire.Msg{})
+					t.Send(ctx, remote, wire.Msg{})
 				}()
 
 				time.Sleep(7 * time.Second)
 				cancel()
 
-				_, ok = table.PeerAddress(privKey2.Signatory())
+				_, ok = t.Table().PeerAddress(remote)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when failing to connect to a peer during its maintenance window", func() {
+			It("should not expire the peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t := transporttest.NewTransport(
+					transporttest.Options().
+						WithDialBackoff(policy.ConstantTimeout(100*time.Millisecond)).
+						WithExpiry(time.Second),
+					transporttest.ClientOptions(),
+				)
+
+				// Nothing is listening on the address of the remote peer.
+				remote := id.NewPrivKey().Signatory()
+				t.Table().AddPeer(remote, transporttest.UnusedAddress())
+				t.ExpectMaintenance(remote, time.Minute)
+				Expect(t.InMaintenance(remote)).To(BeTrue())
+				go t.Send(ctx, remote, wire.Msg{})
+
+				Consistently(func() bool {
+					_, ok := t.Table().PeerAddress(remote)
+					return ok
+				}, 3*time.Second).Should(BeTrue())
+			})
+		})
+		Context("when a peer that could not be dialed connects", func() {
+			It("should not expire the peer because of earlier dial failures", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				dialFailed := make(chan struct{}, 1)
+				observer := transport.CallbackConnObserver{
+					OnDialFailureCallback: func(id.Signatory, wire.Address, error) {
+						select {
+						case dialFailed <- struct{}{}:
+						default:
+						}
+					},
+				}
+
+				t1 := transporttest.NewTransport(
+					transporttest.Options().
+						WithDialBackoff(policy.ConstantTimeout(100*time.Millisecond)).
+						WithExpiry(time.Second).
+						WithConnObserver(observer),
+					transporttest.ClientOptions(),
+				)
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				go t1.Run(ctx)
+				go t2.Run(ctx)
+
+				// Nothing is listening on the address of the remote peer, so
+				// dialing it fails and its expiry begins.
+				t1.Table().AddPeer(t2.Self(), transporttest.UnusedAddress())
+				opts := channel.DefaultSendOptions().WithMaxDialAttempts(1).WithTimeout(5 * time.Second)
+				Expect(t1.SendWithOptions(ctx, t2.Self(), wire.Msg{}, opts)).To(Succeed())
+				Eventually(dialFailed, 5*time.Second).Should(Receive())
+
+				// The remote peer connects, which proves that it is alive.
+				t2.Table().AddPeer(t1.Self(), transporttest.Address(t1))
+				t2.Link(t1.Self())
+				defer t2.Unlink(t1.Self())
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{})).To(Succeed())
+				Eventually(func() bool { return t1.IsConnected(t2.Self()) }, 5*time.Second).Should(BeTrue())
+
+				time.Sleep(2 * time.Second)
+				Expect(t1.Table().HandleExpired(t2.Self())).To(BeFalse())
+				_, ok := t1.Table().PeerAddress(t2.Self())
+				Expect(ok).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("Reconnect", func() {
+		Context("when connected to a remote peer", func() {
+			It("should re-dial the remote peer and continue to deliver messages", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				dialed := make(chan id.Signatory, 4)
+				closed := make(chan id.Signatory, 4)
+				observer := transport.CallbackConnObserver{
+					OnDialSuccessCallback: func(remote id.Signatory, addr net.Addr) { dialed <- remote },
+					OnConnClosedCallback:  func(remote id.Signatory, addr net.Addr) { closed <- remote },
+				}
+
+				t1 := transporttest.NewTransport(transporttest.Options().WithConnObserver(observer), transporttest.ClientOptions())
+				// The remote peer must accept the new network connection,
+				// even though it has recently accepted another one, which the
+				// test Options allow.
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 2)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				t1.Link(t2.Self())
+				defer t1.Unlink(t2.Self())
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("before")})).To(Succeed())
+				Eventually(dialed, 5*time.Second).Should(Receive(Equal(t2.Self())))
+				Eventually(received, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("before")})))
+
+				Expect(t1.Reconnect(ctx, t2.Self())).To(Succeed())
+				Eventually(closed, 5*time.Second).Should(Receive(Equal(t2.Self())))
+				Eventually(dialed, 5*time.Second).Should(Receive(Equal(t2.Self())))
+
+				// The linked network connection is re-dialed once, by the
+				// same dialing loop, instead of being dialed twice.
+				Consistently(dialed, 500*time.Millisecond).ShouldNot(Receive())
+				Expect(closed).ToNot(Receive())
+				Expect(t1.IsConnected(t2.Self())).To(BeTrue())
+
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("after")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("after")})))
+			})
+		})
+
+		Context("when the remote peer is unknown", func() {
+			It("should return an error", func() {
+				t := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				Expect(t.Reconnect(context.Background(), id.NewPrivKey().Signatory())).ToNot(Succeed())
+			})
+		})
+	})
+
+	Describe("SendToMany", func() {
+		Context("when sending to known and unknown remote peers", func() {
+			It("should send to the known remote peers and return errors for the others", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				newTransport := func() *transport.Transport {
+					return transporttest.NewTransport(transporttest.Options().WithMaxConcurrentSends(1), transporttest.ClientOptions())
+				}
+				t1 := newTransport()
+				t2 := newTransport()
+				t3 := newTransport()
+
+				received := make(chan id.Signatory, 2)
+				for _, t := range []*transport.Transport{t2, t3} {
+					self := t.Self()
+					go t.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+						received <- self
+						return nil
+					})
+					go t.Run(ctx)
+				}
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				t1.Table().AddPeer(t3.Self(), transporttest.Address(t3))
+				unknown := id.NewPrivKey().Signatory()
+
+				errs := t1.SendToMany(ctx, []id.Signatory{t2.Self(), unknown, t3.Self()}, wire.Msg{Data: []byte("hello")})
+				Expect(errs).To(HaveLen(1))
+				Expect(errs).To(HaveKey(unknown))
+
+				Eventually(received, 5*time.Second).Should(Receive())
+				Eventually(received, 5*time.Second).Should(Receive())
+			})
+		})
+	})
+
+	Describe("TLS", func() {
+		Context("when both peers use TLS", func() {
+			It("should deliver messages", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				cert := selfSignedCert()
+				serverConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+				clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+				t1 := transporttest.NewTransport(transporttest.Options().WithClientTLSConfig(clientConfig), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options().WithServerTLSConfig(serverConfig), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("hello")})))
+			})
+		})
+	})
+	Describe("AcceptStats", func() {
+		Context("when accepting network connections", func() {
+			It("should count handshakes and rejects", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+
+				stats := t2.AcceptStats()
+				Expect(stats.Backlog).To(Equal(0))
+				Expect(stats.Handshaking).To(Equal(0))
+				Expect(stats.HandshakeLatency.Count).To(Equal(uint64(1)))
+
+				// A network connection that does not complete the handshake.
+				conn, err := net.Dial("tcp", transporttest.Address(t2).Value)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = conn.Write([]byte("not a handshake"))
+				Expect(err).ToNot(HaveOccurred())
+				conn.Close()
+
+				Eventually(func() uint64 { return t2.AcceptStats().Rejects[transport.RejectHandshake] }, 5*time.Second).Should(Equal(uint64(1)))
+				stats = t2.AcceptStats()
+				Expect(stats.Backlog).To(Equal(0))
+				Expect(stats.HandshakeLatency.Count).To(Equal(uint64(1)))
+			})
+		})
+	})
+	Describe("Handshake rate limit", func() {
+		Context("when an IP address connects too quickly", func() {
+			It("should close its network connections before the handshake", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t := transporttest.NewTransport(transporttest.Options().WithHandshakeRateLimit(1.0/60, 1), transporttest.ClientOptions())
+				go t.Run(ctx)
+
+				Eventually(func() error {
+					conn, err := net.Dial("tcp", transporttest.Address(t).Value)
+					if err == nil {
+						conn.Close()
+					}
+					return err
+				}, 5*time.Second).Should(Succeed())
+
+				conn, err := net.Dial("tcp", transporttest.Address(t).Value)
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+				Eventually(func() uint64 { return t.AcceptStats().Rejects[transport.RejectRateLimit] }, 5*time.Second).Should(Equal(uint64(1)))
+
+				// The network connection is closed by the Transport.
+				Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+				_, err = conn.Read(make([]byte, 1))
+				Expect(err).To(HaveOccurred())
+				Eventually(func() int { return t.AcceptStats().Backlog }).Should(Equal(0))
+			})
+		})
+	})
+	Describe("Listener", func() {
+		Context("when a listener is provided", func() {
+			It("should accept network connections from it, and close it when done", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				listener, err := net.Listen("tcp", "localhost:0")
+				Expect(err).ToNot(HaveOccurred())
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options().WithListener(listener), transporttest.ClientOptions())
+				Expect(t2.CheckListener()).To(Succeed())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				runCtx, runCancel := context.WithCancel(ctx)
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					t2.Run(runCtx)
+				}()
+
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, listener.Addr().String(), uint64(time.Now().UnixNano())))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("hello")})))
+
+				runCancel()
+				Eventually(done, 5*time.Second).Should(BeClosed())
+				_, err = listener.Accept()
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("should stop running when the listener is closed by the caller", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				listener, err := net.Listen("tcp", "localhost:0")
+				Expect(err).ToNot(HaveOccurred())
+				t := transporttest.NewTransport(transporttest.Options().WithListener(listener), transporttest.ClientOptions())
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					t.Run(ctx)
+				}()
+
+				Expect(listener.Close()).To(Succeed())
+				Eventually(done, 5*time.Second).Should(BeClosed())
+			})
+		})
+	})
+	Describe("Encryption", func() {
+		Context("when sending messages in both directions", func() {
+			It("should not write their plaintext to the network connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				request := []byte("plaintext-marker-3f6c1a9e-request")
+				response := []byte("plaintext-marker-8b2d47f0-response")
+				detector := tcputil.NewLeakDetector(request, response)
+				listener, err := net.Listen("tcp", "localhost:0")
+				Expect(err).ToNot(HaveOccurred())
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options().WithListener(detector.Listener(listener)), transporttest.ClientOptions())
+				received1 := make(chan wire.Msg, 1)
+				go t1.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received1 <- packet.Msg
+					return nil
+				})
+				received2 := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received2 <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+				t2.Link(t1.Self())
+				defer t2.Unlink(t1.Self())
+
+				// The response is written to the network connection that was
+				// accepted by t2, so it passes through the LeakDetector.
+				t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.TCP, listener.Addr().String(), uint64(time.Now().UnixNano())))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: request})).To(Succeed())
+				Eventually(received2, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: request})))
+				// t1 does not run, but the address is not dialed while t2 is
+				// connected to t1.
+				t2.Table().AddPeer(t1.Self(), transporttest.UnusedAddress())
+				Expect(t2.IsConnected(t1.Self())).To(BeTrue())
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: response})).To(Succeed())
+				Eventually(received1, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: response})))
+
+				Expect(detector.Written()).To(BeNumerically(">", len(response)))
+				Expect(detector.Err()).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("when plaintext is written to the network connection", func() {
+			It("should be detected, even if it is split across writes", func() {
+				local, remote := net.Pipe()
+				defer local.Close()
+				defer remote.Close()
+				go func() {
+					buf := make([]byte, 64)
+					for {
+						if _, err := remote.Read(buf); err != nil {
+							return
+						}
+					}
+				}()
+
+				detector := tcputil.NewLeakDetector([]byte("plaintext-marker"))
+				conn := detector.Conn(local)
+				_, err := conn.Write([]byte("some plaintext-"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(detector.Err()).ToNot(HaveOccurred())
+				_, err = conn.Write([]byte("marker"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(detector.Err()).To(HaveOccurred())
+			})
+		})
+	})
+	Describe("Resource limits", func() {
+		Context("when too many dials are pending", func() {
+			It("should fail to dial with a LimitError until a dial stops", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options().WithMaxPendingDials(1), transporttest.ClientOptions())
+
+				// Nothing listens on the address, so dials stay pending.
+				remote1 := id.NewPrivKey().Signatory()
+				remote2 := id.NewPrivKey().Signatory()
+				addr := transporttest.UnusedAddress()
+				t1.Table().AddPeer(remote1, addr)
+				t1.Table().AddPeer(remote2, addr)
+
+				dialCtx, dialCancel := context.WithCancel(ctx)
+				Expect(t1.Reconnect(dialCtx, remote1)).To(Succeed())
+				var limitErr transport.LimitError
+				Expect(errors.As(t1.Reconnect(ctx, remote2), &limitErr)).To(BeTrue())
+				Expect(limitErr.Resource).To(Equal(transport.ResourcePendingDials))
+				Expect(limitErr.Limit).To(Equal(1))
+				Expect(errors.As(t1.Send(ctx, remote2, wire.Msg{Data: []byte("hello")}), &limitErr)).To(BeTrue())
+
+				stats := t1.ResourceStats()
+				Expect(stats.InUse[transport.ResourcePendingDials]).To(Equal(1))
+				Expect(stats.Exceeded[transport.ResourcePendingDials]).To(Equal(uint64(2)))
+
+				dialCancel()
+				Eventually(func() int { return t1.ResourceStats().InUse[transport.ResourcePendingDials] }, 5*time.Second).Should(Equal(0))
+				Expect(t1.Reconnect(ctx, remote2)).To(Succeed())
+			})
+		})
+	})
+	Describe("SendToConnected", func() {
+		Context("when a remote peer that cannot be dialed has connected", func() {
+			It("should send to it using the accepted network connection", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				received1 := make(chan wire.Msg, 1)
+				go t1.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received1 <- packet.Msg
+					return nil
+				})
+				received2 := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received2 <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+				t2.Link(t1.Self())
+				defer t2.Unlink(t1.Self())
+
+				Expect(t2.SendToConnected(ctx, t1.Self(), wire.Msg{Data: []byte("hello")})).To(MatchError(transport.ErrNotConnected))
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received2, 5*time.Second).Should(Receive())
+				Expect(t2.Connected()).To(Equal([]id.Signatory{t1.Self()}))
+
+				// t1 is not in the table of t2, so it cannot be dialed.
+				Expect(t2.Send(ctx, t1.Self(), wire.Msg{Data: []byte("reply")})).ToNot(Succeed())
+				Expect(t2.SendToConnected(ctx, t1.Self(), wire.Msg{Data: []byte("reply")})).To(Succeed())
+				Eventually(received1, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("reply")})))
+				Expect(t2.BroadcastToConnected(ctx, wire.Msg{Data: []byte("broadcast")})).To(BeEmpty())
+				Eventually(received1, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("broadcast")})))
+			})
+		})
+	})
+	Describe("Server idle timeout", func() {
+		Context("when an accepted network connection goes quiet", func() {
+			It("should close it, even if the remote peer is linked", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options().WithServerIdleTimeout(500*time.Millisecond), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+				t2.Link(t1.Self())
+				defer t2.Unlink(t1.Self())
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive())
+				Expect(t2.IsConnected(t1.Self())).To(BeTrue())
+
+				Eventually(func() bool { return t2.IsConnected(t1.Self()) }, 5*time.Second).Should(BeFalse())
+			})
+		})
+	})
+	Describe("Sessions", func() {
+		Context("when a session is established", func() {
+			It("should notify the observers on both sides", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				sessions1 := make(chan transport.SessionInfo, 1)
+				sessions2 := make(chan transport.SessionInfo, 1)
+				t1 := transporttest.NewTransport(
+					transporttest.Options().
+						WithConnObserver(transport.CallbackConnObserver{
+							OnSessionEstablishedCallback: func(info transport.SessionInfo) { sessions1 <- info },
+						}),
+					transporttest.ClientOptions(),
+				)
+				t2 := transporttest.NewTransport(
+					transporttest.Options().
+						WithConnObserver(transport.CallbackConnObserver{
+							OnSessionEstablishedCallback: func(info transport.SessionInfo) { sessions2 <- info },
+						}),
+					transporttest.ClientOptions().WithWireVersionSelector(channel.CanaryWireVersion(1)),
+				)
+				go t2.Run(ctx)
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+
+				var info transport.SessionInfo
+				Eventually(sessions1, 5*time.Second).Should(Receive(&info))
+				Expect(info.Remote).To(Equal(t2.Self()))
+				Expect(info.Inbound).To(BeFalse())
+				Expect(info.Transport).To(Equal("tcp"))
+				Expect(info.WireVersion).To(Equal(uint16(0)))
+
+				Eventually(sessions2, 5*time.Second).Should(Receive(&info))
+				Expect(info.Remote).To(Equal(t1.Self()))
+				Expect(info.Inbound).To(BeTrue())
+				Expect(info.Transport).To(Equal("tcp"))
+				Expect(info.WireVersion).To(Equal(wire.MsgVersion2))
+			})
+		})
+	})
+
+	Describe("Tracing", func() {
+		Context("when a message is sent to a remote peer that is selected for version 3", func() {
+			It("should continue the trace on the remote peer", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				tracer1 := newRecordingTracer()
+				t1 := transporttest.NewTransport(
+					transporttest.Options(),
+					transporttest.ClientOptions().
+						WithTracer(tracer1).
+						WithWireVersionSelector(func(id.Signatory) uint16 { return wire.MsgVersion3 }),
+				)
+				tracer2 := newRecordingTracer()
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions().WithTracer(tracer2))
+				received := make(chan wire.Msg, 1)
+				t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				parent, err := wire.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+				Expect(err).ToNot(HaveOccurred())
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello"), Trace: parent})).To(Succeed())
+
+				var msg wire.Msg
+				Eventually(received, 5*time.Second).Should(Receive(&msg))
+				Expect(msg.Trace.TraceID).To(Equal(parent.TraceID))
+				Expect(msg.Trace.SpanID).ToNot(Equal(parent.SpanID))
+
+				Eventually(tracer1.Ended, 5*time.Second).Should(ConsistOf(channel.SpanDial, channel.SpanHandshake, channel.SpanWrite))
+				Eventually(tracer2.Ended, 5*time.Second).Should(ConsistOf(channel.SpanHandshake, channel.SpanReceive))
+			})
+		})
+	})
+
+	Describe("UpdateOptions", func() {
+		Context("when the PeerFilter is changed", func() {
+			It("should apply to new network connections without restarting", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				t2 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				t2.UpdateOptions(func(opts transport.Options) transport.Options {
+					return opts.WithPeerFilter(transport.NewDenylist(t1.Self()))
+				})
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() uint64 { return t2.AcceptStats().Rejects[transport.RejectFiltered] }, 5*time.Second).Should(BeNumerically(">=", 1))
+				Consistently(received).ShouldNot(Receive())
+
+				t2.UpdateOptions(func(opts transport.Options) transport.Options {
+					return opts.WithPeerFilter(nil)
+				})
+				Eventually(func() bool {
+					Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+					select {
+					case msg := <-received:
+						return Expect(msg).To(Equal(wire.Msg{Data: []byte("hello")}))
+					case <-time.After(500 * time.Millisecond):
+						return false
+					}
+				}, 10*time.Second).Should(BeTrue())
+			})
+		})
+	})
+
+	Describe("PeerFilter", func() {
+		Context("when a remote peer is denied", func() {
+			It("should close its network connections until it is allowed", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				t1 := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				denylist := transport.NewDenylist(t1.Self())
+				t2 := transporttest.NewTransport(transporttest.Options().WithPeerFilter(denylist), transporttest.ClientOptions())
+				received := make(chan wire.Msg, 1)
+				go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- packet.Msg
+					return nil
+				})
+				go t2.Run(ctx)
+
+				t1.Table().AddPeer(t2.Self(), transporttest.Address(t2))
+				Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+				Eventually(func() uint64 { return t2.AcceptStats().Rejects[transport.RejectFiltered] }, 5*time.Second).Should(BeNumerically(">=", 1))
+				Consistently(received).ShouldNot(Receive())
+
+				// The remote peer is allowed once it is removed from the
+				// denylist, but the network connection that was closed might
+				// not have been noticed yet, so sending is retried.
+				denylist.Remove(t1.Self())
+				Eventually(func() bool {
+					Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+					select {
+					case msg := <-received:
+						return Expect(msg).To(Equal(wire.Msg{Data: []byte("hello")}))
+					case <-time.After(500 * time.Millisecond):
+						return false
+					}
+				}, 10*time.Second).Should(BeTrue())
+			})
+		})
+
+		Context("when using allowlists and denylists", func() {
+			It("should only allow the expected remote peers", func() {
+				known := id.NewPrivKey().Signatory()
+				unknown := id.NewPrivKey().Signatory()
+
+				allowlist := transport.NewAllowlist(known)
+				Expect(allowlist.AllowPeer(known, nil)).To(BeTrue())
+				Expect(allowlist.AllowPeer(unknown, nil)).To(BeFalse())
+				allowlist.Add(unknown)
+				Expect(allowlist.AllowPeer(unknown, nil)).To(BeTrue())
+
+				denylist := transport.NewDenylist(known)
+				Expect(denylist.AllowPeer(known, nil)).To(BeFalse())
+				Expect(denylist.AllowPeer(unknown, nil)).To(BeTrue())
+				denylist.Remove(known)
+				Expect(denylist.AllowPeer(known, nil)).To(BeTrue())
+			})
+		})
+	})
+	Describe("Inbound slots", func() {
+		Context("when all unreserved slots are in use", func() {
+			It("should only accept allowlisted remote peers", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				allowed := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+				unknown := transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+
+				// There is only one slot, and it is reserved.
+				server := transporttest.NewTransport(
+					transporttest.Options().
+						WithMaxInboundConns(1).
+						WithReservedInboundConns(1, []id.Signatory{allowed.Self()}),
+					transporttest.ClientOptions(),
+				)
+				received := make(chan id.Signatory, 2)
+				go server.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+					received <- from
+					return nil
+				})
+				go server.Run(ctx)
+
+				serverAddr := transporttest.Address(server)
+				unknown.Table().AddPeer(server.Self(), serverAddr)
+				allowed.Table().AddPeer(server.Self(), serverAddr)
+
+				Expect(unknown.Send(ctx, server.Self(), wire.Msg{})).To(Succeed())
+				Consistently(received, time.Second).ShouldNot(Receive())
+
+				Expect(allowed.Send(ctx, server.Self(), wire.Msg{})).To(Succeed())
+				Eventually(received, 5*time.Second).Should(Receive(Equal(allowed.Self())))
+			})
+		})
+	})
+	Describe("SendWithOptions", func() {
+		Context("when the maximum number of dial attempts is set", func() {
+			It("should stop dialing after the maximum number of failures", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				failures := make(chan error, 10)
+				observer := transport.CallbackConnObserver{
+					OnDialFailureCallback: func(remote id.Signatory, addr wire.Address, err error) {
+						failures <- err
+					},
+				}
+				t := transporttest.NewTransport(transporttest.Options().WithConnObserver(observer), transporttest.ClientOptions())
+
+				// Nothing is listening on the address of the remote peer.
+				remote := id.NewPrivKey().Signatory()
+				t.Table().AddPeer(remote, transporttest.UnusedAddress())
+				opts := channel.DefaultSendOptions().WithMaxDialAttempts(2)
+				go t.SendWithOptions(ctx, remote, wire.Msg{}, opts)
+
+				Eventually(failures, 5*time.Second).Should(HaveLen(2))
+				Consistently(failures, 2*time.Second).Should(HaveLen(2))
+			})
+		})
+	})
+	Describe("Going away", func() {
+		newTransport := func() *transport.Transport {
+			return transporttest.NewTransport(transporttest.Options(), transporttest.ClientOptions())
+		}
+
+		Context("when a remote peer is seen after it was going away", func() {
+			It("should forget the announcement", func() {
+				t := newTransport()
+				remote := id.NewPrivKey().Signatory()
+
+				// Remote peers that are seen before they go away are still
+				// going away.
+				t.ExpectGoingAway(remote, transport.GoingAway{At: time.Now().Add(time.Minute)})
+				t.ForgetGoingAway(remote)
+				_, ok := t.IsGoingAway(remote)
+				Expect(ok).To(BeTrue())
+
+				t.ExpectGoingAway(remote, transport.GoingAway{At: time.Now().Add(-time.Second)})
+				_, ok = t.IsGoingAway(remote)
+				Expect(ok).To(BeTrue())
+				t.ForgetGoingAway(remote)
+				_, ok = t.IsGoingAway(remote)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when a remote peer is not seen long after it was going away", func() {
+			It("should expire the announcement", func() {
+				t := newTransport()
+				remote := id.NewPrivKey().Signatory()
+
+				t.ExpectGoingAway(remote, transport.GoingAway{At: time.Now().Add(-time.Hour)})
+				_, ok := t.IsGoingAway(remote)
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when many remote peers are going away", func() {
+			It("should forget the announcements that are due the soonest", func() {
+				t := newTransport()
+				first := id.NewPrivKey().Signatory()
+				now := time.Now()
+
+				t.ExpectGoingAway(first, transport.GoingAway{At: now})
+				for i := 0; i < 4096; i++ {
+					t.ExpectGoingAway(id.NewPrivKey().Signatory(), transport.GoingAway{At: now.Add(time.Duration(i+1) * time.Second)})
+				}
+				_, ok := t.IsGoingAway(first)
 				Expect(ok).To(BeFalse())
 			})
 		})
 	})
 })
+
+// recordingTracer records the names of the spans that have ended. Spans share
+// the trace of their parent, and start a new trace if there is no parent.
+type recordingTracer struct {
+	mu    *sync.Mutex
+	ended []string
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{mu: new(sync.Mutex)}
+}
+
+func (tracer *recordingTracer) StartSpan(name string, remote id.Signatory, parent wire.TraceContext) channel.Span {
+	trace := parent
+	if !trace.IsValid() {
+		rand.Read(trace.TraceID[:])
+	}
+	rand.Read(trace.SpanID[:])
+	return &recordingSpan{tracer: tracer, name: name, trace: trace}
+}
+
+func (tracer *recordingTracer) Ended() []string {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	return append([]string(nil), tracer.ended...)
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+	trace  wire.TraceContext
+}
+
+func (span *recordingSpan) Context() wire.TraceContext {
+	return span.trace
+}
+
+func (span *recordingSpan) End(err error) {
+	span.tracer.mu.Lock()
+	defer span.tracer.mu.Unlock()
+
+	span.tracer.ended = append(span.tracer.ended, span.name)
+}
+
+func selfSignedCert() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,113 @@
+// Package transporttest provides helpers for testing code that sends messages
+// between Transports.
+package transporttest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+)
+
+// Host on which the Transports listen.
+const Host = "127.0.0.1"
+
+// New returns n Transports, and runs them until the context is done. Every
+// Transport listens on a port that is assigned by the OS, and its listener is
+// bound before New returns, so the Transports can be dialed straight away,
+// without waiting for them to start running. The Transports do not know about
+// each other until they are connected (see Connect). It panics if a listener
+// cannot be bound.
+func New(ctx context.Context, n int) []*transport.Transport {
+	transports := make([]*transport.Transport, n)
+	for i := range transports {
+		transports[i] = NewTransport(Options(), ClientOptions())
+		go transports[i].Run(ctx)
+	}
+	return transports
+}
+
+// Options returns the Options used by New. They do not log, they time out
+// quickly, and they accept a network connection from a remote peer even if it
+// has recently connected.
+func Options() transport.Options {
+	return transport.DefaultOptions().
+		WithLogger(zap.NewNop()).
+		WithClientTimeout(time.Second).
+		WithOncePoolOptions(handshake.DefaultOncePoolOptions().WithMinimumExpiryAge(0))
+}
+
+// ClientOptions returns the channel Options used by New. They do not log.
+func ClientOptions() channel.Options {
+	return channel.DefaultOptions().WithLogger(zap.NewNop())
+}
+
+// NewTransport returns a Transport with a new identity, that uses the Options
+// and the channel Options, and that is not running. If the Options do not have
+// a listener, one is bound on a port that is assigned by the OS. The host and
+// port of the Transport are those of the listener. It panics if a listener
+// cannot be bound.
+func NewTransport(opts transport.Options, clientOpts channel.Options) *transport.Transport {
+	if opts.Listener == nil {
+		listener, err := net.Listen("tcp", fmt.Sprintf("%v:0", Host))
+		if err != nil {
+			panic(err)
+		}
+		opts = opts.WithListener(listener)
+	}
+	if addr, ok := opts.Listener.Addr().(*net.TCPAddr); ok {
+		opts = opts.WithHost(addr.IP.String()).WithPort(uint16(addr.Port))
+	}
+	privKey := id.NewPrivKey()
+	return transport.New(
+		opts,
+		privKey.Signatory(),
+		channel.NewClient(clientOpts, privKey.Signatory()),
+		handshake.ECIES(privKey),
+		dht.NewInMemTable(privKey.Signatory()),
+	)
+}
+
+// Connect two Transports, by adding each of them to the table of the other.
+func Connect(a, b *transport.Transport) {
+	a.Table().AddPeer(b.Self(), Address(b))
+	b.Table().AddPeer(a.Self(), Address(a))
+}
+
+// ConnectAll connects every pair of Transports.
+func ConnectAll(transports []*transport.Transport) {
+	for i := range transports {
+		for j := i + 1; j < len(transports); j++ {
+			Connect(transports[i], transports[j])
+		}
+	}
+}
+
+// Address returns a new unsigned network address of a Transport, which
+// supersedes its older network addresses.
+func Address(t *transport.Transport) wire.Address {
+	return wire.NewUnsignedAddress(wire.TCP, fmt.Sprintf("%v:%v", t.Host(), t.Port()), uint64(time.Now().UnixNano()))
+}
+
+// UnusedAddress returns a new unsigned network address on which nothing
+// listens. Dialing it fails straight away. It panics if the address cannot be
+// found.
+func UnusedAddress() wire.Address {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%v:0", Host))
+	if err != nil {
+		panic(err)
+	}
+	value := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		panic(err)
+	}
+	return wire.NewUnsignedAddress(wire.TCP, value, uint64(time.Now().UnixNano()))
+}
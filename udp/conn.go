@@ -0,0 +1,486 @@
+package udp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReset is returned when the remote peer does not know about the
+	// network connection (for example, because it restarted).
+	ErrReset = errors.New("connection reset")
+	// ErrRetransmitLimit is returned when a segment has been retransmitted too
+	// many times without being acknowledged, in which case the remote peer is
+	// assumed to be dead.
+	ErrRetransmitLimit = errors.New("retransmission limit exceeded")
+)
+
+// segment of the bytes written to a network connection that has not yet been
+// acknowledged.
+type segment struct {
+	kind        uint8
+	seq         uint32
+	data        []byte
+	sent        time.Time
+	retransmits int
+}
+
+// Conn is a network connection over UDP. Bytes are split into segments, which
+// are acknowledged by the remote peer, and retransmitted if they are not
+// acknowledged in time, so that all bytes are read in the order that they were
+// written. It implements the net.Conn interface.
+type Conn struct {
+	opts   Options
+	id     uint32
+	local  net.Addr
+	remote net.Addr
+
+	// write a packet to the remote peer.
+	write func([]byte) error
+	// release the resources of the network connection once it is done.
+	release func()
+
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// readable and writable are signalled when the network connection might
+	// have become readable, or writable.
+	readable chan struct{}
+	writable chan struct{}
+	// done is closed once the network connection has failed, or has been
+	// closed and all of its segments have been acknowledged (or it has
+	// lingered for long enough).
+	done chan struct{}
+
+	mu *sync.Mutex
+
+	// State of the bytes that are written.
+	nextSeq uint32
+	unacked []*segment
+	lastAck uint32
+	dupAcks int
+	rto     time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+
+	// State of the bytes that are read.
+	expected   uint32
+	outOfOrder map[uint32]*segment
+	readBuf    []byte
+	eof        bool
+	// full is true if a segment was dropped because the receive buffer was
+	// full.
+	full bool
+
+	closed  bool
+	lingers time.Time
+	err     error
+}
+
+func newConn(opts Options, id uint32, local, remote net.Addr, write func([]byte) error, release func()) *Conn {
+	conn := &Conn{
+		opts:   opts,
+		id:     id,
+		local:  local,
+		remote: remote,
+
+		write:   write,
+		release: release,
+
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+
+		mu: new(sync.Mutex),
+
+		rto: opts.InitialRTO,
+
+		outOfOrder: map[uint32]*segment{},
+	}
+	go conn.retransmitInBackground()
+	return conn
+}
+
+// Read bytes that were written by the remote peer, in order. It returns io.EOF
+// once the remote peer has closed the network connection, and all bytes
+// written before closing have been read.
+func (conn *Conn) Read(p []byte) (int, error) {
+	for {
+		conn.mu.Lock()
+		switch {
+		case conn.closed:
+			conn.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(conn.readBuf) > 0:
+			n := copy(p, conn.readBuf)
+			conn.readBuf = conn.readBuf[n:]
+			full := conn.full
+			if full {
+				// Tell the remote peer that there is room, so that it
+				// retransmits the segments that were dropped without
+				// waiting for their timeouts.
+				conn.full = false
+				conn.deliverInOrder()
+			}
+			ack := conn.expected
+			conn.mu.Unlock()
+			if full {
+				conn.sendAck(ack)
+			}
+			return n, nil
+		case conn.eof:
+			conn.mu.Unlock()
+			return 0, io.EOF
+		case conn.err != nil:
+			err := conn.err
+			conn.mu.Unlock()
+			return 0, err
+		}
+		conn.mu.Unlock()
+
+		select {
+		case <-conn.readable:
+		case <-conn.done:
+		case <-conn.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write bytes to the remote peer. It waits while the window of segments that
+// have not yet been acknowledged is full.
+func (conn *Conn) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		conn.mu.Lock()
+		switch {
+		case conn.closed:
+			conn.mu.Unlock()
+			return n, net.ErrClosed
+		case conn.err != nil:
+			err := conn.err
+			conn.mu.Unlock()
+			return n, err
+		case len(conn.unacked) < conn.opts.Window:
+			end := n + conn.opts.MaxSegmentSize
+			if end > len(p) {
+				end = len(p)
+			}
+			seg := conn.push(kindData, append([]byte(nil), p[n:end]...))
+			conn.mu.Unlock()
+			conn.send(seg)
+			n = end
+			continue
+		}
+		conn.mu.Unlock()
+
+		select {
+		case <-conn.writable:
+		case <-conn.done:
+		case <-conn.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+	return n, nil
+}
+
+// Close the network connection. Reading and writing stop immediately, but
+// bytes that have already been written continue to be retransmitted in the
+// background until they are acknowledged, or until the network connection has
+// lingered for long enough.
+func (conn *Conn) Close() error {
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return nil
+	}
+	conn.closed = true
+	conn.lingers = time.Now().Add(conn.opts.Linger)
+	var fin *segment
+	if conn.err == nil {
+		fin = conn.push(kindFin, nil)
+	}
+	conn.mu.Unlock()
+
+	if fin != nil {
+		conn.send(fin)
+	}
+	conn.signal(conn.readable)
+	conn.signal(conn.writable)
+	return nil
+}
+
+// LocalAddr implements the net.Conn interface.
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// SetDeadline implements the net.Conn interface.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.writeDeadline.set(t)
+	return nil
+}
+
+// push a new segment onto the segments that have not yet been acknowledged. It
+// must be called while holding the mutex.
+func (conn *Conn) push(kind uint8, data []byte) *segment {
+	seg := &segment{kind: kind, seq: conn.nextSeq, data: data, sent: time.Now()}
+	conn.nextSeq++
+	conn.unacked = append(conn.unacked, seg)
+	return seg
+}
+
+// send a segment to the remote peer. Errors are ignored, because segments
+// that are not acknowledged are retransmitted.
+func (conn *Conn) send(seg *segment) {
+	_ = conn.write(header{kind: seg.kind, conn: conn.id, seq: seg.seq}.marshal(seg.data))
+}
+
+func (conn *Conn) sendAck(ack uint32) {
+	_ = conn.write(header{kind: kindAck, conn: conn.id, ack: ack}.marshal(nil))
+}
+
+func (conn *Conn) signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// handle a packet for the network connection.
+func (conn *Conn) handle(h header, data []byte) {
+	switch h.kind {
+	case kindData, kindFin:
+		conn.handleSegment(h, data)
+	case kindAck:
+		conn.handleAck(h.ack)
+	case kindRst:
+		conn.fail(ErrReset)
+	}
+}
+
+func (conn *Conn) handleSegment(h header, data []byte) {
+	conn.mu.Lock()
+	switch {
+	case h.seq == conn.expected:
+		if !conn.fits(len(data)) {
+			// The segment is dropped without being acknowledged, so that the
+			// remote peer stops sending more segments until there is room.
+			conn.full = true
+			conn.mu.Unlock()
+			return
+		}
+		conn.deliver(&segment{kind: h.kind, data: append([]byte(nil), data...)})
+		conn.expected++
+		conn.deliverInOrder()
+	case seqBefore(conn.expected, h.seq) && h.seq-conn.expected < uint32(2*conn.opts.Window):
+		// Segments after a lost segment are kept until the lost segment is
+		// retransmitted. Duplicate acknowledgements tell the remote peer that
+		// a segment was lost.
+		if _, ok := conn.outOfOrder[h.seq]; !ok {
+			conn.outOfOrder[h.seq] = &segment{kind: h.kind, data: append([]byte(nil), data...)}
+		}
+	}
+	ack := conn.expected
+	conn.mu.Unlock()
+
+	conn.sendAck(ack)
+	conn.signal(conn.readable)
+}
+
+// fits returns true if n more bytes fit in the receive buffer. It must be
+// called while holding the mutex.
+func (conn *Conn) fits(n int) bool {
+	return conn.opts.ReceiveBuffer <= 0 || len(conn.readBuf) == 0 || len(conn.readBuf)+n <= conn.opts.ReceiveBuffer
+}
+
+// deliverInOrder delivers the segments that were received out of order, and
+// are now in order, while they fit in the receive buffer. It must be called
+// while holding the mutex.
+func (conn *Conn) deliverInOrder() {
+	for {
+		seg, ok := conn.outOfOrder[conn.expected]
+		if !ok {
+			break
+		}
+		if !conn.fits(len(seg.data)) {
+			conn.full = true
+			break
+		}
+		delete(conn.outOfOrder, conn.expected)
+		conn.deliver(seg)
+		conn.expected++
+	}
+}
+
+// deliver a segment that was received in order. It must be called while
+// holding the mutex.
+func (conn *Conn) deliver(seg *segment) {
+	if seg.kind == kindFin {
+		conn.eof = true
+		return
+	}
+	if !conn.closed && !conn.eof {
+		conn.readBuf = append(conn.readBuf, seg.data...)
+	}
+}
+
+func (conn *Conn) handleAck(ack uint32) {
+	conn.mu.Lock()
+
+	now := time.Now()
+	acked := 0
+	for acked < len(conn.unacked) && seqBefore(conn.unacked[acked].seq, ack) {
+		acked++
+	}
+	if acked > 0 {
+		// Only segments that were not retransmitted give an unambiguous
+		// measurement of the round trip time.
+		if last := conn.unacked[acked-1]; last.retransmits == 0 {
+			conn.measureRTT(now.Sub(last.sent))
+		}
+		conn.unacked = conn.unacked[acked:]
+		conn.lastAck = ack
+		conn.dupAcks = 0
+	} else if ack == conn.lastAck && len(conn.unacked) > 0 {
+		// Three duplicate acknowledgements mean that the first segment that
+		// has not been acknowledged was lost, but later segments were not, so
+		// it is retransmitted without waiting for its timeout.
+		conn.dupAcks++
+		if conn.dupAcks == 3 {
+			seg := conn.unacked[0]
+			seg.sent = now
+			seg.retransmits++
+			conn.mu.Unlock()
+			conn.send(seg)
+			return
+		}
+	}
+	finished := conn.closed && len(conn.unacked) == 0
+	conn.mu.Unlock()
+
+	conn.signal(conn.writable)
+	if finished {
+		conn.finish(nil)
+	}
+}
+
+// measureRTT updates the retransmission timeout (see RFC 6298). It must be
+// called while holding the mutex.
+func (conn *Conn) measureRTT(rtt time.Duration) {
+	if conn.srtt == 0 {
+		conn.srtt = rtt
+		conn.rttvar = rtt / 2
+	} else {
+		diff := conn.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		conn.rttvar = (3*conn.rttvar + diff) / 4
+		conn.srtt = (7*conn.srtt + rtt) / 8
+	}
+	conn.rto = conn.srtt + 4*conn.rttvar
+	if conn.rto < conn.opts.MinRTO {
+		conn.rto = conn.opts.MinRTO
+	}
+	if conn.rto > conn.opts.MaxRTO {
+		conn.rto = conn.opts.MaxRTO
+	}
+}
+
+// retransmitInBackground retransmits segments that have not been acknowledged
+// before their timeout, which doubles after every retransmission.
+func (conn *Conn) retransmitInBackground() {
+	interval := conn.opts.MinRTO / 2
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case now := <-ticker.C:
+			conn.mu.Lock()
+			if conn.closed && now.After(conn.lingers) {
+				conn.mu.Unlock()
+				conn.finish(nil)
+				return
+			}
+			retransmit := []*segment{}
+			for _, seg := range conn.unacked {
+				timeout := conn.rto << uint(seg.retransmits)
+				if timeout > conn.opts.MaxRTO || timeout <= 0 {
+					timeout = conn.opts.MaxRTO
+				}
+				if now.Sub(seg.sent) < timeout {
+					continue
+				}
+				if seg.retransmits >= conn.opts.MaxRetransmits {
+					conn.mu.Unlock()
+					conn.fail(ErrRetransmitLimit)
+					return
+				}
+				seg.sent = now
+				seg.retransmits++
+				retransmit = append(retransmit, seg)
+			}
+			conn.mu.Unlock()
+
+			for _, seg := range retransmit {
+				conn.send(seg)
+			}
+		}
+	}
+}
+
+// fail the network connection with an error.
+func (conn *Conn) fail(err error) {
+	conn.finish(err)
+}
+
+// finish the network connection, and release its resources.
+func (conn *Conn) finish(err error) {
+	conn.mu.Lock()
+	if isClosed(conn.done) {
+		conn.mu.Unlock()
+		return
+	}
+	if err != nil && conn.err == nil {
+		conn.err = err
+	}
+	if conn.err == nil {
+		conn.err = net.ErrClosed
+	}
+	close(conn.done)
+	conn.mu.Unlock()
+
+	conn.release()
+}
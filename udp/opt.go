@@ -0,0 +1,105 @@
+package udp
+
+import "time"
+
+var (
+	// DefaultMaxSegmentSize keeps datagrams below the minimum MTU of IPv6, so
+	// that they are not fragmented.
+	DefaultMaxSegmentSize = 1200
+	DefaultWindow         = 256
+	DefaultReceiveBuffer  = 1024 * 1024 // 1MB
+	DefaultInitialRTO     = 200 * time.Millisecond
+	DefaultMinRTO         = 20 * time.Millisecond
+	DefaultMaxRTO         = 2 * time.Second
+	DefaultMaxRetransmits = 8
+	DefaultLinger         = 5 * time.Second
+	DefaultAcceptBacklog  = 64
+)
+
+// Options for network connections over UDP.
+type Options struct {
+	MaxSegmentSize int
+	Window         int
+	ReceiveBuffer  int
+	InitialRTO     time.Duration
+	MinRTO         time.Duration
+	MaxRTO         time.Duration
+	MaxRetransmits int
+	Linger         time.Duration
+	AcceptBacklog  int
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{
+		MaxSegmentSize: DefaultMaxSegmentSize,
+		Window:         DefaultWindow,
+		ReceiveBuffer:  DefaultReceiveBuffer,
+		InitialRTO:     DefaultInitialRTO,
+		MinRTO:         DefaultMinRTO,
+		MaxRTO:         DefaultMaxRTO,
+		MaxRetransmits: DefaultMaxRetransmits,
+		Linger:         DefaultLinger,
+		AcceptBacklog:  DefaultAcceptBacklog,
+	}
+}
+
+// WithMaxSegmentSize sets the maximum number of bytes written in one datagram,
+// not including its header.
+func (opts Options) WithMaxSegmentSize(size int) Options {
+	opts.MaxSegmentSize = size
+	return opts
+}
+
+// WithWindow sets the number of segments that can be written before they are
+// acknowledged by the remote peer. Writing waits once the window is full.
+func (opts Options) WithWindow(window int) Options {
+	opts.Window = window
+	return opts
+}
+
+// WithReceiveBuffer sets the maximum number of bytes that have been received,
+// but not yet read. Once the maximum is reached, segments are dropped without
+// being acknowledged, so the remote peer retransmits them after they have been
+// read. A remote peer that is not read for long enough reaches its maximum
+// number of retransmissions, and the network connection is closed. A segment
+// is always received when there are no bytes waiting to be read, even if it is
+// larger than the maximum. A non-positive maximum means that there is no
+// maximum.
+func (opts Options) WithReceiveBuffer(size int) Options {
+	opts.ReceiveBuffer = size
+	return opts
+}
+
+// WithRTO sets the retransmission timeout that is used before the round trip
+// time has been measured, and the bounds of the retransmission timeout once it
+// has been measured. A lower minimum than that of TCP (usually, 200ms) is what
+// allows lost segments to be recovered quickly.
+func (opts Options) WithRTO(initial, min, max time.Duration) Options {
+	opts.InitialRTO = initial
+	opts.MinRTO = min
+	opts.MaxRTO = max
+	return opts
+}
+
+// WithMaxRetransmits sets the number of times that a segment is retransmitted
+// before the network connection is assumed to be dead, and is closed.
+func (opts Options) WithMaxRetransmits(max int) Options {
+	opts.MaxRetransmits = max
+	return opts
+}
+
+// WithLinger sets how long a closed network connection keeps retransmitting
+// segments that have not yet been acknowledged.
+func (opts Options) WithLinger(linger time.Duration) Options {
+	opts.Linger = linger
+	return opts
+}
+
+// WithAcceptBacklog sets the number of network connections that can be waiting
+// to be accepted by a Listener. Network connections from remote peers beyond
+// the backlog are dropped, and the remote peers retry.
+func (opts Options) WithAcceptBacklog(backlog int) Options {
+	opts.AcceptBacklog = backlog
+	return opts
+}
@@ -0,0 +1,72 @@
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Enumerate all packet kinds.
+const (
+	// kindSyn packets are written by dialers until a packet for the network
+	// connection is received.
+	kindSyn = uint8(1)
+	// kindSynAck packets are written by listeners in response to kindSyn
+	// packets.
+	kindSynAck = uint8(2)
+	// kindData packets are segments of the bytes written to the network
+	// connection.
+	kindData = uint8(3)
+	// kindFin packets are segments that mark the end of the bytes written to
+	// the network connection. They have no data.
+	kindFin = uint8(4)
+	// kindAck packets acknowledge all segments before their ack.
+	kindAck = uint8(5)
+	// kindRst packets are written in response to packets for network
+	// connections that do not exist.
+	kindRst = uint8(6)
+)
+
+// headerSize is the number of bytes in the header of a packet.
+const headerSize = 1 + 4 + 4 + 4
+
+// header of a packet. The conn identifies the network connection, so that
+// packets for an old network connection from the same address are not mixed up
+// with a new one.
+type header struct {
+	kind uint8
+	conn uint32
+	seq  uint32
+	ack  uint32
+}
+
+func (h header) marshal(data []byte) []byte {
+	buf := make([]byte, headerSize+len(data))
+	buf[0] = h.kind
+	binary.BigEndian.PutUint32(buf[1:], h.conn)
+	binary.BigEndian.PutUint32(buf[5:], h.seq)
+	binary.BigEndian.PutUint32(buf[9:], h.ack)
+	copy(buf[headerSize:], data)
+	return buf
+}
+
+func unmarshalHeader(buf []byte) (header, []byte, error) {
+	if len(buf) < headerSize {
+		return header{}, nil, fmt.Errorf("packet too short: %v bytes", len(buf))
+	}
+	h := header{
+		kind: buf[0],
+		conn: binary.BigEndian.Uint32(buf[1:]),
+		seq:  binary.BigEndian.Uint32(buf[5:]),
+		ack:  binary.BigEndian.Uint32(buf[9:]),
+	}
+	if h.kind < kindSyn || h.kind > kindRst {
+		return header{}, nil, fmt.Errorf("unknown packet kind: %v", h.kind)
+	}
+	return h, buf[headerSize:], nil
+}
+
+// seqBefore returns true if the sequence number a comes before b, allowing for
+// sequence numbers to wrap around.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
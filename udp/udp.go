@@ -0,0 +1,305 @@
+// Package udp implements network connections over UDP that can be used
+// wherever network connections over TCP are used (for example, by handshakes,
+// and Channels). Bytes are acknowledged, and retransmitted, by the application
+// instead of the kernel, so that lost bytes are recovered after a
+// retransmission timeout that is based on the measured round trip time, rather
+// than the (usually, much longer) minimum timeout of TCP. This is useful for
+// latency-sensitive gossip on lossy networks.
+//
+// Listen and Dial mirror the functions of the tcp package.
+package udp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/tcp"
+)
+
+// maxPacketSize is the size of the buffer into which packets are read.
+const maxPacketSize = 64 * 1024
+
+// Listen for network connections from remote peers until the context is done
+// (see tcp.Listen).
+func Listen(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	listener, err := NewListener(address, DefaultOptions())
+	if err != nil {
+		return err
+	}
+	return tcp.ListenWithListener(ctx, listener, handle, handleErr, allow)
+}
+
+// Dial a remote peer until a network connection is established, or until the
+// context is done (see tcp.Dial).
+func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	return DialWithBackoff(ctx, address, handle, handleErr, timeout, nil)
+}
+
+// DialWithBackoff is the same as Dial, but waits between failed dial attempts
+// (see tcp.DialWithBackoff).
+func DialWithBackoff(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration, backoff func(int) time.Duration) error {
+	return tcp.DialUsing(ctx, Dialer(DefaultOptions()), address, handle, handleErr, timeout, backoff)
+}
+
+// Dialer returns a tcp.DialFunc that dials network connections over UDP,
+// regardless of the network that it is given. A network connection is
+// established once the remote peer responds.
+func Dialer(opts Options) tcp.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		raddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		sock, err := net.DialUDP("udp", nil, raddr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, opts, sock)
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func dial(ctx context.Context, opts Options, sock *net.UDPConn) (*Conn, error) {
+	// Connection IDs are random, so that remote peers cannot guess them, and
+	// inject packets into (or reset) the network connection.
+	var idBytes [4]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, fmt.Errorf("generating connection id: %w", err)
+	}
+	id := binary.BigEndian.Uint32(idBytes[:])
+	syn := header{kind: kindSyn, conn: id}.marshal(nil)
+
+	buf := make([]byte, maxPacketSize)
+	rto := opts.InitialRTO
+	for {
+		if _, err := sock.Write(syn); err != nil {
+			return nil, err
+		}
+		sock.SetReadDeadline(time.Now().Add(rto))
+		for {
+			n, err := sock.Read(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			h, data, err := unmarshalHeader(buf[:n])
+			if err != nil || h.conn != id {
+				continue
+			}
+			if h.kind == kindRst {
+				return nil, ErrReset
+			}
+			sock.SetReadDeadline(time.Time{})
+
+			// Any packet for the network connection means that it was
+			// established, because packets can arrive out of order.
+			conn := newConn(opts, id, sock.LocalAddr(), sock.RemoteAddr(), func(packet []byte) error {
+				_, err := sock.Write(packet)
+				return err
+			}, func() { sock.Close() })
+			conn.handle(h, data)
+			go readInBackground(sock, conn)
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dialing %w", ctx.Err())
+		default:
+		}
+		if rto *= 2; rto > opts.MaxRTO {
+			rto = opts.MaxRTO
+		}
+	}
+}
+
+// readInBackground reads the packets of a dialed network connection until its
+// socket is closed.
+func readInBackground(sock *net.UDPConn, conn *Conn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := sock.Read(buf)
+		if err != nil {
+			if isClosed(conn.done) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Other errors are caused by ICMP messages (such as the port
+			// being unreachable), and are not fatal, because the remote peer
+			// might come back before the retransmission limit is reached.
+			continue
+		}
+		h, data, err := unmarshalHeader(buf[:n])
+		if err != nil || h.conn != conn.id {
+			continue
+		}
+		if h.kind == kindSyn || h.kind == kindSynAck {
+			continue
+		}
+		conn.handle(h, data)
+	}
+}
+
+// A Listener accepts network connections over UDP. All network connections
+// share the socket of the Listener, so closing the Listener also closes all of
+// its network connections. It implements the net.Listener interface.
+type Listener struct {
+	opts Options
+	sock *net.UDPConn
+
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce *sync.Once
+
+	connsMu *sync.Mutex
+	conns   map[string]*Conn
+}
+
+// NewListener returns a Listener that is listening on the address.
+func NewListener(address string, opts Options) (*Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	sock, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	listener := &Listener{
+		opts: opts,
+		sock: sock,
+
+		accept:    make(chan *Conn, opts.AcceptBacklog),
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+
+		connsMu: new(sync.Mutex),
+		conns:   map[string]*Conn{},
+	}
+	go listener.readInBackground()
+	return listener, nil
+}
+
+// Accept the next network connection.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	case conn := <-listener.accept:
+		return conn, nil
+	}
+}
+
+// Close the Listener, and all of its network connections.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+
+	listener.connsMu.Lock()
+	conns := make([]*Conn, 0, len(listener.conns))
+	for _, conn := range listener.conns {
+		conns = append(conns, conn)
+	}
+	listener.connsMu.Unlock()
+
+	for _, conn := range conns {
+		conn.fail(net.ErrClosed)
+	}
+	return listener.sock.Close()
+}
+
+// Addr returns the address on which the Listener is listening.
+func (listener *Listener) Addr() net.Addr {
+	return listener.sock.LocalAddr()
+}
+
+func (listener *Listener) readInBackground() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := listener.sock.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-listener.closed:
+				return
+			default:
+				continue
+			}
+		}
+		h, data, err := unmarshalHeader(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		key := addr.String()
+		listener.connsMu.Lock()
+		conn, ok := listener.conns[key]
+		if ok && conn.id != h.conn && h.kind == kindSyn {
+			// The remote peer has dialed again, so its old network
+			// connection is dead.
+			listener.connsMu.Unlock()
+			conn.fail(ErrReset)
+			listener.connsMu.Lock()
+			conn, ok = nil, false
+		}
+		switch {
+		case ok && conn.id == h.conn:
+			listener.connsMu.Unlock()
+			if h.kind == kindSyn {
+				// The acknowledgement of the dial was lost.
+				listener.writeTo(header{kind: kindSynAck, conn: h.conn}, addr)
+				continue
+			}
+			conn.handle(h, data)
+
+		case h.kind == kindSyn:
+			conn = listener.newConn(h.conn, addr)
+			select {
+			case listener.accept <- conn:
+				listener.conns[key] = conn
+				listener.connsMu.Unlock()
+				listener.writeTo(header{kind: kindSynAck, conn: h.conn}, addr)
+			default:
+				// The backlog is full, so the remote peer will dial again.
+				listener.connsMu.Unlock()
+				conn.fail(net.ErrClosed)
+			}
+
+		default:
+			listener.connsMu.Unlock()
+			if h.kind != kindRst {
+				listener.writeTo(header{kind: kindRst, conn: h.conn}, addr)
+			}
+		}
+	}
+}
+
+func (listener *Listener) newConn(id uint32, addr *net.UDPAddr) *Conn {
+	var conn *Conn
+	conn = newConn(listener.opts, id, listener.sock.LocalAddr(), addr, func(packet []byte) error {
+		_, err := listener.sock.WriteToUDP(packet, addr)
+		return err
+	}, func() {
+		listener.connsMu.Lock()
+		defer listener.connsMu.Unlock()
+
+		if listener.conns[addr.String()] == conn {
+			delete(listener.conns, addr.String())
+		}
+	})
+	return conn
+}
+
+func (listener *Listener) writeTo(h header, addr *net.UDPAddr) {
+	_, _ = listener.sock.WriteToUDP(h.marshal(nil), addr)
+}
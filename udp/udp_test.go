@@ -0,0 +1,234 @@
+package udp_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"time"
+
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/udp"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// lossyProxy forwards packets between one dialer and a listener, dropping a
+// fraction of them in both directions.
+func lossyProxy(ctx context.Context, address, target string, loss float64) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	Expect(err).ToNot(HaveOccurred())
+	taddr, err := net.ResolveUDPAddr("udp", target)
+	Expect(err).ToNot(HaveOccurred())
+	front, err := net.ListenUDP("udp", laddr)
+	Expect(err).ToNot(HaveOccurred())
+	back, err := net.DialUDP("udp", nil, taddr)
+	Expect(err).ToNot(HaveOccurred())
+	go func() {
+		<-ctx.Done()
+		front.Close()
+		back.Close()
+	}()
+
+	dialer := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case dialer <- addr:
+			default:
+			}
+			if mrand.Float64() >= loss {
+				back.Write(buf[:n])
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 64*1024)
+		addr := <-dialer
+		for {
+			n, err := back.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			if mrand.Float64() >= loss {
+				front.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+}
+
+var _ = Describe("UDP", func() {
+	echo := func(ctx context.Context, address string, opts udp.Options) {
+		listener, err := udp.NewListener(address, opts)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+	}
+
+	roundTrip := func(conn net.Conn, size int) {
+		data := make([]byte, size)
+		rand.Read(data)
+		go func() {
+			defer GinkgoRecover()
+			_, err := conn.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		echoed := make([]byte, size)
+		_, err := io.ReadFull(conn, echoed)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(echoed).To(Equal(data))
+	}
+
+	Context("when dialing a listener", func() {
+		It("should read the bytes that were written, in order", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			echo(ctx, "127.0.0.1:13440", udp.DefaultOptions())
+			conn, err := udp.Dialer(udp.DefaultOptions())(ctx, "udp", "127.0.0.1:13440")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			roundTrip(conn, 1024*1024)
+		})
+
+		It("should complete a handshake", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			server := id.NewPrivKey()
+			client := id.NewPrivKey()
+			handshakes := make(chan id.Signatory, 1)
+			go udp.Listen(ctx, "127.0.0.1:13441", func(conn net.Conn) {
+				_, _, remote, err := handshake.ECIES(server)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				handshakes <- remote
+			}, nil, nil)
+
+			err := udp.Dial(ctx, "127.0.0.1:13441", func(conn net.Conn) {
+				_, _, remote, err := handshake.ECIES(client)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(remote).To(Equal(server.Signatory()))
+			}, nil, func(int) time.Duration { return time.Second })
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(handshakes, 5*time.Second).Should(Receive(Equal(client.Signatory())))
+		})
+	})
+
+	Context("when packets are lost", func() {
+		It("should retransmit them", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := udp.DefaultOptions().WithRTO(50*time.Millisecond, 5*time.Millisecond, time.Second).WithMaxRetransmits(20)
+			echo(ctx, "127.0.0.1:13442", opts)
+			lossyProxy(ctx, "127.0.0.1:13443", "127.0.0.1:13442", 0.1)
+			conn, err := udp.Dialer(opts)(ctx, "udp", "127.0.0.1:13443")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			roundTrip(conn, 256*1024)
+		})
+	})
+
+	Context("when the receive buffer is full", func() {
+		It("should stop receiving until the bytes have been read", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			opts := udp.DefaultOptions().WithReceiveBuffer(4 * 1024).WithRTO(50*time.Millisecond, 5*time.Millisecond, 100*time.Millisecond).WithMaxRetransmits(20)
+			listener, err := udp.NewListener("127.0.0.1:13447", opts)
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				defer GinkgoRecover()
+				conn, err := listener.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+
+				// Wait for the receive buffer to fill up before reading.
+				time.Sleep(200 * time.Millisecond)
+				data := make([]byte, 64*1024)
+				_, err = io.ReadFull(conn, data)
+				Expect(err).ToNot(HaveOccurred())
+				received <- data
+			}()
+
+			conn, err := udp.Dialer(opts)(ctx, "udp", "127.0.0.1:13447")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			data := make([]byte, 64*1024)
+			rand.Read(data)
+			_, err = conn.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(received, 10*time.Second).Should(Receive(Equal(data)))
+		})
+	})
+
+	Context("when the remote peer goes away", func() {
+		It("should fail to write", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listenerCtx, closeListener := context.WithCancel(ctx)
+			opts := udp.DefaultOptions().WithRTO(10*time.Millisecond, 5*time.Millisecond, 20*time.Millisecond).WithMaxRetransmits(3)
+			echo(listenerCtx, "127.0.0.1:13444", opts)
+			conn, err := udp.Dialer(opts)(ctx, "udp", "127.0.0.1:13444")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			roundTrip(conn, 1024)
+			closeListener()
+			Eventually(func() error {
+				_, err := conn.Write([]byte("hello"))
+				return err
+			}, 5*time.Second).Should(HaveOccurred())
+		})
+	})
+
+	Context("when a read deadline passes", func() {
+		It("should return a timeout error", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			echo(ctx, "127.0.0.1:13445", udp.DefaultOptions())
+			conn, err := udp.Dialer(udp.DefaultOptions())(ctx, "udp", "127.0.0.1:13445")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Expect(conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+			_, err = conn.Read(make([]byte, 1))
+			var netErr net.Error
+			Expect(errors.As(err, &netErr)).To(BeTrue())
+			Expect(netErr.Timeout()).To(BeTrue())
+		})
+	})
+})
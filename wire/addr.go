@@ -19,16 +19,13 @@ import (
 type Protocol uint8
 
 func (p Protocol) String() string {
-	switch p {
-	case TCP:
-		return "tcp"
-	case UDP:
-		return "udp"
-	case WebSocket:
-		return "ws"
-	default:
-		return "unknown"
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	if info, ok := protocols[p]; ok {
+		return info.name
 	}
+	return "unknown"
 }
 
 func (p Protocol) MarshalJSON() ([]byte, error) {
@@ -40,12 +37,13 @@ func (p *Protocol) UnmarshalJSON(data []byte) error {
 }
 
 // Protocol values for the different network address protocols that are
-// supported.
+// supported. Other protocols can be supported using RegisterProtocol.
 const (
 	UndefinedProtocol = Protocol(0)
 	TCP               = Protocol(1)
 	UDP               = Protocol(2)
 	WebSocket         = Protocol(3)
+	Multiaddr         = Protocol(4)
 )
 
 // NewAddressHash returns the Hash of an Address for signing by the peer. An
@@ -222,6 +220,26 @@ func (addr Address) String() string {
 	return fmt.Sprintf("/%v/%v/%v/%v", addr.Protocol, addr.Value, addr.Nonce, addr.Signature)
 }
 
+// IsSigned returns whether the Address has a Signature. It does not verify the
+// Signature.
+func (addr *Address) IsSigned() bool {
+	return !addr.Signature.Equal(&id.Signature{})
+}
+
+// Supersedes returns whether the Address should replace another Address for
+// the same peer. Signed Addresses are self-signed records issued by the peer,
+// so they supersede all unsigned Addresses (which are observed by, or relayed
+// from, other peers), and are never superseded by them. Otherwise, the Address
+// with the greater nonce supersedes the other, so replaying an Address has no
+// effect. The Signatures are not verified, so they must be verified before the
+// Address is trusted.
+func (addr *Address) Supersedes(other *Address) bool {
+	if signed, otherSigned := addr.IsSigned(), other.IsSigned(); signed != otherSigned {
+		return signed
+	}
+	return addr.Nonce > other.Nonce
+}
+
 // Equal compares two Addressees. Returns true if they are the same, otherwise
 // returns false.
 func (addr *Address) Equal(other *Address) bool {
@@ -238,33 +256,29 @@ func DecodeString(addr string) (Address, error) {
 		addr = addr[1:]
 	}
 
+	// Values can contain slashes (for example, multiaddrs), so the nonce and
+	// signature are taken from the end.
 	addrParts := strings.Split(addr, "/")
-	if len(addrParts) != 4 {
+	if len(addrParts) < 4 {
 		return Address{}, fmt.Errorf("invalid format %v", addr)
 	}
-	var protocol Protocol
-	switch addrParts[0] {
-	case "tcp":
-		protocol = TCP
-	case "udp":
-		protocol = UDP
-	case "ws":
-		protocol = WebSocket
-	default:
+	n := len(addrParts)
+	protocol, ok := ProtocolByName(addrParts[0])
+	if !ok {
 		return Address{}, fmt.Errorf("invalid protocol %v", addrParts[0])
 	}
-	value := addrParts[1]
-	nonce, err := strconv.ParseUint(addrParts[2], 10, 64)
+	value := strings.Join(addrParts[1:n-2], "/")
+	nonce, err := strconv.ParseUint(addrParts[n-2], 10, 64)
 	if err != nil {
 		return Address{}, err
 	}
 	var sig id.Signature
-	sigBytes, err := base64.RawURLEncoding.DecodeString(addrParts[3])
+	sigBytes, err := base64.RawURLEncoding.DecodeString(addrParts[n-1])
 	if err != nil {
 		return Address{}, err
 	}
 	if len(sigBytes) != 65 {
-		return Address{}, fmt.Errorf("invalid signature %v", addrParts[3])
+		return Address{}, fmt.Errorf("invalid signature %v", addrParts[n-1])
 	}
 	copy(sig[:], sigBytes)
 	return Address{
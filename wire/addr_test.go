@@ -4,6 +4,7 @@ import (
 	"math/rand"
 
 	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -43,4 +44,99 @@ var _ = Describe("Address", func() {
 			Expect(h3).ToNot(Equal(h4))
 		})
 	})
+
+	Context("when comparing addresses for the same peer", func() {
+		It("should only be superseded by newer addresses, and never by unsigned addresses when signed", func() {
+			privKey := id.NewPrivKey()
+			older := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1)
+			newer := wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 2)
+			Expect(newer.Supersedes(&older)).To(BeTrue())
+			Expect(older.Supersedes(&newer)).To(BeFalse())
+			Expect(older.Supersedes(&older)).To(BeFalse())
+
+			signed := wire.NewUnsignedAddress(wire.TCP, "10.0.0.3:3333", 0)
+			Expect(signed.Sign(privKey)).To(Succeed())
+			Expect(signed.IsSigned()).To(BeTrue())
+			Expect(newer.IsSigned()).To(BeFalse())
+			Expect(signed.Supersedes(&newer)).To(BeTrue())
+			Expect(newer.Supersedes(&signed)).To(BeFalse())
+		})
+	})
+
+	Context("when verifying the addresses of a peer with many addresses", func() {
+		It("should only accept non-empty lists of addresses with equal nonces that are signed by the peer", func() {
+			privKey := id.NewPrivKey()
+			addrs := []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1),
+				wire.NewUnsignedAddress(wire.WebSocket, "10.0.0.1:3334", 1),
+				wire.NewUnsignedAddress(wire.TCP, "[::1]:3333", 1),
+			}
+			for i := range addrs {
+				Expect(addrs[i].Sign(privKey)).To(Succeed())
+			}
+			Expect(wire.VerifyAddresses(addrs, privKey.Signatory())).To(Succeed())
+			Expect(wire.VerifyAddresses(addrs, id.NewPrivKey().Signatory())).ToNot(Succeed())
+			Expect(wire.VerifyAddresses(nil, privKey.Signatory())).ToNot(Succeed())
+
+			other := wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 2)
+			Expect(other.Sign(privKey)).To(Succeed())
+			Expect(wire.VerifyAddresses(append(addrs, other), privKey.Signatory())).ToNot(Succeed())
+		})
+	})
+
+	Context("when verifying a peer list", func() {
+		It("should group the newest verified entries by signatory", func() {
+			self := id.NewPrivKey().Signatory()
+			multi := id.NewPrivKey()
+			tcp := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 2)
+			ws := wire.NewUnsignedAddress(wire.WebSocket, "10.0.0.1:3334", 2)
+			old := wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3000", 1)
+			for _, addr := range []*wire.Address{&tcp, &ws, &old} {
+				Expect(addr.Sign(multi)).To(Succeed())
+			}
+			forged := wire.NewUnsignedAddress(wire.TCP, "10.0.0.2:3333", 1)
+			Expect(forged.Sign(id.NewPrivKey())).To(Succeed())
+			forger := id.NewPrivKey().Signatory()
+			unsigned := id.NewPrivKey().Signatory()
+			known := id.NewPrivKey().Signatory()
+
+			list := []wire.SignatoryAndAddress{
+				{Signatory: self, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.3:3333", 1)},
+				{Signatory: multi.Signatory(), Address: old},
+				{Signatory: multi.Signatory(), Address: tcp},
+				{Signatory: multi.Signatory(), Address: ws},
+				{Signatory: forger, Address: forged},
+				{Signatory: unsigned, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.4:3333", 1)},
+				{Signatory: known, Address: wire.NewUnsignedAddress(wire.TCP, "10.0.0.5:3333", 1)},
+			}
+			Expect(wire.VerifyPeerList(list, self, false, nil)).To(Equal([]wire.PeerAddresses{
+				{Signatory: multi.Signatory(), Addresses: []wire.Address{tcp, ws}},
+				{Signatory: unsigned, Addresses: []wire.Address{list[5].Address}},
+				{Signatory: known, Addresses: []wire.Address{list[6].Address}},
+			}))
+			Expect(wire.VerifyPeerList(list, self, true, nil)).To(Equal([]wire.PeerAddresses{
+				{Signatory: multi.Signatory(), Addresses: []wire.Address{tcp, ws}},
+			}))
+
+			// Entries that do not supersede the known address are dropped.
+			knownAddr := func(signatory id.Signatory) (wire.Address, bool) {
+				return list[6].Address, signatory == known
+			}
+			Expect(wire.VerifyPeerList(list, self, false, knownAddr)).To(HaveLen(2))
+		})
+	})
+
+	Context("when sorting addresses by protocol preference", func() {
+		It("should put preferred protocols first, and otherwise keep the order", func() {
+			addrs := []wire.Address{
+				wire.NewUnsignedAddress(wire.TCP, "10.0.0.1:3333", 1),
+				wire.NewUnsignedAddress(wire.UDP, "10.0.0.1:3335", 1),
+				wire.NewUnsignedAddress(wire.WebSocket, "10.0.0.1:3334", 1),
+				wire.NewUnsignedAddress(wire.TCP, "[::1]:3333", 1),
+			}
+			Expect(wire.SortAddresses(addrs, nil)).To(Equal(addrs))
+			Expect(wire.SortAddresses(addrs, []wire.Protocol{wire.WebSocket})).To(Equal([]wire.Address{addrs[2], addrs[0], addrs[1], addrs[3]}))
+			Expect(wire.SortAddresses(addrs, []wire.Protocol{wire.UDP, wire.TCP})).To(Equal([]wire.Address{addrs[1], addrs[0], addrs[3], addrs[2]}))
+		})
+	})
 })
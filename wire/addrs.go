@@ -0,0 +1,102 @@
+package wire
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/renproject/id"
+)
+
+// VerifyAddresses verifies a list of Addresses that is advertised by a peer
+// with more than one network address (for example, TCP and WebSocket, or IPv4
+// and IPv6). The list must not be empty, all Addresses must be signed by the
+// Signatory, and all Addresses must have the same nonce, so that the list is
+// superseded as a whole. The Addresses are in order of priority, so the first
+// Address is the one that is used when only one Address can be used.
+func VerifyAddresses(addrs []Address, signatory id.Signatory) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("no addresses")
+	}
+	for i := range addrs {
+		if addrs[i].Nonce != addrs[0].Nonce {
+			return fmt.Errorf("bad address %v: expected nonce %v, got nonce %v", i, addrs[0].Nonce, addrs[i].Nonce)
+		}
+		if err := addrs[i].Verify(signatory); err != nil {
+			return fmt.Errorf("bad address %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// SortAddresses returns a copy of the Addresses that is sorted by the local
+// preference for their Protocols. Addresses with Protocols that appear earlier
+// in the preference come first, and Addresses with Protocols that are not in
+// the preference come last. Otherwise, the order of priority advertised by the
+// peer is kept.
+func SortAddresses(addrs []Address, preference []Protocol) []Address {
+	rank := func(protocol Protocol) int {
+		for i, preferred := range preference {
+			if preferred == protocol {
+				return i
+			}
+		}
+		return len(preference)
+	}
+	sorted := make([]Address, len(addrs))
+	copy(sorted, addrs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i].Protocol) < rank(sorted[j].Protocol)
+	})
+	return sorted
+}
+
+// PeerAddresses are the Addresses of a peer in a peer list, in order of
+// priority.
+type PeerAddresses struct {
+	Signatory id.Signatory
+	Addresses []Address
+}
+
+// VerifyPeerList returns the entries of a peer list that can be added to a
+// table, grouped by Signatory. Entries for the local peer, entries with signed
+// Addresses that were not signed by their Signatory, and entries with unsigned
+// Addresses (if signed Addresses are required) are dropped. If the function
+// that returns the known Address of a Signatory is not nil, entries that do
+// not supersede the known Address are also dropped. When there are many
+// entries for the same Signatory, only the newest are kept, and signed entries
+// with the same nonce are kept together, in order, as the Addresses of a peer
+// with more than one network address.
+func VerifyPeerList(list []SignatoryAndAddress, self id.Signatory, requireSigned bool, known func(id.Signatory) (Address, bool)) []PeerAddresses {
+	newest := make(map[id.Signatory]int, len(list))
+	valid := make([]PeerAddresses, 0, len(list))
+	for _, x := range list {
+		if x.Signatory.Equal(&self) {
+			continue
+		}
+		if x.Address.IsSigned() {
+			if err := x.Address.Verify(x.Signatory); err != nil {
+				continue
+			}
+		} else if requireSigned {
+			continue
+		}
+		if known != nil {
+			if current, ok := known(x.Signatory); ok && !x.Address.Supersedes(&current) {
+				continue
+			}
+		}
+		if i, ok := newest[x.Signatory]; ok {
+			first := &valid[i].Addresses[0]
+			switch {
+			case x.Address.Supersedes(first):
+				valid[i].Addresses = []Address{x.Address}
+			case x.Address.IsSigned() && first.IsSigned() && x.Address.Nonce == first.Nonce:
+				valid[i].Addresses = append(valid[i].Addresses, x.Address)
+			}
+			continue
+		}
+		newest[x.Signatory] = len(valid)
+		valid = append(valid, PeerAddresses{Signatory: x.Signatory, Addresses: []Address{x.Address}})
+	}
+	return valid
+}
@@ -0,0 +1,176 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/renproject/surge"
+)
+
+// minMsgSize is the size of the smallest marshaled Msg, which is used to bound
+// the number of Msgs in a batch.
+var minMsgSize = Msg{Version: MsgVersion1}.SizeHint()
+
+// BatchOverhead is the number of bytes that a batch adds to the marshaled Msgs
+// that it carries.
+var BatchOverhead = Msg{Version: MsgVersion1, Type: MsgTypeBatch}.SizeHint() + surge.SizeHintU32
+
+// maxBatchLen is the maximum number of Msgs in a batch. The first byte of the
+// data of a batch that is encoded using surge is the most significant byte of
+// the number of Msgs, so it is always zero, and cannot be mistaken for the
+// ContentType of a batch that is encoded otherwise.
+const maxBatchLen = 1<<24 - 1
+
+// Batch returns a MsgTypeBatch message that carries the Msgs, so that they can
+// be written in one frame. The batch uses the lowest version of the Msgs, so
+// it can be read by any remote peer that can read all of them. Batches cannot
+// be batched, and neither can MsgTypeSync messages, because their sync data is
+// written separately.
+func Batch(msgs []Msg) (Msg, error) {
+	return BatchContent(msgs, ContentTypeSurge)
+}
+
+// BatchContent is the same as Batch, except that the Msgs are encoded using
+// the ContentType (see MarshalContent). Unless the ContentType is surge, the
+// data of the batch is the ContentType, followed by the number of Msgs, and
+// then each encoded Msg prefixed by its length.
+func BatchContent(msgs []Msg, contentType ContentType) (Msg, error) {
+	if len(msgs) == 0 {
+		return Msg{}, fmt.Errorf("batch: no messages")
+	}
+	if len(msgs) > maxBatchLen {
+		return Msg{}, fmt.Errorf("batch: expected at most %v messages, got %v", maxBatchLen, len(msgs))
+	}
+	version := msgs[0].Version
+	size := surge.SizeHintU32
+	for _, msg := range msgs {
+		if msg.Type == MsgTypeBatch || msg.Type == MsgTypeSync {
+			return Msg{}, fmt.Errorf("batch: cannot batch messages of type %v", msg.Type)
+		}
+		if msg.Version < version {
+			version = msg.Version
+		}
+		size += msg.SizeHint()
+	}
+	if contentType != ContentTypeSurge {
+		data, err := batchContent(msgs, contentType)
+		if err != nil {
+			return Msg{}, err
+		}
+		return Msg{Version: version, Type: MsgTypeBatch, Data: data}, nil
+	}
+
+	data := make([]byte, size)
+	buf, rem, err := surge.MarshalU32(uint32(len(msgs)), data, len(data))
+	if err != nil {
+		return Msg{}, fmt.Errorf("batch: %v", err)
+	}
+	for i, msg := range msgs {
+		if buf, rem, err = msg.Marshal(buf, rem); err != nil {
+			return Msg{}, fmt.Errorf("batch message %v: %v", i, err)
+		}
+	}
+
+	return Msg{Version: version, Type: MsgTypeBatch, Data: data}, nil
+}
+
+func batchContent(msgs []Msg, contentType ContentType) ([]byte, error) {
+	data := make([]byte, 1+surge.SizeHintU32)
+	data[0] = byte(contentType)
+	binary.BigEndian.PutUint32(data[1:], uint32(len(msgs)))
+	for i, msg := range msgs {
+		content, err := MarshalContent(msg, contentType)
+		if err != nil {
+			return nil, fmt.Errorf("batch message %v: %v", i, err)
+		}
+		data = append(data, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[len(data)-4:], uint32(len(content)))
+		data = append(data, content...)
+	}
+	return data, nil
+}
+
+// Unbatch returns the Msgs carried by a MsgTypeBatch message, no matter the
+// ContentType of the batch.
+func Unbatch(batch Msg) ([]Msg, error) {
+	return unbatch(batch, false)
+}
+
+// UnbatchBorrowed is the same as Unbatch, except that the data of the Msgs is
+// not copied. Instead, it refers to the data of the batch.
+func UnbatchBorrowed(batch Msg) ([]Msg, error) {
+	return unbatch(batch, true)
+}
+
+func unbatch(batch Msg, borrow bool) ([]Msg, error) {
+	if batch.Type != MsgTypeBatch {
+		return nil, fmt.Errorf("unbatch: expected type %v, got %v", MsgTypeBatch, batch.Type)
+	}
+	if ContentTypeOf(batch.Data) != ContentTypeSurge {
+		return unbatchContent(batch.Data)
+	}
+	n := uint32(0)
+	buf, rem, err := surge.UnmarshalU32(&n, batch.Data, len(batch.Data))
+	if err != nil {
+		return nil, fmt.Errorf("unbatch: %w", unmarshalErr("count", err))
+	}
+	if n == 0 || int(n) > len(buf)/minMsgSize {
+		return nil, fmt.Errorf("unbatch: bad number of messages %v: %w", n, ErrTruncated)
+	}
+
+	msgs := make([]Msg, n)
+	for i := range msgs {
+		unmarshal := msgs[i].Unmarshal
+		if borrow {
+			unmarshal = msgs[i].UnmarshalBorrowed
+		}
+		if buf, rem, err = unmarshal(buf, rem); err != nil {
+			return nil, fmt.Errorf("unbatch message %v: %w", i, err)
+		}
+		if msgs[i].Type == MsgTypeBatch {
+			return nil, fmt.Errorf("unbatch message %v: nested batch", i)
+		}
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("unbatch: %v unexpected bytes", len(buf))
+	}
+	return msgs, nil
+}
+
+// unbatchContent returns the Msgs of a batch that is not encoded using surge.
+// The Msgs never refer to the data of the batch.
+func unbatchContent(data []byte) ([]Msg, error) {
+	if len(data) < 1+surge.SizeHintU32 {
+		return nil, fmt.Errorf("unbatch: %w", ErrTruncated)
+	}
+	n := binary.BigEndian.Uint32(data[1:])
+	buf := data[1+surge.SizeHintU32:]
+	if n == 0 || int(n) > len(buf)/(surge.SizeHintU32+1) {
+		return nil, fmt.Errorf("unbatch: bad number of messages %v: %w", n, ErrTruncated)
+	}
+
+	msgs := make([]Msg, n)
+	for i := range msgs {
+		if len(buf) < surge.SizeHintU32 {
+			return nil, fmt.Errorf("unbatch message %v: %w", i, ErrTruncated)
+		}
+		size := binary.BigEndian.Uint32(buf)
+		buf = buf[surge.SizeHintU32:]
+		if uint64(size) > uint64(len(buf)) {
+			return nil, fmt.Errorf("unbatch message %v: %w", i, ErrTruncated)
+		}
+		msg, err := UnmarshalContent(buf[:size])
+		if err != nil {
+			return nil, fmt.Errorf("unbatch message %v: %w", i, err)
+		}
+		if msg.Type == MsgTypeBatch {
+			return nil, fmt.Errorf("unbatch message %v: nested batch", i)
+		}
+		msgs[i] = msg
+		buf = buf[size:]
+	}
+	if len(buf) != 0 {
+		return nil, fmt.Errorf("unbatch: %v unexpected bytes", len(buf))
+	}
+	return msgs, nil
+}
@@ -0,0 +1,79 @@
+package wire_test
+
+import (
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batches", func() {
+	Context("when batching messages", func() {
+		It("should unbatch the same messages", func() {
+			msgs := []wire.Msg{
+				{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Stream: 1, Data: []byte("hello")},
+				{Version: wire.MsgVersion2, Type: wire.MsgTypePush, Data: []byte{}},
+				{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: []byte("world")},
+			}
+			batch, err := wire.Batch(msgs)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(batch.Type).To(Equal(wire.MsgTypeBatch))
+			Expect(batch.Version).To(Equal(wire.MsgVersion2))
+
+			for _, unbatch := range []func(wire.Msg) ([]wire.Msg, error){wire.Unbatch, wire.UnbatchBorrowed} {
+				unbatched, err := unbatch(batch)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(unbatched).To(Equal(msgs))
+			}
+		})
+
+		It("should unbatch the same messages, no matter the content type", func() {
+			msgs := []wire.Msg{
+				{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Stream: 1, Data: []byte("hello")},
+				{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: []byte("world")},
+			}
+			for _, contentType := range []wire.ContentType{wire.ContentTypeProtobuf, wire.ContentTypeJSON} {
+				batch, err := wire.BatchContent(msgs, contentType)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wire.ContentTypeOf(batch.Data)).To(Equal(contentType))
+
+				unbatched, err := wire.Unbatch(batch)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(unbatched).To(Equal(msgs))
+
+				// Truncated batches are rejected.
+				batch.Data = batch.Data[:len(batch.Data)-1]
+				_, err = wire.Unbatch(batch)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
+		It("should not batch batches or sync messages", func() {
+			batch, err := wire.Batch([]wire.Msg{{Version: wire.MsgVersion5, Type: wire.MsgTypeSend}})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = wire.Batch([]wire.Msg{batch})
+			Expect(err).To(HaveOccurred())
+			_, err = wire.Batch([]wire.Msg{{Version: wire.MsgVersion5, Type: wire.MsgTypeSync}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when unbatching a malformed batch", func() {
+		It("should return an error", func() {
+			batch, err := wire.Batch([]wire.Msg{{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: []byte("hello")}})
+			Expect(err).ToNot(HaveOccurred())
+
+			// Too many messages.
+			malformed := batch
+			malformed.Data = append([]byte{}, batch.Data...)
+			malformed.Data[3] = 2
+			_, err = wire.Unbatch(malformed)
+			Expect(err).To(HaveOccurred())
+
+			// Trailing bytes.
+			malformed.Data = append(append([]byte{}, batch.Data...), 0)
+			_, err = wire.Unbatch(malformed)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compression of the data of a Msg.
+type Compression uint8
+
+// Enumerate all valid Compression values.
+const (
+	// CompressionNone means that the data is not compressed.
+	CompressionNone = Compression(0)
+	// CompressionFlate means that the data is compressed using DEFLATE (see
+	// RFC 1951).
+	CompressionFlate = Compression(1)
+)
+
+// ErrDecompressedTooLarge is returned when the data of a Msg is larger than
+// the maximum size once it has been decompressed.
+var ErrDecompressedTooLarge = errors.New("decompressed data too large")
+
+// String returns a human-readable representation of the Compression.
+func (compression Compression) String() string {
+	switch compression {
+	case CompressionNone:
+		return "none"
+	case CompressionFlate:
+		return "flate"
+	default:
+		return "unknown"
+	}
+}
+
+// Compress the data of a Msg, if it is sent using MsgVersion4 (or later), its
+// data is not already compressed, and its data is at least as large as the
+// threshold. Otherwise, the Msg is returned unchanged. The Msg is also
+// returned unchanged if compression does not make its data smaller, so that
+// data that is not compressible (for example, data that is already encrypted)
+// only costs the time spent trying. MsgTypeSync messages are never
+// compressed, because their sync data is written separately from the Msg.
+func Compress(msg Msg, threshold int) (Msg, error) {
+	if msg.Version < MsgVersion4 || msg.Type == MsgTypeSync || msg.Compression != CompressionNone || threshold <= 0 || len(msg.Data) < threshold {
+		return msg, nil
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return msg, fmt.Errorf("compress: %v", err)
+	}
+	if _, err := w.Write(msg.Data); err != nil {
+		return msg, fmt.Errorf("compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return msg, fmt.Errorf("compress: %v", err)
+	}
+	if buf.Len() >= len(msg.Data) {
+		return msg, nil
+	}
+	msg.Data = buf.Bytes()
+	msg.Compression = CompressionFlate
+	return msg, nil
+}
+
+// Decompress the data of a Msg, so that it is no larger than the maximum
+// size. The returned Msg is never compressed. Its data never refers to the
+// data of the compressed Msg.
+func Decompress(msg Msg, maxSize int) (Msg, error) {
+	switch msg.Compression {
+	case CompressionNone:
+		return msg, nil
+	case CompressionFlate:
+	default:
+		return msg, fmt.Errorf("decompress: unknown compression %v", uint8(msg.Compression))
+	}
+
+	r := flate.NewReader(bytes.NewReader(msg.Data))
+	defer r.Close()
+
+	// Read one more byte than the maximum size, so that data that is too large
+	// can be detected without decompressing all of it.
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return msg, fmt.Errorf("decompress: %v", err)
+	}
+	if len(data) > maxSize {
+		return msg, fmt.Errorf("decompress: %w", ErrDecompressedTooLarge)
+	}
+	msg.Data = data
+	msg.Compression = CompressionNone
+	return msg, nil
+}
@@ -0,0 +1,69 @@
+package wire_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	compressible := bytes.Repeat([]byte(`{"key":"value"}`), 100)
+
+	Context("when compressing a version 4 message above the threshold", func() {
+		It("should decompress to the same data", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: compressible}
+			compressed, err := wire.Compress(msg, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(compressed.Compression).To(Equal(wire.CompressionFlate))
+			Expect(len(compressed.Data)).To(BeNumerically("<", len(compressible)))
+
+			decompressed, err := wire.Decompress(compressed, len(compressible))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decompressed).To(Equal(msg))
+		})
+
+		It("should not compress data that is not compressible", func() {
+			data := make([]byte, 2048)
+			_, err := rand.Read(data)
+			Expect(err).ToNot(HaveOccurred())
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: data}
+			Expect(wire.Compress(msg, 1024)).To(Equal(msg))
+		})
+	})
+
+	Context("when compressing a message below the threshold", func() {
+		It("should not compress it", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: compressible}
+			Expect(wire.Compress(msg, len(compressible)+1)).To(Equal(msg))
+		})
+	})
+
+	Context("when compressing a version 3 message", func() {
+		It("should not compress it", func() {
+			msg := wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeSend, Data: compressible}
+			Expect(wire.Compress(msg, 1)).To(Equal(msg))
+		})
+	})
+
+	Context("when compressing a sync message", func() {
+		It("should not compress it", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSync, Data: compressible, SyncData: compressible}
+			Expect(wire.Compress(msg, 1)).To(Equal(msg))
+		})
+	})
+
+	Context("when decompressing data that is larger than the maximum size", func() {
+		It("should return an error", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: compressible}
+			compressed, err := wire.Compress(msg, 1)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = wire.Decompress(compressed, len(compressible)-1)
+			Expect(errors.Is(err, wire.ErrDecompressedTooLarge)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,116 @@
+package wire
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ContentType is the encoding of a Msg. Surge is the native encoding, and
+// other encodings exist so that peers (and debugging tools) that are not
+// written in Go can speak the protocol without implementing surge. The
+// ContentType of an encoded Msg is indicated by its first byte, so all
+// ContentTypes can be read without knowing which one was written.
+type ContentType uint8
+
+// Enumerate all valid ContentType values.
+const (
+	// ContentTypeSurge Msgs begin with the most significant byte of their
+	// version, which is always zero.
+	ContentTypeSurge = ContentType(0x00)
+	// ContentTypeProtobuf Msgs begin with the ContentType, which is followed
+	// by the Msg encoded using protobuf (see wire.proto).
+	ContentTypeProtobuf = ContentType(0x01)
+	// ContentTypeJSON Msgs are JSON objects, so they begin with '{'. Byte
+	// slices are encoded using base64.
+	ContentTypeJSON = ContentType('{')
+)
+
+// String returns a human-readable representation of the ContentType.
+func (contentType ContentType) String() string {
+	switch contentType {
+	case ContentTypeSurge:
+		return "surge"
+	case ContentTypeProtobuf:
+		return "protobuf"
+	case ContentTypeJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// ContentTypeOf returns the ContentType of an encoded Msg.
+func ContentTypeOf(data []byte) ContentType {
+	if len(data) == 0 {
+		return ContentTypeSurge
+	}
+	return ContentType(data[0])
+}
+
+// MarshalContent encodes a Msg using the ContentType. Only the fields that are
+// sent on-the-wire by the version of the Msg are encoded, no matter the
+// ContentType, and the sync data is never encoded (it is written separately,
+// after the Msg).
+func MarshalContent(msg Msg, contentType ContentType) ([]byte, error) {
+	msg = msg.onTheWire()
+	switch contentType {
+	case ContentTypeSurge:
+		buf := make([]byte, msg.SizeHint())
+		if _, _, err := msg.Marshal(buf, len(buf)); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	case ContentTypeProtobuf:
+		return marshalProto(msg, []byte{byte(ContentTypeProtobuf)}), nil
+	case ContentTypeJSON:
+		return json.Marshal(msg)
+	default:
+		return nil, fmt.Errorf("marshal: unknown content type %v", uint8(contentType))
+	}
+}
+
+// UnmarshalContent decodes a Msg, using the ContentType indicated by its first
+// byte. The data of the Msg never refers to the encoded Msg.
+func UnmarshalContent(data []byte) (Msg, error) {
+	msg := Msg{}
+	switch contentType := ContentTypeOf(data); contentType {
+	case ContentTypeSurge:
+		if _, _, err := msg.Unmarshal(data, len(data)); err != nil {
+			return Msg{}, err
+		}
+		return msg, nil
+	case ContentTypeProtobuf:
+		if err := unmarshalProto(&msg, data[1:]); err != nil {
+			return Msg{}, fmt.Errorf("unmarshal protobuf: %w", err)
+		}
+	case ContentTypeJSON:
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return Msg{}, fmt.Errorf("unmarshal json: %v", err)
+		}
+	default:
+		return Msg{}, fmt.Errorf("unmarshal: unknown content type %v", uint8(contentType))
+	}
+	if msg.Version > MsgVersion5 {
+		return Msg{}, fmt.Errorf("unmarshal version: %w: %v", ErrBadVersion, msg.Version)
+	}
+	return msg.onTheWire(), nil
+}
+
+// onTheWire returns a copy of the Msg without the fields that are not sent
+// on-the-wire by its version.
+func (msg Msg) onTheWire() Msg {
+	if msg.Version < MsgVersion2 {
+		msg.Stream = 0
+	}
+	if msg.Version < MsgVersion3 {
+		msg.Trace = TraceContext{}
+	}
+	if msg.Version < MsgVersion4 {
+		msg.Compression = CompressionNone
+	}
+	if msg.Version < MsgVersion5 {
+		msg.Headers = nil
+	}
+	msg.SyncData = nil
+	return msg
+}
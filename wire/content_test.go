@@ -0,0 +1,85 @@
+package wire_test
+
+import (
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Content types", func() {
+	msg := wire.Msg{
+		Version:     wire.MsgVersion5,
+		Type:        wire.MsgTypeSend,
+		Stream:      3,
+		To:          id.NewHash([]byte("to")),
+		Data:        []byte("hello"),
+		Trace:       wire.TraceContext{TraceID: [16]byte{1}, SpanID: [8]byte{2}, Flags: wire.TraceFlagSampled},
+		Compression: wire.CompressionFlate,
+	}.WithHeader(wire.HeaderTypeApplication, []byte("value"))
+
+	for _, contentType := range []wire.ContentType{wire.ContentTypeSurge, wire.ContentTypeProtobuf, wire.ContentTypeJSON} {
+		contentType := contentType
+
+		Context("when marshaling a message using "+contentType.String(), func() {
+			It("should unmarshal to the same message", func() {
+				data, err := wire.MarshalContent(msg, contentType)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wire.ContentTypeOf(data)).To(Equal(contentType))
+
+				unmarshaled, err := wire.UnmarshalContent(data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(unmarshaled).To(Equal(msg))
+			})
+
+			It("should drop the fields that are not sent by the version", func() {
+				old := msg
+				old.Version = wire.MsgVersion1
+				old.SyncData = []byte("sync")
+				data, err := wire.MarshalContent(old, contentType)
+				Expect(err).ToNot(HaveOccurred())
+
+				unmarshaled, err := wire.UnmarshalContent(data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(unmarshaled).To(Equal(wire.Msg{Version: wire.MsgVersion1, Type: msg.Type, To: msg.To, Data: msg.Data}))
+			})
+		})
+	}
+
+	Context("when unmarshaling a message using protobuf", func() {
+		It("should skip unknown fields", func() {
+			data := []byte{
+				byte(wire.ContentTypeProtobuf),
+				0x08, 0x01, // version = 1
+				0x10, 0x04, // type = 4
+				0x2A, 0x02, 'h', 'i', // data = "hi"
+				0x78, 0x2A, // unknown varint field 15
+				0x82, 0x01, 0x01, 0xFF, // unknown bytes field 16
+			}
+			unmarshaled, err := wire.UnmarshalContent(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshaled).To(Equal(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hi")}))
+		})
+
+		It("should return an error if it is truncated", func() {
+			_, err := wire.UnmarshalContent([]byte{byte(wire.ContentTypeProtobuf), 0x2A, 0x05, 'h', 'i'})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when unmarshaling a message using JSON", func() {
+		It("should decode byte slices from base64", func() {
+			unmarshaled, err := wire.UnmarshalContent([]byte(`{"version":1,"type":4,"data":"aGk="}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshaled).To(Equal(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hi")}))
+		})
+	})
+
+	Context("when unmarshaling a message of an unknown content type", func() {
+		It("should return an error", func() {
+			_, err := wire.UnmarshalContent([]byte{0xFF, 0x00})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -1,5 +1,39 @@
 package wire
 
+import (
+	"errors"
+	"fmt"
+
+	"github.com/renproject/surge"
+)
+
+// Errors returned when unmarshaling fails. They are wrapped with the field
+// that could not be unmarshaled, so they must be compared using errors.Is.
+var (
+	// ErrTruncated is returned when the buffer ends before the value that is
+	// being unmarshaled.
+	ErrTruncated = errors.New("truncated")
+	// ErrTooLarge is returned when a length is larger than surge.MaxBytes, or
+	// the remaining number of bytes that can be allocated.
+	ErrTooLarge = errors.New("too large")
+	// ErrBadVersion is returned when the version of a Msg is newer than all
+	// versions that are known, so the rest of the Msg cannot be unmarshaled.
+	ErrBadVersion = errors.New("bad version")
+)
+
+// unmarshalErr wraps an error with the field that could not be unmarshaled.
+// Errors returned by surge are replaced by the equivalent ErrTruncated, or
+// ErrTooLarge.
+func unmarshalErr(field string, err error) error {
+	switch {
+	case errors.Is(err, surge.ErrUnexpectedEndOfBuffer):
+		err = ErrTruncated
+	case errors.Is(err, surge.ErrLengthOverflow):
+		err = ErrTooLarge
+	}
+	return fmt.Errorf("unmarshal %v: %w", field, err)
+}
+
 // NegligibleError are errors can be ignored by the logger.
 type NegligibleError struct {
 	Err error
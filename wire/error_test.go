@@ -0,0 +1,87 @@
+package wire_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unmarshaling errors", func() {
+	msg := wire.Msg{
+		Version: wire.MsgVersion5,
+		Type:    wire.MsgTypeSend,
+		Stream:  1,
+		To:      id.NewHash([]byte("to")),
+		Data:    []byte("hello"),
+	}.WithHeader(wire.HeaderTypeApplication, []byte("value"))
+
+	marshal := func(msg wire.Msg) []byte {
+		buf := make([]byte, msg.SizeHint())
+		_, _, err := msg.Marshal(buf, len(buf))
+		Expect(err).ToNot(HaveOccurred())
+		return buf
+	}
+
+	Context("when the buffer is truncated", func() {
+		It("should return ErrTruncated", func() {
+			data := marshal(msg)
+			for i := 0; i < len(data); i++ {
+				unmarshaled := wire.Msg{}
+				_, _, err := unmarshaled.Unmarshal(data[:i], i)
+				Expect(errors.Is(err, wire.ErrTruncated)).To(BeTrue(), "length %v: %v", i, err)
+			}
+		})
+	})
+
+	Context("when a length is too large", func() {
+		It("should return ErrTooLarge", func() {
+			data := marshal(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")})
+			binary.BigEndian.PutUint32(data[len(data)-9:], 0xFFFFFFFF)
+			unmarshaled := wire.Msg{}
+			_, _, err := unmarshaled.Unmarshal(data, len(data))
+			Expect(errors.Is(err, wire.ErrTooLarge)).To(BeTrue())
+
+			// The length is also limited by the number of bytes that can be
+			// allocated.
+			data = marshal(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")})
+			_, _, err = unmarshaled.Unmarshal(data, len(data)-1)
+			Expect(errors.Is(err, wire.ErrTooLarge)).To(BeTrue())
+		})
+	})
+
+	Context("when the version is unknown", func() {
+		It("should return ErrBadVersion", func() {
+			data := marshal(msg)
+			binary.BigEndian.PutUint16(data, wire.MsgVersion5+1)
+			unmarshaled := wire.Msg{}
+			_, _, err := unmarshaled.Unmarshal(data, len(data))
+			Expect(errors.Is(err, wire.ErrBadVersion)).To(BeTrue())
+		})
+	})
+
+	Context("when the message is corrupted", func() {
+		It("should not panic, and only return known errors", func() {
+			r := rand.New(rand.NewSource(1))
+			valid := marshal(msg)
+			for i := 0; i < 10000; i++ {
+				data := append([]byte{}, valid...)
+				for j := r.Intn(4); j >= 0; j-- {
+					data[r.Intn(len(data))] = byte(r.Intn(256))
+				}
+				data = data[:r.Intn(len(data)+1)]
+
+				unmarshaled := wire.Msg{}
+				_, _, err := unmarshaled.Unmarshal(data, len(data))
+				if err != nil {
+					Expect(errors.Is(err, wire.ErrTruncated) || errors.Is(err, wire.ErrTooLarge) || errors.Is(err, wire.ErrBadVersion)).To(BeTrue(), "%x: %v", data, err)
+				}
+			}
+		})
+	})
+})
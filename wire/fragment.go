@@ -0,0 +1,232 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// fragmentHeaderSize is the size of the ID of the fragmented message, the
+// index of the fragment, the total number of fragments, and the size of the
+// marshaled message.
+const fragmentHeaderSize = 8 + 4 + 4 + 4
+
+// FragmentOverhead is the number of bytes that each fragment adds to the part
+// of the marshaled message that it carries.
+var FragmentOverhead = Msg{Version: MsgVersion1, Type: MsgTypeFragment}.SizeHint() + fragmentHeaderSize
+
+var (
+	// ErrFragmentedMessageTooLarge is returned when a fragmented message is
+	// larger than the maximum size of reassembled messages.
+	ErrFragmentedMessageTooLarge = errors.New("fragmented message too large")
+	// ErrReassemblyFull is returned when a fragmented message cannot be
+	// reassembled, because the messages that are already being reassembled
+	// use all of the memory available for reassembly.
+	ErrReassemblyFull = errors.New("reassembly full")
+)
+
+// fragmentSlack is the number of bytes by which the overhead of a fragment
+// that is not encoded using surge can grow with the size of its data (for
+// example, the length of the data is a varint in protobuf).
+const fragmentSlack = 16
+
+// Fragment a Msg into MsgTypeFragment messages that are each no larger than
+// the maximum size once marshaled. The fragments must be written in order.
+// The ID must be unique among the messages that are fragmented on the same
+// network connection. Sync data is not fragmented, and must be written after
+// all of the fragments.
+func Fragment(msg Msg, maxSize int, id uint64) ([]Msg, error) {
+	return FragmentContent(msg, ContentTypeSurge, maxSize, id)
+}
+
+// FragmentContent is the same as Fragment, except that the Msg is encoded using
+// the ContentType, and the fragments are no larger than the maximum size once
+// they are also encoded using the ContentType (see MarshalContent).
+func FragmentContent(msg Msg, contentType ContentType, maxSize int, id uint64) ([]Msg, error) {
+	chunkSize, err := fragmentChunkSize(contentType, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("fragment: %v", err)
+	}
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("fragment: maximum size %v is too small for %v fragments", maxSize, contentType)
+	}
+
+	buf, err := MarshalContent(msg, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("fragment: %v", err)
+	}
+
+	// Spread the marshaled message evenly across the fragments, so that the
+	// receiver can place fragments using only their index.
+	total := (len(buf) + chunkSize - 1) / chunkSize
+	chunkSize = (len(buf) + total - 1) / total
+
+	fragments := make([]Msg, 0, total)
+	for index := 0; index < total; index++ {
+		end := (index + 1) * chunkSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		chunk := buf[index*chunkSize : end]
+		data := make([]byte, fragmentHeaderSize+len(chunk))
+		binary.BigEndian.PutUint64(data[0:8], id)
+		binary.BigEndian.PutUint32(data[8:12], uint32(index))
+		binary.BigEndian.PutUint32(data[12:16], uint32(total))
+		binary.BigEndian.PutUint32(data[16:20], uint32(len(buf)))
+		copy(data[fragmentHeaderSize:], chunk)
+		fragments = append(fragments, Msg{Version: MsgVersion1, Type: MsgTypeFragment, Data: data})
+	}
+	return fragments, nil
+}
+
+// fragmentChunkSize returns the number of bytes of the encoded Msg that each
+// fragment can carry, so that the encoded fragment is no larger than the
+// maximum size.
+func fragmentChunkSize(contentType ContentType, maxSize int) (int, error) {
+	if contentType == ContentTypeSurge {
+		return maxSize - FragmentOverhead, nil
+	}
+	empty, err := MarshalContent(Msg{Version: MsgVersion1, Type: MsgTypeFragment}, contentType)
+	if err != nil {
+		return 0, err
+	}
+	room := maxSize - len(empty) - fragmentSlack
+	if contentType == ContentTypeJSON {
+		// Byte slices are encoded using base64, so every 3 bytes of data are
+		// encoded as 4 bytes.
+		room = room / 4 * 3
+	}
+	return room - fragmentHeaderSize, nil
+}
+
+// reassembly of one fragmented message.
+type reassembly struct {
+	buf      []byte
+	total    int
+	received []bool
+	n        int
+	expiry   time.Time
+}
+
+// A Reassembler reassembles the fragments of messages (see Fragment). It
+// bounds the size of each reassembled message, the total memory used by
+// messages that are being reassembled, and the time spent waiting for the
+// fragments of each message. It is not safe for concurrent use, and is
+// expected to be used by the reader of one network connection.
+type Reassembler struct {
+	timeout  time.Duration
+	maxSize  int
+	maxBytes int
+
+	pending map[uint64]*reassembly
+	bytes   int
+}
+
+// NewReassembler returns a Reassembler that drops messages whose fragments
+// are not all added within the timeout, that rejects messages larger than the
+// maximum size, and that rejects messages while the messages being
+// reassembled use more than the maximum number of bytes.
+func NewReassembler(timeout time.Duration, maxSize, maxBytes int) *Reassembler {
+	return &Reassembler{
+		timeout:  timeout,
+		maxSize:  maxSize,
+		maxBytes: maxBytes,
+
+		pending: map[uint64]*reassembly{},
+		bytes:   0,
+	}
+}
+
+// Add a fragment. Once all fragments of a message have been added, the
+// message is unmarshaled (using the ContentType indicated by its first byte)
+// and returned, together with true. Otherwise, false
+// is returned. If the fragment is malformed, or its message cannot be
+// reassembled, an error is returned and the fragments of its message that
+// have already been added are dropped.
+func (r *Reassembler) Add(fragment Msg, now time.Time) (Msg, bool, error) {
+	r.prune(now)
+
+	if fragment.Type != MsgTypeFragment || len(fragment.Data) < fragmentHeaderSize {
+		return Msg{}, false, fmt.Errorf("reassemble: malformed fragment")
+	}
+	id := binary.BigEndian.Uint64(fragment.Data[0:8])
+	index := int(binary.BigEndian.Uint32(fragment.Data[8:12]))
+	total := int(binary.BigEndian.Uint32(fragment.Data[12:16]))
+	size := int(binary.BigEndian.Uint32(fragment.Data[16:20]))
+	chunk := fragment.Data[fragmentHeaderSize:]
+
+	re, ok := r.pending[id]
+	if !ok {
+		if total == 0 || size < total || index >= total {
+			return Msg{}, false, fmt.Errorf("reassemble: malformed fragment %v/%v of %v bytes", index, total, size)
+		}
+		if size > r.maxSize {
+			return Msg{}, false, fmt.Errorf("reassemble %v bytes: %w", size, ErrFragmentedMessageTooLarge)
+		}
+		if r.bytes+size > r.maxBytes {
+			return Msg{}, false, fmt.Errorf("reassemble %v bytes: %w", size, ErrReassemblyFull)
+		}
+		re = &reassembly{
+			buf:      make([]byte, size),
+			total:    total,
+			received: make([]bool, total),
+			n:        0,
+			expiry:   now.Add(r.timeout),
+		}
+		r.pending[id] = re
+		r.bytes += size
+	}
+
+	chunkSize := (len(re.buf) + re.total - 1) / re.total
+	start := index * chunkSize
+	end := start + chunkSize
+	if end > len(re.buf) {
+		end = len(re.buf)
+	}
+	if total != re.total || size != len(re.buf) || index >= re.total || start >= end || len(chunk) != end-start || re.received[index] {
+		r.drop(id)
+		return Msg{}, false, fmt.Errorf("reassemble: unexpected fragment %v/%v of %v bytes", index, total, size)
+	}
+	copy(re.buf[start:end], chunk)
+	re.received[index] = true
+	re.n++
+	if re.n < re.total {
+		return Msg{}, false, nil
+	}
+
+	r.drop(id)
+	msg := Msg{}
+	if ContentTypeOf(re.buf) != ContentTypeSurge {
+		var err error
+		if msg, err = UnmarshalContent(re.buf); err != nil {
+			return Msg{}, false, fmt.Errorf("reassemble: %v", err)
+		}
+	} else if _, _, err := msg.UnmarshalBorrowed(re.buf, len(re.buf)); err != nil {
+		return Msg{}, false, fmt.Errorf("reassemble: %v", err)
+	}
+	if msg.Type == MsgTypeFragment {
+		return Msg{}, false, fmt.Errorf("reassemble: nested fragment")
+	}
+	return msg, true, nil
+}
+
+// Len returns the number of messages that are being reassembled.
+func (r *Reassembler) Len() int {
+	return len(r.pending)
+}
+
+func (r *Reassembler) drop(id uint64) {
+	if re, ok := r.pending[id]; ok {
+		r.bytes -= len(re.buf)
+		delete(r.pending, id)
+	}
+}
+
+func (r *Reassembler) prune(now time.Time) {
+	for id, re := range r.pending {
+		if now.After(re.expiry) {
+			r.drop(id)
+		}
+	}
+}
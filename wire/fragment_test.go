@@ -0,0 +1,119 @@
+package wire_test
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fragmentation", func() {
+	msg := wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, Stream: 42, Data: bytes.Repeat([]byte{0xAB}, 10000)}
+
+	Context("when fragmenting a message", func() {
+		It("should produce fragments that are no larger than the maximum size", func() {
+			fragments, err := wire.Fragment(msg, 1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(fragments)).To(BeNumerically(">", 1))
+			for _, fragment := range fragments {
+				Expect(fragment.Type).To(Equal(wire.MsgTypeFragment))
+				Expect(fragment.SizeHint()).To(BeNumerically("<=", 1024))
+			}
+		})
+
+		It("should reassemble the message, even if the fragments are out of order", func() {
+			fragments, err := wire.Fragment(msg, 1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+			fragments[0], fragments[len(fragments)-1] = fragments[len(fragments)-1], fragments[0]
+
+			r := wire.NewReassembler(time.Minute, 1<<20, 1<<20)
+			now := time.Now()
+			for i, fragment := range fragments {
+				reassembled, ok, err := r.Add(fragment, now)
+				Expect(err).ToNot(HaveOccurred())
+				if i < len(fragments)-1 {
+					Expect(ok).To(BeFalse())
+					continue
+				}
+				Expect(ok).To(BeTrue())
+				Expect(reassembled).To(Equal(msg))
+			}
+			Expect(r.Len()).To(Equal(0))
+		})
+
+		It("should encode the fragments using the content type", func() {
+			for _, contentType := range []wire.ContentType{wire.ContentTypeProtobuf, wire.ContentTypeJSON} {
+				fragments, err := wire.FragmentContent(msg, contentType, 1024, 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				r := wire.NewReassembler(time.Minute, 1<<20, 1<<20)
+				now := time.Now()
+				for i, fragment := range fragments {
+					encoded, err := wire.MarshalContent(fragment, contentType)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(len(encoded)).To(BeNumerically("<=", 1024))
+
+					reassembled, ok, err := r.Add(fragment, now)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(ok).To(Equal(i == len(fragments)-1))
+					if ok {
+						Expect(reassembled).To(Equal(msg))
+					}
+				}
+			}
+		})
+
+		It("should return an error if the maximum size is too small", func() {
+			_, err := wire.Fragment(msg, wire.FragmentOverhead, 1)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when the fragmented message is too large", func() {
+		It("should return an error", func() {
+			fragments, err := wire.Fragment(msg, 1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+			r := wire.NewReassembler(time.Minute, 1000, 1<<20)
+			_, _, err = r.Add(fragments[0], time.Now())
+			Expect(errors.Is(err, wire.ErrFragmentedMessageTooLarge)).To(BeTrue())
+		})
+	})
+
+	Context("when the reassembly memory is used up", func() {
+		It("should return an error until the pending message expires", func() {
+			fragments1, err := wire.Fragment(msg, 1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+			fragments2, err := wire.Fragment(msg, 1024, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			r := wire.NewReassembler(time.Minute, 1<<20, msg.SizeHint())
+			now := time.Now()
+			_, _, err = r.Add(fragments1[0], now)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = r.Add(fragments2[0], now)
+			Expect(errors.Is(err, wire.ErrReassemblyFull)).To(BeTrue())
+
+			// Once the timeout has passed, the first message is dropped.
+			_, _, err = r.Add(fragments2[0], now.Add(2*time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(r.Len()).To(Equal(1))
+		})
+	})
+
+	Context("when a fragment is added twice", func() {
+		It("should drop the message", func() {
+			fragments, err := wire.Fragment(msg, 1024, 1)
+			Expect(err).ToNot(HaveOccurred())
+			r := wire.NewReassembler(time.Minute, 1<<20, 1<<20)
+			_, _, err = r.Add(fragments[0], time.Now())
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = r.Add(fragments[0], time.Now())
+			Expect(err).To(HaveOccurred())
+			Expect(r.Len()).To(Equal(0))
+		})
+	})
+})
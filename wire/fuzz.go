@@ -0,0 +1,51 @@
+//go:build gofuzz
+// +build gofuzz
+
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Fuzz is the go-fuzz target for unmarshaling a Msg (see
+// https://github.com/dvyukov/go-fuzz). Build it using
+//
+//	go-fuzz-build -tags gofuzz github.com/renproject/aw/wire
+//
+// It panics if unmarshaling fails with an error that is not ErrTruncated,
+// ErrTooLarge, or ErrBadVersion, or if a Msg does not marshal back to the bytes
+// from which it was unmarshaled. Batches, and other content types, are also
+// unmarshaled, so that they are checked for panics.
+func Fuzz(data []byte) int {
+	if _, err := UnmarshalContent(data); err != nil && ContentTypeOf(data) != ContentTypeSurge {
+		return 0
+	}
+
+	msg := Msg{}
+	tail, _, err := msg.Unmarshal(data, len(data))
+	if err != nil {
+		if !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrTooLarge) && !errors.Is(err, ErrBadVersion) {
+			panic(fmt.Sprintf("unexpected error: %v", err))
+		}
+		return 0
+	}
+	borrowed := Msg{}
+	if _, _, err := borrowed.UnmarshalBorrowed(data, len(data)); err != nil {
+		panic(fmt.Sprintf("unexpected error when borrowing: %v", err))
+	}
+
+	buf := make([]byte, msg.SizeHint())
+	if _, _, err := msg.Marshal(buf, len(buf)); err != nil {
+		panic(fmt.Sprintf("marshal: %v", err))
+	}
+	if consumed := data[:len(data)-len(tail)]; !bytes.Equal(buf, consumed) {
+		panic(fmt.Sprintf("expected %x, got %x", consumed, buf))
+	}
+
+	if msg.Type == MsgTypeBatch {
+		Unbatch(msg)
+	}
+	return 1
+}
@@ -0,0 +1,125 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/renproject/surge"
+)
+
+// HeaderTypeApplication is the first Header type that is reserved for
+// applications. Header types below it are reserved for airwave.
+const HeaderTypeApplication = uint16(0x8000)
+
+const (
+	// maxHeaders is the maximum number of Headers of a Msg.
+	maxHeaders = 255
+	// maxHeaderValueSize is the maximum size of the value of a Header.
+	maxHeaderValueSize = 65535
+)
+
+// A Header is a type-length-value extension of the header of a Msg. Receivers
+// ignore the Headers whose types they do not know, so new types of Headers can
+// be sent to remote peers that do not know about them. A Msg has at most 255
+// Headers, and each value is at most 65535 bytes.
+type Header struct {
+	Type  uint16 `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// Header returns the value of the first Header of a type, and true, or false
+// if the Msg has no Header of the type.
+func (msg Msg) Header(headerType uint16) ([]byte, bool) {
+	for _, header := range msg.Headers {
+		if header.Type == headerType {
+			return header.Value, true
+		}
+	}
+	return nil, false
+}
+
+// WithHeader returns a copy of the Msg with a Header of a type, replacing any
+// existing Headers of the same type. The Headers of the original Msg are not
+// changed. Headers are only sent to remote peers that use MsgVersion5.
+func (msg Msg) WithHeader(headerType uint16, value []byte) Msg {
+	headers := make([]Header, 0, len(msg.Headers)+1)
+	for _, header := range msg.Headers {
+		if header.Type != headerType {
+			headers = append(headers, header)
+		}
+	}
+	msg.Headers = append(headers, Header{Type: headerType, Value: value})
+	return msg
+}
+
+func sizeHintHeaders(headers []Header) int {
+	size := surge.SizeHintU8
+	for _, header := range headers {
+		size += surge.SizeHintU16 + surge.SizeHintU16 + len(header.Value)
+	}
+	return size
+}
+
+func marshalHeaders(headers []Header, buf []byte, rem int) ([]byte, int, error) {
+	if len(headers) > maxHeaders {
+		return buf, rem, fmt.Errorf("expected at most %v headers, got %v", maxHeaders, len(headers))
+	}
+	buf, rem, err := surge.MarshalU8(uint8(len(headers)), buf, rem)
+	if err != nil {
+		return buf, rem, err
+	}
+	for _, header := range headers {
+		if len(header.Value) > maxHeaderValueSize {
+			return buf, rem, fmt.Errorf("header %v: expected at most %v bytes, got %v bytes", header.Type, maxHeaderValueSize, len(header.Value))
+		}
+		if buf, rem, err = surge.MarshalU16(header.Type, buf, rem); err != nil {
+			return buf, rem, err
+		}
+		if buf, rem, err = surge.MarshalU16(uint16(len(header.Value)), buf, rem); err != nil {
+			return buf, rem, err
+		}
+		if len(buf) < len(header.Value) || rem < len(header.Value) {
+			return buf, rem, surge.ErrUnexpectedEndOfBuffer
+		}
+		copy(buf, header.Value)
+		buf, rem = buf[len(header.Value):], rem-len(header.Value)
+	}
+	return buf, rem, nil
+}
+
+func unmarshalHeaders(headers *[]Header, buf []byte, rem int) ([]byte, int, error) {
+	n := uint8(0)
+	buf, rem, err := surge.UnmarshalU8(&n, buf, rem)
+	if err != nil {
+		return buf, rem, err
+	}
+	if n == 0 {
+		*headers = nil
+		return buf, rem, nil
+	}
+	// Every Header is at least 4 bytes, so the Headers are not allocated
+	// unless the buffer is large enough.
+	if len(buf) < 4*int(n) {
+		return buf, rem, fmt.Errorf("%w: expected at least %v bytes, got %v bytes", ErrTruncated, 4*int(n), len(buf))
+	}
+	*headers = make([]Header, n)
+	for i := range *headers {
+		header := &(*headers)[i]
+		if buf, rem, err = surge.UnmarshalU16(&header.Type, buf, rem); err != nil {
+			return buf, rem, err
+		}
+		size := uint16(0)
+		if buf, rem, err = surge.UnmarshalU16(&size, buf, rem); err != nil {
+			return buf, rem, err
+		}
+		if len(buf) < int(size) {
+			return buf, rem, fmt.Errorf("%w: expected %v bytes, got %v bytes", ErrTruncated, size, len(buf))
+		}
+		if rem < int(size) {
+			return buf, rem, fmt.Errorf("%w: %v bytes", ErrTooLarge, size)
+		}
+		header.Value = make([]byte, size)
+		copy(header.Value, buf)
+		buf, rem = buf[size:], rem-int(size)
+	}
+	return buf, rem, nil
+}
@@ -0,0 +1,84 @@
+package wire_test
+
+import (
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Headers", func() {
+	appHeader := wire.HeaderTypeApplication + 1
+
+	marshal := func(msg wire.Msg) ([]byte, error) {
+		buf := make([]byte, msg.SizeHint())
+		_, rem, err := msg.Marshal(buf, len(buf))
+		if err == nil {
+			Expect(rem).To(Equal(0))
+		}
+		return buf, err
+	}
+
+	Context("when marshaling a version 5 message", func() {
+		It("should include the headers", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend, Data: []byte("hello")}.
+				WithHeader(appHeader, []byte("value")).
+				WithHeader(42, []byte{})
+			buf, err := marshal(msg)
+			Expect(err).ToNot(HaveOccurred())
+
+			unmarshaled := wire.Msg{}
+			_, _, err = unmarshaled.Unmarshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshaled).To(Equal(msg))
+
+			// Headers of unknown types are kept, so that applications can
+			// read them.
+			value, ok := unmarshaled.Header(appHeader)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]byte("value")))
+			_, ok = unmarshaled.Header(appHeader + 1)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should return an error if there are too many headers", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend}
+			for i := 0; i < 256; i++ {
+				msg.Headers = append(msg.Headers, wire.Header{Type: uint16(i)})
+			}
+			_, err := marshal(msg)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error if a header value is too large", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypeSend}.WithHeader(appHeader, make([]byte, 65536))
+			_, err := marshal(msg)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when marshaling a version 4 message", func() {
+		It("should not include the headers", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Data: []byte("hello")}.WithHeader(appHeader, []byte("value"))
+			buf, err := marshal(msg)
+			Expect(err).ToNot(HaveOccurred())
+
+			unmarshaled := wire.Msg{}
+			_, _, err = unmarshaled.Unmarshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshaled.Headers).To(BeEmpty())
+		})
+	})
+
+	Context("when setting a header", func() {
+		It("should replace existing headers of the same type without changing the original message", func() {
+			original := wire.Msg{Version: wire.MsgVersion5}.WithHeader(appHeader, []byte("a"))
+			changed := original.WithHeader(appHeader, []byte("b"))
+			Expect(changed.Headers).To(HaveLen(1))
+			value, _ := changed.Header(appHeader)
+			Expect(value).To(Equal([]byte("b")))
+			value, _ = original.Header(appHeader)
+			Expect(value).To(Equal([]byte("a")))
+		})
+	})
+})
@@ -0,0 +1,52 @@
+package wire
+
+// HeaderTypeHops is the Header type of the Hops of a Msg. Its value is the TTL
+// of the Msg, followed by its hop count.
+const HeaderTypeHops = uint16(1)
+
+// Hops bound how far a Msg travels when it is relayed between peers (for
+// example, when gossiping). The TTL is the number of times that the Msg can
+// still be received, and the Count is the number of times that it has been
+// received. Receiving Channels drop a Msg whose TTL is zero, and decrement the
+// TTL (and increment the Count) of all other Msgs, so relays that forward the
+// Hops of the Msg that they received cannot loop forever. Msgs without Hops
+// are not bounded.
+type Hops struct {
+	TTL   uint8 `json:"ttl"`
+	Count uint8 `json:"count"`
+}
+
+// Hops returns the Hops of a Msg, and true, or false if the Msg has no Hops (or
+// they are malformed).
+func (msg Msg) Hops() (Hops, bool) {
+	value, ok := msg.Header(HeaderTypeHops)
+	if !ok || len(value) != 2 {
+		return Hops{}, false
+	}
+	return Hops{TTL: value[0], Count: value[1]}, true
+}
+
+// WithHops returns a copy of the Msg with the Hops. Like all Headers, Hops are
+// only sent to remote peers that use MsgVersion5.
+func (msg Msg) WithHops(hops Hops) Msg {
+	return msg.WithHeader(HeaderTypeHops, []byte{hops.TTL, hops.Count})
+}
+
+// Hop returns a copy of a received Msg with its TTL decremented, and its hop
+// count incremented, and true. It returns false if the TTL of the Msg is zero,
+// in which case the Msg has expired, and must be dropped. Msgs without Hops
+// are returned unchanged.
+func (msg Msg) Hop() (Msg, bool) {
+	hops, ok := msg.Hops()
+	if !ok {
+		return msg, true
+	}
+	if hops.TTL == 0 {
+		return msg, false
+	}
+	hops.TTL--
+	if hops.Count < 255 {
+		hops.Count++
+	}
+	return msg.WithHops(hops), true
+}
@@ -0,0 +1,55 @@
+package wire_test
+
+import (
+	"github.com/renproject/aw/wire"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hops", func() {
+	Context("when a message with a TTL is received", func() {
+		It("should decrement the TTL, and increment the hop count", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypePush}.WithHops(wire.Hops{TTL: 2})
+
+			msg, ok := msg.Hop()
+			Expect(ok).To(BeTrue())
+			hops, ok := msg.Hops()
+			Expect(ok).To(BeTrue())
+			Expect(hops).To(Equal(wire.Hops{TTL: 1, Count: 1}))
+
+			msg, ok = msg.Hop()
+			Expect(ok).To(BeTrue())
+			hops, _ = msg.Hops()
+			Expect(hops).To(Equal(wire.Hops{TTL: 0, Count: 2}))
+
+			_, ok = msg.Hop()
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should keep the hops when marshaling", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypePush, Data: []byte("id")}.WithHops(wire.Hops{TTL: 3, Count: 4})
+			buf := make([]byte, msg.SizeHint())
+			_, _, err := msg.Marshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+
+			unmarshaled := wire.Msg{}
+			_, _, err = unmarshaled.Unmarshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			hops, ok := unmarshaled.Hops()
+			Expect(ok).To(BeTrue())
+			Expect(hops).To(Equal(wire.Hops{TTL: 3, Count: 4}))
+		})
+	})
+
+	Context("when a message without a TTL is received", func() {
+		It("should not change it", func() {
+			msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypePush}
+			hopped, ok := msg.Hop()
+			Expect(ok).To(BeTrue())
+			Expect(hopped).To(Equal(msg))
+			_, ok = hopped.Hops()
+			Expect(ok).To(BeFalse())
+		})
+	})
+})
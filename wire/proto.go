@@ -0,0 +1,215 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/renproject/id"
+)
+
+// Protobuf wire types (see https://developers.google.com/protocol-buffers/docs/encoding).
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Field numbers of the protobuf encoding of a Msg (see wire.proto).
+const (
+	protoMsgVersion     = 1
+	protoMsgType        = 2
+	protoMsgStream      = 3
+	protoMsgTo          = 4
+	protoMsgData        = 5
+	protoMsgTraceID     = 6
+	protoMsgSpanID      = 7
+	protoMsgTraceFlags  = 8
+	protoMsgCompression = 9
+	protoMsgHeaders     = 10
+
+	protoHeaderType  = 1
+	protoHeaderValue = 2
+)
+
+// marshalProto appends the protobuf encoding of a Msg to the buffer. Like
+// proto3, fields with zero values are not encoded.
+func marshalProto(msg Msg, buf []byte) []byte {
+	buf = appendProtoVarint(buf, protoMsgVersion, uint64(msg.Version))
+	buf = appendProtoVarint(buf, protoMsgType, uint64(msg.Type))
+	buf = appendProtoVarint(buf, protoMsgStream, uint64(msg.Stream))
+	if msg.To != (id.Hash{}) {
+		buf = appendProtoBytes(buf, protoMsgTo, msg.To[:])
+	}
+	buf = appendProtoBytes(buf, protoMsgData, msg.Data)
+	if msg.Trace != (TraceContext{}) {
+		buf = appendProtoBytes(buf, protoMsgTraceID, msg.Trace.TraceID[:])
+		buf = appendProtoBytes(buf, protoMsgSpanID, msg.Trace.SpanID[:])
+		buf = appendProtoVarint(buf, protoMsgTraceFlags, uint64(msg.Trace.Flags))
+	}
+	buf = appendProtoVarint(buf, protoMsgCompression, uint64(msg.Compression))
+	for _, header := range msg.Headers {
+		var encoded []byte
+		encoded = appendProtoVarint(encoded, protoHeaderType, uint64(header.Type))
+		encoded = appendProtoBytes(encoded, protoHeaderValue, header.Value)
+		buf = appendProtoTag(buf, protoMsgHeaders, protoBytes)
+		buf = appendUvarint(buf, uint64(len(encoded)))
+		buf = append(buf, encoded...)
+	}
+	return buf
+}
+
+// unmarshalProto decodes the protobuf encoding of a Msg. Unknown fields are
+// skipped, so that fields can be added to the encoding without breaking older
+// peers.
+func unmarshalProto(msg *Msg, buf []byte) error {
+	return forEachProtoField(buf, func(field int, varint uint64, value []byte) error {
+		var err error
+		switch field {
+		case protoMsgVersion:
+			msg.Version, err = protoU16(varint)
+		case protoMsgType:
+			msg.Type, err = protoU16(varint)
+		case protoMsgStream:
+			msg.Stream, err = protoU16(varint)
+		case protoMsgTo:
+			err = protoArray(msg.To[:], value)
+		case protoMsgData:
+			msg.Data = append([]byte{}, value...)
+		case protoMsgTraceID:
+			err = protoArray(msg.Trace.TraceID[:], value)
+		case protoMsgSpanID:
+			err = protoArray(msg.Trace.SpanID[:], value)
+		case protoMsgTraceFlags:
+			msg.Trace.Flags, err = protoU8(varint)
+		case protoMsgCompression:
+			var compression uint8
+			compression, err = protoU8(varint)
+			msg.Compression = Compression(compression)
+		case protoMsgHeaders:
+			if len(msg.Headers) >= maxHeaders {
+				return fmt.Errorf("%w: expected at most %v headers", ErrTooLarge, maxHeaders)
+			}
+			header := Header{}
+			err = forEachProtoField(value, func(field int, varint uint64, value []byte) error {
+				var err error
+				switch field {
+				case protoHeaderType:
+					header.Type, err = protoU16(varint)
+				case protoHeaderValue:
+					if len(value) > maxHeaderValueSize {
+						return fmt.Errorf("header %v: %w: expected at most %v bytes, got %v bytes", header.Type, ErrTooLarge, maxHeaderValueSize, len(value))
+					}
+					header.Value = append([]byte{}, value...)
+				}
+				return err
+			})
+			msg.Headers = append(msg.Headers, header)
+		}
+		if err != nil {
+			return fmt.Errorf("field %v: %w", field, err)
+		}
+		return nil
+	})
+}
+
+// forEachProtoField calls the function with the number, and the value, of each
+// field of a protobuf message. Varints are passed as integers, and
+// length-delimited values are passed as bytes. Fixed-size values are skipped.
+func forEachProtoField(buf []byte, f func(field int, varint uint64, value []byte) error) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrTruncated
+		}
+		buf = buf[n:]
+		field := tag >> 3
+		if field == 0 || field > math.MaxInt32 {
+			return fmt.Errorf("bad field %v", field)
+		}
+
+		var varint uint64
+		var value []byte
+		switch wireType := tag & 0x7; wireType {
+		case protoVarint:
+			if varint, n = binary.Uvarint(buf); n <= 0 {
+				return ErrTruncated
+			}
+			buf = buf[n:]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wireType == protoFixed32 {
+				size = 4
+			}
+			if len(buf) < size {
+				return ErrTruncated
+			}
+			buf = buf[size:]
+			continue
+		case protoBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return ErrTruncated
+			}
+			value = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		default:
+			return fmt.Errorf("field %v: unsupported wire type %v", field, wireType)
+		}
+		if err := f(int(field), varint, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendProtoTag(buf []byte, field int, wireType int) []byte {
+	return appendUvarint(buf, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(buf []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendProtoTag(buf, field, protoVarint)
+	return appendUvarint(buf, value)
+}
+
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return buf
+	}
+	buf = appendProtoTag(buf, field, protoBytes)
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func protoU16(varint uint64) (uint16, error) {
+	if varint > math.MaxUint16 {
+		return 0, fmt.Errorf("expected at most %v, got %v", math.MaxUint16, varint)
+	}
+	return uint16(varint), nil
+}
+
+func protoU8(varint uint64) (uint8, error) {
+	if varint > math.MaxUint8 {
+		return 0, fmt.Errorf("expected at most %v, got %v", math.MaxUint8, varint)
+	}
+	return uint8(varint), nil
+}
+
+// protoArray copies a length-delimited value into a fixed-size array.
+func protoArray(dst []byte, value []byte) error {
+	if len(value) != len(dst) {
+		return fmt.Errorf("expected %v bytes, got %v bytes", len(dst), len(value))
+	}
+	copy(dst, value)
+	return nil
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(buf, varint[:n]...)
+}
@@ -0,0 +1,155 @@
+package wire
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An AddressCodec interprets the values of Addresses that use a specific
+// Protocol. Registering AddressCodecs for new Protocols allows peers that use
+// different address formats to exchange, and dial, each others addresses (for
+// example, while migrating a network from one format to another).
+type AddressCodec interface {
+	// Validate returns an error if the value is malformed.
+	Validate(value string) error
+	// Dialable returns the network (for example, "tcp") and network address
+	// that can be dialed to reach a peer at the value.
+	Dialable(value string) (string, string, error)
+}
+
+type protocolInfo struct {
+	name  string
+	codec AddressCodec
+}
+
+var (
+	protocolsMu     = new(sync.RWMutex)
+	protocols       = map[Protocol]protocolInfo{}
+	protocolsByName = map[string]Protocol{}
+)
+
+func init() {
+	mustRegisterProtocol(TCP, "tcp", HostPortCodec("tcp"))
+	mustRegisterProtocol(UDP, "udp", HostPortCodec("udp"))
+	mustRegisterProtocol(WebSocket, "ws", HostPortCodec("tcp"))
+	mustRegisterProtocol(Multiaddr, "multiaddr", MultiaddrCodec{})
+}
+
+// RegisterProtocol registers the name, and the AddressCodec, of a Protocol.
+// The name is used when converting Addresses to, and from, strings. An error is
+// returned if the Protocol, or the name, has already been registered.
+// Protocols are usually registered during initialisation.
+func RegisterProtocol(protocol Protocol, name string, codec AddressCodec) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid protocol name %q", name)
+	}
+
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+
+	if _, ok := protocols[protocol]; ok {
+		return fmt.Errorf("protocol %v already registered", uint8(protocol))
+	}
+	if _, ok := protocolsByName[name]; ok {
+		return fmt.Errorf("protocol %v already registered", name)
+	}
+	protocols[protocol] = protocolInfo{name: name, codec: codec}
+	protocolsByName[name] = protocol
+	return nil
+}
+
+func mustRegisterProtocol(protocol Protocol, name string, codec AddressCodec) {
+	if err := RegisterProtocol(protocol, name, codec); err != nil {
+		panic(err)
+	}
+}
+
+// ProtocolByName returns the Protocol that was registered with a name, and
+// false if no such Protocol has been registered.
+func ProtocolByName(name string) (Protocol, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	protocol, ok := protocolsByName[name]
+	return protocol, ok
+}
+
+// Codec returns the AddressCodec registered for the Protocol, and false if the
+// Protocol has not been registered.
+func (p Protocol) Codec() (AddressCodec, bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+
+	info, ok := protocols[p]
+	return info.codec, ok
+}
+
+// Dialable returns the network and network address that can be dialed to reach
+// the peer at the Address. An error is returned if the Protocol of the Address
+// is not registered, or if the value of the Address is malformed. Addresses
+// with unregistered Protocols can still be stored and gossiped, but they cannot
+// be dialed.
+func (addr Address) Dialable() (string, string, error) {
+	codec, ok := addr.Protocol.Codec()
+	if !ok {
+		return "", "", fmt.Errorf("unknown protocol %v", uint8(addr.Protocol))
+	}
+	return codec.Dialable(addr.Value)
+}
+
+// HostPortCodec is an AddressCodec for values of the form "host:port" that are
+// dialed using a fixed network.
+type HostPortCodec string
+
+// Validate that the value is of the form "host:port".
+func (codec HostPortCodec) Validate(value string) error {
+	_, _, err := net.SplitHostPort(value)
+	return err
+}
+
+// Dialable returns the network of the HostPortCodec, and the value unchanged.
+func (codec HostPortCodec) Dialable(value string) (string, string, error) {
+	if err := codec.Validate(value); err != nil {
+		return "", "", err
+	}
+	return string(codec), value, nil
+}
+
+// MultiaddrCodec is an AddressCodec for the subset of multiaddrs that are
+// needed to describe TCP addresses; for example, "/ip4/127.0.0.1/tcp/3333" or
+// "/dns4/example.com/tcp/3333".
+type MultiaddrCodec struct{}
+
+// Validate that the value is a supported multiaddr.
+func (codec MultiaddrCodec) Validate(value string) error {
+	_, _, err := codec.Dialable(value)
+	return err
+}
+
+// Dialable converts the multiaddr into a TCP network address.
+func (codec MultiaddrCodec) Dialable(value string) (string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(value, "/"), "/")
+	if len(parts) != 4 || parts[2] != "tcp" {
+		return "", "", fmt.Errorf("unsupported multiaddr %v", value)
+	}
+	host := parts[1]
+	switch parts[0] {
+	case "ip4", "ip6":
+		if net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("invalid ip %v in multiaddr %v", host, value)
+		}
+	case "dns", "dns4", "dns6":
+		if host == "" {
+			return "", "", fmt.Errorf("empty host in multiaddr %v", value)
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported multiaddr %v", value)
+	}
+	if _, err := strconv.ParseUint(parts[3], 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid port %v in multiaddr %v", parts[3], value)
+	}
+	return "tcp", net.JoinHostPort(host, parts[3]), nil
+}
@@ -0,0 +1,61 @@
+package wire_test
+
+import (
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Protocols", func() {
+	Context("when dialing a multiaddr address", func() {
+		It("should convert it to a tcp network address", func() {
+			addr := wire.NewUnsignedAddress(wire.Multiaddr, "/ip4/127.0.0.1/tcp/3333", 1)
+			network, value, err := addr.Dialable()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(network).To(Equal("tcp"))
+			Expect(value).To(Equal("127.0.0.1:3333"))
+
+			addr = wire.NewUnsignedAddress(wire.Multiaddr, "/ip4/127.0.0.1/udp/3333", 1)
+			_, _, err = addr.Dialable()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when encoding a multiaddr address as a string", func() {
+		It("should decode the same address", func() {
+			addr := wire.NewUnsignedAddress(wire.Multiaddr, "/dns4/example.com/tcp/3333", 1)
+			Expect(addr.Sign(id.NewPrivKey())).To(Succeed())
+
+			decoded, err := wire.DecodeString(addr.String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.Equal(&addr)).To(BeTrue())
+		})
+	})
+
+	Context("when registering a protocol", func() {
+		It("should be usable by addresses", func() {
+			protocol := wire.Protocol(200)
+			Expect(wire.RegisterProtocol(protocol, "test", wire.HostPortCodec("tcp"))).To(Succeed())
+			Expect(protocol.String()).To(Equal("test"))
+
+			addr := wire.NewUnsignedAddress(protocol, "localhost:3333", 1)
+			Expect(addr.Sign(id.NewPrivKey())).To(Succeed())
+			decoded, err := wire.DecodeString(addr.String())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.Equal(&addr)).To(BeTrue())
+
+			Expect(wire.RegisterProtocol(protocol, "other", wire.HostPortCodec("tcp"))).ToNot(Succeed())
+			Expect(wire.RegisterProtocol(wire.Protocol(201), "tcp", wire.HostPortCodec("tcp"))).ToNot(Succeed())
+		})
+	})
+
+	Context("when the protocol is not registered", func() {
+		It("should not be dialable", func() {
+			addr := wire.NewUnsignedAddress(wire.Protocol(250), "localhost:3333", 1)
+			_, _, err := addr.Dialable()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,112 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/renproject/surge"
+)
+
+// Req is a request that expects a Resp from the remote peer. The ID correlates
+// the Req with its Resp, and is chosen by the sender.
+type Req struct {
+	ID   uint64 `json:"id"`
+	Data []byte `json:"data"`
+}
+
+// SizeHint returns the number of bytes required to represent a Req in binary.
+func (req Req) SizeHint() int {
+	return surge.SizeHintU64 + surge.SizeHintBytes(req.Data)
+}
+
+// Marshal a Req to binary.
+func (req Req) Marshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := surge.MarshalU64(req.ID, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal id: %v", err)
+	}
+	buf, rem, err = surge.MarshalBytes(req.Data, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal data: %v", err)
+	}
+	return buf, rem, err
+}
+
+// Unmarshal a Req from binary.
+func (req *Req) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := surge.UnmarshalU64(&req.ID, buf, rem)
+	if err != nil {
+		return buf, rem, unmarshalErr("id", err)
+	}
+	buf, rem, err = unmarshalBytes(&req.Data, buf, rem, false)
+	if err != nil {
+		return buf, rem, unmarshalErr("data", err)
+	}
+	return buf, rem, err
+}
+
+// Msg returns a MsgTypeReq message that carries the Req.
+func (req Req) Msg() (Msg, error) {
+	data := make([]byte, req.SizeHint())
+	if _, _, err := req.Marshal(data, len(data)); err != nil {
+		return Msg{}, err
+	}
+	return Msg{Version: MsgVersion1, Type: MsgTypeReq, Data: data}, nil
+}
+
+// Resp is the response to a Req with the same ID. If the remote peer failed to
+// handle the Req, the Resp has no data, and the error is the reason.
+type Resp struct {
+	ID    uint64 `json:"id"`
+	Data  []byte `json:"data"`
+	Error string `json:"error"`
+}
+
+// SizeHint returns the number of bytes required to represent a Resp in binary.
+func (resp Resp) SizeHint() int {
+	return surge.SizeHintU64 + surge.SizeHintBytes(resp.Data) + surge.SizeHintString(resp.Error)
+}
+
+// Marshal a Resp to binary.
+func (resp Resp) Marshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := surge.MarshalU64(resp.ID, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal id: %v", err)
+	}
+	buf, rem, err = surge.MarshalBytes(resp.Data, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal data: %v", err)
+	}
+	buf, rem, err = surge.MarshalString(resp.Error, buf, rem)
+	if err != nil {
+		return buf, rem, fmt.Errorf("marshal error: %v", err)
+	}
+	return buf, rem, err
+}
+
+// Unmarshal a Resp from binary.
+func (resp *Resp) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
+	buf, rem, err := surge.UnmarshalU64(&resp.ID, buf, rem)
+	if err != nil {
+		return buf, rem, unmarshalErr("id", err)
+	}
+	buf, rem, err = unmarshalBytes(&resp.Data, buf, rem, false)
+	if err != nil {
+		return buf, rem, unmarshalErr("data", err)
+	}
+	reason := []byte{}
+	buf, rem, err = unmarshalBytes(&reason, buf, rem, true)
+	if err != nil {
+		return buf, rem, unmarshalErr("error", err)
+	}
+	resp.Error = string(reason)
+	return buf, rem, err
+}
+
+// Msg returns a MsgTypeResp message that carries the Resp.
+func (resp Resp) Msg() (Msg, error) {
+	data := make([]byte, resp.SizeHint())
+	if _, _, err := resp.Marshal(data, len(data)); err != nil {
+		return Msg{}, err
+	}
+	return Msg{Version: MsgVersion1, Type: MsgTypeResp, Data: data}, nil
+}
@@ -0,0 +1,91 @@
+package wire
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/renproject/id"
+	"github.com/renproject/surge"
+)
+
+// HeaderTypeSignature is the Header type of the signature of a Msg (see
+// Msg.Sign).
+const HeaderTypeSignature = uint16(2)
+
+// signingPrefix separates the hashes that are signed for Msgs from all other
+// hashes that are signed using the same identity key.
+var signingPrefix = []byte("aw/msg/signature")
+
+// ErrUnsigned is returned when a Msg that has no signature is verified.
+var ErrUnsigned = errors.New("unsigned")
+
+// A Signer signs digests on behalf of an identity, without exposing its
+// private key (see handshake.Signer). An *id.PrivKey is a Signer.
+type Signer interface {
+	// Sign a 32 byte digest, returning a recoverable secp256k1 signature.
+	Sign(digest *id.Hash) (id.Signature, error)
+}
+
+// SigningHash returns the hash that is signed by the sender of a Msg. It
+// covers the type, recipient, and data of the Msg, but not its version,
+// stream, compression, or Headers, because these can be changed by the peers
+// that relay the Msg (for example, when a relay negotiates a different
+// version, or decrements the Hops).
+func (msg Msg) SigningHash() id.Hash {
+	// The buffer is exactly large enough, so marshaling cannot fail.
+	buf := make([]byte, len(signingPrefix)+surge.SizeHintU16+id.SizeHintHash+surge.SizeHintBytes(msg.Data))
+	n := copy(buf, signingPrefix)
+	tail, rem, _ := surge.MarshalU16(msg.Type, buf[n:], len(buf)-n)
+	tail, rem, _ = msg.To.Marshal(tail, rem)
+	surge.MarshalBytes(msg.Data, tail, rem)
+	return sha256.Sum256(buf)
+}
+
+// Sign returns a copy of the Msg with a Header that holds the signature of its
+// SigningHash. The signature attributes the Msg to the sender, even when it
+// is received from a peer that relayed it, so it must only be used by the
+// peer that created the Msg. Like all Headers, signatures are only sent to
+// remote peers that use MsgVersion5.
+func (msg Msg) Sign(signer Signer) (Msg, error) {
+	hash := msg.SigningHash()
+	signature, err := signer.Sign(&hash)
+	if err != nil {
+		return msg, fmt.Errorf("signing: %v", err)
+	}
+	return msg.WithHeader(HeaderTypeSignature, signature[:]), nil
+}
+
+// Signatory returns the Signatory that signed the Msg. It returns ErrUnsigned
+// if the Msg has no signature. Any signature of the right size recovers some
+// Signatory, so the Signatory must be compared to the expected sender (see
+// Verify) before it is trusted.
+func (msg Msg) Signatory() (id.Signatory, error) {
+	value, ok := msg.Header(HeaderTypeSignature)
+	if !ok {
+		return id.Signatory{}, ErrUnsigned
+	}
+	if len(value) != id.SizeHintSignature {
+		return id.Signatory{}, fmt.Errorf("bad signature: expected %v bytes, got %v bytes", id.SizeHintSignature, len(value))
+	}
+	signature := id.Signature{}
+	copy(signature[:], value)
+	hash := msg.SigningHash()
+	signatory, err := signature.Signatory(&hash)
+	if err != nil {
+		return id.Signatory{}, fmt.Errorf("bad signature: %v", err)
+	}
+	return signatory, nil
+}
+
+// Verify that the Msg was signed by the Signatory.
+func (msg Msg) Verify(signatory id.Signatory) error {
+	signer, err := msg.Signatory()
+	if err != nil {
+		return err
+	}
+	if !signer.Equal(&signatory) {
+		return fmt.Errorf("bad signature: expected %v, got %v", signatory, signer)
+	}
+	return nil
+}
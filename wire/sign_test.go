@@ -0,0 +1,60 @@
+package wire_test
+
+import (
+	"errors"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signatures", func() {
+	privKey := id.NewPrivKey()
+	msg := wire.Msg{Version: wire.MsgVersion5, Type: wire.MsgTypePush, To: id.NewHash([]byte("subnet")), Data: []byte("content")}
+
+	Context("when a message is signed", func() {
+		It("should be attributed to the signatory", func() {
+			signed, err := msg.Sign(privKey)
+			Expect(err).ToNot(HaveOccurred())
+			signatory, err := signed.Signatory()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signatory).To(Equal(privKey.Signatory()))
+			Expect(signed.Verify(privKey.Signatory())).To(Succeed())
+			Expect(signed.Verify(id.NewPrivKey().Signatory())).ToNot(Succeed())
+		})
+
+		It("should still verify after being relayed", func() {
+			signed, err := msg.Sign(privKey)
+			Expect(err).ToNot(HaveOccurred())
+			relayed, ok := signed.WithHops(wire.Hops{TTL: 2}).Hop()
+			Expect(ok).To(BeTrue())
+			relayed.Stream = 1
+			Expect(relayed.Verify(privKey.Signatory())).To(Succeed())
+
+			// The signature survives being marshaled.
+			buf := make([]byte, relayed.SizeHint())
+			_, _, err = relayed.Marshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			unmarshaled := wire.Msg{}
+			_, _, err = unmarshaled.Unmarshal(buf, len(buf))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmarshaled.Verify(privKey.Signatory())).To(Succeed())
+		})
+
+		It("should not verify if the data is changed", func() {
+			signed, err := msg.Sign(privKey)
+			Expect(err).ToNot(HaveOccurred())
+			signed.Data = []byte("forged")
+			Expect(signed.Verify(privKey.Signatory())).ToNot(Succeed())
+		})
+	})
+
+	Context("when a message is not signed", func() {
+		It("should return ErrUnsigned", func() {
+			_, err := msg.Signatory()
+			Expect(errors.Is(err, wire.ErrUnsigned)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package wire
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/renproject/surge"
+)
+
+// SizeHintTraceContext is the number of bytes required to represent a
+// TraceContext in binary.
+const SizeHintTraceContext = 16 + 8 + 1
+
+// TraceFlagSampled is set in the flags of a TraceContext that is being
+// recorded by its tracer.
+const TraceFlagSampled = uint8(0x01)
+
+// A TraceContext identifies the span of a distributed trace that caused a Msg
+// to be sent, so that the remote peer can continue the trace. Its fields are
+// the same as those of the W3C Trace Context, so that it can be propagated to,
+// and from, tracing systems such as OpenTelemetry (see ParseTraceParent). It
+// is only sent on-the-wire by MsgVersion3 messages.
+type TraceContext struct {
+	TraceID [16]byte `json:"traceId"`
+	SpanID  [8]byte  `json:"spanId"`
+	Flags   uint8    `json:"flags"`
+}
+
+// ParseTraceParent parses a TraceContext from the value of a W3C traceparent
+// header.
+func ParseTraceParent(traceParent string) (TraceContext, error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || parts[0] != "00" {
+		return TraceContext{}, fmt.Errorf("bad traceparent: %q", traceParent)
+	}
+	trace := TraceContext{}
+	flags := [1]byte{}
+	for _, field := range []struct {
+		dst []byte
+		src string
+	}{
+		{trace.TraceID[:], parts[1]},
+		{trace.SpanID[:], parts[2]},
+		{flags[:], parts[3]},
+	} {
+		if hex.DecodedLen(len(field.src)) != len(field.dst) {
+			return TraceContext{}, fmt.Errorf("bad traceparent: %q", traceParent)
+		}
+		if _, err := hex.Decode(field.dst, []byte(field.src)); err != nil {
+			return TraceContext{}, fmt.Errorf("bad traceparent: %v", err)
+		}
+	}
+	trace.Flags = flags[0]
+	if !trace.IsValid() {
+		return TraceContext{}, fmt.Errorf("bad traceparent: %q", traceParent)
+	}
+	return trace, nil
+}
+
+// IsValid returns true if the TraceContext has a trace ID and a span ID. The
+// zero TraceContext is not valid, and means that there is no trace.
+func (trace TraceContext) IsValid() bool {
+	return trace.TraceID != [16]byte{} && trace.SpanID != [8]byte{}
+}
+
+// IsSampled returns true if the span is being recorded by its tracer.
+func (trace TraceContext) IsSampled() bool {
+	return trace.Flags&TraceFlagSampled != 0
+}
+
+// String returns the TraceContext as the value of a W3C traceparent header.
+func (trace TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", trace.TraceID, trace.SpanID, trace.Flags)
+}
+
+// SizeHint returns the number of bytes required to represent a TraceContext in
+// binary.
+func (trace TraceContext) SizeHint() int {
+	return SizeHintTraceContext
+}
+
+// Marshal a TraceContext to binary.
+func (trace TraceContext) Marshal(buf []byte, rem int) ([]byte, int, error) {
+	if len(buf) < SizeHintTraceContext || rem < SizeHintTraceContext {
+		return buf, rem, surge.ErrUnexpectedEndOfBuffer
+	}
+	n := copy(buf, trace.TraceID[:])
+	n += copy(buf[n:], trace.SpanID[:])
+	buf[n] = trace.Flags
+	return buf[SizeHintTraceContext:], rem - SizeHintTraceContext, nil
+}
+
+// Unmarshal a TraceContext from binary.
+func (trace *TraceContext) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
+	if len(buf) < SizeHintTraceContext || rem < SizeHintTraceContext {
+		return buf, rem, ErrTruncated
+	}
+	n := copy(trace.TraceID[:], buf)
+	n += copy(trace.SpanID[:], buf[n:])
+	trace.Flags = buf[n]
+	return buf[SizeHintTraceContext:], rem - SizeHintTraceContext, nil
+}
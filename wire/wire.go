@@ -1,6 +1,7 @@
 package wire
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"net"
 
@@ -12,6 +13,20 @@ import (
 // Enumerate all valid MsgVersion values.
 const (
 	MsgVersion1 = uint16(1)
+
+	// MsgVersion2 messages include a stream ID in their header, so that many
+	// independent flows of messages can share one network connection.
+	MsgVersion2 = uint16(2)
+	// MsgVersion3 messages also include a TraceContext in their header, so
+	// that traces can follow messages between peers.
+	MsgVersion3 = uint16(3)
+	// MsgVersion4 messages also include the Compression of their data in
+	// their header.
+	MsgVersion4 = uint16(4)
+	// MsgVersion5 messages also include a list of type-length-value Headers,
+	// so that new information can be attached to messages without defining
+	// new versions.
+	MsgVersion5 = uint16(5)
 )
 
 // Enumerate all valid MsgType values.
@@ -22,16 +37,164 @@ const (
 	MsgTypeSend    = uint16(4)
 	MsgTypePing    = uint16(5)
 	MsgTypePingAck = uint16(6)
+
+	// MsgTypeKeepAlive messages are written by Channels to idle network
+	// connections. They are dropped by the receiving Channel, and are never
+	// seen by applications.
+	MsgTypeKeepAlive = uint16(7)
+
+	// MsgTypeAddressUpdate messages are pushed by peers to their connected
+	// peers when their network address changes. The data is a signed Address.
+	MsgTypeAddressUpdate = uint16(8)
+
+	// MsgTypeNonce messages are written by Channels immediately before
+	// messages that are delivered at least once. The data is the 8 byte
+	// big-endian nonce of the next message, which is used by the receiving
+	// Channel to drop messages that it has already received. They are never
+	// seen by applications.
+	MsgTypeNonce = uint16(9)
+
+	// MsgTypeMaintenance messages are pushed by peers to their connected
+	// peers before a planned restart. The data is the 8 byte big-endian
+	// duration, in milliseconds, of the maintenance window during which the
+	// peer is expected to be briefly unavailable.
+	MsgTypeMaintenance = uint16(10)
+
+	// MsgTypeGoingAway messages are sent by peers to their connected peers
+	// when they are draining, before closing their network connections, in
+	// which case they have no data. They can also be sent ahead of draining,
+	// in which case the data is the 8 byte big-endian duration, in
+	// milliseconds, until the peer expects to begin draining, followed by the
+	// reason.
+	MsgTypeGoingAway = uint16(11)
+
+	// MsgTypeRecentContent messages are sent by peers that are catching up
+	// after a restart, to ask for the content IDs that were recently gossiped.
+	// They have no data.
+	MsgTypeRecentContent = uint16(12)
+
+	// MsgTypeRecentContentAck messages are sent in response to
+	// MsgTypeRecentContent messages. The data is the list of content IDs that
+	// were recently gossiped, most recent first.
+	MsgTypeRecentContentAck = uint16(13)
+
+	// MsgTypeRekey messages are written by Channels to tell the receiving
+	// Channel that all later messages are encrypted with the next key of the
+	// session (see codec.RekeyEncoder). They are never seen by applications.
+	MsgTypeRekey = uint16(14)
+
+	// MsgTypeFragment messages are written by Channels instead of messages
+	// that are larger than the maximum message size. The data is a fragment
+	// header followed by part of the marshaled message (see Fragment). They
+	// are reassembled by the receiving Channel, and are never seen by
+	// applications. Channels only fragment MsgVersion4 (or later) messages,
+	// because older peers cannot reassemble them.
+	MsgTypeFragment = uint16(15)
+
+	// MsgTypeReq messages are requests that expect a response from the remote
+	// peer. The data is a marshaled Req.
+	MsgTypeReq = uint16(16)
+
+	// MsgTypeResp messages are sent in response to MsgTypeReq messages. The
+	// data is a marshaled Resp, with the same ID as the Req.
+	MsgTypeResp = uint16(17)
+
+	// MsgTypeBatch messages are written by Channels to carry many messages in
+	// one frame (see Batch). They are unbatched by the receiving Channel, and
+	// are never seen by applications.
+	MsgTypeBatch = uint16(18)
+
+	// MsgTypeAddressesUpdate messages are pushed by peers to their connected
+	// peers when their network addresses change, and they have more than one
+	// network address. The data is a list of signed Addresses with equal
+	// nonces, in order of priority (see VerifyAddresses).
+	MsgTypeAddressesUpdate = uint16(19)
 )
 
+// Outcome of sending a Msg.
+type Outcome uint8
+
+// Enumerate all Outcome values.
+const (
+	// OutcomeWritten means that the Msg was written to a network connection.
+	// It does not mean that the Msg was processed by the remote peer.
+	OutcomeWritten = Outcome(1)
+	// OutcomeDropped means that the Msg was rejected before being queued (for
+	// example, because the outbound queue was full, or because of rate
+	// limiting), or that it could not be marshaled.
+	OutcomeDropped = Outcome(2)
+	// OutcomeExpired means that the context, or timeout, used when sending
+	// the Msg was done before the Msg could be queued.
+	OutcomeExpired = Outcome(3)
+	// OutcomePersisted means that the Channel to the remote peer stopped
+	// before the Msg was written, and the Msg was persisted so that it can be
+	// written by the next Channel to the remote peer.
+	OutcomePersisted = Outcome(4)
+	// OutcomeLost means that the Channel to the remote peer stopped (for
+	// example, because it was killed, or because its network connection died
+	// and it was unbound) before the Msg was written, and the Msg was not
+	// persisted.
+	OutcomeLost = Outcome(5)
+)
+
+// String returns a human-readable representation of the Outcome.
+func (outcome Outcome) String() string {
+	switch outcome {
+	case OutcomeWritten:
+		return "written"
+	case OutcomeDropped:
+		return "dropped"
+	case OutcomeExpired:
+		return "expired"
+	case OutcomePersisted:
+		return "persisted"
+	case OutcomeLost:
+		return "lost"
+	default:
+		return "unknown"
+	}
+}
+
 // Msg defines the low-level message structure that is sent on-the-wire between
 // peers.
 type Msg struct {
 	Version  uint16  `json:"version"`
 	Type     uint16  `json:"type"`
+	Stream   uint16  `json:"stream"`
 	To       id.Hash `json:"to"`
 	Data     []byte  `json:"data"`
 	SyncData []byte  `json:"syncData"`
+
+	// Trace is the TraceContext of the span that caused the Msg to be sent.
+	// It is only sent on-the-wire by MsgVersion3 messages, and is otherwise
+	// dropped.
+	Trace TraceContext `json:"trace"`
+
+	// Compression of the data of the Msg. It is only sent on-the-wire by
+	// MsgVersion4 messages, so the data of older messages must not be
+	// compressed (see Compress).
+	Compression Compression `json:"compression"`
+
+	// Headers are extensions of the header of the Msg (see Header). They are
+	// only sent on-the-wire by MsgVersion5 messages, and are otherwise
+	// dropped.
+	Headers []Header `json:"headers"`
+}
+
+// Hash returns the SHA-256 hash of the version, type, and data of the Msg. It
+// identifies the content of the Msg, so it is the same for Msgs that only
+// differ in their stream, recipient, trace, or headers. The data is hashed
+// as it is, so the hash of a compressed Msg is different from the hash of the
+// same Msg before it was compressed (Channels decompress messages before they
+// are received).
+func (msg Msg) Hash() id.Hash {
+	// The buffer is exactly large enough, so marshaling cannot fail.
+	buf := make([]byte, surge.SizeHintU16+surge.SizeHintU16+surge.SizeHintBytes(msg.Data))
+	rem := len(buf)
+	tail, rem, _ := surge.MarshalU16(msg.Version, buf, rem)
+	tail, rem, _ = surge.MarshalU16(msg.Type, tail, rem)
+	surge.MarshalBytes(msg.Data, tail, rem)
+	return sha256.Sum256(buf)
 }
 
 // Packet defines a struct that captures the incoming message and the corresponding IP address
@@ -42,10 +205,23 @@ type Packet struct {
 
 // SizeHint returns the number of bytes required to represent a Msg in binary.
 func (msg Msg) SizeHint() int {
-	return surge.SizeHintU16 +
+	size := surge.SizeHintU16 +
 		surge.SizeHintU16 +
 		id.SizeHintHash +
 		surge.SizeHintBytes(msg.Data)
+	if msg.Version >= MsgVersion2 {
+		size += surge.SizeHintU16
+	}
+	if msg.Version >= MsgVersion3 {
+		size += SizeHintTraceContext
+	}
+	if msg.Version >= MsgVersion4 {
+		size += surge.SizeHintU8
+	}
+	if msg.Version >= MsgVersion5 {
+		size += sizeHintHeaders(msg.Headers)
+	}
+	return size
 }
 
 // Marshal a Msg to binary.
@@ -58,6 +234,30 @@ func (msg Msg) Marshal(buf []byte, rem int) ([]byte, int, error) {
 	if err != nil {
 		return buf, rem, fmt.Errorf("marshal type: %v", err)
 	}
+	if msg.Version >= MsgVersion2 {
+		buf, rem, err = surge.MarshalU16(msg.Stream, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal stream: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion3 {
+		buf, rem, err = msg.Trace.Marshal(buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal trace: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion4 {
+		buf, rem, err = surge.MarshalU8(uint8(msg.Compression), buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal compression: %v", err)
+		}
+	}
+	if msg.Version >= MsgVersion5 {
+		buf, rem, err = marshalHeaders(msg.Headers, buf, rem)
+		if err != nil {
+			return buf, rem, fmt.Errorf("marshal headers: %v", err)
+		}
+	}
 	buf, rem, err = surge.Marshal(msg.To, buf, rem)
 	if err != nil {
 		return buf, rem, fmt.Errorf("marshal to: %v", err)
@@ -71,21 +271,99 @@ func (msg Msg) Marshal(buf []byte, rem int) ([]byte, int, error) {
 
 // Unmarshal a Msg from binary.
 func (msg *Msg) Unmarshal(buf []byte, rem int) ([]byte, int, error) {
+	return msg.unmarshal(buf, rem, false)
+}
+
+// UnmarshalBorrowed is the same as Unmarshal, except that the data of the Msg
+// is not copied. Instead, it refers to the buffer, and is only valid for as long
+// as the buffer is not modified.
+func (msg *Msg) UnmarshalBorrowed(buf []byte, rem int) ([]byte, int, error) {
+	return msg.unmarshal(buf, rem, true)
+}
+
+func (msg *Msg) unmarshal(buf []byte, rem int, borrow bool) ([]byte, int, error) {
 	buf, rem, err := surge.UnmarshalU16(&msg.Version, buf, rem)
 	if err != nil {
-		return buf, rem, fmt.Errorf("unmarshal version: %v", err)
+		return buf, rem, unmarshalErr("version", err)
+	}
+	if msg.Version > MsgVersion5 {
+		return buf, rem, unmarshalErr("version", fmt.Errorf("%w: %v", ErrBadVersion, msg.Version))
 	}
 	buf, rem, err = surge.UnmarshalU16(&msg.Type, buf, rem)
 	if err != nil {
-		return buf, rem, fmt.Errorf("unmarshal type: %v", err)
+		return buf, rem, unmarshalErr("type", err)
+	}
+	if msg.Version >= MsgVersion2 {
+		buf, rem, err = surge.UnmarshalU16(&msg.Stream, buf, rem)
+		if err != nil {
+			return buf, rem, unmarshalErr("stream", err)
+		}
+	}
+	if msg.Version >= MsgVersion3 {
+		buf, rem, err = msg.Trace.Unmarshal(buf, rem)
+		if err != nil {
+			return buf, rem, unmarshalErr("trace", err)
+		}
+	}
+	if msg.Version >= MsgVersion4 {
+		buf, rem, err = surge.UnmarshalU8((*uint8)(&msg.Compression), buf, rem)
+		if err != nil {
+			return buf, rem, unmarshalErr("compression", err)
+		}
+	}
+	if msg.Version >= MsgVersion5 {
+		buf, rem, err = unmarshalHeaders(&msg.Headers, buf, rem)
+		if err != nil {
+			return buf, rem, unmarshalErr("headers", err)
+		}
 	}
 	buf, rem, err = surge.Unmarshal(&msg.To, buf, rem)
 	if err != nil {
-		return buf, rem, fmt.Errorf("unmarshal to: %v", err)
+		return buf, rem, unmarshalErr("to", err)
 	}
-	buf, rem, err = surge.Unmarshal(&msg.Data, buf, rem)
+	buf, rem, err = unmarshalBytes(&msg.Data, buf, rem, borrow)
 	if err != nil {
-		return buf, rem, fmt.Errorf("unmarshal data: %v", err)
+		return buf, rem, unmarshalErr("data", err)
 	}
-	return buf, rem, err
+	return buf, rem, nil
+}
+
+// unmarshalLen unmarshals the length of a byte slice. The length is checked
+// against surge.MaxBytes, the remaining buffer, and the remaining number of
+// bytes that can be allocated, in that order.
+func unmarshalLen(dst *uint32, buf []byte, rem int) ([]byte, int, error) {
+	n := uint32(0)
+	buf, rem, err := surge.UnmarshalU32(&n, buf, rem)
+	if err != nil {
+		return buf, rem, ErrTruncated
+	}
+	if uint64(n) > uint64(surge.MaxBytes) {
+		return buf, rem, fmt.Errorf("%w: %v bytes", ErrTooLarge, n)
+	}
+	if uint64(n) > uint64(len(buf)) {
+		return buf, rem, fmt.Errorf("%w: expected %v bytes, got %v bytes", ErrTruncated, n, len(buf))
+	}
+	if int64(n) > int64(rem) {
+		return buf, rem, fmt.Errorf("%w: %v bytes", ErrTooLarge, n)
+	}
+	*dst = n
+	return buf, rem, nil
+}
+
+// unmarshalBytes unmarshals a length-prefixed byte slice, using the strict
+// bounds of unmarshalLen. If the slice is borrowed, it refers to the buffer,
+// instead of being copied.
+func unmarshalBytes(dst *[]byte, buf []byte, rem int, borrow bool) ([]byte, int, error) {
+	n := uint32(0)
+	buf, rem, err := unmarshalLen(&n, buf, rem)
+	if err != nil {
+		return buf, rem, err
+	}
+	if borrow {
+		*dst = buf[:n:n]
+	} else {
+		*dst = make([]byte, n)
+		copy(*dst, buf)
+	}
+	return buf[n:], rem - int(n), nil
 }
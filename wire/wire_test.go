@@ -1 +1,119 @@
 package wire_test
+
+import (
+	"encoding/hex"
+
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/id"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Msg", func() {
+	roundTrip := func(msg wire.Msg) wire.Msg {
+		buf := make([]byte, msg.SizeHint())
+		_, rem, err := msg.Marshal(buf, len(buf))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rem).To(Equal(0))
+
+		unmarshaled := wire.Msg{}
+		_, _, err = unmarshaled.Unmarshal(buf, len(buf))
+		Expect(err).ToNot(HaveOccurred())
+		return unmarshaled
+	}
+
+	Context("when marshaling a version 4 message", func() {
+		It("should include the compression", func() {
+			msg := wire.Msg{Version: wire.MsgVersion4, Type: wire.MsgTypeSend, Stream: 42, Data: []byte("hello"), Compression: wire.CompressionFlate}
+			Expect(roundTrip(msg)).To(Equal(msg))
+		})
+	})
+
+	Context("when marshaling a version 3 message", func() {
+		It("should include the stream and the trace", func() {
+			trace, err := wire.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(trace.IsSampled()).To(BeTrue())
+			Expect(trace.String()).To(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+
+			msg := wire.Msg{Version: wire.MsgVersion3, Type: wire.MsgTypeSend, Stream: 42, Data: []byte("hello"), Trace: trace}
+			Expect(roundTrip(msg)).To(Equal(msg))
+		})
+	})
+
+	Context("when marshaling a version 2 message", func() {
+		It("should include the stream", func() {
+			msg := wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, Stream: 42, Data: []byte("hello")}
+			Expect(roundTrip(msg)).To(Equal(msg))
+		})
+
+		It("should not include the trace", func() {
+			trace, err := wire.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			Expect(err).ToNot(HaveOccurred())
+			msg := wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypeSend, Data: []byte("hello"), Trace: trace}
+			Expect(roundTrip(msg).Trace.IsValid()).To(BeFalse())
+		})
+	})
+
+	Context("when marshaling a version 1 message", func() {
+		It("should not include the stream", func() {
+			msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Stream: 42, Data: []byte("hello")}
+			Expect(msg.SizeHint()).To(Equal(wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}.SizeHint()))
+
+			unmarshaled := roundTrip(msg)
+			Expect(unmarshaled.Stream).To(Equal(uint16(0)))
+			Expect(unmarshaled.Data).To(Equal(msg.Data))
+		})
+	})
+})
+
+var _ = Describe("Req and Resp", func() {
+	It("should marshal and unmarshal", func() {
+		req := wire.Req{ID: 42, Data: []byte("hello")}
+		msg, err := req.Msg()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(msg.Type).To(Equal(wire.MsgTypeReq))
+		unmarshaledReq := wire.Req{}
+		_, _, err = unmarshaledReq.Unmarshal(msg.Data, len(msg.Data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unmarshaledReq).To(Equal(req))
+
+		resp := wire.Resp{ID: 42, Data: []byte{}, Error: "failed"}
+		msg, err = resp.Msg()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(msg.Type).To(Equal(wire.MsgTypeResp))
+		unmarshaledResp := wire.Resp{}
+		_, _, err = unmarshaledResp.Unmarshal(msg.Data, len(msg.Data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unmarshaledResp).To(Equal(resp))
+	})
+})
+
+var _ = Describe("Msg hash", func() {
+	It("should only depend on the version, type, and data", func() {
+		msg := wire.Msg{Version: wire.MsgVersion2, Type: wire.MsgTypePush, Data: []byte("hello")}
+		Expect(msg.Hash()).To(Equal(msg.Hash()))
+
+		other := msg
+		other.Stream = 42
+		other.To = id.Hash{1}
+		Expect(other.Hash()).To(Equal(msg.Hash()))
+
+		other = msg
+		other.Version = wire.MsgVersion1
+		Expect(other.Hash()).ToNot(Equal(msg.Hash()))
+		other = msg
+		other.Type = wire.MsgTypeSend
+		Expect(other.Hash()).ToNot(Equal(msg.Hash()))
+		other = msg
+		other.Data = []byte("hellp")
+		Expect(other.Hash()).ToNot(Equal(msg.Hash()))
+	})
+
+	It("should not change between releases", func() {
+		msg := wire.Msg{Version: wire.MsgVersion1, Type: wire.MsgTypeSend, Data: []byte("hello")}
+		hash := msg.Hash()
+		Expect(hex.EncodeToString(hash[:])).To(Equal("d2bce78c453b1f6bcd01936a45aa99ea7be9b77d5b0d42970732d45532b71f6a"))
+	})
+})
@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+var (
+	DefaultPath          = "/aw"
+	DefaultOrigin        = "http://localhost/"
+	DefaultAcceptBacklog = 64
+	DefaultReadTimeout   = 10 * time.Second
+)
+
+// Options for network connections over WebSocket.
+type Options struct {
+	Path          string
+	Origin        string
+	TLSConfig     *tls.Config
+	AcceptBacklog int
+	ReadTimeout   time.Duration
+}
+
+// DefaultOptions returns Options with sensible defaults.
+func DefaultOptions() Options {
+	return Options{
+		Path:          DefaultPath,
+		Origin:        DefaultOrigin,
+		TLSConfig:     nil,
+		AcceptBacklog: DefaultAcceptBacklog,
+		ReadTimeout:   DefaultReadTimeout,
+	}
+}
+
+// WithPath sets the path of the URL at which the Listener is mounted, and to
+// which network connections are dialed.
+func (opts Options) WithPath(path string) Options {
+	opts.Path = path
+	return opts
+}
+
+// WithOrigin sets the origin sent when dialing. Listeners do not check the
+// origin, because remote peers are authenticated by the handshake instead.
+func (opts Options) WithOrigin(origin string) Options {
+	opts.Origin = origin
+	return opts
+}
+
+// WithTLSConfig sets the TLS configuration used when dialing, in which case
+// network connections are dialed using "wss" instead of "ws". Listeners
+// mounted on an HTTPS server (or behind a proxy that terminates TLS) do not
+// need any configuration. By default, TLS is not used.
+func (opts Options) WithTLSConfig(config *tls.Config) Options {
+	opts.TLSConfig = config
+	return opts
+}
+
+// WithAcceptBacklog sets the number of network connections that can be
+// waiting to be accepted. Network connections upgraded while the backlog is
+// full are closed.
+func (opts Options) WithAcceptBacklog(backlog int) Options {
+	opts.AcceptBacklog = backlog
+	return opts
+}
+
+// WithReadTimeout sets the timeout for reading the HTTP request of network
+// connections accepted by Listen. It does not apply to Listeners mounted on
+// an existing server.
+func (opts Options) WithReadTimeout(timeout time.Duration) Options {
+	opts.ReadTimeout = timeout
+	return opts
+}
@@ -0,0 +1,266 @@
+// Package ws implements network connections over WebSocket that can be used
+// wherever network connections over TCP are used (for example, by handshakes,
+// and Channels). Bytes are written in binary frames, so the handshake, and
+// everything after it, is unchanged. This allows peers that can only make
+// HTTP(S) connections (for example, light clients behind firewalls that only
+// allow outbound connections to port 443) to participate.
+//
+// A Listener is an http.Handler, so it can be mounted on an existing
+// http.ServeMux, and it is also a net.Listener, so it can be given to a
+// Transport (see transport.Options.WithListener).
+//
+//	listener := ws.NewListener(ws.DefaultOptions())
+//	mux.Handle(ws.DefaultPath, listener)
+//	t := transport.New(transport.DefaultOptions().WithListener(listener).WithDialer(ws.Dialer(ws.DefaultOptions()), wire.WebSocket), self, client, h, table)
+//
+// Listen and Dial mirror the functions of the tcp package.
+package ws
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/renproject/aw/policy"
+	"github.com/renproject/aw/tcp"
+	"golang.org/x/net/websocket"
+)
+
+// Listen for network connections from remote peers until the context is done
+// (see tcp.Listen). An HTTP server is started on the address, and the
+// Listener is mounted at the DefaultPath.
+func Listen(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), allow policy.Allow) error {
+	opts := DefaultOptions()
+	netListener, err := new(net.ListenConfig).Listen(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	listener := NewListener(opts)
+	listener.addr = netListener.Addr()
+
+	mux := http.NewServeMux()
+	mux.Handle(opts.Path, listener)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: opts.ReadTimeout}
+	go server.Serve(netListener)
+	defer server.Close()
+
+	return tcp.ListenWithListener(ctx, listener, handle, handleErr, allow)
+}
+
+// Dial a remote peer until a network connection is established, or until the
+// context is done (see tcp.Dial).
+func Dial(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration) error {
+	return DialWithBackoff(ctx, address, handle, handleErr, timeout, nil)
+}
+
+// DialWithBackoff is the same as Dial, but waits between failed dial attempts
+// (see tcp.DialWithBackoff).
+func DialWithBackoff(ctx context.Context, address string, handle func(net.Conn), handleErr func(error), timeout func(int) time.Duration, backoff func(int) time.Duration) error {
+	return tcp.DialUsing(ctx, Dialer(DefaultOptions()), address, handle, handleErr, timeout, backoff)
+}
+
+// Dialer returns a tcp.DialFunc that dials network connections over
+// WebSocket, regardless of the network that it is given. The address is the
+// host and port of the HTTP server on which the remote Listener is mounted.
+func Dialer(opts Options) tcp.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		scheme := "ws"
+		if opts.TLSConfig != nil {
+			scheme = "wss"
+		}
+		config, err := websocket.NewConfig(fmt.Sprintf("%v://%v%v", scheme, address, opts.Path), opts.Origin)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := new(net.Dialer).DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		if opts.TLSConfig != nil {
+			tlsConfig := opts.TLSConfig.Clone()
+			if tlsConfig.ServerName == "" {
+				tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		wsConn, err := websocket.NewClient(config, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return newConn(wsConn, conn.LocalAddr(), conn.RemoteAddr()), nil
+	}
+}
+
+// A Listener accepts network connections over WebSocket from the HTTP
+// requests that it serves. It implements the http.Handler and net.Listener
+// interfaces. Closing the Listener does not close the network connections that
+// it has already accepted.
+type Listener struct {
+	opts   Options
+	addr   net.Addr
+	server websocket.Server
+
+	accept    chan *Conn
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// NewListener returns a Listener that accepts network connections once it is
+// mounted on an HTTP server.
+func NewListener(opts Options) *Listener {
+	listener := &Listener{
+		opts: opts,
+		addr: Addr(opts.Path),
+
+		accept:    make(chan *Conn, opts.AcceptBacklog),
+		closed:    make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+	// The origin is not checked, because browsers are not the only clients,
+	// and remote peers are authenticated by the handshake.
+	listener.server = websocket.Server{Handler: listener.handle}
+	return listener
+}
+
+// ServeHTTP upgrades the HTTP request to a network connection over WebSocket,
+// and waits until it has been accepted and closed.
+func (listener *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-listener.closed:
+		http.Error(w, "listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	listener.server.ServeHTTP(w, r)
+}
+
+// Accept the next network connection.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	case conn := <-listener.accept:
+		return conn, nil
+	}
+}
+
+// Close the Listener. HTTP requests that are served after closing are
+// rejected.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.closed) })
+	return nil
+}
+
+// Addr returns the address of the HTTP server on which the Listener is
+// listening, if it was started by Listen, or otherwise the path at which it is
+// mounted.
+func (listener *Listener) Addr() net.Addr {
+	return listener.addr
+}
+
+func (listener *Listener) handle(wsConn *websocket.Conn) {
+	r := wsConn.Request()
+	var local net.Addr
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		local = addr
+	} else {
+		local = listener.addr
+	}
+	var remote net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	} else {
+		remote = wsConn.RemoteAddr()
+	}
+
+	// The HTTP server might have set deadlines for reading the request.
+	wsConn.SetDeadline(time.Time{})
+
+	conn := newConn(wsConn, local, remote)
+	select {
+	case <-listener.closed:
+		return
+	case listener.accept <- conn:
+	default:
+		// The backlog is full, so the remote peer will dial again.
+		return
+	}
+	// The HTTP server closes the network connection once the handler
+	// returns.
+	<-conn.done
+}
+
+// Conn is a network connection over WebSocket. Every write is sent in its own
+// binary frame. It implements the net.Conn interface, and its addresses are
+// those of the underlying network connection (instead of the URLs used by
+// WebSocket).
+type Conn struct {
+	*websocket.Conn
+
+	local  net.Addr
+	remote net.Addr
+
+	done      chan struct{}
+	closeOnce *sync.Once
+	closeErr  error
+}
+
+func newConn(wsConn *websocket.Conn, local, remote net.Addr) *Conn {
+	wsConn.PayloadType = websocket.BinaryFrame
+	return &Conn{
+		Conn: wsConn,
+
+		local:  local,
+		remote: remote,
+
+		done:      make(chan struct{}),
+		closeOnce: new(sync.Once),
+	}
+}
+
+// Close the network connection.
+func (conn *Conn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.closeErr = conn.Conn.Close()
+		close(conn.done)
+	})
+	return conn.closeErr
+}
+
+// LocalAddr implements the net.Conn interface.
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+// Addr is the path at which a Listener is mounted.
+type Addr string
+
+// Network implements the net.Addr interface.
+func (addr Addr) Network() string {
+	return "ws"
+}
+
+// String implements the net.Addr interface.
+func (addr Addr) String() string {
+	return string(addr)
+}
@@ -0,0 +1,13 @@
+package ws_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestWS(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "WS Suite")
+}
@@ -0,0 +1,161 @@
+package ws_test
+
+import (
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/renproject/aw/channel"
+	"github.com/renproject/aw/codec"
+	"github.com/renproject/aw/dht"
+	"github.com/renproject/aw/handshake"
+	"github.com/renproject/aw/transport"
+	"github.com/renproject/aw/wire"
+	"github.com/renproject/aw/ws"
+	"github.com/renproject/id"
+	"go.uber.org/zap"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WebSocket", func() {
+	// serve a Listener mounted on a mux alongside another handler.
+	serve := func(opts ws.Options) (*ws.Listener, *httptest.Server) {
+		listener := ws.NewListener(opts)
+		mux := http.NewServeMux()
+		mux.Handle(opts.Path, listener)
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		return listener, httptest.NewServer(mux)
+	}
+
+	Context("when mounted on a mux", func() {
+		It("should read the bytes that were written, in order", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			listener, server := serve(ws.DefaultOptions())
+			defer server.Close()
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+
+			conn, err := ws.Dialer(ws.DefaultOptions())(ctx, "tcp", server.Listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.RemoteAddr().String()).To(Equal(server.Listener.Addr().String()))
+
+			data := make([]byte, 1024*1024)
+			rand.Read(data)
+			go func() {
+				defer GinkgoRecover()
+				_, err := conn.Write(data)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+			echoed := make([]byte, len(data))
+			_, err = io.ReadFull(conn, echoed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(echoed).To(Equal(data))
+
+			resp, err := http.Get(server.URL + "/health")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal("ok"))
+		})
+
+		It("should reject requests once closed", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			listener, server := serve(ws.DefaultOptions())
+			defer server.Close()
+			Expect(listener.Close()).To(Succeed())
+
+			_, err := ws.Dialer(ws.DefaultOptions())(ctx, "tcp", server.Listener.Addr().String())
+			Expect(err).To(HaveOccurred())
+			_, err = listener.Accept()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when listening and dialing", func() {
+		It("should complete a handshake", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			server := id.NewPrivKey()
+			client := id.NewPrivKey()
+			handshakes := make(chan id.Signatory, 1)
+			go ws.Listen(ctx, "127.0.0.1:13446", func(conn net.Conn) {
+				_, _, remote, err := handshake.ECIES(server)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				handshakes <- remote
+			}, nil, nil)
+
+			err := ws.Dial(ctx, "127.0.0.1:13446", func(conn net.Conn) {
+				_, _, remote, err := handshake.ECIES(client)(conn, codec.PlainEncoder, codec.PlainDecoder)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(remote).To(Equal(server.Signatory()))
+			}, nil, func(int) time.Duration { return time.Second })
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(handshakes, 5*time.Second).Should(Receive(Equal(client.Signatory())))
+		})
+	})
+
+	Context("when used by a Transport", func() {
+		It("should send messages", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			listener, server := serve(ws.DefaultOptions())
+			defer server.Close()
+
+			privKey1 := id.NewPrivKey()
+			t1 := transport.New(
+				transport.DefaultOptions().
+					WithLogger(zap.NewNop()).
+					WithDialer(ws.Dialer(ws.DefaultOptions()), wire.WebSocket),
+				privKey1.Signatory(),
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), privKey1.Signatory()),
+				handshake.ECIES(privKey1),
+				dht.NewInMemTable(privKey1.Signatory()),
+			)
+			privKey2 := id.NewPrivKey()
+			t2 := transport.New(
+				transport.DefaultOptions().
+					WithLogger(zap.NewNop()).
+					WithListener(listener),
+				privKey2.Signatory(),
+				channel.NewClient(channel.DefaultOptions().WithLogger(zap.NewNop()), privKey2.Signatory()),
+				handshake.ECIES(privKey2),
+				dht.NewInMemTable(privKey2.Signatory()),
+			)
+			received := make(chan wire.Msg, 1)
+			go t2.Receive(ctx, func(from id.Signatory, packet wire.Packet) error {
+				received <- packet.Msg
+				return nil
+			})
+			go t2.Run(ctx)
+
+			addr := strings.TrimPrefix(server.URL, "http://")
+			t1.Table().AddPeer(t2.Self(), wire.NewUnsignedAddress(wire.WebSocket, addr, uint64(time.Now().UnixNano())))
+			Expect(t1.Send(ctx, t2.Self(), wire.Msg{Data: []byte("hello")})).To(Succeed())
+			Eventually(received, 5*time.Second).Should(Receive(Equal(wire.Msg{Data: []byte("hello")})))
+		})
+	})
+})